@@ -0,0 +1,121 @@
+#!/usr/bin/env python3
+"""Generates pfs.py, the Python client, from spec/api.json.
+
+Run it whenever the spec changes:
+
+    $ python3 clients/python/generate.py spec/api.json > clients/python/pfs.py
+"""
+
+import json
+import re
+import sys
+
+HEADER = '''"""A Python client for pfs, generated from spec/api.json by generate.py.
+
+Don't edit it by hand, change the spec and regenerate it instead.
+
+    c = Client("http://pfs")
+    c.put_file("logs/1", b"hello")
+    c.commit(commit="commit1")
+    c.get_file("logs/1", commit="commit1")  # b"hello"
+"""
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+
+
+class Error(Exception):
+    """Raised when pfs rejects a request."""
+
+    def __init__(self, status, message):
+        Exception.__init__(self, "pfs returned %d: %s" % (status, message))
+        self.status = status
+        self.message = message
+
+
+class Client(object):
+    """Talks to a pfs cluster through its router."""
+
+    def __init__(self, url):
+        self.url = url.rstrip("/")
+
+    def _request(self, method, path, query, body, fmt):
+        url = self.url + urllib.parse.quote(path)
+        query = dict((k, v) for k, v in query.items() if v is not None)
+        if query:
+            url += "?" + urllib.parse.urlencode(query)
+        req = urllib.request.Request(url, data=body, method=method)
+        try:
+            with urllib.request.urlopen(req) as resp:
+                data = resp.read()
+        except urllib.error.HTTPError as e:
+            raise Error(e.code, e.read().decode("utf-8", "replace").strip())
+        if fmt == "json":
+            return json.loads(data.decode("utf-8"))
+        if fmt == "ndjson":
+            return [json.loads(line) for line in data.decode("utf-8").splitlines() if line]
+        if fmt == "text":
+            return data.decode("utf-8")
+        return data
+'''
+
+
+def snake(name):
+    return re.sub(r"([A-Z])", lambda m: "_" + m.group(1).lower(), name)
+
+
+def response_format(op):
+    for status, response in sorted(op["responses"].items()):
+        if not status.startswith("2"):
+            continue
+        if "x-format" in response:
+            return response["x-format"]
+        content = response.get("content", {})
+        if "application/json" in content:
+            return "json"
+        if "text/plain" in content:
+            return "text"
+    return "bytes"
+
+
+def ident(name):
+    # from is a keyword in Python.
+    return name + "_" if name == "from" else name
+
+
+def method(path, verb, op, path_params):
+    params = path_params + op.get("parameters", [])
+    args = ["self"] + [ident(p["name"]) for p in params if p.get("required")]
+    if "requestBody" in op:
+        args.append("body")
+    args += [ident(p["name"]) + "=None" for p in params if not p.get("required")]
+    query = ", ".join('"%s": %s' % (p["name"], ident(p["name"])) for p in params if p["in"] == "query")
+    formatted = '"%s"' % path
+    names = [p["name"] for p in params if p["in"] == "path"]
+    if names:
+        formatted += ".format(%s)" % ", ".join("%s=%s" % (n, n) for n in names)
+    lines = [
+        "",
+        "    def %s(%s):" % (snake(op["operationId"]), ", ".join(args)),
+        '        """%s"""' % op["summary"],
+        "        return self._request(\"%s\", %s, {%s}, %s, \"%s\")" % (
+            verb.upper(), formatted, query, "body" if "requestBody" in op else "None", response_format(op)),
+    ]
+    return "\n".join(lines)
+
+
+def generate(spec):
+    out = [HEADER.rstrip("\n")]
+    for path in sorted(spec["paths"]):
+        item = spec["paths"][path]
+        for verb in ("get", "post", "put", "delete"):
+            if verb in item:
+                out.append(method(path, verb, item[verb], item.get("parameters", [])))
+    return "\n".join(out) + "\n"
+
+
+if __name__ == "__main__":
+    with open(sys.argv[1]) as f:
+        sys.stdout.write(generate(json.load(f)))
@@ -0,0 +1,101 @@
+"""A Python client for pfs, generated from spec/api.json by generate.py.
+
+Don't edit it by hand, change the spec and regenerate it instead.
+
+    c = Client("http://pfs")
+    c.put_file("logs/1", b"hello")
+    c.commit(commit="commit1")
+    c.get_file("logs/1", commit="commit1")  # b"hello"
+"""
+
+import json
+import urllib.error
+import urllib.parse
+import urllib.request
+
+
+class Error(Exception):
+    """Raised when pfs rejects a request."""
+
+    def __init__(self, status, message):
+        Exception.__init__(self, "pfs returned %d: %s" % (status, message))
+        self.status = status
+        self.message = message
+
+
+class Client(object):
+    """Talks to a pfs cluster through its router."""
+
+    def __init__(self, url):
+        self.url = url.rstrip("/")
+
+    def _request(self, method, path, query, body, fmt):
+        url = self.url + urllib.parse.quote(path)
+        query = dict((k, v) for k, v in query.items() if v is not None)
+        if query:
+            url += "?" + urllib.parse.urlencode(query)
+        req = urllib.request.Request(url, data=body, method=method)
+        try:
+            with urllib.request.urlopen(req) as resp:
+                data = resp.read()
+        except urllib.error.HTTPError as e:
+            raise Error(e.code, e.read().decode("utf-8", "replace").strip())
+        if fmt == "json":
+            return json.loads(data.decode("utf-8"))
+        if fmt == "ndjson":
+            return [json.loads(line) for line in data.decode("utf-8").splitlines() if line]
+        if fmt == "text":
+            return data.decode("utf-8")
+        return data
+
+    def list_branches(self):
+        """List branches."""
+        return self._request("GET", "/branch", {}, None, "ndjson")
+
+    def create_branch(self, commit, branch):
+        """Create a branch from a commit."""
+        return self._request("POST", "/branch", {"commit": commit, "branch": branch}, None, "text")
+
+    def list_commits(self, order=None, limit=None, after=None):
+        """List commits, newest first."""
+        return self._request("GET", "/commit", {"order": order, "limit": limit, "after": after}, None, "ndjson")
+
+    def commit(self, branch=None, commit=None):
+        """Commit a branch."""
+        return self._request("POST", "/commit", {"branch": branch, "commit": commit}, None, "json")
+
+    def diff(self, from_=None, to=None):
+        """List the files that changed between two commits, deleted files included."""
+        return self._request("GET", "/diff", {"from": from_, "to": to}, None, "json")
+
+    def get_file(self, file, commit=None, hold=None):
+        """Read a file."""
+        return self._request("GET", "/file/{file}".format(file=file), {"commit": commit, "hold": hold}, None, "bytes")
+
+    def put_file(self, file, body, branch=None):
+        """Write a file."""
+        return self._request("POST", "/file/{file}".format(file=file), {"branch": branch}, body, "text")
+
+    def delete_file(self, file, branch=None):
+        """Delete a file."""
+        return self._request("DELETE", "/file/{file}".format(file=file), {"branch": branch}, None, "text")
+
+    def head(self, branch=None):
+        """Get the commit at the head of a branch, pass it to reads to pin them to the branch as it is now."""
+        return self._request("GET", "/head", {"branch": branch}, None, "json")
+
+    def list_holds(self):
+        """List holds."""
+        return self._request("GET", "/hold", {}, None, "ndjson")
+
+    def hold_commit(self, commit=None, ttl=None, id=None):
+        """Hold a commit, reads with ?hold= see it even if it's deleted until the hold is released or expires."""
+        return self._request("POST", "/hold", {"commit": commit, "ttl": ttl, "id": id}, None, "json")
+
+    def renew_hold(self, id, ttl=None):
+        """Renew a hold."""
+        return self._request("POST", "/hold/{id}".format(id=id), {"ttl": ttl}, None, "json")
+
+    def release_hold(self, id):
+        """Release a hold."""
+        return self._request("DELETE", "/hold/{id}".format(id=id), {}, None, "text")
@@ -0,0 +1,235 @@
+package main
+
+// pfs is a command line interface to a pfs cluster, it talks to the router
+// at $PFS_ADDRESS. Run it with no arguments to see its commands.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/client"
+	"github.com/pachyderm/pfs/lib/s3utils"
+)
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: pfs <command> [<args>]
+
+Commands:
+  put [-b <branch>] <file> [<local file>]  write a file, from stdin if no local file is given
+  get [-c <commit>] <file>                 write a file to stdout
+  commit [-b <branch>] [-n <name>]         commit a branch
+  log                                      list commits, newest first
+  branch [<commit> <branch>]               list branches or create one
+  tag [<commit> <tag>]                     list tags or tag a commit
+  diff <from> [<to>]                       list the files that changed between two commits
+  mount [-c <commit>] [-d <dir>] <local>   copy a commit's files, or those in dir, in to local
+  push [-b <branch>] <local> [<dir>]       write the files in local to dir on a branch
+  remote log s3://<bucket>/<path>          list the commits in an S3 replica, oldest first
+
+The router's address is read from $PFS_ADDRESS, it defaults to http://localhost.
+It can be a comma separated list of routers, requests fail over between them.
+S3 replicas are reached with the same $PFS_S3_* settings as the shards.
+`)
+	os.Exit(2)
+}
+
+// addresses returns the addresses of the routers in $PFS_ADDRESS.
+func addresses() []string {
+	if address := os.Getenv("PFS_ADDRESS"); address != "" {
+		return strings.Split(address, ",")
+	}
+	return []string{"http://localhost"}
+}
+
+func put(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("put", flag.ExitOnError)
+	branch := flags.String("b", "master", "the branch to write to")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usage()
+	}
+	var r io.Reader = os.Stdin
+	if flags.NArg() == 2 {
+		f, err := os.Open(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return c.PutFile(flags.Arg(0), *branch, r)
+}
+
+func get(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	commit := flags.String("c", "master", "the commit or branch to read from")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	f, err := c.GetFile(flags.Arg(0), *commit)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(os.Stdout, f)
+	return err
+}
+
+func commit(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("commit", flag.ExitOnError)
+	branch := flags.String("b", "master", "the branch to commit")
+	name := flags.String("n", "", "the commit's name, a new one is picked by default")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usage()
+	}
+	info, err := c.Commit(*branch, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (%d files changed on %d shards)\n", info.Id, info.Files, info.Shards)
+	return nil
+}
+
+func commitLog(c *client.Client, args []string) error {
+	if len(args) != 0 {
+		usage()
+	}
+	entries, err := c.ListCommits()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s\t%s\t%d shards", entry.Name, entry.TStamp, entry.Shards)
+		if len(entry.Missing) > 0 {
+			fmt.Printf("\tmissing from %v", entry.Missing)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func branch(c *client.Client, args []string) error {
+	switch len(args) {
+	case 0:
+		branches, err := c.ListBranches()
+		if err != nil {
+			return err
+		}
+		for _, branch := range branches {
+			fmt.Printf("%s\t%s\n", branch.Name, branch.TStamp)
+		}
+		return nil
+	case 2:
+		return c.Branch(args[0], args[1])
+	}
+	usage()
+	return nil
+}
+
+func tag(c *client.Client, args []string) error {
+	switch len(args) {
+	case 0:
+		tags, err := c.ListTags()
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			fmt.Printf("%s\t%s\n", tag.Name, tag.Commit)
+		}
+		return nil
+	case 2:
+		return c.Tag(args[0], args[1])
+	}
+	usage()
+	return nil
+}
+
+func diff(c *client.Client, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		usage()
+	}
+	to := "master"
+	if len(args) == 2 {
+		to = args[1]
+	}
+	files, err := c.Diff(args[0], to)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fmt.Println(file)
+	}
+	return nil
+}
+
+// mount copies every file in a commit in to a local directory. It's a copy
+// rather than a live view, run it again to pick up later commits.
+func mount(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	commit := flags.String("c", "master", "the commit or branch to copy")
+	dir := flags.String("d", "", "the directory in the commit to copy, the whole commit if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	return c.PullDir(*dir, *commit, flags.Arg(0))
+}
+
+func push(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	branch := flags.String("b", "master", "the branch to write to")
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		usage()
+	}
+	return c.PushDir(flags.Arg(0), flags.Arg(1), *branch)
+}
+
+// remote inspects replicas directly, without going through the cluster.
+func remote(c *client.Client, args []string) error {
+	if len(args) != 2 || args[0] != "log" || !strings.HasPrefix(args[1], "s3://") {
+		usage()
+	}
+	m, err := btrfs.ReadS3Manifest(args[1], s3utils.BucketOptionsFromEnv())
+	if err != nil {
+		return err
+	}
+	for _, commit := range m.Commits {
+		fmt.Printf("%s\t%s\t%s\t%d\t%s\n", commit.Key, commit.Name, commit.Parent, commit.Size, commit.Time)
+	}
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	commands := map[string]func(*client.Client, []string) error{
+		"put":    put,
+		"get":    get,
+		"commit": commit,
+		"log":    commitLog,
+		"branch": branch,
+		"tag":    tag,
+		"diff":   diff,
+		"mount":  mount,
+		"push":   push,
+		"remote": remote,
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	routers := addresses()
+	if err := command(client.New(routers[0], routers[1:]...), os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+// pfsadmin is a command line interface to the admin endpoints of pfs shards
+// and routers, so that operators can maintain repos without running btrfs on
+// the shards themselves. Run it with no arguments to see its commands.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: pfsadmin [-a <address>] <command> [<args>]
+
+Commands:
+  fsck [-repair]                   check the repos for problems, and repair them with -repair
+  gc [-n] [-grace <duration>]      remove the chunks no file refers to, -n reports what would be removed
+  scrub [start]                    list the last scrubs, or scrub now
+  quota <repo> [<bytes>]           show a repo's usage, or set its quota, 0 removes it
+  freeze <repo>                    make a repo refuse writes and commits
+  thaw <repo>                      undo freeze
+  replica list                     list replication targets and how far behind they are
+  replica add <url>                add a replication target
+  replica remove <id>              remove a replication target
+  replica sync [-pull] <id>        push new commits to a target, or pull them from it
+  reshard [-n] <modulos>           grow the cluster to <modulos> shards, -n counts the files that would move
+  role                             show the shard's role
+  promote                          make the shard the primary for its index
+  demote <upstream>                make the shard a passive follower of the shard at upstream
+
+Commands are sent to -a, which defaults to $PFS_ADMIN_ADDRESS, then to
+http://localhost. Most of them act on a single shard, reshard must be sent
+to a router. Requests are authenticated with the bearer token in
+$PFS_ADMIN_TOKEN, which must belong to an admin.
+`)
+	os.Exit(2)
+}
+
+// admin sends requests to the admin endpoints of a shard or router.
+type admin struct {
+	address string
+	token   string
+}
+
+// do sends a request with body encoded as JSON, nil means there's no body,
+// and writes the response to stdout. JSON responses are indented.
+func (a admin) do(method, p string, query url.Values, body interface{}) error {
+	u := strings.TrimSuffix(a.address, "/") + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %d: %s", method, p, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") != nil {
+		// Not JSON, or a stream of it.
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+func fsck(a admin, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "repair the problems that can be")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usage()
+	}
+	if *repair {
+		return a.do("POST", "/fsck", nil, nil)
+	}
+	return a.do("GET", "/fsck", nil, nil)
+}
+
+func gc(a admin, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "report what would be removed without removing it")
+	grace := flags.Duration("grace", 0, "keep chunks written more recently than this, the shard's default if 0")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		usage()
+	}
+	query := url.Values{}
+	if *grace != 0 {
+		query.Set("grace", grace.String())
+	}
+	if *dryRun {
+		return a.do("GET", "/admin/gc", query, nil)
+	}
+	return a.do("POST", "/admin/gc", query, nil)
+}
+
+func scrub(a admin, args []string) error {
+	switch {
+	case len(args) == 0:
+		return a.do("GET", "/scrub", nil, nil)
+	case len(args) == 1 && args[0] == "start":
+		return a.do("POST", "/scrub", nil, nil)
+	}
+	usage()
+	return nil
+}
+
+func quota(a admin, args []string) error {
+	switch len(args) {
+	case 1:
+		return a.do("GET", "/repo/"+args[0]+"/usage", nil, nil)
+	case 2:
+		limit, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || limit < 0 {
+			return fmt.Errorf("Invalid quota %s.", args[1])
+		}
+		return a.do("POST", "/repo/"+args[0], nil, map[string]int64{"quota": limit})
+	}
+	usage()
+	return nil
+}
+
+func freeze(a admin, args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	return a.do("POST", "/repo/"+args[0], nil, map[string]bool{"frozen": true})
+}
+
+func thaw(a admin, args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	return a.do("POST", "/repo/"+args[0], nil, map[string]bool{"frozen": false})
+}
+
+func replica(a admin, args []string) error {
+	if len(args) == 0 {
+		usage()
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return a.do("GET", "/replica", nil, nil)
+	case args[0] == "add" && len(args) == 2:
+		return a.do("POST", "/replica", nil, map[string]string{"url": args[1]})
+	case args[0] == "remove" && len(args) == 2:
+		return a.do("DELETE", "/replica/"+args[1], nil, nil)
+	case args[0] == "sync":
+		flags := flag.NewFlagSet("replica sync", flag.ExitOnError)
+		pull := flags.Bool("pull", false, "pull new commits from the target rather than pushing them")
+		flags.Parse(args[1:])
+		if flags.NArg() != 1 {
+			usage()
+		}
+		direction := "push"
+		if *pull {
+			direction = "pull"
+		}
+		return a.do("POST", "/replica/"+flags.Arg(0)+"/sync", url.Values{"direction": {direction}}, nil)
+	}
+	usage()
+	return nil
+}
+
+func reshard(a admin, args []string) error {
+	flags := flag.NewFlagSet("reshard", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "count the files that would move without resharding")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	query := url.Values{"modulos": {flags.Arg(0)}}
+	if *dryRun {
+		return a.do("GET", "/reshard", query, nil)
+	}
+	return a.do("POST", "/reshard", query, nil)
+}
+
+func role(a admin, args []string) error {
+	if len(args) != 0 {
+		usage()
+	}
+	return a.do("GET", "/admin/role", nil, nil)
+}
+
+func promote(a admin, args []string) error {
+	if len(args) != 0 {
+		usage()
+	}
+	return a.do("POST", "/admin/promote", nil, nil)
+}
+
+func demote(a admin, args []string) error {
+	if len(args) != 1 {
+		usage()
+	}
+	return a.do("POST", "/admin/demote", url.Values{"upstream": {args[0]}}, nil)
+}
+
+func main() {
+	log.SetFlags(0)
+	address := os.Getenv("PFS_ADMIN_ADDRESS")
+	if address == "" {
+		address = "http://localhost"
+	}
+	flag.StringVar(&address, "a", address, "the address of the shard or router")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	commands := map[string]func(admin, []string) error{
+		"fsck":    fsck,
+		"gc":      gc,
+		"scrub":   scrub,
+		"quota":   quota,
+		"freeze":  freeze,
+		"thaw":    thaw,
+		"replica": replica,
+		"reshard": reshard,
+		"role":    role,
+		"promote": promote,
+		"demote":  demote,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+	}
+	a := admin{address: address, token: os.Getenv("PFS_ADMIN_TOKEN")}
+	if err := command(a, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
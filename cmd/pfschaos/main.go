@@ -0,0 +1,376 @@
+package main
+
+// pfschaos soak tests a running cluster. It writes, commits and reads files
+// through the routers at $PFS_ADDRESS while killing shards with -kill, then
+// waits for the cluster to settle and checks that nothing it was told had
+// succeeded was lost: every acknowledged commit is on every shard with the
+// files acknowledged before it, every acknowledged write reads back, and
+// every shard's replicas catch up. Failed requests while shards are down are
+// expected and only counted, anything that breaks those invariants is a
+// violation and makes pfschaos exit 1.
+//
+//	pfschaos -d 10m -shards http://shard-0,http://shard-1 -kill 'docker restart shard-%d'
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/client"
+)
+
+// ackedCommit is a commit the cluster acknowledged.
+type ackedCommit struct {
+	id string
+	// files is how many writes had been acknowledged when the commit was
+	// sent, they must all be in it.
+	files int
+}
+
+// ledger records what the cluster acknowledged and what went wrong.
+type ledger struct {
+	lock sync.Mutex
+	// files maps the acknowledged writes to their contents, order has
+	// their names in the order they were acknowledged.
+	files      map[string]string
+	order      []string
+	commits    []ackedCommit
+	failures   map[string]int
+	violations []string
+}
+
+func newLedger() *ledger {
+	return &ledger{files: make(map[string]string), failures: make(map[string]int)}
+}
+
+func (l *ledger) ackWrite(name, content string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.files[name] = content
+	l.order = append(l.order, name)
+}
+
+func (l *ledger) written() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.order)
+}
+
+func (l *ledger) ackCommit(c ackedCommit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.commits = append(l.commits, c)
+}
+
+func (l *ledger) fail(op string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.failures[op]++
+}
+
+func (l *ledger) violate(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	msg := fmt.Sprintf(format, args...)
+	log.Print("VIOLATION: ", msg)
+	l.violations = append(l.violations, msg)
+}
+
+// pick returns a random acknowledged write, ok is false if there aren't any.
+func (l *ledger) pick(rng *rand.Rand) (name, content string, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.order) == 0 {
+		return "", "", false
+	}
+	name = l.order[rng.Intn(len(l.order))]
+	return name, l.files[name], true
+}
+
+// chaos is a soak test run.
+type chaos struct {
+	c      *client.Client
+	shards []string
+	token  string
+	l      *ledger
+}
+
+// write writes new files to master until ctx is done.
+func (ch *chaos) write(ctx context.Context, writer int, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for n := 0; ctx.Err() == nil; n++ {
+		name := fmt.Sprintf("chaos/%d/%d", writer, n)
+		content := fmt.Sprintf("%s %x\n", name, rng.Int63())
+		if err := ch.c.PutFile(name, "master", strings.NewReader(content)); err != nil {
+			ch.l.fail("write")
+			continue
+		}
+		ch.l.ackWrite(name, content)
+	}
+}
+
+// commit commits master every interval until ctx is done.
+func (ch *chaos) commit(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		files := ch.l.written()
+		info, err := ch.c.Commit("master", "")
+		if err != nil {
+			ch.l.fail("commit")
+			continue
+		}
+		ch.l.ackCommit(ackedCommit{id: info.Id, files: files})
+	}
+}
+
+// read reads acknowledged writes back until ctx is done.
+func (ch *chaos) read(ctx context.Context, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for ctx.Err() == nil {
+		name, content, ok := ch.l.pick(rng)
+		if !ok {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if err := ch.checkFile(name, "master", content); err != nil {
+			ch.l.fail("read")
+		}
+	}
+}
+
+// checkFile reads name from commit and records a violation if it's wrong.
+// It returns an error if it couldn't be read.
+func (ch *chaos) checkFile(name, commit, content string) error {
+	f, err := ch.c.GetFile(name, commit)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if string(data) != content {
+		ch.l.violate("%s in %s is %q, expected %q", name, commit, data, content)
+	}
+	return nil
+}
+
+// kill runs the kill command on a random shard every interval until ctx is
+// done.
+func (ch *chaos) kill(ctx context.Context, command string, interval time.Duration, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	for {
+		// Jitter, so that kills don't line up with commits.
+		wait := interval/2 + time.Duration(rng.Int63n(int64(interval)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		shard := rng.Intn(len(ch.shards))
+		c := exec.Command("sh", "-c", fmt.Sprintf(command, shard))
+		output, err := c.CombinedOutput()
+		log.Printf("killed shard %d: %s", shard, strings.TrimSpace(string(output)))
+		if err != nil {
+			log.Printf("kill command failed: %s", err)
+		}
+	}
+}
+
+// get decodes the JSON response to a GET of a shard's url.
+func (ch *chaos) get(url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if ch.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ch.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// settle waits until every shard is healthy and its replicas have caught
+// up, or deadline. Replicas that haven't caught up by then are violations.
+func (ch *chaos) settle(deadline time.Time) {
+	for _, shard := range ch.shards {
+		for ch.get(shard+"/health", nil) != nil && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+		}
+	}
+	for _, shard := range ch.shards {
+		var lagging []string
+		for {
+			var replicas []struct {
+				Id       string `json:"id"`
+				Lag      int    `json:"lag"`
+				LagError string `json:"lagError"`
+			}
+			lagging = nil
+			err := ch.get(shard+"/replica", &replicas)
+			if err != nil {
+				lagging = append(lagging, err.Error())
+			}
+			for _, r := range replicas {
+				if r.Lag != 0 || r.LagError != "" {
+					lagging = append(lagging, fmt.Sprintf("%s is %d commits behind %s", r.Id, r.Lag, r.LagError))
+				}
+			}
+			if len(lagging) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		for _, lag := range lagging {
+			ch.l.violate("%s's replicas didn't converge: %s", shard, lag)
+		}
+	}
+}
+
+// verify checks that everything acknowledged survived.
+func (ch *chaos) verify() {
+	entries, err := ch.c.ListCommits()
+	if err != nil {
+		ch.l.violate("couldn't list commits: %s", err)
+		return
+	}
+	commits := make(map[string]client.LogEntry)
+	for _, e := range entries {
+		commits[e.Name] = e
+	}
+	prev := 0
+	for _, c := range ch.l.commits {
+		e, ok := commits[c.id]
+		if !ok {
+			ch.l.violate("acknowledged commit %s is missing", c.id)
+			continue
+		}
+		if len(e.Missing) > 0 {
+			ch.l.violate("acknowledged commit %s is missing from %s", c.id, strings.Join(e.Missing, ", "))
+		}
+		// Earlier files were checked in earlier commits, commits keep
+		// files so they'd be caught on master if they were lost.
+		for _, name := range ch.l.order[prev:c.files] {
+			if err := ch.checkFile(name, c.id, ch.l.files[name]); err != nil {
+				ch.l.violate("%s from acknowledged commit %s can't be read: %s", name, c.id, err)
+			}
+		}
+		prev = c.files
+	}
+	for _, name := range ch.l.order {
+		if err := ch.checkFile(name, "master", ch.l.files[name]); err != nil {
+			ch.l.violate("acknowledged write %s can't be read: %s", name, err)
+		}
+	}
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags)
+	duration := flag.Duration("d", 5*time.Minute, "how long to run for")
+	writers := flag.Int("writers", 4, "how many concurrent writers to run")
+	readers := flag.Int("readers", 4, "how many concurrent readers to run")
+	commitEvery := flag.Duration("commit-every", 5*time.Second, "how often to commit master")
+	shards := flag.String("shards", "", "comma separated urls of the shards, checked once the run is over")
+	kill := flag.String("kill", "", "the command that kills a shard, %d is replaced with its index in -shards")
+	killEvery := flag.Duration("kill-every", 30*time.Second, "roughly how often to kill a shard")
+	settle := flag.Duration("settle", 2*time.Minute, "how long the cluster has to recover before it's checked")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seeds the random choices, to repeat a run")
+	flag.Parse()
+	if *kill != "" && *shards == "" {
+		log.Fatal("-kill needs -shards.")
+	}
+
+	addresses := []string{"http://localhost"}
+	if address := os.Getenv("PFS_ADDRESS"); address != "" {
+		addresses = strings.Split(address, ",")
+	}
+	ch := &chaos{c: client.New(addresses[0], addresses[1:]...), token: os.Getenv("PFS_ADMIN_TOKEN"), l: newLedger()}
+	if *shards != "" {
+		ch.shards = strings.Split(*shards, ",")
+	}
+	log.Printf("running for %s with seed %d", *duration, *seed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	run := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	for i := 0; i < *writers; i++ {
+		i := i
+		run(func() { ch.write(ctx, i, *seed+int64(i)) })
+	}
+	for i := 0; i < *readers; i++ {
+		i := i
+		run(func() { ch.read(ctx, *seed+int64(*writers+i)) })
+	}
+	run(func() { ch.commit(ctx, *commitEvery) })
+	if *kill != "" {
+		run(func() { ch.kill(ctx, *kill, *killEvery, *seed-1) })
+	}
+	wg.Wait()
+
+	// Whatever was written after the last commit should make it in to one.
+	for deadline := time.Now().Add(*settle); ; {
+		files := ch.l.written()
+		info, err := ch.c.Commit("master", "")
+		if err == nil {
+			ch.l.ackCommit(ackedCommit{id: info.Id, files: files})
+			break
+		}
+		if time.Now().After(deadline) {
+			ch.l.violate("couldn't make the final commit: %s", err)
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	log.Print("settling")
+	ch.settle(time.Now().Add(*settle))
+	log.Print("verifying")
+	ch.verify()
+
+	var ops []string
+	for op := range ch.l.failures {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		log.Printf("%d %ss failed", ch.l.failures[op], op)
+	}
+	log.Printf("%d writes and %d commits acknowledged, %d violations", len(ch.l.order), len(ch.l.commits), len(ch.l.violations))
+	if len(ch.l.violations) > 0 {
+		os.Exit(1)
+	}
+}
@@ -16,6 +16,7 @@ type service struct {
 	Container, Name      string
 	Shard, Nshards, Port int
 	Disk                 string
+	Placement            string
 }
 
 var outPath string = "/host/home/core/pfs"
@@ -33,6 +34,7 @@ func printShardedService(name string) {
 			config.Container = *container
 			config.Shard = s
 			config.Nshards = *shards
+			config.Placement = *placement
 			config.Port = minPort + rand.Intn(maxPort-minPort)
 			server, err := os.Create(fmt.Sprintf("%s/%s-%d-%d:%d.service", outPath, config.Name, config.Shard, config.Nshards, r))
 			if err != nil {
@@ -57,6 +59,7 @@ func printGlobalService(name string) {
 	config.Name = name
 	config.Container = *container
 	config.Nshards = *shards
+	config.Placement = *placement
 
 	server, err := os.Create(fmt.Sprintf("%s/%s.service", outPath, config.Name))
 	if err != nil {
@@ -143,6 +146,7 @@ func printStorageService(name string) {
 var shards, replicas *int
 var container *string
 var disk *string
+var placement *string
 
 func main() {
 	log.SetFlags(log.Lshortfile)
@@ -151,6 +155,7 @@ func main() {
 	replicas = flag.Int("replicas", 3, "The number of replicas of each shard.")
 	container = flag.String("container", "pachyderm/pfs", "The container to use for the deploy.")
 	disk = flag.String("disk", "/var/lib/pfs/data.img", "The disk to use for pfs' storage.")
+	placement = flag.String("placement", "modulo", "How files are placed on shards, modulo or consistent.")
 	flag.Parse()
 
 	printShardedService("shard")
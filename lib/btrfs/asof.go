@@ -0,0 +1,105 @@
+package btrfs
+
+// asof.go resolves names like master@{2015-03-01T00:00:00Z} to the latest
+// commit, in a branch's history, made at or before a time. The part before
+// the @ can be a branch, a commit or a tag, and defaults to master.
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// CommitTime returns when commit was made. Commits from before commit times
+// were recorded fall back to their modification time.
+func CommitTime(repo, commit string) (time.Time, error) {
+	if t := GetMeta(path.Join(repo, commit), "time"); t != "" {
+		return time.Parse(time.RFC3339Nano, t)
+	}
+	fi, err := Stat(path.Join(repo, commit))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// AsOf returns the latest commit made at or before t in the history of ref,
+// which is a branch, a commit or a tag.
+func AsOf(repo, ref string, t time.Time) (string, error) {
+	commit := ResolveTag(repo, ref)
+	exists, err := FileExists(path.Join(repo, commit))
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errorf(ErrCommitNotFound, "Commit %s not found.", ref)
+	}
+	isCommit, err := IsReadOnly(path.Join(repo, commit))
+	if err != nil {
+		return "", err
+	}
+	if !isCommit {
+		commit = Head(repo, commit)
+	}
+	for commit != "" {
+		committed, err := CommitTime(repo, commit)
+		if err != nil {
+			return "", err
+		}
+		if !committed.After(t) {
+			return commit, nil
+		}
+		commit = GetMeta(path.Join(repo, commit), "parent")
+	}
+	return "", errorf(ErrCommitNotFound, "%s has no commits from before %s.", ref, t.Format(time.RFC3339))
+}
+
+// ValidRef is like ValidName but also accepts as-ofs of valid names, it
+// checks refs that are about to be resolved.
+func ValidRef(name string) error {
+	ref, _, ok, err := ParseAsOf(name)
+	if !ok {
+		return ValidName(name)
+	}
+	if err != nil {
+		return err
+	}
+	return ValidName(ref)
+}
+
+// ParseAsOf splits name, like master@{2015-03-01T00:00:00Z}, in to the ref
+// and the time. Times are RFC 3339 or dates. ok is false if name isn't an
+// as-of.
+func ParseAsOf(name string) (ref string, t time.Time, ok bool, err error) {
+	i := strings.Index(name, "@{")
+	if i < 0 || !strings.HasSuffix(name, "}") {
+		return "", time.Time{}, false, nil
+	}
+	ref, value := name[:i], name[i+2:len(name)-1]
+	if ref == "" {
+		ref = "master"
+	}
+	if t, err = time.Parse(time.RFC3339, value); err != nil {
+		if t, err = time.Parse("2006-01-02", value); err != nil {
+			return "", time.Time{}, true, errorf(ErrInvalidName, "Invalid time %s, times look like 2015-03-01T00:00:00Z.", value)
+		}
+	}
+	return ref, t, true, nil
+}
+
+// Resolve returns the commit name refers to if it's a tag or an as-of,
+// otherwise, or if it doesn't resolve, it returns name.
+func Resolve(repo, name string) string {
+	ref, t, ok, err := ParseAsOf(name)
+	if !ok {
+		return ResolveTag(repo, name)
+	}
+	if err != nil {
+		return name
+	}
+	commit, err := AsOf(repo, ref, t)
+	if err != nil {
+		return name
+	}
+	return commit
+}
@@ -0,0 +1,340 @@
+package btrfs
+
+// backup.go takes whole repos to and from replicas. Pull only moves commits,
+// a backup is everything needed to bring a repo back: its commits, the
+// uncommitted state of its branches and the repo's own settings, like its
+// tags, hooks and compression, along with any files the caller wants kept with it.
+//
+// A backup is pushed to a replica as ordinary send streams: every commit,
+// then a read-only snapshot of each branch, named backup-<id>-<branch>, then
+// a manifest subvolume, backup-<id>, holding backup.json, the hooks and the
+// extra files. The snapshots and the manifest are marked with the backup's
+// id so that Recv leaves them be, Restore turns them back in to branches.
+// Replicas should hold one backup each, use a new replica per backup.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// backupPrefix starts the names of the subvolumes Backup makes.
+const backupPrefix = "backup-"
+
+// BackupBranch is a branch in a backup.
+type BackupBranch struct {
+	Name string `json:"name"`
+	// Head is the commit the branch was made from, Snapshot the subvolume
+	// holding its uncommitted state.
+	Head     string `json:"head"`
+	Snapshot string `json:"snapshot"`
+}
+
+// BackupManifest describes a backup, it's stored as backup.json in the
+// backup's manifest subvolume.
+type BackupManifest struct {
+	Id          string         `json:"id"`
+	Repo        string         `json:"repo"`
+	Time        string         `json:"time"`
+	Compression string         `json:"compression,omitempty"`
+	Permissions bool           `json:"permissions,omitempty"`
+	Branches    []BackupBranch `json:"branches"`
+	Tags        []TagInfo      `json:"tags,omitempty"`
+	Hooks       []string       `json:"hooks,omitempty"`
+	// Files are the names of the extra files, see BackupOptions.Files.
+	Files []string `json:"files,omitempty"`
+}
+
+// BackupOptions controls Backup.
+type BackupOptions struct {
+	// Files are extra files to keep with the backup, keyed by name, the
+	// values are their paths. Files that don't exist are skipped.
+	Files map[string]string
+}
+
+// RestoreOptions controls Restore.
+type RestoreOptions struct {
+	// Files says where to put the backup's extra files, keyed by the names
+	// they were backed up with. Files that aren't listed aren't restored.
+	Files map[string]string
+}
+
+// backupPath is where Backup stages the subvolumes it sends for repo.
+func backupPath(repo string) string {
+	return path.Join("tmp", "backup", repo)
+}
+
+// isBackup returns true if name was made by Backup.
+func isBackup(name string) bool {
+	return GetMeta(name, "backup") != ""
+}
+
+// Backup pushes a backup of repo to replica and returns its id.
+func Backup(ctx context.Context, repo string, replica Pusher) (string, error) {
+	return BackupWithOptions(ctx, repo, replica, BackupOptions{})
+}
+
+// BackupWithOptions is Backup with options.
+func BackupWithOptions(ctx context.Context, repo string, replica Pusher, opts BackupOptions) (string, error) {
+	id := NewCommitId()
+	staging := path.Join(backupPath(repo), id)
+	if err := MkdirAll(staging); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := cleanRecv(staging); err != nil {
+			logger.ErrorContext(ctx, "cleaning up backup", "repo", repo, "err", err)
+		}
+	}()
+	m := BackupManifest{Id: id, Repo: repo, Time: time.Now().UTC().Format(time.RFC3339), Permissions: PreservesPermissions(repo)}
+	var err error
+	if m.Compression, err = GetCompression(repo); err != nil {
+		return "", err
+	}
+	if m.Tags, err = ListTags(repo); err != nil {
+		return "", err
+	}
+
+	// Branches are snapshotted first so that their heads are among the
+	// commits we send.
+	subvolumes, err := Listing(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, sv := range subvolumes {
+		if sv.Commit {
+			continue
+		}
+		branch, err := snapshotBranch(repo, sv.Name, staging, id)
+		if err != nil {
+			return "", err
+		}
+		m.Branches = append(m.Branches, branch)
+	}
+	if err := Pull(ctx, repo, "", replica); err != nil {
+		return "", err
+	}
+	for _, branch := range m.Branches {
+		err := sendSubvolume(ctx, path.Join(staging, branch.Snapshot), path.Join(repo, branch.Head), func(diff io.Reader) error {
+			return replica.Push(ctx, diff)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	manifest := path.Join(staging, backupPrefix+id)
+	if err := SubvolumeCreate(manifest); err != nil {
+		return "", err
+	}
+	hooks, err := ReadDir(path.Dir(HookPath(repo, "")))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, hook := range hooks {
+		if err := copyBackupFile(HookPath(repo, hook.Name()), path.Join(manifest, "hooks", hook.Name())); err != nil {
+			return "", err
+		}
+		m.Hooks = append(m.Hooks, hook.Name())
+	}
+	for name, src := range opts.Files {
+		exists, err := FileExists(src)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			continue
+		}
+		if err := copyBackupFile(src, path.Join(manifest, "files", name)); err != nil {
+			return "", err
+		}
+		m.Files = append(m.Files, name)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := WriteFile(path.Join(manifest, "backup.json"), data); err != nil {
+		return "", err
+	}
+	if err := SetMeta(manifest, "backup", id); err != nil {
+		return "", err
+	}
+	if err := SetReadOnly(manifest); err != nil {
+		return "", err
+	}
+	err = sendSubvolume(ctx, manifest, "", func(diff io.Reader) error { return replica.Push(ctx, diff) })
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// snapshotBranch snapshots branch, read only, in to staging for backup id.
+func snapshotBranch(repo, branch, staging, id string) (BackupBranch, error) {
+	lock, err := LockBranch(repo, branch)
+	if err != nil {
+		return BackupBranch{}, err
+	}
+	defer lock.Unlock()
+	b := BackupBranch{Name: branch, Head: Head(repo, branch), Snapshot: backupPrefix + id + "-" + branch}
+	snapshot := path.Join(staging, b.Snapshot)
+	if err := Snapshot(path.Join(repo, branch), snapshot, false); err != nil {
+		return BackupBranch{}, err
+	}
+	if err := SetMeta(snapshot, "backup", id); err != nil {
+		return BackupBranch{}, err
+	}
+	return b, SetReadOnly(snapshot)
+}
+
+// copyBackupFile copies src to dst, keeping its permissions.
+func copyBackupFile(src, dst string) error {
+	fi, err := Stat(src)
+	if err != nil {
+		return err
+	}
+	f, err := Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := MkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+	out, err := OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, f)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Restore recreates repo, which mustn't exist, from the backup in replica and
+// returns the backup's id. If it fails repo is deleted.
+func Restore(ctx context.Context, replica Puller, repo string) (string, error) {
+	return RestoreWithOptions(ctx, replica, repo, RestoreOptions{})
+}
+
+// RestoreWithOptions is Restore with options.
+func RestoreWithOptions(ctx context.Context, replica Puller, repo string, opts RestoreOptions) (id string, retErr error) {
+	exists, err := FileExists(repo)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", fmt.Errorf("Can't restore in to %s, it already exists.", repo)
+	}
+	if err := InitReplica(repo); err != nil {
+		return "", err
+	}
+	defer func() {
+		if retErr == nil {
+			return
+		}
+		if err := deleteRepo(repo); err != nil {
+			logger.ErrorContext(ctx, "deleting failed restore", "repo", repo, "err", err)
+		}
+	}()
+	if err := replica.Pull(ctx, "", NewLocalReplica(repo)); err != nil {
+		return "", err
+	}
+
+	subvolumes, err := Listing(repo)
+	if err != nil {
+		return "", err
+	}
+	var manifest string
+	for _, sv := range subvolumes {
+		if sv.Commit && strings.HasPrefix(sv.Name, backupPrefix) && GetMeta(path.Join(repo, sv.Name), "backup") == strings.TrimPrefix(sv.Name, backupPrefix) {
+			manifest = path.Join(repo, sv.Name)
+			break
+		}
+	}
+	if manifest == "" {
+		return "", fmt.Errorf("Replica has no backup in it.")
+	}
+	data, err := ReadFile(path.Join(manifest, "backup.json"))
+	if err != nil {
+		return "", err
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", fmt.Errorf("Invalid backup manifest: %w", err)
+	}
+
+	// Recv made branches from the commits, the backup's branches replace
+	// them.
+	for _, sv := range subvolumes {
+		if !sv.Commit {
+			if err := SubvolumeDelete(path.Join(repo, sv.Name)); err != nil {
+				return "", err
+			}
+		}
+	}
+	for _, branch := range m.Branches {
+		if err := snapshotInRepo(repo, path.Join(repo, branch.Snapshot), path.Join(repo, branch.Name), false); err != nil {
+			return "", err
+		}
+		if err := Remove(path.Join(repo, branch.Name, ".meta", "backup")); err != nil {
+			return "", err
+		}
+	}
+	for _, tag := range m.Tags {
+		if err := Tag(repo, tag.Commit, tag.Name); err != nil {
+			return "", err
+		}
+	}
+	for _, hook := range m.Hooks {
+		if err := copyBackupFile(path.Join(manifest, "hooks", hook), HookPath(repo, hook)); err != nil {
+			return "", err
+		}
+	}
+	for _, name := range m.Files {
+		if dst, ok := opts.Files[name]; ok {
+			if err := copyBackupFile(path.Join(manifest, "files", name), dst); err != nil {
+				return "", err
+			}
+		}
+	}
+	if m.Compression != "" {
+		if err := SetCompression(repo, m.Compression); err != nil {
+			return "", err
+		}
+	}
+	if err := SetPreservePermissions(repo, m.Permissions); err != nil {
+		return "", err
+	}
+	for _, sv := range subvolumes {
+		if sv.Commit && isBackup(path.Join(repo, sv.Name)) {
+			if err := SubvolumeDelete(path.Join(repo, sv.Name)); err != nil {
+				return "", err
+			}
+		}
+	}
+	return m.Id, syncDir(repo)
+}
+
+// deleteRepo deletes repo and every subvolume in it.
+func deleteRepo(repo string) error {
+	names, err := ReadDir(repo)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name.IsDir() && !strings.HasPrefix(name.Name(), ".") {
+			if err := SubvolumeDelete(path.Join(repo, name.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return SubvolumeDelete(repo)
+}
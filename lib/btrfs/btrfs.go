@@ -3,16 +3,18 @@ package btrfs
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path"
-	"runtime"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -23,6 +25,15 @@ import (
 	"github.com/pachyderm/pfs/lib/shell"
 )
 
+var logger = slog.Default()
+
+// SetLogger sets the logger this package logs to. Operations that are passed
+// a context log with it, so they're tagged with its request id. It should be
+// called before anything else in the package is used.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 var once sync.Once
 
@@ -58,7 +69,11 @@ func TrimFilePath(name string) string {
 }
 
 func Create(name string) (*os.File, error) {
-	return os.Create(FilePath(name))
+	if err := checkWriteFile(name); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(FilePath(name))
+	return f, readOnly(err)
 }
 
 func CreateAll(name string) (*os.File, error) {
@@ -66,7 +81,7 @@ func CreateAll(name string) (*os.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return os.Create(FilePath(name))
+	return Create(name)
 }
 
 func CreateFromReader(name string, r io.Reader) (int64, error) {
@@ -83,7 +98,13 @@ func Open(name string) (*os.File, error) {
 }
 
 func OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
-	return os.OpenFile(FilePath(name), flag, perm)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := checkWriteFile(name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(FilePath(name), flag, perm)
+	return f, readOnly(err)
 }
 
 func OpenFd(name string, mode int, perm uint32) (int, error) {
@@ -95,10 +116,53 @@ func ReadFile(name string) ([]byte, error) {
 }
 
 func WriteFile(name string, data []byte) error {
-	return ioutil.WriteFile(FilePath(name), data, 0666)
+	if err := checkWriteFile(name); err != nil {
+		return err
+	}
+	return readOnly(ioutil.WriteFile(FilePath(name), data, 0666))
+}
+
+// WriteFileAtomic writes data to name durably and atomically, after a crash
+// name holds either its old contents or data.
+func WriteFileAtomic(name string, data []byte) error {
+	if err := checkWrite(name); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(FilePath(path.Dir(name)), "."+path.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), FilePath(name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(path.Dir(name))
+}
+
+// syncDir makes dir's entries durable.
+func syncDir(dir string) error {
+	f, err := os.Open(FilePath(dir))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 func CopyFile(name string, r io.Reader) (int64, error) {
+	if err := checkWriteFile(name); err != nil {
+		return 0, err
+	}
 	f, err := Open(name)
 	if err != nil {
 		return 0, err
@@ -107,16 +171,61 @@ func CopyFile(name string, r io.Reader) (int64, error) {
 	return io.Copy(f, r)
 }
 
+// WriteAt writes r in to name starting at offset, creating name if it
+// doesn't exist. The rest of the file is left as it is, writing past its end
+// leaves a hole that reads as zeros. It returns the number of bytes written.
+func WriteAt(name string, offset int64, r io.Reader) (int64, error) {
+	f, err := OpenFile(name, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(f, r)
+}
+
+// Append writes r to the end of name, creating name if it doesn't exist. It
+// returns the offset r was written at and the number of bytes written. The
+// offset is only reliable if nothing else is appending to name at the same
+// time.
+func Append(name string, r io.Reader) (int64, int64, error) {
+	f, err := OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := io.Copy(f, r)
+	return fi.Size(), n, err
+}
+
 func Remove(name string) error {
-	return os.Remove(FilePath(name))
+	if err := checkWrite(name); err != nil {
+		return err
+	}
+	return readOnly(os.Remove(FilePath(name)))
 }
 
 func RemoveAll(name string) error {
-	return os.RemoveAll(FilePath(name))
+	if err := checkWrite(name); err != nil {
+		return err
+	}
+	return readOnly(os.RemoveAll(FilePath(name)))
 }
 
 func Rename(oldname, newname string) error {
-	return os.Rename(FilePath(oldname), FilePath(newname))
+	if err := checkWrite(oldname); err != nil {
+		return err
+	}
+	if err := checkWrite(newname); err != nil {
+		return err
+	}
+	return readOnly(os.Rename(FilePath(oldname), FilePath(newname)))
 }
 
 func Stat(name string) (os.FileInfo, error) {
@@ -139,16 +248,28 @@ func FileExists(name string) (bool, error) {
 }
 
 func Mkdir(name string) error {
-	return os.Mkdir(FilePath(name), 0777)
+	if err := checkWrite(name); err != nil {
+		return err
+	}
+	return readOnly(os.Mkdir(FilePath(name), 0777))
 }
 
 // TODO(rw,jd): check into atomicity/race conditions with multiple callers
 func MkdirAll(name string) error {
-	return os.MkdirAll(FilePath(name), 0777)
+	if err := checkWrite(name); err != nil {
+		return err
+	}
+	return readOnly(os.MkdirAll(FilePath(name), 0777))
 }
 
 func Link(oldname, newname string) error {
-	return os.Link(FilePath(oldname), FilePath(newname))
+	if err := checkWrite(newname); err != nil {
+		return err
+	}
+	if err := checkNoSymlinks(oldname, false); err != nil {
+		return err
+	}
+	return readOnly(os.Link(FilePath(oldname), FilePath(newname)))
 }
 
 func Readlink(name string) (string, error) {
@@ -160,7 +281,10 @@ func Readlink(name string) (string, error) {
 }
 
 func Symlink(oldname, newname string) error {
-	return os.Symlink(FilePath(oldname), FilePath(newname))
+	if err := checkWrite(newname); err != nil {
+		return err
+	}
+	return readOnly(os.Symlink(FilePath(oldname), FilePath(newname)))
 }
 
 func ReadDir(name string) ([]os.FileInfo, error) {
@@ -192,42 +316,36 @@ func LazyWalk(name string, f func(string) error) error {
 
 func WaitForFile(name string) error {
 	if err := MkdirAll(path.Dir(name)); err != nil {
-		log.Print(err)
 		return err
 	}
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		log.Print(err)
 		return err
 	}
 	defer watcher.Close()
 
 	if err := watcher.Add(FilePath(path.Dir(name))); err != nil {
-		log.Print(err)
 		return err
 	}
 
 	exists, err := FileExists(name)
 	if err != nil {
-		log.Print(err)
 		return err
 	}
 	if exists {
-		log.Print("File exists, returning.")
 		return nil
 	}
 
-	log.Print("File doesn't exist. Waiting for it...")
+	logger.Debug("waiting for file", "file", name)
 	for {
 		select {
 		case event := <-watcher.Events:
-			log.Print(event)
+			logger.Debug("file event", "event", event)
 			if event.Op == fsnotify.Create && event.Name == FilePath(name) {
 				return nil
 			}
 		case err := <-watcher.Errors:
-			log.Print(err)
 			return err
 		}
 	}
@@ -235,10 +353,12 @@ func WaitForFile(name string) error {
 }
 
 func SubvolumeCreate(name string) error {
+	defer invalidateListings()
 	return shell.RunStderr(exec.Command("btrfs", "subvolume", "create", FilePath(name)))
 }
 
 func SubvolumeDelete(name string) error {
+	defer invalidateListings()
 	return shell.RunStderr(exec.Command("btrfs", "subvolume", "delete", FilePath(name)))
 }
 
@@ -254,7 +374,18 @@ func SubvolumeDeleteAll(name string) error {
 	}
 }
 
+// LimitExclusive limits the data that only the subvolume name refers to,
+// the data it shares with its snapshots doesn't count, to size bytes. It
+// turns on quotas if they aren't on already.
+func LimitExclusive(name string, size int64) error {
+	if err := shell.RunStderr(exec.Command("btrfs", "quota", "enable", FilePath(name))); err != nil {
+		return err
+	}
+	return shell.RunStderr(exec.Command("btrfs", "qgroup", "limit", "-e", fmt.Sprint(size), FilePath(name)))
+}
+
 func Snapshot(volume string, dest string, readonly bool) error {
+	defer invalidateListings()
 	if readonly {
 		return shell.RunStderr(exec.Command("btrfs", "subvolume", "snapshot", "-r",
 			FilePath(volume), FilePath(dest)))
@@ -264,14 +395,373 @@ func Snapshot(volume string, dest string, readonly bool) error {
 	}
 }
 
+// snapshotInRepo is like Snapshot for snapshots in repo, it adds them to the
+// repo's qgroup if it has a quota.
+func snapshotInRepo(repo, volume, dest string, readonly bool) error {
+	defer invalidateListings()
+	args := []string{"subvolume", "snapshot"}
+	if readonly {
+		args = append(args, "-r")
+	}
+	if qgroup := GetMeta(repo, "qgroup"); qgroup != "" {
+		args = append(args, "-i", qgroup)
+	}
+	return shell.RunStderr(exec.Command("btrfs", append(args, FilePath(volume), FilePath(dest))...))
+}
+
+// subvolumeId returns the id of the subvolume name.
+func subvolumeId(name string) (string, error) {
+	var id string
+	err := shell.CallCont(exec.Command("btrfs", "inspect-internal", "rootid", FilePath(name)),
+		func(r io.Reader) error {
+			data, err := ioutil.ReadAll(r)
+			id = strings.TrimSpace(string(data))
+			return err
+		})
+	return id, err
+}
+
+func quotaLimit(quota int64) string {
+	if quota == 0 {
+		return "none"
+	}
+	return fmt.Sprint(quota)
+}
+
+// SetQuota limits the space that repo's commits and branches refer to,
+// together, to quota bytes, 0 removes the limit. Writes that would go over
+// it fail with EDQUOT, see IsQuotaExceeded.
+func SetQuota(repo string, quota int64) error {
+	if quota < 0 {
+		return fmt.Errorf("Invalid quota %d.", quota)
+	}
+	if err := shell.RunStderr(exec.Command("btrfs", "quota", "enable", FilePath(repo))); err != nil {
+		return err
+	}
+	qgroup := GetMeta(repo, "qgroup")
+	if qgroup == "" {
+		// The repo gets a level 1 qgroup containing all of its subvolumes,
+		// named after the repo's subvolume so that it's unique.
+		id, err := subvolumeId(repo)
+		if err != nil {
+			return err
+		}
+		qgroup = "1/" + id
+		if err := shell.RunStderr(exec.Command("btrfs", "qgroup", "create", qgroup, FilePath(repo))); err != nil {
+			return err
+		}
+		names := []string{repo}
+		err = Commits(repo, "", Desc, func(c CommitInfo) error {
+			names = append(names, path.Join(repo, c.Path))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			id, err := subvolumeId(name)
+			if err != nil {
+				return err
+			}
+			if err := shell.RunStderr(exec.Command("btrfs", "qgroup", "assign", "0/"+id, qgroup, FilePath(repo))); err != nil {
+				return err
+			}
+		}
+		if err := shell.RunStderr(exec.Command("btrfs", "quota", "rescan", "-w", FilePath(repo))); err != nil {
+			return err
+		}
+		if err := SetMeta(repo, "qgroup", qgroup); err != nil {
+			return err
+		}
+	}
+	return shell.RunStderr(exec.Command("btrfs", "qgroup", "limit", quotaLimit(quota), qgroup, FilePath(repo)))
+}
+
+// SetBranchQuota limits the space that branch refers to to quota bytes, 0
+// removes the limit.
+func SetBranchQuota(repo, branch string, quota int64) error {
+	if quota < 0 {
+		return fmt.Errorf("Invalid quota %d.", quota)
+	}
+	isCommit, err := IsReadOnly(path.Join(repo, branch))
+	if err != nil {
+		return err
+	}
+	if isCommit {
+		return errorf(ErrReadOnlyCommit, "%s is a commit, only branches have quotas.", branch)
+	}
+	if err := shell.RunStderr(exec.Command("btrfs", "quota", "enable", FilePath(repo))); err != nil {
+		return err
+	}
+	return shell.RunStderr(exec.Command("btrfs", "qgroup", "limit", quotaLimit(quota), FilePath(path.Join(repo, branch))))
+}
+
+// Usage is how much space something refers to and its quota, 0 if it
+// doesn't have one.
+type Usage struct {
+	Used  int64
+	Quota int64
+}
+
+// qgroups returns the usage of every qgroup in the filesystem containing
+// repo, by qgroup id.
+func qgroups(repo string) (map[string]Usage, error) {
+	res := make(map[string]Usage)
+	err := shell.CallCont(exec.Command("btrfs", "qgroup", "show", "--raw", "-r", FilePath(repo)),
+		func(r io.Reader) error {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				// scanner.Text() looks like this:
+				// qgroupid         rfer         excl     max_rfer
+				// --------         ----         ----     --------
+				// 0/257           16384        16384         none
+				// 0               1            2             3
+				tokens := strings.Fields(scanner.Text())
+				if len(tokens) < 4 || !strings.Contains(tokens[0], "/") {
+					continue
+				}
+				var usage Usage
+				if _, err := fmt.Sscan(tokens[1], &usage.Used); err != nil {
+					return err
+				}
+				if tokens[3] != "none" {
+					if _, err := fmt.Sscan(tokens[3], &usage.Quota); err != nil {
+						return err
+					}
+				}
+				res[tokens[0]] = usage
+			}
+			return scanner.Err()
+		})
+	return res, err
+}
+
+var ErrNoQuota = errors.New("No quota has been set.")
+
+// RepoUsage returns the space that repo's commits and branches refer to,
+// together, and its quota. It returns ErrNoQuota if SetQuota has never been
+// called for repo, since its usage isn't tracked until then.
+func RepoUsage(repo string) (Usage, error) {
+	qgroup := GetMeta(repo, "qgroup")
+	if qgroup == "" {
+		return Usage{}, ErrNoQuota
+	}
+	usages, err := qgroups(repo)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usages[qgroup], nil
+}
+
+// BranchUsage returns the space that branch refers to and its quota.
+func BranchUsage(repo, branch string) (Usage, error) {
+	id, err := subvolumeId(path.Join(repo, branch))
+	if err != nil {
+		return Usage{}, err
+	}
+	usages, err := qgroups(repo)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usages["0/"+id], nil
+}
+
+// DiskUsage is the space a commit or branch takes up.
+type DiskUsage struct {
+	// Logical is the size of its files.
+	Logical int64
+	// Exclusive is the space on disk that only it refers to, which deleting
+	// it would free.
+	Exclusive int64
+	// Shared is the space on disk that it shares with other commits and
+	// branches.
+	Shared int64
+}
+
+// Du returns the space commit, which may also be a branch, takes up in repo.
+func Du(repo, commit string) (DiskUsage, error) {
+	var du DiskUsage
+	err := filepath.Walk(FilePath(path.Join(repo, commit)), func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			du.Logical += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return du, err
+	}
+	err = shell.CallCont(exec.Command("btrfs", "filesystem", "du", "-s", "--raw", FilePath(path.Join(repo, commit))),
+		func(r io.Reader) error {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				// scanner.Text() looks like this:
+				//      Total   Exclusive  Set shared  Filename
+				//      16384       4096       12288  /var/lib/pfs/vol/repo/commit
+				//          0          1           2  3
+				tokens := strings.Fields(scanner.Text())
+				if len(tokens) < 4 || tokens[0] == "Total" {
+					continue
+				}
+				if _, err := fmt.Sscan(tokens[1], &du.Exclusive); err != nil {
+					return err
+				}
+				if _, err := fmt.Sscan(tokens[2], &du.Shared); err != nil {
+					return err
+				}
+			}
+			return scanner.Err()
+		})
+	return du, err
+}
+
+// ScrubStats are the results of a scrub.
+type ScrubStats struct {
+	BytesScrubbed       int64
+	CsumErrors          int64
+	ReadErrors          int64
+	VerifyErrors        int64
+	SuperErrors         int64
+	CorrectedErrors     int64
+	UncorrectableErrors int64
+}
+
+// parseScrubStats parses the output of btrfs scrub start -R.
+func parseScrubStats(r io.Reader) (ScrubStats, error) {
+	var stats ScrubStats
+	fields := map[string]*int64{
+		"data_bytes_scrubbed":  &stats.BytesScrubbed,
+		"tree_bytes_scrubbed":  &stats.BytesScrubbed,
+		"csum_errors":          &stats.CsumErrors,
+		"read_errors":          &stats.ReadErrors,
+		"verify_errors":        &stats.VerifyErrors,
+		"super_errors":         &stats.SuperErrors,
+		"corrected_errors":     &stats.CorrectedErrors,
+		"uncorrectable_errors": &stats.UncorrectableErrors,
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// scanner.Text() looks like this:
+		//	data_bytes_scrubbed: 1048576
+		tokens := strings.Split(strings.TrimSpace(scanner.Text()), ": ")
+		if len(tokens) != 2 {
+			continue
+		}
+		field, ok := fields[tokens[0]]
+		if !ok {
+			continue
+		}
+		var n int64
+		if _, err := fmt.Sscan(tokens[1], &n); err != nil {
+			return stats, err
+		}
+		*field += n
+	}
+	return stats, scanner.Err()
+}
+
+// Scrub reads every block in the volume and checks it against its checksum,
+// repairing it from another copy where there is one. It blocks until the
+// scrub is done.
+func Scrub() (ScrubStats, error) {
+	var stats ScrubStats
+	err := shell.CallCont(exec.Command("btrfs", "scrub", "start", "-B", "-R", FilePath("")),
+		func(r io.Reader) error {
+			var err error
+			stats, err = parseScrubStats(r)
+			return err
+		})
+	// btrfs scrub exits non-zero when it finds errors it can't correct,
+	// that's reported in the stats.
+	if err != nil && stats.UncorrectableErrors > 0 {
+		err = nil
+	}
+	return stats, err
+}
+
+// IsQuotaExceeded returns true if err is from a write that went over a
+// quota.
+func IsQuotaExceeded(err error) bool {
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	}
+	return err == syscall.EDQUOT
+}
+
 func SetReadOnly(volume string) error {
+	defer invalidateListings()
 	return shell.RunStderr(exec.Command("btrfs", "property", "set", FilePath(volume), "ro", "true"))
 }
 
 func UnsetReadOnly(volume string) error {
+	defer forgetCommits()
 	return shell.RunStderr(exec.Command("btrfs", "property", "set", FilePath(volume), "ro", "false"))
 }
 
+// Compressions are the compression algorithms btrfs supports, "" means no
+// compression.
+var Compressions = []string{"", "zlib", "lzo", "zstd"}
+
+// ValidCompression returns an error if btrfs doesn't support compression.
+func ValidCompression(compression string) error {
+	for _, c := range Compressions {
+		if c == compression {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported compression %s, it must be one of zlib, lzo or zstd.", compression)
+}
+
+// SetCompression sets the compression algorithm for files written to
+// repo's branches from now on, and to branches made from them. Existing
+// files and commits aren't recompressed.
+func SetCompression(repo, compression string) error {
+	if err := ValidCompression(compression); err != nil {
+		return err
+	}
+	names := []string{repo}
+	err := Commits(repo, "", Desc, func(c CommitInfo) error {
+		isCommit, err := IsReadOnly(path.Join(repo, c.Path))
+		if err != nil {
+			return err
+		}
+		if !isCommit {
+			names = append(names, path.Join(repo, c.Path))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := shell.RunStderr(exec.Command("btrfs", "property", "set", FilePath(name), "compression", compression)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCompression returns the compression algorithm set for repo with
+// SetCompression, "" if there isn't one.
+func GetCompression(repo string) (string, error) {
+	var res string
+	err := shell.CallCont(exec.Command("btrfs", "property", "get", FilePath(repo), "compression"),
+		func(r io.Reader) error {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				// scanner.Text() looks like this:
+				// compression=zlib
+				if strings.HasPrefix(scanner.Text(), "compression=") {
+					res = strings.TrimPrefix(scanner.Text(), "compression=")
+				}
+			}
+			return scanner.Err()
+		})
+	return res, err
+}
+
 func IsReadOnly(volume string) (bool, error) {
 	var res bool
 	// "-t s" indicates to btrfs that this is a subvolume without the "-t s"
@@ -292,22 +782,34 @@ func IsReadOnly(volume string) (bool, error) {
 }
 
 func ensureMetaDir(branch string) error {
+	metaExists, err := FileExists(path.Join(branch, ".meta"))
+	if err != nil || metaExists {
+		return err
+	}
 	branchExists, err := FileExists(branch)
 	if err != nil {
 		return err
 	}
 	if !branchExists {
-		fmt.Errorf("Cannot create meta dir for nonexistant branch %s.", branch)
+		return errorf(ErrBranchNotFound, "Cannot create meta dir for nonexistant branch %s.", branch)
+	}
+	if err := MkdirAll(path.Join(branch, ".meta")); err != nil {
+		return err
 	}
-	return MkdirAll(path.Join(branch, ".meta"))
+	return syncDir(branch)
 }
 
-// SetMeta sets metadata for a branch.
+// SetMeta sets metadata for a branch. The value is durable when SetMeta
+// returns and a crash never leaves part of it.
 func SetMeta(branch, key, value string) error {
+	if key == "parent" || key == "branch" {
+		// They're part of the branch's Listing.
+		defer invalidateListings()
+	}
 	if err := ensureMetaDir(branch); err != nil {
 		return err
 	}
-	return WriteFile(path.Join(branch, ".meta", key), []byte(value))
+	return WriteFileAtomic(path.Join(branch, ".meta", key), []byte(value))
 }
 
 // GetMeta gets metadata from a commit.
@@ -319,46 +821,165 @@ func GetMeta(name, key string) string {
 	return string(value)
 }
 
-func Send(repo, commit string, cont func(io.Reader) error) error {
-	parent := GetMeta(path.Join(repo, commit), "parent")
-	if parent == "" {
-		return shell.CallCont(exec.Command("btrfs", "send", FilePath(path.Join(repo, commit))), cont)
-	} else {
-		return shell.CallCont(exec.Command("btrfs", "send", "-p",
-			FilePath(path.Join(repo, parent)), FilePath(path.Join(repo, commit))), cont)
-	}
+// lockPollInterval is how often LockBranch retries a lock that's held.
+var lockPollInterval = 10 * time.Millisecond
+
+// lockPath is the file branch's lock is taken on.
+func lockPath(repo, branch string) string {
+	return path.Join(repo, branch, ".meta", "lock")
 }
 
-// createNewBranch gets called after a new commit has been `Recv`ed it creates
-// the branch that should be pointing to the newly made commit.
-func createNewBranch(repo string) error {
-	err := Commits(repo, "", Desc, func(c CommitInfo) error {
-		branch := GetMeta(path.Join(repo, c.Path), "branch")
-		err := SubvolumeDeleteAll(path.Join(repo, branch))
+// BranchLock is an advisory lock on a branch, see LockBranch.
+type BranchLock struct {
+	f *os.File
+}
+
+// LockBranch takes an exclusive lock on branch, waiting until it's free. Locks
+// are advisory, they're flocks on a file in the branch's .meta so they work
+// between processes. Commit, Prepare and Finalize take an exclusive lock so
+// that writers that take a shared lock with RLockBranch are never part way
+// through a write when the branch is snapshotted.
+func LockBranch(repo, branch string) (*BranchLock, error) {
+	return lockBranch(repo, branch, syscall.LOCK_EX)
+}
+
+// RLockBranch takes a shared lock on branch, any number of writers can hold
+// one at once but not while someone holds an exclusive lock.
+func RLockBranch(repo, branch string) (*BranchLock, error) {
+	return lockBranch(repo, branch, syscall.LOCK_SH)
+}
+
+func lockBranch(repo, branch string, how int) (*BranchLock, error) {
+	// Branches come from requests, .. would lock, and let writers in to,
+	// whatever's outside the repo.
+	if err := ValidName(branch); err != nil {
+		return nil, err
+	}
+	if err := ensureMetaDir(path.Join(repo, branch)); err != nil {
+		return nil, err
+	}
+	for {
+		f, err := OpenFile(lockPath(repo, branch), os.O_RDONLY|os.O_CREATE, 0666)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			f.Close()
+			time.Sleep(lockPollInterval)
+			continue
 		}
-		err = Branch(repo, c.Path, branch)
 		if err != nil {
-			return err
+			f.Close()
+			return nil, err
+		}
+		// ForceUnlock may have replaced the lock file since we opened it,
+		// in which case we've locked the old one.
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := Stat(lockPath(repo, branch))
+		if err == nil && os.SameFile(locked, current) {
+			return &BranchLock{f: f}, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
 		}
-		return Complete
-	})
-	if err != nil && err != Complete {
-		return err
 	}
-	return nil
 }
 
-func Recv(repo string, data io.Reader) error {
-	c := exec.Command("btrfs", "receive", FilePath(repo))
-	_, callerFile, callerLine, _ := runtime.Caller(0)
-	log.Printf("%15s:%.3d -> %s", path.Base(callerFile), callerLine, strings.Join(c.Args, " "))
-	stdin, err := c.StdinPipe()
-	if err != nil {
-		return err
-	}
-	stderr, err := c.StderrPipe()
+// Unlock releases the lock.
+func (l *BranchLock) Unlock() error {
+	return l.f.Close()
+}
+
+// ForceUnlock breaks branch's lock, for when its holder is stuck. It replaces
+// the lock file so new lockers don't wait for the old holders, which keep
+// running believing they hold the lock.
+func ForceUnlock(repo, branch string) error {
+	err := Remove(lockPath(repo, branch))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Send streams commit, as a diff against its parent, to cont. Cancelling ctx
+// kills the send.
+func Send(ctx context.Context, repo, commit string, cont func(io.Reader) error) error {
+	parent := GetMeta(path.Join(repo, commit), "parent")
+	if parent != "" {
+		parent = path.Join(repo, parent)
+	}
+	if err := fault(FaultSend); err != nil {
+		return err
+	}
+	return sendSubvolume(ctx, path.Join(repo, commit), parent, func(r io.Reader) error {
+		return cont(faultStream(FaultSend, r))
+	})
+}
+
+// sendSubvolume streams the read only subvolume name to cont, as a diff
+// against parent if it isn't "".
+func sendSubvolume(ctx context.Context, name, parent string, cont func(io.Reader) error) error {
+	if parent == "" {
+		return shell.CallCont(exec.CommandContext(ctx, "btrfs", "send", FilePath(name)), cont)
+	}
+	return shell.CallCont(exec.CommandContext(ctx, "btrfs", "send", "-p", FilePath(parent), FilePath(name)), cont)
+}
+
+// createNewBranch gets called after commit has been `Recv`ed, it recreates
+// the branch commit was made on from commit. Subvolumes made by Backup are
+// left for Restore.
+func createNewBranch(repo, commit string) error {
+	if isBackup(path.Join(repo, commit)) {
+		return nil
+	}
+	branch := GetMeta(path.Join(repo, commit), "branch")
+	if branch == "" {
+		return fmt.Errorf("Commit %s has no branch.", commit)
+	}
+	if err := SubvolumeDeleteAll(path.Join(repo, branch)); err != nil {
+		return err
+	}
+	return Branch(repo, commit, branch)
+}
+
+// recvPath is where Recv receives commits for repo.
+func recvPath(repo string) string {
+	return path.Join("tmp", "recv", repo)
+}
+
+// Recv receives a commit made by Send in to repo. Commits are received in to
+// a staging directory and only renamed in to repo once they're complete, so
+// repo never contains part of a commit. If we crash while receiving Recover
+// cleans up. Cancelling ctx kills the receive, what had been received is
+// thrown away.
+func Recv(ctx context.Context, repo string, data io.Reader) error {
+	defer invalidateListings()
+	if err := fault(FaultRecv); err != nil {
+		return err
+	}
+	data = faultStream(FaultRecv, data)
+	staging := path.Join(recvPath(repo), uuid.New())
+	if err := MkdirAll(staging); err != nil {
+		return err
+	}
+	defer func() {
+		if err := cleanRecv(staging); err != nil {
+			logger.ErrorContext(ctx, "cleaning up receive", "repo", repo, "err", err)
+		}
+	}()
+	c := exec.CommandContext(ctx, "btrfs", "receive", FilePath(staging))
+	logger.DebugContext(ctx, "running command", "cmd", strings.Join(c.Args, " "))
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := c.StderrPipe()
 	if err != nil {
 		return err
 	}
@@ -367,10 +988,13 @@ func Recv(repo string, data io.Reader) error {
 		return err
 	}
 	n, err := io.Copy(stdin, data)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
-	log.Print("Copied bytes:", n)
+	logger.DebugContext(ctx, "received", "repo", repo, "bytes", n)
 	err = stdin.Close()
 	if err != nil {
 		return err
@@ -378,28 +1002,233 @@ func Recv(repo string, data io.Reader) error {
 
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(stderr)
-	log.Print("Stderr:", buf)
+	if buf.Len() != 0 {
+		logger.DebugContext(ctx, "btrfs receive had output on stderr", "repo", repo, "stderr", buf.String())
+	}
 
 	err = c.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && strings.Contains(buf.String(), "cannot find parent subvolume") {
+		return wrappedError{kind: ErrNotReplica, cause: err,
+			msg: fmt.Sprintf("%s is missing the parent of the commit being received: %s", repo, strings.TrimSpace(buf.String()))}
+	}
 	if err != nil {
 		return err
 	}
-	createNewBranch(repo)
+	received, err := ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, commit := range received {
+		if err := Rename(path.Join(staging, commit.Name()), path.Join(repo, commit.Name())); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(repo); err != nil {
+		return err
+	}
+	for _, commit := range received {
+		if err := createNewBranch(repo, commit.Name()); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// cleanRecv deletes a staging directory made by Recv and anything left in it.
+func cleanRecv(staging string) error {
+	subvolumes, err := ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	for _, subvolume := range subvolumes {
+		if err := SubvolumeDelete(path.Join(staging, subvolume.Name())); err != nil {
+			return err
+		}
+	}
+	return RemoveAll(staging)
+}
+
+// isReceived returns true if name was made by Recv.
+func isReceived(name string) (bool, error) {
+	var res bool
+	err := shell.CallCont(exec.Command("btrfs", "subvolume", "show", FilePath(name)),
+		func(r io.Reader) error {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				// The line we want looks like: "Received UUID: -"
+				fields := strings.Fields(scanner.Text())
+				if len(fields) == 3 && fields[0] == "Received" && fields[1] == "UUID:" {
+					res = fields[2] != "-"
+				}
+			}
+			return scanner.Err()
+		})
+	return res, err
+}
+
+// Recover cleans up repo after a crash. Commits and branches are snapshots,
+// which are durable once they're made, but a crash can still come between
+// making one and recording it. Recover deletes commits that were being
+// received or backed up, finishes Finalizes whose commit was made, and points branches at
+// commits that were made from them but not recorded as their parents. It
+// should be called on startup, before repo is used.
+func Recover(repo string) error {
+	for _, dir := range []string{recvPath(repo), backupPath(repo)} {
+		exists, err := FileExists(dir)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		stagings, err := ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, staging := range stagings {
+			logger.Info("deleting interrupted receive", "staging", path.Join(dir, staging.Name()))
+			if err := cleanRecv(path.Join(dir, staging.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	exists, err := FileExists(repo)
+	if err != nil || !exists {
+		return err
+	}
+
+	exists, err = FileExists(path.Dir(preparedPath(repo, "")))
+	if err != nil {
+		return err
+	}
+	if exists {
+		prepared, err := ReadDir(path.Dir(preparedPath(repo, "")))
+		if err != nil {
+			return err
+		}
+		for _, commit := range prepared {
+			committed, err := FileExists(path.Join(repo, commit.Name()))
+			if err != nil {
+				return err
+			}
+			if !committed {
+				// Still waiting to be finalized or aborted.
+				continue
+			}
+			logger.Info("finishing interrupted finalize", "commit", path.Join(repo, commit.Name()))
+			branch := GetMeta(preparedPath(repo, commit.Name()), "branch")
+			if err := SetMeta(path.Join(repo, branch), "parent", commit.Name()); err != nil {
+				return err
+			}
+			if err := SubvolumeDelete(preparedPath(repo, commit.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	var names []string
+	if err := Commits(repo, "", Asc, func(c CommitInfo) error {
+		names = append(names, c.Path)
+		return nil
+	}); err != nil {
+		return err
+	}
+	readOnly := make(map[string]bool)
+	for _, name := range names {
+		isReadOnly, err := IsReadOnly(path.Join(repo, name))
+		if err != nil {
+			return err
+		}
+		readOnly[name] = isReadOnly
+	}
+	// child finds the commit that was made from branch when its parent was
+	// parent.
+	child := func(branch, parent string) string {
+		for _, name := range names {
+			if readOnly[name] && name != parent && GetMeta(path.Join(repo, name), "branch") == branch &&
+				GetMeta(path.Join(repo, name), "parent") == parent && !isBackup(path.Join(repo, name)) {
+				return name
+			}
+		}
+		return ""
+	}
+	for _, branch := range names {
+		if readOnly[branch] || GetMeta(path.Join(repo, branch), "branch") != branch {
+			continue
+		}
+		for commit := child(branch, GetMeta(path.Join(repo, branch), "parent")); commit != ""; commit = child(branch, commit) {
+			logger.Info("pointing branch at interrupted commit", "branch", path.Join(repo, branch), "commit", commit)
+			received, err := isReceived(path.Join(repo, commit))
+			if err != nil {
+				return err
+			}
+			if received {
+				// The branch is a snapshot of the commit before, so it
+				// needs to be remade.
+				err = createNewBranch(repo, commit)
+			} else {
+				err = SetMeta(path.Join(repo, branch), "parent", commit)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// InitOptions configure new repos.
+type InitOptions struct {
+	// Compression is the compression algorithm for the repo's files, see
+	// SetCompression.
+	Compression string
+	// Quota limits the repo's size in bytes, see SetQuota. 0 means no limit.
+	Quota int64
+	// Permissions keeps the modes and owners files are written with, see
+	// SetPreservePermissions.
+	Permissions bool
+}
+
 // Init initializes an empty repo.
 func Init(repo string) error {
+	return InitWithOptions(repo, InitOptions{})
+}
+
+// InitWithOptions initializes an empty repo configured by opts.
+func InitWithOptions(repo string, opts InitOptions) error {
+	if err := ValidCompression(opts.Compression); err != nil {
+		return err
+	}
 	if err := SubvolumeCreate(repo); err != nil {
 		return err
 	}
 	if err := SubvolumeCreate(path.Join(repo, "master")); err != nil {
 		return err
 	}
+	if opts.Compression != "" {
+		// Commits and branches are snapshots of master so they inherit
+		// this.
+		if err := SetCompression(repo, opts.Compression); err != nil {
+			return err
+		}
+	}
+	if opts.Quota != 0 {
+		if err := SetQuota(repo, opts.Quota); err != nil {
+			return err
+		}
+	}
+	if opts.Permissions {
+		if err := SetPreservePermissions(repo, true); err != nil {
+			return err
+		}
+	}
 	if err := SetMeta(path.Join(repo, "master"), "branch", "master"); err != nil {
 		return err
 	}
-	if err := Commit(repo, "t0", "master"); err != nil {
+	if _, err := Commit(repo, "t0", "master"); err != nil {
 		return err
 	}
 	return nil
@@ -408,6 +1237,11 @@ func Init(repo string) error {
 // Ensure is like Init but won't error if the repo is already present. It will
 // error if the repo is not present and we fail to make it.
 func Ensure(repo string) error {
+	return EnsureWithOptions(repo, InitOptions{})
+}
+
+// EnsureWithOptions is like Ensure but initializes the repo with opts.
+func EnsureWithOptions(repo string, opts InitOptions) error {
 	exists, err := FileExists(repo)
 	if err != nil {
 		return err
@@ -415,7 +1249,7 @@ func Ensure(repo string) error {
 	if exists {
 		return nil
 	} else {
-		return Init(repo)
+		return InitWithOptions(repo, opts)
 	}
 }
 
@@ -438,46 +1272,377 @@ func EnsureReplica(repo string) error {
 	}
 }
 
-// Commit creates a new commit for a branch.
-func Commit(repo, commit, branch string) error {
+var lastCommitTime time.Time
+var commitIdLock sync.Mutex
+
+// NewCommitId generates a unique commit id. Ids sort in the order they were
+// generated in, they look like: 20150102T150405.000000000Z-aBcDeFgH
+func NewCommitId() string {
+	commitIdLock.Lock()
+	now := time.Now().UTC()
+	if !now.After(lastCommitTime) {
+		now = lastCommitTime.Add(time.Nanosecond)
+	}
+	lastCommitTime = now
+	commitIdLock.Unlock()
+	return fmt.Sprintf("%s-%s", now.Format("20060102T150405.000000000Z"), RandSeq(8))
+}
+
+// maxNameLength is the longest a commit or branch name can be, it's the
+// longest file name btrfs allows.
+const maxNameLength = 255
+
+// ReservedNames are the names of commits and branches pfs makes itself, t0 is
+// every repo's first commit.
+var ReservedNames = []string{"t0"}
+
+// ReservedPrefixes start the names of the commits and branches pfs makes for
+// pipelines, shuffles and backups.
+var ReservedPrefixes = []string{"pipeline-", "shuffle-", "backup-"}
+
+// ValidName returns an error if name isn't safe to use as a commit or branch
+// name. Names are 1 to 255 letters, digits, `-`, `_` and `.` and can't start
+// with `.`, so they can't escape the repo or collide with .meta. Commit,
+// Prepare and Branch reject names that aren't valid.
+func ValidName(name string) error {
+	if name == "" || len(name) > maxNameLength {
+		return errorf(ErrInvalidName, "Names must be between 1 and %d characters.", maxNameLength)
+	}
+	if name[0] == '.' {
+		return errorf(ErrInvalidName, "Invalid name %s, names can't start with `.`.", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return errorf(ErrInvalidName, "Invalid name %s, names may only contain letters, digits, `-`, `_` and `.`.", name)
+		}
+	}
+	return nil
+}
+
+// ValidUserName is like ValidName but also rejects ReservedNames and names
+// that start with ReservedPrefixes, which users shouldn't make. Migration
+// tools that need to recreate commits and branches pfs made can pass
+// allowReserved.
+func ValidUserName(name string, allowReserved bool) error {
+	if err := ValidName(name); err != nil || allowReserved {
+		return err
+	}
+	for _, reserved := range ReservedNames {
+		if name == reserved {
+			return errorf(ErrInvalidName, "%s is a reserved name.", name)
+		}
+	}
+	for _, prefix := range ReservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return errorf(ErrInvalidName, "Invalid name %s, names starting with %s are reserved.", name, prefix)
+		}
+	}
+	return nil
+}
+
+// CommitOptions configure commits.
+type CommitOptions struct {
+	// IfHead, if it's set, makes the commit fail with a HeadMovedError
+	// unless it's the branch's head.
+	IfHead string
+}
+
+// HeadMovedError is returned when a commit's IfHead isn't its branch's head.
+type HeadMovedError struct {
+	Branch   string
+	Head     string
+	Expected string
+}
+
+func (e HeadMovedError) Error() string {
+	return fmt.Sprintf("Branch %s's head is %s, not %s.", e.Branch, e.Head, e.Expected)
+}
+
+// Head returns branch's head, the last commit made from it.
+func Head(repo, branch string) string {
+	return GetMeta(path.Join(repo, branch), "parent")
+}
+
+// Commit creates a new commit for a branch. If commit is empty a name is
+// generated with NewCommitId. It returns the name of the commit.
+func Commit(repo, commit, branch string) (string, error) {
+	return CommitWithOptions(repo, commit, branch, CommitOptions{})
+}
+
+// CommitWithOptions is like Commit but configured by opts.
+func CommitWithOptions(repo, commit, branch string, opts CommitOptions) (string, error) {
+	if err := checkFrozen(repo); err != nil {
+		return "", err
+	}
+	if commit == "" {
+		commit = NewCommitId()
+	}
+	if err := ValidName(commit); err != nil {
+		return "", err
+	}
 	// check to make sure that the branch actually exists
 	exists, err := FileExists(path.Join(repo, branch))
 	if err != nil {
-		return err
+		return "", err
 	}
 	if !exists {
-		return fmt.Errorf("Branch %s not found.", branch)
+		return "", errorf(ErrBranchNotFound, "Branch %s not found.", branch)
+	}
+	lock, err := LockBranch(repo, branch)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	parent := GetMeta(path.Join(repo, branch), "parent")
+	if opts.IfHead != "" && opts.IfHead != parent {
+		return "", HeadMovedError{Branch: branch, Head: parent, Expected: opts.IfHead}
+	}
+	exists, err = FileExists(path.Join(repo, commit))
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", errorf(ErrCommitExists, "Commit %s already exists.", commit)
+	}
+	if err := runHook(repo, "pre-commit", branch, parent); err != nil {
+		return "", err
+	}
+	if err := setCommitTime(path.Join(repo, branch)); err != nil {
+		return "", err
 	}
 	// Snapshot the branch
-	if err := Snapshot(path.Join(repo, branch), path.Join(repo, commit), true); err != nil {
-		return err
+	if err := snapshotInRepo(repo, path.Join(repo, branch), path.Join(repo, commit), true); err != nil {
+		return "", err
+	}
+	if err := fault(FaultCommit); err != nil {
+		return "", err
 	}
 
-	// Record the new commit as the parent of this branch
+	// Record the new commit as the parent of this branch, if we crash before
+	// this Recover will do it.
 	if err := SetMeta(path.Join(repo, branch), "parent", commit); err != nil {
+		return "", err
+	}
+
+	// The commit has been made so post-commit hooks can't fail it.
+	if err := runHook(repo, "post-commit", commit, parent); err != nil {
+		logger.Warn("post-commit hook failed", "commit", path.Join(repo, commit), "err", err)
+	}
+	return commit, nil
+}
+
+// setCommitTime records the time on branch as it's committed, so that the
+// commit has it, see CommitTime.
+func setCommitTime(branch string) error {
+	return SetMeta(branch, "time", time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// HookError is returned when a pre-commit hook rejects a commit.
+type HookError struct {
+	Hook   string
+	Output string
+}
+
+func (e HookError) Error() string {
+	return fmt.Sprintf("%s hook failed: %s", e.Hook, e.Output)
+}
+
+// HookPath is where repo's hook is stored. Hooks are executables, the
+// pre-commit hook runs before a branch is committed and the post-commit hook
+// after. Both are passed the path of the branch, or the new commit, followed
+// by the files that changed since its parent and run in that directory. If
+// the pre-commit hook exits non-zero the commit is rejected with a HookError
+// containing the hook's output.
+func HookPath(repo, hook string) string {
+	return path.Join(repo, ".meta", "hooks", hook)
+}
+
+// runHook runs repo's hook, if it has one, on name.
+func runHook(repo, hook, name, parent string) error {
+	exists, err := FileExists(HookPath(repo, hook))
+	if err != nil || !exists {
+		return err
+	}
+	args := []string{FilePath(path.Join(repo, name))}
+	if parent != "" {
+		files, err := FindNew(repo, parent, name)
+		if err != nil {
+			return err
+		}
+		args = append(args, files...)
+	}
+	c := exec.Command(FilePath(HookPath(repo, hook)), args...)
+	c.Dir = FilePath(path.Join(repo, name))
+	logger.Info("running hook", "hook", hook, "name", path.Join(repo, name))
+	if output, err := c.CombinedOutput(); err != nil {
+		return HookError{Hook: hook, Output: strings.TrimSpace(fmt.Sprintf("%s\n%s", output, err))}
+	}
+	return nil
+}
+
+// preparedPath is where Prepare puts the snapshot for commit.
+func preparedPath(repo, commit string) string {
+	return path.Join("tmp", "prepared", repo, commit)
+}
+
+// Prepare is the first phase of a two phase commit. It snapshots branch so
+// that Finalize can turn the snapshot in to commit. Writes to branch after
+// Prepare won't be in the commit. Prepared commits that won't be finalized
+// must be cleaned up with Abort.
+func Prepare(repo, commit, branch string) error {
+	return PrepareWithOptions(repo, commit, branch, CommitOptions{})
+}
+
+// PrepareWithOptions is like Prepare but configured by opts. opts.IfHead is
+// only checked here, Finalize checks that the head hasn't moved since.
+func PrepareWithOptions(repo, commit, branch string, opts CommitOptions) error {
+	if err := checkFrozen(repo); err != nil {
+		return err
+	}
+	if err := ValidName(commit); err != nil {
+		return err
+	}
+	exists, err := FileExists(path.Join(repo, branch))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errorf(ErrBranchNotFound, "Branch %s not found.", branch)
+	}
+	lock, err := LockBranch(repo, branch)
+	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
+	parent := GetMeta(path.Join(repo, branch), "parent")
+	if opts.IfHead != "" && opts.IfHead != parent {
+		return HeadMovedError{Branch: branch, Head: parent, Expected: opts.IfHead}
+	}
+	if err := runHook(repo, "pre-commit", branch, parent); err != nil {
+		return err
+	}
+	for _, name := range []string{path.Join(repo, commit), preparedPath(repo, commit)} {
+		exists, err := FileExists(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errorf(ErrCommitExists, "Commit %s already exists.", commit)
+		}
+	}
+	if err := MkdirAll(path.Dir(preparedPath(repo, commit))); err != nil {
+		return err
+	}
+	if err := setCommitTime(path.Join(repo, branch)); err != nil {
+		return err
+	}
+	return Snapshot(path.Join(repo, branch), preparedPath(repo, commit), true)
+}
 
+// IsPrepared returns true if commit has been prepared but not yet finalized
+// or aborted.
+func IsPrepared(repo, commit string) (bool, error) {
+	return FileExists(preparedPath(repo, commit))
+}
+
+// Finalize is the second phase of a two phase commit, it turns a snapshot
+// made by Prepare in to a commit on the branch it was prepared from. It
+// returns a HeadMovedError if the branch has been committed since Prepare,
+// the prepared commit would orphan those commits, and leaves it to be
+// aborted.
+func Finalize(repo, commit string) error {
+	prepared := preparedPath(repo, commit)
+	exists, err := FileExists(prepared)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errorf(ErrCommitNotFound, "Commit %s hasn't been prepared.", commit)
+	}
+	branch := GetMeta(prepared, "branch")
+	parent := GetMeta(prepared, "parent")
+	lock, err := LockBranch(repo, branch)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if head := GetMeta(path.Join(repo, branch), "parent"); head != parent {
+		return HeadMovedError{Branch: branch, Head: head, Expected: parent}
+	}
+	if err := snapshotInRepo(repo, prepared, path.Join(repo, commit), true); err != nil {
+		return err
+	}
+	if err := fault(FaultCommit); err != nil {
+		return err
+	}
+	if err := SetMeta(path.Join(repo, branch), "parent", commit); err != nil {
+		return err
+	}
+	if err := SubvolumeDelete(prepared); err != nil {
+		return err
+	}
+	if err := runHook(repo, "post-commit", commit, parent); err != nil {
+		logger.Warn("post-commit hook failed", "commit", path.Join(repo, commit), "err", err)
+	}
 	return nil
 }
 
+// Abort throws away a commit made by Prepare.
+func Abort(repo, commit string) error {
+	return SubvolumeDeleteAll(preparedPath(repo, commit))
+}
+
 // Hold creates a temporary snapshot of a commit that no one else knows about.
 // It's your responsibility to release the snapshot with Release
 func Hold(repo, commit string) (string, error) {
-	MkdirAll("tmp")
 	name := path.Join("tmp", uuid.New())
-	if err := Snapshot(path.Join(repo, commit), name, false); err != nil {
+	if err := HoldAs(repo, commit, name); err != nil {
 		return "", err
 	}
 	return name, nil
 }
 
+// HoldAs is like Hold but names the snapshot, so that holds can be found
+// again after a restart. It's also released with Release.
+func HoldAs(repo, commit, name string) error {
+	MkdirAll(path.Dir(name))
+	return Snapshot(path.Join(repo, commit), name, false)
+}
+
 // Release releases commit snapshots held by Hold.
 func Release(name string) {
 	SubvolumeDelete(name)
 }
 
+// BranchOptions configure new branches.
+type BranchOptions struct {
+	// Quota limits the branch's size in bytes, see SetBranchQuota. 0 means
+	// no limit.
+	Quota int64
+}
+
 func Branch(repo, commit, branch string) error {
+	return BranchWithOptions(repo, commit, branch, BranchOptions{})
+}
+
+// BranchWithOptions creates branch from commit, configured by opts.
+func BranchWithOptions(repo, commit, branch string, opts BranchOptions) error {
+	if err := checkFrozen(repo); err != nil {
+		return err
+	}
+	if opts.Quota < 0 {
+		return fmt.Errorf("Invalid quota %d.", opts.Quota)
+	}
+	if err := ValidName(branch); err != nil {
+		return err
+	}
+	exists, err := FileExists(path.Join(repo, commit))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errorf(ErrCommitNotFound, "Commit %s not found.", commit)
+	}
 	// Check that the commit is read only
 	isReadOnly, err := IsReadOnly(path.Join(repo, commit))
 	if err != nil {
@@ -488,16 +1653,16 @@ func Branch(repo, commit, branch string) error {
 	}
 
 	// Check that the branch doesn't exist
-	exists, err := FileExists(path.Join(repo, branch))
+	exists, err = FileExists(path.Join(repo, branch))
 	if err != nil {
 		return err
 	}
 	if exists {
-		return fmt.Errorf("Branch \"%s\" already exists.", branch)
+		return errorf(ErrBranchExists, "Branch \"%s\" already exists.", branch)
 	}
 
 	// Create a writeable subvolume for the branch
-	if err := Snapshot(path.Join(repo, commit), path.Join(repo, branch), false); err != nil {
+	if err := snapshotInRepo(repo, path.Join(repo, commit), path.Join(repo, branch), false); err != nil {
 		return err
 	}
 
@@ -510,17 +1675,44 @@ func Branch(repo, commit, branch string) error {
 	if err := SetMeta(path.Join(repo, branch), "branch", branch); err != nil {
 		return err
 	}
+	if opts.Quota != 0 {
+		return SetBranchQuota(repo, branch, opts.Quota)
+	}
 	return nil
 }
 
-// Constants used for passing to log
+// Order is the order commits are listed in, by when they were made.
+type Order int
+
 const (
-	Desc = iota
-	Asc  = iota
+	// Desc lists the newest commits first.
+	Desc Order = iota
+	// Asc lists the oldest commits first.
+	Asc
 )
 
-//Log returns all of the commits the repo which have generation >= from.
-func Log(repo, from string, order int, cont func(io.Reader) error) error {
+func (o Order) String() string {
+	if o == Asc {
+		return "asc"
+	}
+	return "desc"
+}
+
+// ParseOrder parses "asc" or "desc", "" is Desc.
+func ParseOrder(s string) (Order, error) {
+	switch s {
+	case "", "desc":
+		return Desc, nil
+	case "asc":
+		return Asc, nil
+	}
+	return Desc, fmt.Errorf("Invalid order %s, it must be asc or desc.", s)
+}
+
+// Log returns all of the commits the repo which have generation >= from.
+// It streams btrfs's own output, which is meant for humans, LogEntries
+// parses it.
+func Log(repo, from string, order Order, cont func(io.Reader) error) error {
 	var sort string
 	if order == Desc {
 		sort = "-ogen"
@@ -529,39 +1721,89 @@ func Log(repo, from string, order int, cont func(io.Reader) error) error {
 	}
 
 	if from == "" {
-		c := exec.Command("btrfs", "subvolume", "list", "-o", "-c", "-u", "-q", "--sort", sort, FilePath(path.Join(repo)))
+		c := exec.Command("btrfs", "subvolume", "list", "-o", "-c", "-u", "-q", "-R", "--sort", sort, FilePath(path.Join(repo)))
 		return shell.CallCont(c, cont)
 	} else {
 		t, err := transid(repo, from)
 		if err != nil {
 			return err
 		}
-		c := exec.Command("btrfs", "subvolume", "list", "-o", "-c", "-u", "-q", "-C", "+"+t, "--sort", sort, FilePath(path.Join(repo)))
+		c := exec.Command("btrfs", "subvolume", "list", "-o", "-c", "-u", "-q", "-R", "-C", "+"+t, "--sort", sort, FilePath(path.Join(repo)))
 		return shell.CallCont(c, cont)
 	}
 }
 
-type CommitInfo struct {
-	gen, id, parent, Path string
+// LogEntry is a subvolume in a repo, as listed by LogEntries.
+type LogEntry struct {
+	// Path is the subvolume's name in the repo, like a commit or branch.
+	Path string
+	// Transid is the last transaction that changed the subvolume, see
+	// Transid, and CTransid the one that created it.
+	Transid, CTransid uint64
+	// UUID identifies the subvolume. ParentUUID is the subvolume it was
+	// snapshotted from and ReceivedUUID the one it was received from on
+	// the sending side, they're empty if it wasn't.
+	UUID, ParentUUID, ReceivedUUID string
 }
 
-var Complete = errors.New("Complete")
+// parseLogEntry parses a line of Log's output, which looks like:
+// ID 299 gen 67 cgen 66 top level 292 parent_uuid 7a4a824b-7b78-d144-a956-eb0229616d21 received_uuid - uuid c1cd770c-600b-a744-940c-835bf73b5fa9 path repo/25853824-60a8-4d32-9168-adfce78a6c91
+// Columns are found by name, so versions of btrfs that order them
+// differently still parse.
+func parseLogEntry(line string) (LogEntry, error) {
+	var e LogEntry
+	malformed := fmt.Errorf("Malformed commit line: %s.", line)
+	fields := make(map[string]string)
+	tokens := strings.Split(line, " ")
+	for i := 0; i < len(tokens); i += 2 {
+		key := tokens[i]
+		if key == "top" && i+1 < len(tokens) && tokens[i+1] == "level" {
+			key, i = "top level", i+1
+		}
+		if key == "path" {
+			// Paths are last, and might have spaces in them.
+			fields[key] = strings.Join(tokens[i+1:], " ")
+			break
+		}
+		if i+1 >= len(tokens) {
+			return e, malformed
+		}
+		fields[key] = tokens[i+1]
+	}
+	p, ok := fields["path"]
+	if !ok || fields["gen"] == "" || fields["uuid"] == "" {
+		return e, malformed
+	}
+	_, e.Path = path.Split(p) // we want to returns paths without the repo/ before them
+	var err error
+	if e.Transid, err = strconv.ParseUint(fields["gen"], 10, 64); err != nil {
+		return e, malformed
+	}
+	if cgen, ok := fields["cgen"]; ok {
+		if e.CTransid, err = strconv.ParseUint(cgen, 10, 64); err != nil {
+			return e, malformed
+		}
+	}
+	uuid := func(key string) string {
+		if fields[key] == "-" {
+			return ""
+		}
+		return fields[key]
+	}
+	e.UUID, e.ParentUUID, e.ReceivedUUID = uuid("uuid"), uuid("parent_uuid"), uuid("received_uuid")
+	return e, nil
+}
 
-// Commits is a wrapper around `Log` which parses the output in to a convenient
-// struct
-func Commits(repo, from string, order int, cont func(CommitInfo) error) error {
+// LogEntries is Log parsed, it calls cont with each subvolume in turn.
+func LogEntries(repo, from string, order Order, cont func(LogEntry) error) error {
 	return Log(repo, from, order, func(r io.Reader) error {
 		scanner := bufio.NewScanner(r)
 		for scanner.Scan() {
-			// scanner.Text() looks like:
-			// ID 299 gen 67 cgen 66 top level 292 parent_uuid 7a4a824b-7b78-d144-a956-eb0229616d21 uuid c1cd770c-600b-a744-940c-835bf73b5fa9 path repo/25853824-60a8-4d32-9168-adfce78a6c91
-			// 0  1   2   3  4    5  6   7     8   9           10                                   11   12                                   13   14
-			tokens := strings.Split(scanner.Text(), " ")
-			if len(tokens) != 15 {
-				return fmt.Errorf("Malformed commit line: %s.", scanner.Text())
+			e, err := parseLogEntry(scanner.Text())
+			if err != nil {
+				return err
 			}
-			_, p := path.Split(tokens[14]) // we want to returns paths without the repo/ before them
-			if err := cont(CommitInfo{gen: tokens[3], id: tokens[12], parent: tokens[10], Path: p}); err != nil {
+			if err := cont(e); err != nil {
 				return err
 			}
 		}
@@ -572,29 +1814,133 @@ func Commits(repo, from string, order int, cont func(CommitInfo) error) error {
 	})
 }
 
+// CommitInfo is a subvolume in a repo, as listed by Commits.
+type CommitInfo struct {
+	id, parent, Path string
+	// Transid is the last transaction that changed the subvolume, see
+	// Transid.
+	Transid uint64
+}
+
+var Complete = errors.New("Complete")
+
+// Commits is a wrapper around `LogEntries` for callers that only need
+// names.
+func Commits(repo, from string, order Order, cont func(CommitInfo) error) error {
+	return LogEntries(repo, from, order, func(e LogEntry) error {
+		return cont(CommitInfo{Transid: e.Transid, id: e.UUID, parent: e.ParentUUID, Path: e.Path})
+	})
+}
+
 // GetFrom returns the commit that this repo should pass to Pull to get itself up
 // to date.
 func GetFrom(repo string) (string, error) {
-	from := ""
-	err := Commits(repo, "", Desc, func(c CommitInfo) error {
-		isCommit, err := IsReadOnly(path.Join(repo, c.Path))
+	subvolumes, err := Listing(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range subvolumes {
+		if s.Commit {
+			return s.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// FsckProblem is an inconsistency found by Fsck.
+type FsckProblem struct {
+	// Name is the commit or branch with the problem.
+	Name    string
+	Problem string
+	// Repaired is true if Fsck fixed the problem.
+	Repaired bool
+}
+
+// Fsck checks that repo is consistent: every commit and branch has its
+// metadata, commits are read only and branches aren't, and every parent
+// exists. If repair is true it fixes the problems it can, which it only does
+// by changing read only flags and metadata, it never deletes anything.
+//
+// Receives create writable subvolumes and only make them read only when they
+// finish, so a writable commit newer than the last read only one is most
+// likely an interrupted receive. GetFrom ignores it, so it doesn't make the
+// repo's last received commit invalid, but it isn't repaired since it could
+// also be an interrupted Branch.
+func Fsck(repo string, repair bool) ([]FsckProblem, error) {
+	var names []string
+	exists := make(map[string]bool)
+	if err := Commits(repo, "", Asc, func(c CommitInfo) error {
+		names = append(names, c.Path)
+		exists[c.Path] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	readOnly := make(map[string]bool)
+	last := -1
+	for i, name := range names {
+		isReadOnly, err := IsReadOnly(path.Join(repo, name))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if isCommit {
-			from = c.Path
-			return Complete
+		readOnly[name] = isReadOnly
+		if isReadOnly {
+			last = i
 		}
-		return nil
-	})
-	if err != nil && err != Complete {
-		return "", err
 	}
 
-	return from, nil
+	var problems []FsckProblem
+	report := func(name, problem string, fix func() error) error {
+		p := FsckProblem{Name: name, Problem: problem}
+		if repair && fix != nil {
+			if err := fix(); err != nil {
+				return err
+			}
+			p.Repaired = true
+		}
+		problems = append(problems, p)
+		return nil
+	}
+	for i, name := range names {
+		subvolume := path.Join(repo, name)
+		isBranch := GetMeta(subvolume, "branch") == name
+		metaExists, err := FileExists(path.Join(subvolume, ".meta", "branch"))
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !readOnly[name] && !isBranch && i > last:
+			err = report(name, "Writable commit newer than the last commit, probably an interrupted receive.", nil)
+		case !metaExists && readOnly[name]:
+			err = report(name, "Commit is missing its branch metadata.", nil)
+		case !metaExists:
+			err = report(name, "Branch is missing its branch metadata.", func() error {
+				return SetMeta(subvolume, "branch", name)
+			})
+		case isBranch && readOnly[name]:
+			err = report(name, "Branch is read only.", func() error {
+				return UnsetReadOnly(subvolume)
+			})
+		case !isBranch && !readOnly[name]:
+			err = report(name, "Commit isn't read only.", func() error {
+				return SetReadOnly(subvolume)
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if parent := GetMeta(subvolume, "parent"); parent != "" && !exists[parent] {
+			if err := report(name, fmt.Sprintf("Parent %s doesn't exist.", parent), nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return problems, nil
 }
 
-func Pull(repo, from string, cb Pusher) error {
+// Pull sends the commits in repo after from to cb, oldest first. Cancelling
+// ctx stops it, commits that were already pushed stay pushed.
+func Pull(ctx context.Context, repo, from string, cb Pusher) error {
 	// First check that `from` is actually a valid commit
 	if from != "" {
 		exists, err := FileExists(path.Join(repo, from))
@@ -602,7 +1948,7 @@ func Pull(repo, from string, cb Pusher) error {
 			return err
 		}
 		if !exists {
-			return fmt.Errorf("`from` commit %s does not exists", from)
+			return errorf(ErrCommitNotFound, "`from` commit %s does not exists", from)
 		}
 		// from should also be a commit not a branch
 		isCommit, err := IsReadOnly(path.Join(repo, from))
@@ -615,6 +1961,9 @@ func Pull(repo, from string, cb Pusher) error {
 	}
 
 	err := Commits(repo, from, Asc, func(c CommitInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if c.Path == from {
 			// Commits gives us things >= `from` so we explicitly skip `from`
 			return nil
@@ -625,9 +1974,18 @@ func Pull(repo, from string, cb Pusher) error {
 			return err
 		}
 		if isCommit {
-			err := Send(repo, c.Path, cb.Push)
+			if err := fault(FaultPull); err != nil {
+				return err
+			}
+			err := Send(ctx, repo, c.Path, func(diff io.Reader) error {
+				if cp, ok := cb.(CommitPusher); ok {
+					info := SentCommit{Repo: repo, Name: c.Path, Parent: GetMeta(path.Join(repo, c.Path), "parent")}
+					return cp.PushCommit(ctx, info, diff)
+				}
+				return cb.Push(ctx, diff)
+			})
 			if err != nil {
-				log.Print(err)
+				logger.ErrorContext(ctx, "sending commit", "commit", path.Join(repo, c.Path), "err", err)
 				return err
 			}
 		}
@@ -671,9 +2029,22 @@ func transid(repo, commit string) (string, error) {
 	return transid, err
 }
 
+// Transid returns the transid of commit, the last btrfs transaction that
+// changed it. Transids only go up, so they order commits across branches:
+// a commit with a lower transid was made first. They're local to the volume,
+// the same commit has a different transid on a replica.
+func Transid(repo, commit string) (uint64, error) {
+	t, err := transid(repo, commit)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(t, 10, 64)
+}
+
 // FindNew returns an array of filenames that were created between `from` and `to`
 func FindNew(repo, from, to string) ([]string, error) {
 	var files []string
+	seen := make(map[string]bool) // files with several extents show up more than once
 	t, err := transid(repo, from)
 	if err != nil {
 		return files, err
@@ -688,7 +2059,8 @@ func FindNew(repo, from, to string) ([]string, error) {
 			tokens := strings.Split(scanner.Text(), " ")
 			// Make sure the line is parseable as a file and the path isn't hidden.
 			if len(tokens) == 17 {
-				if !strings.HasPrefix(tokens[16], ".") { // check if it's a hidden file
+				if !strings.HasPrefix(tokens[16], ".") && !seen[tokens[16]] { // check if it's a hidden file
+					seen[tokens[16]] = true
 					files = append(files, tokens[16])
 				}
 			} else if len(tokens) == 4 {
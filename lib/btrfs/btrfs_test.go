@@ -2,7 +2,10 @@ package btrfs
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,14 +13,17 @@ import (
 	"path"
 	"reflect"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var run_string string
 
-func check(err error, t *testing.T) {
+func check(err error, t testing.TB) {
 	if err != nil {
 		debug.PrintStack()
 		t.Fatal(err)
@@ -52,6 +58,12 @@ func writeLots(prefix string, nFiles int, t *testing.T) {
 	}
 }
 
+// commit commits branch as name and fails the test if it can't.
+func commit(repo, name, branch string, t *testing.T) {
+	_, err := Commit(repo, name, branch)
+	check(err, t)
+}
+
 // checkFile checks if a file on disk contains a given string.
 func checkFile(name, content string, t *testing.T) {
 	exists, err := FileExists(name)
@@ -110,7 +122,7 @@ func TestGit(t *testing.T) {
 	if !testing.Short() {
 		writeLots(fmt.Sprintf("%s/master/big_file", srcRepo), 3, t)
 	}
-	err := Commit(srcRepo, "commit1", "master")
+	_, err := Commit(srcRepo, "commit1", "master")
 	check(err, t)
 	checkFile(path.Join(srcRepo, "commit1", "file"), "foo", t)
 
@@ -125,7 +137,7 @@ func TestGit(t *testing.T) {
 	if !testing.Short() {
 		writeLots(fmt.Sprintf("%s/master/big_file", srcRepo), 3, t)
 	}
-	err = Commit(srcRepo, "commit2", "branch")
+	_, err = Commit(srcRepo, "commit2", "branch")
 	check(err, t)
 	checkFile(path.Join(srcRepo, "commit2", "file2"), "foo", t)
 
@@ -153,7 +165,7 @@ func TestCommitsAreReadOnly(t *testing.T) {
 	srcRepo := "repo_TestCommitsAreReadOnly"
 	check(Init(srcRepo), t)
 
-	err := Commit(srcRepo, "commit1", "master")
+	_, err := Commit(srcRepo, "commit1", "master")
 	check(err, t)
 
 	_, err = Create(fmt.Sprintf("%s/commit1/file", srcRepo))
@@ -199,7 +211,7 @@ func TestSendRecv(t *testing.T) {
 	}
 
 	// Create a commit in the source repo:
-	check(Commit(srcRepo, "mycommit1", "master"), t)
+	commit(srcRepo, "mycommit1", "master", t)
 
 	// Create another file in the source repo:
 	writeFile(fmt.Sprintf("%s/master/myfile2", srcRepo), "bar", t)
@@ -210,13 +222,13 @@ func TestSendRecv(t *testing.T) {
 	}
 
 	// Create a another commit in the source repo:
-	check(Commit(srcRepo, "mycommit2", "master"), t)
+	commit(srcRepo, "mycommit2", "master", t)
 
 	// Create a destination repo:
 	dstRepo := "repo_TestSendRecv_dst"
 	check(InitReplica(dstRepo), t)
-	repo2Recv := func(r io.Reader) error { return Recv(dstRepo, r) }
-	check(Send(srcRepo, "t0", repo2Recv), t)
+	repo2Recv := func(r io.Reader) error { return Recv(context.Background(), dstRepo, r) }
+	check(Send(context.Background(), srcRepo, "t0", repo2Recv), t)
 
 	// Verify that the commits "mycommit1" and "mycommit2" do not exist in destination:
 	checkNoFile(fmt.Sprintf("%s/mycommit1", dstRepo), t)
@@ -224,14 +236,14 @@ func TestSendRecv(t *testing.T) {
 
 	// Run a Send/Recv operation to fetch data from the older "mycommit1".
 	// This verifies that tree copying works:
-	check(Send(srcRepo, "mycommit1", repo2Recv), t)
+	check(Send(context.Background(), srcRepo, "mycommit1", repo2Recv), t)
 
 	// Check that the file from mycommit1 exists, but not from mycommit2:
 	checkFile(fmt.Sprintf("%s/mycommit1/myfile1", dstRepo), "foo", t)
 	checkNoFile(fmt.Sprintf("%s/mycommit2/myfile2", dstRepo), t)
 
 	// Send again, this time starting from mycommit1 and going to mycommit2:
-	check(Send(srcRepo, "mycommit2", repo2Recv), t)
+	check(Send(context.Background(), srcRepo, "mycommit2", repo2Recv), t)
 
 	// Verify that files from both commits are present:
 	checkFile(fmt.Sprintf("%s/mycommit1/myfile1", dstRepo), "foo", t)
@@ -255,7 +267,7 @@ func TestCommitsAreReplicated(t *testing.T) {
 	}
 
 	// Create a commit in the source repo:
-	check(Commit(srcRepo, "mycommit1", "master"), t)
+	commit(srcRepo, "mycommit1", "master", t)
 
 	// Create another file in the source repo:
 	writeFile(fmt.Sprintf("%s/master/myfile2", srcRepo), "bar", t)
@@ -266,7 +278,7 @@ func TestCommitsAreReplicated(t *testing.T) {
 	}
 
 	// Create a another commit in the source repo:
-	check(Commit(srcRepo, "mycommit2", "master"), t)
+	commit(srcRepo, "mycommit2", "master", t)
 
 	// Create a destination repo:
 	dstRepo := "repo_TestCommitsAreReplicated_dst"
@@ -281,13 +293,21 @@ func TestCommitsAreReplicated(t *testing.T) {
 	checkNoFile(fmt.Sprintf("%s/mycommit2", dstRepo), t)
 
 	// Run a Pull/Recv operation to fetch all commits:
-	err := Pull(srcRepo, "", NewLocalReplica(dstRepo))
+	err := Pull(context.Background(), srcRepo, "", NewLocalReplica(dstRepo))
 	check(err, t)
 
 	// Verify that files from both commits are present:
 	checkFile(fmt.Sprintf("%s/mycommit1/myfile1", dstRepo), "foo", t)
 	checkFile(fmt.Sprintf("%s/mycommit2/myfile2", dstRepo), "bar", t)
 
+	// Received commits say so in the log.
+	check(LogEntries(dstRepo, "", Asc, func(e LogEntry) error {
+		if e.Path == "mycommit1" && e.ReceivedUUID == "" {
+			t.Fatalf("Received commit %+v should have a received uuid.", e)
+		}
+		return nil
+	}), t)
+
 	// Now check that we can use dstRepo as the source for replication
 	// Create a second dest repo:
 	dstRepo2 := "repo_TestCommitsAreReplicated_dst2"
@@ -298,7 +318,7 @@ func TestCommitsAreReplicated(t *testing.T) {
 	checkNoFile(fmt.Sprintf("%s/mycommit2", dstRepo2), t)
 
 	// Run a Pull/Recv operation to fetch all commits:
-	err = Pull(dstRepo, "", NewLocalReplica(dstRepo2))
+	err = Pull(context.Background(), dstRepo, "", NewLocalReplica(dstRepo2))
 	check(err, t)
 
 	// Verify that files from both commits are present:
@@ -320,13 +340,13 @@ func TestSendWithMissingIntermediateCommitIsCorrect(t *testing.T) {
 	writeFile(fmt.Sprintf("%s/master/myfile1", srcRepo), "foo", t)
 
 	// Create a commit in the source repo:
-	check(Commit(srcRepo, "mycommit1", "master"), t)
+	commit(srcRepo, "mycommit1", "master", t)
 
 	// Create another file in the source repo:
 	writeFile(fmt.Sprintf("%s/master/myfile2", srcRepo), "bar", t)
 
 	// Create a another commit in the source repo:
-	check(Commit(srcRepo, "mycommit2", "master"), t)
+	commit(srcRepo, "mycommit2", "master", t)
 
 	// Delete intermediate commit "mycommit1":
 	check(SubvolumeDelete(fmt.Sprintf("%s/mycommit1", srcRepo)), t)
@@ -344,7 +364,7 @@ func TestSendWithMissingIntermediateCommitIsCorrect(t *testing.T) {
 	checkNoFile(fmt.Sprintf("%s/mycommit2", dstRepo), t)
 
 	// Run a Pull/Recv operation to fetch all commits:
-	check(Pull(srcRepo, "t0", NewLocalReplica(dstRepo)), t)
+	check(Pull(context.Background(), srcRepo, "t0", NewLocalReplica(dstRepo)), t)
 
 	// Verify that the commit "mycommit1" does not exist and "mycommit2" does in the destination repo:
 	t.Skipf("TODO(jd,rw): no files were synced")
@@ -359,7 +379,7 @@ func TestBranchesAreNotImplicitlyReplicated(t *testing.T) {
 	check(Init(srcRepo), t)
 
 	// Create a commit in the source repo:
-	check(Commit(srcRepo, "mycommit", "master"), t)
+	commit(srcRepo, "mycommit", "master", t)
 
 	// Create a branch in the source repo:
 	check(Branch(srcRepo, "mycommit", "mybranch"), t)
@@ -369,7 +389,7 @@ func TestBranchesAreNotImplicitlyReplicated(t *testing.T) {
 	check(InitReplica(dstRepo), t)
 
 	// Run a Pull/Recv operation to fetch all commits on master:
-	check(Pull(srcRepo, "", NewLocalReplica(dstRepo)), t)
+	check(Pull(context.Background(), srcRepo, "", NewLocalReplica(dstRepo)), t)
 
 	// Verify that only the commits are replicated, not branches:
 	commitFilename := fmt.Sprintf("%s/mycommit", dstRepo)
@@ -395,7 +415,7 @@ func TestS3Replica(t *testing.T) {
 	}
 
 	// Create a commit in the source repo:
-	check(Commit(srcRepo, "mycommit1", "master"), t)
+	commit(srcRepo, "mycommit1", "master", t)
 
 	// Create another file in the source repo:
 	writeFile(fmt.Sprintf("%s/master/myfile2", srcRepo), "bar", t)
@@ -406,7 +426,7 @@ func TestS3Replica(t *testing.T) {
 	}
 
 	// Create a another commit in the source repo:
-	check(Commit(srcRepo, "mycommit2", "master"), t)
+	commit(srcRepo, "mycommit2", "master", t)
 
 	// Create a destination repo:
 	dstRepo := "repo_TestS3Replica_dst"
@@ -422,11 +442,11 @@ func TestS3Replica(t *testing.T) {
 
 	// Run a Pull to push all commits to s3
 	s3Replica := NewS3Replica(path.Join("pachyderm-test", RandSeq(20)))
-	err := Pull(srcRepo, "", s3Replica)
+	err := Pull(context.Background(), srcRepo, "", s3Replica)
 	check(err, t)
 
 	// Pull commits from s3 to a new local replica
-	err = s3Replica.Pull("", NewLocalReplica(dstRepo))
+	err = s3Replica.Pull(context.Background(), "", NewLocalReplica(dstRepo))
 	check(err, t)
 
 	// Verify that files from both commits are present:
@@ -448,7 +468,7 @@ func TestHoldRelease(t *testing.T) {
 
 	// Create a commit "mycommit" and verify "myfile" exists:
 	mycommit_fn := fmt.Sprintf("%s/mycommit/myfile", srcRepo)
-	check(Commit(srcRepo, "mycommit", "master"), t)
+	commit(srcRepo, "mycommit", "master", t)
 	checkFile(mycommit_fn, "foo", t)
 
 	// Grab a snapshot:
@@ -505,7 +525,7 @@ func TestFindNew(t *testing.T) {
 	checkFindNew([]string{"myfile1"}, repoName, "t0", "master")
 
 	// When that file is commited, then it still shows up in the delta since transid0:
-	check(Commit(repoName, "mycommit1", "master"), t)
+	commit(repoName, "mycommit1", "master", t)
 	// TODO(rw, jd) Shouldn't this pass?
 	checkFindNew([]string{"myfile1"}, repoName, "t0", "mycommit1")
 
@@ -553,15 +573,15 @@ func TestTwoSources(t *testing.T) {
 	// write a file to src1
 	writeFile(fmt.Sprintf("%s/master/file1", src1), "file1", t)
 	// commit it
-	check(Commit(src1, "commit1", "master"), t)
+	commit(src1, "commit1", "master", t)
 	// push it to src2
-	check(NewLocalReplica(src1).Pull("", NewLocalReplica(src2)), t)
+	check(NewLocalReplica(src1).Pull(context.Background(), "", NewLocalReplica(src2)), t)
 	// push it to dst
-	check(NewLocalReplica(src1).Pull("", NewLocalReplica(dst)), t)
+	check(NewLocalReplica(src1).Pull(context.Background(), "", NewLocalReplica(dst)), t)
 
 	writeFile(fmt.Sprintf("%s/master/file2", src2), "file2", t)
-	check(Commit(src2, "commit2", "master"), t)
-	check(NewLocalReplica(src2).Pull("commit1", NewLocalReplica(dst)), t)
+	commit(src2, "commit2", "master", t)
+	check(NewLocalReplica(src2).Pull(context.Background(), "commit1", NewLocalReplica(dst)), t)
 
 	checkFile(fmt.Sprintf("%s/commit1/file1", dst), "file1", t)
 	checkFile(fmt.Sprintf("%s/commit2/file2", dst), "file2", t)
@@ -570,3 +590,1306 @@ func TestTwoSources(t *testing.T) {
 // Case: create, delete, edit files and check that the filenames correspond to the changes ones.
 
 // go test coverage
+
+func TestNewCommitIdsSort(t *testing.T) {
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, NewCommitId())
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i-1] >= ids[i] {
+			t.Fatalf("Commit ids out of order: %s >= %s.", ids[i-1], ids[i])
+		}
+	}
+}
+
+func TestCommitGeneratesId(t *testing.T) {
+	repo := "repo_TestCommitGeneratesId"
+	check(Init(repo), t)
+	writeFile(fmt.Sprintf("%s/master/file", repo), "foo", t)
+	commit1, err := Commit(repo, "", "master")
+	check(err, t)
+	commit2, err := Commit(repo, "", "master")
+	check(err, t)
+	if commit1 == "" || commit1 >= commit2 {
+		t.Fatalf("Bad generated commit ids: %s, %s.", commit1, commit2)
+	}
+	checkFile(path.Join(repo, commit1, "file"), "foo", t)
+}
+
+func writeHook(repo, hook, script string, t *testing.T) {
+	check(MkdirAll(path.Dir(HookPath(repo, hook))), t)
+	check(WriteFile(HookPath(repo, hook), []byte(script)), t)
+	check(os.Chmod(FilePath(HookPath(repo, hook)), 0755), t)
+}
+
+func TestCommitHooks(t *testing.T) {
+	repo := "repo_TestCommitHooks"
+	check(Init(repo), t)
+	// The pre-commit hook rejects commits containing a file called bad, the
+	// post-commit hook records the files that changed.
+	writeHook(repo, "pre-commit", "#!/bin/sh\nshift\nfor f in \"$@\"; do if [ \"$f\" = bad ]; then echo no bad files; exit 1; fi; done\n", t)
+	writeHook(repo, "post-commit", "#!/bin/sh\necho \"$@\" > "+FilePath(path.Join(repo, ".meta", "hooks", "log"))+"\n", t)
+
+	writeFile(fmt.Sprintf("%s/master/good", repo), "foo", t)
+	commit(repo, "commit1", "master", t)
+	data, err := ReadFile(path.Join(repo, ".meta", "hooks", "log"))
+	check(err, t)
+	if string(data) != FilePath(path.Join(repo, "commit1"))+" good\n" {
+		t.Fatalf("Unexpected post-commit hook arguments: %q", data)
+	}
+
+	writeFile(fmt.Sprintf("%s/master/bad", repo), "foo", t)
+	_, err = Commit(repo, "commit2", "master")
+	if hookErr, ok := err.(HookError); !ok || hookErr.Hook != "pre-commit" || !strings.HasPrefix(hookErr.Output, "no bad files") {
+		t.Fatalf("Expected the pre-commit hook to reject the commit, got: %v", err)
+	}
+	checkNoFile(fmt.Sprintf("%s/commit2", repo), t)
+	if err := Prepare(repo, "commit2", "master"); err == nil {
+		t.Fatal("Expected the pre-commit hook to reject the prepare.")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	repo := "repo_TestCompression"
+	check(InitWithOptions(repo, InitOptions{Compression: "zlib"}), t)
+	checkCompression := func(name, expected string) {
+		compression, err := GetCompression(name)
+		check(err, t)
+		if compression != expected {
+			t.Fatalf("%s has compression %q, expected %q.", name, compression, expected)
+		}
+	}
+	checkCompression(repo, "zlib")
+	checkCompression(path.Join(repo, "master"), "zlib")
+	// Branches inherit it from the commits they're made from.
+	check(Branch(repo, "t0", "branch"), t)
+	checkCompression(path.Join(repo, "branch"), "zlib")
+
+	check(SetCompression(repo, "lzo"), t)
+	checkCompression(path.Join(repo, "master"), "lzo")
+	checkCompression(path.Join(repo, "branch"), "lzo")
+	if err := SetCompression(repo, "gzip"); err == nil {
+		t.Fatal("Setting an unsupported compression should fail.")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	repo := "repo_TestQuota"
+	check(InitWithOptions(repo, InitOptions{Quota: 1 << 20}), t)
+	writeFile(fmt.Sprintf("%s/master/file", repo), "foo", t)
+	commit(repo, "commit1", "master", t)
+	usage, err := RepoUsage(repo)
+	check(err, t)
+	if usage.Quota != 1<<20 || usage.Used == 0 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+	f, err := Create(fmt.Sprintf("%s/master/big", repo))
+	check(err, t)
+	_, err = f.Write(make([]byte, 4<<20))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if !IsQuotaExceeded(err) {
+		t.Fatalf("Expected to exceed the quota, got: %v", err)
+	}
+
+	check(BranchWithOptions(repo, "commit1", "branch", BranchOptions{Quota: 1 << 16}), t)
+	usage, err = BranchUsage(repo, "branch")
+	check(err, t)
+	if usage.Quota != 1<<16 {
+		t.Fatalf("Unexpected branch usage: %+v", usage)
+	}
+}
+
+func TestDu(t *testing.T) {
+	repo := "repo_TestDu"
+	check(Init(repo), t)
+	f, err := Create(fmt.Sprintf("%s/master/file", repo))
+	check(err, t)
+	_, err = f.Write(make([]byte, 1<<20))
+	check(err, t)
+	check(f.Close(), t)
+	check(Sync(), t)
+	commit(repo, "commit1", "master", t)
+	check(Sync(), t)
+	du, err := Du(repo, "commit1")
+	check(err, t)
+	// Everything in commit1 is shared with master.
+	if du.Logical < 1<<20 || du.Exclusive != 0 || du.Shared < 1<<20 {
+		t.Fatalf("Unexpected usage for commit1: %+v", du)
+	}
+	check(Remove(fmt.Sprintf("%s/master/file", repo)), t)
+	check(Sync(), t)
+	du, err = Du(repo, "commit1")
+	check(err, t)
+	// Now only commit1 has the file.
+	if du.Exclusive < 1<<20 {
+		t.Fatalf("Unexpected usage for commit1 after deleting from master: %+v", du)
+	}
+}
+
+func TestParseScrubStats(t *testing.T) {
+	stats, err := parseScrubStats(strings.NewReader(`scrub done for 7fb25b83-a4fb-4d3f-a1d5-d6ba1bf3e7b1
+Scrub started:    Mon Jan  5 10:00:00 2015
+Status:           finished
+Duration:         0:00:01
+	data_extents_scrubbed: 4
+	tree_extents_scrubbed: 16
+	data_bytes_scrubbed: 1048576
+	tree_bytes_scrubbed: 262144
+	read_errors: 1
+	csum_errors: 2
+	verify_errors: 0
+	no_csum: 0
+	csum_discards: 0
+	super_errors: 0
+	malloc_errors: 0
+	uncorrectable_errors: 1
+	unverified_errors: 0
+	corrected_errors: 2
+	last_physical: 0
+`))
+	check(err, t)
+	expected := ScrubStats{
+		BytesScrubbed:       1048576 + 262144,
+		CsumErrors:          2,
+		ReadErrors:          1,
+		CorrectedErrors:     2,
+		UncorrectableErrors: 1,
+	}
+	if stats != expected {
+		t.Fatalf("Got %+v, expected %+v.", stats, expected)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	repo := "repo_TestFsck"
+	check(Init(repo), t)
+	commit(repo, "commit1", "master", t)
+	check(Branch(repo, "commit1", "branch1"), t)
+	problems, err := Fsck(repo, false)
+	check(err, t)
+	if len(problems) != 0 {
+		t.Fatalf("Found problems in a new repo: %+v", problems)
+	}
+
+	check(UnsetReadOnly(fmt.Sprintf("%s/t0", repo)), t)
+	check(SetReadOnly(fmt.Sprintf("%s/branch1", repo)), t)
+	check(Remove(fmt.Sprintf("%s/master/.meta/branch", repo)), t)
+	problems, err = Fsck(repo, false)
+	check(err, t)
+	if len(problems) != 3 {
+		t.Fatalf("Expected 3 problems, got: %+v", problems)
+	}
+	problems, err = Fsck(repo, true)
+	check(err, t)
+	for _, p := range problems {
+		if !p.Repaired {
+			t.Fatalf("Problem wasn't repaired: %+v", p)
+		}
+	}
+	problems, err = Fsck(repo, false)
+	check(err, t)
+	if len(problems) != 0 {
+		t.Fatalf("Found problems after repairing: %+v", problems)
+	}
+	isReadOnly, err := IsReadOnly(fmt.Sprintf("%s/t0", repo))
+	check(err, t)
+	if !isReadOnly {
+		t.Fatal("t0 should be read only after repairing.")
+	}
+	if branch := GetMeta(fmt.Sprintf("%s/master", repo), "branch"); branch != "master" {
+		t.Fatalf("master has branch metadata %s after repairing.", branch)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	repo := "repo_TestRecover"
+	check(Init(repo), t)
+	writeFile(fmt.Sprintf("%s/master/file", repo), "foo", t)
+	// A commit whose snapshot was made but which wasn't recorded as
+	// master's parent.
+	check(Snapshot(fmt.Sprintf("%s/master", repo), fmt.Sprintf("%s/commit1", repo), true), t)
+	// An interrupted receive.
+	staging := path.Join(recvPath(repo), "staging")
+	check(MkdirAll(staging), t)
+	check(SubvolumeCreate(path.Join(staging, "commit2")), t)
+
+	check(Recover(repo), t)
+	if parent := GetMeta(fmt.Sprintf("%s/master", repo), "parent"); parent != "commit1" {
+		t.Fatalf("master's parent is %s after recovering, expected commit1.", parent)
+	}
+	checkNoFile(recvPath(repo), t)
+	// Recovering again changes nothing.
+	check(Recover(repo), t)
+	if parent := GetMeta(fmt.Sprintf("%s/master", repo), "parent"); parent != "commit1" {
+		t.Fatalf("master's parent is %s after recovering twice, expected commit1.", parent)
+	}
+}
+
+// testFaults fails at point with err, after letting n bytes through if the
+// point streams.
+type testFaults struct {
+	point string
+	n     int64
+	err   error
+}
+
+func (f testFaults) Fault(point string) error {
+	if point == f.point && f.n < 0 {
+		return f.err
+	}
+	return nil
+}
+
+func (f testFaults) Stream(point string, r io.Reader) io.Reader {
+	if point == f.point && f.n >= 0 {
+		return FailAfter(r, f.n, f.err)
+	}
+	return r
+}
+
+func TestFaults(t *testing.T) {
+	defer SetFaults(nil)
+	repo := "repo_TestFaults"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file"), "foo", t)
+
+	// A full disk after the snapshot is made leaves a commit that Recover
+	// records.
+	SetFaults(testFaults{point: FaultCommit, n: -1, err: syscall.ENOSPC})
+	if _, err := Commit(repo, "commit1", "master"); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Expected ENOSPC from the commit, got %v.", err)
+	}
+	if parent := GetMeta(path.Join(repo, "master"), "parent"); parent == "commit1" {
+		t.Fatal("The failed commit shouldn't be master's parent yet.")
+	}
+	SetFaults(nil)
+	check(Recover(repo), t)
+	if parent := GetMeta(path.Join(repo, "master"), "parent"); parent != "commit1" {
+		t.Fatalf("master's parent is %s after recovering, expected commit1.", parent)
+	}
+
+	// Truncated and dropped streams leave nothing behind in the replica.
+	dst := "repo_TestFaults_dst"
+	check(InitReplica(dst), t)
+	for _, f := range []testFaults{
+		{point: FaultSend, n: 100, err: io.EOF},
+		{point: FaultRecv, n: 100, err: io.ErrUnexpectedEOF},
+		{point: FaultPull, n: -1, err: io.ErrUnexpectedEOF},
+	} {
+		SetFaults(f)
+		if err := Pull(context.Background(), repo, "", NewLocalReplica(dst)); err == nil {
+			t.Fatalf("Pull should fail with a fault at %s.", f.point)
+		}
+		checkNoFile(path.Join(dst, "commit1"), t)
+	}
+	SetFaults(nil)
+	check(Pull(context.Background(), repo, "", NewLocalReplica(dst)), t)
+	checkFile(path.Join(dst, "commit1", "file"), "foo", t)
+}
+
+func TestBranchLock(t *testing.T) {
+	repo := "repo_TestBranchLock"
+	check(Init(repo), t)
+	writer, err := RLockBranch(repo, "master")
+	check(err, t)
+	// Shared locks don't exclude each other.
+	other, err := RLockBranch(repo, "master")
+	check(err, t)
+	check(other.Unlock(), t)
+
+	committed := make(chan error)
+	go func() {
+		_, err := Commit(repo, "commit1", "master")
+		committed <- err
+	}()
+	select {
+	case err := <-committed:
+		t.Fatalf("Commit didn't wait for the writer: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	check(writer.Unlock(), t)
+	check(<-committed, t)
+
+	stuck, err := LockBranch(repo, "master")
+	check(err, t)
+	defer stuck.Unlock()
+	check(ForceUnlock(repo, "master"), t)
+	lock, err := LockBranch(repo, "master")
+	check(err, t)
+	check(lock.Unlock(), t)
+}
+
+// TestValidName checks which commit and branch names are accepted.
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"", ".", "..", ".meta", "a/b", "a b", strings.Repeat("a", 256)} {
+		if ValidName(name) == nil {
+			t.Fatalf("%q should be invalid.", name)
+		}
+	}
+	for _, name := range []string{"commit1", "my-branch", "v1.0_rc", strings.Repeat("a", 255)} {
+		check(ValidName(name), t)
+		check(ValidUserName(name, false), t)
+	}
+	for _, name := range []string{"t0", "pipeline-wc", "shuffle-x"} {
+		check(ValidName(name), t)
+		if ValidUserName(name, false) == nil {
+			t.Fatalf("%q should be reserved.", name)
+		}
+		check(ValidUserName(name, true), t)
+	}
+	if ValidUserName("..", true) == nil {
+		t.Fatal(".. should be invalid even when reserved names are allowed.")
+	}
+	for _, ref := range []string{"master", "master@{2015-03-01}", "@{2015-03-01}"} {
+		check(ValidRef(ref), t)
+	}
+	for _, ref := range []string{"..", "..@{2015-03-01}", "master@{yesterday}"} {
+		if ValidRef(ref) == nil {
+			t.Fatalf("%q should be an invalid ref.", ref)
+		}
+	}
+}
+
+// TestErrors checks that failures can be told apart with errors.Is.
+func TestErrors(t *testing.T) {
+	repo := "repo_TestErrors"
+	check(Init(repo), t)
+	commit(repo, "commit1", "master", t)
+
+	_, err := Commit(repo, "commit2", "nobranch")
+	checkIs(err, ErrBranchNotFound, t)
+	_, err = Commit(repo, "commit1", "master")
+	checkIs(err, ErrCommitExists, t)
+	checkIs(Branch(repo, "nocommit", "branch1"), ErrCommitNotFound, t)
+	check(Branch(repo, "commit1", "branch1"), t)
+	checkIs(Branch(repo, "commit1", "branch1"), ErrBranchExists, t)
+	checkIs(WriteFile(fmt.Sprintf("%s/commit1/file", repo), []byte("foo")), ErrReadOnlyCommit, t)
+	checkIs(Finalize(repo, "unprepared"), ErrCommitNotFound, t)
+	checkIs(ValidName(".meta"), ErrInvalidName, t)
+}
+
+// TestReadOnlyError checks that read-only errors keep their cause.
+func TestReadOnlyError(t *testing.T) {
+	err := readOnly(&os.PathError{Op: "open", Path: "commit1/file", Err: syscall.EROFS})
+	checkIs(err, ErrReadOnlyCommit, t)
+	checkIs(err, syscall.EROFS, t)
+	if err := readOnly(&os.PathError{Op: "open", Path: "file", Err: syscall.ENOENT}); !os.IsNotExist(err) {
+		t.Fatalf("%v should still be a not exist error.", err)
+	}
+}
+
+func checkIs(err, target error, t *testing.T) {
+	if !errors.Is(err, target) {
+		t.Fatalf("Expected %q, got: %v", target, err)
+	}
+}
+
+// TestContextReader checks that reads stop once their context is cancelled.
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := contextReader{ctx, strings.NewReader("foo")}
+	buf := make([]byte, 1)
+	_, err := r.Read(buf)
+	check(err, t)
+	cancel()
+	if _, err := r.Read(buf); err != context.Canceled {
+		t.Fatalf("Expected %v, got: %v", context.Canceled, err)
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	for s, expected := range map[string]Order{"": Desc, "desc": Desc, "asc": Asc} {
+		order, err := ParseOrder(s)
+		check(err, t)
+		if order != expected {
+			t.Fatalf("Parsed %q as %s, expected %s.", s, order, expected)
+		}
+	}
+	if _, err := ParseOrder("ASC"); err == nil {
+		t.Fatal("ASC should be rejected.")
+	}
+}
+
+func TestParseLogEntry(t *testing.T) {
+	e, err := parseLogEntry("ID 299 gen 67 cgen 66 top level 292 parent_uuid 7a4a824b-7b78-d144-a956-eb0229616d21 received_uuid - uuid c1cd770c-600b-a744-940c-835bf73b5fa9 path repo/commit1")
+	check(err, t)
+	expected := LogEntry{Path: "commit1", Transid: 67, CTransid: 66, UUID: "c1cd770c-600b-a744-940c-835bf73b5fa9", ParentUUID: "7a4a824b-7b78-d144-a956-eb0229616d21"}
+	if e != expected {
+		t.Fatalf("Parsed %+v, expected %+v.", e, expected)
+	}
+	// Received subvolumes, and columns in another order.
+	e, err = parseLogEntry("ID 300 gen 70 top level 292 cgen 69 uuid 5e1d3b7a-2c7e-4b4f-8e0b-1f2a3b4c5d6e parent_uuid - received_uuid 9a8b7c6d-5e4f-3a2b-1c0d-e9f8a7b6c5d4 path repo/commit2")
+	check(err, t)
+	expected = LogEntry{Path: "commit2", Transid: 70, CTransid: 69, UUID: "5e1d3b7a-2c7e-4b4f-8e0b-1f2a3b4c5d6e", ReceivedUUID: "9a8b7c6d-5e4f-3a2b-1c0d-e9f8a7b6c5d4"}
+	if e != expected {
+		t.Fatalf("Parsed %+v, expected %+v.", e, expected)
+	}
+	for _, line := range []string{"", "ID 299 gen 67", "ID 299 gen x uuid u path repo/c", "ID 299 gen 67 uuid"} {
+		if _, err := parseLogEntry(line); err == nil {
+			t.Fatalf("%q should fail to parse.", line)
+		}
+	}
+}
+
+func TestTransid(t *testing.T) {
+	repo := "repo_TestTransid"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file1"), "foo", t)
+	commit(repo, "commit1", "master", t)
+	check(Branch(repo, "commit1", "branch1"), t)
+	writeFile(path.Join(repo, "branch1", "file2"), "bar", t)
+	commit(repo, "commit2", "branch1", t)
+	writeFile(path.Join(repo, "master", "file3"), "baz", t)
+	commit(repo, "commit3", "master", t)
+
+	transids := make(map[string]uint64)
+	for _, commit := range []string{"commit1", "commit2", "commit3"} {
+		transid, err := Transid(repo, commit)
+		check(err, t)
+		transids[commit] = transid
+	}
+	// Transids order commits across branches.
+	if !(transids["commit1"] < transids["commit2"] && transids["commit2"] < transids["commit3"]) {
+		t.Fatalf("Transids %v should go up in the order the commits were made.", transids)
+	}
+	check(Commits(repo, "", Desc, func(c CommitInfo) error {
+		if expected, ok := transids[c.Path]; ok && c.Transid != expected {
+			t.Fatalf("Commits gave %s transid %d, Transid gave %d.", c.Path, c.Transid, expected)
+		}
+		return nil
+	}), t)
+	if _, err := Transid(repo, "nonexistent"); err == nil {
+		t.Fatal("Transid of a nonexistent commit should fail.")
+	}
+}
+
+func TestListing(t *testing.T) {
+	repo := "repo_TestListing"
+	check(Init(repo), t)
+	commit(repo, "commit1", "master", t)
+	check(Branch(repo, "commit1", "branch1"), t)
+
+	checkListing := func(expected []Subvolume) {
+		subvolumes, err := Listing(repo)
+		check(err, t)
+		names := make(map[string]Subvolume)
+		for _, s := range subvolumes {
+			names[s.Name] = s
+		}
+		if len(names) != len(expected) {
+			t.Fatalf("Listed %+v, expected %+v.", subvolumes, expected)
+		}
+		for _, s := range expected {
+			// Transids are checked by TestTransid.
+			listed := names[s.Name]
+			listed.Transid = 0
+			if listed != s {
+				t.Fatalf("Listed %+v, expected %+v.", names[s.Name], s)
+			}
+		}
+	}
+	checkListing([]Subvolume{
+		{Name: "t0", Commit: true},
+		{Name: "commit1", Commit: true},
+		{Name: "master", Head: "commit1"},
+		{Name: "branch1", Head: "commit1"},
+	})
+	// Committing moves master's head and adds a commit.
+	commit(repo, "commit2", "master", t)
+	checkListing([]Subvolume{
+		{Name: "t0", Commit: true},
+		{Name: "commit1", Commit: true},
+		{Name: "commit2", Commit: true},
+		{Name: "master", Head: "commit2"},
+		{Name: "branch1", Head: "commit1"},
+	})
+	from, err := GetFrom(repo)
+	check(err, t)
+	if from != "commit2" {
+		t.Fatalf("GetFrom returned %s, expected commit2.", from)
+	}
+}
+
+func TestS3Manifest(t *testing.T) {
+	m := S3Manifest{Commits: []S3Commit{{Name: "c1", Key: "0000000000"}, {Name: "c2", Key: "0000000001"}, {Key: "0000000002"}}}
+	for from, expected := range map[string]int{"": 3, "c1": 2, "c2": 1, "0000000001": 1, "path/0000000002": 0} {
+		commits, err := m.after(from)
+		check(err, t)
+		if len(commits) != expected {
+			t.Fatalf("Expected %d commits after %q, got %d.", expected, from, len(commits))
+		}
+	}
+	if _, err := m.after("c3"); !errors.Is(err, ErrCommitNotFound) {
+		t.Fatalf("Expected ErrCommitNotFound, got %v.", err)
+	}
+
+	h := newHashingReader(strings.NewReader("foo"))
+	_, err := io.ReadAll(h)
+	check(err, t)
+	c := newS3Commit(SentCommit{Name: "c1"}, "0000000000", h)
+	if c.Size != 3 || c.Name != "c1" {
+		t.Fatalf("Wrong manifest entry %+v.", c)
+	}
+	if _, err := io.ReadAll(verifyingReader{newHashingReader(strings.NewReader("foo")), c}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(verifyingReader{newHashingReader(strings.NewReader("bar")), c}); err == nil {
+		t.Fatal("Corrupt data should fail its checksum.")
+	}
+}
+
+func TestCommitFiles(t *testing.T) {
+	repo := "repo_TestCommitFiles"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file1"), "foo", t)
+	check(MkdirAll(path.Join(repo, "master", "dir")), t)
+	writeFile(path.Join(repo, "master", "dir", "file2"), "bar", t)
+	commit(repo, "commit1", "master", t)
+	files, err := commitFiles(repo, "commit1")
+	check(err, t)
+	sort.Strings(files)
+	if !reflect.DeepEqual(files, []string{"dir/file2", "file1"}) {
+		t.Fatalf("Got files %v.", files)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := "repo_TestExportImport_src"
+	dst := "repo_TestExportImport_dst"
+	check(Init(src), t)
+	check(Init(dst), t)
+	writeFile(path.Join(src, "master", "file1"), "foo", t)
+	check(MkdirAll(path.Join(src, "master", "dir")), t)
+	writeFile(path.Join(src, "master", "dir", "file2"), "bar", t)
+	commit(src, "commit1", "master", t)
+
+	var archive bytes.Buffer
+	check(Export(src, "commit1", &archive), t)
+	data := archive.Bytes()
+	name, err := Import(dst, bytes.NewReader(data))
+	check(err, t)
+	if name != "commit1" {
+		t.Fatalf("Imported %s, expected commit1.", name)
+	}
+	checkFile(path.Join(dst, "commit1", "file1"), "foo", t)
+	checkFile(path.Join(dst, "commit1", "dir", "file2"), "bar", t)
+	isCommit, err := IsReadOnly(path.Join(dst, "commit1"))
+	check(err, t)
+	if !isCommit {
+		t.Fatal("Imported commit should be read only.")
+	}
+
+	_, err = Import(dst, bytes.NewReader(data))
+	checkIs(err, ErrCommitExists, t)
+
+	// Flip a byte of file content, the import should fail and leave nothing.
+	corrupt := append([]byte(nil), data...)
+	i := bytes.Index(corrupt, []byte("bar\n"))
+	corrupt[i] = 'c'
+	other := "repo_TestExportImport_other"
+	check(Init(other), t)
+	if _, err := Import(other, bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("Corrupt archive should fail to import.")
+	}
+	exists, err := FileExists(path.Join(other, "commit1"))
+	check(err, t)
+	if exists {
+		t.Fatal("Failed import shouldn't leave a commit behind.")
+	}
+
+	if err := Export(src, "master", io.Discard); err == nil {
+		t.Fatal("Exporting a branch should fail.")
+	}
+}
+
+func TestPack(t *testing.T) {
+	repo := "repo_TestPack"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file1"), "foo", t)
+	check(MkdirAll(path.Join(repo, "master", "dir")), t)
+	writeFile(path.Join(repo, "master", "dir", "file2"), "bar", t)
+	commit(repo, "commit1", "master", t)
+
+	var pack, again bytes.Buffer
+	check(WritePack(repo, "commit1", &pack, ExportOptions{}), t)
+	check(WritePack(repo, "commit1", &again, ExportOptions{}), t)
+	if !bytes.Equal(pack.Bytes(), again.Bytes()) {
+		t.Fatal("Packing the same commit twice should give the same bytes.")
+	}
+
+	r := bytes.NewReader(pack.Bytes())
+	index, err := ReadPackIndex(r, int64(pack.Len()))
+	check(err, t)
+	if index.Commit != "commit1" || len(index.Files) != 2 || index.Files[0].Name != "dir/file2" {
+		t.Fatalf("Unexpected pack index %#v.", index)
+	}
+	e, ok := index.Find("/dir/file2")
+	if !ok {
+		t.Fatal("dir/file2 should be in the pack.")
+	}
+	data, err := io.ReadAll(OpenPackFile(r, e))
+	check(err, t)
+	if string(data) != "bar\n" {
+		t.Fatalf("Read %q from the pack, expected \"bar\\n\".", data)
+	}
+	if _, ok := index.Find("file3"); ok {
+		t.Fatal("file3 shouldn't be in the pack.")
+	}
+
+	// Flip a byte of file content, reading it should fail at the end.
+	corrupt := append([]byte(nil), pack.Bytes()...)
+	corrupt[e.Offset] = 'c'
+	if _, err := io.ReadAll(OpenPackFile(bytes.NewReader(corrupt), e)); err == nil {
+		t.Fatal("Reading a corrupt file should fail.")
+	}
+	if _, err := ReadPackIndex(bytes.NewReader(corrupt[:len(corrupt)-1]), int64(len(corrupt)-1)); err == nil {
+		t.Fatal("A truncated pack should be rejected.")
+	}
+
+	if err := WritePack(repo, "master", io.Discard, ExportOptions{}); err == nil {
+		t.Fatal("Packing a branch should fail.")
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := "repo_TestBackupRestore_src"
+	backup := "repo_TestBackupRestore_backup"
+	dst := "repo_TestBackupRestore_dst"
+	check(Init(src), t)
+	check(InitReplica(backup), t)
+	writeFile(path.Join(src, "master", "committed"), "foo", t)
+	commit(src, "commit1", "master", t)
+	check(Branch(src, "commit1", "branch"), t)
+	writeFile(path.Join(src, "master", "uncommitted"), "bar", t)
+	writeFile(path.Join(src, "branch", "file"), "baz", t)
+	writeHook(src, "pre-commit", "#!/bin/sh\nexit 0\n", t)
+	check(Tag(src, "commit1", "v1"), t)
+	check(MkdirAll("repo_TestBackupRestore_files"), t)
+	writeFile("repo_TestBackupRestore_files/pipelines", "[]", t)
+
+	opts := BackupOptions{Files: map[string]string{"pipelines": "repo_TestBackupRestore_files/pipelines", "missing": "repo_TestBackupRestore_files/missing"}}
+	id, err := BackupWithOptions(context.Background(), src, NewLocalReplica(backup), opts)
+	check(err, t)
+	// The replica holds the backup but its branches are left alone.
+	if Head(backup, "master") != "commit1" {
+		t.Fatalf("Backup moved the replica's master to %s.", Head(backup, "master"))
+	}
+
+	restoreOpts := RestoreOptions{Files: map[string]string{"pipelines": "repo_TestBackupRestore_files/restored"}}
+	restored, err := RestoreWithOptions(context.Background(), NewLocalReplica(backup), dst, restoreOpts)
+	check(err, t)
+	if restored != id {
+		t.Fatalf("Restored backup %s, expected %s.", restored, id)
+	}
+	checkFile(path.Join(dst, "commit1", "committed"), "foo", t)
+	checkFile(path.Join(dst, "master", "uncommitted"), "bar", t)
+	checkFile(path.Join(dst, "branch", "file"), "baz", t)
+	checkFile("repo_TestBackupRestore_files/restored", "[]", t)
+	for _, branch := range []string{"master", "branch"} {
+		if Head(dst, branch) != "commit1" {
+			t.Fatalf("Restored %s has head %s, expected commit1.", branch, Head(dst, branch))
+		}
+	}
+	exists, err := FileExists(HookPath(dst, "pre-commit"))
+	check(err, t)
+	if !exists {
+		t.Fatal("Hook wasn't restored.")
+	}
+	if ResolveTag(dst, "v1") != "commit1" {
+		t.Fatal("Tag wasn't restored.")
+	}
+	subvolumes, err := Listing(dst)
+	check(err, t)
+	for _, sv := range subvolumes {
+		if strings.HasPrefix(sv.Name, "backup-") {
+			t.Fatalf("Restore left %s behind.", sv.Name)
+		}
+	}
+	_, err = Commit(dst, "commit2", "master")
+	check(err, t)
+
+	if _, err := Restore(context.Background(), NewLocalReplica(backup), dst); err == nil {
+		t.Fatal("Restoring in to an existing repo should fail.")
+	}
+}
+
+func TestTags(t *testing.T) {
+	repo := "repo_TestTags"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file"), "foo", t)
+	commit(repo, "commit1", "master", t)
+
+	check(Tag(repo, "commit1", "v1.0"), t)
+	if ResolveTag(repo, "v1.0") != "commit1" {
+		t.Fatalf("v1.0 resolved to %s, expected commit1.", ResolveTag(repo, "v1.0"))
+	}
+	checkFile(path.Join(repo, ResolveTag(repo, "v1.0"), "file"), "foo", t)
+	// Tags of tags point at the commit.
+	check(Tag(repo, "v1.0", "stable"), t)
+	if ResolveTag(repo, "stable") != "commit1" {
+		t.Fatalf("stable resolved to %s, expected commit1.", ResolveTag(repo, "stable"))
+	}
+	for _, name := range []string{"master", "commit1", "missing"} {
+		if ResolveTag(repo, name) != name {
+			t.Fatalf("%s shouldn't resolve to %s.", name, ResolveTag(repo, name))
+		}
+	}
+
+	checkIs(Tag(repo, "commit1", "v1.0"), ErrTagExists, t)
+	checkIs(Tag(repo, "master", "v2.0"), ErrCommitNotFound, t)
+	checkIs(Tag(repo, "missing", "v2.0"), ErrCommitNotFound, t)
+	checkIs(Tag(repo, "commit1", "master"), ErrInvalidName, t)
+	checkIs(Tag(repo, "commit1", "../v2.0"), ErrInvalidName, t)
+
+	tags, err := ListTags(repo)
+	check(err, t)
+	expected := []TagInfo{{Name: "stable", Commit: "commit1"}, {Name: "v1.0", Commit: "commit1"}}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Got tags %+v, expected %+v.", tags, expected)
+	}
+	check(Untag(repo, "stable"), t)
+	checkIs(Untag(repo, "stable"), ErrTagNotFound, t)
+	if ResolveTag(repo, "stable") != "stable" {
+		t.Fatal("Deleted tag still resolves.")
+	}
+}
+
+func TestAsOf(t *testing.T) {
+	repo := "repo_TestAsOf"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file"), "foo", t)
+	commit(repo, "commit1", "master", t)
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	writeFile(path.Join(repo, "master", "file"), "bar", t)
+	commit(repo, "commit2", "master", t)
+
+	for _, c := range []struct {
+		ref      string
+		at       time.Time
+		expected string
+	}{
+		{"master", time.Now(), "commit2"},
+		{"master", between, "commit1"},
+		{"commit2", between, "commit1"},
+		{"commit1", time.Now(), "commit1"},
+	} {
+		commit, err := AsOf(repo, c.ref, c.at)
+		check(err, t)
+		if commit != c.expected {
+			t.Fatalf("%s as of %s is %s, expected %s.", c.ref, c.at, commit, c.expected)
+		}
+	}
+	_, err := AsOf(repo, "master", time.Time{})
+	checkIs(err, ErrCommitNotFound, t)
+	_, err = AsOf(repo, "missing", time.Now())
+	checkIs(err, ErrCommitNotFound, t)
+
+	check(Tag(repo, "commit2", "v2"), t)
+	at := between.UTC().Format(time.RFC3339Nano)
+	for name, expected := range map[string]string{
+		"master@{" + at + "}": "commit1",
+		"@{" + at + "}":       "commit1",
+		"v2@{" + at + "}":     "commit1",
+		"v2":                  "commit2",
+		"master@{1970-01-01}": "master@{1970-01-01}",
+		"master@{yesterday}":  "master@{yesterday}",
+	} {
+		if commit := Resolve(repo, name); commit != expected {
+			t.Fatalf("%s resolved to %s, expected %s.", name, commit, expected)
+		}
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+	ref, at, ok, err := ParseAsOf("dev@{2015-03-01T12:00:00+01:00}")
+	check(err, t)
+	if !ok || ref != "dev" || !at.Equal(time.Date(2015, 3, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Got %s, %s, %v.", ref, at, ok)
+	}
+	ref, at, ok, err = ParseAsOf("@{2015-03-01}")
+	check(err, t)
+	if !ok || ref != "master" || !at.Equal(time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Got %s, %s, %v.", ref, at, ok)
+	}
+	for _, name := range []string{"master", "commit1", "master@{2015-03-01"} {
+		if _, _, ok, err := ParseAsOf(name); ok || err != nil {
+			t.Fatalf("%s shouldn't parse as an as-of.", name)
+		}
+	}
+	_, _, ok, err = ParseAsOf("master@{yesterday}")
+	if !ok {
+		t.Fatal("master@{yesterday} should parse as an as-of.")
+	}
+	checkIs(err, ErrInvalidName, t)
+}
+
+func TestHistory(t *testing.T) {
+	repo := "repo_TestHistory"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file"), "foo", t)
+	commit(repo, "commit1", "master", t)
+	writeFile(path.Join(repo, "master", "other"), "foo", t)
+	commit(repo, "commit2", "master", t)
+	writeFile(path.Join(repo, "master", "file"), "foobar", t)
+	commit(repo, "commit3", "master", t)
+	check(Remove(path.Join(repo, "master", "file")), t)
+	commit(repo, "commit4", "master", t)
+
+	changes, err := History(repo, "master", "file")
+	check(err, t)
+	expected := []FileChange{
+		{Commit: "commit4", Deleted: true},
+		{Commit: "commit3", Size: 7},
+		{Commit: "commit1", Size: 4},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Got %d changes, expected %d: %v", len(changes), len(expected), changes)
+	}
+	for i, change := range changes {
+		if change.Commit != expected[i].Commit || change.Size != expected[i].Size || change.Deleted != expected[i].Deleted {
+			t.Fatalf("Change %d is %v, expected %v.", i, change, expected[i])
+		}
+		if change.Time.IsZero() {
+			t.Fatalf("Change %d has no time.", i)
+		}
+	}
+
+	changes, err = HistoryWithOptions(repo, "commit3", "/file", HistoryOptions{Limit: 1})
+	check(err, t)
+	if len(changes) != 1 || changes[0].Commit != "commit3" {
+		t.Fatalf("Got %v, expected commit3.", changes)
+	}
+	changes, err = History(repo, "master", "missing")
+	check(err, t)
+	if len(changes) != 0 {
+		t.Fatalf("Got %v for a file that never existed.", changes)
+	}
+	_, err = History(repo, "missing", "file")
+	checkIs(err, ErrCommitNotFound, t)
+}
+
+func TestLinks(t *testing.T) {
+	srcRepo := "repo_TestLinks_src"
+	check(Init(srcRepo), t)
+	master := path.Join(srcRepo, "master")
+	writeFile(path.Join(master, "file"), "foo", t)
+	check(CreateSymlink(master, "dir/symlink", "../file"), t)
+	check(CreateLink(master, "dir/link", "file"), t)
+	checkIs(CreateSymlink(master, "absolute", "/etc/passwd"), ErrInvalidName, t)
+	checkIs(CreateSymlink(master, "dir/escape", "../../file"), ErrInvalidName, t)
+	checkIs(CreateSymlink(master, ".meta/symlink", "file"), ErrInvalidName, t)
+	checkIs(CreateLink(master, "link", "missing"), ErrFileNotFound, t)
+	// Links that only leave the commit through other links.
+	check(CreateSymlink(master, "d/up", ".."), t)
+	checkIs(CreateSymlink(master, "d/up/up", ".."), ErrInvalidName, t)
+	check(CreateSymlink(master, "d/self", "up/.."), t)
+	if info, err := StatFile(master, "d/self"); err != nil || info.Target != "." {
+		t.Fatalf("Got %+v, %v for a symlink that should have been cleaned.", info, err)
+	}
+	check(os.Symlink("../..", FilePath(path.Join(master, "d/legacy"))), t)
+	checkIs(CreateSymlink(master, "escape", "d/legacy/other"), ErrInvalidName, t)
+	check(Remove(path.Join(master, "d/legacy")), t)
+	_, err := CreateAll(path.Join(master, "d/up/file"))
+	checkIs(err, ErrInvalidName, t)
+	checkIs(WriteFile(path.Join(master, "dir/symlink"), []byte("bar")), ErrInvalidName, t)
+	check(Remove(path.Join(master, "d/up")), t)
+	commit(srcRepo, "commit1", "master", t)
+
+	dstRepo := "repo_TestLinks_dst"
+	check(InitReplica(dstRepo), t)
+	check(Pull(context.Background(), srcRepo, "", NewLocalReplica(dstRepo)), t)
+	for _, repo := range []string{srcRepo, dstRepo} {
+		root := path.Join(repo, "commit1")
+		info, err := StatFile(root, "dir/symlink")
+		check(err, t)
+		if info.Type != TypeSymlink || info.Target != "../file" {
+			t.Fatalf("Got %+v for the symlink in %s.", info, repo)
+		}
+		checkFile(path.Join(root, "dir/symlink"), "foo", t)
+		info, err = StatFile(root, "dir/link")
+		check(err, t)
+		if info.Type != TypeFile || info.Links != 2 {
+			t.Fatalf("Got %+v for the hard link in %s.", info, repo)
+		}
+		checkFile(path.Join(root, "dir/link"), "foo", t)
+	}
+	_, err = StatFile(path.Join(srcRepo, "commit1"), "missing")
+	checkIs(err, ErrFileNotFound, t)
+}
+
+func TestPermissions(t *testing.T) {
+	srcRepo := "repo_TestPermissions_src"
+	check(InitWithOptions(srcRepo, InitOptions{Permissions: true}), t)
+	if !PreservesPermissions(srcRepo) {
+		t.Fatal("Repo should preserve permissions.")
+	}
+	master := path.Join(srcRepo, "master")
+	writeFile(path.Join(master, "file"), "foo", t)
+	check(Chmod(path.Join(master, "file"), 0750|os.ModeSetgid), t)
+	check(Lchown(path.Join(master, "file"), 1000, -1), t)
+	commit(srcRepo, "commit1", "master", t)
+
+	dstRepo := "repo_TestPermissions_dst"
+	check(InitReplica(dstRepo), t)
+	check(Pull(context.Background(), srcRepo, "", NewLocalReplica(dstRepo)), t)
+	for _, repo := range []string{srcRepo, dstRepo} {
+		info, err := StatFile(path.Join(repo, "commit1"), "file")
+		check(err, t)
+		if info.Mode != 0750|os.ModeSetgid || info.Uid != 1000 {
+			t.Fatalf("Got mode %s and uid %d in %s.", info.Mode, info.Uid, repo)
+		}
+	}
+
+	check(SetPreservePermissions(srcRepo, false), t)
+	if PreservesPermissions(srcRepo) {
+		t.Fatal("Repo shouldn't preserve permissions.")
+	}
+	check(SetPreservePermissions(srcRepo, false), t)
+}
+
+func TestWriteAt(t *testing.T) {
+	repo := "repo_TestWriteAt"
+	check(Init(repo), t)
+	file := path.Join(repo, "master", "file")
+	n, err := WriteAt(file, 0, strings.NewReader("foo"))
+	check(err, t)
+	if n != 3 {
+		t.Fatalf("Wrote %d bytes, expected 3.", n)
+	}
+	_, err = WriteAt(file, 1, strings.NewReader("ee"))
+	check(err, t)
+	offset, n, err := Append(file, strings.NewReader("bar\n"))
+	check(err, t)
+	if offset != 3 || n != 4 {
+		t.Fatalf("Appended %d bytes at %d, expected 4 at 3.", n, offset)
+	}
+	commit(repo, "commit1", "master", t)
+	checkFile(path.Join(repo, "commit1", "file"), "feebar", t)
+	_, err = WriteAt(path.Join(repo, "commit1", "file"), 0, strings.NewReader("foo"))
+	checkIs(err, ErrReadOnlyCommit, t)
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"images/*.png", "images/a.png", true},
+		{"images/*.png", "images/2015/a.png", false},
+		{"images/**/*.png", "images/a.png", true},
+		{"images/**/*.png", "images/2015/03/a.png", true},
+		{"images/**/*.png", "images/2015/03/a.jpg", false},
+		{"images/**", "images/2015/a.png", true},
+		{"**", "a/b/c", true},
+		{"**/b", "a/b", true},
+		{"a/?", "a/bc", false},
+		{"a/[bc]", "a/c", true},
+		{"a/[", "a/[", false},
+	} {
+		if MatchGlob(c.pattern, c.name) != c.match {
+			t.Errorf("MatchGlob(%q, %q) should be %v.", c.pattern, c.name, c.match)
+		}
+	}
+	checkIs(ValidGlob("a/["), ErrInvalidName, t)
+	check(ValidGlob("a/**/*.png"), t)
+}
+
+func TestListFiles(t *testing.T) {
+	repo := "repo_TestListFiles"
+	check(Init(repo), t)
+	check(MkdirAll(path.Join(repo, "master", "images", "2015")), t)
+	writeFile(path.Join(repo, "master", "images", "a.png"), "foo", t)
+	writeFile(path.Join(repo, "master", "images", "2015", "b.png"), "foo", t)
+	writeFile(path.Join(repo, "master", "images", "2015", "c.jpg"), "foo", t)
+	writeFile(path.Join(repo, "master", "file"), "foo", t)
+	commit(repo, "commit1", "master", t)
+
+	files, err := ListFiles(repo, "commit1", nil)
+	check(err, t)
+	expected := []string{"file", "images/2015/b.png", "images/2015/c.jpg", "images/a.png"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Got %v, expected %v.", files, expected)
+	}
+	files, err = ListFiles(repo, "commit1", func(name string) bool { return MatchGlob("images/**/*.png", name) })
+	check(err, t)
+	expected = []string{"images/2015/b.png", "images/a.png"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Got %v, expected %v.", files, expected)
+	}
+	_, err = ListFiles(repo, "missing", nil)
+	checkIs(err, ErrCommitNotFound, t)
+}
+
+func TestComparePaths(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		cmp  int
+	}{
+		{"a", "a", 0},
+		{"a", "b", -1},
+		{"a/b", "a.b", -1},
+		{"a.b", "a/b", 1},
+		{"a/z", "ab", -1},
+		{"a", "a/b", -1},
+	} {
+		if cmp := ComparePaths(c.a, c.b); cmp != c.cmp {
+			t.Fatalf("ComparePaths(%q, %q) = %d, expected %d.", c.a, c.b, cmp, c.cmp)
+		}
+	}
+}
+
+func TestWalkFiles(t *testing.T) {
+	repo := "repo_TestWalkFiles"
+	check(Init(repo), t)
+	check(MkdirAll(path.Join(repo, "master", "a")), t)
+	writeFile(path.Join(repo, "master", "a", "x"), "foo", t)
+	writeFile(path.Join(repo, "master", "a", "y"), "foo", t)
+	writeFile(path.Join(repo, "master", "a.b"), "foo", t)
+	writeFile(path.Join(repo, "master", "b"), "foo", t)
+	commit(repo, "commit1", "master", t)
+
+	// Page through the commit 2 files at a time.
+	var pages [][]string
+	after := ""
+	for {
+		var page []string
+		check(WalkFiles(repo, "commit1", ListOptions{After: after, Limit: 2}, func(name string) error {
+			page = append(page, name)
+			return nil
+		}), t)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		after = page[len(page)-1]
+	}
+	expected := [][]string{{"a/x", "a/y"}, {"a.b", "b"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("Got %v, expected %v.", pages, expected)
+	}
+	// After needn't be a file in the commit.
+	var files []string
+	check(WalkFiles(repo, "commit1", ListOptions{After: "a/xx"}, func(name string) error {
+		files = append(files, name)
+		return nil
+	}), t)
+	if expected := []string{"a/y", "a.b", "b"}; !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Got %v, expected %v.", files, expected)
+	}
+}
+
+func TestFindDeleted(t *testing.T) {
+	repo := "repo_TestFindDeleted"
+	check(Init(repo), t)
+	check(MkdirAll(path.Join(repo, "master", "dir")), t)
+	writeFile(path.Join(repo, "master", "dir", "a"), "foo", t)
+	writeFile(path.Join(repo, "master", "b"), "foo", t)
+	writeFile(path.Join(repo, "master", "c"), "foo", t)
+	commit(repo, "commit1", "master", t)
+	check(RemoveAll(path.Join(repo, "master", "dir")), t)
+	check(Remove(path.Join(repo, "master", "c")), t)
+	writeFile(path.Join(repo, "master", "d"), "foo", t)
+	commit(repo, "commit2", "master", t)
+
+	deleted, err := FindDeleted(repo, "commit1", "commit2")
+	check(err, t)
+	if expected := []string{"c", "dir/a"}; !reflect.DeepEqual(deleted, expected) {
+		t.Fatalf("Got %v, expected %v.", deleted, expected)
+	}
+	_, err = FindDeleted(repo, "commit1", "missing")
+	checkIs(err, ErrCommitNotFound, t)
+}
+
+func TestWalkCommits(t *testing.T) {
+	repo := "repo_TestWalkCommits"
+	check(Init(repo), t)
+	for _, c := range []string{"commit1", "commit2", "commit3"} {
+		writeFile(path.Join(repo, "master", c), c, t)
+		commit(repo, c, "master", t)
+	}
+	var commits []string
+	check(WalkCommits(repo, ListOptions{After: "commit3", Limit: 1}, func(sv Subvolume) error {
+		commits = append(commits, sv.Name)
+		return nil
+	}), t)
+	if expected := []string{"commit2"}; !reflect.DeepEqual(commits, expected) {
+		t.Fatalf("Got %v, expected %v.", commits, expected)
+	}
+	err := WalkCommits(repo, ListOptions{After: "missing"}, func(Subvolume) error { return nil })
+	checkIs(err, ErrCommitNotFound, t)
+}
+
+func TestConfig(t *testing.T) {
+	repo := "repo_TestConfig"
+	check(Init(repo), t)
+	c, err := LoadConfig(repo)
+	check(err, t)
+	if c.Version != 0 {
+		t.Fatalf("Expected an empty config, got %+v.", c)
+	}
+
+	perms := true
+	c.Permissions = &perms
+	c.Hooks = map[string]string{"pre-commit": "#!/bin/sh\necho no commits\nexit 1\n"}
+	c, err = SaveConfig(repo, c)
+	check(err, t)
+	if c.Version != 1 {
+		t.Fatalf("Expected version 1, got %d.", c.Version)
+	}
+	check(ApplyConfig(repo, c), t)
+	if !PreservesPermissions(repo) {
+		t.Fatal("The config should have turned on permissions.")
+	}
+	writeFile(fmt.Sprintf("%s/master/file", repo), "foo", t)
+	if _, err := Commit(repo, "commit1", "master"); err == nil {
+		t.Fatal("The configured pre-commit hook should have rejected the commit.")
+	}
+
+	// Saves based on an old version are rejected.
+	stale := Config{Version: 0}
+	_, err = SaveConfig(repo, stale)
+	checkIs(err, ErrConfigChanged, t)
+	c, err = LoadConfig(repo)
+	check(err, t)
+	if c.Version != 1 || c.Hooks == nil {
+		t.Fatalf("The stale save shouldn't have changed the config, got %+v.", c)
+	}
+
+	c.Hooks = map[string]string{}
+	c, err = SaveConfig(repo, c)
+	check(err, t)
+	check(ApplyConfig(repo, c), t)
+	commit(repo, "commit1", "master", t)
+
+	c.Hooks = map[string]string{"pre-push": ""}
+	if _, err := SaveConfig(repo, c); err == nil {
+		t.Fatal("Unknown hooks should be rejected.")
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	repo := "repo_TestFreeze"
+	check(Init(repo), t)
+	writeFile(path.Join(repo, "master", "file"), "foo", t)
+	commit(repo, "commit1", "master", t)
+
+	check(SetFrozen(repo, true), t)
+	if !IsFrozen(repo) {
+		t.Fatal("Repo should be frozen.")
+	}
+	checkIs(WriteFile(path.Join(repo, "master", "file"), []byte("bar")), ErrFrozen, t)
+	_, err := Create(path.Join(repo, "master", "file2"))
+	checkIs(err, ErrFrozen, t)
+	checkIs(Remove(path.Join(repo, "master", "file")), ErrFrozen, t)
+	checkIs(Rename(path.Join(repo, "master", "file"), path.Join(repo, "master", "file2")), ErrFrozen, t)
+	_, err = Commit(repo, "commit2", "master")
+	checkIs(err, ErrFrozen, t)
+	checkIs(Branch(repo, "commit1", "branch"), ErrFrozen, t)
+	checkIs(Tag(repo, "commit1", "v1.0"), ErrFrozen, t)
+	// Reads still work.
+	checkFile(path.Join(repo, "master", "file"), "foo", t)
+	checkFile(path.Join(repo, "commit1", "file"), "foo", t)
+
+	check(SetFrozen(repo, false), t)
+	if IsFrozen(repo) {
+		t.Fatal("Repo should be thawed.")
+	}
+	writeFile(path.Join(repo, "master", "file"), "bar", t)
+	commit(repo, "commit2", "master", t)
+	checkFile(path.Join(repo, "commit2", "file"), "bar", t)
+}
+
+// _BenchmarkCommit measures committing a branch with nFiles files in it, one
+// of which changed since the last commit.
+func _BenchmarkCommit(nFiles int, b *testing.B) {
+	repo := "repo_BenchmarkCommit_" + RandSeq(10)
+	check(Init(repo), b)
+	for i := 0; i < nFiles; i++ {
+		check(WriteFile(fmt.Sprintf("%s/master/file%d", repo, i), []byte("foo")), b)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		check(WriteFile(fmt.Sprintf("%s/master/file0", repo), []byte(fmt.Sprint(i))), b)
+		_, err := Commit(repo, "", "master")
+		check(err, b)
+	}
+}
+
+func BenchmarkCommit10Files(b *testing.B) {
+	_BenchmarkCommit(10, b)
+}
+
+func BenchmarkCommit1KFiles(b *testing.B) {
+	_BenchmarkCommit(1000, b)
+}
+
+func BenchmarkCommit100KFiles(b *testing.B) {
+	_BenchmarkCommit(100000, b)
+}
+
+// benchmarkCommits makes n commits in a new repo, each adding a file of size
+// bytes, and returns the repo and the commits.
+func benchmarkCommits(n int, size int64, b *testing.B) (string, []string) {
+	repo := "repo_BenchmarkSrc_" + RandSeq(10)
+	check(Init(repo), b)
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	check(err, b)
+	commits := make([]string, n)
+	for i := range commits {
+		check(WriteFile(fmt.Sprintf("%s/master/file%d", repo, i), data), b)
+		commits[i], err = Commit(repo, "", "master")
+		check(err, b)
+	}
+	return repo, commits
+}
+
+// _BenchmarkSendRecv measures replicating commits of size bytes from one
+// repo to another.
+func _BenchmarkSendRecv(size int64, b *testing.B) {
+	ctx := context.Background()
+	src, commits := benchmarkCommits(b.N, size, b)
+	dst := "repo_BenchmarkSendRecv_" + RandSeq(10)
+	check(InitReplica(dst), b)
+	recv := func(r io.Reader) error { return Recv(ctx, dst, r) }
+	check(Send(ctx, src, "t0", recv), b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for _, commit := range commits {
+		check(Send(ctx, src, commit, recv), b)
+	}
+}
+
+func BenchmarkSendRecv1KB(b *testing.B) {
+	_BenchmarkSendRecv(1<<10, b)
+}
+
+func BenchmarkSendRecv1MB(b *testing.B) {
+	_BenchmarkSendRecv(1<<20, b)
+}
+
+func BenchmarkSendRecv64MB(b *testing.B) {
+	_BenchmarkSendRecv(64<<20, b)
+}
+
+// _BenchmarkS3Replica measures pushing commits of size bytes to S3, it uses
+// the same bucket as TestS3Replica.
+func _BenchmarkS3Replica(size int64, b *testing.B) {
+	src, _ := benchmarkCommits(b.N, size, b)
+	b.SetBytes(size)
+	b.ResetTimer()
+	check(Pull(context.Background(), src, "t0", NewS3Replica(path.Join("pachyderm-test", RandSeq(20)))), b)
+}
+
+func BenchmarkS3Replica1MB(b *testing.B) {
+	_BenchmarkS3Replica(1<<20, b)
+}
+
+func BenchmarkS3Replica64MB(b *testing.B) {
+	_BenchmarkS3Replica(64<<20, b)
+}
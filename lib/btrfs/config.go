@@ -0,0 +1,160 @@
+package btrfs
+
+// config.go keeps a repo's settings together in one file, .meta/config, so
+// that they can be read back, copied to another repo and reapplied in one go
+// rather than being scattered across flags. The file is JSON and versioned:
+// every save bumps its version and a save based on an older version fails
+// with ErrConfigChanged, so two operators can't silently undo each other's
+// changes.
+//
+// ApplyConfig applies the settings this package knows about, compression,
+// quotas, permissions and hooks. Replicas and the GC grace are stored for
+// whoever runs the repo to apply.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// configMeta is the repo metadata the config is kept in.
+const configMeta = "config"
+
+// Hooks are the hooks a repo can have, see HookPath.
+var Hooks = []string{"pre-commit", "post-commit"}
+
+// Config is a repo's settings. Settings that are nil, or empty, are left as
+// they are when the config is applied.
+type Config struct {
+	// Version is bumped by SaveConfig, it's 0 for a repo that's never had a
+	// config saved.
+	Version     int     `json:"version"`
+	Compression *string `json:"compression,omitempty"`
+	Quota       *int64  `json:"quota,omitempty"`
+	Permissions *bool   `json:"permissions,omitempty"`
+	// Hooks maps hook names to the scripts to install as them, hooks that
+	// aren't in it are removed unless it's nil.
+	Hooks map[string]string `json:"hooks,omitempty"`
+	// Replicas are the urls of the repo's replication targets.
+	Replicas []string `json:"replicas,omitempty"`
+	// GCGrace is how recently written chunks have to be to be kept by
+	// collections that don't say, like "1h".
+	GCGrace string `json:"gcGrace,omitempty"`
+}
+
+// Validate returns an error if c has settings that can't be applied.
+func (c Config) Validate() error {
+	if c.Compression != nil {
+		if err := ValidCompression(*c.Compression); err != nil {
+			return err
+		}
+	}
+	if c.Quota != nil && *c.Quota < 0 {
+		return fmt.Errorf("Invalid quota %d.", *c.Quota)
+	}
+	for hook := range c.Hooks {
+		if !validHook(hook) {
+			return fmt.Errorf("Unknown hook %s, it must be pre-commit or post-commit.", hook)
+		}
+	}
+	if c.GCGrace != "" {
+		if grace, err := time.ParseDuration(c.GCGrace); err != nil || grace < 0 {
+			return fmt.Errorf("Invalid gcGrace %s.", c.GCGrace)
+		}
+	}
+	return nil
+}
+
+func validHook(hook string) bool {
+	for _, h := range Hooks {
+		if h == hook {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadConfig returns repo's config, a Config with version 0 if it doesn't
+// have one.
+func LoadConfig(repo string) (Config, error) {
+	var c Config
+	data, err := ReadFile(path.Join(repo, ".meta", configMeta))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("Reading the config of %s: %s", repo, err)
+	}
+	return c, nil
+}
+
+// SaveConfig replaces repo's config with c, which must have the version of
+// the config it replaces, and returns it with its new version. It doesn't
+// apply it, see ApplyConfig.
+func SaveConfig(repo string, c Config) (Config, error) {
+	if err := c.Validate(); err != nil {
+		return c, err
+	}
+	current, err := LoadConfig(repo)
+	if err != nil {
+		return c, err
+	}
+	if c.Version != current.Version {
+		return c, errorf(ErrConfigChanged, "The config of %s is at version %d, not %d.", repo, current.Version, c.Version)
+	}
+	c.Version++
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return c, err
+	}
+	return c, SetMeta(repo, configMeta, string(data))
+}
+
+// ApplyConfig applies c's compression, quota, permissions and hooks to repo.
+func ApplyConfig(repo string, c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if c.Compression != nil {
+		if err := SetCompression(repo, *c.Compression); err != nil {
+			return err
+		}
+	}
+	if c.Quota != nil {
+		if err := SetQuota(repo, *c.Quota); err != nil {
+			return err
+		}
+	}
+	if c.Permissions != nil {
+		if err := SetPreservePermissions(repo, *c.Permissions); err != nil {
+			return err
+		}
+	}
+	if c.Hooks == nil {
+		return nil
+	}
+	for _, hook := range Hooks {
+		script, ok := c.Hooks[hook]
+		if !ok {
+			if err := Remove(HookPath(repo, hook)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := MkdirAll(path.Dir(HookPath(repo, hook))); err != nil {
+			return err
+		}
+		if err := WriteFileAtomic(HookPath(repo, hook), []byte(script)); err != nil {
+			return err
+		}
+		if err := os.Chmod(FilePath(HookPath(repo, hook)), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
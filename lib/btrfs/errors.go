@@ -0,0 +1,59 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// The errors this package returns for the common ways an operation can fail.
+// They're wrapped with what the operation was about, so check for them with
+// errors.Is rather than ==.
+var (
+	ErrCommitNotFound = errors.New("commit not found")
+	ErrBranchNotFound = errors.New("branch not found")
+	ErrFileNotFound   = errors.New("file not found")
+	ErrCommitExists   = errors.New("commit already exists")
+	ErrBranchExists   = errors.New("branch already exists")
+	ErrTagNotFound    = errors.New("tag not found")
+	ErrTagExists      = errors.New("tag already exists")
+	ErrReadOnlyCommit = errors.New("commit is read only")
+	ErrNotReplica     = errors.New("repo is not a replica")
+	ErrInvalidName    = errors.New("invalid name")
+	ErrFrozen         = errors.New("repo is frozen")
+	ErrConfigChanged  = errors.New("config has changed")
+)
+
+// wrappedError is one of the errors above with a message saying what it's
+// about. cause, if there is one, is the error that it was made from.
+type wrappedError struct {
+	kind  error
+	cause error
+	msg   string
+}
+
+func (e wrappedError) Error() string {
+	return e.msg
+}
+
+func (e wrappedError) Unwrap() []error {
+	if e.cause == nil {
+		return []error{e.kind}
+	}
+	return []error{e.kind, e.cause}
+}
+
+// errorf returns kind wrapped with a formatted message.
+func errorf(kind error, format string, args ...interface{}) error {
+	return wrappedError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// readOnly turns the error from writing to a commit, which the kernel reports
+// as a read-only file system, in to ErrReadOnlyCommit. Other errors are
+// returned as they are.
+func readOnly(err error) error {
+	if err == nil || !errors.Is(err, syscall.EROFS) {
+		return err
+	}
+	return wrappedError{kind: ErrReadOnlyCommit, cause: err, msg: err.Error()}
+}
@@ -0,0 +1,273 @@
+package btrfs
+
+// export.go moves commits between repos as portable archives, which don't
+// depend on btrfs send streams, so they can be carried across air gaps or
+// kept for the long term. An archive is a tar file:
+//
+//	pfs-export.json   an ExportHeader describing the commit
+//	data/<file>       the commit's files, each with its sha256 in a
+//	                  PFS.sha256 PAX record
+//
+// Import checks every file against its checksum and the header's file count,
+// and only adds the commit to the repo once all of it has been written.
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const (
+	exportVersion     = 1
+	exportHeaderName  = "pfs-export.json"
+	exportDataPrefix  = "data/"
+	exportChecksumKey = "PFS.sha256"
+)
+
+// ExportHeader is the first entry in an archive made by Export.
+type ExportHeader struct {
+	Version int    `json:"version"`
+	Commit  string `json:"commit"`
+	// Meta is the commit's metadata, like its parent and branch.
+	Meta map[string]string `json:"meta"`
+	// Files is how many files the archive holds.
+	Files int `json:"files"`
+}
+
+// ExportOptions controls Export.
+type ExportOptions struct {
+	// Open opens the files being exported, it defaults to Open. Callers
+	// that store files in their own format can resolve it here.
+	Open func(name string) (io.ReadCloser, error)
+}
+
+// Export writes commit, from repo, to w as a portable archive.
+func Export(repo, commit string, w io.Writer) error {
+	return ExportWithOptions(repo, commit, w, ExportOptions{})
+}
+
+// ExportWithOptions is Export with options.
+func ExportWithOptions(repo, commit string, w io.Writer, opts ExportOptions) error {
+	name := path.Join(repo, commit)
+	isCommit, err := IsReadOnly(name)
+	if err != nil {
+		return err
+	}
+	if !isCommit {
+		return errorf(ErrCommitNotFound, "%s isn't a commit", commit)
+	}
+	files, err := commitFiles(repo, commit)
+	if err != nil {
+		return err
+	}
+	meta, err := commitMeta(name)
+	if err != nil {
+		return err
+	}
+	header := ExportHeader{Version: exportVersion, Commit: commit, Meta: meta, Files: len(files)}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: exportHeaderName, Mode: 0644, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	open := opts.Open
+	if open == nil {
+		open = func(name string) (io.ReadCloser, error) { return Open(name) }
+	}
+	for _, file := range files {
+		if err := exportFile(tw, open, name, file); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// commitMeta returns the metadata of the commit name, like its parent and
+// branch.
+func commitMeta(name string) (map[string]string, error) {
+	result := make(map[string]string)
+	metas, err := ReadDir(path.Join(name, ".meta"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, meta := range metas {
+		if meta.Mode().IsRegular() && meta.Name() != "lock" {
+			result[meta.Name()] = GetMeta(name, meta.Name())
+		}
+	}
+	return result, nil
+}
+
+// exportFile writes file, from the commit name, to tw. Files are read twice,
+// once to checksum them, since the checksum has to come first.
+func exportFile(tw *tar.Writer, open func(string) (io.ReadCloser, error), name, file string) error {
+	hash := sha256.New()
+	f, err := open(path.Join(name, file))
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	fi, err := Stat(path.Join(name, file))
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:       exportDataPrefix + file,
+		Mode:       int64(fi.Mode().Perm()),
+		Size:       size,
+		ModTime:    fi.ModTime(),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{exportChecksumKey: hex.EncodeToString(hash.Sum(nil))},
+	})
+	if err != nil {
+		return err
+	}
+	if f, err = open(path.Join(name, file)); err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(tw, f)
+	if err == nil && n != size {
+		err = fmt.Errorf("%s changed while it was being exported.", file)
+	}
+	return err
+}
+
+// Import recreates the commit in r, an archive made by Export, in repo and
+// returns its name. The commit's parent is only kept if repo has it.
+func Import(repo string, r io.Reader) (string, error) {
+	defer invalidateListings()
+	tr := tar.NewReader(r)
+	th, err := tr.Next()
+	if err != nil {
+		return "", fmt.Errorf("Invalid archive: %w", err)
+	}
+	if th.Name != exportHeaderName {
+		return "", fmt.Errorf("Invalid archive, it starts with %s rather than %s.", th.Name, exportHeaderName)
+	}
+	var header ExportHeader
+	if err := json.NewDecoder(tr).Decode(&header); err != nil {
+		return "", fmt.Errorf("Invalid archive header: %w", err)
+	}
+	if header.Version != exportVersion {
+		return "", fmt.Errorf("Unsupported archive version %d.", header.Version)
+	}
+	if err := ValidName(header.Commit); err != nil {
+		return "", err
+	}
+	exists, err := FileExists(path.Join(repo, header.Commit))
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", errorf(ErrCommitExists, "Commit %s already exists.", header.Commit)
+	}
+
+	// The commit is built where Recv stages commits, so that Recover
+	// cleans it up if we crash part way through.
+	staging := path.Join(recvPath(repo), uuid.New())
+	if err := MkdirAll(staging); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := cleanRecv(staging); err != nil {
+			logger.Error("cleaning up import", "repo", repo, "err", err)
+		}
+	}()
+	commit := path.Join(staging, header.Commit)
+	if err := SubvolumeCreate(commit); err != nil {
+		return "", err
+	}
+	files := 0
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Invalid archive: %w", err)
+		}
+		if err := importFile(commit, tr, th); err != nil {
+			return "", err
+		}
+		files++
+	}
+	if files != header.Files {
+		return "", fmt.Errorf("Archive holds %d files, its header says %d.", files, header.Files)
+	}
+	for key, value := range header.Meta {
+		if key == "parent" {
+			exists, err := FileExists(path.Join(repo, value))
+			if err != nil {
+				return "", err
+			}
+			if !exists {
+				continue
+			}
+		}
+		if err := SetMeta(commit, key, value); err != nil {
+			return "", err
+		}
+	}
+	if err := SetReadOnly(commit); err != nil {
+		return "", err
+	}
+	if err := Rename(commit, path.Join(repo, header.Commit)); err != nil {
+		return "", err
+	}
+	if err := syncDir(repo); err != nil {
+		return "", err
+	}
+	return header.Commit, nil
+}
+
+// importFile writes the file in th, read from tr, in to commit.
+func importFile(commit string, tr *tar.Reader, th *tar.Header) error {
+	if th.Typeflag != tar.TypeReg || !strings.HasPrefix(th.Name, exportDataPrefix) {
+		return fmt.Errorf("Invalid archive entry %s.", th.Name)
+	}
+	file := path.Clean(strings.TrimPrefix(th.Name, exportDataPrefix))
+	if file == "." || strings.HasPrefix(file, ".") || filepath.IsAbs(file) {
+		return fmt.Errorf("Invalid file name %s in archive.", th.Name)
+	}
+	name := path.Join(commit, file)
+	if err := MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(th.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), tr)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != th.PAXRecords[exportChecksumKey] {
+		return fmt.Errorf("%s has checksum %s, expected %s.", file, sum, th.PAXRecords[exportChecksumKey])
+	}
+	return nil
+}
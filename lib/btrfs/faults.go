@@ -0,0 +1,107 @@
+package btrfs
+
+// faults.go lets tests make replication and commits fail part way through,
+// so that what's left behind by a crash, a dropped connection or a full disk
+// can be checked instead of hoped about. A test installs Faults with
+// SetFaults and each fault point below asks it whether to fail and lets it
+// wrap the data streamed through it. Nothing is injected unless a test
+// installs Faults.
+
+import (
+	"io"
+	"sync"
+)
+
+// The points where faults are injected.
+const (
+	// FaultSend is reached as Send starts, its stream is what's sent.
+	FaultSend = "send"
+	// FaultRecv is reached as Recv starts, its stream is what's received.
+	FaultRecv = "recv"
+	// FaultPull is reached before Pull pushes each commit.
+	FaultPull = "pull"
+	// FaultS3Upload is reached before S3Replica uploads a commit, its
+	// stream is what's uploaded.
+	FaultS3Upload = "s3.upload"
+	// FaultS3Manifest is reached after S3Replica has uploaded a commit but
+	// before it's added to the manifest.
+	FaultS3Manifest = "s3.manifest"
+	// FaultCommit is reached after a commit's snapshot is made but before
+	// it's recorded as its branch's parent, by Commit and Finalize. Failing
+	// here is the crash Recover recovers from.
+	FaultCommit = "commit"
+)
+
+// Faults decides which operations fail. Tests that only want one of the
+// methods can embed NoFaults for the other.
+type Faults interface {
+	// Fault is called each time point is reached, the operation fails
+	// with the error it returns.
+	Fault(point string) error
+	// Stream wraps the data streamed through point, to cut it short say,
+	// see FailAfter.
+	Stream(point string, r io.Reader) io.Reader
+}
+
+// NoFaults injects nothing.
+type NoFaults struct{}
+
+func (NoFaults) Fault(point string) error { return nil }
+
+func (NoFaults) Stream(point string, r io.Reader) io.Reader { return r }
+
+var faults struct {
+	lock sync.RWMutex
+	f    Faults
+}
+
+// SetFaults installs f, nil removes whatever was installed.
+func SetFaults(f Faults) {
+	faults.lock.Lock()
+	defer faults.lock.Unlock()
+	faults.f = f
+}
+
+func getFaults() Faults {
+	faults.lock.RLock()
+	defer faults.lock.RUnlock()
+	if faults.f == nil {
+		return NoFaults{}
+	}
+	return faults.f
+}
+
+// fault returns the error to fail with at point, if any.
+func fault(point string) error {
+	return getFaults().Fault(point)
+}
+
+// faultStream wraps r, the data streamed through point.
+func faultStream(point string, r io.Reader) io.Reader {
+	return getFaults().Stream(point, r)
+}
+
+// FailAfter returns a reader that reads n bytes of r and then fails with
+// err. io.EOF truncates the stream, io.ErrUnexpectedEOF looks like a
+// dropped connection and syscall.ENOSPC like a full disk.
+func FailAfter(r io.Reader, n int64, err error) io.Reader {
+	return &failingReader{r: r, n: n, err: err}
+}
+
+type failingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, r.err
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
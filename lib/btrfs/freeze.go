@@ -0,0 +1,58 @@
+package btrfs
+
+// freeze.go stops a repo changing while it's being resharded, restored or
+// looked in to after an incident. A frozen repo refuses writes to the files
+// in its branches and new commits, branches and tags, whoever asks for them,
+// while reads carry on and replication still receives commits, so a frozen
+// replica keeps up. Commits that were prepared before the freeze can still be
+// finalized or aborted. Metadata can still be changed, which is how a repo is
+// thawed.
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// frozenMeta is the repo metadata that freezes it.
+const frozenMeta = "frozen"
+
+// SetFrozen freezes or thaws repo.
+func SetFrozen(repo string, frozen bool) error {
+	if frozen {
+		return SetMeta(repo, frozenMeta, "true")
+	}
+	err := Remove(path.Join(repo, ".meta", frozenMeta))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// IsFrozen returns true if repo is frozen.
+func IsFrozen(repo string) bool {
+	return GetMeta(repo, frozenMeta) == "true"
+}
+
+// checkFrozen returns ErrFrozen if repo is frozen.
+func checkFrozen(repo string) error {
+	if IsFrozen(repo) {
+		return errorf(ErrFrozen, "Repo %s is frozen.", repo)
+	}
+	return nil
+}
+
+// checkFrozenFile returns ErrFrozen if name is a file in a branch of a frozen
+// repo. The repo's and its branches' own metadata, apart from the stripes of
+// files that are kept with it, and names outside of branches, like the
+// commits that replication moves in to place, aren't checked.
+func checkFrozenFile(name string) error {
+	parts := strings.Split(strings.TrimPrefix(path.Clean(name), "/"), "/")
+	if len(parts) < 3 || parts[1] == ".meta" {
+		return nil
+	}
+	if parts[2] == ".meta" && (len(parts) < 4 || parts[3] != "stripes") {
+		return nil
+	}
+	return checkFrozen(parts[0])
+}
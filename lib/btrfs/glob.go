@@ -0,0 +1,52 @@
+package btrfs
+
+// glob.go picks out parts of a commit by pattern. Patterns are matched
+// against paths relative to the commit, a segment at a time, with the
+// syntax of path.Match plus ** which matches any number of segments,
+// including none. So images/**/*.png matches images/a.png and
+// images/2015/03/b.png.
+
+import (
+	"path"
+	"strings"
+)
+
+// ValidGlob returns an error if pattern is malformed.
+func ValidGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			continue
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return errorf(ErrInvalidName, "Invalid pattern %s.", pattern)
+		}
+	}
+	return nil
+}
+
+// MatchGlob returns true if name, a path relative to a commit, matches
+// pattern. Malformed patterns match nothing.
+func MatchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,134 @@
+package btrfs
+
+// history.go traces a file through a branch's commits. Commits share files
+// with their parents until they're written, so a file changed in a commit if
+// its size, modification time or change time differs from the parent's
+// copy, or it was added or deleted.
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FileChange is a commit in which a file changed.
+type FileChange struct {
+	Commit string
+	// Time is when the commit was made, see CommitTime.
+	Time time.Time
+	// Size is the file's size in the commit, 0 if it was deleted.
+	Size    int64
+	Deleted bool
+}
+
+// HistoryOptions controls History.
+type HistoryOptions struct {
+	// Size returns the size of the file name, it defaults to its size on
+	// disk. Callers that store files in their own format can resolve it
+	// here.
+	Size func(name string) (int64, error)
+	// Limit is the most changes to return, 0 means no limit.
+	Limit int
+}
+
+// fileVersion is what we compare to tell if a file changed.
+type fileVersion struct {
+	exists  bool
+	size    int64
+	modTime int64
+	ctime   syscall.Timespec
+}
+
+func statVersion(name string) (fileVersion, error) {
+	fi, err := Lstat(name)
+	if os.IsNotExist(err) || err == nil && !fi.Mode().IsRegular() {
+		return fileVersion{}, nil
+	}
+	if err != nil {
+		return fileVersion{}, err
+	}
+	v := fileVersion{exists: true, size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		v.ctime = st.Ctim
+	}
+	return v, nil
+}
+
+// History returns the commits in which the file name changed, newest first,
+// in the history of ref, which is a branch, a commit or a tag. History stops
+// at commits that aren't in repo, like ones that have been tiered.
+func History(repo, ref, name string) ([]FileChange, error) {
+	return HistoryWithOptions(repo, ref, name, HistoryOptions{})
+}
+
+// HistoryWithOptions is History with options.
+func HistoryWithOptions(repo, ref, name string, opts HistoryOptions) ([]FileChange, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("Invalid file name %s.", name)
+	}
+	size := opts.Size
+	if size == nil {
+		size = func(name string) (int64, error) {
+			fi, err := Stat(name)
+			if err != nil {
+				return 0, err
+			}
+			return fi.Size(), nil
+		}
+	}
+	commit := ResolveTag(repo, ref)
+	exists, err := FileExists(path.Join(repo, commit))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errorf(ErrCommitNotFound, "Commit %s not found.", ref)
+	}
+	isCommit, err := IsReadOnly(path.Join(repo, commit))
+	if err != nil {
+		return nil, err
+	}
+	if !isCommit {
+		commit = Head(repo, commit)
+	}
+
+	var changes []FileChange
+	version, err := statVersion(path.Join(repo, commit, name))
+	if err != nil {
+		return nil, err
+	}
+	for commit != "" && (opts.Limit == 0 || len(changes) < opts.Limit) {
+		parent := GetMeta(path.Join(repo, commit), "parent")
+		if parent != "" {
+			if exists, err := FileExists(path.Join(repo, parent)); err != nil {
+				return nil, err
+			} else if !exists {
+				parent = ""
+			}
+		}
+		var parentVersion fileVersion
+		if parent != "" {
+			if parentVersion, err = statVersion(path.Join(repo, parent, name)); err != nil {
+				return nil, err
+			}
+		}
+		if version != parentVersion {
+			change := FileChange{Commit: commit, Deleted: !version.exists}
+			if change.Time, err = CommitTime(repo, commit); err != nil {
+				return nil, err
+			}
+			if version.exists {
+				if change.Size, err = size(path.Join(repo, commit, name)); err != nil {
+					return nil, err
+				}
+			}
+			changes = append(changes, change)
+		}
+		commit, version = parent, parentVersion
+	}
+	return changes, nil
+}
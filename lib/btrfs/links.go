@@ -0,0 +1,242 @@
+package btrfs
+
+// links.go makes and describes symlinks and hard links inside branches.
+// btrfs send streams carry both, so they survive Pull and Recv as they are.
+// Symlinks are kept relative and inside the snapshot that holds them, so
+// that they point at the same file in every commit and on every replica,
+// an absolute target would point at whichever branch it was made in.
+//
+// Checking a target as text isn't enough to keep it inside, the links it
+// goes through can take it elsewhere, so targets are followed through the
+// links on disk. Writes refuse to go through symlinks, so every symlink is in
+// a real directory of its snapshot, and targets are stored cleaned, so their
+// `..`s all come first and climb real directories. Together that keeps
+// symlinks inside their snapshot however the links around them change later.
+
+import (
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The types of files FileInfo reports.
+const (
+	TypeFile    = "file"
+	TypeDir     = "dir"
+	TypeSymlink = "symlink"
+	TypeOther   = "other"
+)
+
+// FileInfo describes a file in a snapshot without following symlinks.
+type FileInfo struct {
+	Name string
+	Type string
+	Size int64
+	// Target is where a symlink points, relative to its directory.
+	Target string
+	// Links is the number of hard links to the file.
+	Links   uint64
+	ModTime time.Time
+	// Mode holds the permission bits, Uid and Gid the owner.
+	Mode     os.FileMode
+	Uid, Gid int
+}
+
+// cleanFileName cleans name, a path in a snapshot, and checks that it's in
+// the snapshot and not our metadata.
+func cleanFileName(name string) (string, error) {
+	clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if clean == "" || clean == ".meta" || strings.HasPrefix(clean, ".meta/") {
+		return "", errorf(ErrInvalidName, "Invalid file name %s.", name)
+	}
+	return clean, nil
+}
+
+// CreateSymlink makes name, a path in the snapshot root, a symlink to
+// target. target is relative to name's directory and mustn't leave root.
+func CreateSymlink(root, name, target string) error {
+	name, err := cleanFileName(name)
+	if err != nil {
+		return err
+	}
+	if target == "" || path.IsAbs(target) {
+		return errorf(ErrInvalidName, "Symlink target %s must be a relative path.", target)
+	}
+	target = path.Clean(target)
+	if resolved := path.Join(path.Dir(name), target); resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return errorf(ErrInvalidName, "Symlink target %s is outside of the commit.", target)
+	}
+	if err := MkdirAll(path.Dir(path.Join(root, name))); err != nil {
+		return err
+	}
+	if err := checkWrite(path.Join(root, name)); err != nil {
+		return err
+	}
+	if err := followLink(root, path.Dir(name), target); err != nil {
+		return err
+	}
+	// os.Symlink stores target as it's given, unlike Symlink which makes it
+	// absolute.
+	return readOnly(os.Symlink(target, FilePath(path.Join(root, name))))
+}
+
+// maxLinkHops is how many symlinks followLink follows before it gives up,
+// like the kernel's ELOOP.
+const maxLinkHops = 40
+
+// followLink follows target, relative to dir in the snapshot root, through
+// the symlinks on disk and returns ErrInvalidName if it leaves root. Parts of
+// target that don't exist yet are followed as text.
+func followLink(root, dir, target string) error {
+	var resolved []string
+	if dir != "." {
+		resolved = strings.Split(dir, "/")
+	}
+	pending := strings.Split(target, "/")
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return errorf(ErrInvalidName, "Symlink target %s is outside of the commit.", target)
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, part)
+		name := path.Join(root, path.Join(resolved...))
+		fi, err := Lstat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if hops++; hops > maxLinkHops {
+			return errorf(ErrInvalidName, "Symlink target %s goes through too many symlinks.", target)
+		}
+		link, err := os.Readlink(FilePath(name))
+		if err != nil {
+			return err
+		}
+		if path.IsAbs(link) {
+			return errorf(ErrInvalidName, "Symlink target %s is outside of the commit.", target)
+		}
+		resolved = resolved[:len(resolved)-1]
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+	return nil
+}
+
+// checkNoSymlinks returns ErrInvalidName if any of name's directories, or
+// name itself if last is true, are symlinks.
+func checkNoSymlinks(name string, last bool) error {
+	parts := strings.Split(strings.TrimPrefix(path.Clean(name), "/"), "/")
+	if !last {
+		parts = parts[:len(parts)-1]
+	}
+	for i := range parts {
+		p := path.Join(parts[:i+1]...)
+		fi, err := Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errorf(ErrInvalidName, "Can't write %s, %s is a symlink.", name, p)
+		}
+	}
+	return nil
+}
+
+// checkWrite returns an error if name can't be changed: ErrFrozen if it's
+// in a branch of a frozen repo and ErrInvalidName if any of its directories
+// are symlinks. Writes follow symlinks, so a write through one would land
+// wherever it points.
+func checkWrite(name string) error {
+	if err := checkFrozenFile(name); err != nil {
+		return err
+	}
+	return checkNoSymlinks(name, false)
+}
+
+// checkWriteFile is checkWrite for writes to name's contents, which also
+// follow name if it's a symlink.
+func checkWriteFile(name string) error {
+	if err := checkFrozenFile(name); err != nil {
+		return err
+	}
+	return checkNoSymlinks(name, true)
+}
+
+// CreateLink makes name, a path in the snapshot root, a hard link to the
+// file existing in the same snapshot.
+func CreateLink(root, name, existing string) error {
+	name, err := cleanFileName(name)
+	if err != nil {
+		return err
+	}
+	if existing, err = cleanFileName(existing); err != nil {
+		return err
+	}
+	fi, err := Lstat(path.Join(root, existing))
+	if os.IsNotExist(err) {
+		return errorf(ErrFileNotFound, "File %s not found.", existing)
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errorf(ErrInvalidName, "Can't link to %s, it's a directory.", existing)
+	}
+	if err := MkdirAll(path.Dir(path.Join(root, name))); err != nil {
+		return err
+	}
+	return Link(path.Join(root, existing), path.Join(root, name))
+}
+
+// StatFile describes name, a path in the snapshot root. Symlinks are
+// described rather than followed.
+func StatFile(root, name string) (FileInfo, error) {
+	name, err := cleanFileName(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi, err := Lstat(path.Join(root, name))
+	if os.IsNotExist(err) {
+		return FileInfo{}, errorf(ErrFileNotFound, "File %s not found.", name)
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := FileInfo{Name: name, Size: fi.Size(), Links: 1, ModTime: fi.ModTime()}
+	info.Mode = fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		info.Links = uint64(st.Nlink)
+		info.Uid, info.Gid = int(st.Uid), int(st.Gid)
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		info.Type = TypeFile
+	case fi.IsDir():
+		info.Type = TypeDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		info.Type = TypeSymlink
+		if info.Target, err = os.Readlink(FilePath(path.Join(root, name))); err != nil {
+			return FileInfo{}, err
+		}
+	default:
+		info.Type = TypeOther
+	}
+	return info, nil
+}
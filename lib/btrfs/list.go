@@ -0,0 +1,180 @@
+package btrfs
+
+// list.go pages through listings that can be too big to hold at once, like
+// a directory with millions of files in it. Listings are visited in a fixed
+// order and a page starts after the last entry of the previous one, so
+// clients can carry on from where they left off without us keeping any
+// state between pages.
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// ListOptions controls WalkFiles and WalkCommits.
+type ListOptions struct {
+	// After skips the entries up to and including After, it needn't exist
+	// for WalkFiles.
+	After string
+	// Limit is the most entries to visit, 0 means no limit.
+	Limit int
+	// Match picks the files WalkFiles visits, nil visits them all.
+	Match func(name string) bool
+	// Order is the order WalkCommits visits commits in, newest first by
+	// default.
+	Order Order
+}
+
+// errLimit stops a walk that's reached its limit.
+var errLimit = errors.New("limit reached")
+
+// ComparePaths orders paths the way WalkFiles visits them: a segment at a
+// time, so that everything in a directory comes before the siblings that
+// sort after it. It returns -1, 0 or 1 like strings.Compare.
+func ComparePaths(a, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := a[i], b[i]
+		if ca == cb {
+			continue
+		}
+		// '/' ends a segment so it sorts before everything else.
+		if ca == '/' {
+			return -1
+		}
+		if cb == '/' {
+			return 1
+		}
+		if ca < cb {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+// WalkFiles calls f for the files in commit, which can also be a branch, in
+// the order of ComparePaths. Names are relative to the commit. Directories
+// aren't visited and our metadata is skipped.
+func WalkFiles(repo, commit string, opts ListOptions, f func(name string) error) error {
+	root := FilePath(path.Join(repo, commit))
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return errorf(ErrCommitNotFound, "Commit %s not found.", commit)
+	}
+	n := 0
+	err := filepath.Walk(root, func(abs string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, abs)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == "." {
+			return nil
+		}
+		if name == ".meta" {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() {
+			// Directories that end before After don't have anything we
+			// want in them.
+			if opts.After != "" && ComparePaths(name+"/\xff", opts.After) < 0 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if opts.After != "" && ComparePaths(name, opts.After) <= 0 {
+			return nil
+		}
+		if opts.Match != nil && !opts.Match(name) {
+			return nil
+		}
+		if err := f(name); err != nil {
+			return err
+		}
+		if n++; opts.Limit != 0 && n >= opts.Limit {
+			return errLimit
+		}
+		return nil
+	})
+	if err == errLimit {
+		return nil
+	}
+	return err
+}
+
+// ListFiles returns the files in commit that match, in the order of
+// ComparePaths. match is passed paths relative to the commit, nil matches
+// everything.
+func ListFiles(repo, commit string, match func(name string) bool) ([]string, error) {
+	var files []string
+	err := WalkFiles(repo, commit, ListOptions{Match: match}, func(name string) error {
+		files = append(files, name)
+		return nil
+	})
+	return files, err
+}
+
+// FindDeleted returns the files in from that aren't in to, in the order of
+// ComparePaths. It's the other half of FindNew, which only sees files that
+// are in to.
+func FindDeleted(repo, from, to string) ([]string, error) {
+	if _, err := os.Stat(FilePath(path.Join(repo, to))); os.IsNotExist(err) {
+		return nil, errorf(ErrCommitNotFound, "Commit %s not found.", to)
+	}
+	var deleted []string
+	err := WalkFiles(repo, from, ListOptions{}, func(name string) error {
+		_, err := os.Lstat(FilePath(path.Join(repo, to, name)))
+		if os.IsNotExist(err) {
+			deleted = append(deleted, name)
+			return nil
+		}
+		return err
+	})
+	return deleted, err
+}
+
+// WalkCommits calls f for the commits in repo, in opts.Order. After is the
+// name of a commit, it's an error if it doesn't exist.
+func WalkCommits(repo string, opts ListOptions, f func(Subvolume) error) error {
+	subvolumes, err := Listing(repo)
+	if err != nil {
+		return err
+	}
+	started := opts.After == ""
+	n := 0
+	for i := range subvolumes {
+		// Listings are newest first.
+		sv := subvolumes[i]
+		if opts.Order == Asc {
+			sv = subvolumes[len(subvolumes)-1-i]
+		}
+		if !sv.Commit {
+			continue
+		}
+		if !started {
+			started = sv.Name == opts.After
+			continue
+		}
+		if opts.Limit != 0 && n >= opts.Limit {
+			return nil
+		}
+		if err := f(sv); err != nil {
+			return err
+		}
+		n++
+	}
+	if !started {
+		return errorf(ErrCommitNotFound, "Commit %s not found.", opts.After)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package btrfs
+
+import (
+	"path"
+	"sync"
+)
+
+// Subvolume is a commit or branch in a repo's Listing.
+type Subvolume struct {
+	Name string
+	// Commit is true for commits, which are read only, and false for
+	// branches.
+	Commit bool
+	// Head is a branch's head, it's empty for commits.
+	Head string
+	// Transid is the last transaction that changed it, see Transid.
+	Transid uint64
+}
+
+// listing is a repo's cached Listing and the transid it was made at.
+type listing struct {
+	transid    string
+	subvolumes []Subvolume
+}
+
+// listings caches Listings. Anything this process does that changes a
+// repo's subvolumes or branch heads clears it, and entries are only used if
+// the repo's transid hasn't changed since they were made, which catches
+// changes made by anyone else.
+var listings = struct {
+	sync.Mutex
+	// version goes up every time the cache is cleared, so that a listing
+	// that was made while the repo changed isn't cached.
+	version uint64
+	repos   map[string]listing
+	// commits are the uuids of the subvolumes we've seen are commits.
+	// Commits stay commits, so it outlives clearing the cache and only the
+	// branches need checking when a repo is listed again.
+	commits map[string]bool
+}{repos: make(map[string]listing), commits: make(map[string]bool)}
+
+// invalidateListings clears the Listing cache.
+func invalidateListings() {
+	listings.Lock()
+	defer listings.Unlock()
+	listings.version++
+	listings.repos = make(map[string]listing)
+}
+
+// forgetCommits clears the Listing cache, including which subvolumes are
+// commits. It's for when a commit's made writable.
+func forgetCommits() {
+	listings.Lock()
+	defer listings.Unlock()
+	listings.version++
+	listings.repos = make(map[string]listing)
+	listings.commits = make(map[string]bool)
+}
+
+func knownCommit(uuid string) bool {
+	listings.Lock()
+	defer listings.Unlock()
+	return listings.commits[uuid]
+}
+
+// Listing returns repo's commits and branches, newest first. Working out
+// which subvolumes are commits means running btrfs for each of them, so
+// listings are cached; a cached listing only costs looking up the repo's
+// transid. Callers mustn't modify the result.
+func Listing(repo string) ([]Subvolume, error) {
+	t, err := transid(repo, "")
+	if err != nil {
+		return nil, err
+	}
+	listings.Lock()
+	cached, ok := listings.repos[repo]
+	version := listings.version
+	listings.Unlock()
+	if ok && cached.transid == t {
+		return cached.subvolumes, nil
+	}
+
+	var subvolumes []Subvolume
+	var commits []string
+	err = Commits(repo, "", Desc, func(c CommitInfo) error {
+		isCommit := knownCommit(c.id)
+		if !isCommit {
+			var err error
+			if isCommit, err = IsReadOnly(path.Join(repo, c.Path)); err != nil {
+				return err
+			}
+			if isCommit {
+				commits = append(commits, c.id)
+			}
+		}
+		s := Subvolume{Name: c.Path, Commit: isCommit, Transid: c.Transid}
+		if !isCommit {
+			s.Head = Head(repo, c.Path)
+		}
+		subvolumes = append(subvolumes, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	listings.Lock()
+	defer listings.Unlock()
+	if listings.version == version {
+		listings.repos[repo] = listing{transid: t, subvolumes: subvolumes}
+		for _, uuid := range commits {
+			listings.commits[uuid] = true
+		}
+	}
+	return subvolumes, nil
+}
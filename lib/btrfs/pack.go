@@ -0,0 +1,216 @@
+package btrfs
+
+// pack.go stores a commit's files as a single object, a pack, that single
+// files can be read back out of without reading the rest, so object stores
+// only have to hold one object per commit to serve reads of any file in it.
+// A pack is:
+//
+//	"PFSPACK1"                          8 bytes
+//	the commit's files, one after the other, in path order
+//	the PackIndex, as JSON
+//	the index's offset and length       8 bytes each, big endian
+//	"PFSPACK1"                          8 bytes
+//
+// Packs are deterministic, the same commit always packs to the same bytes, so
+// they can be compared and deduplicated by their hash. Reading a file means
+// reading the trailer, then the index, then the file's range, which is what
+// ReadPackIndex and OpenPackFile do with an io.ReaderAt.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	packMagic   = "PFSPACK1"
+	packVersion = 1
+	// PackTrailerSize is the size of the end of a pack that says where its
+	// index is.
+	PackTrailerSize = 24
+)
+
+// PackEntry is a file in a pack.
+type PackEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Sha256 is the hex sha256 of the file's contents.
+	Sha256 string `json:"sha256"`
+}
+
+// PackIndex lists the files in a pack, sorted by name.
+type PackIndex struct {
+	Version int    `json:"version"`
+	Commit  string `json:"commit"`
+	// Meta is the commit's metadata, like its parent and branch.
+	Meta  map[string]string `json:"meta"`
+	Files []PackEntry       `json:"files"`
+}
+
+// Find returns the entry for the file name.
+func (x PackIndex) Find(name string) (PackEntry, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	i := sort.Search(len(x.Files), func(i int) bool { return x.Files[i].Name >= name })
+	if i == len(x.Files) || x.Files[i].Name != name {
+		return PackEntry{}, false
+	}
+	return x.Files[i], true
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// WritePack writes commit, from repo, to w as a pack. opts.Open, if it's
+// set, opens the files.
+func WritePack(repo, commit string, w io.Writer, opts ExportOptions) error {
+	name := path.Join(repo, commit)
+	isCommit, err := IsReadOnly(name)
+	if err != nil {
+		return err
+	}
+	if !isCommit {
+		return errorf(ErrCommitNotFound, "%s isn't a commit", commit)
+	}
+	files, err := commitFiles(repo, commit)
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	meta, err := commitMeta(name)
+	if err != nil {
+		return err
+	}
+	index := PackIndex{Version: packVersion, Commit: commit, Meta: meta, Files: []PackEntry{}}
+	open := opts.Open
+	if open == nil {
+		open = func(name string) (io.ReadCloser, error) { return Open(name) }
+	}
+
+	cw := &countingWriter{w: w}
+	if _, err := io.WriteString(cw, packMagic); err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := open(path.Join(name, file))
+		if err != nil {
+			return err
+		}
+		sum := sha256.New()
+		offset := cw.n
+		_, err = io.Copy(io.MultiWriter(cw, sum), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		index.Files = append(index.Files, PackEntry{Name: file, Offset: offset, Length: cw.n - offset, Sha256: hex.EncodeToString(sum.Sum(nil))})
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexOffset := cw.n
+	if _, err := cw.Write(data); err != nil {
+		return err
+	}
+	trailer := make([]byte, PackTrailerSize)
+	binary.BigEndian.PutUint64(trailer[0:8], uint64(indexOffset))
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(len(data)))
+	copy(trailer[16:], packMagic)
+	_, err = cw.Write(trailer)
+	return err
+}
+
+// ParsePackTrailer returns where the index of a pack is, given the last
+// PackTrailerSize bytes of it.
+func ParsePackTrailer(trailer []byte) (offset, length int64, err error) {
+	if len(trailer) != PackTrailerSize || string(trailer[16:]) != packMagic {
+		return 0, 0, fmt.Errorf("Not a pack, its trailer is wrong.")
+	}
+	offset = int64(binary.BigEndian.Uint64(trailer[0:8]))
+	length = int64(binary.BigEndian.Uint64(trailer[8:16]))
+	if offset < int64(len(packMagic)) || length <= 0 {
+		return 0, 0, fmt.Errorf("Corrupt pack trailer, index at %d is %d bytes.", offset, length)
+	}
+	return offset, length, nil
+}
+
+// ParsePackIndex parses the index of a pack.
+func ParsePackIndex(data []byte) (PackIndex, error) {
+	var index PackIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("Corrupt pack index: %s", err)
+	}
+	if index.Version != packVersion {
+		return index, fmt.Errorf("Unsupported pack version %d.", index.Version)
+	}
+	return index, nil
+}
+
+// ReadPackIndex reads the index of the pack in r, which is size bytes.
+func ReadPackIndex(r io.ReaderAt, size int64) (PackIndex, error) {
+	if size < int64(len(packMagic))+PackTrailerSize {
+		return PackIndex{}, fmt.Errorf("Not a pack, it's only %d bytes.", size)
+	}
+	trailer := make([]byte, PackTrailerSize)
+	if _, err := r.ReadAt(trailer, size-PackTrailerSize); err != nil {
+		return PackIndex{}, err
+	}
+	offset, length, err := ParsePackTrailer(trailer)
+	if err != nil {
+		return PackIndex{}, err
+	}
+	if offset+length > size-PackTrailerSize {
+		return PackIndex{}, fmt.Errorf("Corrupt pack trailer, index at %d is %d bytes.", offset, length)
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, offset); err != nil {
+		return PackIndex{}, err
+	}
+	return ParsePackIndex(data)
+}
+
+// OpenPackFile returns a reader for the file e in the pack in r. Reads fail
+// at the end of the file if it doesn't match its checksum.
+func OpenPackFile(r io.ReaderAt, e PackEntry) io.Reader {
+	return VerifyPackEntry(io.NewSectionReader(r, e.Offset, e.Length), e)
+}
+
+// VerifyPackEntry wraps r, which reads the contents of e, so that reads fail
+// at the end of it if it doesn't match e's checksum.
+func VerifyPackEntry(r io.Reader, e PackEntry) io.Reader {
+	return &packEntryReader{r: r, e: e, sum: sha256.New()}
+}
+
+type packEntryReader struct {
+	r   io.Reader
+	e   PackEntry
+	sum hash.Hash
+}
+
+func (r *packEntryReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.sum.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(r.sum.Sum(nil)); got != r.e.Sha256 {
+			return n, fmt.Errorf("%s is corrupt, its sha256 is %s, expected %s.", r.e.Name, got, r.e.Sha256)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,51 @@
+package btrfs
+
+// perms.go lets a repo keep the modes and owners that its files are written
+// with, for pipelines that run as particular users. Repos don't by default,
+// files get the mode and owner of the process writing them. Either way btrfs
+// send streams carry modes and owners so commits arrive on replicas as they
+// were made.
+
+import (
+	"os"
+	"path"
+)
+
+// permsMeta is the repo metadata that turns preserving permissions on.
+const permsMeta = "permissions"
+
+// SetPreservePermissions sets whether repo keeps the modes and owners its
+// files are written with.
+func SetPreservePermissions(repo string, preserve bool) error {
+	if preserve {
+		return SetMeta(repo, permsMeta, "true")
+	}
+	err := Remove(path.Join(repo, ".meta", permsMeta))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// PreservesPermissions returns true if repo keeps the modes and owners its
+// files are written with.
+func PreservesPermissions(repo string) bool {
+	return GetMeta(repo, permsMeta) == "true"
+}
+
+// Chmod changes the mode of name, setuid, setgid and sticky bits included.
+func Chmod(name string, mode os.FileMode) error {
+	if err := checkWriteFile(name); err != nil {
+		return err
+	}
+	return readOnly(os.Chmod(FilePath(name), mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)))
+}
+
+// Lchown changes the owner of name, without following symlinks. A uid or
+// gid of -1 is left as it is.
+func Lchown(name string, uid, gid int) error {
+	if err := checkWrite(name); err != nil {
+		return err
+	}
+	return readOnly(os.Lchown(FilePath(name), uid, gid))
+}
@@ -1,24 +1,37 @@
 package btrfs
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"path"
 
 	"github.com/mitchellh/goamz/s3"
 	"github.com/pachyderm/pfs/lib/s3utils"
 )
 
+// Pushers and Pullers stop what they're doing, and return ctx's error, when
+// ctx is cancelled.
 type Pusher interface {
-	Push(diff io.Reader) error
+	Push(ctx context.Context, diff io.Reader) error
 }
 
 type Puller interface {
 	// Pull pulls data from a replica and applies it to the target,
 	// `from` is used to pickup where you left-off, passing `from=""` will start from the beginning
 	// Pull returns the value that should be passed next as `from`
-	Pull(from string, target Pusher) error
+	Pull(ctx context.Context, from string, target Pusher) error
+}
+
+// SentCommit is the commit a diff was sent from.
+type SentCommit struct {
+	Repo, Name, Parent string
+}
+
+// A CommitPusher is a Pusher that wants to know which commit each diff it's
+// pushed is, Pull tells it.
+type CommitPusher interface {
+	PushCommit(ctx context.Context, info SentCommit, diff io.Reader) error
 }
 
 type Replica interface {
@@ -32,71 +45,173 @@ type LocalReplica struct {
 	repo string
 }
 
-func (r LocalReplica) Push(diff io.Reader) error {
-	return Recv(r.repo, diff)
+func (r LocalReplica) Push(ctx context.Context, diff io.Reader) error {
+	return Recv(ctx, r.repo, diff)
 }
 
-func (r LocalReplica) Pull(from string, cb Pusher) error {
-	return Pull(r.repo, from, cb)
+func (r LocalReplica) Pull(ctx context.Context, from string, cb Pusher) error {
+	return Pull(ctx, r.repo, from, cb)
 }
 
 func NewLocalReplica(repo string) *LocalReplica {
 	return &LocalReplica{repo: repo}
 }
 
+// S3Options configures an S3Replica.
+type S3Options struct {
+	// Bucket says where the bucket is and which credentials to use.
+	Bucket s3utils.BucketOptions
+	// Upload controls how commits are uploaded.
+	Upload s3utils.UploadOptions
+	// Files uploads the files in each commit too, so that they can be
+	// restored one at a time, see RestoreFile.
+	Files bool
+	// Packs uploads each commit as a pack too, packs/<commit>.pack, that
+	// single files can be read out of with ranged reads, see pack.go.
+	Packs bool
+	// Open opens the files uploaded for Files and Packs, it defaults to Open. Callers
+	// that store files in their own format can resolve it here.
+	Open func(name string) (io.ReadCloser, error)
+}
+
+// A FileRestorer can restore single files from the commits it holds.
+type FileRestorer interface {
+	RestoreFile(ctx context.Context, commit, name string, w io.Writer) error
+}
+
 type S3Replica struct {
-	uri   string
-	count int // number of sent commits
+	uri  string
+	opts S3Options
+	// manifest is what's in the replica, it's read the first time we push.
+	manifest *S3Manifest
+	// index is the file index of indexCommit, the last commit we pushed,
+	// which the next commit's index is built from.
+	index       s3Index
+	indexCommit string
+}
+
+func (r *S3Replica) Push(ctx context.Context, diff io.Reader) error {
+	return r.PushCommit(ctx, SentCommit{}, diff)
 }
 
-func (r *S3Replica) Push(diff io.Reader) error {
-	bucket, err := s3utils.NewBucket(r.uri)
+// PushCommit uploads diff, which is info, and adds it to the manifest.
+func (r *S3Replica) PushCommit(ctx context.Context, info SentCommit, diff io.Reader) error {
+	bucket, err := s3utils.NewBucketWithOptions(r.uri, r.opts.Bucket)
 	if err != nil {
-		log.Print(err)
+		logger.ErrorContext(ctx, "connecting to s3", "uri", r.uri, "err", err)
 		return err
 	}
-	key := fmt.Sprintf("%.10d", r.count)
-	r.count++
-
 	p, err := s3utils.GetPath(r.uri)
 	if err != nil {
-		log.Print(err)
+		logger.ErrorContext(ctx, "parsing s3 uri", "uri", r.uri, "err", err)
 		return err
 	}
+	if r.manifest == nil {
+		m, err := ReadS3Manifest(r.uri, r.opts.Bucket)
+		if err != nil {
+			logger.ErrorContext(ctx, "reading s3 manifest", "uri", r.uri, "err", err)
+			return err
+		}
+		r.manifest = &m
+	}
+	key := fmt.Sprintf("%.10d", len(r.manifest.Commits))
 
-	return s3utils.PutMulti(bucket, path.Join(p, key), diff, "application/octet-stream", s3.BucketOwnerFull)
+	if err := fault(FaultS3Upload); err != nil {
+		return err
+	}
+	h := newHashingReader(contextReader{ctx, faultStream(FaultS3Upload, diff)})
+	err = s3utils.Upload(ctx, bucket, path.Join(p, key), h, "application/octet-stream", s3.BucketOwnerFull, r.opts.Upload)
+	if err != nil {
+		logger.ErrorContext(ctx, "uploading to s3", "uri", r.uri, "key", key, "err", err)
+		return err
+	}
+	if r.opts.Files && info.Name != "" {
+		if err := r.pushFiles(ctx, bucket, p, info); err != nil {
+			logger.ErrorContext(ctx, "uploading files to s3", "uri", r.uri, "commit", info.Name, "err", err)
+			return err
+		}
+	}
+	if r.opts.Packs && info.Name != "" {
+		if err := r.pushPack(ctx, bucket, p, info); err != nil {
+			logger.ErrorContext(ctx, "uploading pack to s3", "uri", r.uri, "commit", info.Name, "err", err)
+			return err
+		}
+	}
+	c := newS3Commit(info, key, h)
+	c.Files = r.opts.Files && info.Name != ""
+	c.Pack = r.opts.Packs && info.Name != ""
+	if err := fault(FaultS3Manifest); err != nil {
+		return err
+	}
+	m := S3Manifest{Commits: append(append([]S3Commit(nil), r.manifest.Commits...), c)}
+	if err := writeS3Manifest(ctx, bucket, p, m, r.opts.Upload); err != nil {
+		// The object is orphaned, the next push overwrites it.
+		logger.ErrorContext(ctx, "writing s3 manifest", "uri", r.uri, "err", err)
+		return err
+	}
+	r.manifest = &m
+	return nil
 }
 
-func (r *S3Replica) Pull(from string, target Pusher) error {
-	bucket, err := s3utils.NewBucket(r.uri)
+// Pull pushes the commits after from, which is a commit's name or the key
+// of its object, to target in the order the manifest lists them.
+func (r *S3Replica) Pull(ctx context.Context, from string, target Pusher) error {
+	bucket, err := s3utils.NewBucketWithOptions(r.uri, r.opts.Bucket)
+	if err != nil {
+		logger.ErrorContext(ctx, "connecting to s3", "uri", r.uri, "err", err)
+		return err
+	}
+	p, err := s3utils.GetPath(r.uri)
+	if err != nil {
+		return err
+	}
+	m, err := ReadS3Manifest(r.uri, r.opts.Bucket)
+	if err != nil {
+		logger.ErrorContext(ctx, "reading s3 manifest", "uri", r.uri, "err", err)
+		return err
+	}
+	commits, err := m.after(from)
 	if err != nil {
-		log.Print(err)
 		return err
 	}
-	_, err = s3utils.ForEachFile(r.uri, from, func(path string) error {
-		f, err := bucket.GetReader(path)
-		if f == nil {
-			return fmt.Errorf("Nil file returned.")
+	for _, c := range commits {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
+		key := path.Join(p, c.Key)
+		f, err := bucket.GetReader(key)
 		if err != nil {
-			log.Print(err)
+			logger.ErrorContext(ctx, "reading from s3", "uri", r.uri, "path", key, "err", err)
 			return err
 		}
-		defer f.Close()
-
-		err = target.Push(f)
+		err = target.Push(ctx, verifyingReader{newHashingReader(contextReader{ctx, f}), c})
+		f.Close()
 		if err != nil {
-			log.Print(err)
+			logger.ErrorContext(ctx, "pushing from s3", "uri", r.uri, "path", key, "err", err)
 			return err
 		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 	return nil
 }
 
 func NewS3Replica(uri string) *S3Replica {
-	return &S3Replica{uri: uri}
+	return NewS3ReplicaWithOptions(uri, S3Options{Upload: s3utils.DefaultUploadOptions})
+}
+
+func NewS3ReplicaWithOptions(uri string, opts S3Options) *S3Replica {
+	return &S3Replica{uri: uri, opts: opts}
+}
+
+// contextReader fails reads once ctx is cancelled. goamz doesn't know about
+// contexts so this is how we stop S3 transfers part way through.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
 }
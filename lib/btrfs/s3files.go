@@ -0,0 +1,292 @@
+package btrfs
+
+// s3files.go lets single files be restored from an S3Replica without
+// pulling whole commits. With S3Options.Files set, pushing a commit also
+// uploads the files it added or changed, as files/<commit>/<file>, and an
+// index, index/<commit>.json, that maps every file in the commit to the
+// commit whose upload holds its content. Restoring a file is then one read
+// of the index and one of the file.
+//
+// With S3Options.Packs set the commit is uploaded as a pack instead,
+// packs/<commit>.pack, see pack.go, and a file is restored with three ranged
+// reads: the pack's trailer, its index and the file.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/pachyderm/pfs/lib/s3utils"
+)
+
+// s3Index maps the files in a commit to the commit whose upload holds their
+// content.
+type s3Index map[string]string
+
+func s3IndexKey(p, commit string) string {
+	return path.Join(p, "index", commit+".json")
+}
+
+func s3FileKey(p, commit, name string) string {
+	return path.Join(p, "files", commit, name)
+}
+
+func s3PackKey(p, commit string) string {
+	return path.Join(p, "packs", commit+".pack")
+}
+
+// commitFiles returns the files in commit, skipping metadata.
+func commitFiles(repo, commit string) ([]string, error) {
+	root := FilePath(path.Join(repo, commit))
+	var files []string
+	err := filepath.Walk(root, func(abs string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, abs)
+		if err != nil || rel == "." {
+			return err
+		}
+		if strings.HasPrefix(rel, ".") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files, err
+}
+
+// readS3Index reads commit's index, it returns nil if there isn't one.
+func readS3Index(bucket *s3.Bucket, p, commit string) (s3Index, error) {
+	data, err := bucket.Get(s3IndexKey(p, commit))
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index s3Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// pushFiles uploads the files that info added or changed and its index.
+// Everything is uploaded if the parent's index isn't there to build on.
+func (r *S3Replica) pushFiles(ctx context.Context, bucket *s3.Bucket, p string, info SentCommit) error {
+	var parent s3Index
+	changed := make(map[string]bool)
+	if info.Parent != "" {
+		var err error
+		if r.index != nil && r.indexCommit == info.Parent {
+			parent = r.index
+		} else if parent, err = readS3Index(bucket, p, info.Parent); err != nil {
+			return err
+		}
+		if parent != nil {
+			files, err := FindNew(info.Repo, info.Parent, info.Name)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				changed[file] = true
+			}
+		}
+	}
+	files, err := commitFiles(info.Repo, info.Name)
+	if err != nil {
+		return err
+	}
+	open := r.opts.Open
+	if open == nil {
+		open = func(name string) (io.ReadCloser, error) { return Open(name) }
+	}
+	index := make(s3Index)
+	for _, file := range files {
+		if owner, ok := parent[file]; ok && !changed[file] {
+			index[file] = owner
+			continue
+		}
+		f, err := open(path.Join(info.Repo, info.Name, file))
+		if err != nil {
+			return err
+		}
+		err = s3utils.Upload(ctx, bucket, s3FileKey(p, info.Name, file), contextReader{ctx, f}, "application/octet-stream", s3.BucketOwnerFull, r.opts.Upload)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		index[file] = info.Name
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = s3utils.Upload(ctx, bucket, s3IndexKey(p, info.Name), bytes.NewReader(data), "application/json", s3.BucketOwnerFull, r.opts.Upload)
+	if err != nil {
+		return err
+	}
+	r.index, r.indexCommit = index, info.Name
+	return nil
+}
+
+// pushPack uploads info's commit as a pack.
+func (r *S3Replica) pushPack(ctx context.Context, bucket *s3.Bucket, p string, info SentCommit) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WritePack(info.Repo, info.Name, pw, ExportOptions{Open: r.opts.Open}))
+	}()
+	err := s3utils.Upload(ctx, bucket, s3PackKey(p, info.Name), contextReader{ctx, pr}, "application/octet-stream", s3.BucketOwnerFull, r.opts.Upload)
+	pr.CloseWithError(err)
+	return err
+}
+
+// getRange reads length bytes of key starting at offset, a negative offset
+// reads the last length bytes. It returns nil if there's no key.
+func getRange(bucket *s3.Bucket, key string, offset, length int64) (io.ReadCloser, error) {
+	rng := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	if offset < 0 {
+		rng = fmt.Sprintf("bytes=-%d", length)
+	}
+	resp, err := bucket.GetResponseWithHeaders(key, map[string][]string{"Range": {rng}})
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// readRange is getRange for small ranges that are read whole.
+func readRange(bucket *s3.Bucket, key string, offset, length int64) ([]byte, error) {
+	body, err := getRange(bucket, key, offset, length)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	defer body.Close()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readS3PackIndex reads the index of commit's pack, it returns nil if there
+// isn't a pack.
+func readS3PackIndex(bucket *s3.Bucket, p, commit string) (*PackIndex, error) {
+	key := s3PackKey(p, commit)
+	trailer, err := readRange(bucket, key, -1, PackTrailerSize)
+	if err != nil || trailer == nil {
+		return nil, err
+	}
+	offset, length, err := ParsePackTrailer(trailer)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readRange(bucket, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("Pack %s disappeared while it was being read.", key)
+	}
+	index, err := ParsePackIndex(data)
+	if err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// openPackFile opens the file name from commit's pack. It returns nil if
+// there isn't a pack.
+func openPackFile(ctx context.Context, bucket *s3.Bucket, p, commit, name string) (io.ReadCloser, int64, error) {
+	index, err := readS3PackIndex(bucket, p, commit)
+	if err != nil || index == nil {
+		return nil, 0, err
+	}
+	e, ok := index.Find(name)
+	if !ok {
+		return nil, 0, errorf(ErrFileNotFound, "file %s isn't in commit %s", name, commit)
+	}
+	if e.Length == 0 {
+		return io.NopCloser(VerifyPackEntry(strings.NewReader(""), e)), 0, nil
+	}
+	body, err := getRange(bucket, s3PackKey(p, commit), e.Offset, e.Length)
+	if err != nil {
+		return nil, 0, err
+	}
+	if body == nil {
+		return nil, 0, fmt.Errorf("Pack for %s disappeared while it was being read.", commit)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{VerifyPackEntry(contextReader{ctx, io.LimitReader(body, e.Length)}, e), body}, e.Length, nil
+}
+
+// OpenFile opens the file name as it was in commit and returns its size.
+// Only commits pushed with S3Options.Files or S3Options.Packs set can be
+// read from.
+func (r *S3Replica) OpenFile(ctx context.Context, commit, name string) (io.ReadCloser, int64, error) {
+	bucket, err := s3utils.NewBucketWithOptions(r.uri, r.opts.Bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	p, err := s3utils.GetPath(r.uri)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, err := readS3Index(bucket, p, commit)
+	if err != nil {
+		return nil, 0, err
+	}
+	if index == nil {
+		f, size, err := openPackFile(ctx, bucket, p, commit, name)
+		if err != nil || f != nil {
+			return f, size, err
+		}
+		return nil, 0, errorf(ErrCommitNotFound, "commit %s has no file index or pack in %s", commit, r.uri)
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	owner, ok := index[name]
+	if !ok {
+		return nil, 0, errorf(ErrFileNotFound, "file %s isn't in commit %s", name, commit)
+	}
+	resp, err := bucket.GetResponse(s3FileKey(p, owner, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{contextReader{ctx, resp.Body}, resp.Body}, resp.ContentLength, nil
+}
+
+// RestoreFile writes the file name, as it was in commit, to w. Only commits
+// pushed with S3Options.Files or S3Options.Packs set can be restored from.
+func (r *S3Replica) RestoreFile(ctx context.Context, commit, name string, w io.Writer) error {
+	f, _, err := r.OpenFile(ctx, commit, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
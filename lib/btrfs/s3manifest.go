@@ -0,0 +1,159 @@
+package btrfs
+
+// s3manifest.go describes what's in an S3Replica. Commits are uploaded as
+// numbered objects of send data, <path>/0000000000, <path>/0000000001, ...,
+// and <path>/manifest.json lists them in the order they were pushed, with
+// the commit each one is, its parent and a checksum. Pulls go by the
+// manifest rather than by listing the bucket, so they apply commits in the
+// right order and can check what they read.
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/pachyderm/pfs/lib/s3utils"
+)
+
+// s3ManifestKey is the manifest's key, relative to the replica's path.
+const s3ManifestKey = "manifest.json"
+
+// S3Commit is a commit stored in an S3Replica.
+type S3Commit struct {
+	// Name and Parent are empty for commits that were pushed without
+	// saying which commit they are, and for commits uploaded before
+	// replicas had manifests.
+	Name   string `json:"name,omitempty"`
+	Parent string `json:"parent,omitempty"`
+	// Key is the object holding the commit's send data, relative to the
+	// replica's path.
+	Key string `json:"key"`
+	// Sha256 is the hex encoded checksum of the object, empty if it isn't
+	// known.
+	Sha256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size"`
+	Time   string `json:"time,omitempty"`
+	// Files is true if the commit's files were uploaded as well, see
+	// S3Options.Files.
+	Files bool `json:"files,omitempty"`
+	// Pack is true if the commit was uploaded as a pack too, see
+	// S3Options.Packs.
+	Pack bool `json:"pack,omitempty"`
+}
+
+// S3Manifest lists the commits in an S3Replica, oldest first.
+type S3Manifest struct {
+	Commits []S3Commit `json:"commits"`
+}
+
+// after returns the commits pushed after from, which is a commit's name or
+// its object's key, all of them if from is "".
+func (m S3Manifest) after(from string) ([]S3Commit, error) {
+	if from == "" {
+		return m.Commits, nil
+	}
+	for i, c := range m.Commits {
+		if c.Name == from || c.Key == from || c.Key == path.Base(from) {
+			return m.Commits[i+1:], nil
+		}
+	}
+	return nil, errorf(ErrCommitNotFound, "`from` commit %s isn't in the replica", from)
+}
+
+// ReadS3Manifest reads the manifest of the replica at uri. Replicas that were
+// written before manifests existed get one made by listing the bucket.
+func ReadS3Manifest(uri string, opts s3utils.BucketOptions) (S3Manifest, error) {
+	bucket, err := s3utils.NewBucketWithOptions(uri, opts)
+	if err != nil {
+		return S3Manifest{}, err
+	}
+	p, err := s3utils.GetPath(uri)
+	if err != nil {
+		return S3Manifest{}, err
+	}
+	var m S3Manifest
+	data, err := bucket.Get(path.Join(p, s3ManifestKey))
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == 404 {
+		_, err = s3utils.ForEachFileWithOptions(uri, "", opts, func(key string) error {
+			if path.Base(key) != s3ManifestKey {
+				m.Commits = append(m.Commits, S3Commit{Key: path.Base(key)})
+			}
+			return nil
+		})
+		return m, err
+	}
+	if err != nil {
+		return S3Manifest{}, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return S3Manifest{}, fmt.Errorf("Invalid manifest in %s: %w", uri, err)
+	}
+	return m, nil
+}
+
+// writeS3Manifest replaces the manifest in bucket under p.
+func writeS3Manifest(ctx context.Context, bucket *s3.Bucket, p string, m S3Manifest, opts s3utils.UploadOptions) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s3utils.Upload(ctx, bucket, path.Join(p, s3ManifestKey), bytes.NewReader(data), "application/json", s3.BucketOwnerFull, opts)
+}
+
+// newS3Commit returns the manifest entry for an upload that's been hashed
+// and counted by h.
+func newS3Commit(info SentCommit, key string, h *hashingReader) S3Commit {
+	return S3Commit{
+		Name:   info.Name,
+		Parent: info.Parent,
+		Key:    key,
+		Sha256: hex.EncodeToString(h.hash.Sum(nil)),
+		Size:   h.n,
+		Time:   time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+// hashingReader hashes and counts what's read through it.
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// verifyingReader fails instead of returning io.EOF if what was read doesn't
+// match c's checksum, so a corrupt commit is never applied.
+type verifyingReader struct {
+	*hashingReader
+	c S3Commit
+}
+
+func (v verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.hashingReader.Read(p)
+	if err == io.EOF && v.c.Sha256 != "" {
+		if sum := hex.EncodeToString(v.hash.Sum(nil)); sum != v.c.Sha256 {
+			return n, fmt.Errorf("Object %s has checksum %s, expected %s.", v.c.Key, sum, v.c.Sha256)
+		}
+	}
+	return n, err
+}
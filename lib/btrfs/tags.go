@@ -0,0 +1,118 @@
+package btrfs
+
+// tags.go gives commits names people can remember, like v1.2. A tag is a
+// file in the repo's .meta/tags holding the name of the commit it points
+// at. Tags can be used anywhere a commit can, see ResolveTag, but commits
+// and branches take precedence, so a tag can't be made with the name of
+// either.
+
+import (
+	"os"
+	"path"
+	"sort"
+)
+
+// TagInfo is a tag and the commit it points at.
+type TagInfo struct {
+	Name   string `json:"name"`
+	Commit string `json:"commit"`
+}
+
+func tagPath(repo, tag string) string {
+	return path.Join(repo, ".meta", "tags", tag)
+}
+
+// Tag tags commit, which can itself be a tag, as tag. Tags can't be moved,
+// Untag a tag first to point it somewhere else.
+func Tag(repo, commit, tag string) error {
+	if err := checkFrozen(repo); err != nil {
+		return err
+	}
+	if err := ValidName(tag); err != nil {
+		return err
+	}
+	commit = ResolveTag(repo, commit)
+	isCommit, err := IsReadOnly(path.Join(repo, commit))
+	if err != nil || !isCommit {
+		return errorf(ErrCommitNotFound, "Commit %s not found.", commit)
+	}
+	exists, err := FileExists(path.Join(repo, tag))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errorf(ErrInvalidName, "Can't tag %s, it's already a commit or branch.", tag)
+	}
+	if err := MkdirAll(path.Dir(tagPath(repo, tag))); err != nil {
+		return err
+	}
+	// The tag is written in full and then linked in to place, which fails
+	// if someone else has taken the name.
+	tmp := tagPath(repo, "."+tag+"-"+RandSeq(8))
+	if err := WriteFileAtomic(tmp, []byte(commit)); err != nil {
+		return err
+	}
+	defer Remove(tmp)
+	if err := Link(tmp, tagPath(repo, tag)); os.IsExist(err) {
+		return errorf(ErrTagExists, "Tag %s already exists.", tag)
+	} else if err != nil {
+		return err
+	}
+	return syncDir(path.Dir(tagPath(repo, tag)))
+}
+
+// Untag deletes tag, the commit it points at is left alone.
+func Untag(repo, tag string) error {
+	if err := checkFrozen(repo); err != nil {
+		return err
+	}
+	if err := ValidName(tag); err != nil {
+		return err
+	}
+	err := Remove(tagPath(repo, tag))
+	if os.IsNotExist(err) {
+		return errorf(ErrTagNotFound, "Tag %s not found.", tag)
+	}
+	return err
+}
+
+// ListTags returns repo's tags, sorted by name.
+func ListTags(repo string) ([]TagInfo, error) {
+	files, err := ReadDir(path.Dir(tagPath(repo, "")))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tags []TagInfo
+	for _, f := range files {
+		if ValidName(f.Name()) != nil {
+			// Tags being written.
+			continue
+		}
+		commit, err := ReadFile(tagPath(repo, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, TagInfo{Name: f.Name(), Commit: string(commit)})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// ResolveTag returns the commit name points at if it's a tag, otherwise it
+// returns name.
+func ResolveTag(repo, name string) string {
+	if ValidName(name) != nil {
+		return name
+	}
+	if exists, err := FileExists(path.Join(repo, name)); err != nil || exists {
+		return name
+	}
+	commit, err := ReadFile(tagPath(repo, name))
+	if err != nil {
+		return name
+	}
+	return string(commit)
+}
@@ -0,0 +1,111 @@
+// Package checksum checks uploads against checksums their clients computed,
+// so that data corrupted on its way to pfs is caught when it's written rather
+// than when it's read. Clients send either or both of:
+//
+//	Content-MD5          the base64 MD5 of the body, as in RFC 1864
+//	X-Checksum-Sha256    the hex SHA-256 of the body
+//
+// Whoever writes the body wraps it with NewReader, which fails at the end of
+// the body if it doesn't match.
+package checksum
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+const (
+	MD5Header    = "Content-MD5"
+	SHA256Header = "X-Checksum-Sha256"
+)
+
+// Error is returned when a body doesn't match its checksum.
+type Error struct {
+	Header string
+	// Expected and Got are encoded as they are in Header.
+	Expected string
+	Got      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Body doesn't match its %s, expected %s, got %s.", e.Header, e.Expected, e.Got)
+}
+
+// check is a checksum a body is expected to have.
+type check struct {
+	header   string
+	hash     hash.Hash
+	expected []byte
+	encode   func([]byte) string
+}
+
+// parse returns the checks that header asks for.
+func parse(header http.Header) ([]check, error) {
+	var checks []check
+	if value := header.Get(MD5Header); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != md5.Size {
+			return nil, fmt.Errorf("Invalid %s %s.", MD5Header, value)
+		}
+		checks = append(checks, check{MD5Header, md5.New(), sum, base64.StdEncoding.EncodeToString})
+	}
+	if value := header.Get(SHA256Header); value != "" {
+		sum, err := hex.DecodeString(value)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("Invalid %s %s.", SHA256Header, value)
+		}
+		checks = append(checks, check{SHA256Header, sha256.New(), sum, hex.EncodeToString})
+	}
+	return checks, nil
+}
+
+// Reader reads a body, checking it against its checksums.
+type Reader struct {
+	r      io.Reader
+	checks []check
+}
+
+// NewReader returns a Reader for r, a body sent with header. Reads return an
+// *Error in place of io.EOF if r doesn't match its checksums. It fails if
+// the checksums in header are malformed.
+func NewReader(r io.Reader, header http.Header) (*Reader, error) {
+	checks, err := parse(header)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, checks: checks}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for _, c := range r.checks {
+		c.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		for _, c := range r.checks {
+			if sum := c.hash.Sum(nil); !bytes.Equal(sum, c.expected) {
+				return n, &Error{Header: c.header, Expected: c.encode(c.expected), Got: c.encode(sum)}
+			}
+		}
+	}
+	return n, err
+}
+
+// Set computes the checksums of r and sets them in header. It reads r to
+// the end.
+func Set(header http.Header, r io.Reader) error {
+	md5Sum, sha256Sum := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Sum, sha256Sum), r); err != nil {
+		return err
+	}
+	header.Set(MD5Header, base64.StdEncoding.EncodeToString(md5Sum.Sum(nil)))
+	header.Set(SHA256Header, hex.EncodeToString(sha256Sum.Sum(nil)))
+	return nil
+}
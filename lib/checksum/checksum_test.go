@@ -0,0 +1,59 @@
+package checksum
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	header := make(http.Header)
+	if err := Set(header, strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if header.Get(MD5Header) != "rL0Y20zC+Fzt72VPzMSk2A==" {
+		t.Fatalf("Got %s %s.", MD5Header, header.Get(MD5Header))
+	}
+	if header.Get(SHA256Header) != "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+		t.Fatalf("Got %s %s.", SHA256Header, header.Get(SHA256Header))
+	}
+
+	r, err := NewReader(strings.NewReader("foo"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "foo" {
+		t.Fatalf("Got %q, %v.", data, err)
+	}
+
+	for _, h := range []string{MD5Header, SHA256Header} {
+		only := make(http.Header)
+		only.Set(h, header.Get(h))
+		r, err := NewReader(strings.NewReader("fob"), only)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(r)
+		if e, ok := err.(*Error); !ok || e.Header != h || e.Expected != header.Get(h) {
+			t.Fatalf("Expected a mismatched %s, got %v.", h, err)
+		}
+	}
+
+	// No checksums, nothing to check.
+	r, err = NewReader(strings.NewReader("foo"), make(http.Header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "foo" {
+		t.Fatalf("Got %q, %v.", data, err)
+	}
+
+	for h, value := range map[string]string{MD5Header: "nope", SHA256Header: "abcd"} {
+		bad := make(http.Header)
+		bad.Set(h, value)
+		if _, err := NewReader(strings.NewReader("foo"), bad); err == nil {
+			t.Fatalf("%s %s should be rejected.", h, value)
+		}
+	}
+}
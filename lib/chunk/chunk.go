@@ -0,0 +1,309 @@
+// Package chunk is a content-addressed block store. Files are split in to
+// chunks at content-defined boundaries, found with a rolling hash, and each
+// chunk is stored once under its SHA-256 no matter how many files contain it.
+// A file is then described by a Manifest listing its chunks. Because the
+// boundaries depend on the content rather than on offsets, inserting or
+// removing data only changes the chunks around the edit.
+package chunk
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// window is how many bytes the rolling hash covers.
+const window = 64
+
+// table maps bytes to the random values the rolling hash is built from. It's
+// generated from a fixed seed so boundaries are the same everywhere.
+var table [256]uint32
+
+func init() {
+	// splitmix64
+	x := uint64(0x7066732d63686e6b)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = uint32(z ^ (z >> 31))
+	}
+}
+
+func rotl(x uint32, n uint) uint32 {
+	n %= 32
+	return x<<n | x>>(32-n)
+}
+
+// Chunker decides where chunks end. A chunk ends where the low bits of the
+// rolling hash selected by Mask are all set, but never before Min bytes and
+// always at Max bytes. Chunks average about Mask+1 bytes.
+type Chunker struct {
+	Min, Max int
+	Mask     uint32
+}
+
+// Default makes chunks of 256KB to 4MB, 1MB on average.
+var Default = Chunker{Min: 256 << 10, Max: 4 << 20, Mask: 1<<20 - 1}
+
+// Split reads r to the end and calls f with each chunk in turn. f mustn't
+// hold on to the chunk after it returns.
+func (c Chunker) Split(r io.Reader, f func(chunk []byte) error) error {
+	in := bufio.NewReaderSize(r, 64<<10)
+	chunk := make([]byte, 0, c.Max)
+	var h uint32
+	for {
+		b, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, b)
+		// buzhash, see https://en.wikipedia.org/wiki/Rolling_hash
+		h = rotl(h, 1) ^ table[b]
+		if n := len(chunk); n > window {
+			h ^= rotl(table[chunk[n-1-window]], window)
+		}
+		if (len(chunk) >= c.Min && h&c.Mask == c.Mask) || len(chunk) >= c.Max {
+			if err := f(chunk); err != nil {
+				return err
+			}
+			chunk, h = chunk[:0], 0
+		}
+	}
+	if len(chunk) > 0 {
+		return f(chunk)
+	}
+	return nil
+}
+
+// Ref refers to a chunk in a Store.
+type Ref struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest describes a file as the chunks it's made of.
+type Manifest struct {
+	Size   int64 `json:"size"`
+	Chunks []Ref `json:"chunks"`
+}
+
+// magic starts every encoded Manifest.
+const magic = "pfs-chunk-manifest\n"
+
+// WriteManifest encodes m to w.
+func WriteManifest(w io.Writer, m Manifest) error {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(m)
+}
+
+// ReadManifest decodes a Manifest written by WriteManifest.
+func ReadManifest(r io.Reader) (Manifest, error) {
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != magic {
+		return Manifest{}, fmt.Errorf("Not a chunk manifest.")
+	}
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+// Store stores chunks as files named after their hashes in a directory.
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (s *Store) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// put stores chunk, unless it's already stored, and returns its hash.
+func (s *Store) put(chunk []byte) (string, error) {
+	sum := sha256.Sum256(chunk)
+	hash := hex.EncodeToString(sum[:])
+	if _, err := os.Stat(s.path(hash)); err == nil {
+		// Touch the chunk so that a Sweep that started before the
+		// manifest referring to it is written leaves it alone.
+		now := time.Now()
+		return hash, os.Chtimes(s.path(hash), now, now)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path(hash)), 0777); err != nil {
+		return "", err
+	}
+	// Write to a temporary file and rename it in to place so that readers
+	// never see part of a chunk.
+	f, err := ioutil.TempFile(s.dir, ".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(chunk)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(hash))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// Write splits r with c, stores its chunks and returns its Manifest.
+func (s *Store) Write(r io.Reader, c Chunker) (Manifest, error) {
+	var m Manifest
+	err := c.Split(r, func(chunk []byte) error {
+		hash, err := s.put(chunk)
+		if err != nil {
+			return err
+		}
+		m.Chunks = append(m.Chunks, Ref{Hash: hash, Size: int64(len(chunk))})
+		m.Size += int64(len(chunk))
+		return nil
+	})
+	return m, err
+}
+
+// read reads a chunk and checks that it hasn't been corrupted, since a bad
+// chunk is shared by every file that contains it.
+func (s *Store) read(ref Ref) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(ref.Hash))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != ref.Hash {
+		return nil, fmt.Errorf("Chunk %s is corrupt.", ref.Hash)
+	}
+	return data, nil
+}
+
+// SweepStats counts the chunks a Sweep found.
+type SweepStats struct {
+	// Kept is how many chunks were kept.
+	Kept int
+	// Removed and Bytes are how many chunks were, or would be, removed and
+	// their total size.
+	Removed int
+	Bytes   int64
+}
+
+// Sweep removes the chunks that keep returns false for and that haven't
+// been written or reused since before, along with temporary files left
+// behind by writes that failed. Chunks are touched when they're written or
+// reused, so before should be earlier than any write whose manifest keep
+// might not have seen. If dryRun is true nothing is removed, Sweep just
+// counts what it would remove.
+func (s *Store) Sweep(keep func(hash string) bool, before time.Time, dryRun bool) (SweepStats, error) {
+	var stats SweepStats
+	err := filepath.Walk(s.dir, func(name string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && name == s.dir {
+			// Nothing's been stored yet.
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		isTemp := strings.HasPrefix(fi.Name(), ".tmp")
+		if !isTemp && keep(fi.Name()) || !fi.ModTime().Before(before) {
+			if !isTemp {
+				stats.Kept++
+			}
+			return nil
+		}
+		stats.Removed++
+		stats.Bytes += fi.Size()
+		if dryRun {
+			return nil
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Open returns a Reader for the file m describes.
+func (s *Store) Open(m Manifest) *Reader {
+	return &Reader{s: s, m: m, chunk: -1}
+}
+
+// Reader reads a file from a Store, a chunk at a time.
+type Reader struct {
+	s *Store
+	m Manifest
+	// offset is the position in the file.
+	offset int64
+	// chunk is the index of the chunk in data, -1 if there isn't one.
+	chunk int
+	// start is the offset of chunk in the file.
+	start int64
+	data  []byte
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.m.Size {
+		return 0, io.EOF
+	}
+	if r.chunk == -1 || r.offset < r.start || r.offset >= r.start+int64(len(r.data)) {
+		// Find the chunk containing offset.
+		var start int64
+		for i, ref := range r.m.Chunks {
+			if r.offset < start+ref.Size {
+				data, err := r.s.read(ref)
+				if err != nil {
+					return 0, err
+				}
+				r.chunk, r.start, r.data = i, start, data
+				break
+			}
+			start += ref.Size
+		}
+	}
+	n := copy(p, r.data[r.offset-r.start:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += r.offset
+	case os.SEEK_END:
+		offset += r.m.Size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d.", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Negative position %d.", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
@@ -0,0 +1,193 @@
+package chunk
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var small = Chunker{Min: 64, Max: 4096, Mask: 1<<10 - 1}
+
+func check(err error, t *testing.T) {
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func split(c Chunker, data []byte, t *testing.T) [][]byte {
+	var chunks [][]byte
+	check(c.Split(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	}), t)
+	return chunks
+}
+
+func TestSplit(t *testing.T) {
+	data := randomData(1<<20, 1)
+	chunks := split(small, data, t)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("Chunks don't add up to the data.")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > small.Max || (len(chunk) < small.Min && i != len(chunks)-1) {
+			t.Fatalf("Chunk %d has bad size %d.", i, len(chunk))
+		}
+	}
+	if len(chunks) < 1<<20/small.Max {
+		t.Fatalf("Only got %d chunks.", len(chunks))
+	}
+}
+
+func TestSplitIsContentDefined(t *testing.T) {
+	data := randomData(1<<20, 2)
+	before := make(map[string]bool)
+	for _, chunk := range split(small, data, t) {
+		before[string(chunk)] = true
+	}
+	// Inserting data at the start should only change the first few chunks.
+	after := split(small, append([]byte("inserted"), data...), t)
+	changed := 0
+	for _, chunk := range after {
+		if !before[string(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("%d of %d chunks changed.", changed, len(after))
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunk")
+	check(err, t)
+	defer os.RemoveAll(dir)
+	s := NewStore(dir)
+
+	data := randomData(1<<20, 3)
+	m1, err := s.Write(bytes.NewReader(data), small)
+	check(err, t)
+	if m1.Size != int64(len(data)) {
+		t.Fatalf("Manifest has size %d, expected %d.", m1.Size, len(data))
+	}
+	countChunks := func() int {
+		n := 0
+		filepath.Walk(dir, func(_ string, fi os.FileInfo, _ error) error {
+			if fi != nil && !fi.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	stored := countChunks()
+	// Writing the same data again stores nothing new.
+	m2, err := s.Write(bytes.NewReader(data), small)
+	check(err, t)
+	if countChunks() != stored || len(m1.Chunks) != len(m2.Chunks) {
+		t.Fatal("Identical data was stored twice.")
+	}
+
+	var buf bytes.Buffer
+	check(WriteManifest(&buf, m1), t)
+	m, err := ReadManifest(&buf)
+	check(err, t)
+	read, err := ioutil.ReadAll(s.Open(m))
+	check(err, t)
+	if !bytes.Equal(read, data) {
+		t.Fatal("Read back the wrong data.")
+	}
+
+	r := s.Open(m)
+	offset, err := r.Seek(-100, os.SEEK_END)
+	check(err, t)
+	if offset != int64(len(data)-100) {
+		t.Fatalf("Seeked to %d.", offset)
+	}
+	tail, err := ioutil.ReadAll(r)
+	check(err, t)
+	if !bytes.Equal(tail, data[len(data)-100:]) {
+		t.Fatal("Read back the wrong data after seeking.")
+	}
+	_, err = r.Seek(12345, os.SEEK_SET)
+	check(err, t)
+	part := make([]byte, 10000)
+	_, err = io.ReadFull(r, part)
+	check(err, t)
+	if !bytes.Equal(part, data[12345:22345]) {
+		t.Fatal("Read back the wrong data after seeking.")
+	}
+
+	if _, err := ReadManifest(bytes.NewReader(data)); err == nil {
+		t.Fatal("Random data shouldn't be a manifest.")
+	}
+}
+
+func TestCorruptChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunk")
+	check(err, t)
+	defer os.RemoveAll(dir)
+	s := NewStore(dir)
+	m, err := s.Write(bytes.NewReader(randomData(10000, 4)), small)
+	check(err, t)
+	check(ioutil.WriteFile(s.path(m.Chunks[0].Hash), []byte("corrupt"), 0666), t)
+	if _, err := ioutil.ReadAll(s.Open(m)); err == nil {
+		t.Fatal("Reading a corrupt chunk should fail.")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunk")
+	check(err, t)
+	defer os.RemoveAll(dir)
+	s := NewStore(dir)
+	kept, err := s.Write(bytes.NewReader(randomData(10000, 5)), small)
+	check(err, t)
+	garbage, err := s.Write(bytes.NewReader(randomData(10000, 6)), small)
+	check(err, t)
+	keep := make(map[string]bool)
+	for _, ref := range kept.Chunks {
+		keep[ref.Hash] = true
+	}
+	keepFunc := func(hash string) bool { return keep[hash] }
+
+	// Everything was written after before so nothing is removed.
+	stats, err := s.Sweep(keepFunc, time.Now().Add(-time.Hour), false)
+	check(err, t)
+	if stats.Removed != 0 {
+		t.Fatalf("Removed %d chunks that were just written.", stats.Removed)
+	}
+	stats, err = s.Sweep(keepFunc, time.Now().Add(time.Hour), true)
+	check(err, t)
+	if stats.Removed != len(garbage.Chunks) || stats.Kept != len(kept.Chunks) {
+		t.Fatalf("Dry run would remove %d chunks and keep %d, expected %d and %d.", stats.Removed, stats.Kept, len(garbage.Chunks), len(kept.Chunks))
+	}
+	if _, err := ioutil.ReadAll(s.Open(garbage)); err != nil {
+		t.Fatal("A dry run removed chunks.")
+	}
+	_, err = s.Sweep(keepFunc, time.Now().Add(time.Hour), false)
+	check(err, t)
+	if _, err := ioutil.ReadAll(s.Open(kept)); err != nil {
+		t.Fatalf("Kept chunks were removed: %s.", err)
+	}
+	if _, err := ioutil.ReadAll(s.Open(garbage)); err == nil {
+		t.Fatal("Unreferenced chunks weren't removed.")
+	}
+
+	stats, err = NewStore(filepath.Join(dir, "missing")).Sweep(keepFunc, time.Now(), false)
+	check(err, t)
+	if stats != (SweepStats{}) {
+		t.Fatalf("Swept %v from an empty store.", stats)
+	}
+}
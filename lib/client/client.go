@@ -0,0 +1,687 @@
+// Package client is a Go client for pfs. It talks to a cluster's router,
+// which takes care of sending each request to the shards that should get it,
+// so a Client only needs the router's url:
+//
+//	c := client.New("http://pfs")
+//	if err := c.PutFile("logs/1", "master", strings.NewReader("hello")); err != nil {
+//		return err
+//	}
+//	commit, err := c.Commit("master", "")
+//
+// Requests that fail because of the network, an error on the server or
+// being throttled are retried. Writes are tagged with a request id so that a
+// retry of a write that actually went through isn't applied twice. Files
+// are sent with their checksums, so that pfs rejects them if they're
+// corrupted on the way. A Client can be given several routers, requests move
+// on to the next one when the one they're using fails:
+//
+//	c := client.New("http://router-1", "http://router-2")
+//
+// When no router can serve a read of a file, it's read straight from the
+// shard that owns it, its primary first and then its replicas. The Client
+// finds them with the cluster's topology, which it fetches from a router the
+// first time a read needs it, or when Refresh is called, and refreshes every
+// RefreshInterval after that so that it's still there when every router is
+// down. Reads served by a replica may not see the newest writes to a branch.
+//
+// A Client reads its own writes: it remembers the consistency token of its
+// last write and passes it on reads so that they're only served by nodes that
+// have caught up with it. Pass Token to another Client's SetToken to have it
+// read this one's writes.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/pachyderm/pfs/lib/checksum"
+	"github.com/pachyderm/pfs/lib/discovery"
+	"github.com/pachyderm/pfs/lib/pipeline"
+	"github.com/pachyderm/pfs/lib/route"
+	"github.com/pachyderm/pfs/lib/stripe"
+)
+
+// Client talks to a pfs cluster.
+type Client struct {
+	routers []string
+	http    *http.Client
+	// Retries is how many times a failed request is retried.
+	Retries int
+	// Backoff is how long to wait before the first retry, it doubles with
+	// each retry. Throttled requests wait as long as the server asks if
+	// that's longer.
+	Backoff time.Duration
+	// Parallelism is how many files PushDir and PullDir transfer at once.
+	Parallelism int
+	// RefreshInterval is how often the topology is refreshed once the
+	// Client has one, 0 means it's only refreshed when a read needs it.
+	RefreshInterval time.Duration
+	// lock guards token, router, topology and refreshed.
+	lock  sync.Mutex
+	token string
+	// router is the index in routers of the router requests are sent to.
+	router    int
+	topology  *Topology
+	refreshed time.Time
+}
+
+// tokenHeader carries consistency tokens.
+const tokenHeader = "X-Pfs-Token"
+
+// Token returns the consistency token of the Client's last write, "" if it
+// hasn't written anything.
+func (c *Client) Token() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.token
+}
+
+// SetToken makes the Client's reads see at least the writes token came from.
+func (c *Client) SetToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token = token
+}
+
+// New returns a Client for the cluster whose router is at url. Requests fail
+// over to the routers at others, in turn, when the one they're sent to
+// fails.
+func New(url string, others ...string) *Client {
+	c := &Client{
+		http:            http.DefaultClient,
+		Retries:         3,
+		Backoff:         100 * time.Millisecond,
+		Parallelism:     8,
+		RefreshInterval: time.Minute,
+	}
+	for _, u := range append([]string{url}, others...) {
+		c.routers = append(c.routers, strings.TrimSuffix(u, "/"))
+	}
+	return c
+}
+
+// currentRouter returns the router requests are being sent to.
+func (c *Client) currentRouter() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.routers[c.router]
+}
+
+// failover moves requests on from router to the next router, unless another
+// request already has.
+func (c *Client) failover(router string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.routers[c.router] == router {
+		c.router = (c.router + 1) % len(c.routers)
+	}
+}
+
+// Error is returned when pfs rejects a request.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("pfs returned %d: %s", e.Status, e.Message)
+}
+
+// CommitInfo describes a commit.
+type CommitInfo struct {
+	Id     string `json:"id"`
+	Branch string `json:"branch"`
+	Parent string `json:"parent"`
+	TStamp string `json:"tstamp"`
+	// Files is how many files changed in the commit.
+	Files int `json:"files"`
+	// Shards is how many shards made the commit.
+	Shards int `json:"shards"`
+}
+
+// LogEntry is a commit in the cluster's commit log.
+type LogEntry struct {
+	Name   string `json:"name"`
+	TStamp string `json:"tstamp"`
+	Shards int    `json:"shards"`
+	// Missing lists the shards that don't have the commit.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// retryable returns true if a request that failed with status might succeed
+// if it's sent again.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// transient returns true if err is from the network or a response that's
+// retryable.
+func transient(err error) bool {
+	e, ok := err.(*Error)
+	return !ok || retryable(e.Status)
+}
+
+// send sends a single request to u, with id as its request id if it's not "".
+// It returns the response if it succeeded.
+func (c *Client) send(method, u string, header http.Header, id string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	if token := c.Token(); method == "GET" && token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if token := resp.Header.Get(tokenHeader); method != "GET" && token != "" {
+			c.SetToken(token)
+		}
+		return resp, nil
+	}
+	message, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, &Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
+
+// do sends a request and returns the response if it succeeded. body is
+// called for each attempt to get a fresh request body, nil means there's no
+// body. header is added to the request. Failures are retried if retry is
+// true, each retry goes to the next router unless the request was
+// throttled.
+func (c *Client) do(method, p string, query url.Values, header http.Header, body func() (io.Reader, error), retry bool) (*http.Response, error) {
+	if len(query) > 0 {
+		p += "?" + query.Encode()
+	}
+	id := ""
+	if method != "GET" {
+		id = uuid.New()
+	}
+	retries := c.Retries
+	if !retry {
+		retries = 0
+	}
+	var err error
+	var wait time.Duration
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if backoff := c.Backoff << uint(attempt-1); backoff > wait {
+				wait = backoff
+			}
+			time.Sleep(wait)
+		}
+		var r io.Reader
+		if body != nil {
+			if r, err = body(); err != nil {
+				return nil, err
+			}
+		}
+		router := c.currentRouter()
+		var resp *http.Response
+		if resp, err = c.send(method, router+p, header, id, r); err == nil {
+			return resp, nil
+		}
+		if !transient(err) {
+			// The request is wrong, sending it again won't help.
+			return nil, err
+		}
+		wait = 0
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			// It's us that's going too fast, not the router that's
+			// failing.
+			seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			wait = time.Duration(seconds) * time.Second
+			continue
+		}
+		c.failover(router)
+	}
+	return nil, err
+}
+
+// Topology is where a cluster's files are, as a router sees it.
+type Topology struct {
+	// Modulos is how many shards the cluster's files are spread over.
+	Modulos uint64 `json:"modulos"`
+	// Placement is the name of the placement that decides which shard
+	// owns a file, see lib/route.
+	Placement string             `json:"placement"`
+	Members   []discovery.Member `json:"members"`
+}
+
+// Topology returns the last topology the Client fetched, nil if it hasn't
+// fetched one.
+func (c *Client) Topology() *Topology {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.topology
+}
+
+// Refresh fetches the cluster's topology from a router.
+func (c *Client) Refresh() error {
+	resp, err := c.do("GET", "/topology", nil, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var t Topology
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.topology = &t
+	c.refreshed = time.Now()
+	return nil
+}
+
+// errNoTopology is returned when a read can't go straight to the shards
+// because the Client doesn't know where they are.
+var errNoTopology = errors.New("no topology")
+
+// shardHosts returns the addresses of the primary and then the replicas of
+// the shard that owns the file at the url path p.
+func (c *Client) shardHosts(p string) ([]string, error) {
+	t := c.Topology()
+	if t == nil || t.Modulos == 0 {
+		return nil, errNoTopology
+	}
+	placement, err := route.GetPlacement(t.Placement)
+	if err != nil {
+		return nil, err
+	}
+	shard := placement.Owner(p, t.Modulos)
+	var primary *discovery.Member
+	var hosts []string
+	for i, m := range t.Members {
+		if m.Shard != shard || m.Modulos != t.Modulos {
+			continue
+		}
+		switch m.Role {
+		case discovery.RoleMaster:
+			// Until an old primary's registration expires there can be
+			// two, the newest epoch wins.
+			if primary == nil || m.Epoch > primary.Epoch {
+				primary = &t.Members[i]
+			}
+		case discovery.RoleReplica:
+			hosts = append(hosts, m.Address)
+		}
+	}
+	if primary != nil {
+		hosts = append([]string{primary.Address}, hosts...)
+	}
+	return hosts, nil
+}
+
+// readFromShards sends a GET of the file at p straight to the shards that
+// have it, trying each in turn.
+func (c *Client) readFromShards(p string, query url.Values, header http.Header) (*http.Response, error) {
+	// The routers might be up but unable to reach the primary, in which
+	// case they can tell us about its replicas.
+	c.Refresh()
+	hosts, err := c.shardHosts(p)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("No shard has %s.", p)
+	for _, host := range hosts {
+		u := "http://" + strings.TrimPrefix(host, "http://") + p
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		var resp *http.Response
+		if resp, err = c.send("GET", u, header, "", nil); err != nil {
+			continue
+		}
+		if resp.Header.Get(stripe.Header) != "" {
+			// The shard has the file's manifest, only routers can put
+			// the stripes back together.
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s is striped, it can only be read through a router.", p)
+		}
+		return resp, nil
+	}
+	return nil, err
+}
+
+// read sends a GET of the file at p. If no router can serve it, it's read
+// straight from the shards.
+func (c *Client) read(p string, query url.Values, header http.Header) (*http.Response, error) {
+	c.lock.Lock()
+	stale := c.topology != nil && c.RefreshInterval > 0 && time.Since(c.refreshed) > c.RefreshInterval
+	c.lock.Unlock()
+	if stale {
+		// If the routers are down we'll make do with the old one.
+		c.Refresh()
+	}
+	resp, err := c.do("GET", p, query, header, nil, true)
+	if err == nil || !transient(err) {
+		return resp, err
+	}
+	resp, shardErr := c.readFromShards(p, query, header)
+	if shardErr == errNoTopology {
+		return nil, err
+	}
+	return resp, shardErr
+}
+
+// PutFile writes the contents of r to the file name on branch. If r is an
+// io.Seeker that can seek failed writes are retried, and the write is sent
+// with r's checksums so that pfs rejects it if it's corrupted on the way.
+func (c *Client) PutFile(name, branch string, r io.Reader) error {
+	body := func() (io.Reader, error) { return r, nil }
+	seeker, retry := r.(io.Seeker)
+	var start int64
+	if retry {
+		// Files can be Seekers that can't seek, like pipes.
+		var err error
+		start, err = seeker.Seek(0, 1)
+		retry = err == nil
+	}
+	var header http.Header
+	if retry {
+		body = func() (io.Reader, error) {
+			_, err := seeker.Seek(start, 0)
+			return r, err
+		}
+		header = make(http.Header)
+		if err := checksum.Set(header, r); err != nil {
+			return err
+		}
+	}
+	resp, err := c.do("POST", path.Join("/file", name), url.Values{"branch": {branch}}, header, body, retry)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetFile returns the contents of the file name at commit, which can also
+// be a branch. Close it when you're done with it.
+func (c *Client) GetFile(name, commit string) (io.ReadCloser, error) {
+	resp, err := c.read(path.Join("/file", name), url.Values{"commit": {commit}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteFile deletes the file name from branch.
+func (c *Client) DeleteFile(name, branch string) error {
+	resp, err := c.do("DELETE", path.Join("/file", name), url.Values{"branch": {branch}}, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// FileSize returns the size of the file name at commit.
+func (c *Client) FileSize(name, commit string) (int64, error) {
+	// Asking for the first byte gets us the size in Content-Range without
+	// the rest of the file.
+	resp, err := c.read(path.Join("/file", name), url.Values{"commit": {commit}}, http.Header{"Range": {"bytes=0-0"}})
+	if e, ok := err.(*Error); ok && e.Status == http.StatusRequestedRangeNotSatisfiable {
+		// Empty files don't have a first byte.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		// The range was ignored so we got the whole file.
+		return resp.ContentLength, nil
+	}
+	var start, end, size int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, fmt.Errorf("Invalid Content-Range %q.", resp.Header.Get("Content-Range"))
+	}
+	return size, nil
+}
+
+// Commit commits branch as commit, "" picks a new name.
+func (c *Client) Commit(branch, commit string) (CommitInfo, error) {
+	var info CommitInfo
+	query := url.Values{"branch": {branch}}
+	if commit == "" {
+		// We pick the name rather than the router so that retries commit
+		// under the same name.
+		commit = uuid.New()
+	}
+	query.Set("commit", commit)
+	resp, err := c.do("POST", "/commit", query, nil, nil, true)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// ListCommits returns every commit in the cluster, newest first.
+func (c *Client) ListCommits() ([]LogEntry, error) {
+	resp, err := c.do("GET", "/commit", nil, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var entries []LogEntry
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var entry LogEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// BranchInfo describes a branch.
+type BranchInfo struct {
+	Name   string `json:"name"`
+	TStamp string `json:"tstamp"`
+}
+
+// Branch creates branch from commit.
+func (c *Client) Branch(commit, branch string) error {
+	resp, err := c.do("POST", "/branch", url.Values{"commit": {commit}, "branch": {branch}}, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListBranches returns every branch in the cluster.
+func (c *Client) ListBranches() ([]BranchInfo, error) {
+	resp, err := c.do("GET", "/branch", nil, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var branches []BranchInfo
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var branch BranchInfo
+		if err := decoder.Decode(&branch); err == io.EOF {
+			return branches, nil
+		} else if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch)
+	}
+}
+
+// Head returns the commit at the head of branch. Passing it to reads
+// instead of the branch pins them to the branch as it is now.
+func (c *Client) Head(branch string) (string, error) {
+	resp, err := c.do("GET", "/head", url.Values{"branch": {branch}}, nil, nil, true)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var head struct {
+		Commit string `json:"commit"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&head)
+	return head.Commit, err
+}
+
+// HoldInfo describes a hold, see Hold.
+type HoldInfo struct {
+	Id      string `json:"id"`
+	Commit  string `json:"commit"`
+	Expires string `json:"expires"`
+}
+
+// Hold holds commit for ttl, 0 means the default of 10 minutes. Reads from
+// the hold with GetHeldFile see the commit as it is now even if it's deleted
+// before they're done. Renew the hold to keep it for longer and Release it
+// when you're done.
+func (c *Client) Hold(commit string, ttl time.Duration) (HoldInfo, error) {
+	var info HoldInfo
+	// We pick the id rather than the router so that retries make one hold.
+	query := url.Values{"commit": {commit}, "id": {uuid.New()}}
+	if ttl != 0 {
+		query.Set("ttl", ttl.String())
+	}
+	resp, err := c.do("POST", "/hold", query, nil, nil, true)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// Renew makes the hold id expire ttl from now, 0 means the default.
+func (c *Client) Renew(id string, ttl time.Duration) (HoldInfo, error) {
+	var info HoldInfo
+	query := url.Values{}
+	if ttl != 0 {
+		query.Set("ttl", ttl.String())
+	}
+	resp, err := c.do("POST", path.Join("/hold", id), query, nil, nil, true)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// Release releases the hold id.
+func (c *Client) Release(id string) error {
+	resp, err := c.do("DELETE", path.Join("/hold", id), nil, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetHeldFile is like GetFile but reads from the hold id, see Hold.
+func (c *Client) GetHeldFile(name, id string) (io.ReadCloser, error) {
+	resp, err := c.read(path.Join("/file", name), url.Values{"hold": {id}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// TagInfo describes a tag.
+type TagInfo struct {
+	Name   string `json:"name"`
+	Commit string `json:"commit"`
+}
+
+// Tag tags commit as tag, tags can be used anywhere a commit can.
+func (c *Client) Tag(commit, tag string) error {
+	resp, err := c.do("POST", "/tag", url.Values{"commit": {commit}, "tag": {tag}}, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListTags returns every tag in the cluster.
+func (c *Client) ListTags() ([]TagInfo, error) {
+	resp, err := c.do("GET", "/tag", nil, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tags []TagInfo
+	// Every shard lists every tag.
+	seen := make(map[string]bool)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var tag TagInfo
+		if err := decoder.Decode(&tag); err == io.EOF {
+			return tags, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if !seen[tag.Name] {
+			seen[tag.Name] = true
+			tags = append(tags, tag)
+		}
+	}
+}
+
+// Diff returns the files that changed between the commits from and to.
+func (c *Client) Diff(from, to string) ([]string, error) {
+	resp, err := c.do("GET", "/diff", url.Values{"from": {from}, "to": {to}}, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var files []string
+	err = json.NewDecoder(resp.Body).Decode(&files)
+	return files, err
+}
+
+// CreatePipeline registers p with every shard. If a retry finds that the
+// pipeline already exists the Error's Status is 409.
+func (c *Client) CreatePipeline(p pipeline.Pipeline) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", "/pipeline", nil, nil, func() (io.Reader, error) { return bytes.NewReader(data), nil }, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
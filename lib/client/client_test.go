@@ -0,0 +1,393 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/discovery"
+	"github.com/pachyderm/pfs/lib/pipeline"
+)
+
+func TestRetry(t *testing.T) {
+	var writes, sums []string
+	failures := 2
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		writes = append(writes, string(data))
+		sums = append(sums, r.Header.Get("X-Checksum-Sha256"))
+		if failures > 0 {
+			failures--
+			http.Error(w, "Try again.", 500)
+			return
+		}
+		fmt.Fprintln(w, "Created file.")
+	}))
+	defer s.Close()
+	c := New(s.URL)
+	c.Backoff = 0
+
+	if err := c.PutFile("file", "master", strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes) != 3 || writes[2] != "foo" {
+		t.Fatalf("Failed writes should be retried with the whole body, got %q.", writes)
+	}
+	if sums[2] != "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae" {
+		t.Fatalf("Write was sent with checksum %q.", sums[2])
+	}
+
+	// Readers that can't be rewound can't be retried.
+	writes, failures = nil, 1
+	err := c.PutFile("file", "master", ioutil.NopCloser(strings.NewReader("foo")))
+	if e, ok := err.(*Error); !ok || e.Status != 500 || e.Message != "Try again." || len(writes) != 1 {
+		t.Fatalf("Expected one failed write, got %v after %q.", err, writes)
+	}
+
+	writes, failures = nil, 10
+	if err := c.PutFile("file", "master", strings.NewReader("foo")); err == nil || len(writes) != c.Retries+1 {
+		t.Fatalf("Expected %d failed writes, got %v after %q.", c.Retries+1, err, writes)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "Pipeline wc already exists.", 409)
+	}))
+	defer s.Close()
+	c := New(s.URL)
+	err := c.CreatePipeline(pipeline.Pipeline{Name: "wc", Cmd: []string{"wc"}})
+	if e, ok := err.(*Error); !ok || e.Status != 409 {
+		t.Fatalf("Expected a 409, got %v.", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Rejected requests shouldn't be retried, got %d requests.", requests)
+	}
+}
+
+func TestClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/file/dir/file":
+			fmt.Fprintf(w, "contents of %s", r.URL.Query().Get("commit"))
+		case r.Method == "POST" && r.URL.Path == "/commit":
+			json.NewEncoder(w).Encode(CommitInfo{Id: "commit1", Branch: r.URL.Query().Get("branch"), Files: 2, Shards: 4})
+		case r.Method == "GET" && r.URL.Path == "/commit":
+			json.NewEncoder(w).Encode(LogEntry{Name: "commit2", Shards: 4})
+			json.NewEncoder(w).Encode(LogEntry{Name: "commit1", Shards: 3, Missing: []string{"shard-3"}})
+		case r.Method == "GET" && r.URL.Path == "/branch":
+			json.NewEncoder(w).Encode(BranchInfo{Name: "master"})
+			json.NewEncoder(w).Encode(BranchInfo{Name: "dev"})
+		case r.Method == "GET" && r.URL.Path == "/head":
+			fmt.Fprintf(w, `{"branch":%q,"commit":"commit2"}`, r.URL.Query().Get("branch"))
+		case r.Method == "POST" && r.URL.Path == "/hold":
+			fmt.Fprintf(w, `{"id":%q,"commit":%q,"expires":%q}`, r.URL.Query().Get("id"), r.URL.Query().Get("commit"), r.URL.Query().Get("ttl"))
+		case r.Method == "GET" && r.URL.Path == "/file/dir/held":
+			fmt.Fprintf(w, "contents of hold %s", r.URL.Query().Get("hold"))
+		case r.Method == "DELETE" && r.URL.Path == "/hold/hold1":
+			fmt.Fprint(w, "Released hold hold1.\n")
+		case r.Method == "POST" && r.URL.Path == "/branch":
+			fmt.Fprintf(w, "Created branch. (%s) -> %s.\n", r.URL.Query().Get("commit"), r.URL.Query().Get("branch"))
+		case r.Method == "GET" && r.URL.Path == "/diff":
+			json.NewEncoder(w).Encode([]string{r.URL.Query().Get("from"), r.URL.Query().Get("to")})
+		case r.Method == "POST" && r.URL.Path == "/pipeline":
+			var p pipeline.Pipeline
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Name != "wc" {
+				http.Error(w, "Bad pipeline.", 400)
+				return
+			}
+			json.NewEncoder(w).Encode(p)
+		default:
+			http.Error(w, "Not found.", 404)
+		}
+	}))
+	defer s.Close()
+	c := New(s.URL)
+
+	f, err := c.GetFile("dir/file", "commit1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "contents of commit1" {
+		t.Fatalf("Got %q, %v.", data, err)
+	}
+	if _, err := c.GetFile("nope", "master"); err == nil {
+		t.Fatal("Getting a missing file should fail.")
+	}
+
+	info, err := c.Commit("master", "")
+	if err != nil || info.Id != "commit1" || info.Branch != "master" || info.Shards != 4 {
+		t.Fatalf("Unexpected commit %+v, %v.", info, err)
+	}
+	entries, err := c.ListCommits()
+	if err != nil || len(entries) != 2 || entries[0].Name != "commit2" || entries[1].Missing[0] != "shard-3" {
+		t.Fatalf("Unexpected commits %+v, %v.", entries, err)
+	}
+	if err := c.Branch("commit1", "dev"); err != nil {
+		t.Fatal(err)
+	}
+	branches, err := c.ListBranches()
+	if err != nil || len(branches) != 2 || branches[1].Name != "dev" {
+		t.Fatalf("Unexpected branches %+v, %v.", branches, err)
+	}
+	head, err := c.Head("master")
+	if err != nil || head != "commit2" {
+		t.Fatalf("Unexpected head %q, %v.", head, err)
+	}
+	hold, err := c.Hold("commit2", time.Minute)
+	if err != nil || hold.Id == "" || hold.Commit != "commit2" || hold.Expires != "1m0s" {
+		t.Fatalf("Unexpected hold %+v, %v.", hold, err)
+	}
+	f, err = c.GetHeldFile("dir/held", "hold1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "contents of hold hold1" {
+		t.Fatalf("Got %q, %v.", data, err)
+	}
+	if err := c.Release("hold1"); err != nil {
+		t.Fatal(err)
+	}
+	files, err := c.Diff("commit1", "commit2")
+	if err != nil || len(files) != 2 || files[0] != "commit1" || files[1] != "commit2" {
+		t.Fatalf("Unexpected diff %q, %v.", files, err)
+	}
+	if err := c.CreatePipeline(pipeline.Pipeline{Name: "wc", Cmd: []string{"wc"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	var tokens []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			tokens = append(tokens, r.Header.Get("X-Pfs-Token"))
+			return
+		}
+		w.Header().Set("X-Pfs-Token", "commit1")
+		fmt.Fprintln(w, "Created file.")
+	}))
+	defer s.Close()
+	c := New(s.URL)
+	f, err := c.GetFile("file", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := c.PutFile("file", "master", strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if c.Token() != "commit1" {
+		t.Fatalf("Expected token commit1, got %q.", c.Token())
+	}
+	if f, err = c.GetFile("file", "master"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	other := New(s.URL)
+	other.SetToken(c.Token())
+	if f, err = other.GetFile("file", "master"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if len(tokens) != 3 || tokens[0] != "" || tokens[1] != "commit1" || tokens[2] != "commit1" {
+		t.Fatalf("Reads were sent with tokens %q.", tokens)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	var requests []string
+	handler := func(name string, status int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, name)
+			if status == http.StatusTooManyRequests {
+				// Throttle once.
+				status = 200
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "Slow down.", http.StatusTooManyRequests)
+				return
+			}
+			if status != 200 {
+				http.Error(w, "Down.", status)
+				return
+			}
+			fmt.Fprintln(w, "Created file.")
+		}
+	}
+	down := httptest.NewServer(handler("down", 503))
+	defer down.Close()
+	throttled := httptest.NewServer(handler("throttled", http.StatusTooManyRequests))
+	defer throttled.Close()
+	c := New(down.URL, throttled.URL)
+	c.Backoff = 0
+
+	if err := c.PutFile("file", "master", strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	// Throttled requests are retried on the same router.
+	if strings.Join(requests, " ") != "down throttled throttled" {
+		t.Fatalf("Got requests %q.", requests)
+	}
+	// Requests stay with the router that works.
+	requests = nil
+	if err := c.PutFile("file", "master", strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(requests, " ") != "throttled" {
+		t.Fatalf("Got requests %q.", requests)
+	}
+}
+
+func TestShardReads(t *testing.T) {
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file/file" {
+			http.Error(w, "Not found.", 404)
+			return
+		}
+		fmt.Fprintf(w, "replica's %s", r.URL.Query().Get("commit"))
+	}))
+	defer replica.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// The primary is down.
+	primary.Close()
+	topology := Topology{
+		Modulos:   1,
+		Placement: "modulo",
+		Members: []discovery.Member{
+			{Shard: 0, Modulos: 1, Address: primary.URL, Role: discovery.RoleMaster},
+			{Shard: 0, Modulos: 1, Address: replica.URL, Role: discovery.RoleReplica},
+		},
+	}
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/topology" {
+			json.NewEncoder(w).Encode(topology)
+			return
+		}
+		http.Error(w, "Failed to reach the primary.", 500)
+	}))
+	c := New(router.URL)
+	c.Backoff = 0
+
+	f, err := c.GetFile("file", "commit1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "replica's commit1" {
+		t.Fatalf("Got %q, %v.", data, err)
+	}
+	if c.Topology() == nil || len(c.Topology().Members) != 2 {
+		t.Fatalf("Unexpected topology %+v.", c.Topology())
+	}
+	// With the router down the Client remembers where the shards are, and
+	// returns their errors.
+	router.Close()
+	if _, err := c.GetFile("missing", "commit1"); err == nil {
+		t.Fatal("Getting a missing file should fail.")
+	}
+	if f, err = c.GetFile("file", "commit2"); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "replica's commit2" {
+		t.Fatalf("Got %q, %v.", data, err)
+	}
+}
+
+func TestPushPullDir(t *testing.T) {
+	var lock sync.Mutex
+	files := make(map[string]string)
+	var writes []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		name := strings.TrimPrefix(r.URL.Path, "/file/")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/list":
+			var list []string
+			for name := range files {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					list = append(list, name)
+				}
+			}
+			sort.Strings(list)
+			json.NewEncoder(w).Encode(list)
+		case r.Method == "GET" && r.URL.Query().Get("stat") == "true":
+			data, ok := files[name]
+			if !ok {
+				http.Error(w, "Not found.", 404)
+				return
+			}
+			json.NewEncoder(w).Encode(FileInfo{Name: name, Type: "file", Size: int64(len(data)), Sha256: fmt.Sprintf("%x", sha256.Sum256([]byte(data)))})
+		case r.Method == "GET":
+			fmt.Fprint(w, files[name])
+		case r.Method == "POST":
+			data, _ := ioutil.ReadAll(r.Body)
+			files[name] = string(data)
+			writes = append(writes, name)
+			fmt.Fprintln(w, "Created file.")
+		}
+	}))
+	defer s.Close()
+	c := New(s.URL)
+
+	local, err := ioutil.TempDir("", "TestPushPullDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(local)
+	write := func(name, data string) {
+		p := filepath.Join(local, "push", name)
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a", "foo")
+	write("dir/b", "bar")
+	files["data/a"] = "foo"
+	if err := c.PushDir(filepath.Join(local, "push"), "data", "master"); err != nil {
+		t.Fatal(err)
+	}
+	// a was already there.
+	if strings.Join(writes, " ") != "data/dir/b" || files["data/dir/b"] != "bar" {
+		t.Fatalf("Got writes %q, files %q.", writes, files)
+	}
+
+	files["data/c"] = "baz"
+	files["other/d"] = "qux"
+	pull := filepath.Join(local, "pull")
+	write("../pull/a", "old")
+	if err := c.PullDir("data", "master", pull); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"a": "foo", "dir/b": "bar", "c": "baz"} {
+		data, err := ioutil.ReadFile(filepath.Join(pull, name))
+		if err != nil || string(data) != expected {
+			t.Fatalf("Pulled %s as %q, %v, expected %q.", name, data, err, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(pull, "d")); !os.IsNotExist(err) {
+		t.Fatal("Files outside of the directory shouldn't be pulled.")
+	}
+}
@@ -0,0 +1,232 @@
+package client
+
+// dirs.go copies whole directories in to and out of pfs. Files are
+// transferred Parallelism at a time, and files that are already the same on
+// both sides, going by their sha256, are skipped, so a PushDir or PullDir
+// that's interrupted can be run again to pick up where it left off.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileInfo describes a file.
+type FileInfo struct {
+	Name string `json:"name"`
+	// Type is file, dir, symlink or other.
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// Sha256 is the hex sha256 of a file's contents, it's only set by Stat
+	// with checksum true. Striped files don't have one.
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// Stat describes the file name at commit. With checksum true the
+// description includes the sha256 of the file's contents, which pfs has to
+// read the whole file for.
+func (c *Client) Stat(name, commit string, checksum bool) (FileInfo, error) {
+	var info FileInfo
+	query := url.Values{"commit": {commit}, "stat": {"true"}}
+	if checksum {
+		query.Set("checksum", "true")
+	}
+	resp, err := c.read(path.Join("/file", name), query, nil)
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// ListFiles returns the files in commit whose paths start with prefix, ""
+// lists every file.
+func (c *Client) ListFiles(commit, prefix string) ([]string, error) {
+	query := url.Values{"commit": {commit}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	resp, err := c.do("GET", "/list", query, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var files []string
+	err = json.NewDecoder(resp.Body).Decode(&files)
+	return files, err
+}
+
+// parallel calls f with each of names, Parallelism at a time. Once a call
+// fails the names that haven't been started are skipped, it returns the
+// first error.
+func (c *Client) parallel(names []string, f func(name string) error) error {
+	n := c.Parallelism
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	for _, name := range names {
+		sem <- struct{}{}
+		lock.Lock()
+		failed := firstErr != nil
+		lock.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := f(name); err != nil {
+				lock.Lock()
+				defer lock.Unlock()
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}(name)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// localChecksum returns the hex sha256 of the local file name.
+func localChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// same returns true if the local file local has the same contents as the
+// file name at commit.
+func (c *Client) same(local, name, commit string) (bool, error) {
+	fi, err := os.Stat(local)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	info, err := c.Stat(name, commit, true)
+	if e, ok := err.(*Error); ok && e.Status == 404 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Sizes are cheaper to compare than checksums.
+	if info.Sha256 == "" || info.Size != fi.Size() {
+		return false, nil
+	}
+	sum, err := localChecksum(local)
+	return sum == info.Sha256, err
+}
+
+// dirPrefix returns the prefix of the paths of the files in the directory
+// dir in pfs.
+func dirPrefix(dir string) string {
+	if dir = strings.Trim(dir, "/"); dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// PushDir writes every file under the local directory localPath to the
+// directory dir on branch, "" is the top of the branch. Files that are
+// already on the branch with the same contents aren't written again.
+func (c *Client) PushDir(localPath, dir, branch string) error {
+	var files []string
+	err := filepath.Walk(localPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			rel, err := filepath.Rel(localPath, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.parallel(files, func(rel string) error {
+		local, name := filepath.Join(localPath, filepath.FromSlash(rel)), dirPrefix(dir)+rel
+		if same, err := c.same(local, name, branch); err != nil || same {
+			return err
+		}
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return c.PutFile(name, branch, f)
+	})
+}
+
+// PullDir writes every file in the directory dir at commit to the local
+// directory localPath, "" is the whole commit. Local files that already have
+// the same contents aren't written again. Files are written to a temporary
+// file and then renamed in to place, so a file that's only partly
+// downloaded is never left under its own name.
+func (c *Client) PullDir(dir, commit, localPath string) error {
+	prefix := dirPrefix(dir)
+	files, err := c.ListFiles(commit, prefix)
+	if err != nil {
+		return err
+	}
+	return c.parallel(files, func(name string) error {
+		local := filepath.Join(localPath, filepath.FromSlash(strings.TrimPrefix(name, prefix)))
+		if same, err := c.same(local, name, commit); err != nil || same {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(local), 0777); err != nil {
+			return err
+		}
+		r, err := c.GetFile(name, commit)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		f, err := ioutil.TempFile(filepath.Dir(local), "."+filepath.Base(local)+".tmp")
+		if err != nil {
+			return err
+		}
+		// TempFile makes files only we can read.
+		if err = f.Chmod(0644); err == nil {
+			_, err = io.Copy(f, r)
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), local)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+		return err
+	})
+}
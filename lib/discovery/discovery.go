@@ -0,0 +1,259 @@
+// Package discovery keeps track of the shards in a cluster. Shards register
+// themselves in etcd under /pfs/members with a TTL and keep refreshing the
+// registration while they're alive; a Table watches those registrations so
+// that routers always know where every shard is without polling.
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const (
+	RoleMaster  = "master"
+	RoleReplica = "replica"
+
+	// TTL is how long, in seconds, a registration lasts if it isn't renewed.
+	TTL = 60
+
+	membersDir = "/pfs/members"
+)
+
+// Member is a shard's registration.
+type Member struct {
+	Shard   uint64 `json:"shard"`
+	Modulos uint64 `json:"modulos"`
+	Address string `json:"address"`
+	Role    string `json:"role"`
+	// Epoch is the epoch a master became master in.
+	Epoch uint64 `json:"epoch,omitempty"`
+}
+
+// Key is where m is registered in etcd. There's one key per address so a
+// shard changing role overwrites its old registration.
+func Key(m Member) string {
+	return path.Join(membersDir, fmt.Sprintf("%d-%d", m.Shard, m.Modulos), url.QueryEscape(m.Address))
+}
+
+// Register registers m, or renews its registration, for TTL seconds.
+func Register(client *etcd.Client, m Member) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = client.Set(Key(m), string(data), TTL)
+	return err
+}
+
+// Deregister removes m's registration so that it stops getting traffic
+// right away rather than when the TTL runs out.
+func Deregister(client *etcd.Client, m Member) error {
+	_, err := client.Delete(Key(m), false)
+	return err
+}
+
+// Table is the set of registered members, kept up to date by Watch.
+type Table struct {
+	lock    sync.RWMutex
+	members map[string]Member
+	// index is the etcd index we've seen changes up to.
+	index uint64
+	// modulos, if it's not 0, is the number of shards the cluster is
+	// currently using. Masters only returns shards for it.
+	modulos uint64
+}
+
+func NewTable() *Table {
+	return &Table{members: make(map[string]Member)}
+}
+
+// add adds the members in node, and in its children, to the table. Callers
+// must hold the lock.
+func (t *Table) add(node *etcd.Node) {
+	if node.Dir {
+		for _, child := range node.Nodes {
+			t.add(child)
+		}
+		return
+	}
+	var m Member
+	if err := json.Unmarshal([]byte(node.Value), &m); err != nil {
+		log.Printf("Bad registration at %s: %s", node.Key, err)
+		return
+	}
+	t.members[node.Key] = m
+}
+
+// remove removes the member at key, or every member under it if it's a
+// directory. Callers must hold the lock.
+func (t *Table) remove(key string) {
+	for k := range t.members {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(t.members, k)
+		}
+	}
+}
+
+// Apply updates the table with a change that Watch saw.
+func (t *Table) Apply(resp *etcd.Response) {
+	if resp == nil || resp.Node == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch resp.Action {
+	case "delete", "expire", "compareAndDelete":
+		t.remove(resp.Node.Key)
+	default:
+		t.add(resp.Node)
+	}
+	if resp.Node.ModifiedIndex > t.index {
+		t.index = resp.Node.ModifiedIndex
+	}
+}
+
+// Load replaces the table with what's currently registered.
+func (t *Table) Load(client *etcd.Client) error {
+	resp, err := client.Get(membersDir, false, true)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.members = make(map[string]Member)
+	t.add(resp.Node)
+	t.index = resp.EtcdIndex
+	return nil
+}
+
+// Watch keeps the table up to date until stop is closed. If the watch falls
+// too far behind, or etcd goes away, the table is reloaded from scratch.
+func (t *Table) Watch(client *etcd.Client, stop chan bool) {
+	for {
+		t.lock.RLock()
+		index := t.index
+		t.lock.RUnlock()
+
+		receiver := make(chan *etcd.Response)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := client.Watch(membersDir, index+1, true, receiver, stop)
+			errc <- err
+		}()
+		// Watch closes receiver when it returns.
+		for resp := range receiver {
+			t.Apply(resp)
+		}
+		err := <-errc
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Print(err)
+		time.Sleep(time.Second)
+		if err := t.Load(client); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+type byShard []Member
+
+func (l byShard) Len() int      { return len(l) }
+func (l byShard) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byShard) Less(i, j int) bool {
+	if l[i].Modulos != l[j].Modulos {
+		return l[i].Modulos < l[j].Modulos
+	}
+	if l[i].Shard != l[j].Shard {
+		return l[i].Shard < l[j].Shard
+	}
+	return l[i].Address < l[j].Address
+}
+
+// Members returns every registered member, ordered by shard.
+func (t *Table) Members() []Member {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var res []Member
+	for _, m := range t.members {
+		res = append(res, m)
+	}
+	sort.Sort(byShard(res))
+	return res
+}
+
+// SetModulos sets the number of shards the cluster is using, shards
+// registered for any other number are left out of Masters. It changes when
+// the cluster is resharded.
+func (t *Table) SetModulos(modulos uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.modulos = modulos
+}
+
+// masters returns the master of every shard. Until an old master's
+// registration expires there can be two for a shard, the one from the newest
+// epoch wins.
+func (t *Table) masters() []Member {
+	var res []Member
+	for _, m := range t.Members() {
+		if m.Role != RoleMaster {
+			continue
+		}
+		if n := len(res); n > 0 && res[n-1].Shard == m.Shard && res[n-1].Modulos == m.Modulos {
+			if m.Epoch > res[n-1].Epoch {
+				res[n-1] = m
+			}
+			continue
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// Master returns the address of the master for shard, out of modulos.
+func (t *Table) Master(shard, modulos uint64) (string, bool) {
+	for _, m := range t.masters() {
+		if m.Shard == shard && m.Modulos == modulos {
+			return m.Address, true
+		}
+	}
+	return "", false
+}
+
+// Masters returns the addresses of every master, ordered by shard.
+func (t *Table) Masters() []string {
+	t.lock.RLock()
+	modulos := t.modulos
+	t.lock.RUnlock()
+	var res []string
+	for _, m := range t.masters() {
+		if modulos == 0 || m.Modulos == modulos {
+			res = append(res, m.Address)
+		}
+	}
+	return res
+}
+
+// Replicas returns the addresses of the replicas for shard, out of modulos.
+func (t *Table) Replicas(shard, modulos uint64) []string {
+	var res []string
+	for _, m := range t.Members() {
+		if m.Shard == shard && m.Modulos == modulos && m.Role == RoleReplica {
+			res = append(res, m.Address)
+		}
+	}
+	return res
+}
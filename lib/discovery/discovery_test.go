@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+func memberNode(m Member, t *testing.T) *etcd.Node {
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &etcd.Node{Key: Key(m), Value: string(data)}
+}
+
+func TestTable(t *testing.T) {
+	table := NewTable()
+	master0 := Member{Shard: 0, Modulos: 2, Address: "http://host0:80", Role: RoleMaster}
+	replica0 := Member{Shard: 0, Modulos: 2, Address: "http://host1:80", Role: RoleReplica}
+	master1 := Member{Shard: 1, Modulos: 2, Address: "http://host2:80", Role: RoleMaster}
+	for _, m := range []Member{master1, replica0, master0} {
+		table.Apply(&etcd.Response{Action: "set", Node: memberNode(m, t)})
+	}
+
+	if master, ok := table.Master(0, 2); !ok || master != master0.Address {
+		t.Errorf("Master(0, 2) = %s, %t, expected %s.", master, ok, master0.Address)
+	}
+	if _, ok := table.Master(0, 3); ok {
+		t.Error("Found a master for a modulos that isn't registered.")
+	}
+	if masters := table.Masters(); !reflect.DeepEqual(masters, []string{master0.Address, master1.Address}) {
+		t.Errorf("Masters() = %v.", masters)
+	}
+	if replicas := table.Replicas(0, 2); !reflect.DeepEqual(replicas, []string{replica0.Address}) {
+		t.Errorf("Replicas(0, 2) = %v.", replicas)
+	}
+	table.SetModulos(4)
+	if masters := table.Masters(); masters != nil {
+		t.Errorf("Masters() = %v, expected none for modulos 4.", masters)
+	}
+	table.SetModulos(2)
+
+	// The replica takes over as master when the old master expires.
+	table.Apply(&etcd.Response{Action: "expire", Node: &etcd.Node{Key: Key(master0)}})
+	replica0.Role = RoleMaster
+	table.Apply(&etcd.Response{Action: "set", Node: memberNode(replica0, t)})
+	if master, ok := table.Master(0, 2); !ok || master != replica0.Address {
+		t.Errorf("Master(0, 2) = %s, %t, expected %s.", master, ok, replica0.Address)
+	}
+	if replicas := table.Replicas(0, 2); replicas != nil {
+		t.Errorf("Replicas(0, 2) = %v, expected none.", replicas)
+	}
+
+	// Until its registration expires a deposed master is still there, the
+	// master from the newest epoch wins.
+	deposed := Member{Shard: 1, Modulos: 2, Address: "http://host3:80", Role: RoleMaster, Epoch: 1}
+	promoted := Member{Shard: 1, Modulos: 2, Address: "http://host4:80", Role: RoleMaster, Epoch: 2}
+	table.Apply(&etcd.Response{Action: "set", Node: memberNode(promoted, t)})
+	table.Apply(&etcd.Response{Action: "set", Node: memberNode(deposed, t)})
+	if masters := table.Masters(); !reflect.DeepEqual(masters, []string{replica0.Address, promoted.Address}) {
+		t.Errorf("Masters() = %v.", masters)
+	}
+	table.Apply(&etcd.Response{Action: "delete", Node: &etcd.Node{Key: Key(deposed)}})
+	table.Apply(&etcd.Response{Action: "delete", Node: &etcd.Node{Key: Key(promoted)}})
+
+	// Deleting a shard's directory removes all of its members.
+	table.Apply(&etcd.Response{Action: "delete", Node: &etcd.Node{Key: "/pfs/members/0-2", Dir: true}})
+	if members := table.Members(); !reflect.DeepEqual(members, []Member{master1}) {
+		t.Errorf("Members() = %v.", members)
+	}
+}
@@ -0,0 +1,88 @@
+// Package logging is how pfs logs. Loggers are log/slog Loggers, so they're
+// leveled and structured and anything that takes one can be handed a logger
+// that writes wherever, and however, the caller likes. Requests get an id
+// that's carried in their context, including in to the replication they
+// cause on other shards, and loggers made by New tag every line logged with
+// that context with it, so everything a request did can be found by its id.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// IdHeader is the header requests carry their id in between pfs services.
+const IdHeader = "X-Pfs-Request-Id"
+
+// IdKey is the key request ids are logged under.
+const IdKey = "request"
+
+type idKey struct{}
+
+// NewId generates a request id.
+func NewId() string {
+	return uuid.New()
+}
+
+// WithId returns a copy of ctx that carries id.
+func WithId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// Id returns the request id ctx carries, "" if it doesn't carry one.
+func Id(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// ParseLevel parses debug, info, warn or error, case insensitively. "" is
+// info.
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("Invalid log level %s, it must be one of debug, info, warn or error.", level)
+}
+
+// New returns a logger that writes lines of key=value pairs at level and
+// above to w.
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(NewHandler(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})))
+}
+
+// NewHandler wraps h so that records logged with a context that carries a
+// request id are tagged with it.
+func NewHandler(h slog.Handler) slog.Handler {
+	return idHandler{h}
+}
+
+type idHandler struct {
+	slog.Handler
+}
+
+func (h idHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := Id(ctx); id != "" {
+		r.AddAttrs(slog.String(IdKey, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h idHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return idHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h idHandler) WithGroup(name string) slog.Handler {
+	return idHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRequestId(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo).With("shard", "0-1")
+	ctx := WithId(context.Background(), "abc")
+	logger.InfoContext(ctx, "committed", "commit", "commit1")
+	logger.Info("no request")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got: %q", buf.String())
+	}
+	for _, want := range []string{"msg=committed", "shard=0-1", "commit=commit1", "request=abc"} {
+		if !strings.Contains(lines[0], want) {
+			t.Fatalf("%q is missing %s.", lines[0], want)
+		}
+	}
+	if strings.Contains(lines[1], "request=") {
+		t.Fatalf("%q shouldn't have a request id.", lines[1])
+	}
+}
+
+func TestLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	logger := New(&buf, level)
+	logger.Info("quiet")
+	logger.Warn("loud")
+	if strings.Contains(buf.String(), "quiet") || !strings.Contains(buf.String(), "loud") {
+		t.Fatalf("Expected only the warning, got: %q", buf.String())
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("verbose shouldn't be a level.")
+	}
+}
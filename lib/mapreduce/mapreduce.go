@@ -261,7 +261,7 @@ func pumpFiles(files chan string, job Job, m materializeInfo, shard, modulos uin
 				return
 			}
 			for _, key := range lr.Contents {
-				if route.HashResource(key.Key)%modulos == shard {
+				if route.Owner(key.Key, modulos) == shard {
 					// This file belongs on this shard
 					files <- key.Key
 					fileCount++
@@ -361,7 +361,7 @@ func Map(job Job, jobName string, m materializeInfo, shard, modulos uint64) {
 }
 
 func Reduce(job Job, jobName string, m materializeInfo, shard, modulos uint64) {
-	if (route.HashResource(path.Join("/job", jobName)) % modulos) != shard {
+	if route.Owner(path.Join("/job", jobName), modulos) != shard {
 		// This resource isn't supposed to be located on this machine so we
 		// don't need to materialize it.
 		return
@@ -470,7 +470,7 @@ func Materialize(in_repo, branch, commit, outRepo, jobDir string, shard, modulos
 	// We make sure that this function always commits so that we know the comp
 	// repo stays in sync with the data repo.
 	defer func() {
-		if err := btrfs.Commit(outRepo, commit, branch); err != nil {
+		if _, err := btrfs.Commit(outRepo, commit, branch); err != nil {
 			log.Print("DEFERED: btrfs.Commit error in Materialize: ", err)
 		}
 	}()
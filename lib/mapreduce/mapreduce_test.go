@@ -72,7 +72,8 @@ func TestMapJob(t *testing.T) {
 	f.Close()
 
 	// Commit it:
-	check(btrfs.Commit(inRepoName, "commit1", "master"), t)
+	_, err = btrfs.Commit(inRepoName, "commit1", "master")
+	check(err, t)
 
 	// Set up the job:
 	j := Job{
@@ -89,7 +90,8 @@ func TestMapJob(t *testing.T) {
 	shard := uint64(0)
 	mod := uint64(1)
 	Map(j, "TestMapJob", matInfo, shard, mod)
-	check(btrfs.Commit(outRepoName, "commit1", "master"), t)
+	_, err = btrfs.Commit(outRepoName, "commit1", "master")
+	check(err, t)
 
 	// Check that the output file exists and contains the expected output:
 	output, err := btrfs.ReadFile(fmt.Sprintf("%s/commit1/TestMapJob/foo", outRepoName))
@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"time"
+
+	"github.com/samalba/dockerclient"
+)
+
+const (
+	// inputDir, diffDir, outputDir and spoolDir are where a run's Dirs are
+	// mounted in the container.
+	inputDir  = "/pfs/in"
+	diffDir   = "/pfs/diff"
+	outputDir = "/pfs/out"
+	spoolDir  = "/pfs/spool"
+	// pollInterval is how often we check whether a container has exited.
+	pollInterval = 500 * time.Millisecond
+)
+
+// DockerRunner runs commands in a container from the pipeline's image. The
+// input commit is mounted read-only at /pfs/in, the files that changed since
+// the last run read-only at /pfs/diff, the output branch read-write at
+// /pfs/out and, if the pipeline shuffles, the spool read-write at /pfs/spool.
+// $PFS_INPUT, $PFS_DIFF, $PFS_OUTPUT and $PFS_SPOOL point at them. The
+// container's CPU shares and memory are limited by the pipeline's Resources.
+type DockerRunner struct{}
+
+func (DockerRunner) Run(p Pipeline, dirs Dirs, logs io.Writer) error {
+	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
+	if err != nil {
+		return err
+	}
+	if err := docker.PullImage(p.Image, nil); err != nil {
+		// We keep going here because it might be a local image.
+		log.Print("Failed to pull ", p.Image, " with error: ", err)
+	}
+	config := &dockerclient.ContainerConfig{
+		Image:      p.Image,
+		Cmd:        p.Cmd,
+		Env:        []string{"PFS_INPUT=" + inputDir, "PFS_DIFF=" + diffDir, "PFS_OUTPUT=" + outputDir},
+		WorkingDir: outputDir,
+		Volumes:    map[string]struct{}{inputDir: struct{}{}, diffDir: struct{}{}, outputDir: struct{}{}},
+		CpuShares:  p.Resources.CpuShares,
+		Memory:     p.Resources.Memory,
+	}
+	if p.Resources.Memory > 0 {
+		// Setting swap to the same limit stops the container from swapping
+		// past it.
+		config.MemorySwap = p.Resources.Memory
+	}
+	if dirs.Spool != "" {
+		config.Env = append(config.Env, "PFS_SPOOL="+spoolDir)
+		config.Volumes[spoolDir] = struct{}{}
+	}
+	containerId, err := docker.CreateContainer(config, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := docker.RemoveContainer(containerId, true, true); err != nil {
+			log.Print(err)
+		}
+	}()
+	hostConfig := &dockerclient.HostConfig{
+		Binds: []string{
+			dirs.In + ":" + inputDir + ":ro",
+			dirs.Diff + ":" + diffDir + ":ro",
+			dirs.Out + ":" + outputDir + ":rw",
+		},
+	}
+	if dirs.Spool != "" {
+		hostConfig.Binds = append(hostConfig.Binds, dirs.Spool+":"+spoolDir+":rw")
+	}
+	if err := docker.StartContainer(containerId, hostConfig); err != nil {
+		return err
+	}
+	// Following the logs streams them while the container runs, the stream
+	// ends when it exits.
+	reader, err := docker.ContainerLogs(containerId, &dockerclient.LogOptions{Follow: true, Stdout: true, Stderr: true})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := demux(reader, logs); err != nil {
+		return err
+	}
+	var info *dockerclient.ContainerInfo
+	for {
+		if info, err = docker.InspectContainer(containerId); err != nil {
+			return err
+		}
+		if !info.State.Running {
+			break
+		}
+		time.Sleep(pollInterval)
+	}
+	if info.State.ExitCode != 0 {
+		return &ExitError{Pipeline: p.Name, Code: info.State.ExitCode}
+	}
+	return nil
+}
+
+// ImageDigest returns the id of the local copy of image, which identifies
+// exactly what ran.
+func ImageDigest(image string) (string, error) {
+	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
+	if err != nil {
+		return "", err
+	}
+	info, err := docker.InspectImage(image)
+	if err != nil {
+		return "", err
+	}
+	return info.Id, nil
+}
+
+// demux copies the stdout and stderr that Docker multiplexes into one log
+// stream to w. Each frame has an 8 byte header, the first byte says which
+// stream it's from and the last 4 are the frame's size.
+func demux(r io.Reader, w io.Writer) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
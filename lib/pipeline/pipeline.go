@@ -0,0 +1,439 @@
+// Package pipeline runs user supplied transformations over the commits of a
+// data repo. Every pipeline gets its own branch of the comp repo. For each
+// input commit the pipeline's command runs with the commit as its input and
+// the branch as its output, then the branch is committed with the input
+// commit recorded as the output's provenance.
+//
+// Runs are incremental: besides the whole input commit, each run sees just
+// the files that changed since the commit the pipeline last ran over, and
+// the output commit records which delta it covers.
+//
+// Pipelines can read the outputs of another pipeline instead of the data
+// repo, they run over each output commit the other pipeline makes, so
+// pipelines form a DAG of processing stages.
+//
+// Every output commit records the commit it ran over, the spec it ran with
+// and the digest of its image, if it has one, in its metadata so that runs
+// can be audited and reproduced.
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// Pipeline is the spec users POST to /pipeline.
+type Pipeline struct {
+	Name string `json:"name"`
+	// From is the pipeline whose outputs this one reads, "" means it reads
+	// the data repo.
+	From string `json:"from,omitempty"`
+	// Input is the directory of its input that the pipeline reads, "" means
+	// all of it.
+	Input string   `json:"input,omitempty"`
+	Image string   `json:"image,omitempty"`
+	Cmd   []string `json:"command"`
+	// Shuffle means the command writes files for other shards to
+	// $PFS_SPOOL/<shard>. Once every shard's job over a commit has
+	// succeeded, each shard merges the files sent to it and the pipelines
+	// that read this one's outputs read the merged files instead.
+	Shuffle   bool        `json:"shuffle,omitempty"`
+	Retry     RetryPolicy `json:"retry"`
+	Resources Resources   `json:"resources"`
+	// Schedule runs the pipeline on a timer rather than on every commit,
+	// nil means it runs on every commit.
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// Schedule runs a pipeline over the head of a data repo branch every so
+// often. Each run commits the branch first, so that what it ran over is
+// recorded like any other commit.
+type Schedule struct {
+	// Every is how often it runs, like "1h".
+	Every string `json:"every"`
+	// Branch is the branch it runs over, "" means master.
+	Branch string `json:"branch,omitempty"`
+}
+
+// Period returns how often the schedule runs.
+func (s Schedule) Period() time.Duration {
+	period, _ := time.ParseDuration(s.Every)
+	return period
+}
+
+// BranchOrMaster returns the branch the schedule runs over.
+func (s Schedule) BranchOrMaster() string {
+	if s.Branch == "" {
+		return "master"
+	}
+	return s.Branch
+}
+
+// Resources limits what a pipeline's jobs can use so that a runaway job
+// can't take down the shard it runs on, 0 means no limit.
+type Resources struct {
+	// CpuShares is the job's share of the CPU relative to other containers,
+	// Docker gives them 1024 by default. Only DockerRunner enforces it.
+	CpuShares int64 `json:"cpuShares,omitempty"`
+	// Memory is how many bytes of memory the job can use.
+	Memory int64 `json:"memory,omitempty"`
+	// Scratch is how many bytes the job can write to its output branch.
+	Scratch int64 `json:"scratch,omitempty"`
+}
+
+// RetryPolicy says how many times a failing job is tried and how long to
+// wait between tries.
+type RetryPolicy struct {
+	// Attempts is how many times a job is tried in all, 0 means once.
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is how long to wait before the first retry, like "10s". It
+	// doubles with each retry.
+	Backoff string `json:"backoff,omitempty"`
+}
+
+// Delay returns how long to wait before retry, the first retry is 1.
+func (r RetryPolicy) Delay(retry int) time.Duration {
+	backoff, err := time.ParseDuration(r.Backoff)
+	if err != nil || retry < 1 {
+		return 0
+	}
+	return backoff << uint(retry-1)
+}
+
+// Validate returns an error if p can't be run.
+func (p Pipeline) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("Pipelines must have a name.")
+	}
+	for _, c := range p.Name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("Invalid pipeline name %s, names may only contain letters, digits and `-`.", p.Name)
+		}
+	}
+	if p.From == p.Name {
+		return fmt.Errorf("Pipeline %s can't read its own outputs.", p.Name)
+	}
+	if len(p.Cmd) == 0 {
+		return fmt.Errorf("Pipeline %s has no command.", p.Name)
+	}
+	if path.Clean("/"+p.Input) != "/"+strings.Trim(p.Input, "/") {
+		return fmt.Errorf("Invalid input %s for pipeline %s.", p.Input, p.Name)
+	}
+	if p.Schedule != nil {
+		if p.From != "" {
+			return fmt.Errorf("Pipeline %s reads from %s, it can't have a schedule too.", p.Name, p.From)
+		}
+		// Trigger commits are named to the second.
+		if period, err := time.ParseDuration(p.Schedule.Every); err != nil || period < time.Second {
+			return fmt.Errorf("Invalid schedule %s for pipeline %s, it must run at most once a second.", p.Schedule.Every, p.Name)
+		}
+	}
+	if p.Image == "" && !AllowExec {
+		return fmt.Errorf("Pipeline %s has no image, commands only run on the host if the operator allows it.", p.Name)
+	}
+	if p.Resources.CpuShares < 0 || p.Resources.Memory < 0 || p.Resources.Scratch < 0 {
+		return fmt.Errorf("Invalid resources %+v for pipeline %s.", p.Resources, p.Name)
+	}
+	if p.Image == "" && p.Resources.CpuShares != 0 {
+		return fmt.Errorf("Pipeline %s has cpu shares but no image, only containers can be given cpu shares.", p.Name)
+	}
+	if p.Retry.Attempts < 0 {
+		return fmt.Errorf("Invalid number of attempts %d for pipeline %s.", p.Retry.Attempts, p.Name)
+	}
+	if p.Retry.Backoff != "" {
+		if backoff, err := time.ParseDuration(p.Retry.Backoff); err != nil || backoff < 0 {
+			return fmt.Errorf("Invalid backoff %s for pipeline %s.", p.Retry.Backoff, p.Name)
+		}
+	}
+	return nil
+}
+
+// Branch returns the comp repo branch that the pipeline name writes to.
+func Branch(name string) string {
+	return "pipeline-" + name
+}
+
+// OutputCommit returns the comp repo commit that holds the outputs of the
+// pipeline name for data repo commit, whether it reads the data repo itself
+// or the outputs of other pipelines.
+func OutputCommit(name, commit string) string {
+	return Branch(name) + "-" + commit
+}
+
+// Dirs are the directories a run uses, they're all absolute paths.
+type Dirs struct {
+	// In holds the pipeline's input at the commit it's running over.
+	In string
+	// Diff holds just the input files that changed since the last run.
+	Diff string
+	// Out is where the outputs go, it starts with the last run's outputs.
+	Out string
+	// Spool is where files for other shards go, in a directory per shard.
+	// It's "" unless the pipeline shuffles.
+	Spool string
+}
+
+// ExitError is returned by Runners when a command exits with a non-zero code.
+type ExitError struct {
+	Pipeline string
+	Code     int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Pipeline %s failed, its command exited with code %d.", e.Pipeline, e.Code)
+}
+
+// TriggerCommit returns the data repo commit that the scheduler makes to
+// run the pipeline name at t.
+func TriggerCommit(name string, t time.Time) string {
+	return "trigger-" + name + "-" + t.UTC().Format("20060102T150405")
+}
+
+// ShuffleBranch returns the comp repo branch that the files that the pipeline
+// name shuffles to a shard are merged on.
+func ShuffleBranch(name string) string {
+	return "shuffle-" + name
+}
+
+// ShuffleCommit returns the comp repo commit that holds the files that the
+// pipeline name shuffled to a shard for data repo commit.
+func ShuffleCommit(name, commit string) string {
+	return ShuffleBranch(name) + "-" + commit
+}
+
+// A Runner runs pipeline commands.
+type Runner interface {
+	// Run runs p's command over dirs, the command's stdout and stderr are
+	// written to logs.
+	Run(p Pipeline, dirs Dirs, logs io.Writer) error
+}
+
+// AllowExec lets pipelines without an image run their commands directly on
+// the shard's host with ExecRunner. It's off unless the operator turns it on,
+// until then Validate rejects pipelines without an image and the ones that
+// were registered before can't run.
+var AllowExec = false
+
+var errExecNotAllowed = fmt.Errorf("Pipelines without an image can't run, running commands on the host isn't allowed.")
+
+// DefaultRunner returns the runner for p, pipelines with an image run in
+// Docker and the rest run with ExecRunner if AllowExec is set.
+func DefaultRunner(p Pipeline) Runner {
+	if p.Image != "" {
+		return DockerRunner{}
+	}
+	if !AllowExec {
+		return refusingRunner{}
+	}
+	return ExecRunner{}
+}
+
+// refusingRunner fails every run, it's what pipelines without an image get
+// when AllowExec isn't set.
+type refusingRunner struct{}
+
+func (refusingRunner) Run(p Pipeline, dirs Dirs, logs io.Writer) error {
+	return errExecNotAllowed
+}
+
+// ExecRunner runs commands directly on the shard's host, they find their
+// directories in $PFS_INPUT, $PFS_DIFF, $PFS_OUTPUT and $PFS_SPOOL. Memory
+// limits are enforced with ulimit.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(p Pipeline, dirs Dirs, logs io.Writer) error {
+	cmd := exec.Command(p.Cmd[0], p.Cmd[1:]...)
+	if p.Resources.Memory > 0 {
+		// ulimit takes kilobytes, the shell execs the command once it's set.
+		script := fmt.Sprintf(`ulimit -v %d && exec "$@"`, (p.Resources.Memory+1023)/1024)
+		cmd = exec.Command("sh", append([]string{"-c", script, "sh"}, p.Cmd...)...)
+	}
+	cmd.Dir = dirs.Out
+	cmd.Env = append(os.Environ(), "PFS_INPUT="+dirs.In, "PFS_DIFF="+dirs.Diff, "PFS_OUTPUT="+dirs.Out, "PFS_SPOOL="+dirs.Spool)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return &ExitError{Pipeline: p.Name, Code: status.ExitStatus()}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Pipeline %s failed: %s", p.Name, err)
+	}
+	return nil
+}
+
+// lastInput returns the commit of repo that the branch's last run was over,
+// or t0 if it hasn't run.
+func lastInput(repo, branch string) (string, error) {
+	provenance := btrfs.GetMeta(branch, "provenance")
+	if !strings.HasPrefix(provenance, repo+"/") {
+		return "t0", nil
+	}
+	last := strings.TrimPrefix(provenance, repo+"/")
+	exists, err := btrfs.FileExists(path.Join(repo, last))
+	if err != nil || !exists {
+		return "t0", err
+	}
+	return last, nil
+}
+
+// holdDiff holds commit of repo with every file that hasn't changed since
+// from removed. Release it when you're done with it. Files deleted since from
+// don't show up.
+func holdDiff(repo, from, commit string) (string, error) {
+	files, err := btrfs.FindNew(repo, from, commit)
+	if err != nil {
+		return "", err
+	}
+	changed := make(map[string]bool)
+	for _, file := range files {
+		changed[file] = true
+	}
+	diff, err := btrfs.Hold(repo, commit)
+	if err != nil {
+		return "", err
+	}
+	root := btrfs.FilePath(diff)
+	err = filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if changed[rel] {
+			return nil
+		}
+		return os.Remove(name)
+	})
+	if err != nil {
+		btrfs.Release(diff)
+		return "", err
+	}
+	return diff, nil
+}
+
+// resetBranch puts branch of repo back the way it was when it was last
+// committed.
+func resetBranch(repo, branch string) error {
+	parent := btrfs.GetMeta(path.Join(repo, branch), "parent")
+	if parent == "" {
+		return fmt.Errorf("Branch %s of %s has no parent to reset to.", branch, repo)
+	}
+	if err := btrfs.SubvolumeDelete(path.Join(repo, branch)); err != nil {
+		return err
+	}
+	return btrfs.Branch(repo, parent, branch)
+}
+
+// A Job is one run of a pipeline.
+type Job struct {
+	Pipeline Pipeline
+	// Repo is the repo the pipeline reads, the data repo or, for pipelines
+	// that read another's outputs, CompRepo. Commit is the commit of it that
+	// the job runs over.
+	Repo, Commit string
+	// CompRepo is where the outputs are committed, as Output.
+	CompRepo, Output string
+	// Spool is the directory that the command writes files for other shards
+	// in, "" means it doesn't.
+	Spool string
+}
+
+// Run runs job with runner, the command's output goes to logs. It returns
+// the output commit.
+func Run(job Job, runner Runner, logs io.Writer) (string, error) {
+	p := job.Pipeline
+	branch := path.Join(job.CompRepo, Branch(p.Name))
+	exists, err := btrfs.FileExists(branch)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		if err := btrfs.Branch(job.CompRepo, "t0", Branch(p.Name)); err != nil {
+			return "", err
+		}
+	}
+	from, err := lastInput(job.Repo, branch)
+	if err != nil {
+		return "", err
+	}
+	in, err := btrfs.Hold(job.Repo, job.Commit)
+	if err != nil {
+		return "", err
+	}
+	defer btrfs.Release(in)
+	diff, err := holdDiff(job.Repo, from, job.Commit)
+	if err != nil {
+		return "", err
+	}
+	defer btrfs.Release(diff)
+	if p.Resources.Scratch > 0 {
+		if err := btrfs.LimitExclusive(branch, p.Resources.Scratch); err != nil {
+			return "", err
+		}
+	}
+	dirs := Dirs{
+		In:   btrfs.FilePath(path.Join(in, p.Input)),
+		Diff: btrfs.FilePath(path.Join(diff, p.Input)),
+		Out:  btrfs.FilePath(branch),
+	}
+	if job.Spool != "" {
+		dirs.Spool = btrfs.FilePath(job.Spool)
+	}
+	if err := runner.Run(p, dirs, logs); err != nil {
+		// Throw away whatever the command wrote so that the next run starts
+		// from the last good outputs.
+		if resetErr := resetBranch(job.CompRepo, Branch(p.Name)); resetErr != nil {
+			log.Print(resetErr)
+		}
+		return "", err
+	}
+	if err := btrfs.SetMeta(branch, "pipeline", p.Name); err != nil {
+		return "", err
+	}
+	if err := btrfs.SetMeta(branch, "provenance", path.Join(job.Repo, job.Commit)); err != nil {
+		return "", err
+	}
+	// The delta this run covers is (from, job.Commit].
+	if err := btrfs.SetMeta(branch, "delta-from", from); err != nil {
+		return "", err
+	}
+	// The spec and the image the run used are recorded so that it can be
+	// reproduced.
+	spec, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	if err := btrfs.SetMeta(branch, "spec", string(spec)); err != nil {
+		return "", err
+	}
+	if err := btrfs.SetMeta(branch, "spec-hash", fmt.Sprintf("%x", sha256.Sum256(spec))); err != nil {
+		return "", err
+	}
+	var digest string
+	if p.Image != "" {
+		if digest, err = ImageDigest(p.Image); err != nil {
+			return "", err
+		}
+	}
+	if err := btrfs.SetMeta(branch, "image-digest", digest); err != nil {
+		return "", err
+	}
+	return btrfs.Commit(job.CompRepo, job.Output, Branch(p.Name))
+}
@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	AllowExec = true
+	defer func() { AllowExec = false }()
+	valid := []Pipeline{
+		{Name: "wc", Cmd: []string{"wc"}},
+		{Name: "wc-2", Input: "logs/", Cmd: []string{"wc"}},
+		{Name: "sum", From: "wc", Cmd: []string{"sum"}},
+		{Name: "wc", Cmd: []string{"wc"}, Retry: RetryPolicy{Attempts: 3, Backoff: "1s"}},
+		{Name: "wc", Image: "ubuntu", Cmd: []string{"wc"}, Resources: Resources{CpuShares: 512, Memory: 1 << 30, Scratch: 1 << 30}},
+		{Name: "wc", Cmd: []string{"wc"}, Resources: Resources{Memory: 1 << 30}},
+		{Name: "wc", Cmd: []string{"wc"}, Schedule: &Schedule{Every: "1h"}},
+	}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%+v should be valid: %s", p, err)
+		}
+	}
+	invalid := []Pipeline{
+		{Cmd: []string{"wc"}},
+		{Name: "wc/2", Cmd: []string{"wc"}},
+		{Name: "wc"},
+		{Name: "wc", Input: "../logs", Cmd: []string{"wc"}},
+		{Name: "wc", From: "wc", Cmd: []string{"wc"}},
+		{Name: "wc", Cmd: []string{"wc"}, Retry: RetryPolicy{Attempts: -1}},
+		{Name: "wc", Cmd: []string{"wc"}, Retry: RetryPolicy{Backoff: "soon"}},
+		{Name: "wc", Cmd: []string{"wc"}, Resources: Resources{Memory: -1}},
+		{Name: "wc", Cmd: []string{"wc"}, Schedule: &Schedule{Every: "hourly"}},
+		{Name: "wc", Cmd: []string{"wc"}, Schedule: &Schedule{Every: "10ms"}},
+		{Name: "sum", From: "wc", Cmd: []string{"sum"}, Schedule: &Schedule{Every: "1h"}},
+		// Only containers get cpu shares.
+		{Name: "wc", Cmd: []string{"wc"}, Resources: Resources{CpuShares: 512}},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v should be invalid.", p)
+		}
+	}
+	// Commands only run on the host if the operator allows it.
+	AllowExec = false
+	if err := (Pipeline{Name: "wc", Cmd: []string{"wc"}}).Validate(); err == nil {
+		t.Error("Pipelines without an image should be invalid unless AllowExec is set.")
+	}
+	if err := (Pipeline{Name: "wc", Image: "ubuntu", Cmd: []string{"wc"}}).Validate(); err != nil {
+		t.Error(err)
+	}
+	if err := DefaultRunner(Pipeline{Name: "wc", Cmd: []string{"wc"}}).Run(Pipeline{}, Dirs{}, ioutil.Discard); err != errExecNotAllowed {
+		t.Errorf("Running a pipeline without an image returned %v, expected errExecNotAllowed.", err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	r := RetryPolicy{Attempts: 4, Backoff: "1s"}
+	for retry, expected := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second} {
+		if delay := r.Delay(retry); delay != expected {
+			t.Errorf("Delay(%d) = %s, expected %s.", retry, delay, expected)
+		}
+	}
+	if delay := (RetryPolicy{}).Delay(1); delay != 0 {
+		t.Errorf("No backoff should mean no delay, got %s.", delay)
+	}
+}
+
+func TestExecRunner(t *testing.T) {
+	in, err := ioutil.TempDir("", "pfs-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(in)
+	out, err := ioutil.TempDir("", "pfs-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	if err := ioutil.WriteFile(path.Join(in, "file"), []byte("foo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	p := Pipeline{Name: "copy", Cmd: []string{"sh", "-c", "cp $PFS_INPUT/file $PFS_OUTPUT/copy && ls $PFS_DIFF"}}
+	var logs bytes.Buffer
+	if err := (ExecRunner{}).Run(p, Dirs{In: in, Diff: in, Out: out}, &logs); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(out, "copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "foo" {
+		t.Fatalf("Got %q, expected foo.", data)
+	}
+	if logs.String() != "file\n" {
+		t.Fatalf("Unexpected logs %q.", logs.String())
+	}
+	logs.Reset()
+
+	p.Cmd = []string{"sh", "-c", "echo oops; exit 3"}
+	err = (ExecRunner{}).Run(p, Dirs{In: in, Diff: in, Out: out}, &logs)
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Code != 3 {
+		t.Fatalf("A failing command should return its exit code, got %v.", err)
+	}
+	if logs.String() != "oops\n" {
+		t.Fatalf("Unexpected logs %q.", logs.String())
+	}
+	logs.Reset()
+
+	p.Cmd = []string{"sh", "-c", "ulimit -v"}
+	p.Resources.Memory = 64 << 20
+	if err := (ExecRunner{}).Run(p, Dirs{In: in, Diff: in, Out: out}, &logs); err != nil {
+		t.Fatal(err)
+	}
+	if logs.String() != "65536\n" {
+		t.Fatalf("The memory limit should be 65536 kilobytes, got %q.", logs.String())
+	}
+}
+
+func TestDemux(t *testing.T) {
+	var stream bytes.Buffer
+	for _, frame := range []struct {
+		stream byte
+		data   string
+	}{{1, "out\n"}, {2, "err\n"}, {1, "done\n"}} {
+		header := []byte{frame.stream, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[4:], uint32(len(frame.data)))
+		stream.Write(header)
+		stream.WriteString(frame.data)
+	}
+	var logs bytes.Buffer
+	if err := demux(&stream, &logs); err != nil {
+		t.Fatal(err)
+	}
+	if logs.String() != "out\nerr\ndone\n" {
+		t.Fatalf("Unexpected logs %q.", logs.String())
+	}
+	if err := demux(bytes.NewReader([]byte{1, 0, 0, 0, 0, 0, 0, 9, 'x'}), &logs); err == nil {
+		t.Fatal("A truncated frame should return an error.")
+	}
+}
@@ -0,0 +1,88 @@
+// Package replica makes btrfs.Replicas from urls, so that config files, flags
+// and the API name replication targets the same way whatever they are:
+//
+//	s3://<bucket>/<prefix>   a prefix in an S3 bucket, see btrfs.S3Replica
+//	file:///<repo>           a repo on the local btrfs volume
+//	ssh://<host>/<path>      a directory on another machine's btrfs volume,
+//	                         commits are received there with btrfs receive
+//
+// The scheme picks a Factory. Programs that know about other kinds of
+// target, like the shards that serve pfs:// urls, add them with Register.
+package replica
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// A Factory makes the Replica for a url with its scheme. It fails if the
+// url is malformed.
+type Factory func(u *url.URL) (btrfs.Replica, error)
+
+var factories = struct {
+	sync.RWMutex
+	m map[string]Factory
+}{m: map[string]Factory{
+	"s3":   newS3,
+	"file": newFile,
+	"ssh":  newSSH,
+}}
+
+// Register makes New use f for urls with scheme, replacing any Factory it
+// already had.
+func Register(scheme string, f Factory) {
+	factories.Lock()
+	defer factories.Unlock()
+	factories.m[strings.ToLower(scheme)] = f
+}
+
+// Schemes returns the schemes New understands, sorted.
+func Schemes() []string {
+	factories.RLock()
+	defer factories.RUnlock()
+	var schemes []string
+	for scheme := range factories.m {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// New returns the Replica that rawurl names.
+func New(rawurl string) (btrfs.Replica, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid replica url %s: %s", rawurl, err)
+	}
+	factories.RLock()
+	f, ok := factories.m[strings.ToLower(u.Scheme)]
+	factories.RUnlock()
+	if !ok {
+		var prefixes []string
+		for _, scheme := range Schemes() {
+			prefixes = append(prefixes, scheme+"://")
+		}
+		return nil, fmt.Errorf("Unsupported replica url %s, urls must start with one of %s.", rawurl, strings.Join(prefixes, ", "))
+	}
+	return f(u)
+}
+
+func newS3(u *url.URL) (btrfs.Replica, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid replica url %s, it has no bucket.", u)
+	}
+	return btrfs.NewS3Replica(u.String()), nil
+}
+
+func newFile(u *url.URL) (btrfs.Replica, error) {
+	repo := strings.Trim(u.Path, "/")
+	if u.Host != "" || repo == "" {
+		return nil, fmt.Errorf("Invalid replica url %s, it must look like file:///<repo>.", u)
+	}
+	return btrfs.NewLocalReplica(repo), nil
+}
@@ -0,0 +1,57 @@
+package replica
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+type testReplica struct {
+	url string
+}
+
+func (r testReplica) Push(ctx context.Context, diff io.Reader) error { return nil }
+
+func (r testReplica) Pull(ctx context.Context, from string, target btrfs.Pusher) error { return nil }
+
+func TestNew(t *testing.T) {
+	r, err := New("s3://bucket/prefix")
+	if _, ok := r.(*btrfs.S3Replica); err != nil || !ok {
+		t.Fatalf("Expected an S3Replica, got %T, %v.", r, err)
+	}
+	r, err = New("file:///data-0-1")
+	if _, ok := r.(*btrfs.LocalReplica); err != nil || !ok {
+		t.Fatalf("Expected a LocalReplica, got %T, %v.", r, err)
+	}
+	r, err = New("ssh://backup@host:2222/var/lib/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := r.(*SSHReplica).command(context.Background(), "btrfs", "receive", "/var/lib/backups").Args
+	expected := []string{"ssh", "-o", "BatchMode=yes", "-p", "2222", "backup@host", "--", "btrfs", "receive", "/var/lib/backups"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Got ssh command %v, expected %v.", args, expected)
+	}
+
+	for _, bad := range []string{"s3:///prefix", "file://host/repo", "file:///", "ssh://host", "ssh:///path"} {
+		if _, err := New(bad); err == nil {
+			t.Fatalf("%s should be rejected.", bad)
+		}
+	}
+	if _, err := New("ftp://host/path"); err == nil || !strings.Contains(err.Error(), "s3://") {
+		t.Fatalf("Expected an error listing the supported schemes, got %v.", err)
+	}
+
+	Register("test", func(u *url.URL) (btrfs.Replica, error) {
+		return testReplica{url: u.String()}, nil
+	})
+	r, err = New("TEST://somewhere")
+	if tr, ok := r.(testReplica); err != nil || !ok || tr.url != "test://somewhere" {
+		t.Fatalf("Expected the registered replica, got %#v, %v.", r, err)
+	}
+}
@@ -0,0 +1,60 @@
+package replica
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/shell"
+)
+
+// SSHReplica pushes commits to a directory on another machine's btrfs
+// volume by running btrfs receive there over ssh. It authenticates however
+// ssh is set up to for the user pfs runs as. Commits can't be pulled back
+// through it.
+type SSHReplica struct {
+	// host is passed to ssh, it's [user@]host.
+	host, port string
+	dir        string
+}
+
+func newSSH(u *url.URL) (btrfs.Replica, error) {
+	if u.Hostname() == "" || path.Clean(u.Path) == "/" || u.Path == "" {
+		return nil, fmt.Errorf("Invalid replica url %s, it must look like ssh://[<user>@]<host>[:<port>]/<path>.", u)
+	}
+	r := &SSHReplica{host: u.Hostname(), port: u.Port(), dir: path.Clean(u.Path)}
+	if u.User != nil {
+		r.host = u.User.Username() + "@" + r.host
+	}
+	return r, nil
+}
+
+// command returns the command that runs args on the replica's host.
+func (r *SSHReplica) command(ctx context.Context, args ...string) *exec.Cmd {
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if r.port != "" {
+		sshArgs = append(sshArgs, "-p", r.port)
+	}
+	sshArgs = append(append(sshArgs, r.host, "--"), args...)
+	return exec.CommandContext(ctx, "ssh", sshArgs...)
+}
+
+func (r *SSHReplica) Push(ctx context.Context, diff io.Reader) error {
+	c := r.command(ctx, "btrfs", "receive", r.dir)
+	c.Stdin = diff
+	if err := shell.RunStderr(c); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *SSHReplica) Pull(ctx context.Context, from string, target btrfs.Pusher) error {
+	return fmt.Errorf("Commits can't be pulled from ssh replicas, only pushed to them.")
+}
@@ -0,0 +1,140 @@
+package route
+
+// placement.go decides which shard owns a path. The default, "modulo", hashes
+// the path and takes it modulo the number of shards, which is simple but
+// moves nearly every path when the number of shards changes. "consistent"
+// puts VirtualNodes points per shard on a hash ring and gives each path to
+// the shard with the next point along, so adding a shard to N only moves
+// about 1/(N+1) of the paths.
+//
+// Every shard and router in a cluster must use the same placement, it's
+// picked when the cluster is created with PFS_PLACEMENT.
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// VirtualNodes is how many points each shard gets on the consistent hash
+// ring, more points spread paths more evenly.
+const VirtualNodes = 128
+
+// Placement maps paths to shards.
+type Placement interface {
+	// Owner returns the shard, out of shards, that owns p.
+	Owner(p string, shards uint64) uint64
+}
+
+type moduloPlacement struct{}
+
+func (moduloPlacement) Owner(p string, shards uint64) uint64 {
+	return HashResource(p) % shards
+}
+
+// ring is a consistent hash ring, points is sorted and owners[i] is the
+// shard that points[i] belongs to.
+type ring struct {
+	points []uint32
+	owners []uint64
+}
+
+func (r *ring) Len() int           { return len(r.points) }
+func (r *ring) Less(i, j int) bool { return r.points[i] < r.points[j] }
+func (r *ring) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newRing(shards uint64) *ring {
+	r := &ring{}
+	for shard := uint64(0); shard < shards; shard++ {
+		for i := 0; i < VirtualNodes; i++ {
+			r.points = append(r.points, ringHash(fmt.Sprintf("shard-%d-%d", shard, i)))
+			r.owners = append(r.owners, shard)
+		}
+	}
+	sort.Sort(r)
+	return r
+}
+
+func (r *ring) owner(p string) uint64 {
+	h := ringHash(p)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		// Past the last point, wrap around to the first.
+		i = 0
+	}
+	return r.owners[i]
+}
+
+type consistentPlacement struct {
+	lock  sync.RWMutex
+	rings map[uint64]*ring
+}
+
+func (c *consistentPlacement) Owner(p string, shards uint64) uint64 {
+	c.lock.RLock()
+	r, ok := c.rings[shards]
+	c.lock.RUnlock()
+	if !ok {
+		r = newRing(shards)
+		c.lock.Lock()
+		c.rings[shards] = r
+		c.lock.Unlock()
+	}
+	return r.owner(p)
+}
+
+var placements = map[string]Placement{
+	"modulo":     moduloPlacement{},
+	"consistent": &consistentPlacement{rings: make(map[uint64]*ring)},
+}
+
+var placement = struct {
+	sync.RWMutex
+	name string
+}{name: "modulo"}
+
+// GetPlacement returns the placement called name, "" means the default. It's
+// for clients that place paths themselves, rather than using the placement
+// in use.
+func GetPlacement(name string) (Placement, error) {
+	if name == "" {
+		name = "modulo"
+	}
+	p, ok := placements[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown placement %s, it must be modulo or consistent.", name)
+	}
+	return p, nil
+}
+
+// SetPlacement picks the placement, "modulo" or "consistent", "" means the
+// default.
+func SetPlacement(name string) error {
+	if name == "" {
+		name = "modulo"
+	}
+	if _, err := GetPlacement(name); err != nil {
+		return err
+	}
+	placement.Lock()
+	defer placement.Unlock()
+	placement.name = name
+	return nil
+}
+
+// PlacementName returns the name of the placement in use.
+func PlacementName() string {
+	placement.RLock()
+	defer placement.RUnlock()
+	return placement.name
+}
@@ -0,0 +1,55 @@
+package route
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConsistentPlacement(t *testing.T) {
+	if err := SetPlacement("consistent"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetPlacement("")
+
+	var paths []string
+	for i := 0; i < 10000; i++ {
+		paths = append(paths, fmt.Sprintf("/file/dir/file%d", i))
+	}
+	counts := make(map[uint64]int)
+	moved := 0
+	for _, p := range paths {
+		before, after := Owner(p, 4), Owner(p, 5)
+		if before >= 4 || after >= 5 {
+			t.Fatalf("Owner(%s) out of range: %d of 4, %d of 5.", p, before, after)
+		}
+		counts[after]++
+		if before != after {
+			moved++
+			if after != 4 {
+				t.Fatalf("%s moved between old shards, %d -> %d.", p, before, after)
+			}
+		}
+	}
+	// Adding a fifth shard should move about a fifth of the paths, modulo
+	// placement would move about four fifths.
+	if moved < len(paths)/10 || moved > len(paths)*3/10 {
+		t.Errorf("Adding a shard moved %d of %d paths.", moved, len(paths))
+	}
+	for shard := uint64(0); shard < 5; shard++ {
+		if counts[shard] < len(paths)/10 {
+			t.Errorf("Shard %d only owns %d of %d paths.", shard, counts[shard], len(paths))
+		}
+	}
+}
+
+func TestSetPlacement(t *testing.T) {
+	if PlacementName() != "modulo" {
+		t.Fatalf("Default placement should be modulo, got %s.", PlacementName())
+	}
+	if err := SetPlacement("random"); err == nil {
+		t.Fatal("Setting an unknown placement should fail.")
+	}
+	if Owner("/file/foo", 7) != HashResource("/file/foo")%7 {
+		t.Fatal("Modulo placement should hash modulo the number of shards.")
+	}
+}
@@ -11,56 +11,146 @@ import (
 	"path"
 	"strings"
 
+	"github.com/pachyderm/pfs/lib/discovery"
 	"github.com/pachyderm/pfs/lib/etcache"
 )
 
+// members, when set, is used to find shards instead of looking them up in
+// etcd on every request.
+var members *discovery.Table
+
+// UseMembers makes routing use t, which should be kept up to date with
+// t.Watch. Shards that aren't in t are still looked up in etcd.
+func UseMembers(t *discovery.Table) {
+	members = t
+}
+
 func HashResource(resource string) uint64 {
 	return uint64(adler32.Checksum([]byte(resource)))
 }
 
-func hashRequest(r *http.Request) uint64 {
-	return HashResource(r.URL.Path)
+// Owner returns the shard, out of modulos, that owns the resource at the
+// url path p according to the placement in use. Shards use it to check that
+// requests were routed to them correctly.
+func Owner(p string, modulos uint64) uint64 {
+	return placements[PlacementName()].Owner(p, modulos)
 }
 
-func Route(r *http.Request, etcdKey string, modulos uint64) (io.ReadCloser, error) {
-	bucket := hashRequest(r) % modulos
+// master returns the address of the shard that owns the resource in r.
+func master(r *http.Request, etcdKey string, modulos uint64) (string, error) {
+	return Master(r.URL.Path, etcdKey, modulos)
+}
+
+// Master returns the address of the shard that owns the resource at p, which
+// needn't be a real url path, stripes for instance are placed by a key.
+func Master(p, etcdKey string, modulos uint64) (string, error) {
+	bucket := Owner(p, modulos)
+	if members != nil {
+		if master, ok := members.Master(bucket, modulos); ok {
+			return master, nil
+		}
+	}
 	shard := fmt.Sprint(bucket, "-", fmt.Sprint(modulos))
 
 	_master, err := etcache.Get(path.Join(etcdKey, shard), false, false)
+	if err != nil {
+		return "", err
+	}
+	return _master.Node.Value, nil
+}
+
+func Route(r *http.Request, etcdKey string, modulos uint64) (io.ReadCloser, error) {
+	master, err := master(r, etcdKey, modulos)
+	if err != nil {
+		return nil, err
+	}
+	return RouteToHost(r, master)
+}
+
+// RouteToHost sends r to host, bypassing the normal hash based routing.
+func RouteToHost(r *http.Request, host string) (io.ReadCloser, error) {
+	resp, err := sendToHost(r, host)
 	if err != nil {
 		return nil, err
 	}
-	master := _master.Node.Value
+	return resp.Body, nil
+}
 
+func sendToHost(r *http.Request, host string) (*http.Response, error) {
 	httpClient := &http.Client{}
 	// `Do` will complain if r.RequestURI is set so we unset it
 	r.RequestURI = ""
 	r.URL.Scheme = "http"
-	r.URL.Host = strings.TrimPrefix(master, "http://")
+	r.URL.Host = strings.TrimPrefix(host, "http://")
 	log.Printf("Send request: %#v", r)
 	resp, err := httpClient.Do(r)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
+	// 206 and 304 are successes too, they mean we're answering a Range or a
+	// conditional request.
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusPartialContent &&
+		resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
 		return nil, fmt.Errorf("Failed request (%s) to %s.", resp.Status, r.URL.String())
 	}
-	return resp.Body, nil
+	return resp, nil
 }
 
 func RouteHttp(w http.ResponseWriter, r *http.Request, etcdKey string, modulos uint64) {
-	reader, err := Route(r, etcdKey, modulos)
+	master, err := master(r, etcdKey, modulos)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		log.Print(err)
 		return
 	}
-	_, err = io.Copy(w, reader)
+	RouteToHostHttp(w, r, master)
+}
+
+// RouteToHostHttp is like RouteHttp but sends the request to a specific host.
+// The response's status and headers are passed through so that things like
+// Range requests work through the router.
+func RouteToHostHttp(w http.ResponseWriter, r *http.Request, host string) {
+	resp, err := sendToHost(r, host)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		log.Print(err)
 		return
 	}
+	writeResponse(w, resp)
+}
+
+// writeResponse passes resp through to w and closes it.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		// It's too late to send an error status
+		log.Print(err)
+	}
+}
+
+// RouteToHostsHttp is like RouteToHostHttp but tries each of hosts in turn
+// until one of them answers successfully.
+func RouteToHostsHttp(w http.ResponseWriter, r *http.Request, hosts []string) {
+	for i, host := range hosts {
+		if i == len(hosts)-1 {
+			RouteToHostHttp(w, r, host)
+			return
+		}
+		resp, err := sendToHost(r, host)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		writeResponse(w, resp)
+		return
+	}
 }
 
 type multiReadCloser struct {
@@ -109,16 +199,39 @@ func MultiReadCloser(readers ...io.ReadCloser) io.ReadCloser {
 	return &multiReadCloser{r}
 }
 
-// Multicast enables the Ogre Magi to rapidly cast his spells, giving them
-// greater potency.
-func Multicast(r *http.Request, etcdKey string) (io.ReadCloser, error) {
-	_endpoints, err := etcache.Get(etcdKey, false, true)
+// Endpoints returns the addresses of every endpoint under etcdKey.
+func Endpoints(etcdKey string) ([]string, error) {
+	if members != nil && etcdKey == "/pfs/master" {
+		if masters := members.Masters(); len(masters) > 0 {
+			return masters, nil
+		}
+	}
+	resp, err := etcache.Get(etcdKey, false, true)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, node := range resp.Node.Nodes {
+		endpoints = append(endpoints, node.Value)
+	}
+	return endpoints, nil
+}
+
+// Fanout sends r to every endpoint under etcdKey and returns the responses,
+// in the order of the endpoints. If any request fails the responses that did
+// succeed are closed and an error is returned.
+func Fanout(r *http.Request, etcdKey string) ([]*http.Response, error) {
+	endpoints, err := Endpoints(etcdKey)
 	if err != nil {
 		return nil, err
 	}
-	endpoints := _endpoints.Node.Nodes
+	return FanoutTo(r, endpoints)
+}
 
+// FanoutTo is like Fanout but sends r to endpoints.
+func FanoutTo(r *http.Request, endpoints []string) ([]*http.Response, error) {
 	var body []byte
+	var err error
 	if r.ContentLength != 0 {
 		body, err = ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -126,16 +239,18 @@ func Multicast(r *http.Request, etcdKey string) (io.ReadCloser, error) {
 		}
 	}
 
-	var readers []io.ReadCloser
-	for i, node := range endpoints {
+	var resps []*http.Response
+	closeAll := func() {
+		for _, resp := range resps {
+			resp.Body.Close()
+		}
+	}
+	for _, endpoint := range endpoints {
 		httpClient := &http.Client{}
 		// `Do` will complain if r.RequestURI is set so we unset it
 		r.RequestURI = ""
 		r.URL.Scheme = "http"
-		r.URL.Host = strings.TrimPrefix(node.Value, "http://")
-		if err != nil {
-			return nil, err
-		}
+		r.URL.Host = strings.TrimPrefix(endpoint, "http://")
 
 		if r.ContentLength != 0 {
 			r.Body = ioutil.NopCloser(bytes.NewReader(body))
@@ -144,14 +259,33 @@ func Multicast(r *http.Request, etcdKey string) (io.ReadCloser, error) {
 		resp, err := httpClient.Do(r)
 		if err != nil {
 			log.Print(err)
+			closeAll()
 			return nil, err
 		}
 		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			closeAll()
 			return nil, fmt.Errorf("Failed request (%s) to %s.", resp.Status, r.URL.String())
 		}
+		resps = append(resps, resp)
+	}
+	return resps, nil
+}
+
+// Multicast enables the Ogre Magi to rapidly cast his spells, giving them
+// greater potency.
+func Multicast(r *http.Request, etcdKey string) (io.ReadCloser, error) {
+	resps, err := Fanout(r, etcdKey)
+	if err != nil {
+		return nil, err
+	}
+	var readers []io.ReadCloser
+	for i, resp := range resps {
 		// paths with * are multigets so we want all of the responses
 		if i == 0 || strings.Contains(r.URL.Path, "*") {
 			readers = append(readers, resp.Body)
+		} else {
+			resp.Body.Close()
 		}
 	}
 
@@ -0,0 +1,115 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Rules are declarative rewrites that the router applies to requests before
+// routing them. They let us rename repos and move paths around without
+// breaking existing clients. A rules file looks like:
+//
+//	{
+//		"aliases": {"chess-old": "chess"},
+//		"rewrites": [{"from": "^/data/(.*)$", "to": "/file/$1"}],
+//		"canaries": [{"prefix": "/file/chess", "percent": 5, "host": "10.0.0.7:49200"}]
+//	}
+type Rules struct {
+	// Aliases maps old repo names to new ones. A repo is the top level
+	// directory under /file/ or /job/.
+	Aliases map[string]string `json:"aliases"`
+	// Rewrites are applied in order, after aliases, to the request path.
+	Rewrites []Rewrite `json:"rewrites"`
+	// Canaries send a percentage of matching requests to a specific host
+	// rather than the shard that would normally own them.
+	Canaries []Canary `json:"canaries"`
+}
+
+type Rewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	from *regexp.Regexp
+}
+
+type Canary struct {
+	Prefix  string `json:"prefix"`
+	Percent int    `json:"percent"`
+	Host    string `json:"host"`
+}
+
+// ParseRules parses a JSON rules document.
+func ParseRules(data []byte) (*Rules, error) {
+	rules := &Rules{}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, err
+	}
+	for i := range rules.Rewrites {
+		from, err := regexp.Compile(rules.Rewrites[i].From)
+		if err != nil {
+			return nil, err
+		}
+		rules.Rewrites[i].from = from
+	}
+	for _, c := range rules.Canaries {
+		if c.Percent < 0 || c.Percent > 100 {
+			return nil, fmt.Errorf("Canary for %s has invalid percent %d.", c.Prefix, c.Percent)
+		}
+		if c.Host == "" {
+			return nil, fmt.Errorf("Canary for %s has no host.", c.Prefix)
+		}
+	}
+	return rules, nil
+}
+
+// LoadRules reads and parses a rules file.
+func LoadRules(name string) (*Rules, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(data)
+}
+
+// RewritePath applies aliases and rewrites to p.
+func (rules *Rules) RewritePath(p string) string {
+	if rules == nil {
+		return p
+	}
+	for _, prefix := range []string{"/file/", "/job/"} {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(p, prefix)
+		repo := strings.SplitN(rest, "/", 2)[0]
+		if alias, ok := rules.Aliases[repo]; ok {
+			p = prefix + alias + strings.TrimPrefix(rest, repo)
+		}
+	}
+	for _, rw := range rules.Rewrites {
+		p = rw.from.ReplaceAllString(p, rw.To)
+	}
+	return p
+}
+
+// Apply rewrites r's path in place and returns the host of a canary that the
+// request should be sent to, or "" if it should be routed normally.
+func (rules *Rules) Apply(r *http.Request) string {
+	if rules == nil {
+		return ""
+	}
+	r.URL.Path = rules.RewritePath(r.URL.Path)
+	for _, c := range rules.Canaries {
+		if strings.HasPrefix(r.URL.Path, c.Prefix) {
+			if rand.Intn(100) < c.Percent {
+				return c.Host
+			}
+			return ""
+		}
+	}
+	return ""
+}
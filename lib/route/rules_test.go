@@ -0,0 +1,62 @@
+package route
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`{
+		"aliases": {"old": "new"},
+		"rewrites": [{"from": "^/data/(.*)$", "to": "/file/$1"}],
+		"canaries": [{"prefix": "/file/canary", "percent": 100, "host": "canary:80"},
+		             {"prefix": "/file/never", "percent": 0, "host": "never:80"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for in, out := range map[string]string{
+		"/file/old/foo":  "/file/new/foo",
+		"/file/old":      "/file/new",
+		"/file/older":    "/file/older",
+		"/job/old/file/": "/job/new/file/",
+		"/data/old/foo":  "/file/old/foo",
+		"/commit":        "/commit",
+	} {
+		if got := rules.RewritePath(in); got != out {
+			t.Errorf("RewritePath(%s) = %s, expected %s.", in, got, out)
+		}
+	}
+
+	for p, host := range map[string]string{
+		"/file/canary/foo": "canary:80",
+		"/file/never/foo":  "",
+		"/file/other":      "",
+	} {
+		r, err := http.NewRequest("GET", "http://host"+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rules.Apply(r); got != host {
+			t.Errorf("Apply(%s) = %s, expected %s.", p, got, host)
+		}
+	}
+
+	var nilRules *Rules
+	if nilRules.RewritePath("/file/old") != "/file/old" {
+		t.Error("nil rules should not rewrite paths.")
+	}
+}
+
+func TestBadRules(t *testing.T) {
+	for _, data := range []string{
+		`{"rewrites": [{"from": "(", "to": ""}]}`,
+		`{"canaries": [{"prefix": "/file", "percent": 101, "host": "h"}]}`,
+		`{"canaries": [{"prefix": "/file", "percent": 10}]}`,
+	} {
+		if _, err := ParseRules([]byte(data)); err == nil {
+			t.Errorf("Expected %s to fail to parse.", data)
+		}
+	}
+}
@@ -2,15 +2,37 @@ package s3utils
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 )
 
+var logger = slog.Default()
+
+// SetLogger sets the logger this package logs to. Operations that are passed
+// a context log with it, so they're tagged with its request id.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
 const (
 	// AWS says that parts must be at least 5MB, it's unclear if that means 5 *
 	// 10^6 or 5 2^10 so we went with the larger.
@@ -32,12 +54,105 @@ func GetPath(input string) (string, error) {
 }
 
 func NewBucket(uri string) (*s3.Bucket, error) {
-	auth, err := aws.EnvAuth()
+	return NewBucketWithOptions(uri, BucketOptions{})
+}
+
+// BucketOptions says where a bucket is and how to authenticate with it. The
+// zero value is AWS's us-west-1 with credentials from the environment.
+type BucketOptions struct {
+	// Endpoint is the url of an S3 compatible object store, like MinIO or
+	// Ceph RGW, "" means AWS.
+	Endpoint string
+	// Region is the AWS region, or the region to sign requests to Endpoint
+	// with.
+	Region string
+	// PathStyle addresses buckets as <endpoint>/<bucket> rather than
+	// <bucket>.<endpoint>, most on-prem object stores need it.
+	PathStyle bool
+	// AccessKey and SecretKey are static credentials, if they're unset
+	// credentials come from the environment.
+	AccessKey, SecretKey string
+	// IAMRole gets credentials from the instance's IAM role instead.
+	IAMRole bool
+	// InsecureSkipVerify turns off checking Endpoint's certificate.
+	InsecureSkipVerify bool
+}
+
+// BucketOptionsFromEnv reads BucketOptions from the PFS_S3_* environment
+// variables.
+func BucketOptionsFromEnv() BucketOptions {
+	return BucketOptions{
+		Endpoint:           os.Getenv("PFS_S3_ENDPOINT"),
+		Region:             os.Getenv("PFS_S3_REGION"),
+		PathStyle:          os.Getenv("PFS_S3_PATH_STYLE") == "true",
+		AccessKey:          os.Getenv("PFS_S3_ACCESS_KEY"),
+		SecretKey:          os.Getenv("PFS_S3_SECRET_KEY"),
+		IAMRole:            os.Getenv("PFS_S3_IAM_ROLE") == "true",
+		InsecureSkipVerify: os.Getenv("PFS_S3_INSECURE_SKIP_VERIFY") == "true",
+	}
+}
+
+// region returns the aws.Region opts describe.
+func (opts BucketOptions) region() (aws.Region, error) {
+	if opts.Endpoint == "" {
+		if opts.Region == "" {
+			return aws.USWest, nil
+		}
+		region, ok := aws.Regions[opts.Region]
+		if !ok {
+			return aws.Region{}, fmt.Errorf("Unknown region %s.", opts.Region)
+		}
+		return region, nil
+	}
+	u, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return aws.Region{}, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return aws.Region{}, fmt.Errorf("Invalid endpoint %s, it should look like https://<host>.", opts.Endpoint)
+	}
+	name := opts.Region
+	if name == "" {
+		name = "us-east-1"
+	}
+	region := aws.Region{Name: name, S3Endpoint: strings.TrimSuffix(opts.Endpoint, "/")}
+	if !opts.PathStyle {
+		region.S3BucketEndpoint = fmt.Sprintf("%s://${bucket}.%s", u.Scheme, u.Host)
+	}
+	return region, nil
+}
+
+// auth returns the credentials opts describe.
+func (opts BucketOptions) auth() (aws.Auth, error) {
+	switch {
+	case opts.AccessKey != "" || opts.SecretKey != "":
+		if opts.AccessKey == "" || opts.SecretKey == "" {
+			return aws.Auth{}, fmt.Errorf("Static credentials need both an access key and a secret key.")
+		}
+		return aws.Auth{AccessKey: opts.AccessKey, SecretKey: opts.SecretKey}, nil
+	case opts.IAMRole:
+		// With no keys GetAuth asks the instance metadata service.
+		return aws.GetAuth("", "")
+	}
+	return aws.EnvAuth()
+}
+
+// NewBucketWithOptions is NewBucket for buckets described by opts.
+func NewBucketWithOptions(uri string, opts BucketOptions) (*s3.Bucket, error) {
+	auth, err := opts.auth()
 	if err != nil {
 		log.Print(err)
 		return nil, err
 	}
-	client := s3.New(auth, aws.USWest)
+	region, err := opts.region()
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(auth, region)
+	if opts.InsecureSkipVerify {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		client.HTTPClient = func() *http.Client { return &http.Client{Transport: transport} }
+	}
 	bucket, err := GetBucket(uri)
 	if err != nil {
 		return nil, err
@@ -48,54 +163,173 @@ func NewBucket(uri string) (*s3.Bucket, error) {
 
 // PutMulti is like a smart bucket.Put in that it will automatically do a
 // multiput if the input reader has enough data that it makes sense to do so.
+// It's Upload with the DefaultUploadOptions.
 func PutMulti(bucket *s3.Bucket, path string, r io.Reader, contType string, perm s3.ACL) error {
-	// A pointer to a Multi transaction, if this is non nil it means we're
-	// putting the data in parts.
-	var multi *s3.Multi = nil
-	var parts []s3.Part
-	for i := 1; ; i++ {
-		data := make([]byte, maxPart)
-		n, err := io.ReadAtLeast(r, data, minPart)
-		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
-			// EOF means that r was empty
-			// ErrUnexpectedEOF means that r had less than minPart bytes in it
-			// Note that we can hit these errors after having read several 5MB
-			// chunks from r already
-			log.Print(err)
+	return Upload(context.Background(), bucket, path, r, contType, perm, DefaultUploadOptions)
+}
+
+// UploadOptions controls how Upload puts large objects.
+type UploadOptions struct {
+	// PartSize is the size of the parts of multipart uploads, it must be at
+	// least 5MB. Objects smaller than that are put in one request.
+	PartSize int64
+	// Parallelism is how many parts are uploaded at once, each one is
+	// buffered in memory.
+	Parallelism int
+	// Retries is how many times a request that fails with a transient error
+	// is retried.
+	Retries int
+}
+
+// DefaultUploadOptions are the UploadOptions PutMulti uses.
+var DefaultUploadOptions = UploadOptions{PartSize: maxPart, Parallelism: 4, Retries: 5}
+
+// retryBackoff is how long we wait before the first retry, it doubles with
+// each one after that.
+var retryBackoff = 100 * time.Millisecond
+
+// transient returns true if err is worth retrying.
+func transient(err error) bool {
+	var s3Err *s3.Error
+	if errors.As(err, &s3Err) {
+		switch s3Err.Code {
+		case "RequestTimeout", "SlowDown", "InternalError", "ServiceUnavailable":
+			return true
+		}
+		return s3Err.StatusCode >= 500 || s3Err.StatusCode == 429
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retry calls f until it succeeds, fails with an error that isn't transient
+// or has been retried retries times, backing off between attempts.
+func retry(ctx context.Context, retries int, f func() error) error {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i == retries || !transient(err) {
 			return err
 		}
-		if n >= minPart && multi == nil {
-			// We have enough data to do a MultiPut but we haven't started on yet.
-			// That means it's time to start one
-			multi, err = bucket.Multi(path, contType, perm)
-			if err != nil {
-				log.Print(err)
-				return err
-			}
+		logger.WarnContext(ctx, "retrying after transient error", "attempt", i+1, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// partETag returns the ETag S3 gives a part containing data.
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:]))
+}
+
+// putPart uploads data as part n of multi, retrying transient errors and
+// checking that what S3 stored matches what we sent.
+func putPart(ctx context.Context, multi *s3.Multi, n int, data []byte, retries int) (s3.Part, error) {
+	var part s3.Part
+	err := retry(ctx, retries, func() error {
+		var err error
+		if part, err = multi.PutPart(n, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		if expected := partETag(data); !strings.EqualFold(part.ETag, expected) {
+			// Treat a mismatch like a network error, the part is
+			// simply uploaded again.
+			return fmt.Errorf("part %d of %s has ETag %s, expected %s: %w", n, multi.Key, part.ETag, expected, io.ErrUnexpectedEOF)
 		}
-		// Now we upload the actual data
-		if multi == nil {
-			// We're not doing a multi transaction,
-			return bucket.Put(path, data[0:n], contType, perm)
-		} else {
-			part, err := multi.PutPart(i, bytes.NewReader(data[0:n]))
+		return nil
+	})
+	return part, err
+}
+
+// Upload puts the contents of r at path, as a multipart upload with parts
+// uploaded in parallel if r is bigger than a part. Requests that fail with
+// transient errors are retried and parts are checked against their ETags, a
+// multipart upload that fails anyway is aborted. Cancelling ctx stops
+// retries, readers should be cancelled too.
+func Upload(ctx context.Context, bucket *s3.Bucket, path string, r io.Reader, contType string, perm s3.ACL, opts UploadOptions) error {
+	if opts.PartSize < minPart {
+		return fmt.Errorf("Part size %d is smaller than the minimum of %d.", opts.PartSize, minPart)
+	}
+	if opts.Parallelism < 1 {
+		opts.Parallelism = 1
+	}
+	first := make([]byte, opts.PartSize)
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// It fits in a single part.
+		return retry(ctx, opts.Retries, func() error {
+			return bucket.Put(path, first[:n], contType, perm)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	var multi *s3.Multi
+	err = retry(ctx, opts.Retries, func() error {
+		var err error
+		multi, err = bucket.InitMulti(path, contType, perm)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var parts []s3.Part
+	var lock sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+	sem := make(chan struct{}, opts.Parallelism)
+	var wg sync.WaitGroup
+	data := first[:n]
+	for i := 1; len(data) > 0 && !failed(); i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			part, err := putPart(ctx, multi, i, data, opts.Retries)
 			if err != nil {
-				log.Print(err)
-				return err
+				fail(err)
+				return
 			}
+			lock.Lock()
 			parts = append(parts, part)
+			lock.Unlock()
+		}(i, data)
+
+		next := make([]byte, opts.PartSize)
+		n, err := io.ReadFull(r, next)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			fail(err)
 		}
-		if n < minPart {
-			// That means this was the last batch of data, time to break out of
-			// this loop
-			break
-		}
+		data = next[:n]
 	}
-	if multi != nil {
-		if err := multi.Complete(parts); err != nil {
-			log.Print(err)
-			return err
+	wg.Wait()
+	if firstErr == nil {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].N < parts[j].N })
+		firstErr = retry(ctx, opts.Retries, func() error { return multi.Complete(parts) })
+	}
+	if firstErr != nil {
+		if err := multi.Abort(); err != nil {
+			logger.ErrorContext(ctx, "aborting upload", "key", multi.Key, "err", err)
 		}
+		return firstErr
 	}
 	return nil
 }
@@ -104,9 +338,14 @@ func PutMulti(bucket *s3.Bucket, path string, r io.Reader, contType string, perm
 // Pass `marker=""` to start from the beginning.
 // Returns the marker that should be passed to pick-up where this call left off.
 func ForEachFile(uri, marker string, cont func(file string) error) (string, error) {
+	return ForEachFileWithOptions(uri, marker, BucketOptions{}, cont)
+}
+
+// ForEachFileWithOptions is ForEachFile for buckets described by opts.
+func ForEachFileWithOptions(uri, marker string, opts BucketOptions, cont func(file string) error) (string, error) {
 	nextMarker := marker
 
-	bucket, err := NewBucket(uri)
+	bucket, err := NewBucketWithOptions(uri, opts)
 	if err != nil {
 		return nextMarker, err
 	}
@@ -0,0 +1,90 @@
+package s3utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	calls := 0
+	err := retry(context.Background(), 3, func() error {
+		calls++
+		if calls < 3 {
+			return &s3.Error{StatusCode: 503, Code: "SlowDown"}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("Transient errors should be retried, got %v after %d calls.", err, calls)
+	}
+
+	calls = 0
+	err = retry(context.Background(), 3, func() error {
+		calls++
+		return &s3.Error{StatusCode: 403, Code: "AccessDenied"}
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("Permanent errors shouldn't be retried, got %v after %d calls.", err, calls)
+	}
+
+	calls = 0
+	err = retry(context.Background(), 2, func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+	if !errors.Is(err, io.ErrUnexpectedEOF) || calls != 3 {
+		t.Fatalf("Expected to give up after 2 retries, got %v after %d calls.", err, calls)
+	}
+}
+
+func TestPartETag(t *testing.T) {
+	if etag := partETag([]byte("foo")); etag != `"acbd18db4cc2f85cedef654fccc4a4d8"` {
+		t.Fatalf("Wrong ETag %s.", etag)
+	}
+}
+
+func TestUploadPartSize(t *testing.T) {
+	opts := DefaultUploadOptions
+	opts.PartSize = minPart - 1
+	if err := Upload(context.Background(), nil, "foo", nil, "", s3.Private, opts); err == nil {
+		t.Fatal("Parts smaller than S3's minimum should be rejected.")
+	}
+}
+
+func TestBucketOptions(t *testing.T) {
+	region, err := BucketOptions{Endpoint: "http://minio:9000", PathStyle: true}.region()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region.S3Endpoint != "http://minio:9000" || region.S3BucketEndpoint != "" || region.Name != "us-east-1" {
+		t.Fatalf("Wrong path style region %+v.", region)
+	}
+	region, err = BucketOptions{Endpoint: "https://rgw.example.com/", Region: "eu"}.region()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region.S3BucketEndpoint != "https://${bucket}.rgw.example.com" || region.Name != "eu" {
+		t.Fatalf("Wrong virtual host region %+v.", region)
+	}
+	for _, opts := range []BucketOptions{{Region: "nowhere"}, {Endpoint: "minio:9000"}} {
+		if _, err := opts.region(); err == nil {
+			t.Fatalf("%+v should be invalid.", opts)
+		}
+	}
+
+	auth, err := BucketOptions{AccessKey: "foo", SecretKey: "bar"}.auth()
+	if err != nil || auth.AccessKey != "foo" || auth.SecretKey != "bar" {
+		t.Fatalf("Static credentials weren't used: %+v, %v", auth, err)
+	}
+	if _, err := (BucketOptions{AccessKey: "foo"}).auth(); err == nil {
+		t.Fatal("An access key without a secret key should be invalid.")
+	}
+}
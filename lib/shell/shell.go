@@ -2,17 +2,40 @@ package shell
 
 import (
 	"bytes"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os/exec"
 	"path"
 	"runtime"
 	"strings"
 )
 
+var logger = slog.Default()
+
+// SetLogger sets the logger commands are logged to, at debug level, along
+// with anything they write to stderr, as warnings. It should be called
+// before any commands are run.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// logCommand logs that c is about to run, on behalf of the function skip
+// frames up the stack.
+func logCommand(c *exec.Cmd, skip int) {
+	_, callerFile, callerLine, _ := runtime.Caller(skip + 1)
+	logger.Debug("running command", "cmd", strings.Join(c.Args, " "), "caller", fmt.Sprintf("%s:%d", path.Base(callerFile), callerLine))
+}
+
+// logStderr logs what c wrote to stderr, if it wrote anything.
+func logStderr(c *exec.Cmd, stderr *bytes.Buffer) {
+	if stderr.Len() != 0 {
+		logger.Warn("command had output on stderr", "cmd", strings.Join(c.Args, " "), "stderr", stderr.String())
+	}
+}
+
 func RunStderr(c *exec.Cmd) error {
-	_, callerFile, callerLine, _ := runtime.Caller(1)
-	log.Printf("%15s:%.3d -> %s", path.Base(callerFile), callerLine, strings.Join(c.Args, " "))
+	logCommand(c, 1)
 	stderr, err := c.StderrPipe()
 	if err != nil {
 		return err
@@ -23,15 +46,12 @@ func RunStderr(c *exec.Cmd) error {
 	}
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(stderr)
-	if buf.Len() != 0 {
-		log.Print("Command had output on stderr.\n Cmd: ", strings.Join(c.Args, " "), "\nstderr: ", buf)
-	}
+	logStderr(c, buf)
 	return c.Wait()
 }
 
 func CallCont(c *exec.Cmd, cont func(io.Reader) error) error {
-	_, callerFile, callerLine, _ := runtime.Caller(1)
-	log.Printf("%15s:%.3d -> %s", path.Base(callerFile), callerLine, strings.Join(c.Args, " "))
+	logCommand(c, 1)
 	reader, err := c.StdoutPipe()
 	if err != nil {
 		return err
@@ -52,9 +72,7 @@ func CallCont(c *exec.Cmd, cont func(io.Reader) error) error {
 
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(stderr)
-	if buf.Len() != 0 {
-		log.Print("Command had output on stderr.\n Cmd: ", strings.Join(c.Args, " "), "\nstderr: ", buf)
-	}
+	logStderr(c, buf)
 
 	return c.Wait()
 }
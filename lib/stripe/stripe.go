@@ -0,0 +1,81 @@
+// Package stripe splits big files across shards. Normally a file lives on
+// the one shard that owns its path, so reading or writing it is limited to
+// what one disk can do. A striped file is cut in to fixed size stripes, each
+// of which is placed as if it were a file of its own, and the shard that
+// owns the file's path keeps a Manifest saying how to put it back together.
+// The router does the cutting as the file's written and the reassembly as
+// it's read.
+package stripe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Header marks requests and responses whose body is a Manifest rather than
+// the file itself, its value is the number of stripes.
+const Header = "X-Pfs-Stripes"
+
+// Param is the query parameter that picks out one stripe of a file.
+const Param = "stripe"
+
+// SizeParam is the query parameter that gives the size of the whole file on
+// writes of its stripes and manifest, so that shards can hold the file to
+// their limits before any of it's written.
+const SizeParam = "stripedSize"
+
+// Manifest describes a striped file. Every stripe is StripeSize bytes except
+// the last, which has whatever's left.
+type Manifest struct {
+	Size       int64 `json:"size"`
+	StripeSize int64 `json:"stripeSize"`
+}
+
+// Stripes returns how many stripes the file has.
+func (m Manifest) Stripes() int {
+	if m.StripeSize <= 0 {
+		return 0
+	}
+	return int((m.Size + m.StripeSize - 1) / m.StripeSize)
+}
+
+// StripeLen returns the size of stripe i.
+func (m Manifest) StripeLen(i int) int64 {
+	if rest := m.Size - int64(i)*m.StripeSize; rest < m.StripeSize {
+		return rest
+	}
+	return m.StripeSize
+}
+
+// Key returns what stripe i of the file at the url path p is placed by.
+func Key(p string, i int) string {
+	return fmt.Sprintf("%s#%s-%d", p, Param, i)
+}
+
+// magic starts every encoded Manifest.
+const magic = "pfs-stripe-manifest\n"
+
+// WriteManifest encodes m to w.
+func WriteManifest(w io.Writer, m Manifest) error {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(m)
+}
+
+// ReadManifest decodes a Manifest written by WriteManifest.
+func ReadManifest(r io.Reader) (Manifest, error) {
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != magic {
+		return Manifest{}, fmt.Errorf("Not a stripe manifest.")
+	}
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return Manifest{}, err
+	}
+	if m.Size < 0 || m.StripeSize <= 0 {
+		return Manifest{}, fmt.Errorf("Invalid stripe manifest %+v.", m)
+	}
+	return m, nil
+}
@@ -0,0 +1,54 @@
+package stripe
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStripes(t *testing.T) {
+	for _, c := range []struct {
+		m       Manifest
+		stripes int
+		last    int64
+	}{
+		{Manifest{Size: 10, StripeSize: 4}, 3, 2},
+		{Manifest{Size: 8, StripeSize: 4}, 2, 4},
+		{Manifest{Size: 3, StripeSize: 4}, 1, 3},
+		{Manifest{Size: 0, StripeSize: 4}, 0, 0},
+	} {
+		if n := c.m.Stripes(); n != c.stripes {
+			t.Errorf("%+v has %d stripes, expected %d.", c.m, n, c.stripes)
+			continue
+		}
+		if c.stripes > 0 && c.m.StripeLen(c.stripes-1) != c.last {
+			t.Errorf("The last stripe of %+v is %d bytes, expected %d.", c.m, c.m.StripeLen(c.stripes-1), c.last)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	var buf bytes.Buffer
+	m := Manifest{Size: 100, StripeSize: 30}
+	if err := WriteManifest(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != m {
+		t.Fatalf("Read %+v, expected %+v.", read, m)
+	}
+	for _, data := range []string{"foo", magic + `{"size": 10, "stripeSize": 0}`} {
+		if _, err := ReadManifest(strings.NewReader(data)); err == nil {
+			t.Fatalf("%q shouldn't be a manifest.", data)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	if Key("/file/foo", 0) == Key("/file/foo", 1) || Key("/file/foo", 0) == "/file/foo" {
+		t.Fatal("Stripes need their own keys.")
+	}
+}
@@ -0,0 +1,199 @@
+// Package textdiff makes unified diffs of text files, in the format of
+// diff -u, so that changes to datasets can be reviewed with the usual tools.
+// The diff is found by longest common subsequence after trimming the lines
+// the files share at either end, which is the common case for data that's
+// appended to or edited in place. When the lines left over are too many to
+// compare the whole of them is shown as replaced.
+package textdiff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxCells is the most line pairs Unified compares, it bounds its memory.
+const maxCells = 1 << 22
+
+// IsText returns true if data looks like text: it's valid UTF-8 and has no
+// NULs in it.
+func IsText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) == -1
+}
+
+// op is a line of a diff, kind is ' ', '-' or '+'.
+type op struct {
+	kind byte
+	line string
+}
+
+// Unified returns a unified diff that turns from, named fromName, in to to,
+// named toName, with context lines of context around each change. It's
+// empty if from and to are the same.
+func Unified(fromName, toName string, from, to []byte, context int) string {
+	ops := diff(splitLines(from), splitLines(to))
+	var b strings.Builder
+	// fromLine and toLine count the lines of each file before ops[i].
+	fromLine, toLine := 0, 0
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			fromLine, toLine = advance(ops[i], fromLine, toLine)
+			i++
+			continue
+		}
+		if b.Len() == 0 {
+			fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		// The hunk starts context lines before this change and runs until
+		// there's a gap of more than 2*context unchanged lines.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		for j := start; j < i; j++ {
+			if ops[j].kind == ' ' {
+				fromLine--
+				toLine--
+			}
+		}
+		end, gap := i, 0
+		for j := i; j < len(ops) && gap <= 2*context; j++ {
+			if ops[j].kind == ' ' {
+				gap++
+			} else {
+				end, gap = j+1, 0
+			}
+		}
+		if end += context; end > len(ops) {
+			end = len(ops)
+		}
+		fromCount, toCount := 0, 0
+		for _, o := range ops[start:end] {
+			if o.kind != '+' {
+				fromCount++
+			}
+			if o.kind != '-' {
+				toCount++
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(fromLine, fromCount), hunkRange(toLine, toCount))
+		for _, o := range ops[start:end] {
+			b.WriteByte(o.kind)
+			b.WriteString(o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+			fromLine, toLine = advance(o, fromLine, toLine)
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// advance moves the line counts past o.
+func advance(o op, fromLine, toLine int) (int, int) {
+	if o.kind != '+' {
+		fromLine++
+	}
+	if o.kind != '-' {
+		toLine++
+	}
+	return fromLine, toLine
+}
+
+// hunkRange formats the lines of one side of a hunk, start is how many lines
+// precede it.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits data after each newline, the last line may not have one.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// diff returns the ops that turn from in to to.
+func diff(from, to []string) []op {
+	var prefix, suffix []op
+	for len(from) > 0 && len(to) > 0 && from[0] == to[0] {
+		prefix = append(prefix, op{' ', from[0]})
+		from, to = from[1:], to[1:]
+	}
+	for len(from) > 0 && len(to) > 0 && from[len(from)-1] == to[len(to)-1] {
+		suffix = append(suffix, op{' ', from[len(from)-1]})
+		from, to = from[:len(from)-1], to[:len(to)-1]
+	}
+	ops := append(prefix, lcs(from, to)...)
+	for i := len(suffix) - 1; i >= 0; i-- {
+		ops = append(ops, suffix[i])
+	}
+	return ops
+}
+
+// lcs returns the ops that turn from in to to keeping their longest common
+// subsequence of lines.
+func lcs(from, to []string) []op {
+	var ops []op
+	if len(from)*len(to) > maxCells {
+		for _, line := range from {
+			ops = append(ops, op{'-', line})
+		}
+		for _, line := range to {
+			ops = append(ops, op{'+', line})
+		}
+		return ops
+	}
+	// length[i][j] is the length of the lcs of from[i:] and to[j:].
+	length := make([][]int32, len(from)+1)
+	for i := range length {
+		length[i] = make([]int32, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				length[i][j] = length[i+1][j+1] + 1
+			} else if length[i+1][j] >= length[i][j+1] {
+				length[i][j] = length[i+1][j]
+			} else {
+				length[i][j] = length[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case from[i] == to[j]:
+			ops = append(ops, op{' ', from[i]})
+			i, j = i+1, j+1
+		case length[i+1][j] >= length[i][j+1]:
+			ops = append(ops, op{'-', from[i]})
+			i++
+		default:
+			ops = append(ops, op{'+', to[j]})
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		ops = append(ops, op{'-', from[i]})
+	}
+	for ; j < len(to); j++ {
+		ops = append(ops, op{'+', to[j]})
+	}
+	return ops
+}
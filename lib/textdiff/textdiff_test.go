@@ -0,0 +1,47 @@
+package textdiff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	for _, c := range []struct {
+		from, to string
+		expected string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", "--- from\n+++ to\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"", "a\n", "--- from\n+++ to\n@@ -0,0 +1 @@\n+a\n"},
+		{"a\n", "", "--- from\n+++ to\n@@ -1 +0,0 @@\n-a\n"},
+		{"a\nb", "a\nc", "--- from\n+++ to\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n"},
+		// Changes far apart get their own hunks.
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"x\n2\n3\n4\n5\n6\n7\n8\ny\n",
+			"--- from\n+++ to\n@@ -1,2 +1,2 @@\n-1\n+x\n 2\n@@ -8,2 +8,2 @@\n 8\n-9\n+y\n",
+		},
+		// Changes close together share one.
+		{
+			"1\n2\n3\n4\n",
+			"x\n2\n3\ny\n",
+			"--- from\n+++ to\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n-4\n+y\n",
+		},
+		{"a\nb\nc\nd\n", "b\nc\nx\n", "--- from\n+++ to\n@@ -1,4 +1,3 @@\n-a\n b\n c\n-d\n+x\n"},
+	} {
+		if diff := Unified("from", "to", []byte(c.from), []byte(c.to), 1); diff != c.expected {
+			t.Errorf("Diff of %q and %q is:\n%s\nexpected:\n%s", c.from, c.to, diff, c.expected)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	for data, expected := range map[string]bool{
+		"foo\n":        true,
+		"":             true,
+		"héllo":        true,
+		"foo\x00bar":   false,
+		"\xff\xfe\xfd": false,
+	} {
+		if IsText([]byte(data)) != expected {
+			t.Errorf("IsText(%q) should be %v.", data, expected)
+		}
+	}
+}
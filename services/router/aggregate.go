@@ -0,0 +1,613 @@
+package main
+
+// aggregate.go merges the responses of requests that are fanned out to every
+// shard in to a single response, so clients of the router see one cluster
+// rather than N shards.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+// commitMsg is what shards return for POST /commit, Shards is added by the
+// router.
+type commitMsg struct {
+	Id     string `json:"id"`
+	Branch string `json:"branch"`
+	Parent string `json:"parent"`
+	TStamp string `json:"tstamp"`
+	Files  int    `json:"files"`
+	Shards int    `json:"shards"`
+}
+
+type byTStamp []map[string]interface{}
+
+func (l byTStamp) Len() int      { return len(l) }
+func (l byTStamp) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l byTStamp) Less(i, j int) bool {
+	ti, _ := l[i]["tstamp"].(string)
+	tj, _ := l[j]["tstamp"].(string)
+	return ti > tj
+}
+
+// mergeLists merges streams of JSON objects, like the output of GET /commit,
+// dropping objects whose name we've already seen. The result is newest first.
+func mergeLists(bodies []io.Reader) ([]map[string]interface{}, error) {
+	seen := make(map[string]bool)
+	var res []map[string]interface{}
+	for _, body := range bodies {
+		decoder := json.NewDecoder(body)
+		for {
+			var entry map[string]interface{}
+			if err := decoder.Decode(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			name, _ := entry["name"].(string)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			res = append(res, entry)
+		}
+	}
+	sort.Stable(byTStamp(res))
+	return res, nil
+}
+
+// commitLogEntry is a commit in the router's log of the whole cluster.
+// Missing lists the shards that don't have the commit.
+type commitLogEntry struct {
+	Name    string   `json:"name"`
+	TStamp  string   `json:"tstamp"`
+	Shards  int      `json:"shards"`
+	Missing []string `json:"missing,omitempty"`
+}
+
+type byEntryTStamp []commitLogEntry
+
+func (l byEntryTStamp) Len() int           { return len(l) }
+func (l byEntryTStamp) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byEntryTStamp) Less(i, j int) bool { return l[i].TStamp > l[j].TStamp }
+
+// mergeCommitLog merges the output of GET /commit from each of hosts in to
+// one log, newest first, noting which hosts are missing each commit.
+func mergeCommitLog(bodies []io.Reader, hosts []string) ([]commitLogEntry, error) {
+	var entries []commitLogEntry
+	index := make(map[string]int)
+	has := make(map[string]map[string]bool)
+	for i, body := range bodies {
+		decoder := json.NewDecoder(body)
+		for {
+			var entry commitLogEntry
+			if err := decoder.Decode(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if _, ok := index[entry.Name]; !ok {
+				index[entry.Name] = len(entries)
+				has[entry.Name] = make(map[string]bool)
+				entries = append(entries, commitLogEntry{Name: entry.Name, TStamp: entry.TStamp})
+			}
+			if !has[entry.Name][hosts[i]] {
+				has[entry.Name][hosts[i]] = true
+				entries[index[entry.Name]].Shards++
+			}
+		}
+	}
+	for i := range entries {
+		for _, host := range hosts {
+			if !has[entries[i].Name][host] {
+				entries[i].Missing = append(entries[i].Missing, host)
+			}
+		}
+	}
+	sort.Stable(byEntryTStamp(entries))
+	return entries, nil
+}
+
+// mergeDiffs merges the output of GET /diff, either JSON arrays or lines of
+// text, in to a sorted list of files.
+func mergeDiffs(bodies []io.Reader, text bool) ([]string, error) {
+	var files []string
+	for _, body := range bodies {
+		if text {
+			scanner := bufio.NewScanner(body)
+			for scanner.Scan() {
+				files = append(files, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var shardFiles []string
+		if err := json.NewDecoder(body).Decode(&shardFiles); err != nil {
+			return nil, err
+		}
+		files = append(files, shardFiles...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// mergeCommits merges the responses to POST /commit, they should all be for
+// the same commit.
+func mergeCommits(bodies []io.Reader) (commitMsg, error) {
+	var res commitMsg
+	for _, body := range bodies {
+		var msg commitMsg
+		if err := json.NewDecoder(body).Decode(&msg); err != nil {
+			return res, err
+		}
+		if res.Shards == 0 {
+			res = msg
+		} else {
+			res.Files += msg.Files
+		}
+		res.Shards++
+	}
+	return res, nil
+}
+
+// fanoutHttp sends r to every shard and writes the result of merging their
+// responses with merge.
+func fanoutHttp(w http.ResponseWriter, r *http.Request, merge func([]io.Reader) (interface{}, error)) {
+	resps, err := route.Fanout(r, "/pfs/master")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	var bodies []io.Reader
+	for _, resp := range resps {
+		defer resp.Body.Close()
+		bodies = append(bodies, resp.Body)
+	}
+	res, err := merge(bodies)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	switch res := res.(type) {
+	case []map[string]interface{}:
+		// Lists are streams of objects, one per line, like the shards return.
+		encoder := json.NewEncoder(w)
+		for _, entry := range res {
+			if err := encoder.Encode(entry); err != nil {
+				log.Print(err)
+				return
+			}
+		}
+	case []string:
+		if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			for _, line := range res {
+				if _, err := io.WriteString(w, line+"\n"); err != nil {
+					log.Print(err)
+					return
+				}
+			}
+			return
+		}
+		if res == nil {
+			res = []string{}
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Print(err)
+		}
+	default:
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// commitLogHandler returns the commits of the whole cluster. With a `commit`
+// param it returns just that commit, so clients can check that it made it to
+// every shard.
+func commitLogHandler(w http.ResponseWriter, r *http.Request) {
+	// Shards can be missing commits so they can't page through the log
+	// themselves, we page through the merged log.
+	query := r.URL.Query()
+	after, limit := query.Get("after"), 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %s.", l), 400)
+			return
+		}
+	}
+	order, err := btrfs.ParseOrder(query.Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	query.Del("after")
+	query.Del("limit")
+	query.Del("order")
+	r.URL.RawQuery = query.Encode()
+	hosts, err := route.Endpoints("/pfs/master")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	resps, err := route.FanoutTo(r, hosts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	var bodies []io.Reader
+	for _, resp := range resps {
+		defer resp.Body.Close()
+		bodies = append(bodies, resp.Body)
+	}
+	entries, err := mergeCommitLog(bodies, hosts)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	if order == btrfs.Asc {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	encoder := json.NewEncoder(w)
+	if commit := r.URL.Query().Get("commit"); commit != "" {
+		for _, entry := range entries {
+			if entry.Name == commit {
+				if err := encoder.Encode(entry); err != nil {
+					log.Print(err)
+				}
+				return
+			}
+		}
+		http.Error(w, fmt.Sprintf("Commit %s not found on any shard.", commit), 404)
+		return
+	}
+	if after != "" {
+		i := 0
+		for i < len(entries) && entries[i].Name != after {
+			i++
+		}
+		if i == len(entries) {
+			http.Error(w, fmt.Sprintf("Commit %s not found on any shard.", after), 404)
+			return
+		}
+		entries = entries[i+1:]
+	}
+	if limit != 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+}
+
+// headMsg is what shards return for GET /head.
+type headMsg struct {
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+}
+
+// errHeadsDiffer means the shards have different heads for a branch, which
+// happens while a commit is being finalized on them.
+var errHeadsDiffer = errors.New("shards have different heads")
+
+// mergeHeads merges the responses to GET /head, they have to agree.
+func mergeHeads(bodies []io.Reader) (headMsg, error) {
+	var res headMsg
+	for i, body := range bodies {
+		var msg headMsg
+		if err := json.NewDecoder(body).Decode(&msg); err != nil {
+			return res, err
+		}
+		if i == 0 {
+			res = msg
+		} else if msg != res {
+			return res, fmt.Errorf("%w, %s and %s", errHeadsDiffer, res.Commit, msg.Commit)
+		}
+	}
+	return res, nil
+}
+
+// headHandler returns the head of a branch, once every shard agrees on it.
+// Until then clients are asked to retry, so they never pin a commit that
+// some shards don't have yet.
+func headHandler(w http.ResponseWriter, r *http.Request) {
+	resps, err := route.Fanout(r, "/pfs/master")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	var bodies []io.Reader
+	for _, resp := range resps {
+		defer resp.Body.Close()
+		bodies = append(bodies, resp.Body)
+	}
+	head, err := mergeHeads(bodies)
+	if errors.Is(err, errHeadsDiffer) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, fmt.Sprintf("A commit to %s is in progress, %s.", head.Branch, err), 503)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(head); err != nil {
+		log.Print(err)
+	}
+}
+
+// holdMsg is what shards return for POST and GET /hold.
+type holdMsg struct {
+	Id      string `json:"id"`
+	Commit  string `json:"commit"`
+	Expires string `json:"expires"`
+}
+
+// holdExpiry returns when hold expires, shards may be in different time
+// zones so expiries can't be compared as strings.
+func holdExpiry(hold holdMsg) time.Time {
+	expires, _ := time.Parse("2006-01-02T15:04:05.999999-07:00", hold.Expires)
+	return expires
+}
+
+// mergeHolds merges the shards' holds by id. A hold is only as good as its
+// shortest lease so each keeps the earliest expiry, holds that some shards
+// don't have are dropped. The result is sorted by id.
+func mergeHolds(bodies []io.Reader) ([]holdMsg, error) {
+	holds := make(map[string]holdMsg)
+	counts := make(map[string]int)
+	for _, body := range bodies {
+		decoder := json.NewDecoder(body)
+		for {
+			var msg holdMsg
+			if err := decoder.Decode(&msg); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			counts[msg.Id]++
+			if hold, ok := holds[msg.Id]; !ok || holdExpiry(msg).Before(holdExpiry(hold)) {
+				holds[msg.Id] = msg
+			}
+		}
+	}
+	var res []holdMsg
+	for id, hold := range holds {
+		if counts[id] == len(bodies) {
+			res = append(res, hold)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+	return res, nil
+}
+
+// holdHandler holds commits on every shard, under the same id so that reads
+// with ?hold= can go to any of them, and lists, renews and releases them.
+func holdHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "DELETE" {
+		route.MulticastHttp(w, r, "/pfs/master")
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/hold" && r.URL.Query().Get("id") == "" {
+		values := r.URL.Query()
+		values.Set("id", btrfs.NewCommitId())
+		r.URL.RawQuery = values.Encode()
+	}
+	resps, err := route.Fanout(r, "/pfs/master")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	var bodies []io.Reader
+	for _, resp := range resps {
+		defer resp.Body.Close()
+		bodies = append(bodies, resp.Body)
+	}
+	holds, err := mergeHolds(bodies)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if r.Method == "POST" {
+		if len(holds) != 1 {
+			http.Error(w, "Shards returned different holds.", 500)
+			return
+		}
+		holds = holds[:1]
+	}
+	for _, hold := range holds {
+		if err := encoder.Encode(hold); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	fanoutHttp(w, r, func(bodies []io.Reader) (interface{}, error) { return mergeLists(bodies) })
+}
+
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	text := strings.Contains(r.Header.Get("Accept"), "text/plain")
+	fanoutHttp(w, r, func(bodies []io.Reader) (interface{}, error) { return mergeDiffs(bodies, text) })
+}
+
+// fileListHandler merges the shards' file lists as they stream in. Each
+// shard returns its own page of ?limit= files after ?after=, in the order of
+// btrfs.ComparePaths, so the first ?limit= of their merge is the cluster's
+// page. Lists of commits are spread across replicas, see listEndpoints.
+func fileListHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %s.", l), 400)
+			return
+		}
+	}
+	accept := r.Header.Get("Accept")
+	r.Header.Set("Accept", "application/x-ndjson")
+	var resps []*http.Response
+	var err error
+	if endpoints := listEndpoints(r); endpoints != nil {
+		// If a replica can't answer after all the primaries can.
+		if resps, err = route.FanoutTo(r, endpoints); err != nil {
+			log.Print(err)
+		}
+	}
+	if resps == nil {
+		resps, err = route.Fanout(r, "/pfs/master")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	var lists []*fileStream
+	for _, resp := range resps {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			http.Error(w, strings.TrimSpace(string(body)), resp.StatusCode)
+			return
+		}
+		lists = append(lists, &fileStream{scanner: bufio.NewScanner(resp.Body)})
+	}
+	for _, list := range lists {
+		if err := list.next(); err != nil {
+			http.Error(w, err.Error(), 500)
+			log.Print(err)
+			return
+		}
+	}
+	out := newFileListWriter(w, accept)
+	last, n := "", 0
+	for limit == 0 || n < limit {
+		// Take the smallest head of the lists, shards shouldn't share files
+		// but if they do we list them once.
+		var min *fileStream
+		for _, list := range lists {
+			if !list.done && (min == nil || btrfs.ComparePaths(list.head, min.head) < 0) {
+				min = list
+			}
+		}
+		if min == nil {
+			break
+		}
+		if n == 0 || min.head != last {
+			if err := out.write(min.head); err != nil {
+				log.Print(err)
+				return
+			}
+			last = min.head
+			n++
+		}
+		if err := min.next(); err != nil {
+			// We've already started the list so all we can do is log and
+			// cut it short.
+			log.Print(err)
+			return
+		}
+	}
+	if err := out.close(); err != nil {
+		log.Print(err)
+	}
+}
+
+// fileStream reads a shard's file list a line of ndjson at a time.
+type fileStream struct {
+	scanner *bufio.Scanner
+	head    string
+	done    bool
+}
+
+func (s *fileStream) next() error {
+	if !s.scanner.Scan() {
+		s.done = true
+		return s.scanner.Err()
+	}
+	return json.Unmarshal(s.scanner.Bytes(), &s.head)
+}
+
+// fileListWriter writes a list of files in the format a client accepts, see
+// the shard's list.go.
+type fileListWriter struct {
+	w      http.ResponseWriter
+	format string
+	n      int
+}
+
+func newFileListWriter(w http.ResponseWriter, accept string) *fileListWriter {
+	switch {
+	case strings.Contains(accept, "text/plain"):
+		return &fileListWriter{w: w, format: "text"}
+	case strings.Contains(accept, "application/x-ndjson"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return &fileListWriter{w: w, format: "ndjson"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return &fileListWriter{w: w, format: "json"}
+}
+
+func (l *fileListWriter) write(file string) error {
+	var err error
+	switch l.format {
+	case "text":
+		_, err = fmt.Fprintln(l.w, file)
+	case "ndjson":
+		err = json.NewEncoder(l.w).Encode(file)
+	default:
+		sep := ","
+		if l.n == 0 {
+			sep = "["
+		}
+		var data []byte
+		if data, err = json.Marshal(file); err == nil {
+			_, err = fmt.Fprintf(l.w, "%s%s", sep, data)
+		}
+	}
+	l.n++
+	return err
+}
+
+func (l *fileListWriter) close() error {
+	if l.format != "json" {
+		return nil
+	}
+	if l.n == 0 {
+		_, err := fmt.Fprintln(l.w, "[]")
+		return err
+	}
+	_, err := fmt.Fprintln(l.w, "]")
+	return err
+}
@@ -0,0 +1,179 @@
+package main
+
+// coordinator.go commits across every shard with a two phase commit. Each
+// shard prepares the commit, snapshotting the branch, and only once they all
+// have is the commit finalized everywhere. If any shard fails to prepare the
+// others are told to abort, so a commit either lands on every shard or on
+// none. An If-Match header is checked by every shard as it prepares, if any
+// shard's head has moved the commit is aborted with a 412. Shards also refuse
+// to finalize if their head moves between the phases, those shards abort and
+// the commit fails with a 412.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+// phaseResult is the outcome of one phase on one shard.
+type phaseResult struct {
+	body string
+	err  error
+}
+
+// preconditionError is returned when a shard rejects a request because its
+// If-Match precondition failed.
+type preconditionError struct {
+	error
+}
+
+// shardRequest sends a request to the shard at host, passing r's credentials
+// and preconditions through, and returns the body of the response.
+func shardRequest(r *http.Request, method, host, uri string) (string, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", strings.TrimPrefix(host, "http://"), uri), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		req.Header.Set("If-Match", match)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	err = fmt.Errorf("%s %s: %s", host, resp.Status, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return "", preconditionError{err}
+	}
+	if resp.StatusCode != 200 {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// runPhase sends phase to every host in parallel. Results are in the same
+// order as hosts.
+func runPhase(r *http.Request, hosts []string, phase string) []phaseResult {
+	values := r.URL.Query()
+	values.Set("phase", phase)
+	results := make([]phaseResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			results[i].body, results[i].err = shardRequest(r, "POST", host, "/commit?"+values.Encode())
+		}(i, host)
+	}
+	wg.Wait()
+	return results
+}
+
+// twoPhaseCommit commits on every host, r must name the commit.
+func twoPhaseCommit(r *http.Request, hosts []string) (commitMsg, error) {
+	commit := r.URL.Query().Get("commit")
+	var prepared []string
+	var prepareErr error
+	for i, result := range runPhase(r, hosts, "prepare") {
+		if result.err != nil {
+			log.Print(result.err)
+			if prepareErr == nil {
+				prepareErr = result.err
+			}
+		} else {
+			prepared = append(prepared, hosts[i])
+		}
+	}
+	if prepareErr != nil {
+		for i, result := range runPhase(r, prepared, "abort") {
+			if result.err != nil {
+				// The prepared snapshot leaks but the commit still won't
+				// happen, which is what matters.
+				log.Printf("Failed to abort %s on %s: %s", commit, prepared[i], result.err)
+			}
+		}
+		err := fmt.Errorf("Commit %s aborted, %d of %d shards failed to prepare: %s", commit, len(hosts)-len(prepared), len(hosts), prepareErr)
+		if _, ok := prepareErr.(preconditionError); ok {
+			return commitMsg{}, preconditionError{err}
+		}
+		return commitMsg{}, err
+	}
+
+	var bodies []io.Reader
+	var failed, moved []string
+	var finalizeErr error
+	for i, result := range runPhase(r, hosts, "finalize") {
+		if result.err != nil {
+			log.Print(result.err)
+			if _, ok := result.err.(preconditionError); ok {
+				moved = append(moved, hosts[i])
+			} else {
+				failed = append(failed, hosts[i])
+			}
+			if finalizeErr == nil {
+				finalizeErr = result.err
+			}
+			continue
+		}
+		bodies = append(bodies, bytes.NewReader([]byte(result.body)))
+	}
+	if len(moved) > 0 {
+		// Those shards were committed to between the phases, finalizing
+		// would orphan those commits so retrying won't help.
+		for i, result := range runPhase(r, moved, "abort") {
+			if result.err != nil {
+				log.Printf("Failed to abort %s on %s: %s", commit, moved[i], result.err)
+			}
+		}
+		return commitMsg{}, preconditionError{fmt.Errorf("Commit %s aborted on %s, their heads moved after it was prepared: %s",
+			commit, strings.Join(moved, ", "), finalizeErr)}
+	}
+	if finalizeErr != nil {
+		// Every shard prepared so the commit can still be finalized, the
+		// failed shards keep their prepared snapshots until it is.
+		return commitMsg{}, fmt.Errorf("Commit %s failed to finalize on %s, retry with POST /commit?phase=finalize&commit=%s: %s",
+			commit, strings.Join(failed, ", "), url.QueryEscape(commit), finalizeErr)
+	}
+	return mergeCommits(bodies)
+}
+
+// twoPhaseCommitHandler commits on every shard, r must name the commit.
+func twoPhaseCommitHandler(w http.ResponseWriter, r *http.Request) {
+	hosts, err := route.Endpoints("/pfs/master")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	msg, err := twoPhaseCommit(r, hosts)
+	if _, ok := err.(preconditionError); ok {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		log.Print(err)
+		return
+	}
+	w.Header().Set(tokenHeader, msg.Id)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+// failover.go health checks the primary of every shard. When a primary misses
+// failuresBeforeFailover checks in a row, a replica that has every commit
+// the primary was last seen with is promoted in its place and the old primary
+// is fenced, so that if it's still running it stops taking writes.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/discovery"
+)
+
+var healthCheckInterval = 10 * time.Second
+
+const failuresBeforeFailover = 3
+
+// peerToken is sent with the requests the router makes on its own, rather
+// than on behalf of a client.
+var peerToken = os.Getenv("PFS_PEER_TOKEN")
+
+// healthClient gives up on shards quickly, a hung primary counts as down.
+var healthClient = &http.Client{Timeout: 2 * time.Second}
+
+// roleMsg is what shards return for /admin/role.
+type roleMsg struct {
+	Shard   uint64 `json:"shard"`
+	Modulos uint64 `json:"modulos"`
+	Role    string `json:"role"`
+	Epoch   uint64 `json:"epoch"`
+	Commit  string `json:"commit"`
+}
+
+// routerCredentials returns a request carrying the router's credentials, for
+// use with shardRequest.
+func routerCredentials() *http.Request {
+	r := &http.Request{Header: make(http.Header)}
+	if peerToken != "" {
+		r.Header.Set("Authorization", "Bearer "+peerToken)
+	}
+	return r
+}
+
+func getRole(host string) (roleMsg, error) {
+	var msg roleMsg
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/admin/role", strings.TrimPrefix(host, "http://")), nil)
+	if err != nil {
+		return msg, err
+	}
+	req.Header = routerCredentials().Header
+	resp, err := healthClient.Do(req)
+	if err != nil {
+		return msg, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return msg, fmt.Errorf("%s %s", host, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	return msg, err
+}
+
+// shardHealth is what we know about a shard's primary.
+type shardHealth struct {
+	primary  string
+	failures int
+	// commit is the newest commit the primary was seen with.
+	commit string
+}
+
+// checkPrimaries checks every shard's primary once and fails over the ones
+// that have been down for too long.
+func checkPrimaries(health map[uint64]*shardHealth) {
+	modulos := clusterModulos()
+	for shard := uint64(0); shard < modulos; shard++ {
+		h, ok := health[shard]
+		if !ok {
+			h = &shardHealth{}
+			health[shard] = h
+		}
+		primary, ok := members.Master(shard, modulos)
+		if ok && primary != h.primary {
+			// A new primary, it starts with a clean slate.
+			h.primary = primary
+			h.failures = 0
+		}
+		checkReplicas(shard, modulos)
+		var err error
+		if ok {
+			var role roleMsg
+			if role, err = getRole(primary); err == nil && role.Role == discovery.RoleMaster {
+				h.failures = 0
+				h.commit = role.Commit
+				recordProgress(primary, role.Commit)
+				continue
+			}
+		}
+		h.failures++
+		if h.failures < failuresBeforeFailover {
+			continue
+		}
+		log.Printf("Primary %q of shard %d-%d is down (%v), failing over.", h.primary, shard, modulos, err)
+		if err := failover(shard, modulos, h.primary, h.commit); err != nil {
+			log.Print(err)
+			continue
+		}
+		h.failures = 0
+	}
+}
+
+// checkReplicas records how far along each of shard's replicas is.
+func checkReplicas(shard, modulos uint64) {
+	for _, replica := range members.Replicas(shard, modulos) {
+		role, err := getRole(replica)
+		if err != nil {
+			// Don't send reads to replicas we can't reach.
+			recordProgress(replica, "")
+			continue
+		}
+		recordProgress(replica, role.Commit)
+	}
+}
+
+// failover promotes a caught up replica of shard to primary and fences the
+// old primary.
+func failover(shard, modulos uint64, old, commit string) error {
+	promoted := ""
+	for _, replica := range members.Replicas(shard, modulos) {
+		role, err := getRole(replica)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if role.Commit == commit {
+			promoted = replica
+			break
+		}
+	}
+	if promoted == "" {
+		return fmt.Errorf("No replica of shard %d-%d has caught up to commit %q, not failing over.", shard, modulos, commit)
+	}
+	body, err := shardRequest(routerCredentials(), "POST", promoted, "/admin/promote")
+	if err != nil {
+		return err
+	}
+	var role roleMsg
+	if err := json.Unmarshal([]byte(body), &role); err != nil {
+		return err
+	}
+	log.Printf("Promoted %s to primary of shard %d-%d at epoch %d.", promoted, shard, modulos, role.Epoch)
+	if old != "" {
+		if _, err := shardRequest(routerCredentials(), "POST", old, fmt.Sprintf("/admin/fence?epoch=%d", role.Epoch)); err != nil {
+			// It's most likely down, replicas will refuse its pushes either way.
+			log.Printf("Failed to fence %s: %s", old, err)
+		}
+	}
+	return nil
+}
+
+// healthCheck checks primaries forever.
+func healthCheck() {
+	health := make(map[uint64]*shardHealth)
+	for {
+		checkPrimaries(health)
+		time.Sleep(healthCheckInterval)
+	}
+}
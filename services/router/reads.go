@@ -0,0 +1,151 @@
+package main
+
+// reads.go spreads reads of committed files, and lists of them, across each
+// shard's primary and its replicas. Commits never change once they're made,
+// so any replica that has the commit can answer; the health checker tracks the
+// newest commit each replica has. Reads of branches always go to the primary
+// since replicas don't see uncommitted writes.
+//
+// Clients that want to read their own writes pass the consistency token their
+// writes returned in the X-Pfs-Token header, a commit id. Those reads only go
+// to replicas that have the token's commit. The primary made the commit
+// unless there's been a failover since, so if the primary isn't known to have
+// it the read waits briefly for it to catch up.
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+// progress is the newest commit each replica, and primary, is known to have.
+var progress = struct {
+	sync.Mutex
+	commits map[string]string
+}{commits: make(map[string]string)}
+
+func recordProgress(host, commit string) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.commits[host] = commit
+}
+
+// generatedId matches the commit ids that btrfs.NewCommitId generates, they
+// sort in the order they were made.
+var generatedId = regexp.MustCompile(`^\d{8}T\d{6}\.\d{9}Z-`)
+
+// hasCommit returns true if host is known to have commit.
+func hasCommit(host, commit string) bool {
+	progress.Lock()
+	newest, ok := progress.commits[host]
+	progress.Unlock()
+	switch {
+	case !ok || newest == "":
+		return false
+	case commit == newest || commit == "t0":
+		return true
+	case generatedId.MatchString(commit) && generatedId.MatchString(newest):
+		return commit <= newest
+	}
+	return false
+}
+
+// tokenHeader carries consistency tokens.
+const tokenHeader = "X-Pfs-Token"
+
+var (
+	// tokenWait is how long a read waits for the primary to have its token
+	// before it's sent anyway.
+	tokenWait = 2 * time.Second
+	// tokenPoll is how often we check whether the primary has caught up.
+	tokenPoll = 100 * time.Millisecond
+)
+
+// awaitToken waits, up to tokenWait, for host to have the commit token. Only
+// generated commit ids can be waited for since they're the only ones we can
+// tell are older than the newest commit host has.
+func awaitToken(host, token string) {
+	deadline := time.Now().Add(tokenWait)
+	for !hasCommit(host, token) && generatedId.MatchString(token) && time.Now().Before(deadline) {
+		if role, err := getRole(host); err == nil {
+			recordProgress(host, role.Commit)
+			if hasCommit(host, token) {
+				return
+			}
+		}
+		time.Sleep(tokenPoll)
+	}
+}
+
+// nextRead picks which of the candidates serves the next read.
+var nextRead uint64
+
+// readFromReplica sends r, a GET of a file, to a replica if it's its turn and
+// returns true. It returns false if the read should go to the primary.
+func readFromReplica(w http.ResponseWriter, r *http.Request) bool {
+	commit := r.URL.Query().Get("commit")
+	token := r.Header.Get(tokenHeader)
+	if commit == "" && token == "" {
+		return false
+	}
+	modulos := clusterModulos()
+	shard := route.Owner(r.URL.Path, modulos)
+	primary, ok := members.Master(shard, modulos)
+	if !ok {
+		return false
+	}
+	if commit == "" {
+		awaitToken(primary, token)
+		return false
+	}
+	host := readHost(shard, modulos, primary, commit, token)
+	if host == primary {
+		return false
+	}
+	// If the replica can't answer after all the primary can.
+	route.RouteToHostsHttp(w, r, []string{host, primary})
+	return true
+}
+
+// readHost picks which of shard's primary and the replicas that have commit,
+// and token if there is one, serves the next read of commit.
+func readHost(shard, modulos uint64, primary, commit, token string) string {
+	candidates := []string{primary}
+	for _, replica := range members.Replicas(shard, modulos) {
+		if hasCommit(replica, commit) && (token == "" || hasCommit(replica, token)) {
+			candidates = append(candidates, replica)
+		}
+	}
+	host := candidates[atomic.AddUint64(&nextRead, 1)%uint64(len(candidates))]
+	if host == primary && token != "" {
+		awaitToken(primary, token)
+	}
+	return host
+}
+
+// listEndpoints picks the host that serves each shard's part of r, a GET
+// /list of ?commit=, the same way readFromReplica picks hosts for files. It
+// returns nil if the list should go to the primaries: lists of branches and
+// of holds, which replicas don't have, and lists while some shard has no
+// primary.
+func listEndpoints(r *http.Request) []string {
+	commit := r.URL.Query().Get("commit")
+	if commit == "" || r.URL.Query().Get("hold") != "" {
+		return nil
+	}
+	token := r.Header.Get(tokenHeader)
+	modulos := clusterModulos()
+	var endpoints []string
+	for shard := uint64(0); shard < modulos; shard++ {
+		primary, ok := members.Master(shard, modulos)
+		if !ok {
+			return nil
+		}
+		endpoints = append(endpoints, readHost(shard, modulos, primary, commit, token))
+	}
+	return endpoints
+}
@@ -0,0 +1,273 @@
+package main
+
+// reshard.go grows the cluster from M shards to N without reloading it:
+//
+//	GET  /reshard?modulos=N counts the files that would change shard
+//	POST /reshard?modulos=N moves the cluster to N shards
+//
+// The N new shards must already be running and registered as j-N. With
+// modulo placement N must be a multiple of M and each new shard pulls the
+// commits of the old shard that owned its files, (j%M)-M. With consistent
+// placement N can be anything bigger than M: the shards j < M pull j-M's
+// commits, since they keep a slice of its files, and the rest take only the
+// files they own from every old shard. Either way this happens while writes
+// carry on. Then writes are paused, everything written since is committed on
+// every branch of the old shards, the new shards catch up and the routing
+// table switches to N. The old shards can be stopped afterwards.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+// modulosKey is where the number of shards the cluster uses is kept once
+// it's been resharded, it overrides the number the router was started with.
+const modulosKey = "/pfs/modulos"
+
+func clusterModulos() uint64 {
+	return atomic.LoadUint64(&modulos)
+}
+
+func setModulos(n uint64) {
+	atomic.StoreUint64(&modulos, n)
+	members.SetModulos(n)
+}
+
+// watchModulos keeps modulos in sync with modulosKey so every router switches
+// when any of them reshards.
+func watchModulos(client *etcd.Client) {
+	for {
+		var index uint64
+		resp, err := client.Get(modulosKey, false, false)
+		if err == nil {
+			index = resp.EtcdIndex + 1
+			n, err := strconv.ParseUint(resp.Node.Value, 10, 64)
+			if err != nil || n == 0 {
+				log.Printf("Invalid %s: %s", modulosKey, resp.Node.Value)
+			} else if n != clusterModulos() {
+				log.Printf("Cluster now has %d shards.", n)
+				setModulos(n)
+			}
+		}
+		if _, err := client.Watch(modulosKey, index, false, nil, nil); err != nil {
+			log.Print(err)
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// writes is held for reading by every write that goes through the router,
+// resharding holds it for writing to pause them.
+var writes sync.RWMutex
+
+// gateWrites makes h wait while resharding pauses writes.
+func gateWrites(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writes.RLock()
+			defer writes.RUnlock()
+		}
+		h(w, r)
+	}
+}
+
+// resharding makes sure only one reshard runs at a time.
+var resharding sync.Mutex
+
+// reshardPlanMsg is what shards return for GET /reshard.
+type reshardPlanMsg struct {
+	Shard   uint64 `json:"shard"`
+	Modulos uint64 `json:"modulos"`
+	Files   int    `json:"files"`
+	Moving  int    `json:"moving"`
+}
+
+type reshardPlan struct {
+	Modulos uint64           `json:"modulos"`
+	Files   int              `json:"files"`
+	Moving  int              `json:"moving"`
+	Shards  []reshardPlanMsg `json:"shards"`
+}
+
+func mergePlans(bodies []io.Reader) (reshardPlan, error) {
+	var res reshardPlan
+	for _, body := range bodies {
+		var plan reshardPlanMsg
+		if err := json.NewDecoder(body).Decode(&plan); err != nil {
+			return res, err
+		}
+		res.Modulos = plan.Modulos
+		res.Files += plan.Files
+		res.Moving += plan.Moving
+		res.Shards = append(res.Shards, plan)
+	}
+	return res, nil
+}
+
+// masters returns the masters of every shard out of modulos, in order.
+func masters(modulos uint64) ([]string, error) {
+	var res []string
+	for i := uint64(0); i < modulos; i++ {
+		master, ok := members.Master(i, modulos)
+		if !ok {
+			return nil, fmt.Errorf("Shard %d-%d isn't registered.", i, modulos)
+		}
+		res = append(res, master)
+	}
+	return res, nil
+}
+
+// copyShards has every target pull from the source that owned its files, or
+// with consistent placement, take its files from every source if it's a new
+// shard.
+func copyShards(r *http.Request, sources, targets []string) error {
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for j, target := range targets {
+		wg.Add(1)
+		go func(j int, target string) {
+			defer wg.Done()
+			query := "?from=" + url.QueryEscape(sources[j%len(sources)])
+			if route.PlacementName() == "consistent" && j >= len(sources) {
+				query = "?" + url.Values{"take": sources}.Encode()
+			}
+			_, errs[j] = shardRequest(r, "POST", target, "/reshard"+query)
+		}(j, target)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// branchHosts returns the branches on hosts, each with the hosts that have
+// it.
+func branchHosts(r *http.Request, hosts []string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, host := range hosts {
+		body, err := shardRequest(r, "GET", host, "/branch")
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(strings.NewReader(body))
+		for {
+			var branch struct {
+				Name string `json:"name"`
+			}
+			if err := decoder.Decode(&branch); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			res[branch.Name] = append(res[branch.Name], host)
+		}
+	}
+	return res, nil
+}
+
+// commitBranches commits every branch on sources.
+func commitBranches(r *http.Request, sources []string) error {
+	branches, err := branchHosts(r, sources)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range branches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		query := url.Values{"commit": {btrfs.NewCommitId()}, "branch": {name}}
+		commit, err := http.NewRequest("POST", "/commit?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		commit.Header.Set("Authorization", r.Header.Get("Authorization"))
+		if _, err := twoPhaseCommit(commit, branches[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reshard moves the cluster to n shards.
+func reshard(r *http.Request, n uint64) error {
+	sources, err := masters(clusterModulos())
+	if err != nil {
+		return err
+	}
+	targets, err := masters(n)
+	if err != nil {
+		return err
+	}
+	log.Printf("Resharding from %d to %d shards.", len(sources), len(targets))
+	if err := copyShards(r, sources, targets); err != nil {
+		return err
+	}
+
+	writes.Lock()
+	defer writes.Unlock()
+	// Writes since the first copy are only in the old shards' branches, we
+	// commit every branch so that the catch up copy picks them up.
+	if err := commitBranches(r, sources); err != nil {
+		return err
+	}
+	if err := copyShards(r, sources, targets); err != nil {
+		return err
+	}
+	if _, err := etcdClient.Set(modulosKey, fmt.Sprint(n), 0); err != nil {
+		return err
+	}
+	setModulos(n)
+	log.Printf("Resharded to %d shards.", n)
+	return nil
+}
+
+func reshardHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseUint(r.URL.Query().Get("modulos"), 10, 64)
+	if err != nil || n == 0 {
+		http.Error(w, fmt.Sprintf("Invalid modulos %s.", r.URL.Query().Get("modulos")), 400)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		fanoutHttp(w, r, func(bodies []io.Reader) (interface{}, error) { return mergePlans(bodies) })
+	case "POST":
+		resharding.Lock()
+		defer resharding.Unlock()
+		m := clusterModulos()
+		if route.PlacementName() == "consistent" && n <= m {
+			http.Error(w, fmt.Sprintf("The cluster has %d shards, it can only grow.", m), 400)
+			return
+		}
+		if route.PlacementName() != "consistent" && (n <= m || n%m != 0) {
+			http.Error(w, fmt.Sprintf("The cluster has %d shards, it can only grow to a multiple of that.", m), 400)
+			return
+		}
+		if err := reshard(r, n); err != nil {
+			http.Error(w, err.Error(), 500)
+			log.Print(err)
+			return
+		}
+		fmt.Fprintf(w, "Resharded to %d shards.\n", n)
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
@@ -1,52 +1,153 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 
-	"code.google.com/p/go-uuid/uuid"
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/discovery"
 	"github.com/pachyderm/pfs/lib/route"
 )
 
 var modulos uint64
 
+// rules are applied to every request before it's routed, nil means no rules.
+var rules *route.Rules
+
+var etcdClient = etcd.NewClient([]string{"http://172.17.42.1:4001", "http://10.1.42.1:4001"})
+
+// members is the cluster's membership, it's kept up to date by watching etcd.
+var members = discovery.NewTable()
+
 func RouterMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
 	fileHandler := func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.URL.Path, "*") {
+		if canary := rules.Apply(r); canary != "" {
+			route.RouteToHostHttp(w, r, canary)
+		} else if strings.Contains(r.URL.Path, "*") {
 			route.MulticastHttp(w, r, "/pfs/master")
+		} else if shouldStripe(r) {
+			writeStriped(w, r)
+		} else if r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/history") {
+			// History is served by the shard that owns the file.
+			master, err := route.Master(strings.TrimSuffix(r.URL.Path, "/history"), "/pfs/master", clusterModulos())
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			route.RouteToHostHttp(w, r, master)
 		} else {
-			route.RouteHttp(w, r, "/pfs/master", modulos)
+			// The file may turn out to be striped.
+			sw := newStripeWriter(w)
+			if r.Method != "GET" || !readFromReplica(sw, r) {
+				route.RouteHttp(sw, r, "/pfs/master", clusterModulos())
+			}
+			sw.finish(r)
 		}
 	}
 	commitHandler := func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
+		// Every shard needs to use the same name for the commit so we pick
+		// it here.
+		if r.Method == "POST" && r.URL.Query().Get("commit") == "" {
 			values := r.URL.Query()
-			values.Add("commit", uuid.New())
+			values.Set("commit", btrfs.NewCommitId())
 			r.URL.RawQuery = values.Encode()
 		}
-		route.MulticastHttp(w, r, "/pfs/master")
+		switch {
+		case r.Method == "GET":
+			commitLogHandler(w, r)
+		case r.Method == "POST" && r.ContentLength == 0 && r.URL.Query().Get("phase") == "":
+			twoPhaseCommitHandler(w, r)
+		default:
+			route.MulticastHttp(w, r, "/pfs/master")
+		}
 	}
 	branchHandler := func(w http.ResponseWriter, r *http.Request) {
-		route.MulticastHttp(w, r, "/pfs/master")
+		if r.Method == "GET" {
+			listHandler(w, r)
+		} else {
+			route.MulticastHttp(w, r, "/pfs/master")
+		}
 	}
 	jobHandler := func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = rules.RewritePath(r.URL.Path)
+		route.MulticastHttp(w, r, "/pfs/master")
+	}
+	// Every shard runs pipelines over the files it has, so pipelines are
+	// registered with all of them and reads of their outputs are merged.
+	pipelineHandler := func(w http.ResponseWriter, r *http.Request) {
+		route.MulticastHttp(w, r, "/pfs/master")
+	}
+	// A file's content is all on the shard that owns it.
+	filediffHandler := func(w http.ResponseWriter, r *http.Request) {
+		key := path.Join("/file", r.URL.Query().Get("path"))
+		master, err := route.Master(key, "/pfs/master", clusterModulos())
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		route.RouteToHostHttp(w, r, master)
+	}
+	// Every shard tells webhooks about its own commits.
+	webhookHandler := func(w http.ResponseWriter, r *http.Request) {
+		route.MulticastHttp(w, r, "/pfs/master")
+	}
+	// Every shard has its own piece of each repo to configure, measure and
+	// check.
+	repoHandler := func(w http.ResponseWriter, r *http.Request) {
 		route.MulticastHttp(w, r, "/pfs/master")
 	}
 	materializeHandler := func(w http.ResponseWriter, r *http.Request) {
 		route.MulticastHttp(w, r, "/pfs/master")
 	}
+	// Every shard has its own piece of each commit so they're all tagged.
+	tagHandler := func(w http.ResponseWriter, r *http.Request) {
+		route.MulticastHttp(w, r, "/pfs/master")
+	}
 
-	mux.HandleFunc("/file/", fileHandler)
-	mux.HandleFunc("/commit", commitHandler)
-	mux.HandleFunc("/branch", branchHandler)
-	mux.HandleFunc("/job/", jobHandler)
+	mux.HandleFunc("/file/", gateWrites(fileHandler))
+	mux.HandleFunc("/commit", gateWrites(commitHandler))
+	mux.HandleFunc("/branch", gateWrites(branchHandler))
+	mux.HandleFunc("/diff", diffHandler)
+	mux.HandleFunc("/du", repoHandler)
+	mux.HandleFunc("/filediff", filediffHandler)
+	mux.HandleFunc("/fsck", repoHandler)
+	mux.HandleFunc("/head", headHandler)
+	mux.HandleFunc("/hold", holdHandler)
+	mux.HandleFunc("/hold/", holdHandler)
+	mux.HandleFunc("/job", gateWrites(jobHandler))
+	mux.HandleFunc("/job/", gateWrites(jobHandler))
+	mux.HandleFunc("/limits", repoHandler)
+	mux.HandleFunc("/list", fileListHandler)
 	mux.HandleFunc("/materialize", materializeHandler)
+	mux.HandleFunc("/pipeline", gateWrites(pipelineHandler))
+	mux.HandleFunc("/pipeline/", gateWrites(pipelineHandler))
+	mux.HandleFunc("/provenance", pipelineHandler)
+	mux.HandleFunc("/repo", repoHandler)
+	mux.HandleFunc("/repo/", repoHandler)
+	mux.HandleFunc("/reshard", reshardHandler)
+	mux.HandleFunc("/tag", gateWrites(tagHandler))
+	mux.HandleFunc("/tag/", gateWrites(tagHandler))
+	mux.HandleFunc("/webhook", webhookHandler)
+	mux.HandleFunc("/webhook/", webhookHandler)
+	mux.HandleFunc("/members", func(w http.ResponseWriter, r *http.Request) {
+		res := members.Members()
+		if res == nil {
+			res = []discovery.Member{}
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Print(err)
+		}
+	})
+	mux.HandleFunc("/topology", topologyHandler)
 	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "pong\n") })
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Welcome to pfs!\n")
@@ -55,6 +156,24 @@ func RouterMux() *http.ServeMux {
 	return mux
 }
 
+// topologyMsg tells clients where files are, so that they can read from
+// shards directly when routers can't answer.
+type topologyMsg struct {
+	Modulos   uint64             `json:"modulos"`
+	Placement string             `json:"placement"`
+	Members   []discovery.Member `json:"members"`
+}
+
+func topologyHandler(w http.ResponseWriter, r *http.Request) {
+	msg := topologyMsg{Modulos: clusterModulos(), Placement: route.PlacementName(), Members: members.Members()}
+	if msg.Members == nil {
+		msg.Members = []discovery.Member{}
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		log.Print(err)
+	}
+}
+
 func main() {
 	log.SetFlags(log.Lshortfile)
 	log.Print("Starting up...")
@@ -63,7 +182,31 @@ func main() {
 	modulos, err = strconv.ParseUint(os.Args[1], 10, 32)
 
 	if err != nil {
-		log.Fatalf("Failed to parse %s as Uint.")
+		log.Fatalf("Failed to parse %s as Uint.", os.Args[1])
+	}
+	if err := route.SetPlacement(os.Getenv("PFS_PLACEMENT")); err != nil {
+		log.Fatal(err)
+	}
+	if size := os.Getenv("PFS_STRIPE_SIZE"); size != "" {
+		stripeSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			log.Fatalf("Failed to parse PFS_STRIPE_SIZE %s as Int.", size)
+		}
+	}
+	// An optional second argument names a rules file.
+	if len(os.Args) > 2 {
+		rules, err = route.LoadRules(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	setModulos(modulos)
+	if err := members.Load(etcdClient); err != nil {
+		log.Print(err)
 	}
+	go members.Watch(etcdClient, nil)
+	go watchModulos(etcdClient)
+	go healthCheck()
+	route.UseMembers(members)
 	log.Fatal(http.ListenAndServe(":80", RouterMux()))
 }
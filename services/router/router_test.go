@@ -3,16 +3,24 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/discovery"
 	"github.com/pachyderm/pfs/lib/mapreduce"
+	"github.com/pachyderm/pfs/lib/route"
+	"github.com/pachyderm/pfs/lib/stripe"
 )
 
 var KB int64 = 1 << 10
@@ -192,3 +200,552 @@ func Benchmark_1_GB_x_100_MB(b *testing.B) {
 func Benchmark_10_GB_x_500_MB(b *testing.B) {
 	_BenchmarkTraffic(500*MB, 10*GB, b)
 }
+
+// TestAPISpec checks that everything in the API spec, which clients are
+// generated from, is routed.
+func TestAPISpec(t *testing.T) {
+	data, err := ioutil.ReadFile("../../spec/api.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	mux := RouterMux()
+	for p, methods := range spec.Paths {
+		for method := range methods {
+			if method == "parameters" {
+				continue
+			}
+			req, err := http.NewRequest(strings.ToUpper(method), strings.Replace(p, "{file}", "dir/file", 1), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// "/" is the welcome page that everything else falls through to.
+			if _, pattern := mux.Handler(req); pattern == "/" || pattern == "" {
+				t.Errorf("%s %s isn't routed.", strings.ToUpper(method), p)
+			}
+		}
+	}
+}
+
+func TestMergeLists(t *testing.T) {
+	bodies := []io.Reader{
+		strings.NewReader(`{"name":"commit2","tstamp":"2015-01-02T00:00:00Z"}` + "\n" + `{"name":"commit1","tstamp":"2015-01-01T00:00:00Z"}` + "\n"),
+		strings.NewReader(`{"name":"commit3","tstamp":"2015-01-03T00:00:00Z"}` + "\n" + `{"name":"commit1","tstamp":"2015-01-01T00:00:01Z"}` + "\n"),
+	}
+	list, err := mergeLists(bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range list {
+		names = append(names, entry["name"].(string))
+	}
+	if strings.Join(names, ",") != "commit3,commit2,commit1" {
+		t.Fatalf("Merged list in wrong order: %v", names)
+	}
+}
+
+func TestMergeDiffs(t *testing.T) {
+	files, err := mergeDiffs([]io.Reader{strings.NewReader(`["b","d"]`), strings.NewReader(`["a","c"]`)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "a,b,c,d" {
+		t.Fatalf("Bad merged diff: %v", files)
+	}
+	files, err = mergeDiffs([]io.Reader{strings.NewReader("b\n"), strings.NewReader("a\n")}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "a,b" {
+		t.Fatalf("Bad merged diff: %v", files)
+	}
+}
+
+func TestMergeCommits(t *testing.T) {
+	msg, err := mergeCommits([]io.Reader{
+		strings.NewReader(`{"id":"commit1","branch":"master","parent":"t0","tstamp":"2015-01-01T00:00:00Z","files":2}`),
+		strings.NewReader(`{"id":"commit1","branch":"master","parent":"t0","tstamp":"2015-01-01T00:00:00Z","files":3}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != "commit1" || msg.Files != 5 || msg.Shards != 2 {
+		t.Fatalf("Bad merged commit: %+v", msg)
+	}
+}
+
+func TestMergePlans(t *testing.T) {
+	plan, err := mergePlans([]io.Reader{
+		strings.NewReader(`{"shard":0,"modulos":4,"files":10,"moving":5}`),
+		strings.NewReader(`{"shard":1,"modulos":4,"files":6,"moving":3}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Modulos != 4 || plan.Files != 16 || plan.Moving != 8 || len(plan.Shards) != 2 {
+		t.Fatalf("Bad merged plan: %+v", plan)
+	}
+}
+
+// fakeShard answers /admin/role with commit and counts promotions.
+func fakeShard(commit string, promotions *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := roleMsg{Role: discovery.RoleReplica, Commit: commit}
+		if r.URL.Path == "/admin/promote" {
+			atomic.AddInt32(promotions, 1)
+			role.Role = discovery.RoleMaster
+			role.Epoch = 2
+		}
+		json.NewEncoder(w).Encode(role)
+	}))
+}
+
+func TestFailover(t *testing.T) {
+	members = discovery.NewTable()
+	setModulos(1)
+	defer setModulos(0)
+	var stalePromotions, caughtUpPromotions int32
+	stale := fakeShard("commit1", &stalePromotions)
+	defer stale.Close()
+	caughtUp := fakeShard("commit2", &caughtUpPromotions)
+	defer caughtUp.Close()
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primary.Close()
+
+	for _, m := range []discovery.Member{
+		{Shard: 0, Modulos: 1, Address: primary.URL, Role: discovery.RoleMaster, Epoch: 1},
+		{Shard: 0, Modulos: 1, Address: stale.URL, Role: discovery.RoleReplica},
+		{Shard: 0, Modulos: 1, Address: caughtUp.URL, Role: discovery.RoleReplica},
+	} {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members.Apply(&etcd.Response{Action: "set", Node: &etcd.Node{Key: discovery.Key(m), Value: string(data)}})
+	}
+
+	// The primary was last seen with commit2.
+	health := map[uint64]*shardHealth{0: {primary: primary.URL, commit: "commit2"}}
+	for i := 0; i < failuresBeforeFailover-1; i++ {
+		checkPrimaries(health)
+	}
+	if n := atomic.LoadInt32(&caughtUpPromotions); n != 0 {
+		t.Fatalf("Failed over after %d failed checks.", failuresBeforeFailover-1)
+	}
+	checkPrimaries(health)
+	if n := atomic.LoadInt32(&caughtUpPromotions); n != 1 {
+		t.Fatalf("Expected the caught up replica to be promoted once, it was promoted %d times.", n)
+	}
+	if n := atomic.LoadInt32(&stalePromotions); n != 0 {
+		t.Fatal("The replica that's behind was promoted.")
+	}
+}
+
+func TestHasCommit(t *testing.T) {
+	recordProgress("replica", "20150102T000000.000000000Z-aBcDeFgH")
+	for commit, expected := range map[string]bool{
+		"20150101T000000.000000000Z-aBcDeFgH": true,
+		"20150102T000000.000000000Z-aBcDeFgH": true,
+		"20150103T000000.000000000Z-aBcDeFgH": false,
+		"t0":                                  true,
+		"master":                              false,
+	} {
+		if hasCommit("replica", commit) != expected {
+			t.Errorf("hasCommit(replica, %s) should be %t.", commit, expected)
+		}
+	}
+	if hasCommit("unknown", "t0") {
+		t.Error("Replicas we know nothing about shouldn't get reads.")
+	}
+}
+
+func TestReadFromReplica(t *testing.T) {
+	members = discovery.NewTable()
+	setModulos(1)
+	defer setModulos(0)
+	var replicaReads int32
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&replicaReads, 1)
+		io.WriteString(w, "foo")
+	}))
+	defer replica.Close()
+	for _, m := range []discovery.Member{
+		{Shard: 0, Modulos: 1, Address: "http://primary:80", Role: discovery.RoleMaster},
+		{Shard: 0, Modulos: 1, Address: replica.URL, Role: discovery.RoleReplica},
+	} {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members.Apply(&etcd.Response{Action: "set", Node: &etcd.Node{Key: discovery.Key(m), Value: string(data)}})
+	}
+	recordProgress(replica.URL, "20150102T000000.000000000Z-aBcDeFgH")
+
+	read := func(commit string) bool {
+		r, err := http.NewRequest("GET", "/file/foo?commit="+commit, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return readFromReplica(httptest.NewRecorder(), r)
+	}
+	toReplica := 0
+	for i := 0; i < 4; i++ {
+		if read("20150101T000000.000000000Z-aBcDeFgH") {
+			toReplica++
+		}
+	}
+	if toReplica != 2 || atomic.LoadInt32(&replicaReads) != 2 {
+		t.Fatalf("Expected 2 of 4 reads to go to the replica, %d did.", toReplica)
+	}
+	for i := 0; i < 4; i++ {
+		if read("master") || read("20150103T000000.000000000Z-aBcDeFgH") {
+			t.Fatal("Reads the replica can't answer went to the replica.")
+		}
+	}
+}
+
+func TestMergeCommitLog(t *testing.T) {
+	entries, err := mergeCommitLog([]io.Reader{
+		strings.NewReader(`{"name":"commit2","tstamp":"2015-01-02T00:00:00Z"}` + "\n" + `{"name":"commit1","tstamp":"2015-01-01T00:00:00Z"}`),
+		strings.NewReader(`{"name":"commit1","tstamp":"2015-01-01T00:00:00Z"}`),
+	}, []string{"shard0", "shard1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 commits, got %+v.", entries)
+	}
+	if entries[0].Name != "commit2" || entries[0].Shards != 1 || strings.Join(entries[0].Missing, ",") != "shard1" {
+		t.Errorf("Bad entry for commit2: %+v.", entries[0])
+	}
+	if entries[1].Name != "commit1" || entries[1].Shards != 2 || entries[1].Missing != nil {
+		t.Errorf("Bad entry for commit1: %+v.", entries[1])
+	}
+}
+
+func TestMergeHeads(t *testing.T) {
+	head, err := mergeHeads([]io.Reader{
+		strings.NewReader(`{"branch":"master","commit":"commit1"}`),
+		strings.NewReader(`{"branch":"master","commit":"commit1"}`),
+	})
+	if err != nil || head.Commit != "commit1" {
+		t.Fatalf("Expected commit1, got %+v, %v.", head, err)
+	}
+	_, err = mergeHeads([]io.Reader{
+		strings.NewReader(`{"branch":"master","commit":"commit1"}`),
+		strings.NewReader(`{"branch":"master","commit":"commit2"}`),
+	})
+	if !errors.Is(err, errHeadsDiffer) {
+		t.Fatalf("Expected errHeadsDiffer, got %v.", err)
+	}
+}
+
+func TestMergeHolds(t *testing.T) {
+	holds, err := mergeHolds([]io.Reader{
+		strings.NewReader(`{"id":"b","commit":"commit1","expires":"2026-01-01T10:05:00-07:00"}
+{"id":"a","commit":"commit1","expires":"2026-01-01T10:00:00-07:00"}
+{"id":"c","commit":"commit1","expires":"2026-01-01T10:00:00-07:00"}
+`),
+		// An earlier expiry in a different time zone.
+		strings.NewReader(`{"id":"a","commit":"commit1","expires":"2026-01-01T16:59:00Z"}
+{"id":"b","commit":"commit1","expires":"2026-01-01T10:05:00-07:00"}
+`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c is dropped, it's only held on one shard.
+	if len(holds) != 2 || holds[0].Id != "a" || holds[0].Expires != "2026-01-01T16:59:00Z" || holds[1].Id != "b" {
+		t.Fatalf("Unexpected holds %+v.", holds)
+	}
+}
+
+func TestTwoPhaseCommitPrecondition(t *testing.T) {
+	var phases []string
+	var lock sync.Mutex
+	shard := func(head string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			phases = append(phases, r.URL.Query().Get("phase"))
+			lock.Unlock()
+			if r.URL.Query().Get("phase") == "prepare" && r.Header.Get("If-Match") != head {
+				http.Error(w, "Head moved.", http.StatusPreconditionFailed)
+			}
+		}))
+	}
+	current, moved := shard("t0"), shard("commit1")
+	defer current.Close()
+	defer moved.Close()
+
+	r, err := http.NewRequest("POST", "/commit?branch=master&commit=commit2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("If-Match", "t0")
+	_, err = twoPhaseCommit(r, []string{current.URL, moved.URL})
+	if _, ok := err.(preconditionError); !ok {
+		t.Fatalf("Expected a precondition error, got: %v", err)
+	}
+	for _, phase := range phases {
+		if phase == "finalize" {
+			t.Fatal("A commit whose precondition failed was finalized.")
+		}
+	}
+}
+
+func TestTwoPhaseCommitHeadMoved(t *testing.T) {
+	var aborted int32
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("phase") {
+		case "finalize":
+			http.Error(w, "Head moved.", http.StatusPreconditionFailed)
+		case "abort":
+			atomic.AddInt32(&aborted, 1)
+		}
+	}))
+	defer shard.Close()
+
+	r, err := http.NewRequest("POST", "/commit?branch=master&commit=commit2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = twoPhaseCommit(r, []string{shard.URL})
+	if _, ok := err.(preconditionError); !ok {
+		t.Fatalf("Expected a precondition error, got: %v", err)
+	}
+	if atomic.LoadInt32(&aborted) != 1 {
+		t.Fatal("A commit that couldn't be finalized wasn't aborted.")
+	}
+}
+
+func TestReshardCommitsEveryBranch(t *testing.T) {
+	var lock sync.Mutex
+	finalized := make(map[string][]string)
+	fake := func(name string, branches ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/branch":
+				for _, branch := range branches {
+					json.NewEncoder(w).Encode(map[string]string{"name": branch})
+				}
+			case r.URL.Query().Get("phase") == "finalize":
+				lock.Lock()
+				finalized[name] = append(finalized[name], r.URL.Query().Get("branch"))
+				lock.Unlock()
+				io.WriteString(w, `{"id": "commit"}`)
+			}
+		}))
+	}
+	a, b := fake("a", "master", "other"), fake("b", "master")
+	defer a.Close()
+	defer b.Close()
+
+	r, err := http.NewRequest("POST", "/reshard?modulos=4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commitBranches(r, []string{a.URL, b.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(finalized["a"], " ") != "master other" || strings.Join(finalized["b"], " ") != "master" {
+		t.Fatalf("Committed the wrong branches: %v.", finalized)
+	}
+}
+
+func TestReadFromReplicaWithToken(t *testing.T) {
+	members = discovery.NewTable()
+	setModulos(1)
+	defer setModulos(0)
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "foo")
+	}))
+	defer replica.Close()
+	for _, m := range []discovery.Member{
+		{Shard: 0, Modulos: 1, Address: "http://primary:80", Role: discovery.RoleMaster},
+		{Shard: 0, Modulos: 1, Address: replica.URL, Role: discovery.RoleReplica},
+	} {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members.Apply(&etcd.Response{Action: "set", Node: &etcd.Node{Key: discovery.Key(m), Value: string(data)}})
+	}
+	recordProgress(replica.URL, "20150102T000000.000000000Z-aBcDeFgH")
+	recordProgress("http://primary:80", "20150103T000000.000000000Z-aBcDeFgH")
+
+	read := func(token string) bool {
+		r, err := http.NewRequest("GET", "/file/foo?commit=20150101T000000.000000000Z-aBcDeFgH", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(tokenHeader, token)
+		return readFromReplica(httptest.NewRecorder(), r)
+	}
+	toReplica := 0
+	for i := 0; i < 4; i++ {
+		if read("20150102T000000.000000000Z-aBcDeFgH") {
+			toReplica++
+		}
+	}
+	if toReplica != 2 {
+		t.Fatalf("Expected 2 of 4 reads to go to the replica, %d did.", toReplica)
+	}
+	for i := 0; i < 4; i++ {
+		if read("20150103T000000.000000000Z-aBcDeFgH") {
+			t.Fatal("A read went to a replica that doesn't have its token.")
+		}
+	}
+}
+
+// stripeShard is a fake shard that stores files, and stripes of files, in
+// memory.
+func stripeShard() *httptest.Server {
+	var lock sync.Mutex
+	files := make(map[string][]byte)
+	marks := make(map[string]string)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		key := r.URL.Path + "#" + r.URL.Query().Get(stripe.Param)
+		switch r.Method {
+		case "POST":
+			data, _ := ioutil.ReadAll(r.Body)
+			files[key] = data
+			marks[key] = r.Header.Get(stripe.Header)
+		case "GET", "DELETE":
+			data, ok := files[key]
+			if !ok {
+				http.Error(w, "404 page not found", 404)
+				return
+			}
+			if marks[key] != "" {
+				w.Header().Set(stripe.Header, marks[key])
+			}
+			if r.Method == "DELETE" {
+				delete(files, key)
+				io.WriteString(w, "Deleted.\n")
+				return
+			}
+			w.Write(data)
+		}
+	}))
+}
+
+func TestListEndpoints(t *testing.T) {
+	members = discovery.NewTable()
+	setModulos(1)
+	defer setModulos(0)
+	for _, m := range []discovery.Member{
+		{Shard: 0, Modulos: 1, Address: "http://primary:80", Role: discovery.RoleMaster},
+		{Shard: 0, Modulos: 1, Address: "http://replica:80", Role: discovery.RoleReplica},
+	} {
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members.Apply(&etcd.Response{Action: "set", Node: &etcd.Node{Key: discovery.Key(m), Value: string(data)}})
+	}
+	recordProgress("http://replica:80", "20150102T000000.000000000Z-aBcDeFgH")
+
+	endpoints := func(query string) []string {
+		r, err := http.NewRequest("GET", "/list?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return listEndpoints(r)
+	}
+	toReplica := 0
+	for i := 0; i < 4; i++ {
+		e := endpoints("commit=20150101T000000.000000000Z-aBcDeFgH")
+		if len(e) != 1 {
+			t.Fatalf("Expected 1 endpoint, got %v.", e)
+		}
+		if e[0] == "http://replica:80" {
+			toReplica++
+		}
+	}
+	if toReplica != 2 {
+		t.Fatalf("Expected 2 of 4 lists to go to the replica, %d did.", toReplica)
+	}
+	for _, query := range []string{"", "commit=master", "commit=20150103T000000.000000000Z-aBcDeFgH"} {
+		for i := 0; i < 4; i++ {
+			if e := endpoints(query); e != nil && e[0] != "http://primary:80" {
+				t.Fatalf("List with %q went to %v.", query, e)
+			}
+		}
+	}
+	if e := endpoints("commit=20150101T000000.000000000Z-aBcDeFgH&hold=h"); e != nil {
+		t.Fatalf("List of a hold went to %v.", e)
+	}
+}
+
+func TestStripes(t *testing.T) {
+	members = discovery.NewTable()
+	setModulos(2)
+	defer setModulos(0)
+	shards := []*httptest.Server{stripeShard(), stripeShard()}
+	for i, shard := range shards {
+		defer shard.Close()
+		data, err := json.Marshal(discovery.Member{Shard: uint64(i), Modulos: 2, Address: shard.URL, Role: discovery.RoleMaster})
+		if err != nil {
+			t.Fatal(err)
+		}
+		members.Apply(&etcd.Response{Action: "set", Node: &etcd.Node{Key: discovery.Key(discovery.Member{Shard: uint64(i), Modulos: 2, Address: shard.URL}), Value: string(data)}})
+	}
+	route.UseMembers(members)
+	defer route.UseMembers(nil)
+	stripeSize = 10
+	defer func() { stripeSize = 0 }()
+	router := httptest.NewServer(RouterMux())
+	defer router.Close()
+
+	data := strings.Repeat("0123456789", 9) + "abc"
+	resp, err := http.Post(router.URL+"/file/big", "application/text", strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Striped write failed: %s.", resp.Status)
+	}
+	resp, err = http.Get(router.URL + "/file/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != data {
+		t.Fatalf("Read %q, expected %q.", read, data)
+	}
+
+	req, err := http.NewRequest("DELETE", router.URL+"/file/big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("Delete failed: %s.", resp.Status)
+	}
+	for i := 0; i < 10; i++ {
+		stripeReq, err := http.NewRequest("GET", "/file/big", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getStripe(stripeReq, i, 10); err == nil {
+			t.Fatalf("Stripe %d wasn't deleted.", i)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+// stripes.go stripes big files across shards, see lib/stripe. When
+// PFS_STRIPE_SIZE is set files posted with a Content-Length bigger than it
+// are cut in to stripes of that size, which are written to the shards that
+// own them, and then the file's manifest is written to the shard that owns
+// the file. Shards mark responses that carry a manifest, so reads of a
+// striped file are reassembled here, fetching several stripes at once, and
+// deletes remove the stripes as well as the manifest.
+//
+// Stripes are written as plain overwrites so retrying a striped write is
+// safe; only the manifest write is tagged with the request's id. Checksums
+// sent with a striped write are checked here, as the file's cut up.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pachyderm/pfs/lib/checksum"
+	"github.com/pachyderm/pfs/lib/route"
+	"github.com/pachyderm/pfs/lib/stripe"
+)
+
+// stripeSize is the size of the stripes big files are cut in to, 0 means
+// files aren't striped.
+var stripeSize int64
+
+// stripeParallelism is how many stripes of a file are written or read at
+// once, it bounds how much of a file the router holds in memory.
+var stripeParallelism = 4
+
+// shouldStripe returns true if r is a write of a file big enough to stripe.
+func shouldStripe(r *http.Request) bool {
+	if stripeSize <= 0 || r.Method != "POST" || r.ContentLength <= stripeSize {
+		return false
+	}
+	// Resumable uploads are assembled by the shard that owns the file.
+	_, uploads := r.URL.Query()["uploads"]
+	return !uploads && r.URL.Query().Get("uploadId") == ""
+}
+
+// newFileRequest returns a request for the file in r, with values as its
+// query, to the shard that owns key. r's credentials and preconditions are
+// passed through.
+func newFileRequest(r *http.Request, method, key string, values url.Values, body []byte) (*http.Request, error) {
+	host, err := route.Master(key, "/pfs/master", clusterModulos())
+	if err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("http://%s%s?%s", strings.TrimPrefix(host, "http://"), r.URL.Path, values.Encode())
+	req, err := http.NewRequest(method, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range []string{"Authorization", "If-Match"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	return req, nil
+}
+
+// stripeRequest sends a request for stripe i of the file in r to the shard
+// that owns it. It isn't tagged with r's id since several stripes may go to
+// the same shard.
+func stripeRequest(r *http.Request, method string, i int, body []byte) (*http.Response, error) {
+	values := r.URL.Query()
+	values.Del("tag")
+	values.Set(stripe.Param, strconv.Itoa(i))
+	req, err := newFileRequest(r, method, stripe.Key(r.URL.Path, i), values, body)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// stripeError is a stripe request that a shard failed.
+type stripeError struct {
+	status int
+	msg    string
+}
+
+func (e stripeError) Error() string {
+	return e.msg
+}
+
+// checkStripe returns an error if resp isn't a success, closing it.
+func checkStripe(resp *http.Response, i int) error {
+	if resp.StatusCode == 200 {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return stripeError{resp.StatusCode, fmt.Sprintf("Stripe %d failed (%s): %s", i, resp.Status, strings.TrimSpace(string(body)))}
+}
+
+// putStripe writes stripe i of the file in r.
+func putStripe(r *http.Request, i int, data []byte) error {
+	resp, err := stripeRequest(r, "POST", i, data)
+	if err != nil {
+		return err
+	}
+	if err := checkStripe(resp, i); err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// getStripe reads stripe i, which should be size bytes, of the file in r.
+func getStripe(r *http.Request, i int, size int64) ([]byte, error) {
+	resp, err := stripeRequest(r, "GET", i, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStripe(resp, i); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("Stripe %d of %s is %d bytes, expected %d.", i, r.URL.Path, len(data), size)
+	}
+	return data, nil
+}
+
+// writeStriped writes the file in r, a POST, as stripes and then writes its
+// manifest. The manifest isn't written if the file doesn't match the
+// checksums r was sent with.
+func writeStriped(w http.ResponseWriter, r *http.Request) {
+	body, err := checksum.NewReader(r.Body, r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	m := stripe.Manifest{Size: r.ContentLength, StripeSize: stripeSize}
+	values := r.URL.Query()
+	values.Set(stripe.SizeParam, strconv.FormatInt(m.Size, 10))
+	r.URL.RawQuery = values.Encode()
+	sem := make(chan struct{}, stripeParallelism)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for i := 0; i < m.Stripes() && !failed(); i++ {
+		sem <- struct{}{}
+		data := make([]byte, m.StripeLen(i))
+		if _, err := io.ReadFull(body, data); err != nil {
+			<-sem
+			fail(stripeError{400, fmt.Sprintf("Reading stripe %d: %s", i, err.Error())})
+			break
+		}
+		wg.Add(1)
+		go func(i int, data []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := putStripe(r, i, data); err != nil {
+				fail(err)
+			}
+		}(i, data)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		stripeHttpError(w, firstErr)
+		return
+	}
+	// The checksums are checked at the end of the body, which the last
+	// stripe may not have reached.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		stripeHttpError(w, stripeError{400, err.Error()})
+		return
+	}
+
+	var manifest bytes.Buffer
+	if err := stripe.WriteManifest(&manifest, m); err != nil {
+		stripeHttpError(w, err)
+		return
+	}
+	req, err := newFileRequest(r, "POST", r.URL.Path, r.URL.Query(), manifest.Bytes())
+	if err != nil {
+		stripeHttpError(w, err)
+		return
+	}
+	req.Header.Set(stripe.Header, strconv.Itoa(m.Stripes()))
+	// The file's metadata and permissions are kept with its manifest.
+	for key, values := range r.Header {
+		switch {
+		case key == "Content-Type", key == "X-Pfs-Mode", key == "X-Pfs-Uid", key == "X-Pfs-Gid",
+			strings.HasPrefix(key, "X-Pfs-Meta-"):
+			req.Header[key] = values
+		}
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		stripeHttpError(w, err)
+		return
+	}
+	copyResponse(w, resp)
+}
+
+// stripeResult is a stripe that's been read, or the error reading it.
+type stripeResult struct {
+	data []byte
+	err  error
+}
+
+// readStripes reads the stripes of the file in r, which m describes, and
+// calls write with each of them in order. Up to stripeParallelism stripes
+// are fetched ahead of the one being written.
+func readStripes(r *http.Request, m stripe.Manifest, write func([]byte) error) error {
+	results := make([]chan stripeResult, m.Stripes())
+	for i := range results {
+		results[i] = make(chan stripeResult, 1)
+	}
+	sem := make(chan struct{}, stripeParallelism)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := range results {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(i int) {
+				data, err := getStripe(r, i, m.StripeLen(i))
+				results[i] <- stripeResult{data, err}
+			}(i)
+		}
+	}()
+	for i := range results {
+		res := <-results[i]
+		<-sem
+		if res.err != nil {
+			return res.err
+		}
+		if err := write(res.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteStripes deletes the stripes of the file in r, there are n of them.
+// Stripes that are already gone are skipped.
+func deleteStripes(r *http.Request, n int) error {
+	for i := 0; i < n; i++ {
+		resp, err := stripeRequest(r, "DELETE", i, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == 404 {
+			resp.Body.Close()
+			continue
+		}
+		if err := checkStripe(resp, i); err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// stripeWriter passes a response through to w unless it's marked as being
+// for a striped file, in which case it's held on to so that it can be
+// finished.
+type stripeWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	status  int
+	striped bool
+	body    bytes.Buffer
+}
+
+func newStripeWriter(w http.ResponseWriter) *stripeWriter {
+	return &stripeWriter{w: w, header: make(http.Header)}
+}
+
+func (sw *stripeWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *stripeWriter) WriteHeader(status int) {
+	if sw.status != 0 {
+		return
+	}
+	sw.status = status
+	if status == 200 && sw.header.Get(stripe.Header) != "" {
+		sw.striped = true
+		return
+	}
+	for key, values := range sw.header {
+		sw.w.Header()[key] = values
+	}
+	sw.w.WriteHeader(status)
+}
+
+func (sw *stripeWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(200)
+	}
+	if sw.striped {
+		return sw.body.Write(p)
+	}
+	return sw.w.Write(p)
+}
+
+// finish finishes r, a GET or DELETE, if it was for a striped file by
+// reassembling or deleting the stripes.
+func (sw *stripeWriter) finish(r *http.Request) {
+	if !sw.striped {
+		return
+	}
+	for key, values := range sw.header {
+		switch key {
+		case stripe.Header, "Content-Length", "Content-Range", "Accept-Ranges":
+		default:
+			sw.w.Header()[key] = values
+		}
+	}
+	if r.Method == "DELETE" {
+		n, err := strconv.Atoi(sw.header.Get(stripe.Header))
+		if err == nil {
+			err = deleteStripes(r, n)
+		}
+		if err != nil {
+			stripeHttpError(sw.w, err)
+			return
+		}
+		sw.w.WriteHeader(sw.status)
+		sw.w.Write(sw.body.Bytes())
+		return
+	}
+	m, err := stripe.ReadManifest(&sw.body)
+	if err != nil {
+		stripeHttpError(sw.w, err)
+		return
+	}
+	// Range requests get the whole file, the header is only written once
+	// the first stripe is in so that a failure can still be reported.
+	started := false
+	start := func() {
+		if !started {
+			sw.w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+			sw.w.WriteHeader(200)
+			started = true
+		}
+	}
+	err = readStripes(r, m, func(data []byte) error {
+		start()
+		_, err := sw.w.Write(data)
+		return err
+	})
+	if err != nil && !started {
+		stripeHttpError(sw.w, err)
+		return
+	}
+	if err != nil {
+		// It's too late to send an error status
+		log.Print(err)
+		return
+	}
+	start()
+}
+
+// stripeHttpError writes err, with the status the shard failed with if it's
+// a stripeError.
+func stripeHttpError(w http.ResponseWriter, err error) {
+	status := 500
+	if err, ok := err.(stripeError); ok {
+		status = err.status
+	}
+	http.Error(w, err.Error(), status)
+	log.Print(err)
+}
+
+// copyResponse passes resp through to w and closes it.
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+// s3gateway serves pfs through a subset of the S3 API so that S3 tools can
+// read and write it. Buckets are branches and commits:
+//
+//	GET    /                       lists branches as buckets
+//	GET    /<bucket>               lists the files in a branch or commit (ListObjects, v1 and v2)
+//	GET    /<bucket>/<key>         reads a file (GetObject), HEAD works too
+//	PUT    /<bucket>/<key>         writes a file to a branch (PutObject)
+//	DELETE /<bucket>/<key>         deletes a file from a branch (DeleteObject)
+//
+// Reads can name a commit in the x-pfs-commit header instead, which lets
+// tools that only know about one bucket read old commits. Requests aren't
+// authenticated, put the gateway behind whatever guards the router.
+//
+// It talks to the router at $PFS_ADDRESS and listens on port 80.
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/client"
+)
+
+// maxKeys is how many keys a listing returns if the request doesn't say.
+const maxKeys = 1000
+
+type bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listBucketsResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	} `xml:"Owner"`
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listObjectsResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                string         `xml:"Marker,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// writeError writes err as an S3 error response, notFound is the code to use
+// if pfs says there's no such thing.
+func writeError(w http.ResponseWriter, r *http.Request, err error, notFound string) {
+	status, code := 500, "InternalError"
+	if e, ok := err.(*client.Error); ok {
+		switch {
+		case e.Status == 404:
+			status, code = 404, notFound
+		case e.Status < 500:
+			status, code = e.Status, "InvalidRequest"
+		}
+	}
+	if status == 500 {
+		log.Print(err)
+	}
+	writeErrorCode(w, r, status, code, err.Error())
+}
+
+func writeErrorCode(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	if err := xml.NewEncoder(w).Encode(s3Error{Code: code, Message: message, Resource: r.URL.Path}); err != nil {
+		log.Print(err)
+	}
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
+
+// s3Time converts a pfs timestamp to the format S3 uses.
+func s3Time(tstamp string) string {
+	t, err := time.Parse("2006-01-02T15:04:05.999999-07:00", tstamp)
+	if err != nil {
+		t = time.Now()
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// chunkedReader decodes the aws-chunked encoding that signed streaming
+// uploads use, each chunk is "<size in hex>;chunk-signature=<sig>\r\n<data>\r\n"
+// and the last chunk is empty. We don't check the signatures.
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.left == 0 {
+		header, err := c.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		size := strings.TrimSpace(strings.SplitN(header, ";", 2)[0])
+		if c.left, err = strconv.ParseInt(size, 16, 64); err != nil {
+			return 0, fmt.Errorf("Invalid chunk header %q.", header)
+		}
+		if c.left == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.left == 0 && err == nil {
+		// Each chunk's data is followed by \r\n.
+		_, err = c.r.Discard(2)
+	}
+	return n, err
+}
+
+// Gateway serves the S3 API for the cluster c talks to.
+type Gateway struct {
+	c *client.Client
+}
+
+func (g Gateway) listBuckets(w http.ResponseWriter, r *http.Request) {
+	branches, err := g.c.ListBranches()
+	if err != nil {
+		writeError(w, r, err, "NoSuchBucket")
+		return
+	}
+	var result listBucketsResult
+	result.Owner.ID, result.Owner.DisplayName = "pfs", "pfs"
+	for _, branch := range branches {
+		result.Buckets = append(result.Buckets, bucket{Name: branch.Name, CreationDate: s3Time(branch.TStamp)})
+	}
+	writeXML(w, result)
+}
+
+// listObjects lists the files in bucket, keys are sorted so that markers and
+// continuation tokens are just the last key returned.
+func (g Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	query := r.URL.Query()
+	result := listObjectsResult{
+		Name:      bucket,
+		Prefix:    query.Get("prefix"),
+		Delimiter: query.Get("delimiter"),
+		MaxKeys:   maxKeys,
+	}
+	if max := query.Get("max-keys"); max != "" {
+		n, err := strconv.Atoi(max)
+		if err != nil || n < 0 {
+			writeErrorCode(w, r, 400, "InvalidArgument", fmt.Sprintf("Invalid max-keys %s.", max))
+			return
+		}
+		result.MaxKeys = n
+	}
+	v2 := query.Get("list-type") == "2"
+	after := query.Get("marker")
+	if v2 {
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = query.Get("start-after")
+		after = result.StartAfter
+		if result.ContinuationToken != "" {
+			after = result.ContinuationToken
+		}
+	} else {
+		result.Marker = after
+	}
+	// Every file in a commit changed since t0.
+	files, err := g.c.Diff("t0", bucket)
+	if err != nil {
+		writeError(w, r, err, "NoSuchBucket")
+		return
+	}
+	sort.Strings(files)
+	seen := make(map[string]bool)
+	last := ""
+	for _, file := range files {
+		if !strings.HasPrefix(file, result.Prefix) || file <= after {
+			continue
+		}
+		// A marker that's a common prefix covers every key under it.
+		if result.Delimiter != "" && strings.HasSuffix(after, result.Delimiter) && strings.HasPrefix(file, after) {
+			continue
+		}
+		prefix := ""
+		if result.Delimiter != "" {
+			if i := strings.Index(file[len(result.Prefix):], result.Delimiter); i >= 0 {
+				prefix = file[:len(result.Prefix)+i+len(result.Delimiter)]
+			}
+		}
+		if prefix != "" && seen[prefix] {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if prefix != "" {
+			seen[prefix] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: prefix})
+			last = prefix
+			continue
+		}
+		size, err := g.c.FileSize(file, bucket)
+		if err != nil {
+			writeError(w, r, err, "NoSuchKey")
+			return
+		}
+		// pfs doesn't keep modification times for files.
+		result.Contents = append(result.Contents, object{
+			Key:          file,
+			LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+			Size:         size,
+			StorageClass: "STANDARD",
+		})
+		last = file
+	}
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = last
+		} else {
+			result.NextMarker = last
+		}
+	}
+	if v2 {
+		result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	}
+	writeXML(w, result)
+}
+
+func (g Gateway) getObject(w http.ResponseWriter, r *http.Request, commit, key string) {
+	if r.Method == "HEAD" {
+		size, err := g.c.FileSize(key, commit)
+		if err != nil {
+			writeError(w, r, err, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		return
+	}
+	f, err := g.c.GetFile(key, commit)
+	if err != nil {
+		writeError(w, r, err, "NoSuchKey")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, f); err != nil {
+		log.Print(err)
+	}
+}
+
+func (g Gateway) putObject(w http.ResponseWriter, r *http.Request, branch, key string) {
+	var body io.Reader = r.Body
+	if r.Header.Get("X-Amz-Content-Sha256") == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		body = &chunkedReader{r: bufio.NewReader(r.Body)}
+	}
+	if err := g.c.PutFile(key, branch, body); err != nil {
+		writeError(w, r, err, "NoSuchBucket")
+		return
+	}
+	w.Header().Set("ETag", `""`)
+}
+
+func (g Gateway) deleteObject(w http.ResponseWriter, r *http.Request, branch, key string) {
+	if err := g.c.DeleteFile(key, branch); err != nil {
+		writeError(w, r, err, "NoSuchKey")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func (g Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// url looks like /, /<bucket> or /<bucket>/<key>
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := parts[0], ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	commit := bucket
+	if header := r.Header.Get("X-Pfs-Commit"); header != "" {
+		commit = header
+	}
+	switch {
+	case bucket == "" && r.Method == "GET":
+		g.listBuckets(w, r)
+	case key == "" && r.Method == "GET":
+		g.listObjects(w, r, commit)
+	case key == "" && r.Method == "HEAD":
+		// Buckets exist if they can be listed.
+		if _, err := g.c.Diff("t0", commit); err != nil {
+			writeError(w, r, err, "NoSuchBucket")
+		}
+	case key != "" && (r.Method == "GET" || r.Method == "HEAD"):
+		g.getObject(w, r, commit, key)
+	case key != "" && r.Method == "PUT":
+		g.putObject(w, r, bucket, key)
+	case key != "" && r.Method == "DELETE":
+		g.deleteObject(w, r, bucket, key)
+	default:
+		writeErrorCode(w, r, 405, "MethodNotAllowed", fmt.Sprintf("%s isn't supported here.", r.Method))
+	}
+}
+
+func main() {
+	log.SetFlags(log.Lshortfile)
+	address := os.Getenv("PFS_ADDRESS")
+	if address == "" {
+		address = "http://localhost"
+	}
+	log.Print("Serving S3 for ", address)
+	log.Fatal(http.ListenAndServe(":80", Gateway{c: client.New(address)}))
+}
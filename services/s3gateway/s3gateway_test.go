@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pachyderm/pfs/lib/client"
+)
+
+// fakePfs serves enough of the router's API for the gateway, it has one
+// branch, master.
+type fakePfs struct {
+	lock  sync.Mutex
+	files map[string]string
+}
+
+func (f *fakePfs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case r.URL.Path == "/branch":
+		json.NewEncoder(w).Encode(client.BranchInfo{Name: "master", TStamp: "2015-01-02T15:04:05-07:00"})
+	case r.URL.Path == "/diff":
+		if r.URL.Query().Get("to") != "master" {
+			http.Error(w, "Commit not found.", 404)
+			return
+		}
+		var files []string
+		for file := range f.files {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		json.NewEncoder(w).Encode(files)
+	case strings.HasPrefix(r.URL.Path, "/file/"):
+		name := strings.TrimPrefix(r.URL.Path, "/file/")
+		switch r.Method {
+		case "GET":
+			data, ok := f.files[name]
+			if !ok {
+				http.Error(w, "404 page not found", 404)
+				return
+			}
+			if r.Header.Get("Range") == "bytes=0-0" {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-0/%d", len(data)))
+				w.WriteHeader(http.StatusPartialContent)
+				fmt.Fprint(w, data[:1])
+				return
+			}
+			fmt.Fprint(w, data)
+		case "POST":
+			data, _ := ioutil.ReadAll(r.Body)
+			f.files[name] = string(data)
+		case "DELETE":
+			delete(f.files, name)
+		}
+	default:
+		http.Error(w, "404 page not found", 404)
+	}
+}
+
+func list(t *testing.T, url string) listObjectsResult {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var result listObjectsResult
+	if err := xml.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func keys(result listObjectsResult) string {
+	var keys []string
+	for _, prefix := range result.CommonPrefixes {
+		keys = append(keys, prefix.Prefix)
+	}
+	for _, object := range result.Contents {
+		keys = append(keys, fmt.Sprintf("%s:%d", object.Key, object.Size))
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestGateway(t *testing.T) {
+	pfs := httptest.NewServer(&fakePfs{files: map[string]string{
+		"a":       "1",
+		"dir/b":   "22",
+		"dir/c":   "333",
+		"other/d": "4444",
+	}})
+	defer pfs.Close()
+	s := httptest.NewServer(Gateway{c: client.New(pfs.URL)})
+	defer s.Close()
+
+	if got := keys(list(t, s.URL+"/master")); got != "a:1,dir/b:2,dir/c:3,other/d:4" {
+		t.Fatalf("Unexpected listing %s.", got)
+	}
+	if got := keys(list(t, s.URL+"/master?delimiter=/")); got != "dir/,other/,a:1" {
+		t.Fatalf("Unexpected listing %s.", got)
+	}
+	if got := keys(list(t, s.URL+"/master?prefix=dir/&delimiter=/")); got != "dir/b:2,dir/c:3" {
+		t.Fatalf("Unexpected listing %s.", got)
+	}
+	// Page through with a v1 marker and a v2 continuation token.
+	result := list(t, s.URL+"/master?delimiter=/&max-keys=2")
+	if !result.IsTruncated || result.NextMarker != "dir/" || keys(result) != "dir/,a:1" {
+		t.Fatalf("Unexpected first page %+v.", result)
+	}
+	result = list(t, s.URL+"/master?delimiter=/&max-keys=2&marker="+result.NextMarker)
+	if result.IsTruncated || keys(result) != "other/" {
+		t.Fatalf("Unexpected second page %+v.", result)
+	}
+	result = list(t, s.URL+"/master?list-type=2&max-keys=3")
+	if !result.IsTruncated || result.KeyCount != 3 || result.NextContinuationToken != "dir/c" {
+		t.Fatalf("Unexpected first page %+v.", result)
+	}
+	result = list(t, s.URL+"/master?list-type=2&continuation-token="+result.NextContinuationToken)
+	if result.IsTruncated || keys(result) != "other/d:4" {
+		t.Fatalf("Unexpected second page %+v.", result)
+	}
+
+	res, err := http.Get(s.URL + "/master/dir/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "333" {
+		t.Fatalf("Got %q, expected 333.", data)
+	}
+	res, err = http.Head(s.URL + "/master/other/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.ContentLength != 4 {
+		t.Fatalf("HEAD should return the size, got %d.", res.ContentLength)
+	}
+
+	// Signed streaming uploads are chunked.
+	req, err := http.NewRequest("PUT", s.URL+"/master/new", strings.NewReader(
+		"3;chunk-signature=abc\r\nfoo\r\n3;chunk-signature=def\r\nbar\r\n0;chunk-signature=ghi\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("PUT failed: %s", res.Status)
+	}
+	res, err = http.Get(s.URL + "/master/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "foobar" {
+		t.Fatalf("Got %q, expected foobar.", data)
+	}
+
+	req, err = http.NewRequest("DELETE", s.URL+"/master/new", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 204 {
+		t.Fatalf("DELETE should return 204, got %s.", res.Status)
+	}
+	res, err = http.Get(s.URL + "/master/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s3Err s3Error
+	if err := xml.NewDecoder(res.Body).Decode(&s3Err); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 || s3Err.Code != "NoSuchKey" {
+		t.Fatalf("Expected NoSuchKey, got %s %+v.", res.Status, s3Err)
+	}
+	res, err = http.Get(s.URL + "/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Listing a missing bucket should return 404, got %s.", res.Status)
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"path"
 	"time"
 
 	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/discovery"
 )
 
 func (s Shard) Peers() ([]string, error) {
@@ -30,7 +31,7 @@ func (s Shard) SyncFromPeers() error {
 		return err
 	}
 
-	err = SyncFrom(s.dataRepo, peers)
+	err = SyncFrom(s.ctx, s.dataRepo, peers)
 	if err != nil {
 		return err
 	}
@@ -39,12 +40,18 @@ func (s Shard) SyncFromPeers() error {
 }
 
 func (s Shard) SyncToPeers() error {
+	return s.syncToPeers(s.ctx)
+}
+
+// syncToPeers is SyncToPeers but stops when ctx is cancelled.
+func (s Shard) syncToPeers(ctx context.Context) error {
 	peers, err := s.Peers()
 	if err != nil {
 		return err
 	}
 
-	err = SyncTo(s.dataRepo, peers)
+	_, _, epoch := s.role.get()
+	err = syncTo(ctx, s.dataRepo, s.pushTargets(peers), epoch)
 	if err != nil {
 		return err
 	}
@@ -52,17 +59,29 @@ func (s Shard) SyncToPeers() error {
 	return nil
 }
 
+// member is our registration in the cluster's membership.
+func (s Shard) member(role string) discovery.Member {
+	_, _, epoch := s.role.get()
+	return discovery.Member{Shard: s.shard, Modulos: s.modulos, Address: s.url, Role: role, Epoch: epoch}
+}
+
 // FillRole attempts to find a role in the cluster. Once on is found it
 // prepares the local storage for the role and announces the shard to the rest
-// of the cluster. This function will loop until `cancel` is closed.
+// of the cluster, after catching up, see catchup.go. This function will loop until `cancel` is closed.
 func (s Shard) FillRole(cancel chan struct{}) error {
 	shard := fmt.Sprintf("%d-%d", s.shard, s.modulos)
-	masterKey := path.Join("/pfs/master", shard)
+	masterKey := s.masterKey()
 	replicaDir := path.Join("/pfs/replica", shard)
 
-	amMaster := false //true if we're master
+	// We don't join the cluster until we've caught up.
+	if err := s.CatchUp(); err != nil {
+		logger.Error("catching up", "err", err)
+	}
+
 	replicaKey := ""
 	for {
+		// We can also be made master by a promotion.
+		_, amMaster, _ := s.role.get()
 		client := etcd.NewClient([]string{"http://172.17.42.1:4001", "http://10.1.42.1:4001"})
 		// First we attempt to become the master for this shard
 		if !amMaster {
@@ -74,24 +93,33 @@ func (s Shard) FillRole(cancel chan struct{}) error {
 				// no error means we succesfully claimed master
 				err = s.SyncFromPeers()
 				if err != nil {
-					log.Print(err)
+					logger.Error("syncing from peers", "err", err)
 				}
 				// Attempt to finalize ourselves as master
 				_, err := client.CompareAndSwap(masterKey, s.url, 60, backfillingKey, 0)
 				if err != nil {
-					log.Print(err)
+					logger.Error("claiming master", "err", err)
 				} else {
 					// no error means that we succusfully announced ourselves as master
 					// Make sure that if we got nothing from the peers we
 					// initialize as a writeable repo.
 					err = s.EnsureRepos()
 					if err != nil {
-						log.Print(err)
+						logger.Error("creating repos", "err", err)
+					}
+					//Record that we're master, with a new epoch
+					epoch, err := s.nextEpoch(client)
+					if err != nil {
+						// Without an epoch replicas can't tell our pushes from
+						// a deposed master's, so let someone else try.
+						logger.Error("starting epoch", "err", err)
+						client.CompareAndDelete(masterKey, s.url, 0)
+					} else {
+						s.role.becomePrimary(epoch)
+						amMaster = true
+						// Sync the new data we pulled to peers
+						go s.SyncToPeers()
 					}
-					// Sync the new data we pulled to peers
-					go s.SyncToPeers()
-					//Record that we're master
-					amMaster = true
 				}
 			}
 		} else {
@@ -101,17 +129,20 @@ func (s Shard) FillRole(cancel chan struct{}) error {
 				amMaster = false
 			}
 		}
+		if !amMaster {
+			s.role.becomeReplica()
+		}
 
 		// We didn't claim master, so we add ourselves as replica instead.
 		if replicaKey == "" {
 			resp, err := client.CreateInOrder(replicaDir, s.url, 60)
 			if err != nil {
-				log.Print(err)
+				logger.Error("registering as replica", "err", err)
 			} else {
 				replicaKey = resp.Node.Key
 				err = s.EnsureReplicaRepos()
 				if err != nil {
-					log.Print(err)
+					logger.Error("creating replica repos", "err", err)
 				}
 				// Get ourselves up to date
 				go s.SyncFromPeers()
@@ -123,6 +154,15 @@ func (s Shard) FillRole(cancel chan struct{}) error {
 			}
 		}
 
+		// Register, or renew, our membership so routers can find us.
+		role := discovery.RoleReplica
+		if amMaster {
+			role = discovery.RoleMaster
+		}
+		if err := discovery.Register(client, s.member(role)); err != nil {
+			logger.Error("registering", "role", role, "err", err)
+		}
+
 		select {
 		case <-time.After(time.Second * 45):
 			continue
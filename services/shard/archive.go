@@ -0,0 +1,485 @@
+package main
+
+// archive.go streams whole commits, or directories within them, as tar or
+// zip archives. It also does the reverse, unpacking tar streams in to
+// branches, which is the fastest way to load an initial dataset.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// archiveFormats maps the supported formats to their content types.
+var archiveFormats = map[string]string{
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+	"zip":    "application/zip",
+}
+
+// walkSnapshot calls f for every file and directory under dir in the snapshot
+// at root, skipping our metadata. Names passed to f are relative to dir.
+func walkSnapshot(root, dir string, f func(name string, fi os.FileInfo, abs string) error) error {
+	base := btrfs.FilePath(path.Join(root, dir))
+	return filepath.Walk(base, func(abs string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(btrfs.FilePath(root), abs)
+		if err != nil {
+			return err
+		}
+		if rel == ".meta" {
+			return filepath.SkipDir
+		}
+		name, err := filepath.Rel(base, abs)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		return f(filepath.ToSlash(name), fi, abs)
+	})
+}
+
+// writeTar writes the files under dir in the snapshot at root to w as a tar.
+// If match isn't nil only the files it matches are written, without their
+// directories. The files in extra, which are given by their contents, are
+// written after them.
+func writeTar(w io.Writer, root, dir string, match func(name string) bool, extra map[string][]byte) error {
+	tw := tar.NewWriter(w)
+	// links maps the inodes of files with more than one hard link to the
+	// first name we wrote them under, the others are written as links to it.
+	links := make(map[uint64]string)
+	err := walkSnapshot(root, dir, func(name string, fi os.FileInfo, abs string) error {
+		if match != nil && (fi.IsDir() || !match(name)) {
+			return nil
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(abs); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				links[st.Ino] = name
+			}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return tw.WriteHeader(hdr)
+		}
+		f, err := os.Open(abs)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// Chunked files hold manifests, the archive gets their content.
+		content, size, err := fileContent(f)
+		if err != nil {
+			return err
+		}
+		hdr.Size = size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = copyBuffer(tw, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for name, data := range extra {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg, ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeZip is writeTar for zip archives.
+func writeZip(w io.Writer, root, dir string, match func(name string) bool, extra map[string][]byte) error {
+	zw := zip.NewWriter(w)
+	err := walkSnapshot(root, dir, func(name string, fi os.FileInfo, abs string) error {
+		if match != nil && (fi.IsDir() || !match(name)) {
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			// zip has no good way to represent anything else
+			return nil
+		}
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if fi.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		f, err := os.Open(abs)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content, _, err := fileContent(f)
+		if err != nil {
+			return err
+		}
+		_, err = copyBuffer(fw, content)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for name, data := range extra {
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetModTime(time.Now())
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// ArchiveHandler streams an archive of a commit on GET and unpacks a tar
+// stream in to a branch on POST.
+func (s Shard) ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectInvalidRefs(w, r) {
+		return
+	}
+	switch r.Method {
+	case "GET":
+		s.getArchive(w, r)
+	case "POST":
+		if s.rejectWrite(w) {
+			return
+		}
+		s.postArchive(w, r)
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+func (s Shard) getArchive(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar.gz"
+	}
+	contentType, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported format %s.", format), 400)
+		return
+	}
+	filter, err := fileFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	commit := s.commitParam(r)
+	dir := path.Clean("/" + r.URL.Query().Get("path"))
+	var match func(string) bool
+	if filter != nil {
+		// Patterns are relative to the commit, not dir.
+		match = func(name string) bool { return filter(strings.TrimPrefix(path.Join(dir, name), "/")) }
+	}
+	// With shard and modulos set the archive only has the files that shard
+	// owns, resharding copies files that way, see reshard.go.
+	owned, err := ownerFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if owned != nil {
+		filtered := match
+		match = func(name string) bool {
+			return owned(strings.TrimPrefix(path.Join(dir, name), "/")) && (filtered == nil || filtered(name))
+		}
+	}
+	// With from set the archive only has what changed since it, see
+	// diffview.go.
+	var extra map[string][]byte
+	if from := r.URL.Query().Get("from"); from != "" {
+		v, err := s.newDiffView(from, commit)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		filtered := match
+		match = func(name string) bool {
+			return v.changed[strings.TrimPrefix(path.Join(dir, name), "/")] && (filtered == nil || filtered(name))
+		}
+		extra = map[string][]byte{deletedManifest: v.manifest()}
+	}
+	exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit, dir))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if !exists {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+
+	// We hold the commit so that the archive is consistent even if commit
+	// is actually a branch that's being written to.
+	var snapshot string
+	err = timeOp(w, "btrfs.Hold", func() error {
+		var err error
+		snapshot, err = btrfs.Hold(s.dataRepo, commit)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	defer btrfs.Release(snapshot)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", commit, format))
+	err = timeOp(w, "archive", func() error {
+		switch format {
+		case "tar":
+			return writeTar(w, snapshot, dir, match, extra)
+		case "tar.gz":
+			gw := gzip.NewWriter(w)
+			if err := writeTar(gw, snapshot, dir, match, extra); err != nil {
+				return err
+			}
+			return gw.Close()
+		default:
+			return writeZip(w, snapshot, dir, match, extra)
+		}
+	})
+	if err != nil {
+		// We've already started writing the archive so all we can do is
+		// log and cut the response short.
+		logError(r, err)
+	}
+}
+
+// unpackTar writes the contents of a tar stream under dir, within the limits
+// of l. It returns the number of files written. Symlinks that leave dir, and
+// anything other than regular files, directories and links, are skipped. If
+// perms is true files and directories get the modes and owners in the tar
+// headers. If owner isn't nil it's called with the name of every file and
+// link before it's written, unpacking stops at the first error it returns.
+func unpackTar(r io.Reader, dir string, perms bool, l *writeLimiter, owner func(name string) error) (int, error) {
+	if owner == nil {
+		owner = func(string) error { return nil }
+	}
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return n, fmt.Errorf("Illegal path %s in archive.", hdr.Name)
+		}
+		if name == ".meta" || strings.HasPrefix(name, ".meta/") {
+			return n, fmt.Errorf("Archive may not write to %s.", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := btrfs.MkdirAll(path.Join(dir, name)); err != nil {
+				return n, err
+			}
+			if perms {
+				if err := tarPerms(hdr).apply(path.Join(dir, name)); err != nil {
+					return n, err
+				}
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := owner(name); err != nil {
+				return n, err
+			}
+			if err := btrfs.MkdirAll(path.Dir(path.Join(dir, name))); err != nil {
+				return n, err
+			}
+			body, err := l.file(name, 0, hdr.Size, tr)
+			if err != nil {
+				return n, err
+			}
+			if _, err := btrfs.CreateFromReader(path.Join(dir, name), body); err != nil {
+				if isLimitError(err) {
+					// Don't leave the part that fit behind.
+					btrfs.Remove(path.Join(dir, name))
+				}
+				return n, err
+			}
+			if perms {
+				if err := tarPerms(hdr).apply(path.Join(dir, name)); err != nil {
+					return n, err
+				}
+			}
+			n++
+		case tar.TypeSymlink, tar.TypeLink:
+			if err := owner(name); err != nil {
+				return n, err
+			}
+			if _, err := l.file(name, 0, 0, nil); err != nil {
+				return n, err
+			}
+			// Like tar, links replace whatever's in their way.
+			if err := btrfs.Remove(path.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return n, err
+			}
+			var err error
+			if hdr.Typeflag == tar.TypeSymlink {
+				err = btrfs.CreateSymlink(dir, name, hdr.Linkname)
+			} else {
+				err = btrfs.CreateLink(dir, name, hdr.Linkname)
+			}
+			if errors.Is(err, btrfs.ErrInvalidName) {
+				logger.Warn("skipping archive link", "name", hdr.Name, "target", hdr.Linkname, "err", err)
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+			n++
+		default:
+			logger.Warn("skipping archive entry of unsupported type", "name", hdr.Name, "type", string(hdr.Typeflag))
+		}
+	}
+}
+
+// tarPerms returns the mode and owner in hdr.
+func tarPerms(hdr *tar.Header) filePerms {
+	return filePerms{mode: unixMode(uint32(hdr.Mode)), setMode: true, uid: hdr.Uid, gid: hdr.Gid}
+}
+
+// postArchive unpacks a tar stream in to a branch. If the commit parameter is
+// present the branch is committed afterward, with a generated name if the
+// parameter is empty.
+func (s Shard) postArchive(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar"
+	}
+	var body io.Reader = r.Body
+	switch format {
+	case "tar":
+	case "tar.gz":
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		defer gr.Close()
+		body = gr
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported format %s.", format), 400)
+		return
+	}
+	if commit := r.URL.Query().Get("commit"); commit != "" {
+		if err := s.validNewName(commit); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	branch := branchParam(r)
+	exists, err := btrfs.FileExists(path.Join(s.dataRepo, branch))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Branch %s not found.", branch), 404)
+		return
+	}
+
+	// The read lock is released before committing below, Commit takes the
+	// branch's exclusive lock itself.
+	lock, err := btrfs.RLockBranch(s.dataRepo, branch)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	l, err := s.newWriteLimiter(branch)
+	if err != nil {
+		lock.Unlock()
+		httpError(w, r, err)
+		return
+	}
+	var n int
+	err = timeOp(w, "unpack", func() error {
+		var err error
+		n, err = unpackTar(body, path.Join(s.dataRepo, branch), btrfs.PreservesPermissions(s.dataRepo), l, s.checkOwner)
+		return err
+	})
+	lock.Unlock()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fmt.Fprintf(w, "Unpacked %d files in to %s.\n", n, branch)
+
+	if _, ok := r.URL.Query()["commit"]; !ok {
+		return
+	}
+	var commit string
+	err = timeOp(w, "btrfs.Commit", func() error {
+		var err error
+		commit, err = btrfs.Commit(s.dataRepo, r.URL.Query().Get("commit"), branch)
+		return err
+	})
+	if err != nil {
+		// We've already written a 200, so the error goes in the body.
+		fmt.Fprintf(w, "Commit failed: %s\n", err.Error())
+		logError(r, err)
+		return
+	}
+	go s.publishCommit(commit)
+	go s.syncToPeers(s.detach(r))
+	fmt.Fprintf(w, "%s\n", commit)
+}
@@ -0,0 +1,297 @@
+package main
+
+// auth.go contains the shard's authentication and authorization layer. It's
+// off unless a policy is configured, in which case every route except /ping
+// requires the caller to have the appropriate permission. A policy looks
+// like:
+//
+//	{
+//		"tokens": {"s3cr3t": "alice", "0p5": "ops"},
+//		"admins": ["ops"],
+//		"grants": [
+//			{"principal": "alice", "branches": ["master", "alice-*"], "read": true, "write": true},
+//			{"principal": "*", "branches": ["*"], "read": true}
+//		]
+//	}
+//
+// Admins can do anything, including creating branches, replication and the
+// /admin and /debug routes. Principals are identified by Authenticators,
+// either from a bearer token or from the common name of a TLS client
+// certificate.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// anonymous is the principal of requests with no credentials.
+const anonymous = ""
+
+// Authenticator identifies the principal making a request. It returns
+// anonymous if the request doesn't carry credentials it understands and an
+// error if it carries credentials that are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// TokenAuthenticator authenticates bearer tokens, it maps tokens to
+// principals.
+type TokenAuthenticator map[string]string
+
+func (a TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return anonymous, nil
+	}
+	principal, ok := a[strings.TrimPrefix(header, "Bearer ")]
+	if !ok {
+		return anonymous, fmt.Errorf("Invalid token.")
+	}
+	return principal, nil
+}
+
+// CertAuthenticator authenticates TLS client certificates, the principal is
+// the certificate's common name. Verifying the certificate is left to the TLS
+// config.
+type CertAuthenticator struct{}
+
+func (a CertAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return anonymous, nil
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+type Grant struct {
+	Principal string   `json:"principal"`
+	Branches  []string `json:"branches"`
+	Read      bool     `json:"read"`
+	Write     bool     `json:"write"`
+}
+
+type AuthPolicy struct {
+	Tokens map[string]string `json:"tokens"`
+	Admins []string          `json:"admins"`
+	Grants []Grant           `json:"grants"`
+}
+
+type authorizer struct {
+	policy         AuthPolicy
+	authenticators []Authenticator
+}
+
+// newAuthorizer creates an authorizer from a policy, certificates are tried
+// before tokens.
+func newAuthorizer(policy AuthPolicy) *authorizer {
+	return &authorizer{
+		policy:         policy,
+		authenticators: []Authenticator{CertAuthenticator{}, TokenAuthenticator(policy.Tokens)},
+	}
+}
+
+// loadAuthorizer reads a policy file.
+func loadAuthorizer(name string) (*authorizer, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var policy AuthPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	return newAuthorizer(policy), nil
+}
+
+func (a *authorizer) authenticate(r *http.Request) (string, error) {
+	for _, authenticator := range a.authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err != nil || principal != anonymous {
+			return principal, err
+		}
+	}
+	return anonymous, nil
+}
+
+const (
+	accessNone = iota
+	accessRead
+	accessWrite
+	accessAdmin
+)
+
+// allowed returns true if principal has kind access to branch. Listings ask
+// for access to the branch "*" which only grants of "*" match.
+func (a *authorizer) allowed(principal string, kind int, branch string) bool {
+	if kind == accessNone {
+		return true
+	}
+	for _, admin := range a.policy.Admins {
+		if principal != anonymous && principal == admin {
+			return true
+		}
+	}
+	if kind == accessAdmin {
+		return false
+	}
+	for _, grant := range a.policy.Grants {
+		if grant.Principal != "*" && (principal == anonymous || grant.Principal != principal) {
+			continue
+		}
+		if kind == accessRead && !grant.Read || kind == accessWrite && !grant.Write {
+			continue
+		}
+		for _, pattern := range grant.Branches {
+			if match, _ := path.Match(pattern, branch); match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// branchOf returns the branch that ref belongs to. Commits belong to the
+// branch they were made from, branches belong to themselves.
+func (s Shard) branchOf(ref string) string {
+	ref = btrfs.Resolve(s.dataRepo, ref)
+	if branch := btrfs.GetMeta(path.Join(s.dataRepo, ref), "branch"); branch != "" {
+		return branch
+	}
+	return ref
+}
+
+// requiredAccess returns the kind of access that r needs and which branches
+// it needs it on. Routes that aren't listed here need admin access.
+func (s Shard) requiredAccess(r *http.Request) (int, []string) {
+	url := strings.Split(r.URL.Path, "/")
+	isRead := r.Method == "GET" || r.Method == "HEAD"
+	switch url[1] {
+	case "ping", "health":
+		return accessNone, nil
+	case "file", "job", "archive", "list":
+		if isRead {
+			if id := r.URL.Query().Get("hold"); id != "" {
+				return accessRead, []string{s.branchOf(s.heldCommit(id))}
+			}
+			return accessRead, []string{s.branchOf(s.commitParam(r))}
+		}
+		return accessWrite, []string{branchParam(r)}
+	case "commit", "branch":
+		if len(url) > 3 && url[3] == "file" {
+			if isRead {
+				return accessRead, []string{s.branchOf(url[2])}
+			}
+			// The handlers refuse writes here, writes go through /file.
+			return accessAdmin, nil
+		}
+		if isRead {
+			return accessRead, []string{"*"}
+		}
+		if url[1] == "commit" && r.ContentLength == 0 {
+			return accessWrite, []string{branchParam(r)}
+		}
+		// Creating branches and pushing replicated commits
+		return accessAdmin, nil
+	case "diff", "filediff":
+		from := r.URL.Query().Get("from")
+		if from == "" {
+			from = "t0"
+		}
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			to = "master"
+		}
+		return accessRead, []string{s.branchOf(from), s.branchOf(to)}
+	case "dav":
+		ref, _ := davPath(r.URL.Path)
+		if ref == "" {
+			// Listing refs shows every branch and commit.
+			return accessRead, []string{"*"}
+		}
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "PROPFIND", "LOCK", "UNLOCK":
+			// Locks aren't enforced so taking one doesn't need write access.
+			return accessRead, []string{s.branchOf(ref)}
+		}
+		return accessWrite, []string{ref}
+	case "events", "provenance":
+		return accessRead, []string{"*"}
+	case "tag":
+		if isRead {
+			return accessRead, []string{"*"}
+		}
+	case "hold":
+		// Holding a commit needs read access to it, managing holds read
+		// access to everything.
+		if len(url) == 2 && r.Method == "POST" {
+			return accessRead, []string{s.branchOf(s.commitParam(r))}
+		}
+		return accessRead, []string{"*"}
+	}
+	return accessAdmin, nil
+}
+
+// authorize wraps h so that requests without the required access are
+// rejected.
+func (s Shard) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := s.auth.authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		kind, branches := s.requiredAccess(r)
+		if kind == accessAdmin && !s.auth.allowed(principal, kind, "") {
+			deny(w, principal)
+			return
+		}
+		for _, branch := range branches {
+			if !s.auth.allowed(principal, kind, branch) {
+				deny(w, principal)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func deny(w http.ResponseWriter, principal string) {
+	if principal == anonymous {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Authentication required.", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s is not allowed to do that.", principal), http.StatusForbidden)
+}
+
+// peerToken is sent with the requests that shards make to each other.
+var peerToken = os.Getenv("PFS_PEER_TOKEN")
+
+// newPeerRequest creates a request to another shard, with our peerToken if
+// we have one.
+func newPeerRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if peerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+peerToken)
+	}
+	return req, nil
+}
+
+// peerRequest makes a request to another shard.
+func peerRequest(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := newPeerRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,81 @@
+package main
+
+// backup.go backs our data repo up to replicas and restores it, see
+// btrfs.Backup. Backups hold the repo's commits, branches and hooks along
+// with our pipelines.
+//
+//	POST /backup?url=<url>  pushes a backup to the replica at url
+//
+// With PFS_RESTORE_FROM set to the url of a replica holding a backup, a shard
+// that starts without a data repo restores it from there instead of making
+// an empty one. The comp repo isn't backed up.
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// backupFiles are the files, besides the repo, kept with our backups.
+func (s Shard) backupFiles() map[string]string {
+	return map[string]string{"pipelines": s.pipelinesFile()}
+}
+
+// restoreRepo restores our data repo from s.restoreFrom if it's set and the
+// repo doesn't exist yet.
+func (s Shard) restoreRepo() error {
+	if s.restoreFrom == "" {
+		return nil
+	}
+	exists, err := btrfs.FileExists(s.dataRepo)
+	if err != nil || exists {
+		return err
+	}
+	replica, err := newReplica(s.restoreFrom)
+	if err != nil {
+		return err
+	}
+	s.pipelines.lock.Lock()
+	defer s.pipelines.lock.Unlock()
+	id, err := btrfs.RestoreWithOptions(s.ctx, replica, s.dataRepo, btrfs.RestoreOptions{Files: s.backupFiles()})
+	if err != nil {
+		return err
+	}
+	if s.quota != 0 {
+		if err := btrfs.SetQuota(s.dataRepo, s.quota); err != nil {
+			return err
+		}
+	}
+	logger.Info("restored repo", "repo", s.dataRepo, "backup", id, "url", s.restoreFrom)
+	return nil
+}
+
+// BackupHandler pushes backups of our data repo to replicas.
+func (s Shard) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Backing up needs a replica url.", 400)
+		return
+	}
+	replica, err := newReplica(url)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var id string
+	err = timeOp(w, "btrfs.Backup", func() error {
+		var err error
+		id, err = btrfs.BackupWithOptions(r.Context(), s.dataRepo, replica, btrfs.BackupOptions{Files: s.backupFiles()})
+		return err
+	})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fmt.Fprintf(w, "Backed up %s to %s.\n", id, url)
+}
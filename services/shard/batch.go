@@ -0,0 +1,209 @@
+package main
+
+// batch.go writes many files to a branch in one request. Ingesting lots of
+// small files one POST at a time spends most of its time on the request and
+// on locking the branch; a batch pays for those once. The body is either
+// multipart/form-data, with each part's file name (or form name if it has
+// none) as the path, or newline delimited json with one BatchFile per line.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+// batchReader returns the files in a batch one at a time. It returns io.EOF
+// after the last one.
+type batchReader func() (name string, data io.Reader, err error)
+
+// newBatchReader returns a batchReader for r's body based on its content type.
+func newBatchReader(r *http.Request) (batchReader, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Content-Type: %s.", err.Error())
+	}
+	switch mediaType {
+	case "multipart/form-data":
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return nil, err
+		}
+		return multipartBatch(mr), nil
+	case "application/x-ndjson", "application/json":
+		return ndjsonBatch(json.NewDecoder(r.Body)), nil
+	}
+	return nil, fmt.Errorf("Unsupported Content-Type %s, batches must be multipart/form-data or application/x-ndjson.", mediaType)
+}
+
+func multipartBatch(mr *multipart.Reader) batchReader {
+	return func() (string, io.Reader, error) {
+		part, err := mr.NextPart()
+		if err != nil {
+			return "", nil, err
+		}
+		name := part.FileName()
+		if name == "" {
+			name = part.FormName()
+		}
+		return name, part, nil
+	}
+}
+
+func ndjsonBatch(decoder *json.Decoder) batchReader {
+	return func() (string, io.Reader, error) {
+		var file BatchFile
+		if err := decoder.Decode(&file); err != nil {
+			return "", nil, err
+		}
+		return file.Path, bytes.NewReader(file.Data), nil
+	}
+}
+
+// errBadBatch is wrapped by errors in the batch itself, rather than in
+// writing it, so that they're reported as the client's fault.
+var errBadBatch = errors.New("bad batch")
+
+// batchPath checks that name is a path a batch may write to and returns it
+// cleaned.
+func batchPath(name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+	if name == "" || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: illegal path %q", errBadBatch, name)
+	}
+	if isMetaPath(clean) {
+		return "", fmt.Errorf("%w: may not write to %s", errBadBatch, name)
+	}
+	return clean, nil
+}
+
+// misroutedError is returned when a batch has a file that belongs to a
+// different shard.
+type misroutedError struct {
+	name                  string
+	owner, shard, modulos uint64
+}
+
+func (e misroutedError) Error() string {
+	return fmt.Sprintf("%s belongs to shard %d-%d, this is shard %d-%d.", e.name, e.owner, e.modulos, e.shard, e.modulos)
+}
+
+// checkOwner returns a misroutedError if the file name belongs to a different
+// shard.
+func (s Shard) checkOwner(name string) error {
+	if s.modulos > 1 {
+		if owner := route.Owner("/file/"+name, s.modulos); owner != s.shard {
+			return misroutedError{name, owner, s.shard, s.modulos}
+		}
+	}
+	return nil
+}
+
+// writeBatch writes the files from next under dir, within the limits of l,
+// stopping at the first error. Files written before the error stay written.
+func (s Shard) writeBatch(next batchReader, dir string, l *writeLimiter) (BatchMsg, error) {
+	var msg BatchMsg
+	for {
+		name, data, err := next()
+		if err == io.EOF {
+			return msg, nil
+		}
+		if err != nil {
+			return msg, fmt.Errorf("%w: %s", errBadBatch, err.Error())
+		}
+		name, err = batchPath(name)
+		if err != nil {
+			return msg, err
+		}
+		if err := s.checkOwner(name); err != nil {
+			return msg, err
+		}
+		if err := btrfs.MkdirAll(path.Dir(path.Join(dir, name))); err != nil {
+			return msg, err
+		}
+		if data, err = l.file(name, 0, -1, data); err != nil {
+			return msg, err
+		}
+		size, err := createFile(path.Join(dir, name), data)
+		if isLimitError(err) {
+			btrfs.Remove(path.Join(dir, name))
+		}
+		if err != nil {
+			return msg, err
+		}
+		msg.Files++
+		msg.Bytes += size
+	}
+}
+
+// BatchHandler writes every file in the body of a POST to the branch. The
+// branch is locked once for the whole batch.
+func (s Shard) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if s.rejectWrite(w) || rejectInvalidRefs(w, r) {
+		return
+	}
+	next, err := newBatchReader(r)
+	if err != nil {
+		http.Error(w, err.Error(), 415)
+		return
+	}
+	branch := branchParam(r)
+	lock, err := btrfs.RLockBranch(s.dataRepo, branch)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer lock.Unlock()
+	w.Header().Set(tokenHeader, btrfs.Head(s.dataRepo, branch))
+	s.idempotent(w, r, branch, func(w http.ResponseWriter, r *http.Request) {
+		if head := btrfs.Head(s.dataRepo, branch); ifMatch(r) != "" && ifMatch(r) != head {
+			err := btrfs.HeadMovedError{Branch: branch, Head: head, Expected: ifMatch(r)}
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		l, err := s.newWriteLimiter(branch)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		var msg BatchMsg
+		err = timeOp(w, "writeBatch", func() error {
+			var err error
+			msg, err = s.writeBatch(next, path.Join(s.dataRepo, branch), l)
+			return err
+		})
+		var misrouted misroutedError
+		switch {
+		case errors.As(err, &misrouted):
+			// 421 is Misdirected Request
+			http.Error(w, err.Error(), 421)
+			return
+		case errors.Is(err, errBadBatch):
+			http.Error(w, fmt.Sprintf("%s, %d files were written before it.", err.Error(), msg.Files), 400)
+			return
+		case isLimitError(err):
+			httpError(w, r, fmt.Errorf("%w %d files were written before it.", err, msg.Files))
+			return
+		case err != nil:
+			httpError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	})
+}
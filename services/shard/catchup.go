@@ -0,0 +1,126 @@
+package main
+
+// catchup.go brings a shard that starts with an empty or stale data repo up
+// to date before it joins the cluster, so that a failed node can be replaced
+// just by starting a new one. The shard first restores its data repo from
+// PFS_RESTORE_FROM if it doesn't have one, see backup.go, then pulls the
+// commits it's missing from each of its upstreams in turn: the urls in
+// PFS_CATCH_UP_FROM, comma separated, followed by the replication targets
+// it has registered, see replication.go. Upstreams can be shards or S3
+// targets. An upstream that can't be reached is skipped.
+//
+// Until it's caught up the shard doesn't register itself, so routers don't
+// send it requests, and /health reports "catching up" with a 503.
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+type catchUpState struct {
+	lock    sync.Mutex
+	running bool
+}
+
+func (c *catchUpState) set(running bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.running = running
+}
+
+// catchingUp returns true while we're catching up.
+func (s Shard) catchingUp() bool {
+	s.catchUp.lock.Lock()
+	defer s.catchUp.lock.Unlock()
+	return s.catchUp.running
+}
+
+// upstreams returns the urls we catch up from.
+func (s Shard) upstreams() ([]string, error) {
+	s.replicas.lock.Lock()
+	replicas, err := s.loadReplicas()
+	s.replicas.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var urls []string
+	for _, url := range s.catchUpFrom {
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	for _, replica := range replicas {
+		if !seen[replica.Url] {
+			seen[replica.Url] = true
+			urls = append(urls, replica.Url)
+		}
+	}
+	return urls, nil
+}
+
+// CatchUp restores our data repo if it's missing and pulls the commits it's
+// missing from our upstreams. It fails if none of them could be pulled from.
+func (s Shard) CatchUp() error {
+	s.catchUp.set(true)
+	defer s.catchUp.set(false)
+	if err := s.restoreRepo(); err != nil {
+		return err
+	}
+	urls, err := s.upstreams()
+	if err != nil || len(urls) == 0 {
+		return err
+	}
+	exists, err := btrfs.FileExists(s.dataRepo)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := btrfs.InitReplica(s.dataRepo); err != nil {
+			return err
+		}
+	}
+	var firstErr error
+	pulled := 0
+	for _, url := range urls {
+		if err := s.catchUpFromUrl(url); err != nil {
+			logger.Error("catching up", "url", url, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		pulled++
+	}
+	if pulled == 0 {
+		// Leave an empty repo to be made afresh, by EnsureRepos say.
+		if from, err := btrfs.GetFrom(s.dataRepo); !exists && err == nil && from == "" {
+			if err := btrfs.SubvolumeDelete(s.dataRepo); err != nil {
+				logger.Error("removing empty repo", "repo", s.dataRepo, "err", err)
+			}
+		}
+		return fmt.Errorf("Couldn't catch up from any of %d upstreams: %w", len(urls), firstErr)
+	}
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err != nil {
+		return err
+	}
+	logger.Info("caught up", "repo", s.dataRepo, "commit", from)
+	return nil
+}
+
+// catchUpFromUrl pulls the commits we're missing from the upstream at url.
+func (s Shard) catchUpFromUrl(url string) error {
+	replica, err := newReplica(url)
+	if err != nil {
+		return err
+	}
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err != nil {
+		return err
+	}
+	return replica.Pull(s.ctx, from, s.localReplica())
+}
@@ -0,0 +1,148 @@
+package main
+
+// chunks.go optionally stores files in a content-addressed chunk store, see
+// lib/chunk, so that identical data written to several branches or repos is
+// only stored once. It's enabled by setting PFS_CHUNK_STORE=true. Files
+// written through /file and /dav are then split in to chunks, which are kept
+// in the volume's blocks directory, and the file in the btrfs tree holds their
+// manifest and is marked with the user.pfs.chunked xattr. Reads through the
+// shard's API resolve manifests transparently, but pipelines and jobs read
+// the repo directly and would see the manifests. Small files, tarballs and
+// resumable uploads are always stored whole. The chunk store isn't
+// replicated either, so shards with it enabled refuse to start with, or to
+// add, replicas or pipelines.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/chunk"
+)
+
+const chunkedAttr = "user.pfs.chunked"
+
+// chunkFiles is true if new files are written to the chunk store.
+var chunkFiles = false
+
+var errChunkStore = fmt.Errorf("PFS_CHUNK_STORE can't be used with replicas or pipelines, they'd see chunk manifests instead of files.")
+
+// checkChunkStore returns errChunkStore if the chunk store is enabled and
+// we have replicas or pipelines.
+func (s Shard) checkChunkStore() error {
+	if !chunkFiles {
+		return nil
+	}
+	s.replicas.lock.Lock()
+	replicas, err := s.loadReplicas()
+	s.replicas.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	s.pipelines.lock.Lock()
+	pipelines, err := s.loadPipelines()
+	s.pipelines.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(replicas) > 0 || len(pipelines) > 0 {
+		return errChunkStore
+	}
+	return nil
+}
+
+// chunks is the volume's chunk store, it's shared by every repo.
+var chunks = chunk.NewStore(btrfs.FilePath("blocks"))
+
+// createFile writes r to name, in the chunk store if it's enabled and r is
+// big enough to be worth chunking. It returns the size of the file.
+func createFile(name string, r io.Reader) (int64, error) {
+	if err := clearStripes(btrfs.FilePath(name)); err != nil {
+		return 0, err
+	}
+	if !chunkFiles {
+		return btrfs.CreateFromReader(name, r)
+	}
+	head := make([]byte, chunk.Default.Min)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return btrfs.CreateFromReader(name, bytes.NewReader(head[:n]))
+	}
+	if err != nil {
+		return 0, err
+	}
+	m, err := chunks.Write(io.MultiReader(bytes.NewReader(head), r), chunk.Default)
+	if err != nil {
+		return 0, err
+	}
+	f, err := btrfs.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// Mark the file before writing the manifest so that a crash can't leave
+	// a manifest that reads as a whole file.
+	if err := syscall.Setxattr(f.Name(), chunkedAttr, []byte("1"), 0); err != nil {
+		return 0, err
+	}
+	if err := chunk.WriteManifest(f, m); err != nil {
+		return 0, err
+	}
+	return m.Size, nil
+}
+
+// isChunked returns true if f holds a manifest.
+func isChunked(f *os.File) bool {
+	_, err := syscall.Getxattr(f.Name(), chunkedAttr, make([]byte, 1))
+	return err == nil
+}
+
+// fileContent returns a reader for the content of f, resolving manifests,
+// and its size.
+func fileContent(f *os.File) (io.ReadSeeker, int64, error) {
+	if !isChunked(f) {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	}
+	m, err := chunk.ReadManifest(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return chunks.Open(m), m.Size, nil
+}
+
+// contentSize returns the size of the content of the file name, resolving
+// manifests.
+func contentSize(name string) (int64, error) {
+	f, err := btrfs.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	_, size, err := fileContent(f)
+	return size, err
+}
+
+// openContent opens the file name with its content resolved, it's how S3
+// targets that store files read them.
+func openContent(name string) (io.ReadCloser, error) {
+	f, err := btrfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	content, _, err := fileContent(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{content, f}, nil
+}
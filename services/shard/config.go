@@ -0,0 +1,164 @@
+package main
+
+// config.go applies our repos' configs, see btrfs.Config:
+//
+//	GET  /repo/<repo>/config   returns the repo's config
+//	POST /repo/<repo>/config   saves and applies a new one, the body is a
+//	                           btrfs.Config with the version of the config it
+//	                           replaces, a stale version gets a 409
+//
+// Configs are applied when the shard sets up its repos and reapplied when it
+// gets a SIGHUP, after they've been edited by hand say. On top of what btrfs
+// applies, the replicas in the data repo's config are registered like those
+// POSTed to /replica, targets registered by hand are left alone, and its GC
+// grace is the default for /admin/gc.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// applyConfig applies repo's config.
+func (s Shard) applyConfig(repo string, c btrfs.Config) error {
+	if err := btrfs.ApplyConfig(repo, c); err != nil {
+		return err
+	}
+	if repo != s.dataRepo || len(c.Replicas) == 0 {
+		return nil
+	}
+	if chunkFiles {
+		return errChunkStore
+	}
+	for _, url := range c.Replicas {
+		if _, err := newReplica(url); err != nil {
+			return err
+		}
+	}
+	s.replicas.lock.Lock()
+	defer s.replicas.lock.Unlock()
+	replicas, err := s.loadReplicas()
+	if err != nil {
+		return err
+	}
+	registered := make(map[string]bool)
+	for _, replica := range replicas {
+		registered[replica.Url] = true
+	}
+	added := false
+	for _, url := range c.Replicas {
+		if !registered[url] {
+			replicas = append(replicas, ReplicaMsg{Id: uuid.New(), Url: url})
+			registered[url] = true
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	return s.saveReplicas(replicas)
+}
+
+// ReloadConfig applies the configs of our repos.
+func (s Shard) ReloadConfig() error {
+	for _, repo := range []string{s.dataRepo, s.compRepo} {
+		c, err := btrfs.LoadConfig(repo)
+		if err != nil {
+			return err
+		}
+		if err := s.applyConfig(repo, c); err != nil {
+			return fmt.Errorf("Applying the config of %s: %w", repo, err)
+		}
+	}
+	return nil
+}
+
+// ReloadConfigOnHangup reloads our configs whenever we get a SIGHUP, until
+// cancel is closed.
+func (s Shard) ReloadConfigOnHangup(cancel chan struct{}) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-c:
+			logger.Info("reloading config")
+			if err := s.ReloadConfig(); err != nil {
+				logger.Error("reloading config", "err", err)
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// gcGrace returns the grace collections get when they don't ask for one.
+func (s Shard) gcGrace() time.Duration {
+	c, err := btrfs.LoadConfig(s.dataRepo)
+	if err != nil {
+		logger.Error("reading config", "err", err)
+		return defaultGCGrace
+	}
+	if c.GCGrace == "" {
+		return defaultGCGrace
+	}
+	// Configs are validated when they're saved.
+	grace, err := time.ParseDuration(c.GCGrace)
+	if err != nil {
+		return defaultGCGrace
+	}
+	return grace
+}
+
+// configHandler serves repo's config.
+func (s Shard) configHandler(w http.ResponseWriter, r *http.Request, repo string) {
+	switch r.Method {
+	case "GET":
+		c, err := btrfs.LoadConfig(repo)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(c); err != nil {
+			logError(r, err)
+		}
+	case "POST":
+		var c btrfs.Config
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := c.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if repo == s.dataRepo {
+			for _, url := range c.Replicas {
+				if _, err := newReplica(url); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+			}
+		}
+		c, err := btrfs.SaveConfig(repo, c)
+		if err == nil {
+			err = s.applyConfig(repo, c)
+		}
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(c); err != nil {
+			logError(r, err)
+		}
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+// copy.go pools the buffers that file data is copied through, serving and
+// archiving big files would otherwise allocate a new buffer for every copy.
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the pooled buffers.
+const copyBufferSize = 256 << 10
+
+var copyBuffers = sync.Pool{New: func() interface{} {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// copyBuffer is io.Copy with a pooled buffer. Like io.Copy it uses src's
+// WriteTo or dst's ReadFrom if they have one, which for files and sockets
+// lets the kernel move the data without copying it through userspace.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,186 @@
+package main
+
+// diffview.go serves what changed between two commits as a directory of its
+// own, so that jobs that consume a repo a commit at a time can read just
+// what's new rather than going through /diff and fetching each file:
+//
+//	/dav/<from>..<to>/<path>               the files added or changed in <to>
+//	                                       since <from>, over WebDAV
+//	GET /archive?from=<from>&commit=<to>   the same files as an archive
+//
+// Both have a .pfs-deleted file at the top listing, a line each, the files
+// that were in <from> and aren't in <to>. <from> and <to> can be commits,
+// branches or tags. Diff views are read-only and, like the rest of the
+// shard's API, only see the files this shard has.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// deletedManifest lists the files a diff view deleted.
+const deletedManifest = ".pfs-deleted"
+
+// diffView is what changed between two commits.
+type diffView struct {
+	from, to string
+	// changed holds the files that were added or changed, dirs the
+	// directories they're in, "" is the top.
+	changed map[string]bool
+	dirs    map[string]bool
+	deleted []string
+}
+
+// newDiffView works out what changed between from and to.
+func (s Shard) newDiffView(from, to string) (*diffView, error) {
+	v := &diffView{
+		from:    btrfs.Resolve(s.dataRepo, from),
+		to:      btrfs.Resolve(s.dataRepo, to),
+		changed: make(map[string]bool),
+		dirs:    map[string]bool{"": true},
+	}
+	var err error
+	if v.deleted, err = btrfs.FindDeleted(s.dataRepo, v.from, v.to); err != nil {
+		return nil, err
+	}
+	files, err := btrfs.FindNew(s.dataRepo, v.from, v.to)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		v.changed[file] = true
+		for dir := path.Dir(file); dir != "."; dir = path.Dir(dir) {
+			v.dirs[dir] = true
+		}
+	}
+	return v, nil
+}
+
+// manifest returns the contents of the view's deletedManifest.
+func (v *diffView) manifest() []byte {
+	if len(v.deleted) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(v.deleted, "\n") + "\n")
+}
+
+// diffRef splits a WebDAV ref of the form <from>..<to>, ok is false if ref
+// isn't one.
+func (s Shard) diffRef(ref string) (from, to string, ok bool) {
+	i := strings.Index(ref, "..")
+	if i <= 0 || i+2 == len(ref) {
+		return "", "", false
+	}
+	// Names can have .. in them.
+	if exists, _ := btrfs.FileExists(path.Join(s.dataRepo, ref)); exists {
+		return "", "", false
+	}
+	return ref[:i], ref[i+2:], true
+}
+
+// davDiff serves file, in the view of what changed between from and to,
+// over WebDAV. ref is from..to as it appeared in the url.
+func (s Shard) davDiff(w http.ResponseWriter, r *http.Request, ref, from, to, file string) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, LOCK, UNLOCK")
+		return
+	case "PROPFIND", "GET", "HEAD":
+	case "LOCK":
+		davLock(w, r)
+		return
+	case "UNLOCK":
+		w.WriteHeader(204)
+		return
+	default:
+		http.Error(w, "Diffs are read-only.", 403)
+		return
+	}
+	v, err := s.newDiffView(from, to)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if file == deletedManifest {
+		if r.Method == "PROPFIND" {
+			s.davPropfindDiff(w, r, v, ref, file)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(v.manifest())
+		return
+	}
+	if !v.changed[file] && !v.dirs[file] {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	if r.Method == "PROPFIND" {
+		s.davPropfindDiff(w, r, v, ref, file)
+		return
+	}
+	serveFile(w, r, path.Join(s.dataRepo, v.to, file))
+}
+
+// davPropfindDiff is davPropfind for diff views, directories only list what
+// changed under them.
+func (s Shard) davPropfindDiff(w http.ResponseWriter, r *http.Request, v *diffView, ref, file string) {
+	href := path.Join("/dav", ref, file)
+	top, err := btrfs.Stat(path.Join(s.dataRepo, v.to))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	manifest := davResponse{
+		Href: (&url.URL{Path: path.Join("/dav", ref, deletedManifest)}).EscapedPath(),
+		PropStat: davPropStat{
+			Prop: davProp{
+				DisplayName:      deletedManifest,
+				GetContentLength: fmt.Sprint(len(v.manifest())),
+				GetLastModified:  top.ModTime().UTC().Format(http.TimeFormat),
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+	ms := davMultiStatus{Xmlns: "DAV:"}
+	if file == deletedManifest {
+		ms.Responses = append(ms.Responses, manifest)
+	} else {
+		name := path.Join(s.dataRepo, v.to, file)
+		fi, err := btrfs.Stat(name)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		ms.Responses = append(ms.Responses, davEntry(href, fi))
+		if fi.IsDir() && r.Header.Get("Depth") != "0" {
+			infos, err := btrfs.ReadDir(name)
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+			for _, info := range infos {
+				child := path.Join(file, info.Name())
+				if v.changed[child] || v.dirs[child] {
+					ms.Responses = append(ms.Responses, davEntry(path.Join(href, info.Name()), info))
+				}
+			}
+			if file == "" {
+				ms.Responses = append(ms.Responses, manifest)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+// events.go lets clients subscribe to a stream of server-sent events, one for
+// each commit that lands on this shard, whether it was made locally or
+// arrived via replication.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+type broker struct {
+	lock        sync.Mutex
+	subscribers map[chan CommitEventMsg]bool
+}
+
+func newBroker() *broker {
+	return &broker{subscribers: make(map[chan CommitEventMsg]bool)}
+}
+
+func (b *broker) subscribe() chan CommitEventMsg {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := make(chan CommitEventMsg, 16)
+	b.subscribers[c] = true
+	return c
+}
+
+func (b *broker) unsubscribe(c chan CommitEventMsg) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subscribers, c)
+}
+
+// publish sends e to every subscriber. Subscribers that aren't keeping up
+// miss events rather than blocking commits.
+func (b *broker) publish(e CommitEventMsg) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for c := range b.subscribers {
+		select {
+		case c <- e:
+		default:
+			logger.Warn("dropping event for slow subscriber", "commit", e.Name)
+		}
+	}
+}
+
+// commitEvent builds the event for commit in repo.
+func commitEvent(repo, commit string) (CommitEventMsg, error) {
+	e := CommitEventMsg{
+		Name:   commit,
+		Branch: btrfs.GetMeta(path.Join(repo, commit), "branch"),
+		Parent: btrfs.GetMeta(path.Join(repo, commit), "parent"),
+	}
+	if e.Parent != "" {
+		files, err := btrfs.FindNew(repo, e.Parent, commit)
+		if err != nil {
+			return e, err
+		}
+		e.Files = len(files)
+	}
+	return e, nil
+}
+
+// newCommitMsg describes a commit that was just made.
+func (s Shard) newCommitMsg(commit string) (NewCommitMsg, error) {
+	e, err := commitEvent(s.dataRepo, commit)
+	if err != nil {
+		return NewCommitMsg{}, err
+	}
+	fi, err := btrfs.Stat(path.Join(s.dataRepo, commit))
+	if err != nil {
+		return NewCommitMsg{}, err
+	}
+	transid, err := btrfs.Transid(s.dataRepo, commit)
+	if err != nil {
+		return NewCommitMsg{}, err
+	}
+	return NewCommitMsg{
+		Id:      commit,
+		Branch:  e.Branch,
+		Parent:  e.Parent,
+		TStamp:  fi.ModTime().Format("2006-01-02T15:04:05.999999-07:00"),
+		Files:   e.Files,
+		Transid: transid,
+	}, nil
+}
+
+// publishCommit publishes an event for commit to our subscribers and
+// webhooks.
+func (s Shard) publishCommit(commit string) {
+	e, err := commitEvent(s.dataRepo, commit)
+	if err != nil {
+		logger.Error("reading commit event", "commit", commit, "err", err)
+	}
+	s.events.publish(e)
+	s.notifyWebhooks(e)
+}
+
+// eventPusher wraps a Pusher and publishes an event for every commit that's
+// pushed through it.
+type eventPusher struct {
+	btrfs.Pusher
+	s Shard
+}
+
+func (p eventPusher) Push(ctx context.Context, diff io.Reader) error {
+	if err := p.Pusher.Push(ctx, diff); err != nil {
+		return err
+	}
+	commit, err := btrfs.GetFrom(p.s.dataRepo)
+	if err != nil {
+		return err
+	}
+	go p.s.publishCommit(commit)
+	return nil
+}
+
+// localReplica returns a replica of our data repo that publishes events for
+// the commits it receives.
+func (s Shard) localReplica() btrfs.Pusher {
+	return eventPusher{Pusher: btrfs.NewLocalReplica(s.dataRepo), s: s}
+}
+
+// EventsHandler streams commit events to the client until it disconnects.
+func (s Shard) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	flusher.Flush()
+	for {
+		select {
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				logError(r, err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: commit\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+// filediff.go serves diffs of a file's content between two commits:
+//
+//	GET /filediff?from=<commit>&to=<commit>&path=<file>
+//
+// from and to default to t0 and master, like /diff. Text files get a unified
+// diff, see textdiff.Unified, binary files and files over maxTextDiff get
+// the size and sha256 of each side instead. A file missing from one side is
+// diffed against /dev/null.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/textdiff"
+)
+
+// maxTextDiff is the largest file we make a text diff of.
+const maxTextDiff = 1 << 20
+
+// diffSide is one side of a file diff.
+type diffSide struct {
+	name   string
+	exists bool
+	size   int64
+	sum    string
+	// text is true if the file is text no bigger than maxTextDiff, data is
+	// its content.
+	text bool
+	data []byte
+}
+
+// readDiffSide reads the file name in commit for diffing.
+func (s Shard) readDiffSide(commit, name string) (diffSide, error) {
+	side := diffSide{name: path.Join(commit, name)}
+	f, err := openContent(path.Join(s.dataRepo, commit, name))
+	if os.IsNotExist(err) {
+		return side, nil
+	}
+	if err != nil {
+		return side, err
+	}
+	defer f.Close()
+	side.exists = true
+	sum := sha256.New()
+	buf := &limitedBuffer{max: maxTextDiff}
+	if side.size, err = io.Copy(io.MultiWriter(sum, buf), f); err != nil {
+		return side, err
+	}
+	side.sum = hex.EncodeToString(sum.Sum(nil))
+	side.text, side.data = !buf.over && textdiff.IsText(buf.data), buf.data
+	return side, nil
+}
+
+// limitedBuffer keeps what's written to it until it's been given more than
+// max bytes.
+type limitedBuffer struct {
+	max  int
+	data []byte
+	over bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if !b.over {
+		if len(b.data)+len(p) > b.max {
+			b.over, b.data = true, nil
+		} else {
+			b.data = append(b.data, p...)
+		}
+	}
+	return len(p), nil
+}
+
+// FileDiffHandler diffs a file's content between two commits.
+func (s Shard) FileDiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Query().Get("path")), "/")
+	if name == "" || strings.HasPrefix(name, ".") {
+		http.Error(w, fmt.Sprintf("Invalid path %s.", r.URL.Query().Get("path")), 400)
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = "t0"
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = "master"
+	}
+	var sides []diffSide
+	for _, commit := range []string{btrfs.Resolve(s.dataRepo, from), btrfs.Resolve(s.dataRepo, to)} {
+		exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit))
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+			return
+		}
+		side, err := s.readDiffSide(commit, name)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if !side.exists {
+			side.name = "/dev/null"
+		}
+		sides = append(sides, side)
+	}
+	a, b := sides[0], sides[1]
+	if !a.exists && !b.exists {
+		http.Error(w, fmt.Sprintf("File %s not found.", name), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if a.exists == b.exists && a.sum == b.sum {
+		return
+	}
+	if (a.text || !a.exists) && (b.text || !b.exists) {
+		fmt.Fprint(w, textdiff.Unified(a.name, b.name, a.data, b.data, 3))
+		return
+	}
+	fmt.Fprintf(w, "Binary files %s and %s differ\n", a.name, b.name)
+	for _, side := range []struct {
+		prefix string
+		diffSide
+	}{{"-", a}, {"+", b}} {
+		if side.exists {
+			fmt.Fprintf(w, "%s size: %d, sha256: %s\n", side.prefix, side.size, side.sum)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+// filemeta.go keeps metadata with individual files, like their content type
+// or the schema they were written with. It's passed in headers when a file
+// is written and handed back when it's read:
+//
+//	Content-Type:        stored in the user.pfs.content-type xattr
+//	X-Pfs-Meta-<key>:    stored in the user.pfs.meta.<key> xattr
+//
+// Keys are lower cased, like the headers they come from they're case
+// insensitive. Writing a file replaces all of its metadata. xattrs are
+// snapshotted and sent with everything else so commits and replicas keep
+// it, ?stat=true lists it too.
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"syscall"
+)
+
+const (
+	// metaHeaderPrefix starts the headers that carry user metadata.
+	metaHeaderPrefix = "X-Pfs-Meta-"
+	// metaAttrPrefix starts the xattrs that store it.
+	metaAttrPrefix  = "user.pfs.meta."
+	contentTypeAttr = "user.pfs.content-type"
+)
+
+// setFileMeta replaces the metadata of the file at abs, an absolute path,
+// with that in h.
+func setFileMeta(abs string, h http.Header) error {
+	attrs, err := listXattrs(abs)
+	if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		if attr == contentTypeAttr || strings.HasPrefix(attr, metaAttrPrefix) {
+			if err := syscall.Removexattr(abs, attr); err != nil && err != syscall.ENODATA {
+				return err
+			}
+		}
+	}
+	if contentType := h.Get("Content-Type"); contentType != "" {
+		if err := syscall.Setxattr(abs, contentTypeAttr, []byte(contentType), 0); err != nil {
+			return err
+		}
+	}
+	for key, values := range h {
+		key = http.CanonicalHeaderKey(key)
+		if !strings.HasPrefix(key, metaHeaderPrefix) || key == metaHeaderPrefix || len(values) == 0 {
+			continue
+		}
+		attr := metaAttrPrefix + strings.ToLower(strings.TrimPrefix(key, metaHeaderPrefix))
+		if err := syscall.Setxattr(abs, attr, []byte(values[0]), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileMeta returns the content type and user metadata of the file at abs,
+// an absolute path.
+func fileMeta(abs string) (string, map[string]string, error) {
+	attrs, err := listXattrs(abs)
+	if err != nil {
+		return "", nil, err
+	}
+	var contentType string
+	var meta map[string]string
+	for _, attr := range attrs {
+		if attr != contentTypeAttr && !strings.HasPrefix(attr, metaAttrPrefix) {
+			continue
+		}
+		value, err := getXattr(abs, attr)
+		if err != nil {
+			return "", nil, err
+		}
+		if attr == contentTypeAttr {
+			contentType = value
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.TrimPrefix(attr, metaAttrPrefix)] = value
+	}
+	return contentType, meta, nil
+}
+
+// writeFileMeta sets the headers of w from the metadata of the file at abs.
+func writeFileMeta(w http.ResponseWriter, abs string) error {
+	contentType, meta, err := fileMeta(abs)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	for key, value := range meta {
+		w.Header().Set(metaHeaderPrefix+key, value)
+	}
+	return nil
+}
+
+// listXattrs returns the names of the xattrs of the file at abs.
+func listXattrs(abs string) ([]string, error) {
+	size, err := syscall.Listxattr(abs, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(abs, buf)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the xattr attr of the file at abs.
+func getXattr(abs, attr string) (string, error) {
+	size, err := syscall.Getxattr(abs, attr, nil)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(abs, attr, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+// fsck.go checks our repos for inconsistencies, see btrfs.Fsck, and that the
+// last commit each replication target is recorded as having still exists:
+//
+//	GET  /fsck  reports problems
+//	POST /fsck  reports problems and repairs the ones it can
+//
+// A replication target whose last commit is gone has it forgotten by the
+// repair, so the next push sends it everything.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// fsckRepo checks repo.
+func fsckRepo(repo string, repair bool) (FsckMsg, error) {
+	problems, err := btrfs.Fsck(repo, repair)
+	if err != nil {
+		return FsckMsg{}, err
+	}
+	msg := FsckMsg{Repo: repo, Problems: []FsckProblemMsg{}}
+	for _, p := range problems {
+		msg.Problems = append(msg.Problems, FsckProblemMsg{Name: p.Name, Problem: p.Problem, Repaired: p.Repaired})
+	}
+	return msg, nil
+}
+
+// fsckReplicas checks that the last commits our replication targets are
+// recorded as having exist.
+func (s Shard) fsckReplicas(repair bool) ([]FsckProblemMsg, error) {
+	s.replicas.lock.Lock()
+	defer s.replicas.lock.Unlock()
+	replicas, err := s.loadReplicas()
+	if err != nil {
+		return nil, err
+	}
+	var problems []FsckProblemMsg
+	for i := range replicas {
+		if replicas[i].LastSync == "" {
+			continue
+		}
+		exists, err := btrfs.FileExists(path.Join(s.dataRepo, replicas[i].LastSync))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		problems = append(problems, FsckProblemMsg{
+			Name:     fmt.Sprintf("replica %s", replicas[i].Id),
+			Problem:  fmt.Sprintf("Last synced commit %s doesn't exist.", replicas[i].LastSync),
+			Repaired: repair,
+		})
+		replicas[i].LastSync = ""
+	}
+	if repair && len(problems) > 0 {
+		if err := s.saveReplicas(replicas); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// FsckHandler checks, and repairs, our repos.
+func (s Shard) FsckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	repair := r.Method == "POST"
+	var msgs []FsckMsg
+	err := timeOp(w, "btrfs.Fsck", func() error {
+		for _, repo := range []string{s.dataRepo, s.compRepo} {
+			msg, err := fsckRepo(repo, repair)
+			if err != nil {
+				return err
+			}
+			if repo == s.dataRepo {
+				problems, err := s.fsckReplicas(repair)
+				if err != nil {
+					return err
+				}
+				msg.Problems = append(msg.Problems, problems...)
+			}
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(msgs); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+// gc.go collects the chunks in the chunk store, see chunks.go, that no file
+// refers to any more:
+//
+//	GET  /admin/gc   reports what a collection would remove
+//	POST /admin/gc   removes it
+//
+// Chunks are shared by every repo on the volume so every file on it is
+// checked for a manifest, including those in commits, branches and other
+// shards' repos. Chunks written in the last ?grace=, the data repo's
+// configured gcGrace or an hour by default, are kept so that files being
+// written while we look aren't collected from under them. Commits that have been tiered aren't on the volume, their
+// chunks are collected like any others.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/chunk"
+)
+
+const defaultGCGrace = time.Hour
+
+// gcLock makes collections take turns.
+var gcLock sync.Mutex
+
+// referencedChunks returns the hashes of the chunks that files on the volume
+// refer to.
+func referencedChunks() (map[string]bool, error) {
+	blocks := btrfs.FilePath("blocks")
+	refs := make(map[string]bool)
+	err := filepath.Walk(btrfs.FilePath("."), func(name string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Deleted while we were looking, along with its references.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && name == blocks {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if _, err := syscall.Getxattr(name, chunkedAttr, make([]byte, 1)); err != nil {
+			return nil
+		}
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		m, err := chunk.ReadManifest(f)
+		if err != nil {
+			return fmt.Errorf("Reading the manifest of %s: %s", btrfs.TrimFilePath(name), err)
+		}
+		for _, ref := range m.Chunks {
+			refs[ref.Hash] = true
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// GCHandler collects unreferenced chunks.
+func (s Shard) GCHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	grace := s.gcGrace()
+	if g := r.URL.Query().Get("grace"); g != "" {
+		var err error
+		if grace, err = time.ParseDuration(g); err != nil || grace < 0 {
+			http.Error(w, fmt.Sprintf("Invalid grace %s.", g), 400)
+			return
+		}
+	}
+	dryRun := r.Method == "GET"
+	gcLock.Lock()
+	defer gcLock.Unlock()
+	// Anything written after this is kept, so it has to be taken before we
+	// look for manifests.
+	before := time.Now().Add(-grace)
+	var stats chunk.SweepStats
+	err := timeOp(w, "gc", func() error {
+		refs, err := referencedChunks()
+		if err != nil {
+			return err
+		}
+		stats, err = chunks.Sweep(func(hash string) bool { return refs[hash] }, before, dryRun)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	msg := GCMsg{Kept: stats.Kept, Removed: stats.Removed, Bytes: stats.Bytes, DryRun: dryRun}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
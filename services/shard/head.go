@@ -0,0 +1,50 @@
+package main
+
+// head.go serves GET /head?branch=<branch>, the commit at the head of a
+// branch. Every read endpoint takes a commit where it takes a branch, so a
+// job that reads the head once and passes it on every request sees the
+// branch as it was then, however much it moves while the job runs.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// HeadHandler returns the head of a branch.
+func (s Shard) HeadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	branch := branchParam(r)
+	if err := btrfs.ValidName(branch); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	name := path.Join(s.dataRepo, branch)
+	exists, err := btrfs.FileExists(name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Branch %s not found.", branch), 404)
+		return
+	}
+	isCommit, err := btrfs.IsReadOnly(name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if isCommit {
+		http.Error(w, fmt.Sprintf("%s is a commit, not a branch.", branch), 400)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(HeadMsg{Branch: branch, Commit: btrfs.Head(s.dataRepo, branch)}); err != nil {
+		logError(r, err)
+	}
+}
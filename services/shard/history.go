@@ -0,0 +1,62 @@
+package main
+
+// history.go serves the history of files, see btrfs.History:
+//
+//	GET /file/<file>/history  lists the commits in which <file> changed
+//
+// ?commit= picks the branch, commit or tag whose history is followed, it
+// defaults to master, and ?limit= caps how many changes are returned. The
+// router sends history requests to the shard that owns <file>, so a file
+// called history can't be read through /file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+const historySuffix = "/history"
+
+// isHistory returns true if r asks for a file's history.
+func isHistory(r *http.Request) bool {
+	return r.Method == "GET" && strings.HasSuffix(r.URL.Path, historySuffix)
+}
+
+// historyHandler serves the history of the file in r.
+func (s Shard) historyHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/file/"), historySuffix)
+	opts := btrfs.HistoryOptions{Size: contentSize}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %s.", limit), 400)
+			return
+		}
+	}
+	var changes []btrfs.FileChange
+	err := timeOp(w, "btrfs.History", func() error {
+		var err error
+		changes, err = btrfs.HistoryWithOptions(s.dataRepo, s.commitParam(r), name, opts)
+		return err
+	})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	msgs := []FileChangeMsg{}
+	for _, change := range changes {
+		msgs = append(msgs, FileChangeMsg{
+			Commit:  change.Commit,
+			TStamp:  change.Time.Format("2006-01-02T15:04:05.999999-07:00"),
+			Size:    change.Size,
+			Deleted: change.Deleted,
+		})
+	}
+	if err := json.NewEncoder(w).Encode(msgs); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+// hold.go lets readers pin a commit while they read several files from it,
+// see btrfs.Hold:
+//
+//	POST   /hold?commit=<commit>  holds a commit and returns a HoldMsg
+//	GET    /hold                  lists holds
+//	POST   /hold/<id>             renews a hold
+//	DELETE /hold/<id>             releases a hold
+//
+// GET /file/<file>?hold=<id> and GET /list?hold=<id> read from the held
+// snapshot, which stays readable even if the commit is deleted or garbage
+// collected meanwhile. Holds are leases, they expire ?ttl= after they're made
+// or renewed, 10 minutes by default, so that readers that go away don't pin
+// commits forever. ?id= names the hold, the router picks one so that every
+// shard uses the same. Holds are recorded in the volume so that they survive
+// restarts.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+const (
+	defaultHoldTTL = 10 * time.Minute
+	// maxHoldTTL bounds ?ttl=, longer readers have to renew their holds.
+	maxHoldTTL = 24 * time.Hour
+	// holdCheckInterval is how often we release expired holds.
+	holdCheckInterval = time.Minute
+	holdTimeFormat    = "2006-01-02T15:04:05.999999-07:00"
+)
+
+var (
+	errHoldNotFound = fmt.Errorf("Hold not found, it may have expired.")
+	errHoldExists   = fmt.Errorf("Hold already exists.")
+)
+
+type holdSet struct {
+	// lock guards the holds file and the snapshots.
+	lock sync.Mutex
+}
+
+func newHoldSet() *holdSet {
+	return &holdSet{}
+}
+
+func (s Shard) holdsFile() string {
+	return path.Join("holds", s.dataRepo, "leases")
+}
+
+// snapshotsDir is where holds' snapshots are.
+func (s Shard) snapshotsDir() string {
+	return path.Join("holds", s.dataRepo, "snapshots")
+}
+
+// holdPath returns where the snapshot for the hold id is.
+func (s Shard) holdPath(id string) string {
+	return path.Join(s.snapshotsDir(), id)
+}
+
+// loadHolds reads our holds from disk, callers must hold the lock.
+func (s Shard) loadHolds() ([]HoldMsg, error) {
+	exists, err := btrfs.FileExists(s.holdsFile())
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := btrfs.ReadFile(s.holdsFile())
+	if err != nil {
+		return nil, err
+	}
+	var holds []HoldMsg
+	if err := json.Unmarshal(data, &holds); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+// saveHolds writes our holds to disk, callers must hold the lock.
+func (s Shard) saveHolds(holds []HoldMsg) error {
+	data, err := json.Marshal(holds)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(path.Dir(s.holdsFile())); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(s.holdsFile(), data)
+}
+
+func holdExpired(hold HoldMsg, now time.Time) bool {
+	expires, err := time.Parse(holdTimeFormat, hold.Expires)
+	return err != nil || !now.Before(expires)
+}
+
+func holdTTL(r *http.Request) (time.Duration, error) {
+	ttl := defaultHoldTTL
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		var err error
+		if ttl, err = time.ParseDuration(t); err != nil {
+			return 0, err
+		}
+		if ttl <= 0 || ttl > maxHoldTTL {
+			return 0, fmt.Errorf("ttl must be positive and at most %s.", maxHoldTTL)
+		}
+	}
+	return ttl, nil
+}
+
+// hold holds commit as id until ttl from now. Holding the same commit as the
+// same id again is a no-op so that holds can be retried.
+func (s Shard) hold(id, commit string, ttl time.Duration) (HoldMsg, error) {
+	s.holds.lock.Lock()
+	defer s.holds.lock.Unlock()
+	holds, err := s.loadHolds()
+	if err != nil {
+		return HoldMsg{}, err
+	}
+	for _, hold := range holds {
+		if hold.Id != id {
+			continue
+		}
+		if hold.Commit == commit && !holdExpired(hold, time.Now()) {
+			// A retry, the hold was made but the response got lost.
+			return hold, nil
+		}
+		return HoldMsg{}, errHoldExists
+	}
+	if err := btrfs.HoldAs(s.dataRepo, commit, s.holdPath(id)); err != nil {
+		return HoldMsg{}, err
+	}
+	hold := HoldMsg{Id: id, Commit: commit, Expires: time.Now().Add(ttl).Format(holdTimeFormat)}
+	if err := s.saveHolds(append(holds, hold)); err != nil {
+		btrfs.Release(s.holdPath(id))
+		return HoldMsg{}, err
+	}
+	return hold, nil
+}
+
+// renewHold makes the hold id expire ttl from now.
+func (s Shard) renewHold(id string, ttl time.Duration) (HoldMsg, error) {
+	s.holds.lock.Lock()
+	defer s.holds.lock.Unlock()
+	holds, err := s.loadHolds()
+	if err != nil {
+		return HoldMsg{}, err
+	}
+	now := time.Now()
+	for i, hold := range holds {
+		if hold.Id == id && !holdExpired(hold, now) {
+			holds[i].Expires = now.Add(ttl).Format(holdTimeFormat)
+			return holds[i], s.saveHolds(holds)
+		}
+	}
+	return HoldMsg{}, errHoldNotFound
+}
+
+// release releases the hold id.
+func (s Shard) release(id string) error {
+	s.holds.lock.Lock()
+	defer s.holds.lock.Unlock()
+	holds, err := s.loadHolds()
+	if err != nil {
+		return err
+	}
+	err = errHoldNotFound
+	var kept []HoldMsg
+	for _, hold := range holds {
+		if hold.Id == id {
+			err = nil
+		} else {
+			kept = append(kept, hold)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.saveHolds(kept); err != nil {
+		return err
+	}
+	btrfs.Release(s.holdPath(id))
+	return nil
+}
+
+// heldRoot returns the snapshot of the hold id, for reads to read from.
+func (s Shard) heldRoot(id string) (string, error) {
+	s.holds.lock.Lock()
+	defer s.holds.lock.Unlock()
+	holds, err := s.loadHolds()
+	if err != nil {
+		return "", err
+	}
+	for _, hold := range holds {
+		if hold.Id == id && !holdExpired(hold, time.Now()) {
+			return s.holdPath(id), nil
+		}
+	}
+	return "", errHoldNotFound
+}
+
+// heldCommit returns the commit the hold id holds, "" if there's no such
+// hold.
+func (s Shard) heldCommit(id string) string {
+	s.holds.lock.Lock()
+	defer s.holds.lock.Unlock()
+	holds, _ := s.loadHolds()
+	for _, hold := range holds {
+		if hold.Id == id {
+			return hold.Commit
+		}
+	}
+	return ""
+}
+
+// expireHolds releases the holds that have expired by now, along with any
+// snapshots left behind by a crash part way through holding a commit.
+func (s Shard) expireHolds(now time.Time) error {
+	s.holds.lock.Lock()
+	defer s.holds.lock.Unlock()
+	holds, err := s.loadHolds()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	var kept []HoldMsg
+	for _, hold := range holds {
+		if holdExpired(hold, now) {
+			logger.Info("hold expired", "id", hold.Id, "commit", hold.Commit)
+			continue
+		}
+		live[hold.Id] = true
+		kept = append(kept, hold)
+	}
+	if len(kept) != len(holds) {
+		if err := s.saveHolds(kept); err != nil {
+			return err
+		}
+	}
+	dir := s.snapshotsDir()
+	exists, err := btrfs.FileExists(dir)
+	if err != nil || !exists {
+		return err
+	}
+	snapshots, err := btrfs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if !live[snapshot.Name()] {
+			btrfs.Release(path.Join(dir, snapshot.Name()))
+		}
+	}
+	return nil
+}
+
+// RunHoldExpiry releases expired holds every holdCheckInterval until cancel
+// is closed.
+func (s Shard) RunHoldExpiry(cancel chan struct{}) {
+	ticker := time.NewTicker(holdCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := s.expireHolds(now); err != nil {
+				logger.Error("expiring holds", "err", err)
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// HoldHandler makes, lists, renews and releases holds.
+func (s Shard) HoldHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(r.URL.Path, "/")
+	switch {
+	case len(url) == 2 && r.Method == "GET":
+		s.holds.lock.Lock()
+		holds, err := s.loadHolds()
+		s.holds.lock.Unlock()
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		sort.Slice(holds, func(i, j int) bool { return holds[i].Id < holds[j].Id })
+		encoder := json.NewEncoder(w)
+		now := time.Now()
+		for _, hold := range holds {
+			if holdExpired(hold, now) {
+				continue
+			}
+			if err := encoder.Encode(hold); err != nil {
+				logError(r, err)
+				return
+			}
+		}
+	case len(url) == 2 && r.Method == "POST":
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			id = uuid.New()
+		}
+		if err := btrfs.ValidName(id); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		ttl, err := holdTTL(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		commit := s.commitParam(r)
+		exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit))
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+			return
+		}
+		var hold HoldMsg
+		err = timeOp(w, "btrfs.Hold", func() error {
+			var err error
+			hold, err = s.hold(id, commit, ttl)
+			return err
+		})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(hold); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 3 && r.Method == "POST":
+		ttl, err := holdTTL(r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		hold, err := s.renewHold(url[2], ttl)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(hold); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 3 && r.Method == "DELETE":
+		if err := s.release(url[2]); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "Released hold %s.\n", url[2])
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
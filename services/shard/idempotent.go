@@ -0,0 +1,238 @@
+package main
+
+// idempotent.go makes writes safe to retry. Clients tag a write with an
+// `X-Request-Id` header or a `tag` parameter; once a tagged write succeeds its
+// response is recorded and retries with the same id get the recorded response
+// back rather than repeating the write. Records are keyed by the method, path
+// and branch as well as the id, so reusing an id for a different write doesn't
+// replay the wrong response, and they're kept outside the repo so that they
+// don't end up in commits. They expire after requestTTL.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+const (
+	// requestTTL is how long a retry can come after the write it retries.
+	requestTTL = 24 * time.Hour
+	// requestCheckInterval is how often we delete expired records.
+	requestCheckInterval = time.Hour
+)
+
+// requestId returns the id the client tagged r with, or "".
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("tag")
+}
+
+// requestRecord is what we store for a processed request.
+type requestRecord struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        string `json:"body"`
+}
+
+func (s Shard) requestsDir() string {
+	return path.Join("requests", s.dataRepo)
+}
+
+// recordKey identifies the write r to branch tagged with id.
+func recordKey(r *http.Request, branch, id string) string {
+	sum := sha256.Sum256([]byte(r.Method + "\n" + r.URL.Path + "\n" + branch + "\n" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadRequest returns the record for key, or nil if there isn't one or it's
+// expired.
+func (s Shard) loadRequest(key string) (*requestRecord, error) {
+	name := path.Join(s.requestsDir(), key)
+	exists, err := btrfs.FileExists(name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	fi, err := btrfs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(fi.ModTime()) > requestTTL {
+		return nil, nil
+	}
+	data, err := btrfs.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var record requestRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (s Shard) saveRequest(key string, record requestRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(s.requestsDir()); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(path.Join(s.requestsDir(), key), data)
+}
+
+// expireRequests deletes the records that are older than requestTTL at now.
+func (s Shard) expireRequests(now time.Time) error {
+	exists, err := btrfs.FileExists(s.requestsDir())
+	if err != nil || !exists {
+		return err
+	}
+	records, err := btrfs.ReadDir(s.requestsDir())
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if now.Sub(record.ModTime()) > requestTTL {
+			if err := btrfs.Remove(path.Join(s.requestsDir(), record.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunRequestExpiry deletes expired records every requestCheckInterval until
+// cancel is closed.
+func (s Shard) RunRequestExpiry(cancel chan struct{}) {
+	ticker := time.NewTicker(requestCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := s.expireRequests(now); err != nil {
+				logger.Error("expiring requests", "err", err)
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// pendingRequests are the tagged requests currently being processed, it
+// stops concurrent retries from both doing the write.
+type pendingRequests struct {
+	lock    sync.Mutex
+	pending map[string]bool
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{pending: make(map[string]bool)}
+}
+
+func (p *pendingRequests) begin(key string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending[key] {
+		return false
+	}
+	p.pending[key] = true
+	return true
+}
+
+func (p *pendingRequests) end(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.pending, key)
+}
+
+// recordingWriter keeps a copy of the response so that it can be recorded.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idempotent runs h, a write to branch, unless r is tagged with an id that's
+// already been processed for the same write in which case the original
+// response is replayed. Only successful responses are recorded so failed writes can be
+// retried.
+func (s Shard) idempotent(w http.ResponseWriter, r *http.Request, branch string, h http.HandlerFunc) {
+	id := requestId(r)
+	if id == "" {
+		h(w, r)
+		return
+	}
+	if !validId(id) {
+		http.Error(w, fmt.Sprintf("Invalid request id %s.", id), 400)
+		return
+	}
+	w.Header().Set("X-Request-Id", id)
+	key := recordKey(r, branch, id)
+	if !s.pending.begin(key) {
+		http.Error(w, fmt.Sprintf("Request %s is already in progress.", id), http.StatusConflict)
+		return
+	}
+	defer s.pending.end(key)
+
+	record, err := s.loadRequest(key)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if record != nil {
+		if record.ContentType != "" {
+			w.Header().Set("Content-Type", record.ContentType)
+		}
+		w.WriteHeader(record.Status)
+		fmt.Fprint(w, record.Body)
+		return
+	}
+
+	rw := &recordingWriter{ResponseWriter: w}
+	h(rw, r)
+	if rw.status == 0 {
+		rw.status = 200
+	}
+	if rw.status >= 300 {
+		return
+	}
+	err = s.saveRequest(key, requestRecord{
+		Status:      rw.status,
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        rw.body.String(),
+	})
+	if err != nil {
+		// The write happened, so all we can do is log. A retry will repeat it.
+		logError(r, err)
+	}
+}
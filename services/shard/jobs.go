@@ -0,0 +1,457 @@
+package main
+
+// jobs.go runs pipelines over new commits. Every commit queues a job for each
+// pipeline that reads the data repo, and every job that succeeds queues a job
+// for each pipeline that reads its outputs. Jobs run one at a time in the
+// order they were queued so that each run's delta starts where the last
+// one's ended:
+//
+//	GET /job             lists jobs, oldest first
+//	GET /job/<id>        a job's state, timing and exit code
+//	GET /job/<id>/logs   streams a job's output until it finishes
+//
+// A job's id is the output commit it makes, pipeline-<pipeline>-<commit>
+// where commit is the data repo commit that set it off. Listing jobs takes
+// ?pipeline=<name> and ?state=<state> filters, ?state=failed lists the
+// commits whose jobs failed every attempt their pipeline's retry policy
+// allowed.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/pipeline"
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobFailed    = "failed"
+	jobSucceeded = "succeeded"
+)
+
+// logPollInterval is how often we look for more output from a running job.
+var logPollInterval = 100 * time.Millisecond
+
+type queuedJob struct {
+	p   pipeline.Pipeline
+	job JobMsg
+}
+
+func finished(job JobMsg) bool {
+	return job.State == jobFailed || job.State == jobSucceeded
+}
+
+type byQueued []JobMsg
+
+func (j byQueued) Len() int      { return len(j) }
+func (j byQueued) Swap(a, b int) { j[a], j[b] = j[b], j[a] }
+func (j byQueued) Less(a, b int) bool {
+	ta, _ := time.Parse("2006-01-02T15:04:05.999999-07:00", j[a].Queued)
+	tb, _ := time.Parse("2006-01-02T15:04:05.999999-07:00", j[b].Queued)
+	return ta.Before(tb)
+}
+
+func (s Shard) jobsDir() string {
+	return path.Join("jobs", s.dataRepo)
+}
+
+// jobLog is where the output of the job with id goes.
+func (s Shard) jobLog(id string) string {
+	return path.Join("pipeline-logs", s.dataRepo, id)
+}
+
+// saveJob records job, callers must hold the lock.
+func (s Shard) saveJob(job JobMsg) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(s.jobsDir()); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(path.Join(s.jobsDir(), job.Id), data)
+}
+
+// loadJob reads the job with id, callers must hold the lock.
+func (s Shard) loadJob(id string) (JobMsg, error) {
+	var job JobMsg
+	data, err := btrfs.ReadFile(path.Join(s.jobsDir(), id))
+	if err != nil {
+		return job, err
+	}
+	err = json.Unmarshal(data, &job)
+	return job, err
+}
+
+// loadJobs reads every job, oldest first, callers must hold the lock.
+func (s Shard) loadJobs() ([]JobMsg, error) {
+	exists, err := btrfs.FileExists(s.jobsDir())
+	if err != nil || !exists {
+		return nil, err
+	}
+	infos, err := btrfs.ReadDir(s.jobsDir())
+	if err != nil {
+		return nil, err
+	}
+	var jobs []JobMsg
+	for _, info := range infos {
+		job, err := s.loadJob(info.Name())
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Sort(byQueued(jobs))
+	return jobs, nil
+}
+
+// getJob reads the job with id.
+func (s Shard) getJob(id string) (JobMsg, error) {
+	s.pipelines.lock.Lock()
+	defer s.pipelines.lock.Unlock()
+	return s.loadJob(id)
+}
+
+// updateJob applies f to the job with id and records the result.
+func (s Shard) updateJob(id string, f func(*JobMsg)) {
+	s.pipelines.lock.Lock()
+	defer s.pipelines.lock.Unlock()
+	job, err := s.loadJob(id)
+	if err != nil {
+		logger.Error("loading job", "job", id, "err", err)
+		return
+	}
+	f(&job)
+	if err := s.saveJob(job); err != nil {
+		logger.Error("saving job", "job", id, "err", err)
+	}
+}
+
+// queueJobs queues a job over commit for each pipeline that reads the data
+// repo.
+func (s Shard) queueJobs(commit string) error {
+	return s.queueReaders("", commit, commit)
+}
+
+// queueReaders queues a job over input for each pipeline that reads from the
+// pipeline from, commit is the data repo commit that started it all.
+// Scheduled pipelines don't run on every commit, the scheduler queues them.
+func (s Shard) queueReaders(from, commit, input string) error {
+	s.pipelines.lock.Lock()
+	defer s.pipelines.lock.Unlock()
+	pipelines, err := s.loadPipelines()
+	if err != nil {
+		return err
+	}
+	for _, p := range pipelines {
+		if p.From != from || p.Schedule != nil {
+			continue
+		}
+		if err := s.queueJob(p, commit, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueJob queues a job for p over input, callers must hold the lock.
+func (s Shard) queueJob(p pipeline.Pipeline, commit, input string) error {
+	job := JobMsg{
+		Id:       pipeline.OutputCommit(p.Name, commit),
+		Pipeline: p.Name,
+		Commit:   commit,
+		Input:    input,
+		State:    jobQueued,
+		Queued:   time.Now().Format("2006-01-02T15:04:05.999999-07:00"),
+	}
+	if err := s.saveJob(job); err != nil {
+		return err
+	}
+	s.pipelines.queue = append(s.pipelines.queue, queuedJob{p: p, job: job})
+	s.pipelines.ready.Broadcast()
+	return nil
+}
+
+// failInterruptedJobs fails the jobs that were queued or running when we
+// last stopped.
+func (s Shard) failInterruptedJobs() error {
+	s.pipelines.lock.Lock()
+	defer s.pipelines.lock.Unlock()
+	jobs, err := s.loadJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if finished(job) {
+			continue
+		}
+		job.State = jobFailed
+		job.Error = "Interrupted by a restart."
+		job.Finished = time.Now().Format("2006-01-02T15:04:05.999999-07:00")
+		if err := s.saveJob(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tryJob makes one attempt at running q.
+func (s Shard) tryJob(q queuedJob) (string, error) {
+	id := q.job.Id
+	job := pipeline.Job{
+		Pipeline: q.p,
+		Repo:     s.dataRepo,
+		Commit:   q.job.Input,
+		CompRepo: s.compRepo,
+		Output:   id,
+	}
+	if q.p.From != "" {
+		job.Repo = s.compRepo
+	}
+	var err error
+	if q.p.Shuffle {
+		if job.Spool, err = s.makeSpool(id); err != nil {
+			return "", err
+		}
+	}
+	logs, err := btrfs.OpenFile(s.jobLog(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if os.IsNotExist(err) {
+		logs, err = btrfs.CreateAll(s.jobLog(id))
+	}
+	if err != nil {
+		return "", err
+	}
+	output, err := pipeline.Run(job, pipeline.DefaultRunner(q.p), logs)
+	logs.Close()
+	if err != nil {
+		return "", err
+	}
+	if q.p.Shuffle {
+		if err := s.sendSpool(q.p.Name, q.job.Commit, job.Spool); err != nil {
+			return "", err
+		}
+	}
+	return output, nil
+}
+
+// runJob runs q, retrying it as its pipeline's retry policy says, and
+// records how it went. A job that fails every attempt stays failed so that
+// it doesn't hold up the commits after it.
+func (s Shard) runJob(q queuedJob) {
+	id := q.job.Id
+	s.updateJob(id, func(job *JobMsg) {
+		job.State = jobRunning
+		job.Started = time.Now().Format("2006-01-02T15:04:05.999999-07:00")
+	})
+	var output string
+	var err error
+	for attempt := 1; ; attempt++ {
+		s.updateJob(id, func(job *JobMsg) { job.Attempts = attempt })
+		if output, err = s.tryJob(q); err == nil || attempt >= q.p.Retry.Attempts {
+			break
+		}
+		logger.Warn("job attempt failed", "job", id, "attempt", attempt, "err", err)
+		time.Sleep(q.p.Retry.Delay(attempt))
+	}
+	s.updateJob(id, func(job *JobMsg) {
+		job.Finished = time.Now().Format("2006-01-02T15:04:05.999999-07:00")
+		if err != nil {
+			job.State = jobFailed
+			job.Error = err.Error()
+			if exitErr, ok := err.(*pipeline.ExitError); ok {
+				job.ExitCode = exitErr.Code
+			}
+			return
+		}
+		job.State = jobSucceeded
+		job.Output = output
+	})
+	if err != nil {
+		logger.Error("recording job success", "job", id, "err", err)
+		return
+	}
+	logger.Info("pipeline ran", "pipeline", q.p.Name, "input", q.job.Input, "output", output)
+	if q.p.Shuffle {
+		// The readers are queued once every shard's files are merged.
+		return
+	}
+	// Pipelines that read our outputs only run once they're committed.
+	if err := s.queueReaders(q.p.Name, q.job.Commit, output); err != nil {
+		logger.Error("queueing readers", "pipeline", q.p.Name, "err", err)
+	}
+}
+
+// runJobs runs queued jobs until the queue is stopped.
+func (s Shard) runJobs() {
+	for {
+		s.pipelines.lock.Lock()
+		for len(s.pipelines.queue) == 0 && !s.pipelines.stopped {
+			s.pipelines.ready.Wait()
+		}
+		if s.pipelines.stopped {
+			s.pipelines.lock.Unlock()
+			return
+		}
+		q := s.pipelines.queue[0]
+		s.pipelines.queue = s.pipelines.queue[1:]
+		s.pipelines.lock.Unlock()
+		s.runJob(q)
+	}
+}
+
+// RunPipelines queues jobs for each new commit and for scheduled pipelines
+// when they're due, and runs them until cancel is closed.
+func (s Shard) RunPipelines(cancel chan struct{}) {
+	if err := s.failInterruptedJobs(); err != nil {
+		logger.Error("failing interrupted jobs", "err", err)
+	}
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	go s.runJobs()
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if !s.runsPipelines() {
+				continue
+			}
+			if err := s.runSchedules(now); err != nil {
+				logger.Error("running schedules", "err", err)
+			}
+		case <-cancel:
+			s.pipelines.lock.Lock()
+			s.pipelines.stopped = true
+			s.pipelines.ready.Broadcast()
+			s.pipelines.lock.Unlock()
+			return
+		case e := <-events:
+			if !s.runsPipelines() {
+				continue
+			}
+			if err := s.queueJobs(e.Name); err != nil {
+				logger.Error("queueing jobs", "commit", e.Name, "err", err)
+			}
+		}
+	}
+}
+
+// runsPipelines returns true if we should run pipelines, replicas get their
+// inputs from the primary and leave running them to it.
+func (s Shard) runsPipelines() bool {
+	clustered, primary, _ := s.role.get()
+	return s.region.getUpstream() == "" && (!clustered || primary)
+}
+
+// streamJobLogs writes the output of the job with id to w as it's produced,
+// until the job finishes.
+func (s Shard) streamJobLogs(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported.", 500)
+		return
+	}
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		// We check the state before copying so that the last copy gets
+		// everything the job wrote.
+		job, err := s.getJob(id)
+		if err != nil {
+			logError(r, err)
+			return
+		}
+		if f == nil {
+			if f, err = btrfs.Open(s.jobLog(id)); err != nil && !os.IsNotExist(err) {
+				logError(r, err)
+				return
+			}
+			if err != nil {
+				// It hasn't started yet.
+				f = nil
+			}
+		}
+		if f != nil {
+			if _, err := copyBuffer(w, f); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if finished(job) {
+			return
+		}
+		select {
+		case <-closed:
+			return
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// PipelineJobHandler reports on pipeline jobs.
+func (s Shard) PipelineJobHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	// url looks like [, job], [, job, <id>] or [, job, <id>, logs]
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if len(url) == 2 {
+		s.pipelines.lock.Lock()
+		jobs, err := s.loadJobs()
+		s.pipelines.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		filtered := []JobMsg{}
+		for _, job := range jobs {
+			if name := r.URL.Query().Get("pipeline"); name != "" && job.Pipeline != name {
+				continue
+			}
+			if state := r.URL.Query().Get("state"); state != "" && job.State != state {
+				continue
+			}
+			filtered = append(filtered, job)
+		}
+		if err := json.NewEncoder(w).Encode(filtered); err != nil {
+			logError(r, err)
+		}
+		return
+	}
+	job, err := s.getJob(url[2])
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Job %s not found.", url[2]), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if len(url) == 4 && url[3] == "logs" {
+		s.streamJobLogs(w, r, job.Id)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		logError(r, err)
+	}
+}
@@ -3,14 +3,324 @@ package main
 // json.go contains json structures that shard will return in response to
 // requests.
 
-import ()
+import (
+	"time"
+)
 
 type BranchMsg struct {
 	Name   string `json:"name"`
 	TStamp string `json:"tstamp"`
+	// Head is the branch's last commit.
+	Head string `json:"head,omitempty"`
 }
 
 type CommitMsg struct {
 	Name   string `json:"name"`
 	TStamp string `json:"tstamp"`
+	// Transid is the commit's btrfs transid on this shard, see
+	// btrfs.Transid.
+	Transid uint64 `json:"transid,omitempty"`
+}
+
+// HeadMsg is the head of a branch.
+type HeadMsg struct {
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+}
+
+type HoldMsg struct {
+	Id      string `json:"id"`
+	Commit  string `json:"commit"`
+	Expires string `json:"expires"`
+}
+
+type NewCommitMsg struct {
+	Id      string `json:"id"`
+	Branch  string `json:"branch"`
+	Parent  string `json:"parent"`
+	TStamp  string `json:"tstamp"`
+	Files   int    `json:"files"`
+	Transid uint64 `json:"transid,omitempty"`
+}
+
+type ReplicaMsg struct {
+	Id           string `json:"id"`
+	Url          string `json:"url"`
+	LastSync     string `json:"lastSync,omitempty"`
+	LastSyncTime string `json:"lastSyncTime,omitempty"`
+	LastError    string `json:"lastError,omitempty"`
+	Lag          int    `json:"lag"`
+	LagError     string `json:"lagError,omitempty"`
+}
+
+type RoleMsg struct {
+	Shard   uint64 `json:"shard"`
+	Modulos uint64 `json:"modulos"`
+	Role    string `json:"role"`
+	Epoch   uint64 `json:"epoch"`
+	Commit  string `json:"commit"`
+}
+
+type ReshardPlanMsg struct {
+	Shard   uint64 `json:"shard"`
+	Modulos uint64 `json:"modulos"`
+	Files   int    `json:"files"`
+	Moving  int    `json:"moving"`
+}
+
+type ReshardMsg struct {
+	From   string `json:"from"`
+	Pruned int    `json:"pruned"`
+	// Taken is how many files were copied by POST /reshard?take=.
+	Taken int `json:"taken,omitempty"`
+}
+
+type OpTimingMsg struct {
+	Op       string        `json:"op"`
+	Duration time.Duration `json:"duration"`
+}
+
+type SlowRequestMsg struct {
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Route    string        `json:"route"`
+	Status   int           `json:"status"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Ops      []OpTimingMsg `json:"ops"`
+}
+
+type BucketMsg struct {
+	Le    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+type HistogramMsg struct {
+	Buckets []BucketMsg `json:"buckets"`
+	Inf     uint64      `json:"inf"`
+	Count   uint64      `json:"count"`
+	Sum     float64     `json:"sum"`
+}
+
+type RegionMsg struct {
+	Role      string `json:"role"`
+	Upstream  string `json:"upstream,omitempty"`
+	LastSync  string `json:"lastSync,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	Lag       int    `json:"lag"`
+	LagError  string `json:"lagError,omitempty"`
+}
+
+type FailoverMsg struct {
+	OldUpstream string `json:"oldUpstream"`
+	SyncError   string `json:"syncError,omitempty"`
+	Demoted     bool   `json:"demoted"`
+	DemoteError string `json:"demoteError,omitempty"`
+}
+
+type PartMsg struct {
+	Part int   `json:"part"`
+	Size int64 `json:"size"`
+}
+
+type CommitEventMsg struct {
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+	Parent string `json:"parent,omitempty"`
+	Files  int    `json:"files"`
+}
+
+// WatchEventMsg is a commit that changed files a /watch is watching.
+type WatchEventMsg struct {
+	Commit string `json:"commit"`
+	Branch string `json:"branch"`
+	// Parent is the commit the changes are since, it's "" for a branch's
+	// first commit.
+	Parent  string   `json:"parent,omitempty"`
+	Files   []string `json:"files,omitempty"`
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+type RepoMsg struct {
+	Name        string `json:"name"`
+	Compression string `json:"compression"`
+	// Quota is the repo's quota in bytes, 0 means it doesn't have one.
+	Quota int64 `json:"quota"`
+	// Permissions is true if the repo keeps the modes and owners files are
+	// written with.
+	Permissions bool `json:"permissions"`
+	// Frozen is true if the repo refuses writes, see lib/btrfs/freeze.go.
+	Frozen bool `json:"frozen"`
+}
+
+type UsageMsg struct {
+	Name  string `json:"name"`
+	Used  int64  `json:"used"`
+	Quota int64  `json:"quota"`
+}
+
+type RepoUsageMsg struct {
+	// Total is the whole repo's usage, it's only tracked for repos with a
+	// quota.
+	Total    *UsageMsg  `json:"total,omitempty"`
+	Branches []UsageMsg `json:"branches"`
+}
+
+type DuMsg struct {
+	Name      string `json:"name"`
+	Commit    bool   `json:"commit"`
+	Logical   int64  `json:"logical"`
+	Exclusive int64  `json:"exclusive"`
+	Shared    int64  `json:"shared"`
+}
+
+type FileInfoMsg struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Target string `json:"target,omitempty"`
+	Links  uint64 `json:"links"`
+	TStamp string `json:"tstamp"`
+	Mode   string `json:"mode"`
+	Uid    int    `json:"uid"`
+	Gid    int    `json:"gid"`
+
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	// Sha256 is the hex sha256 of a file's contents, if it was asked for.
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type FileChangeMsg struct {
+	Commit  string `json:"commit"`
+	TStamp  string `json:"tstamp"`
+	Size    int64  `json:"size"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type TagMsg struct {
+	Name   string `json:"name"`
+	Commit string `json:"commit"`
+}
+
+type TierMsg struct {
+	Commit string `json:"commit"`
+	Url    string `json:"url"`
+	Tiered string `json:"tiered"`
+}
+
+type ScrubMsg struct {
+	Started             string `json:"started"`
+	Finished            string `json:"finished"`
+	BytesScrubbed       int64  `json:"bytesScrubbed"`
+	CsumErrors          int64  `json:"csumErrors"`
+	ReadErrors          int64  `json:"readErrors"`
+	VerifyErrors        int64  `json:"verifyErrors"`
+	SuperErrors         int64  `json:"superErrors"`
+	CorrectedErrors     int64  `json:"correctedErrors"`
+	UncorrectableErrors int64  `json:"uncorrectableErrors"`
+	Error               string `json:"error,omitempty"`
+}
+
+type HealthMsg struct {
+	// Status is ok, corrupt if the last scrub found errors it couldn't
+	// correct, or catching up while the shard catches up with its
+	// upstreams, see catchup.go.
+	Status    string    `json:"status"`
+	LastScrub *ScrubMsg `json:"lastScrub,omitempty"`
+}
+
+type WebhookMsg struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// Branch limits the webhook to one branch's commits, "" means every
+	// branch.
+	Branch           string `json:"branch,omitempty"`
+	Secret           string `json:"secret,omitempty"`
+	LastDeliveryTime string `json:"lastDeliveryTime,omitempty"`
+	LastError        string `json:"lastError,omitempty"`
+}
+
+// WebhookEventMsg is the body POSTed to webhooks.
+type WebhookEventMsg struct {
+	Repo   string `json:"repo"`
+	Branch string `json:"branch"`
+	Commit string `json:"commit"`
+	Parent string `json:"parent,omitempty"`
+	Files  int    `json:"files"`
+}
+
+type JobMsg struct {
+	Id       string `json:"id"`
+	Pipeline string `json:"pipeline"`
+	// Commit is the data repo commit that set off the job, Input is the
+	// commit it runs over, the same commit or one of the outputs of the
+	// pipeline it reads from.
+	Commit   string `json:"commit"`
+	Input    string `json:"input"`
+	Output   string `json:"output,omitempty"`
+	State    string `json:"state"`
+	Queued   string `json:"queued"`
+	Started  string `json:"started,omitempty"`
+	Finished string `json:"finished,omitempty"`
+	Attempts int    `json:"attempts"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ProvenanceMsg is one step in the lineage of a commit. Repo is the data
+// repo or the comp repo, the rest is only set for pipeline outputs.
+type ProvenanceMsg struct {
+	Repo        string `json:"repo"`
+	Commit      string `json:"commit"`
+	Pipeline    string `json:"pipeline,omitempty"`
+	SpecHash    string `json:"specHash,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	DeltaFrom   string `json:"deltaFrom,omitempty"`
+}
+
+// FsckMsg lists the problems fsck found in a repo.
+type FsckMsg struct {
+	Repo     string           `json:"repo"`
+	Problems []FsckProblemMsg `json:"problems"`
+}
+
+type FsckProblemMsg struct {
+	// Name is the commit, branch or replica with the problem.
+	Name     string `json:"name"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// LimitsMsg holds the limits on writes to a branch, see limits.go. Limits
+// that are 0 don't apply.
+type LimitsMsg struct {
+	// Branch is a branch name or a pattern.
+	Branch         string `json:"branch"`
+	MaxFileSize    int64  `json:"maxFileSize,omitempty"`
+	MaxFiles       int    `json:"maxFiles,omitempty"`
+	MaxBytesPerSec int64  `json:"maxBytesPerSec,omitempty"`
+}
+
+// GCMsg reports a collection of the chunk store.
+type GCMsg struct {
+	// Kept is how many chunks are still referred to, or too new to collect.
+	Kept int `json:"kept"`
+	// Removed and Bytes are how many chunks were collected and their total
+	// size, with DryRun they're what would have been collected.
+	Removed int   `json:"removed"`
+	Bytes   int64 `json:"bytes"`
+	DryRun  bool  `json:"dryRun"`
+}
+
+// BatchFile is one line of an ndjson batch, Data is base64 encoded.
+type BatchFile struct {
+	Path string `json:"path"`
+	Data []byte `json:"data"`
+}
+
+// BatchMsg is the result of a batch write.
+type BatchMsg struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
 }
@@ -0,0 +1,227 @@
+package main
+
+// latency.go contains per-route latency histograms and a record of the
+// slowest requests the shard has served. Handlers can break their time down
+// in to sub-operations with timeOp, which is what makes a slow commit
+// diagnosable after the fact. The counters exported at /metrics are kept here
+// too, see metrics.go.
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the histogram buckets. Anything
+// slower than the last bucket is counted in an implicit +Inf bucket.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// nSlowRequests is the number of slow requests we hold on to.
+const nSlowRequests = 20
+
+type histogram struct {
+	counts []uint64 // len(latencyBuckets) + 1, the last one is +Inf
+	count  uint64
+	sum    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) msg() HistogramMsg {
+	res := HistogramMsg{Count: h.count, Sum: h.sum.Seconds()}
+	for i, b := range latencyBuckets {
+		res.Buckets = append(res.Buckets, BucketMsg{Le: b.Seconds(), Count: h.counts[i]})
+	}
+	res.Inf = h.counts[len(latencyBuckets)]
+	return res
+}
+
+type latencyTracker struct {
+	lock     sync.Mutex
+	routes   map[string]*histogram
+	slowest  []SlowRequestMsg // sorted slowest first
+	requests map[requestKey]uint64
+	bytesIn  map[string]uint64
+	bytesOut map[string]uint64
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		routes:   make(map[string]*histogram),
+		requests: make(map[requestKey]uint64),
+		bytesIn:  make(map[string]uint64),
+		bytesOut: make(map[string]uint64),
+	}
+}
+
+func (t *latencyTracker) record(route string, req SlowRequestMsg, bytesIn, bytesOut int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	h, ok := t.routes[route]
+	if !ok {
+		h = newHistogram()
+		t.routes[route] = h
+	}
+	h.observe(req.Duration)
+	t.requests[requestKey{route: route, method: req.Method, status: req.Status}]++
+	t.bytesIn[route] += uint64(bytesIn)
+	t.bytesOut[route] += uint64(bytesOut)
+
+	if len(t.slowest) == nSlowRequests && req.Duration <= t.slowest[nSlowRequests-1].Duration {
+		return
+	}
+	i := sort.Search(len(t.slowest), func(i int) bool { return t.slowest[i].Duration < req.Duration })
+	t.slowest = append(t.slowest, SlowRequestMsg{})
+	copy(t.slowest[i+1:], t.slowest[i:])
+	t.slowest[i] = req
+	if len(t.slowest) > nSlowRequests {
+		t.slowest = t.slowest[:nSlowRequests]
+	}
+}
+
+// tracedWriter is handed to handlers in place of the real ResponseWriter so
+// that we can see the status code and the sub-operations that were timed.
+type tracedWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	ops     []OpTimingMsg
+}
+
+func (w *tracedWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *tracedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom hands the copy to the underlying ResponseWriter if it can do it
+// itself. net/http's can, and sends files with sendfile, so http.ServeContent
+// doesn't copy files through userspace.
+func (w *tracedWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = copyBuffer(w.ResponseWriter, r)
+	}
+	w.written += n
+	return n, err
+}
+
+func (w *tracedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// wrap instruments h, recording its latency, status and the bytes it read and
+// wrote under route. Every request is also logged.
+func (t *latencyTracker) wrap(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tw := &tracedWriter{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		start := time.Now()
+		h(tw, r)
+		if tw.status == 0 {
+			tw.status = 200
+		}
+		req := SlowRequestMsg{
+			Method:   r.Method,
+			URL:      r.URL.String(),
+			Route:    route,
+			Status:   tw.status,
+			Start:    start,
+			Duration: time.Since(start),
+			Ops:      tw.ops,
+		}
+		t.record(route, req, body.read, tw.written)
+		logRequest(r, req, body.read, tw.written)
+	}
+}
+
+// wrappedWriter is implemented by ResponseWriters that wrap another, timeOp
+// looks through them to find the tracedWriter.
+type wrappedWriter interface {
+	unwrap() http.ResponseWriter
+}
+
+// timeOp runs f and, if w is being traced, records how long it took as op.
+func timeOp(w http.ResponseWriter, op string, f func() error) error {
+	start := time.Now()
+	err := f()
+	for {
+		ww, ok := w.(wrappedWriter)
+		if !ok {
+			break
+		}
+		w = ww.unwrap()
+	}
+	if tw, ok := w.(*tracedWriter); ok {
+		tw.ops = append(tw.ops, OpTimingMsg{Op: op, Duration: time.Since(start)})
+	}
+	return err
+}
+
+// SlowHandler reports the slowest requests served, slowest first.
+func (t *latencyTracker) SlowHandler(w http.ResponseWriter, r *http.Request) {
+	t.lock.Lock()
+	slowest := make([]SlowRequestMsg, len(t.slowest))
+	copy(slowest, t.slowest)
+	t.lock.Unlock()
+	if err := json.NewEncoder(w).Encode(slowest); err != nil {
+		logError(r, err)
+	}
+}
+
+// LatencyHandler reports a latency histogram for each route.
+func (t *latencyTracker) LatencyHandler(w http.ResponseWriter, r *http.Request) {
+	t.lock.Lock()
+	routes := make(map[string]HistogramMsg)
+	for route, h := range t.routes {
+		routes[route] = h.msg()
+	}
+	t.lock.Unlock()
+	if err := json.NewEncoder(w).Encode(routes); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+// limits.go caps what producers can write to a branch, so that one that's
+// misconfigured can't take over a shared cluster:
+//
+//	GET    /limits                   lists every branch's limits
+//	POST   /limits                   sets a branch's limits, the body is a LimitsMsg
+//	DELETE /limits?branch=<branch>   removes them
+//
+// A LimitsMsg's branch can be a pattern, like those in auth.go's grants,
+// limits set for the branch by name take precedence over patterns and
+// patterns are tried in the order they were set. Limits that are 0 don't
+// apply:
+//
+//	maxFileSize      bytes a file may grow to, writes past it get a 413
+//	maxFiles         files that may change between commits, a write that
+//	                 would change one more gets a 413
+//	maxBytesPerSec   bytes a second written to the branch, over a second's
+//	                 worth of burst, once it's exceeded writes get a 429
+//	                 with Retry-After until the branch has paid it back
+//
+// Limits apply to everything that writes files in to a branch: /file,
+// including completing multipart uploads, /batch, /archive and WebDAV.
+// Stripes are held to the limits of the whole file they're part of. Limits
+// are kept in the data repo so they survive restarts, rates are tracked per
+// shard.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/stripe"
+)
+
+// limitError is returned when a write goes over its branch's limits.
+type limitError struct {
+	status int
+	msg    string
+	// retryAfter is how long the client should back off for, 0 if it
+	// shouldn't retry.
+	retryAfter time.Duration
+}
+
+func (e limitError) Error() string {
+	return e.msg
+}
+
+// rateBucket tracks a branch's write rate. Writes take bytes from it and it
+// refills at the branch's rate, up to a second's worth. It goes negative
+// when a write takes more than it has, writes are refused until it's back.
+type rateBucket struct {
+	bytes float64
+	last  time.Time
+}
+
+type limitState struct {
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newLimitState() *limitState {
+	return &limitState{buckets: make(map[string]*rateBucket)}
+}
+
+// bucket returns branch's bucket, refilled at rate bytes a second. It must be
+// called with the lock held.
+func (l *limitState) bucket(branch string, rate int64) *rateBucket {
+	now := time.Now()
+	b, ok := l.buckets[branch]
+	if !ok {
+		b = &rateBucket{bytes: float64(rate), last: now}
+		l.buckets[branch] = b
+	}
+	b.bytes = math.Min(float64(rate), b.bytes+now.Sub(b.last).Seconds()*float64(rate))
+	b.last = now
+	return b
+}
+
+// wait returns how long writes to branch must wait before they're under
+// rate again.
+func (l *limitState) wait(branch string, rate int64) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.bucket(branch, rate)
+	if b.bytes >= 0 {
+		return 0
+	}
+	return time.Duration(-b.bytes / float64(rate) * float64(time.Second))
+}
+
+// take takes n bytes from branch's bucket.
+func (l *limitState) take(branch string, rate int64, n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.bucket(branch, rate).bytes -= float64(n)
+}
+
+func (s Shard) loadLimits() ([]LimitsMsg, error) {
+	data := btrfs.GetMeta(s.dataRepo, "limits")
+	if data == "" {
+		return nil, nil
+	}
+	var limits []LimitsMsg
+	if err := json.Unmarshal([]byte(data), &limits); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+func (s Shard) saveLimits(limits []LimitsMsg) error {
+	data, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	return btrfs.SetMeta(s.dataRepo, "limits", string(data))
+}
+
+// branchLimits returns the limits that apply to branch, false if there
+// aren't any.
+func (s Shard) branchLimits(branch string) (LimitsMsg, bool, error) {
+	limits, err := s.loadLimits()
+	if err != nil {
+		return LimitsMsg{}, false, err
+	}
+	for _, l := range limits {
+		if l.Branch == branch {
+			return l, true, nil
+		}
+	}
+	for _, l := range limits {
+		if match, _ := path.Match(l.Branch, branch); match {
+			return l, true, nil
+		}
+	}
+	return LimitsMsg{}, false, nil
+}
+
+// writeLimiter applies a branch's limits to the files a request writes. A nil
+// writeLimiter applies none.
+type writeLimiter struct {
+	branch string
+	limits LimitsMsg
+	state  *limitState
+	// changed holds the files that changed in the branch since its head
+	// commit, it's nil unless MaxFiles is set.
+	changed map[string]bool
+}
+
+// newWriteLimiter returns a writeLimiter for a request that writes to
+// branch. It fails if the branch is over its rate.
+func (s Shard) newWriteLimiter(branch string) (*writeLimiter, error) {
+	limits, ok, err := s.branchLimits(branch)
+	if err != nil || !ok {
+		return nil, err
+	}
+	l := &writeLimiter{branch: branch, limits: limits, state: s.limits}
+	if limits.MaxBytesPerSec != 0 {
+		if wait := s.limits.wait(branch, limits.MaxBytesPerSec); wait > 0 {
+			return nil, limitError{
+				status:     http.StatusTooManyRequests,
+				msg:        fmt.Sprintf("Branch %s is over its limit of %d bytes a second.", branch, limits.MaxBytesPerSec),
+				retryAfter: wait,
+			}
+		}
+	}
+	if limits.MaxFiles != 0 {
+		files, err := btrfs.FindNew(s.dataRepo, btrfs.Head(s.dataRepo, branch), branch)
+		if err != nil {
+			return nil, err
+		}
+		l.changed = make(map[string]bool)
+		for _, file := range files {
+			l.changed[file] = true
+		}
+	}
+	return l, nil
+}
+
+// file admits the file name, a path in the branch, being written at offset
+// with the data in r, of length bytes or -1 if that isn't known. It returns a
+// reader for the data that fails if it goes over the limits.
+func (l *writeLimiter) file(name string, offset, length int64, r io.Reader) (io.Reader, error) {
+	if l == nil {
+		return r, nil
+	}
+	if l.changed != nil && !l.changed[name] {
+		if len(l.changed) >= l.limits.MaxFiles {
+			return nil, limitError{
+				status: http.StatusRequestEntityTooLarge,
+				msg:    fmt.Sprintf("%d files have changed on branch %s, its limit is %d a commit.", len(l.changed), l.branch, l.limits.MaxFiles),
+			}
+		}
+		l.changed[name] = true
+	}
+	if l.limits.MaxFileSize != 0 && length >= 0 && offset+length > l.limits.MaxFileSize {
+		return nil, l.tooLarge(name)
+	}
+	return &limitedReader{l: l, name: name, r: r, remaining: l.limits.MaxFileSize - offset}, nil
+}
+
+func (l *writeLimiter) tooLarge(name string) error {
+	return limitError{
+		status: http.StatusRequestEntityTooLarge,
+		msg:    fmt.Sprintf("%s is over branch %s's limit of %d bytes a file.", name, l.branch, l.limits.MaxFileSize),
+	}
+}
+
+// limitedReader reads a file being written, it counts the bytes against the
+// branch's rate and fails once they're over its file size.
+type limitedReader struct {
+	l         *writeLimiter
+	name      string
+	r         io.Reader
+	remaining int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.l.limits.MaxBytesPerSec != 0 {
+		r.l.state.take(r.l.branch, r.l.limits.MaxBytesPerSec, n)
+	}
+	if r.l.limits.MaxFileSize != 0 {
+		if r.remaining -= int64(n); r.remaining < 0 {
+			return n, r.l.tooLarge(r.name)
+		}
+	}
+	return n, err
+}
+
+// limitWrite applies the limits of r's branch to the file it writes to
+// branch, fs, replacing its body with one that enforces them.
+func (s Shard) limitWrite(r *http.Request, fs string) error {
+	l, err := s.newWriteLimiter(branchParam(r))
+	if err != nil || l == nil {
+		return err
+	}
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/file/")
+	length := r.ContentLength
+	if size := r.URL.Query().Get(stripe.SizeParam); size != "" {
+		// A stripe, or the manifest, of a striped file. It's the whole
+		// file that's limited.
+		if length, err = strconv.ParseInt(size, 10, 64); err != nil || length < 0 {
+			return fmt.Errorf("%w: invalid %s %s", btrfs.ErrInvalidName, stripe.SizeParam, size)
+		}
+		if _, striped, _ := stripeParam(r); striped {
+			name = path.Dir(strings.TrimPrefix(name, ".meta/stripes/"))
+		}
+	}
+	var offset int64
+	if r.Method == "PATCH" {
+		if r.URL.Query().Get("append") == "true" {
+			if fi, err := btrfs.Stat(path.Join(fs, name)); err == nil {
+				offset = fi.Size()
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+		} else {
+			// Invalid offsets are rejected by patchFile.
+			offset, _ = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		}
+	}
+	body, err := l.file(name, offset, length, r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	return nil
+}
+
+// LimitsHandler lists and sets branches' limits.
+func (s Shard) LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		limits, err := s.loadLimits()
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if limits == nil {
+			limits = []LimitsMsg{}
+		}
+		if err := json.NewEncoder(w).Encode(limits); err != nil {
+			logError(r, err)
+		}
+	case "POST":
+		var msg LimitsMsg
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, err := path.Match(msg.Branch, ""); err != nil || msg.Branch == "" {
+			http.Error(w, fmt.Sprintf("Invalid branch %s.", msg.Branch), 400)
+			return
+		}
+		if msg.MaxFileSize < 0 || msg.MaxFiles < 0 || msg.MaxBytesPerSec < 0 {
+			http.Error(w, "Limits can't be negative.", 400)
+			return
+		}
+		err := s.updateLimits(func(limits []LimitsMsg) []LimitsMsg {
+			for i := range limits {
+				if limits[i].Branch == msg.Branch {
+					limits[i] = msg
+					return limits
+				}
+			}
+			return append(limits, msg)
+		})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	case "DELETE":
+		branch := r.URL.Query().Get("branch")
+		found := false
+		err := s.updateLimits(func(limits []LimitsMsg) []LimitsMsg {
+			for i := range limits {
+				if limits[i].Branch == branch {
+					found = true
+					return append(limits[:i], limits[i+1:]...)
+				}
+			}
+			return limits
+		})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Branch %s has no limits.", branch), 404)
+			return
+		}
+		fmt.Fprintf(w, "Removed the limits of %s.\n", branch)
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+// updateLimits replaces our limits with the result of f.
+func (s Shard) updateLimits(f func([]LimitsMsg) []LimitsMsg) error {
+	s.limits.lock.Lock()
+	defer s.limits.lock.Unlock()
+	limits, err := s.loadLimits()
+	if err != nil {
+		return err
+	}
+	return s.saveLimits(f(limits))
+}
+
+// isLimitError returns true if err is a write going over its limits.
+func isLimitError(err error) bool {
+	var limitErr limitError
+	return errors.As(err, &limitErr)
+}
@@ -0,0 +1,96 @@
+package main
+
+// links.go serves symlinks and hard links, see btrfs.CreateSymlink:
+//
+//	POST /file/<file>?branch=<branch>&symlink=<target>  makes <file> a symlink
+//	POST /file/<file>?branch=<branch>&link=<existing>   hard links <file> to <existing>
+//	GET  /file/<file>?commit=<commit>&stat=true         describes <file>
+//
+// With &checksum=true a description of a file includes the sha256 of its
+// contents, which takes reading them, clients use it to skip files they
+// already have. Striped files don't have one. Reading a symlink through
+// /file follows it. Hard links can only be made
+// between files on the same shard, in a cluster that's rarely the case.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// createLink makes name, in the snapshot fs, a symlink or a hard link
+// depending on r's parameters.
+func createLink(w http.ResponseWriter, r *http.Request, fs, name string) {
+	if target := r.URL.Query().Get("symlink"); target != "" {
+		if err := timeOp(w, "btrfs.CreateSymlink", func() error { return btrfs.CreateSymlink(fs, name, target) }); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "Created %s -> %s.\n", name, target)
+		return
+	}
+	existing := r.URL.Query().Get("link")
+	if err := timeOp(w, "btrfs.CreateLink", func() error { return btrfs.CreateLink(fs, name, existing) }); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fmt.Fprintf(w, "Linked %s to %s.\n", name, existing)
+}
+
+// fileChecksum returns the hex sha256 of the contents of name.
+func fileChecksum(name string) (string, error) {
+	f, err := openContent(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// statFile describes name, in the snapshot fs, as JSON.
+func statFile(w http.ResponseWriter, r *http.Request, fs, name string) {
+	info, err := btrfs.StatFile(fs, name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	msg := FileInfoMsg{
+		Name:   info.Name,
+		Type:   info.Type,
+		Size:   info.Size,
+		Target: info.Target,
+		Links:  info.Links,
+		TStamp: info.ModTime.Format("2006-01-02T15:04:05.999999-07:00"),
+		Mode:   fmt.Sprintf("%04o", unixPerm(info.Mode)),
+		Uid:    info.Uid,
+		Gid:    info.Gid,
+	}
+	// Reading xattrs follows symlinks, so only regular files report their
+	// metadata.
+	if info.Type == btrfs.TypeFile {
+		abs := btrfs.FilePath(path.Join(fs, info.Name))
+		if msg.ContentType, msg.Meta, err = fileMeta(abs); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if _, striped := stripes(abs); r.URL.Query().Get("checksum") == "true" && !striped {
+			if msg.Sha256, err = fileChecksum(path.Join(fs, info.Name)); err != nil {
+				httpError(w, r, err)
+				return
+			}
+		}
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+// list.go lists the files in a commit, and lets the list, diff and archive
+// endpoints pick out some of them:
+//
+//	GET /list?commit=<commit>   lists the files in <commit>
+//
+// ?glob= keeps the files matching a pattern, see btrfs.MatchGlob, ?prefix=
+// the files whose paths start with a prefix. Both are relative to the
+// commit. Lists are JSON arrays of paths, newline delimited with Accept:
+// text/plain, like /diff, or a JSON string per line with Accept:
+// application/x-ndjson. They're written as the files are found.
+//
+// Files are listed in the order of btrfs.ComparePaths. ?limit= returns a
+// page of at most that many files, pass the last of them as ?after= to get
+// the next page. GET /commit pages through commits the same way.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// fileFilter returns a func that matches the files r asks for, or nil if it
+// asks for all of them.
+func fileFilter(r *http.Request) (func(name string) bool, error) {
+	glob := strings.TrimPrefix(r.URL.Query().Get("glob"), "/")
+	prefix := strings.TrimPrefix(r.URL.Query().Get("prefix"), "/")
+	if glob == "" && prefix == "" {
+		return nil, nil
+	}
+	if err := btrfs.ValidGlob(glob); err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		return strings.HasPrefix(name, prefix) && (glob == "" || btrfs.MatchGlob(glob, name))
+	}, nil
+}
+
+// listOptions returns the page of a listing r asks for with ?limit= and
+// ?after=.
+func listOptions(r *http.Request) (btrfs.ListOptions, error) {
+	opts := btrfs.ListOptions{After: r.URL.Query().Get("after")}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil || opts.Limit < 0 {
+			return opts, fmt.Errorf("Invalid limit %s.", limit)
+		}
+	}
+	return opts, nil
+}
+
+// fileListWriter writes a list of files in the format r asks for, as the
+// files are found.
+type fileListWriter struct {
+	w      io.Writer
+	format string
+	n      int
+}
+
+func newFileListWriter(w http.ResponseWriter, r *http.Request) *fileListWriter {
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "text/plain"):
+		return &fileListWriter{w: w, format: "text"}
+	case strings.Contains(accept, "application/x-ndjson"):
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return &fileListWriter{w: w, format: "ndjson"}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return &fileListWriter{w: w, format: "json"}
+}
+
+func (l *fileListWriter) write(file string) error {
+	var err error
+	switch l.format {
+	case "text":
+		_, err = fmt.Fprintln(l.w, file)
+	case "ndjson":
+		err = json.NewEncoder(l.w).Encode(file)
+	default:
+		sep := ","
+		if l.n == 0 {
+			sep = "["
+		}
+		var data []byte
+		if data, err = json.Marshal(file); err == nil {
+			_, err = fmt.Fprintf(l.w, "%s%s", sep, data)
+		}
+	}
+	l.n++
+	return err
+}
+
+func (l *fileListWriter) close() error {
+	if l.format != "json" {
+		return nil
+	}
+	if l.n == 0 {
+		_, err := fmt.Fprintln(l.w, "[]")
+		return err
+	}
+	_, err := fmt.Fprintln(l.w, "]")
+	return err
+}
+
+// writeFileList writes files as r asks for, see list.go.
+func writeFileList(w http.ResponseWriter, r *http.Request, files []string) {
+	l := newFileListWriter(w, r)
+	for _, file := range files {
+		if err := l.write(file); err != nil {
+			logError(r, err)
+			return
+		}
+	}
+	if err := l.close(); err != nil {
+		logError(r, err)
+	}
+}
+
+// ListHandler lists the files in a commit, a page at a time if r asks for
+// one, writing them as they're found.
+func (s Shard) ListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if rejectInvalidRefs(w, r) {
+		return
+	}
+	opts, err := listOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if opts.Match, err = fileFilter(r); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	repo, commit := s.dataRepo, s.commitParam(r)
+	if id := r.URL.Query().Get("hold"); id != "" {
+		// Holds are snapshots outside the repo, see hold.go.
+		root, err := s.heldRoot(id)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		repo, commit = path.Split(root)
+	}
+	exists, err := btrfs.FileExists(path.Join(repo, commit))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+		return
+	}
+	l := newFileListWriter(w, r)
+	err = timeOp(w, "btrfs.WalkFiles", func() error {
+		return btrfs.WalkFiles(repo, commit, opts, l.write)
+	})
+	if err == nil {
+		err = l.close()
+	}
+	if err != nil {
+		// We've already started the list so all we can do is log and cut
+		// it short.
+		logError(r, err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// logging.go tags every request with an id, the one in its
+// logging.IdHeader if it came from another pfs service, otherwise a new one.
+// The id goes in the request's context, so lines logged for the request
+// carry it, and in to the requests we make to replicate what the request
+// did, so a write can be followed from the shard it landed on to its
+// replicas.
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/pachyderm/pfs/lib/logging"
+)
+
+// logger is what the shard logs to, main points it at the log file.
+var logger = slog.Default()
+
+// withRequestId gives requests to h an id and echoes it in the response.
+func withRequestId(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logging.IdHeader)
+		if id == "" {
+			id = logging.NewId()
+		}
+		w.Header().Set(logging.IdHeader, id)
+		h.ServeHTTP(w, r.WithContext(logging.WithId(r.Context(), id)))
+	})
+}
+
+// logError logs err, which r failed with.
+func logError(r *http.Request, err error) {
+	logger.ErrorContext(r.Context(), "request failed", "method", r.Method, "url", r.URL.String(), "err", err)
+}
+
+// detach returns a context for work that r starts but that outlives it, such
+// as replicating a commit. It carries r's id but is only cancelled when the
+// shard shuts down.
+func (s Shard) detach(r *http.Request) context.Context {
+	return logging.WithId(s.ctx, logging.Id(r.Context()))
+}
+
+// withContext returns req made under ctx, passing on ctx's request id.
+func withContext(ctx context.Context, req *http.Request) *http.Request {
+	if id := logging.Id(ctx); id != "" {
+		req.Header.Set(logging.IdHeader, id)
+	}
+	return req.WithContext(ctx)
+}
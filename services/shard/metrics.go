@@ -0,0 +1,120 @@
+package main
+
+// metrics.go exports the shard's request counters in the Prometheus text
+// format at /metrics and logs each request.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type requestKey struct {
+	route, method string
+	status        int
+}
+
+type requestKeys []requestKey
+
+func (k requestKeys) Len() int      { return len(k) }
+func (k requestKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k requestKeys) Less(i, j int) bool {
+	if k[i].route != k[j].route {
+		return k[i].route < k[j].route
+	}
+	if k[i].method != k[j].method {
+		return k[i].method < k[j].method
+	}
+	return k[i].status < k[j].status
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func logRequest(r *http.Request, req SlowRequestMsg, bytesIn, bytesOut int64) {
+	logger.InfoContext(r.Context(), "request", "method", req.Method, "route", req.Route, "url", req.URL, "status", req.Status,
+		"bytes_in", bytesIn, "bytes_out", bytesOut, "duration", req.Duration, "remote", r.RemoteAddr)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MetricsHandler writes our counters and latency histograms in the Prometheus
+// text format.
+func (t *latencyTracker) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var keys requestKeys
+	for k := range t.requests {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	fmt.Fprint(w, "# HELP pfs_requests_total Requests served, by route, method and status.\n")
+	fmt.Fprint(w, "# TYPE pfs_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "pfs_requests_total{route=%q,method=%q,code=\"%d\"} %d\n", k.route, k.method, k.status, t.requests[k])
+	}
+	errors := make(map[string]uint64)
+	for _, k := range keys {
+		if _, ok := errors[k.route]; !ok {
+			errors[k.route] = 0
+		}
+		if k.status >= 500 {
+			errors[k.route] += t.requests[k]
+		}
+	}
+	fmt.Fprint(w, "# HELP pfs_request_errors_total Requests that failed with a 5xx status, by route.\n")
+	fmt.Fprint(w, "# TYPE pfs_request_errors_total counter\n")
+	for _, route := range sortedKeys(errors) {
+		fmt.Fprintf(w, "pfs_request_errors_total{route=%q} %d\n", route, errors[route])
+	}
+	fmt.Fprint(w, "# HELP pfs_request_bytes_total Bytes read from request bodies, by route.\n")
+	fmt.Fprint(w, "# TYPE pfs_request_bytes_total counter\n")
+	for _, route := range sortedKeys(t.bytesIn) {
+		fmt.Fprintf(w, "pfs_request_bytes_total{route=%q} %d\n", route, t.bytesIn[route])
+	}
+	fmt.Fprint(w, "# HELP pfs_response_bytes_total Bytes written to response bodies, by route.\n")
+	fmt.Fprint(w, "# TYPE pfs_response_bytes_total counter\n")
+	for _, route := range sortedKeys(t.bytesOut) {
+		fmt.Fprintf(w, "pfs_response_bytes_total{route=%q} %d\n", route, t.bytesOut[route])
+	}
+
+	var routes []string
+	for route := range t.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprint(w, "# HELP pfs_request_duration_seconds Request latency, by route.\n")
+	fmt.Fprint(w, "# TYPE pfs_request_duration_seconds histogram\n")
+	for _, route := range routes {
+		h := t.routes[route]
+		// Prometheus buckets are cumulative, ours aren't.
+		var cumulative uint64
+		for i, b := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "pfs_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, strconv.FormatFloat(b.Seconds(), 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "pfs_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(w, "pfs_request_duration_seconds_sum{route=%q} %g\n", route, h.sum.Seconds())
+		fmt.Fprintf(w, "pfs_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+}
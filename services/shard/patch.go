@@ -0,0 +1,81 @@
+package main
+
+// patch.go writes parts of files in branches, so that producers like loggers
+// can grow a file across requests between commits:
+//
+//	PATCH /file/<file>?branch=<branch>&offset=<n>   writes the body at byte n
+//	PATCH /file/<file>?branch=<branch>&append=true  writes it at the end
+//
+// Files that don't exist are created. Offsets past the end of the file are
+// rejected rather than leaving a hole. Files kept in the chunk store, or
+// striped across shards, can't be patched, they have to be rewritten whole.
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// patchFile writes the body of r in to file, which is name in a branch.
+func patchFile(w http.ResponseWriter, r *http.Request, file, name string) {
+	appending := r.URL.Query().Get("append") == "true"
+	offsetParam := r.URL.Query().Get("offset")
+	if appending == (offsetParam != "") {
+		http.Error(w, "PATCH needs one of offset or append=true.", 400)
+		return
+	}
+	var size int64
+	f, err := btrfs.Open(file)
+	if err == nil {
+		fi, err := f.Stat()
+		if err == nil {
+			size = fi.Size()
+			if isChunked(f) {
+				err = fmt.Errorf("%s is in the chunk store, it can only be rewritten whole.", name)
+			} else if _, ok := stripes(f.Name()); ok {
+				err = fmt.Errorf("%s is striped, it can only be rewritten whole.", name)
+			}
+		}
+		f.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		httpError(w, r, err)
+		return
+	}
+	var offset, n int64
+	if !appending {
+		if offset, err = strconv.ParseInt(offsetParam, 10, 64); err != nil || offset < 0 {
+			http.Error(w, fmt.Sprintf("Invalid offset %s.", offsetParam), 400)
+			return
+		}
+		if offset > size {
+			http.Error(w, fmt.Sprintf("Offset %d is past the end of %s, which is %d bytes.", offset, name, size), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+	}
+	if err := btrfs.MkdirAll(path.Dir(file)); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	err = timeOp(w, "btrfs.WriteAt", func() error {
+		var err error
+		if appending {
+			offset, n, err = btrfs.Append(file, r.Body)
+		} else {
+			n, err = btrfs.WriteAt(file, offset, r.Body)
+		}
+		return err
+	})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fmt.Fprintf(w, "Wrote %d bytes to %s at offset %d.\n", n, name, offset)
+}
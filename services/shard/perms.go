@@ -0,0 +1,130 @@
+package main
+
+// perms.go sets the modes and owners of files in repos that preserve them,
+// see btrfs.SetPreservePermissions. They're passed in headers when a file is
+// written, anything left out is left as the shard made it:
+//
+//	X-Pfs-Mode:  the mode in octal, like 0755
+//	X-Pfs-Uid:   the owner's uid
+//	X-Pfs-Gid:   the owner's gid
+//
+// Reads of files in those repos return the same headers. Archives posted to
+// them keep the modes and owners in the tar headers.
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// filePerms is a mode and owner to give a file.
+type filePerms struct {
+	mode     os.FileMode
+	setMode  bool
+	uid, gid int
+}
+
+// permsHeaders returns the permissions in h, and false if it has none.
+func permsHeaders(h http.Header) (filePerms, bool, error) {
+	p := filePerms{uid: -1, gid: -1}
+	ok := false
+	if mode := h.Get("X-Pfs-Mode"); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 07777 {
+			return p, false, fmt.Errorf("Invalid mode %s.", mode)
+		}
+		p.mode, p.setMode, ok = unixMode(uint32(m)), true, true
+	}
+	for header, id := range map[string]*int{"X-Pfs-Uid": &p.uid, "X-Pfs-Gid": &p.gid} {
+		if value := h.Get(header); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return p, false, fmt.Errorf("Invalid %s %s.", header, value)
+			}
+			*id, ok = n, true
+		}
+	}
+	return p, ok, nil
+}
+
+// unixMode turns the permission bits of a unix mode in to an os.FileMode.
+func unixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// apply gives the file name p's mode and owner.
+func (p filePerms) apply(name string) error {
+	if p.setMode {
+		if err := btrfs.Chmod(name, p.mode); err != nil {
+			return err
+		}
+	}
+	if p.uid == -1 && p.gid == -1 {
+		return nil
+	}
+	return btrfs.Lchown(name, p.uid, p.gid)
+}
+
+// repoOf returns the repo that the snapshot fs, <repo>/<commit>, is in.
+func repoOf(fs string) string {
+	return strings.SplitN(fs, "/", 2)[0]
+}
+
+// checkPerms returns the permissions r asks for files in fs to have, it's an
+// error to ask in a repo that doesn't preserve them.
+func checkPerms(fs string, r *http.Request) (filePerms, bool, error) {
+	p, ok, err := permsHeaders(r.Header)
+	if err != nil || !ok {
+		return p, false, err
+	}
+	if !btrfs.PreservesPermissions(repoOf(fs)) {
+		return p, false, fmt.Errorf("Repo %s doesn't preserve permissions.", repoOf(fs))
+	}
+	return p, true, nil
+}
+
+// writePerms sets the permission headers of w from name, a file in a repo
+// that preserves them.
+func writePerms(w http.ResponseWriter, name string) error {
+	if !btrfs.PreservesPermissions(repoOf(name)) {
+		return nil
+	}
+	info, err := btrfs.StatFile(path.Dir(name), path.Base(name))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Pfs-Mode", fmt.Sprintf("%04o", unixPerm(info.Mode)))
+	w.Header().Set("X-Pfs-Uid", strconv.Itoa(info.Uid))
+	w.Header().Set("X-Pfs-Gid", strconv.Itoa(info.Gid))
+	return nil
+}
+
+// unixPerm is the reverse of unixMode.
+func unixPerm(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
@@ -0,0 +1,207 @@
+package main
+
+// pipeline.go lets users register pipelines that run over every new commit
+// and write their outputs to the comp repo:
+//
+//	POST   /pipeline                     registers a pipeline, the body is a pipeline.Pipeline
+//	GET    /pipeline                     lists pipelines
+//	DELETE /pipeline/<name>              removes a pipeline
+//	GET    /pipeline/<name>/file/<file>  reads an output, ?commit=<input commit> picks the run
+//
+// Pipelines are recorded in the volume so that they survive restarts. Only
+// the shard that takes writes runs them, see jobs.go.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/pipeline"
+)
+
+type pipelineSet struct {
+	// lock guards the pipelines file, the job records and the queue.
+	lock sync.Mutex
+	// ready is signalled when jobs are queued.
+	ready   *sync.Cond
+	queue   []queuedJob
+	stopped bool
+	// shuffleLock makes sure only one shard's shuffled files are being
+	// counted at a time, so that they're only merged once.
+	shuffleLock sync.Mutex
+}
+
+func newPipelineSet() *pipelineSet {
+	p := &pipelineSet{}
+	p.ready = sync.NewCond(&p.lock)
+	return p
+}
+
+func (s Shard) pipelinesFile() string {
+	return path.Join("pipelines", s.dataRepo)
+}
+
+// loadPipelines reads our pipelines from disk, callers must hold the lock.
+func (s Shard) loadPipelines() ([]pipeline.Pipeline, error) {
+	exists, err := btrfs.FileExists(s.pipelinesFile())
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := btrfs.ReadFile(s.pipelinesFile())
+	if err != nil {
+		return nil, err
+	}
+	var pipelines []pipeline.Pipeline
+	if err := json.Unmarshal(data, &pipelines); err != nil {
+		return nil, err
+	}
+	return pipelines, nil
+}
+
+// savePipelines writes our pipelines to disk, callers must hold the lock.
+func (s Shard) savePipelines(pipelines []pipeline.Pipeline) error {
+	data, err := json.Marshal(pipelines)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(path.Dir(s.pipelinesFile())); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(s.pipelinesFile(), data)
+}
+
+// PipelineHandler manages our pipelines and serves their outputs.
+func (s Shard) PipelineHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	// url looks like [, pipeline], [, pipeline, <name>] or
+	// [, pipeline, <name>, file, <file>]
+	switch {
+	case len(url) == 2 && r.Method == "GET":
+		s.pipelines.lock.Lock()
+		pipelines, err := s.loadPipelines()
+		s.pipelines.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if pipelines == nil {
+			pipelines = []pipeline.Pipeline{}
+		}
+		if err := json.NewEncoder(w).Encode(pipelines); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 2 && r.Method == "POST":
+		if s.rejectWrite(w) {
+			return
+		}
+		if chunkFiles {
+			http.Error(w, errChunkStore.Error(), 409)
+			return
+		}
+		var p pipeline.Pipeline
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := p.Validate(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		s.pipelines.lock.Lock()
+		pipelines, err := s.loadPipelines()
+		// Pipelines can only read from pipelines that already exist, that
+		// way they can't form a cycle.
+		fromFound := p.From == ""
+		if err == nil {
+			for _, existing := range pipelines {
+				if existing.Name == p.Name {
+					err = errPipelineExists
+				}
+				if existing.Name == p.From {
+					fromFound = true
+				}
+			}
+		}
+		if err == nil && fromFound {
+			err = s.savePipelines(append(pipelines, p))
+		}
+		s.pipelines.lock.Unlock()
+		if err == errPipelineExists {
+			http.Error(w, fmt.Sprintf("Pipeline %s already exists.", p.Name), 409)
+			return
+		}
+		if err == nil && !fromFound {
+			http.Error(w, fmt.Sprintf("Pipeline %s reads from %s, which doesn't exist.", p.Name, p.From), 400)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(p); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 3 && r.Method == "DELETE":
+		if s.rejectWrite(w) {
+			return
+		}
+		s.pipelines.lock.Lock()
+		pipelines, err := s.loadPipelines()
+		found, reader := false, ""
+		if err == nil {
+			var kept []pipeline.Pipeline
+			for _, p := range pipelines {
+				if p.From == url[2] {
+					reader = p.Name
+				}
+				if p.Name == url[2] {
+					found = true
+					continue
+				}
+				kept = append(kept, p)
+			}
+			if found && reader == "" {
+				err = s.savePipelines(kept)
+			}
+			if err == nil && found && reader == "" {
+				// A pipeline registered with the same name runs right away.
+				err = btrfs.RemoveAll(s.triggeredFile(url[2]))
+			}
+		}
+		s.pipelines.lock.Unlock()
+		if reader != "" {
+			http.Error(w, fmt.Sprintf("Pipeline %s reads from %s, delete it first.", reader, url[2]), 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Pipeline %s not found.", url[2]), 404)
+			return
+		}
+		fmt.Fprintf(w, "Deleted pipeline %s.\n", url[2])
+	case len(url) > 4 && url[3] == "file" && r.Method == "GET":
+		fs := path.Join(s.compRepo, pipeline.Branch(url[2]))
+		if commit := r.URL.Query().Get("commit"); commit != "" {
+			if err := btrfs.ValidRef(commit); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			fs = path.Join(s.compRepo, pipeline.OutputCommit(url[2], btrfs.Resolve(s.dataRepo, commit)))
+		}
+		genericFileHandler(fs, w, r)
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+var errPipelineExists = fmt.Errorf("Pipeline already exists.")
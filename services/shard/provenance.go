@@ -0,0 +1,92 @@
+package main
+
+// provenance.go walks the lineage of pipeline outputs:
+//
+//	GET /provenance?commit=<commit>
+//
+// returns the commit followed by the commits it was made from, back to the
+// data repo commit that set it all off. Each output commit names the
+// pipeline that made it, a hash of the pipeline's spec and the digest of its
+// image, if it has one.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// provenance returns the lineage of commit of repo, starting with commit.
+func (s Shard) provenance(repo, commit string) ([]ProvenanceMsg, error) {
+	var lineage []ProvenanceMsg
+	for {
+		exists, err := btrfs.FileExists(path.Join(repo, commit))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("Commit %s of %s not found.", commit, repo)
+		}
+		msg := ProvenanceMsg{Repo: repo, Commit: commit}
+		if repo == s.dataRepo {
+			// Data repo commits are where lineages start.
+			return append(lineage, msg), nil
+		}
+		name := path.Join(repo, commit)
+		msg.Pipeline = btrfs.GetMeta(name, "pipeline")
+		msg.SpecHash = btrfs.GetMeta(name, "spec-hash")
+		msg.ImageDigest = btrfs.GetMeta(name, "image-digest")
+		msg.DeltaFrom = btrfs.GetMeta(name, "delta-from")
+		lineage = append(lineage, msg)
+		provenance := btrfs.GetMeta(name, "provenance")
+		switch {
+		case strings.HasPrefix(provenance, s.dataRepo+"/"):
+			repo, commit = s.dataRepo, strings.TrimPrefix(provenance, s.dataRepo+"/")
+		case strings.HasPrefix(provenance, s.compRepo+"/"):
+			repo, commit = s.compRepo, strings.TrimPrefix(provenance, s.compRepo+"/")
+		default:
+			return nil, fmt.Errorf("Commit %s of %s has no provenance.", commit, repo)
+		}
+	}
+}
+
+// ProvenanceHandler serves the lineage of a commit, which is either a
+// pipeline's output commit or a data repo commit.
+func (s Shard) ProvenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	commit := btrfs.Resolve(s.dataRepo, r.URL.Query().Get("commit"))
+	if err := btrfs.ValidName(commit); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	repo := s.compRepo
+	exists, err := btrfs.FileExists(path.Join(s.compRepo, commit))
+	if err == nil && !exists {
+		repo = s.dataRepo
+		exists, err = btrfs.FileExists(path.Join(s.dataRepo, commit))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+		return
+	}
+	lineage, err := s.provenance(repo, commit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(lineage); err != nil {
+		logError(r, err)
+	}
+}
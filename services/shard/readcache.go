@@ -0,0 +1,288 @@
+package main
+
+// readcache.go serves reads of commits this shard doesn't have. A shard only
+// has the commits that were made on it or replicated to it, a read of any
+// other commit is fetched from the shards we replicate with: the shard we
+// follow in the active region and our http replicas. Fetched files are kept
+// on disk, under cache/<repo>, so that repeated reads of popular commits
+// don't cross the network again. The cache is bounded by
+// PFS_READ_CACHE_SIZE, in bytes, and evicts the least recently read files
+// first; it's off if that's unset.
+//
+// Only files in commits are cached, they never change so there's nothing to
+// invalidate. Peers mark those with a strong ETag of the commit's name, see
+// etag, anything else is passed through without being cached.
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/stripe"
+)
+
+// cacheTmpPrefix starts the names of files that are still being fetched.
+const cacheTmpPrefix = ".tmp-"
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// readCache is an on disk LRU cache of files fetched from peers, keyed by
+// <commit>/<file>.
+type readCache struct {
+	lock sync.Mutex
+	dir  string // absolute path of the cache
+	max  int64
+	size int64
+	// lru holds *cacheEntry, the most recently read first.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// newReadCache returns a cache of up to max bytes in dir, an absolute path.
+// Files already in dir, from before a restart, are kept and ordered by when
+// they were last read.
+func newReadCache(dir string, max int64) (*readCache, error) {
+	c := &readCache{dir: dir, max: max, lru: list.New(), entries: make(map[string]*list.Element)}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	type found struct {
+		entry cacheEntry
+		read  time.Time
+	}
+	var files []found
+	err := filepath.Walk(dir, func(abs string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(fi.Name(), cacheTmpPrefix) {
+			return os.Remove(abs)
+		}
+		key, err := filepath.Rel(dir, abs)
+		if err != nil {
+			return err
+		}
+		files = append(files, found{cacheEntry{filepath.ToSlash(key), fi.Size()}, fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].read.Before(files[j].read) })
+	for _, f := range files {
+		entry := f.entry
+		c.entries[entry.key] = c.lru.PushFront(&entry)
+		c.size += entry.size
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// path returns the absolute path that key is stored at.
+func (c *readCache) path(key string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(key))
+}
+
+// get returns the path of key and true if it's cached, and marks it as read.
+func (c *readCache) get(key string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.lru.MoveToFront(e)
+	// The modification time is when the file was last read, so the order
+	// survives a restart.
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	return c.path(key), true
+}
+
+// fits returns true if a file of size bytes can be cached.
+func (c *readCache) fits(size int64) bool {
+	return size >= 0 && size <= c.max
+}
+
+// put caches the contents of r, which should be size bytes, as key and
+// returns its path.
+func (c *readCache) put(key string, r io.Reader, size int64) (string, error) {
+	f, err := os.CreateTemp(c.dir, cacheTmpPrefix)
+	if err != nil {
+		return "", err
+	}
+	n, err := copyBuffer(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("Fetched %d bytes of %s, expected %d.", n, key, size)
+	}
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(c.path(key)), 0777)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := os.Rename(f.Name(), c.path(key)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if e, ok := c.entries[key]; ok {
+		// Someone else fetched it at the same time.
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, n})
+	c.size += n
+	c.evict()
+	return c.path(key), nil
+}
+
+// evict removes the least recently read files until the cache fits, callers
+// must hold the lock. Readers that already have an evicted file open can
+// still finish reading it.
+func (c *readCache) evict() {
+	for c.size > c.max && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+			logger.Error("evicting cached file", "file", entry.key, "err", err)
+		}
+	}
+}
+
+// readSources returns the urls of the shards that reads of commits we don't
+// have can be fetched from.
+func (s Shard) readSources() ([]string, error) {
+	var sources []string
+	if upstream := s.region.getUpstream(); upstream != "" {
+		sources = append(sources, upstream)
+	}
+	s.replicas.lock.Lock()
+	replicas, err := s.loadReplicas()
+	s.replicas.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, replica := range replicas {
+		if isShard(replica.Url) {
+			sources = append(sources, strings.TrimSuffix(shardURL(replica.Url), "/"))
+		}
+	}
+	return sources, nil
+}
+
+// serveRemote serves r, a GET of a file, if it's for a commit we don't have
+// and that's been tiered, see tier.go, or one of our peers has. It returns
+// false if r should be served locally.
+func (s Shard) serveRemote(w http.ResponseWriter, r *http.Request) bool {
+	commit := s.commitParam(r)
+	if strings.Contains(commit, "/") || strings.Contains(r.URL.Path, "*") {
+		return false
+	}
+	if exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit)); err != nil || exists {
+		return false
+	}
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/file/")
+	key := path.Join(commit, name)
+	if s.readCache != nil {
+		if abs, ok := s.readCache.get(key); ok {
+			serveCached(w, r, abs, commit)
+			return true
+		}
+	}
+	stub, err := s.tierStub(commit)
+	if err != nil {
+		logError(r, err)
+		return false
+	}
+	if stub != nil {
+		s.serveTiered(w, r, stub, name, key)
+		return true
+	}
+	if s.readCache == nil {
+		return false
+	}
+
+	sources, err := s.readSources()
+	if err != nil {
+		logError(r, err)
+		return false
+	}
+	for _, source := range sources {
+		req, err := newPeerRequest("GET", fmt.Sprintf("%s/file/%s?commit=%s", source, name, commit), nil)
+		if err != nil {
+			logError(r, err)
+			continue
+		}
+		resp, err := http.DefaultClient.Do(withContext(r.Context(), req))
+		if err != nil {
+			logError(r, err)
+			continue
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			continue
+		}
+		defer resp.Body.Close()
+		cacheable := resp.Header.Get("ETag") == fmt.Sprintf("%q", commit) &&
+			resp.Header.Get(stripe.Header) == "" && s.readCache.fits(resp.ContentLength)
+		if !cacheable {
+			passThrough(w, r, resp)
+			return true
+		}
+		abs, err := s.readCache.put(key, resp.Body, resp.ContentLength)
+		if err != nil {
+			httpError(w, r, err)
+			return true
+		}
+		serveCached(w, r, abs, commit)
+		return true
+	}
+	return false
+}
+
+// serveCached serves the cached copy, at abs, of a file in commit.
+func serveCached(w http.ResponseWriter, r *http.Request, abs, commit string) {
+	f, err := os.Open(abs)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", fmt.Sprintf("%q", commit))
+	http.ServeContent(w, r, path.Base(r.URL.Path), time.Time{}, f)
+}
+
+// passThrough passes resp, a file we can't cache, through to w.
+func passThrough(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	for _, header := range []string{"Content-Type", "Content-Length", "ETag", "Last-Modified", stripe.Header} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := copyBuffer(w, resp.Body); err != nil {
+		logError(r, err)
+	}
+}
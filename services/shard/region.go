@@ -0,0 +1,214 @@
+package main
+
+// region.go implements active-passive multi region deployments. A shard in
+// the passive region continuously pulls from the matching shard in the active
+// region and refuses writes until it's promoted with POST /admin/failover.
+// Promotion reverses the direction of replication by asking the old active
+// shard to demote itself and follow us instead.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// regionSyncInterval is how often a passive shard pulls from upstream.
+var regionSyncInterval = 30 * time.Second
+
+type region struct {
+	lock     sync.Mutex
+	upstream string // url of the active shard we follow, "" means we're active
+	lastSync time.Time
+	lastErr  error
+}
+
+func (r *region) getUpstream() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.upstream
+}
+
+func (r *region) setUpstream(upstream string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.upstream = upstream
+	r.lastErr = nil
+}
+
+// passive returns true if this shard is following another region.
+func (s Shard) passive() bool {
+	return s.region.getUpstream() != ""
+}
+
+// rejectPassive writes an error and returns true if this shard can't accept
+// writes because it's in the passive region.
+func (s Shard) rejectPassive(w http.ResponseWriter) bool {
+	upstream := s.region.getUpstream()
+	if upstream == "" {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("This shard is a passive replica of %s, writes must go to the active region.", upstream), http.StatusServiceUnavailable)
+	return true
+}
+
+// syncFromUpstream pulls new commits from the active region.
+func (s Shard) syncFromUpstream() error {
+	upstream := s.region.getUpstream()
+	if upstream == "" {
+		return nil
+	}
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err == nil {
+		err = NewShardReplica(upstream).Pull(s.ctx, from, s.localReplica())
+	}
+	s.region.lock.Lock()
+	defer s.region.lock.Unlock()
+	s.region.lastErr = err
+	if err == nil {
+		s.region.lastSync = time.Now()
+	}
+	return err
+}
+
+// FollowUpstream keeps a passive shard up to date with the active region. It
+// loops until `cancel` is closed.
+func (s Shard) FollowUpstream(cancel chan struct{}) {
+	for {
+		if s.passive() {
+			if err := s.syncFromUpstream(); err != nil {
+				logger.Error("syncing from upstream", "err", err)
+			} else {
+				go s.SyncToPeers()
+			}
+		}
+		select {
+		case <-time.After(regionSyncInterval):
+			continue
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// upstreamLag returns the number of commits upstream has that we don't.
+func (s Shard) upstreamLag(upstream string) (int, error) {
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := peerRequest("GET", upstream+"/commit", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("Response with status: %s", resp.Status)
+	}
+	lag := 0
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var commit CommitMsg
+		if err := decoder.Decode(&commit); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if commit.Name == from {
+			break
+		}
+		lag++
+	}
+	return lag, nil
+}
+
+// RegionHandler reports this shard's role and, if passive, how far behind the
+// active region it is.
+func (s Shard) RegionHandler(w http.ResponseWriter, r *http.Request) {
+	s.region.lock.Lock()
+	msg := RegionMsg{Role: "active", Upstream: s.region.upstream}
+	if !s.region.lastSync.IsZero() {
+		msg.LastSync = s.region.lastSync.Format("2006-01-02T15:04:05.999999-07:00")
+	}
+	if s.region.lastErr != nil {
+		msg.LastError = s.region.lastErr.Error()
+	}
+	s.region.lock.Unlock()
+
+	if msg.Upstream != "" {
+		msg.Role = "passive"
+		lag, err := s.upstreamLag(msg.Upstream)
+		if err != nil {
+			logError(r, err)
+			msg.LagError = err.Error()
+		}
+		msg.Lag = lag
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
+
+// FailoverHandler promotes a passive shard to active. It makes one last
+// attempt to catch up, stops following upstream and then asks the old active
+// shard to follow us. The old shard may well be down, in which case it needs
+// to be demoted by hand with POST /admin/demote once it comes back.
+func (s Shard) FailoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	upstream := s.region.getUpstream()
+	if upstream == "" {
+		http.Error(w, "This shard is already active.", 400)
+		return
+	}
+	msg := FailoverMsg{OldUpstream: upstream}
+	if err := s.syncFromUpstream(); err != nil {
+		logError(r, err)
+		msg.SyncError = err.Error()
+	}
+	s.region.setUpstream("")
+	if err := s.EnsureRepos(); err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if r.URL.Query().Get("demote") != "false" {
+		resp, err := peerRequest("POST", fmt.Sprintf("%s/admin/demote?upstream=%s", upstream, s.url), nil)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				err = fmt.Errorf("Response with status: %s", resp.Status)
+			}
+		}
+		if err != nil {
+			logError(r, err)
+			msg.DemoteError = err.Error()
+		} else {
+			msg.Demoted = true
+		}
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
+
+// DemoteHandler turns this shard in to a passive follower of `upstream`.
+func (s Shard) DemoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	upstream := r.URL.Query().Get("upstream")
+	if upstream == "" {
+		http.Error(w, "Missing upstream.", 400)
+		return
+	}
+	s.region.setUpstream(upstream)
+	fmt.Fprintf(w, "Following %s.\n", upstream)
+}
@@ -3,10 +3,10 @@ package main
 // replica.go contains code for using shards as replicas
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
@@ -17,36 +17,51 @@ import (
 
 type ShardReplica struct {
 	url string
+	// epoch is the epoch of the primary doing the pushing, 0 if it isn't
+	// known.
+	epoch uint64
 }
 
 func NewShardReplica(url string) ShardReplica {
 	return ShardReplica{url: url}
 }
 
-func (r ShardReplica) Push(diff io.Reader) error {
-	resp, err := http.Post(r.url+"/commit", "application/octet-stream", diff)
+func (r ShardReplica) Push(ctx context.Context, diff io.Reader) error {
+	req, err := newPeerRequest("POST", r.url+"/commit", diff)
 	if err != nil {
 		return err
 	}
+	if r.epoch != 0 {
+		req.Header.Set(epochHeader, fmt.Sprint(r.epoch))
+	}
+	resp, err := http.DefaultClient.Do(withContext(ctx, req))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		log.Printf("Response with status: %s", resp.Status)
+		logger.ErrorContext(ctx, "pushing to shard", "url", r.url, "status", resp.Status)
 		return fmt.Errorf("Response with status: %s", resp.Status)
 	}
 	return nil
 }
 
-func (r ShardReplica) Pull(from string, cb btrfs.Pusher) error {
-	resp, err := http.Get(fmt.Sprintf("%s/pull?from=%s", r.url, from))
+func (r ShardReplica) Pull(ctx context.Context, from string, cb btrfs.Pusher) error {
+	req, err := newPeerRequest("GET", fmt.Sprintf("%s/pull?from=%s", r.url, from), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(withContext(ctx, req))
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != 200 {
-		log.Printf("Response with status: %s", resp.Status)
+		logger.ErrorContext(ctx, "pulling from shard", "url", r.url, "status", resp.Status)
 		return fmt.Errorf("Response with status: %s", resp.Status)
 	}
 	defer resp.Body.Close()
 	m := NewMultiPartPuller(multipart.NewReader(resp.Body, resp.Header.Get("Boundary")))
-	return m.Pull(from, cb)
+	return m.Pull(ctx, from, cb)
 }
 
 type MultiPartCommitBrancher struct {
@@ -57,20 +72,36 @@ func NewMultiPartCommitBrancher(w *multipart.Writer) MultiPartCommitBrancher {
 	return MultiPartCommitBrancher{w: w}
 }
 
-func (m MultiPartCommitBrancher) Push(diff io.Reader) error {
+func (m MultiPartCommitBrancher) Push(ctx context.Context, diff io.Reader) error {
 	h := make(textproto.MIMEHeader)
 	h.Set("pfs-diff-type", "commit")
 	w, err := m.w.CreatePart(h)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(w, diff)
+	_, err = copyBuffer(w, diff)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// WriterPusher writes diffs straight to a Writer, one after the other. btrfs
+// receive accepts concatenated send streams so the result can be fed to Recv
+// in one go.
+type WriterPusher struct {
+	w io.Writer
+}
+
+func NewWriterPusher(w io.Writer) WriterPusher {
+	return WriterPusher{w: w}
+}
+
+func (p WriterPusher) Push(ctx context.Context, diff io.Reader) error {
+	_, err := copyBuffer(p.w, diff)
+	return err
+}
+
 type MultiPartPuller struct {
 	r *multipart.Reader
 }
@@ -79,19 +110,22 @@ func NewMultiPartPuller(r *multipart.Reader) MultiPartPuller {
 	return MultiPartPuller{r: r}
 }
 
-func (m MultiPartPuller) Pull(from string, cb btrfs.Pusher) error {
+func (m MultiPartPuller) Pull(ctx context.Context, from string, cb btrfs.Pusher) error {
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		part, err := m.r.NextPart()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Print(err)
+			logger.ErrorContext(ctx, "reading multipart diff", "err", err)
 			return err
 		}
-		err = cb.Push(part)
+		err = cb.Push(ctx, part)
 		if err != nil {
-			log.Print(err)
+			logger.ErrorContext(ctx, "pushing multipart diff", "err", err)
 			return err
 		}
 	}
@@ -101,7 +135,7 @@ func (m MultiPartPuller) Pull(from string, cb btrfs.Pusher) error {
 // getFrom is a convenience function to ask a shard what value it would like
 // you to use for `from` when pushing to it.
 func getFrom(url string) (string, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/commit", url))
+	resp, err := peerRequest("GET", fmt.Sprintf("%s/commit", url), nil)
 	if err != nil {
 		return "", err
 	}
@@ -117,7 +151,13 @@ func getFrom(url string) (string, error) {
 
 // SyncTo syncs the contents in p to all of the shards in urls
 // Returns the first error if there are multiple
-func SyncTo(dataRepo string, urls []string) error {
+func SyncTo(ctx context.Context, dataRepo string, urls []string) error {
+	return syncTo(ctx, dataRepo, urls, 0)
+}
+
+// syncTo is SyncTo for a primary, epoch is sent with the commits so that
+// replicas can tell if we've been replaced.
+func syncTo(ctx context.Context, dataRepo string, urls []string, epoch uint64) error {
 	var errs []error
 	var lock sync.Mutex
 	addErr := func(err error) {
@@ -136,7 +176,8 @@ func SyncTo(dataRepo string, urls []string) error {
 				addErr(err)
 			}
 			sr := NewShardReplica(url)
-			err = lr.Pull(from, sr)
+			sr.epoch = epoch
+			err = lr.Pull(ctx, from, sr)
 			if err != nil {
 				addErr(err)
 			}
@@ -151,21 +192,21 @@ func SyncTo(dataRepo string, urls []string) error {
 
 // SyncFrom syncs from the most up to date replica in urls
 // Returns the first error if ALL urls error.
-func SyncFrom(dataRepo string, urls []string) error {
+func SyncFrom(ctx context.Context, dataRepo string, urls []string) error {
 	for _, url := range urls {
 		// First we need to figure out what value to use for `from`
 		from, err := btrfs.GetFrom(dataRepo)
 
 		if err != nil {
-			log.Print(err)
+			logger.ErrorContext(ctx, "reading from", "repo", dataRepo, "err", err)
 		}
 
 		sr := NewShardReplica(url)
 		lr := btrfs.NewLocalReplica(dataRepo)
 
-		err = sr.Pull(from, lr)
+		err = sr.Pull(ctx, from, lr)
 		if err != nil {
-			log.Print(err)
+			logger.ErrorContext(ctx, "syncing from shard", "url", url, "err", err)
 		}
 	}
 	//TODO(jd) we need to figure out under what conditions this function should
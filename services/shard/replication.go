@@ -0,0 +1,412 @@
+package main
+
+// replication.go lets operators manage replication targets by hand, on top of
+// the automatic replication to peers in etcd:
+//
+//	POST   /replica                          registers a target, the body is {"url": "<url>"}
+//	GET    /replica                          lists targets and how far behind they are
+//	DELETE /replica/<id>                     forgets a target, its data is left alone
+//	POST   /replica/<id>/sync?direction=push pushes new commits to the target
+//	POST   /replica/<id>/sync?direction=pull pulls new commits from the target
+//	GET    /replica/<id>/file/<file>?commit= restores one file from an S3 target
+//
+// Targets are any url the replica package understands, like S3 urls
+// (s3://bucket/path) and the urls of other shards (pfs://host:port or
+// http://host:port). They're recorded in the volume so that they survive
+// restarts.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/replica"
+	"github.com/pachyderm/pfs/lib/s3utils"
+)
+
+type replicaSet struct {
+	lock sync.Mutex
+	// live holds the Replicas we've made, S3Replicas keep the manifest of
+	// what they've pushed so we need to keep using the same one.
+	live map[string]btrfs.Replica
+	// syncing has a lock per replica, syncs hold it instead of lock so
+	// that they only hold up other syncs of the same replica.
+	syncing map[string]*sync.Mutex
+}
+
+func newReplicaSet() *replicaSet {
+	return &replicaSet{live: make(map[string]btrfs.Replica), syncing: make(map[string]*sync.Mutex)}
+}
+
+func isS3(url string) bool {
+	return strings.HasPrefix(url, "s3://")
+}
+
+// s3Options configures the S3Replicas we create, main sets it from the
+// environment.
+var s3Options = btrfs.S3Options{Upload: s3utils.DefaultUploadOptions, Open: openContent}
+
+func init() {
+	// Shards are replicated to over HTTP, pfs:// urls are http.
+	for _, scheme := range []string{"pfs", "http", "https"} {
+		replica.Register(scheme, func(u *url.URL) (btrfs.Replica, error) {
+			return NewShardReplica(shardURL(u.String())), nil
+		})
+	}
+	replica.Register("s3", func(u *url.URL) (btrfs.Replica, error) {
+		return btrfs.NewS3ReplicaWithOptions(u.String(), s3Options), nil
+	})
+}
+
+// isShard returns true if url is the url of a shard.
+func isShard(url string) bool {
+	for _, prefix := range []string{"pfs://", "http://", "https://"} {
+		if strings.HasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// shardURL returns the url we make requests to the shard at url on.
+func shardURL(url string) string {
+	if strings.HasPrefix(url, "pfs://") {
+		return "http://" + strings.TrimPrefix(url, "pfs://")
+	}
+	return url
+}
+
+// newReplica creates a Replica for url, see the replica package.
+func newReplica(url string) (btrfs.Replica, error) {
+	return replica.New(url)
+}
+
+func (s Shard) replicasFile() string {
+	return path.Join("replicas", s.dataRepo)
+}
+
+// loadReplicas reads our targets from disk, callers must hold the lock.
+func (s Shard) loadReplicas() ([]ReplicaMsg, error) {
+	exists, err := btrfs.FileExists(s.replicasFile())
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := btrfs.ReadFile(s.replicasFile())
+	if err != nil {
+		return nil, err
+	}
+	var replicas []ReplicaMsg
+	if err := json.Unmarshal(data, &replicas); err != nil {
+		return nil, err
+	}
+	return replicas, nil
+}
+
+// saveReplicas writes our targets to disk, callers must hold the lock.
+func (s Shard) saveReplicas(replicas []ReplicaMsg) error {
+	data, err := json.Marshal(replicas)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(path.Dir(s.replicasFile())); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(s.replicasFile(), data)
+}
+
+// replicaFrom returns the last commit that replica has.
+func (s Shard) replicaFrom(replica ReplicaMsg) (string, error) {
+	if !isShard(replica.Url) {
+		return replica.LastSync, nil
+	}
+	return getFrom(shardURL(replica.Url))
+}
+
+// commitsSince counts our commits after from.
+func (s Shard) commitsSince(from string) (int, error) {
+	subvolumes, err := btrfs.Listing(s.dataRepo)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range subvolumes {
+		if c.Name == from {
+			break
+		}
+		if c.Commit {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// syncReplica pushes to or pulls from the replica with id, until ctx is
+// cancelled. The replicas lock is only held to look the replica up and to
+// record the result, not for the sync itself, so other replicas can be
+// listed, changed and synced meanwhile. Syncs of the same replica take turns.
+func (s Shard) syncReplica(ctx context.Context, id string, pull bool) (ReplicaMsg, error) {
+	s.replicas.lock.Lock()
+	msg, replica, syncing, err := s.lookupReplica(id)
+	s.replicas.lock.Unlock()
+	if err != nil {
+		return ReplicaMsg{}, err
+	}
+	syncing.Lock()
+	defer syncing.Unlock()
+
+	if pull {
+		if isS3(msg.Url) {
+			return ReplicaMsg{}, fmt.Errorf("Pulling from S3 targets isn't supported.")
+		}
+		var from string
+		if from, err = btrfs.GetFrom(s.dataRepo); err == nil {
+			err = replica.Pull(ctx, from, s.localReplica())
+		}
+	} else {
+		var from string
+		if from, err = s.replicaFrom(msg); err == nil {
+			err = btrfs.NewLocalReplica(s.dataRepo).Pull(ctx, from, replica)
+		}
+	}
+	msg.LastError = ""
+	if err != nil {
+		msg.LastError = err.Error()
+	} else {
+		if msg.LastSync, err = btrfs.GetFrom(s.dataRepo); err != nil {
+			return msg, err
+		}
+		msg.LastSyncTime = time.Now().Format("2006-01-02T15:04:05.999999-07:00")
+	}
+
+	s.replicas.lock.Lock()
+	defer s.replicas.lock.Unlock()
+	replicas, loadErr := s.loadReplicas()
+	if loadErr != nil {
+		logger.ErrorContext(ctx, "loading replicas", "err", loadErr)
+		return msg, err
+	}
+	for i := range replicas {
+		// The replica may have been removed while we were syncing, then
+		// there's nothing to record.
+		if replicas[i].Id == id {
+			replicas[i].LastError, replicas[i].LastSync, replicas[i].LastSyncTime = msg.LastError, msg.LastSync, msg.LastSyncTime
+			if saveErr := s.saveReplicas(replicas); saveErr != nil {
+				logger.ErrorContext(ctx, "saving replicas", "err", saveErr)
+			}
+		}
+	}
+	return msg, err
+}
+
+// lookupReplica returns the replica with id, the Replica to sync it with and
+// the lock that its syncs take turns with. s.replicas.lock must be held.
+func (s Shard) lookupReplica(id string) (ReplicaMsg, btrfs.Replica, *sync.Mutex, error) {
+	replicas, err := s.loadReplicas()
+	if err != nil {
+		return ReplicaMsg{}, nil, nil, err
+	}
+	for _, msg := range replicas {
+		if msg.Id != id {
+			continue
+		}
+		replica, ok := s.replicas.live[id]
+		if !ok {
+			if replica, err = newReplica(msg.Url); err != nil {
+				return ReplicaMsg{}, nil, nil, err
+			}
+			s.replicas.live[id] = replica
+		}
+		syncing, ok := s.replicas.syncing[id]
+		if !ok {
+			syncing = &sync.Mutex{}
+			s.replicas.syncing[id] = syncing
+		}
+		return msg, replica, syncing, nil
+	}
+	return ReplicaMsg{}, nil, nil, errReplicaNotFound
+}
+
+var errReplicaNotFound = fmt.Errorf("Replica not found.")
+
+// ReplicaHandler manages our replication targets.
+func (s Shard) ReplicaHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	// url looks like [, replica], [, replica, <id>, sync] or
+	// [, replica, <id>, file, <file>]
+	switch {
+	case len(url) == 2 && r.Method == "GET":
+		s.replicas.lock.Lock()
+		replicas, err := s.loadReplicas()
+		s.replicas.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		for i := range replicas {
+			from, err := s.replicaFrom(replicas[i])
+			if err == nil {
+				replicas[i].Lag, err = s.commitsSince(from)
+			}
+			if err != nil {
+				replicas[i].LagError = err.Error()
+			}
+		}
+		if replicas == nil {
+			replicas = []ReplicaMsg{}
+		}
+		if err := json.NewEncoder(w).Encode(replicas); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 2 && r.Method == "POST":
+		if chunkFiles {
+			http.Error(w, errChunkStore.Error(), 409)
+			return
+		}
+		var replica ReplicaMsg
+		if err := json.NewDecoder(r.Body).Decode(&replica); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if _, err := newReplica(replica.Url); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		replica = ReplicaMsg{Id: uuid.New(), Url: replica.Url}
+		s.replicas.lock.Lock()
+		replicas, err := s.loadReplicas()
+		if err == nil {
+			err = s.saveReplicas(append(replicas, replica))
+		}
+		s.replicas.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(replica); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 3 && r.Method == "DELETE":
+		s.replicas.lock.Lock()
+		replicas, err := s.loadReplicas()
+		found := false
+		for i := 0; err == nil && i < len(replicas); i++ {
+			if replicas[i].Id == url[2] {
+				found = true
+				replicas = append(replicas[:i], replicas[i+1:]...)
+				delete(s.replicas.live, url[2])
+				delete(s.replicas.syncing, url[2])
+				err = s.saveReplicas(replicas)
+				break
+			}
+		}
+		s.replicas.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("Replica %s not found.", url[2]), 404)
+			return
+		}
+		fmt.Fprintf(w, "Removed replica %s.\n", url[2])
+	case len(url) == 4 && url[3] == "sync" && r.Method == "POST":
+		direction := r.URL.Query().Get("direction")
+		if direction != "" && direction != "push" && direction != "pull" {
+			http.Error(w, fmt.Sprintf("Invalid direction %s.", direction), 400)
+			return
+		}
+		if direction == "pull" && s.rejectWrite(w) {
+			return
+		}
+		var replica ReplicaMsg
+		err := timeOp(w, "sync", func() error {
+			var err error
+			replica, err = s.syncReplica(r.Context(), url[2], direction == "pull")
+			return err
+		})
+		if err == errReplicaNotFound {
+			http.Error(w, fmt.Sprintf("Replica %s not found.", url[2]), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if direction == "pull" {
+			go s.syncToPeers(s.detach(r))
+		}
+		if err := json.NewEncoder(w).Encode(replica); err != nil {
+			logError(r, err)
+		}
+	case len(url) > 4 && url[3] == "file" && r.Method == "GET":
+		s.restoreFile(w, r, url[2], path.Join(url[4:]...))
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+// restoreFile writes the file name from the replica with id to w, as it was
+// in the commit r names.
+func (s Shard) restoreFile(w http.ResponseWriter, r *http.Request, id, name string) {
+	commit := btrfs.Resolve(s.dataRepo, r.URL.Query().Get("commit"))
+	if commit == "" {
+		http.Error(w, "Restoring a file needs a commit.", 400)
+		return
+	}
+	s.replicas.lock.Lock()
+	replicas, err := s.loadReplicas()
+	s.replicas.lock.Unlock()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	for _, msg := range replicas {
+		if msg.Id != id {
+			continue
+		}
+		replica, err := newReplica(msg.Url)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		restorer, ok := replica.(btrfs.FileRestorer)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Files can't be restored from %s, only from S3 targets.", msg.Url), 400)
+			return
+		}
+		sw := &startedWriter{w: w}
+		err = timeOp(w, "RestoreFile", func() error { return restorer.RestoreFile(r.Context(), commit, name, sw) })
+		if err != nil && !sw.started {
+			httpError(w, r, err)
+		} else if err != nil {
+			// It's too late to send an error status.
+			logError(r, err)
+		}
+		return
+	}
+	http.Error(w, fmt.Sprintf("Replica %s not found.", id), 404)
+}
+
+// startedWriter records whether anything's been written to w.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (sw *startedWriter) Write(p []byte) (int, error) {
+	sw.started = true
+	return sw.w.Write(p)
+}
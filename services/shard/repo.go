@@ -0,0 +1,233 @@
+package main
+
+// repo.go lets operators configure the shard's repos:
+//
+//	GET  /repo                lists the data and comp repos and their settings
+//	POST /repo/<repo>         changes a repo's settings, <repo> is data or comp
+//	                          and the body is a RepoMsg, settings that are left
+//	                          out aren't changed
+//	GET  /repo/<repo>/usage   reports how much space the repo and its branches
+//	                          use against their quotas
+//	/repo/<repo>/config       the repo's config, see config.go
+//	GET  /du                  reports the space each commit and branch in the
+//	                          data repo takes up, newest first, ?commit=
+//	                          picks one
+//
+// Compression applies to files written after it's set. Quotas limit the
+// space a repo's commits and branches refer to, writes that would go over
+// them fail with a 507. Permissions makes the repo keep the modes and owners
+// files are written with, see perms.go. Freezing a repo, during a reshard or
+// restore say, makes writes to it and new commits, branches and tags fail
+// with a 423 until it's thawed, reads and replication carry on.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+func (s Shard) repoMsg(repo string) (RepoMsg, error) {
+	compression, err := btrfs.GetCompression(repo)
+	if err != nil {
+		return RepoMsg{}, err
+	}
+	msg := RepoMsg{
+		Name:        repo,
+		Compression: compression,
+		Permissions: btrfs.PreservesPermissions(repo),
+		Frozen:      btrfs.IsFrozen(repo),
+	}
+	usage, err := btrfs.RepoUsage(repo)
+	if err != nil && err != btrfs.ErrNoQuota {
+		return RepoMsg{}, err
+	}
+	msg.Quota = usage.Quota
+	return msg, nil
+}
+
+// repoUsage reports the space used by repo and its branches.
+func (s Shard) repoUsage(repo string) (RepoUsageMsg, error) {
+	msg := RepoUsageMsg{Branches: []UsageMsg{}}
+	usage, err := btrfs.RepoUsage(repo)
+	if err == nil {
+		msg.Total = &UsageMsg{Name: repo, Used: usage.Used, Quota: usage.Quota}
+	} else if err != btrfs.ErrNoQuota {
+		return msg, err
+	}
+	err = btrfs.Commits(repo, "", btrfs.Desc, func(c btrfs.CommitInfo) error {
+		isCommit, err := btrfs.IsReadOnly(path.Join(repo, c.Path))
+		if err != nil || isCommit {
+			return err
+		}
+		usage, err := btrfs.BranchUsage(repo, c.Path)
+		if err != nil {
+			return err
+		}
+		msg.Branches = append(msg.Branches, UsageMsg{Name: c.Path, Used: usage.Used, Quota: usage.Quota})
+		return nil
+	})
+	return msg, err
+}
+
+// RepoHandler reports and changes our repos' settings.
+func (s Shard) RepoHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	// url looks like [, repo], [, repo, <repo>], [, repo, <repo>, usage] or
+	// [, repo, <repo>, config]
+	var repo string
+	if len(url) > 2 {
+		switch url[2] {
+		case "data":
+			repo = s.dataRepo
+		case "comp":
+			repo = s.compRepo
+		default:
+			http.Error(w, fmt.Sprintf("Repo %s not found, it must be data or comp.", url[2]), 404)
+			return
+		}
+	}
+	switch {
+	case len(url) == 2 && r.Method == "GET":
+		var repos []RepoMsg
+		for _, repo := range []string{s.dataRepo, s.compRepo} {
+			msg, err := s.repoMsg(repo)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				logError(r, err)
+				return
+			}
+			repos = append(repos, msg)
+		}
+		if err := json.NewEncoder(w).Encode(repos); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 3 && r.Method == "POST":
+		var settings struct {
+			Compression *string `json:"compression"`
+			Quota       *int64  `json:"quota"`
+			Permissions *bool   `json:"permissions"`
+			Frozen      *bool   `json:"frozen"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if settings.Compression != nil {
+			if err := btrfs.ValidCompression(*settings.Compression); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+		}
+		if settings.Quota != nil && *settings.Quota < 0 {
+			http.Error(w, fmt.Sprintf("Invalid quota %d.", *settings.Quota), 400)
+			return
+		}
+		var err error
+		if settings.Compression != nil {
+			err = btrfs.SetCompression(repo, *settings.Compression)
+		}
+		if err == nil && settings.Quota != nil {
+			err = btrfs.SetQuota(repo, *settings.Quota)
+		}
+		if err == nil && settings.Permissions != nil {
+			err = btrfs.SetPreservePermissions(repo, *settings.Permissions)
+		}
+		if err == nil && settings.Frozen != nil {
+			err = btrfs.SetFrozen(repo, *settings.Frozen)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		msg, err := s.repoMsg(repo)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 4 && url[3] == "config":
+		s.configHandler(w, r, repo)
+	case len(url) == 4 && url[3] == "usage" && r.Method == "GET":
+		msg, err := s.repoUsage(repo)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+func (s Shard) duMsg(commit string) (DuMsg, error) {
+	isCommit, err := btrfs.IsReadOnly(path.Join(s.dataRepo, commit))
+	if err != nil {
+		return DuMsg{}, err
+	}
+	du, err := btrfs.Du(s.dataRepo, commit)
+	if err != nil {
+		return DuMsg{}, err
+	}
+	return DuMsg{
+		Name:      commit,
+		Commit:    isCommit,
+		Logical:   du.Logical,
+		Exclusive: du.Exclusive,
+		Shared:    du.Shared,
+	}, nil
+}
+
+// DuHandler reports the space our commits and branches take up.
+func (s Shard) DuHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	if commit := r.URL.Query().Get("commit"); commit != "" {
+		commit = btrfs.Resolve(s.dataRepo, commit)
+		exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+			return
+		}
+		msg, err := s.duMsg(commit)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if err := encoder.Encode(msg); err != nil {
+			logError(r, err)
+		}
+		return
+	}
+	err := timeOp(w, "btrfs.Du", func() error {
+		return btrfs.Commits(s.dataRepo, "", btrfs.Desc, func(c btrfs.CommitInfo) error {
+			msg, err := s.duMsg(c.Path)
+			if err != nil {
+				return err
+			}
+			return encoder.Encode(msg)
+		})
+	})
+	if err != nil {
+		logError(r, err)
+	}
+}
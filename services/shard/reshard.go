@@ -0,0 +1,375 @@
+package main
+
+// reshard.go is the shard's half of growing a cluster from M shards to N.
+// With modulo placement N must be a multiple of M, that way every file that
+// the new shard j-N owns used to belong to shard (j%M)-M, so a new shard fills
+// itself by pulling that shard's commits and then dropping the files it
+// doesn't own. With consistent placement the shards j < M also keep a slice
+// of (j%M)-M's files, so they do the same, but the shards that are added own
+// a slice of every old shard's files. They take just those files from each
+// old shard's branches instead, so only the files that change shard move:
+//
+//	GET  /reshard?modulos=N               counts the files on a branch that would change shard
+//	POST /reshard?from=<url>              pulls commits from the shard at url and prunes
+//	POST /reshard?take=<url>&take=<url>   copies the files we own from the shards at the urls
+//
+// The router drives the whole thing, see services/router/reshard.go.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+// owns returns true if the file name belongs to shard, out of modulos.
+func owns(name string, shard, modulos uint64) bool {
+	return route.Owner(path.Join("/file", name), modulos) == shard
+}
+
+// branchFiles returns the names of the files on branch.
+func (s Shard) branchFiles(branch string) ([]string, error) {
+	var files []string
+	err := walkSnapshot(path.Join(s.dataRepo, branch), "", func(name string, fi os.FileInfo, abs string) error {
+		if !fi.IsDir() {
+			files = append(files, name)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// branches returns the names of our branches.
+func (s Shard) branches() ([]string, error) {
+	var branches []string
+	err := btrfs.Commits(s.dataRepo, "", btrfs.Desc, func(c btrfs.CommitInfo) error {
+		isReadOnly, err := btrfs.IsReadOnly(path.Join(s.dataRepo, c.Path))
+		if err != nil {
+			return err
+		}
+		if !isReadOnly {
+			branches = append(branches, c.Path)
+		}
+		return nil
+	})
+	return branches, err
+}
+
+// resetFreshRepo deletes our data repo if all it has is the empty commit that
+// Init makes, a stream from another shard can't be applied on top of it. It
+// returns true if it did.
+func (s Shard) resetFreshRepo() (bool, error) {
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err != nil || from != "t0" {
+		return false, err
+	}
+	files, err := s.branchFiles("master")
+	if err != nil || len(files) > 0 {
+		return false, err
+	}
+	var subvolumes []string
+	err = btrfs.Commits(s.dataRepo, "", btrfs.Desc, func(c btrfs.CommitInfo) error {
+		subvolumes = append(subvolumes, c.Path)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, subvolume := range subvolumes {
+		if err := btrfs.SubvolumeDelete(path.Join(s.dataRepo, subvolume)); err != nil {
+			return false, err
+		}
+	}
+	if err := btrfs.SubvolumeDelete(s.dataRepo); err != nil {
+		return false, err
+	}
+	return true, btrfs.EnsureReplica(s.dataRepo)
+}
+
+// prune removes the files we don't own from every branch and returns how
+// many it removed. The removals are picked up by the next commit.
+func (s Shard) prune() (int, error) {
+	branches, err := s.branches()
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, branch := range branches {
+		files, err := s.branchFiles(branch)
+		if err != nil {
+			return pruned, err
+		}
+		for _, name := range files {
+			if owns(name, s.shard, s.modulos) {
+				continue
+			}
+			if err := btrfs.Remove(path.Join(s.dataRepo, branch, name)); err != nil {
+				return pruned, err
+			}
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// ownerFilter returns a filter for the files that shard ?shard= owns out of
+// ?modulos=, or nil if ?modulos= isn't set.
+func ownerFilter(r *http.Request) (func(name string) bool, error) {
+	if r.URL.Query().Get("modulos") == "" {
+		return nil, nil
+	}
+	modulos, err := strconv.ParseUint(r.URL.Query().Get("modulos"), 10, 64)
+	if err != nil || modulos == 0 {
+		return nil, fmt.Errorf("Invalid modulos %s.", r.URL.Query().Get("modulos"))
+	}
+	shard, err := strconv.ParseUint(r.URL.Query().Get("shard"), 10, 64)
+	if err != nil || shard >= modulos {
+		return nil, fmt.Errorf("Invalid shard %s.", r.URL.Query().Get("shard"))
+	}
+	return func(name string) bool { return owns(name, shard, modulos) }, nil
+}
+
+func validSource(source string) error {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return fmt.Errorf("Invalid source %s, it must be the url of a shard.", source)
+	}
+	return nil
+}
+
+// sourceBranches returns the names of the branches on the shard at source.
+func sourceBranches(ctx context.Context, source string) ([]string, error) {
+	req, err := newPeerRequest("GET", source+"/branch", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(withContext(ctx, req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to list branches on %s: %s", source, resp.Status)
+	}
+	var branches []string
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var branch BranchMsg
+		if err := decoder.Decode(&branch); err == io.EOF {
+			return branches, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := btrfs.ValidName(branch.Name); err != nil {
+			return nil, err
+		}
+		branches = append(branches, branch.Name)
+	}
+}
+
+// clearBranch removes everything but the metadata from branch.
+func (s Shard) clearBranch(branch string) error {
+	lock, err := btrfs.RLockBranch(s.dataRepo, branch)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	files, err := btrfs.ReadDir(path.Join(s.dataRepo, branch))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.Name() == ".meta" {
+			continue
+		}
+		if err := btrfs.RemoveAll(path.Join(s.dataRepo, branch, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeBranch copies the files we own on branch from the shard at source in to
+// our branch and returns how many it copied.
+func (s Shard) takeBranch(ctx context.Context, source, branch string) (int, error) {
+	req, err := newPeerRequest("GET", fmt.Sprintf("%s/archive?branch=%s&format=tar&shard=%d&modulos=%d", source, url.QueryEscape(branch), s.shard, s.modulos), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(withContext(ctx, req))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("Failed to copy %s from %s: %s", branch, source, resp.Status)
+	}
+	lock, err := btrfs.RLockBranch(s.dataRepo, branch)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	// The files were already written once, to the source, so they aren't
+	// limited again.
+	return unpackTar(resp.Body, path.Join(s.dataRepo, branch), btrfs.PreservesPermissions(s.dataRepo), nil, s.checkOwner)
+}
+
+// take replaces the files on our branches with the files we own on the
+// branches of the shards at sources, making any branches we don't have yet.
+// It returns how many files it copied. Taking again copies everything again,
+// so files deleted from the sources meanwhile are deleted here too.
+func (s Shard) take(ctx context.Context, sources []string) (int, error) {
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err != nil {
+		return 0, err
+	}
+	branches := make(map[string][]string)
+	for _, source := range sources {
+		if branches[source], err = sourceBranches(ctx, source); err != nil {
+			return 0, err
+		}
+		for _, branch := range branches[source] {
+			exists, err := btrfs.FileExists(path.Join(s.dataRepo, branch))
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				if err := btrfs.Branch(s.dataRepo, from, branch); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+	ours, err := s.branches()
+	if err != nil {
+		return 0, err
+	}
+	for _, branch := range ours {
+		if err := s.clearBranch(branch); err != nil {
+			return 0, err
+		}
+	}
+	taken := 0
+	for _, source := range sources {
+		for _, branch := range branches[source] {
+			n, err := s.takeBranch(ctx, source, branch)
+			taken += n
+			if err != nil {
+				return taken, err
+			}
+		}
+	}
+	return taken, nil
+}
+
+// ReshardHandler plans resharding and pulls files from the shard we're taking
+// them over from.
+func (s Shard) ReshardHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		modulos, err := strconv.ParseUint(r.URL.Query().Get("modulos"), 10, 64)
+		if err != nil || modulos == 0 {
+			http.Error(w, fmt.Sprintf("Invalid modulos %s.", r.URL.Query().Get("modulos")), 400)
+			return
+		}
+		files, err := s.branchFiles(branchParam(r))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		plan := ReshardPlanMsg{Shard: s.shard, Modulos: modulos, Files: len(files)}
+		for _, name := range files {
+			if !owns(name, s.shard, modulos) {
+				plan.Moving++
+			}
+		}
+		if err := json.NewEncoder(w).Encode(plan); err != nil {
+			logError(r, err)
+		}
+	case "POST":
+		if s.rejectWrite(w) {
+			return
+		}
+		if sources, ok := r.URL.Query()["take"]; ok {
+			s.takeFiles(w, r, sources)
+			return
+		}
+		source := r.URL.Query().Get("from")
+		if err := validSource(source); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		reset, err := s.resetFreshRepo()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if reset {
+			logger.InfoContext(r.Context(), "reset empty repo to take over", "repo", s.dataRepo, "source", source)
+		}
+		var msg ReshardMsg
+		err = timeOp(w, "reshard", func() error {
+			from, err := btrfs.GetFrom(s.dataRepo)
+			if err != nil {
+				return err
+			}
+			if err := NewShardReplica(source).Pull(r.Context(), from, s.localReplica()); err != nil {
+				return err
+			}
+			if msg.Pruned, err = s.prune(); err != nil {
+				return err
+			}
+			msg.From, err = btrfs.GetFrom(s.dataRepo)
+			return err
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		go s.syncToPeers(s.detach(r))
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+// takeFiles responds to POST /reshard?take=.
+func (s Shard) takeFiles(w http.ResponseWriter, r *http.Request, sources []string) {
+	for _, source := range sources {
+		if err := validSource(source); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+	var msg ReshardMsg
+	err := timeOp(w, "reshard", func() error {
+		var err error
+		if msg.Taken, err = s.take(r.Context(), sources); err != nil {
+			return err
+		}
+		msg.From, err = btrfs.GetFrom(s.dataRepo)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	go s.syncToPeers(s.detach(r))
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+// role.go tracks whether this shard is the primary for its shard index. Only
+// the primary takes writes, it pushes its commits to up to
+// replicationFactor replicas. Every time a shard becomes primary the shard
+// index's epoch in etcd goes up; primaries send their epoch with the commits
+// they push and replicas refuse pushes from older epochs, so a deposed
+// primary that's still running can't overwrite its successor's data.
+//
+//	GET  /admin/role           our role, epoch and latest commit
+//	POST /admin/promote        makes us the primary
+//	POST /admin/fence?epoch=N  tells us that epoch N has started
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/discovery"
+)
+
+// epochHeader carries the pushing primary's epoch.
+const epochHeader = "X-Pfs-Epoch"
+
+type roleState struct {
+	lock sync.Mutex
+	// clustered is false until we've taken a role in a cluster, shards
+	// that aren't part of one (like in tests) take writes.
+	clustered bool
+	primary   bool
+	epoch     uint64
+}
+
+func (r *roleState) get() (clustered, primary bool, epoch uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.clustered, r.primary, r.epoch
+}
+
+func (r *roleState) becomePrimary(epoch uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.clustered = true
+	r.primary = true
+	if epoch > r.epoch {
+		r.epoch = epoch
+	}
+}
+
+func (r *roleState) becomeReplica() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.clustered = true
+	r.primary = false
+}
+
+// observe records that epoch has started, if we're the primary of an older
+// epoch we step down. It returns false if epoch is older than ours.
+func (r *roleState) observe(epoch uint64) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if epoch < r.epoch {
+		return false
+	}
+	if epoch > r.epoch {
+		if r.primary {
+			logger.Warn("epoch has started, stepping down as primary", "epoch", epoch, "old_epoch", r.epoch)
+			r.primary = false
+		}
+		r.epoch = epoch
+	}
+	return true
+}
+
+func (s Shard) masterKey() string {
+	return path.Join("/pfs/master", fmt.Sprintf("%d-%d", s.shard, s.modulos))
+}
+
+func (s Shard) epochKey() string {
+	return path.Join("/pfs/epoch", fmt.Sprintf("%d-%d", s.shard, s.modulos))
+}
+
+// nextEpoch starts a new epoch for our shard index and returns it.
+func (s Shard) nextEpoch(client *etcd.Client) (uint64, error) {
+	var err error
+	// We only go around again if another shard changed the epoch under us.
+	for i := 0; i < 10; i++ {
+		var resp *etcd.Response
+		resp, err = client.Get(s.epochKey(), false, false)
+		if etcdErr, ok := err.(*etcd.EtcdError); ok && etcdErr.ErrorCode == 100 {
+			// Key not found, this is the first epoch.
+			if _, err = client.Create(s.epochKey(), "1", 0); err == nil {
+				return 1, nil
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var epoch uint64
+		if epoch, err = strconv.ParseUint(resp.Node.Value, 10, 64); err != nil {
+			return 0, err
+		}
+		if _, err = client.CompareAndSwap(s.epochKey(), fmt.Sprint(epoch+1), 0, resp.Node.Value, 0); err == nil {
+			return epoch + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("Failed to start a new epoch for shard %d-%d: %s", s.shard, s.modulos, err)
+}
+
+// rejectFenced refuses writes, returning true, if we're part of a cluster
+// but aren't the primary.
+func (s Shard) rejectFenced(w http.ResponseWriter) bool {
+	clustered, primary, _ := s.role.get()
+	if !clustered || primary {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("This shard isn't the primary for shard %d-%d.", s.shard, s.modulos), http.StatusServiceUnavailable)
+	return true
+}
+
+// rejectWrite refuses writes, returning true, if we can't take them.
+func (s Shard) rejectWrite(w http.ResponseWriter) bool {
+	return s.rejectPassive(w) || s.rejectFenced(w)
+}
+
+// acceptPush checks the epoch of a commit being pushed to us. It returns
+// false, and responds, if the push comes from a primary that's been
+// replaced. Once we're part of a cluster pushes must carry an epoch, shards
+// outside of one (like in tests) take them without.
+func (s Shard) acceptPush(w http.ResponseWriter, r *http.Request) bool {
+	value := r.Header.Get(epochHeader)
+	if value == "" {
+		if clustered, _, _ := s.role.get(); clustered {
+			http.Error(w, fmt.Sprintf("Pushes to shard %d-%d must carry an %s header.", s.shard, s.modulos, epochHeader), 400)
+			return false
+		}
+		return true
+	}
+	epoch, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid epoch %s.", value), 400)
+		return false
+	}
+	if !s.role.observe(epoch) {
+		_, _, ours := s.role.get()
+		http.Error(w, fmt.Sprintf("Push from epoch %d rejected, this shard is at epoch %d.", epoch, ours), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// pushTargets picks the peers that a primary pushes its commits to.
+func (s Shard) pushTargets(peers []string) []string {
+	if s.replicationFactor <= 0 || len(peers) <= s.replicationFactor {
+		return peers
+	}
+	sort.Strings(peers)
+	return peers[:s.replicationFactor]
+}
+
+func (s Shard) roleMsg() (RoleMsg, error) {
+	clustered, primary, epoch := s.role.get()
+	msg := RoleMsg{Shard: s.shard, Modulos: s.modulos, Role: discovery.RoleReplica, Epoch: epoch}
+	if !clustered || primary {
+		msg.Role = discovery.RoleMaster
+	}
+	var err error
+	msg.Commit, err = btrfs.GetFrom(s.dataRepo)
+	return msg, err
+}
+
+// promote makes us the primary for our shard index.
+func (s Shard) promote() error {
+	client := etcd.NewClient([]string{"http://172.17.42.1:4001", "http://10.1.42.1:4001"})
+	epoch, err := s.nextEpoch(client)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Set(s.masterKey(), s.url, 60); err != nil {
+		return err
+	}
+	if err := s.EnsureRepos(); err != nil {
+		return err
+	}
+	s.role.becomePrimary(epoch)
+	if err := discovery.Register(client, s.member(discovery.RoleMaster)); err != nil {
+		logger.Error("registering as primary", "err", err)
+	}
+	logger.Info("promoted to primary", "shard", fmt.Sprintf("%d-%d", s.shard, s.modulos), "epoch", epoch)
+	return nil
+}
+
+// RoleHandler reports our role and handles promotion and fencing.
+func (s Shard) RoleHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/admin/role" && r.Method == "GET":
+	case r.URL.Path == "/admin/promote" && r.Method == "POST":
+		if s.rejectPassive(w) {
+			return
+		}
+		if err := timeOp(w, "promote", s.promote); err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		go s.SyncToPeers()
+	case r.URL.Path == "/admin/fence" && r.Method == "POST":
+		epoch, err := strconv.ParseUint(r.URL.Query().Get("epoch"), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid epoch %s.", r.URL.Query().Get("epoch")), 400)
+			return
+		}
+		s.role.observe(epoch)
+	default:
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	msg, err := s.roleMsg()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// schedule.go runs scheduled pipelines. A pipeline with a schedule doesn't
+// run on every commit, instead every so often we commit the head of its
+// branch, as trigger-<pipeline>-<time>, and run it over that commit. The
+// trigger commit is replicated and published like any other so that runs are
+// recorded and can be reproduced. A scheduled pipeline first runs as soon as
+// it's registered.
+
+import (
+	"path"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/pipeline"
+)
+
+// scheduleInterval is how often we look for scheduled pipelines that are due.
+var scheduleInterval = time.Second
+
+// triggeredFile records when the pipeline name was last triggered.
+func (s Shard) triggeredFile(name string) string {
+	return path.Join("schedules", s.dataRepo, name)
+}
+
+// lastTriggered returns when the pipeline name was last triggered, the zero
+// time if it never was. Callers must hold the lock.
+func (s Shard) lastTriggered(name string) (time.Time, error) {
+	exists, err := btrfs.FileExists(s.triggeredFile(name))
+	if err != nil || !exists {
+		return time.Time{}, err
+	}
+	data, err := btrfs.ReadFile(s.triggeredFile(name))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse("2006-01-02T15:04:05.999999-07:00", string(data))
+}
+
+// trigger commits the head of p's branch and queues a job for p over it.
+// Callers must hold the lock.
+func (s Shard) trigger(p pipeline.Pipeline, now time.Time) error {
+	commit := pipeline.TriggerCommit(p.Name, now)
+	if _, err := btrfs.Commit(s.dataRepo, commit, p.Schedule.BranchOrMaster()); err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(path.Dir(s.triggeredFile(p.Name))); err != nil {
+		return err
+	}
+	if err := btrfs.WriteFile(s.triggeredFile(p.Name), []byte(now.Format("2006-01-02T15:04:05.999999-07:00"))); err != nil {
+		return err
+	}
+	go s.publishCommit(commit)
+	go s.SyncToPeers()
+	return s.queueJob(p, commit, commit)
+}
+
+// runSchedules triggers the scheduled pipelines that are due at now.
+func (s Shard) runSchedules(now time.Time) error {
+	s.pipelines.lock.Lock()
+	defer s.pipelines.lock.Unlock()
+	pipelines, err := s.loadPipelines()
+	if err != nil {
+		return err
+	}
+	for _, p := range pipelines {
+		if p.Schedule == nil {
+			continue
+		}
+		last, err := s.lastTriggered(p.Name)
+		if err != nil {
+			return err
+		}
+		if now.Sub(last) < p.Schedule.Period() {
+			continue
+		}
+		if err := s.trigger(p, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+// scrub.go scrubs the volume every so often, reading every block and checking
+// it against its checksum, so that corruption is found before the data is
+// needed:
+//
+//	GET  /scrub   lists the last scrubs' results, oldest first
+//	POST /scrub   scrubs now and returns the result
+//	GET  /health  reports whether the last scrub found errors it couldn't
+//	              correct, with a 503 if it did
+//
+// Scrubs run every PFS_SCRUB_INTERVAL, a week by default. Results are
+// recorded in the volume so that they survive restarts, and exported at
+// /metrics.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+const (
+	defaultScrubInterval = 7 * 24 * time.Hour
+	// scrubCheckInterval is how often we check whether a scrub is due.
+	scrubCheckInterval = time.Hour
+	// maxScrubs is how many scrubs' results we keep.
+	maxScrubs = 10
+)
+
+var errScrubRunning = fmt.Errorf("A scrub is already running.")
+
+type scrubState struct {
+	// lock guards the scrubs file and running.
+	lock    sync.Mutex
+	running bool
+}
+
+func (s Shard) scrubsFile() string {
+	return path.Join("scrubs", s.dataRepo)
+}
+
+// loadScrubs reads our scrubs' results from disk, callers must hold the lock.
+func (s Shard) loadScrubs() ([]ScrubMsg, error) {
+	exists, err := btrfs.FileExists(s.scrubsFile())
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := btrfs.ReadFile(s.scrubsFile())
+	if err != nil {
+		return nil, err
+	}
+	var scrubs []ScrubMsg
+	if err := json.Unmarshal(data, &scrubs); err != nil {
+		return nil, err
+	}
+	return scrubs, nil
+}
+
+// saveScrubs writes our scrubs' results to disk, callers must hold the lock.
+func (s Shard) saveScrubs(scrubs []ScrubMsg) error {
+	data, err := json.Marshal(scrubs)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(path.Dir(s.scrubsFile())); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(s.scrubsFile(), data)
+}
+
+// lastScrub returns the result of the last scrub, nil if there hasn't been
+// one.
+func (s Shard) lastScrub() (*ScrubMsg, error) {
+	s.scrubs.lock.Lock()
+	defer s.scrubs.lock.Unlock()
+	scrubs, err := s.loadScrubs()
+	if err != nil || len(scrubs) == 0 {
+		return nil, err
+	}
+	return &scrubs[len(scrubs)-1], nil
+}
+
+// scrub scrubs the volume and records the result.
+func (s Shard) scrub() (ScrubMsg, error) {
+	s.scrubs.lock.Lock()
+	if s.scrubs.running {
+		s.scrubs.lock.Unlock()
+		return ScrubMsg{}, errScrubRunning
+	}
+	s.scrubs.running = true
+	s.scrubs.lock.Unlock()
+
+	msg := ScrubMsg{Started: time.Now().Format("2006-01-02T15:04:05.999999-07:00")}
+	stats, err := btrfs.Scrub()
+	msg.Finished = time.Now().Format("2006-01-02T15:04:05.999999-07:00")
+	msg.BytesScrubbed = stats.BytesScrubbed
+	msg.CsumErrors = stats.CsumErrors
+	msg.ReadErrors = stats.ReadErrors
+	msg.VerifyErrors = stats.VerifyErrors
+	msg.SuperErrors = stats.SuperErrors
+	msg.CorrectedErrors = stats.CorrectedErrors
+	msg.UncorrectableErrors = stats.UncorrectableErrors
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	if msg.UncorrectableErrors > 0 {
+		logger.Error("ALERT: scrub found uncorrectable errors, data is corrupt", "errors", msg.UncorrectableErrors, "repo", s.dataRepo)
+	}
+
+	s.scrubs.lock.Lock()
+	defer s.scrubs.lock.Unlock()
+	s.scrubs.running = false
+	scrubs, loadErr := s.loadScrubs()
+	if loadErr == nil {
+		scrubs = append(scrubs, msg)
+		if len(scrubs) > maxScrubs {
+			scrubs = scrubs[len(scrubs)-maxScrubs:]
+		}
+		loadErr = s.saveScrubs(scrubs)
+	}
+	if loadErr != nil {
+		logger.Error("saving scrubs", "err", loadErr)
+	}
+	return msg, err
+}
+
+// RunScrubs scrubs the volume whenever the last scrub is more than
+// scrubInterval old, until cancel is closed.
+func (s Shard) RunScrubs(cancel chan struct{}) {
+	ticker := time.NewTicker(scrubCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			last, err := s.lastScrub()
+			if err != nil {
+				logger.Error("loading last scrub", "err", err)
+				continue
+			}
+			if last != nil {
+				finished, err := time.Parse("2006-01-02T15:04:05.999999-07:00", last.Finished)
+				if err == nil && now.Sub(finished) < s.scrubInterval {
+					continue
+				}
+			}
+			if _, err := s.scrub(); err != nil {
+				logger.Error("scrubbing", "err", err)
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// ScrubHandler lists scrubs and starts new ones.
+func (s Shard) ScrubHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.scrubs.lock.Lock()
+		scrubs, err := s.loadScrubs()
+		s.scrubs.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if scrubs == nil {
+			scrubs = []ScrubMsg{}
+		}
+		if err := json.NewEncoder(w).Encode(scrubs); err != nil {
+			logError(r, err)
+		}
+	case "POST":
+		var msg ScrubMsg
+		err := timeOp(w, "btrfs.Scrub", func() error {
+			var err error
+			msg, err = s.scrub()
+			return err
+		})
+		if err == errScrubRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+// HealthHandler reports whether our data is intact.
+func (s Shard) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	last, err := s.lastScrub()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	msg := HealthMsg{Status: "ok", LastScrub: last}
+	switch {
+	case last != nil && last.UncorrectableErrors > 0:
+		msg.Status = "corrupt"
+	case s.catchingUp():
+		msg.Status = "catching up"
+	}
+	if msg.Status != "ok" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
+
+// MetricsHandler writes our request metrics followed by the results of the
+// last scrub in the Prometheus text format.
+func (s Shard) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	s.latency.MetricsHandler(w, r)
+	last, err := s.lastScrub()
+	if err != nil {
+		logError(r, err)
+		return
+	}
+	if last == nil {
+		return
+	}
+	if finished, err := time.Parse("2006-01-02T15:04:05.999999-07:00", last.Finished); err == nil {
+		fmt.Fprint(w, "# HELP pfs_scrub_last_finished_timestamp_seconds When the last scrub finished.\n")
+		fmt.Fprint(w, "# TYPE pfs_scrub_last_finished_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "pfs_scrub_last_finished_timestamp_seconds %d\n", finished.Unix())
+	}
+	fmt.Fprint(w, "# HELP pfs_scrub_bytes The bytes the last scrub checked.\n")
+	fmt.Fprint(w, "# TYPE pfs_scrub_bytes gauge\n")
+	fmt.Fprintf(w, "pfs_scrub_bytes %d\n", last.BytesScrubbed)
+	fmt.Fprint(w, "# HELP pfs_scrub_errors Errors the last scrub found, by kind.\n")
+	fmt.Fprint(w, "# TYPE pfs_scrub_errors gauge\n")
+	for _, e := range []struct {
+		kind  string
+		count int64
+	}{
+		{"csum", last.CsumErrors},
+		{"read", last.ReadErrors},
+		{"verify", last.VerifyErrors},
+		{"super", last.SuperErrors},
+	} {
+		fmt.Fprintf(w, "pfs_scrub_errors{kind=%q} %d\n", e.kind, e.count)
+	}
+	fmt.Fprint(w, "# HELP pfs_scrub_corrected_errors Errors the last scrub corrected.\n")
+	fmt.Fprint(w, "# TYPE pfs_scrub_corrected_errors gauge\n")
+	fmt.Fprintf(w, "pfs_scrub_corrected_errors %d\n", last.CorrectedErrors)
+	fmt.Fprint(w, "# HELP pfs_scrub_uncorrectable_errors Errors the last scrub couldn't correct, any means data is corrupt.\n")
+	fmt.Fprint(w, "# TYPE pfs_scrub_uncorrectable_errors gauge\n")
+	fmt.Fprintf(w, "pfs_scrub_uncorrectable_errors %d\n", last.UncorrectableErrors)
+}
@@ -1,29 +1,53 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"code.google.com/p/go-uuid/uuid"
 	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/checksum"
+	"github.com/pachyderm/pfs/lib/logging"
 	"github.com/pachyderm/pfs/lib/mapreduce"
+	"github.com/pachyderm/pfs/lib/pipeline"
+	"github.com/pachyderm/pfs/lib/route"
+	"github.com/pachyderm/pfs/lib/s3utils"
+	"github.com/pachyderm/pfs/lib/shell"
+	"github.com/pachyderm/pfs/lib/stripe"
 )
 
 var jobDir string = "job"
 
-func commitParam(r *http.Request) string {
-	if p := r.URL.Query().Get("commit"); p != "" {
-		return p
+// commitParam returns the commit or branch r is about. Tags and as-ofs, see
+// btrfs.Resolve, are resolved to the commits they refer to, and ?asof=<time>
+// picks the commit from that time in the history of ?commit=.
+func (s Shard) commitParam(r *http.Request) string {
+	p := r.URL.Query().Get("commit")
+	if p == "" {
+		p = "master"
 	}
-	return "master"
+	if asOf := r.URL.Query().Get("asof"); asOf != "" {
+		p = fmt.Sprintf("%s@{%s}", p, asOf)
+	}
+	return btrfs.Resolve(s.dataRepo, p)
 }
 
 func branchParam(r *http.Request) string {
@@ -33,6 +57,111 @@ func branchParam(r *http.Request) string {
 	return "master"
 }
 
+// rejectInvalidRefs responds with a 400 if r's branch or commit isn't a valid
+// name, so that they can't reach outside the repo the way ?branch=.. would.
+// It returns true if it did.
+func rejectInvalidRefs(w http.ResponseWriter, r *http.Request) bool {
+	err := btrfs.ValidName(branchParam(r))
+	if commit := r.URL.Query().Get("commit"); err == nil && commit != "" {
+		err = btrfs.ValidRef(commit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return true
+	}
+	return false
+}
+
+// tokenHeader carries consistency tokens. Writes return the commit they're
+// based on, and commits the commit they made, readers that pass the token
+// back through the router are only served by nodes that have the commit.
+const tokenHeader = "X-Pfs-Token"
+
+// ifMatch returns the head that r's If-Match header requires its branch to
+// have, "" if it doesn't require one.
+func ifMatch(r *http.Request) string {
+	match := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if match == "*" {
+		return ""
+	}
+	return match
+}
+
+// errorStatus returns the status code to respond with when a request fails
+// with err.
+func errorStatus(err error) int {
+	var hookErr btrfs.HookError
+	var headErr btrfs.HeadMovedError
+	var limitErr limitError
+	var checksumErr *checksum.Error
+	var misrouted misroutedError
+	switch {
+	case errors.Is(err, btrfs.ErrCommitNotFound), errors.Is(err, btrfs.ErrBranchNotFound), errors.Is(err, btrfs.ErrFileNotFound),
+		errors.Is(err, btrfs.ErrTagNotFound), errors.Is(err, errHoldNotFound):
+		return 404
+	case errors.Is(err, btrfs.ErrCommitExists), errors.Is(err, btrfs.ErrBranchExists), errors.Is(err, btrfs.ErrTagExists),
+		errors.Is(err, btrfs.ErrNotReplica), errors.Is(err, btrfs.ErrConfigChanged), errors.Is(err, errHoldExists):
+		return http.StatusConflict
+	case errors.Is(err, btrfs.ErrReadOnlyCommit):
+		return http.StatusForbidden
+	case errors.Is(err, btrfs.ErrFrozen):
+		return http.StatusLocked
+	case errors.Is(err, btrfs.ErrInvalidName), errors.As(err, &hookErr), errors.As(err, &checksumErr):
+		return 400
+	case errors.As(err, &headErr):
+		return http.StatusPreconditionFailed
+	case btrfs.IsQuotaExceeded(err):
+		// 507 is Insufficient Storage
+		return 507
+	case errors.As(err, &limitErr):
+		return limitErr.status
+	case errors.As(err, &misrouted):
+		// 421 is Misdirected Request
+		return 421
+	}
+	return 500
+}
+
+// httpError responds to r, which failed with err, with the status code from
+// errorStatus. Only errors that are our fault are logged.
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
+	var limitErr limitError
+	if errors.As(err, &limitErr) && limitErr.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.retryAfter.Seconds()))))
+	}
+	status := errorStatus(err)
+	http.Error(w, err.Error(), status)
+	if status == 500 {
+		logError(r, err)
+	}
+}
+
+// checkUpload replaces the body of r, a write of a whole file, with one that
+// fails if it doesn't match the checksums r was sent with.
+func checkUpload(r *http.Request) error {
+	body, err := checksum.NewReader(r.Body, r.Header)
+	if err != nil {
+		return err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+	return nil
+}
+
+// isChecksumError returns true if err is a body not matching its checksum.
+func isChecksumError(err error) bool {
+	var checksumErr *checksum.Error
+	return errors.As(err, &checksumErr)
+}
+
+// validNewName returns an error if name can't be used for a new commit or
+// branch.
+func (s Shard) validNewName(name string) error {
+	return btrfs.ValidUserName(name, s.allowReserved)
+}
+
 func hasBranch(r *http.Request) bool {
 	return (r.URL.Query().Get("branch") == "")
 }
@@ -57,7 +186,7 @@ func cat(w http.ResponseWriter, name string) {
 	exists, err := btrfs.FileExists(name)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
-		log.Print(err)
+		logger.Error("reading file", "file", name, "err", err)
 	}
 	if !exists {
 		http.Error(w, "404 page not found", 404)
@@ -67,22 +196,166 @@ func cat(w http.ResponseWriter, name string) {
 	f, err := btrfs.Open(name)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
-		log.Print(err)
+		logger.Error("reading file", "file", name, "err", err)
 		return
 	}
 	defer f.Close()
+	content, _, err := fileContent(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logger.Error("reading file", "file", name, "err", err)
+		return
+	}
+
+	if err := timeOp(w, "copyBuffer", func() error {
+		_, err := copyBuffer(w, content)
+		return err
+	}); err != nil {
+		http.Error(w, err.Error(), 500)
+		logger.Error("reading file", "file", name, "err", err)
+		return
+	}
+}
 
-	if _, err := io.Copy(w, f); err != nil {
+// serveFile serves a single file with http.ServeContent, which gives us
+// Range requests, Content-Length and Last-Modified for free.
+func serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := btrfs.Open(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
 		http.Error(w, err.Error(), 500)
-		log.Print(err)
+		logError(r, err)
 		return
 	}
+	if fi.IsDir() {
+		http.Error(w, fmt.Sprintf("%s is a directory.", path.Base(name)), 400)
+		return
+	}
+	etag, err := etag(name, fi)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if err := writeFileMeta(w, f.Name()); err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if err := writePerms(w, name); err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if n, ok := stripes(f.Name()); ok {
+		w.Header().Set(stripe.Header, n)
+	}
+	content, _, err := fileContent(f)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	timeOp(w, "http.ServeContent", func() error {
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+		return nil
+	})
+}
+
+// etag returns the ETag for a file. Files in commits never change so we use
+// the commit's name, files in branches get a weak tag based on their size and
+// modification time.
+func etag(name string, fi os.FileInfo) (string, error) {
+	// name looks like: <repo>/<commit>/<file>
+	parts := strings.SplitN(name, "/", 3)
+	if len(parts) == 3 {
+		isCommit, err := btrfs.IsReadOnly(path.Join(parts[0], parts[1]))
+		if err != nil {
+			return "", err
+		}
+		if isCommit {
+			return fmt.Sprintf("\"%s\"", parts[1]), nil
+		}
+	}
+	return fmt.Sprintf("W/\"%d-%d\"", fi.Size(), fi.ModTime().UnixNano()), nil
+}
+
+// etagMatch returns true if an If-None-Match header matches etag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag || "W/"+candidate == etag || candidate == "W/"+etag {
+			return true
+		}
+	}
+	return false
 }
 
 type Shard struct {
 	url                string
 	dataRepo, compRepo string
 	shard, modulos     uint64
+	latency            *latencyTracker
+	region             *region
+	events             *broker
+	auth               *authorizer // nil means auth is disabled
+	drainer            *drainer
+	pending            *pendingRequests
+	replicas           *replicaSet
+	role               *roleState
+	pipelines          *pipelineSet
+	webhooks           *webhookSet
+	scrubs             *scrubState
+	holds              *holdSet
+	limits             *limitState
+	readCache          *readCache // nil means reads of commits we don't have aren't fetched
+	// replicationFactor is how many replicas we push commits to, 0 means
+	// all of them.
+	replicationFactor int
+	// compression is the compression algorithm new repos are created with.
+	compression string
+	// preservePerms makes new repos keep the modes and owners files are
+	// written with, see perms.go.
+	preservePerms bool
+	// quota is the quota new repos are created with, 0 means no quota.
+	quota int64
+	// scrubInterval is how often we scrub the volume.
+	scrubInterval time.Duration
+	// tierAfter is how old commits get before they're tiered to S3, 0 means
+	// they aren't.
+	tierAfter time.Duration
+	// restoreFrom is the url of a replica holding a backup, our data repo is
+	// restored from it if it doesn't exist, see backup.go.
+	restoreFrom string
+	// catchUpFrom are the urls of upstreams we pull missing commits from
+	// when we start, see catchup.go.
+	catchUpFrom []string
+	catchUp     *catchUpState
+	// allowReserved lets users make commits and branches with reserved
+	// names, see btrfs.ValidUserName.
+	allowReserved bool
+	// ctx is cancelled, by stop, when the shard shuts down. Work that
+	// outlives the request that started it, like replication, runs under it.
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
 func ShardFromArgs() (Shard, error) {
@@ -95,31 +368,140 @@ func ShardFromArgs() (Shard, error) {
 	if err != nil {
 		return Shard{}, err
 	}
+	// os.Args[3] is optional, if present this shard is in the passive region
+	// and follows the shard at that url.
+	upstream := ""
+	if len(os.Args) > 3 {
+		upstream = os.Args[3]
+	}
+	replicationFactor := 0
+	if factor := os.Getenv("PFS_REPLICATION_FACTOR"); factor != "" {
+		if replicationFactor, err = strconv.Atoi(factor); err != nil {
+			return Shard{}, err
+		}
+	}
+	var quota int64
+	if q := os.Getenv("PFS_REPO_QUOTA"); q != "" {
+		if quota, err = strconv.ParseInt(q, 10, 64); err != nil {
+			return Shard{}, err
+		}
+	}
+	scrubInterval := defaultScrubInterval
+	if interval := os.Getenv("PFS_SCRUB_INTERVAL"); interval != "" {
+		if scrubInterval, err = time.ParseDuration(interval); err != nil {
+			return Shard{}, err
+		}
+	}
+	var tierAfter time.Duration
+	if after := os.Getenv("PFS_TIER_AFTER"); after != "" {
+		if tierAfter, err = time.ParseDuration(after); err != nil {
+			return Shard{}, err
+		}
+	}
+	var cache *readCache
+	if size := os.Getenv("PFS_READ_CACHE_SIZE"); size != "" {
+		max, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return Shard{}, err
+		}
+		if cache, err = newReadCache(btrfs.FilePath(path.Join("cache", "data-"+os.Args[1])), max); err != nil {
+			return Shard{}, err
+		}
+	}
+	var catchUpFrom []string
+	if from := os.Getenv("PFS_CATCH_UP_FROM"); from != "" {
+		catchUpFrom = strings.Split(from, ",")
+	}
+	var auth *authorizer
+	if policy := os.Getenv("PFS_AUTH_POLICY"); policy != "" {
+		if auth, err = loadAuthorizer(policy); err != nil {
+			return Shard{}, err
+		}
+	}
+	ctx, stop := context.WithCancel(context.Background())
 	return Shard{
-		url:      "http://" + os.Args[2],
-		dataRepo: "data-" + os.Args[1],
-		compRepo: "comp-" + os.Args[1],
-		shard:    shard,
-		modulos:  modulos,
+		url:       "http://" + os.Args[2],
+		dataRepo:  "data-" + os.Args[1],
+		compRepo:  "comp-" + os.Args[1],
+		shard:     shard,
+		modulos:   modulos,
+		latency:   newLatencyTracker(),
+		region:    &region{upstream: upstream},
+		events:    newBroker(),
+		auth:      auth,
+		drainer:   &drainer{},
+		pending:   newPendingRequests(),
+		replicas:  newReplicaSet(),
+		role:      &roleState{},
+		pipelines: newPipelineSet(),
+		webhooks:  newWebhookSet(),
+		scrubs:    &scrubState{},
+		holds:     newHoldSet(),
+		limits:    newLimitState(),
+		readCache: cache,
+		catchUp:   &catchUpState{},
+
+		replicationFactor: replicationFactor,
+		compression:       os.Getenv("PFS_COMPRESSION"),
+		preservePerms:     os.Getenv("PFS_PRESERVE_PERMISSIONS") == "true",
+		quota:             quota,
+		scrubInterval:     scrubInterval,
+		tierAfter:         tierAfter,
+		restoreFrom:       os.Getenv("PFS_RESTORE_FROM"),
+		catchUpFrom:       catchUpFrom,
+		allowReserved:     os.Getenv("PFS_ALLOW_RESERVED_NAMES") == "true",
+		ctx:               ctx,
+		stop:              stop,
 	}, nil
 }
 
 func NewShard(dataRepo, compRepo string, shard, modulos uint64) Shard {
+	ctx, stop := context.WithCancel(context.Background())
 	return Shard{
-		dataRepo: dataRepo,
-		compRepo: compRepo,
-		shard:    shard,
-		modulos:  modulos,
+		dataRepo:  dataRepo,
+		compRepo:  compRepo,
+		shard:     shard,
+		modulos:   modulos,
+		latency:   newLatencyTracker(),
+		region:    &region{},
+		events:    newBroker(),
+		drainer:   &drainer{},
+		pending:   newPendingRequests(),
+		replicas:  newReplicaSet(),
+		role:      &roleState{},
+		pipelines: newPipelineSet(),
+		webhooks:  newWebhookSet(),
+		scrubs:    &scrubState{},
+		holds:     newHoldSet(),
+		catchUp:   &catchUpState{},
+
+		scrubInterval: defaultScrubInterval,
+		ctx:           ctx,
+		stop:          stop,
 	}
 }
 
 func (s Shard) EnsureRepos() error {
-	if err := btrfs.Ensure(s.dataRepo); err != nil {
+	if err := s.restoreRepo(); err != nil {
 		return err
 	}
-	if err := btrfs.Ensure(s.compRepo); err != nil {
+	opts := btrfs.InitOptions{Compression: s.compression, Quota: s.quota, Permissions: s.preservePerms}
+	if err := btrfs.EnsureWithOptions(s.dataRepo, opts); err != nil {
 		return err
 	}
+	if err := btrfs.EnsureWithOptions(s.compRepo, opts); err != nil {
+		return err
+	}
+	return s.ReloadConfig()
+}
+
+// Recover cleans up our repos after a crash, see btrfs.Recover.
+func (s Shard) Recover() error {
+	for _, repo := range []string{s.dataRepo, s.compRepo} {
+		if err := btrfs.Recover(repo); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -127,10 +509,10 @@ func (s Shard) EnsureReplicaRepos() error {
 	if err := btrfs.EnsureReplica(s.dataRepo); err != nil {
 		return err
 	}
-	if err := btrfs.Ensure(s.compRepo); err != nil {
+	if err := btrfs.EnsureWithOptions(s.compRepo, btrfs.InitOptions{Compression: s.compression, Quota: s.quota, Permissions: s.preservePerms}); err != nil {
 		return err
 	}
-	return nil
+	return s.ReloadConfig()
 }
 
 //func parseArgs() {
@@ -178,43 +560,226 @@ func genericFileHandler(fs string, w http.ResponseWriter, r *http.Request) {
 					}
 				}
 			}
+		} else if r.URL.Query().Get("stat") == "true" {
+			statFile(w, r, fs, path.Join(url[fileStart:]...))
 		} else {
-			cat(w, file)
+			serveFile(w, r, file)
 		}
+	} else if r.Method == "POST" && (r.URL.Query().Get("symlink") != "" || r.URL.Query().Get("link") != "") {
+		createLink(w, r, fs, path.Join(url[fileStart:]...))
 	} else if r.Method == "POST" {
+		perms, setPerms, err := checkPerms(fs, r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		btrfs.MkdirAll(path.Dir(file))
-		size, err := btrfs.CreateFromReader(file, r.Body)
+		var size int64
+		err = timeOp(w, "createFile", func() error {
+			var err error
+			if size, err = createFile(file, r.Body); err != nil {
+				return err
+			}
+			if setPerms {
+				if err := perms.apply(file); err != nil {
+					return err
+				}
+			}
+			return setFileMeta(btrfs.FilePath(file), r.Header)
+		})
+		if isLimitError(err) || isChecksumError(err) {
+			// Don't leave the part that fit, or a corrupt file, behind.
+			btrfs.Remove(file)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			log.Print(err)
+			httpError(w, r, err)
 			return
 		}
 		fmt.Fprintf(w, "Created %s, size: %d.\n", path.Join(url[fileStart:]...), size)
 	} else if r.Method == "PUT" {
+		perms, setPerms, err := checkPerms(fs, r)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		btrfs.MkdirAll(path.Dir(file))
-		size, err := btrfs.CopyFile(file, r.Body)
+		var size int64
+		err = timeOp(w, "btrfs.CopyFile", func() error {
+			var err error
+			if size, err = btrfs.CopyFile(file, r.Body); err != nil {
+				return err
+			}
+			if setPerms {
+				if err := perms.apply(file); err != nil {
+					return err
+				}
+			}
+			return setFileMeta(btrfs.FilePath(file), r.Header)
+		})
+		if isLimitError(err) || isChecksumError(err) {
+			// Don't leave the part that fit, or a corrupt file, behind.
+			btrfs.Remove(file)
+		}
 		if err != nil {
-			http.Error(w, err.Error(), 500)
-			log.Print(err)
+			httpError(w, r, err)
 			return
 		}
 		fmt.Fprintf(w, "Created %s, size: %d.\n", path.Join(url[fileStart:]...), size)
+	} else if r.Method == "PATCH" {
+		patchFile(w, r, file, path.Join(url[fileStart:]...))
 	} else if r.Method == "DELETE" {
-		if err := btrfs.Remove(file); err != nil {
+		// Lstat so that symlinks can be deleted whether or not their
+		// targets exist.
+		_, err := btrfs.Lstat(file)
+		if os.IsNotExist(err) {
+			http.Error(w, fmt.Sprintf("File %s not found.", path.Join(url[fileStart:]...)), 404)
+			return
+		}
+		if err != nil {
 			http.Error(w, err.Error(), 500)
-			log.Print(err)
+			logError(r, err)
 			return
 		}
-		fmt.Fprintf(w, "Deleted %s.\n", file)
+		if n, ok := stripes(btrfs.FilePath(file)); ok {
+			w.Header().Set(stripe.Header, n)
+		}
+		if err := timeOp(w, "btrfs.Remove", func() error { return btrfs.Remove(file) }); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "Deleted %s.\n", path.Join(url[fileStart:]...))
+	}
+}
+
+// isMetaPath returns true if name, a path in a branch, is in the branch's
+// metadata.
+func isMetaPath(name string) bool {
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+	return clean == ".meta" || strings.HasPrefix(clean, ".meta/")
+}
+
+// rejectMisrouted writes an error and returns true if the file in r belongs
+// to a different shard. Writing it here would make it invisible to reads,
+// which the router sends to the owner.
+func (s Shard) rejectMisrouted(w http.ResponseWriter, r *http.Request) bool {
+	if s.modulos <= 1 {
+		return false
+	}
+	key := r.URL.Path
+	if i, ok, _ := stripeParam(r); ok {
+		key = stripe.Key(r.URL.Path, i)
 	}
+	owner := route.Owner(key, s.modulos)
+	if owner == s.shard {
+		return false
+	}
+	// 421 is Misdirected Request
+	http.Error(w, fmt.Sprintf("%s belongs to shard %d-%d, this is shard %d-%d.", r.URL.Path, owner, s.modulos, s.shard, s.modulos), 421)
+	return true
 }
 
 // FileHandler is the core route for modifying the contents of the fileystem.
 func (s Shard) FileHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" || r.Method == "DELETE" || r.Method == "PUT" {
-		genericFileHandler(path.Join(s.dataRepo, branchParam(r)), w, r)
+	i, striped, err := stripeParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if rejectInvalidRefs(w, r) {
+		return
+	}
+	if r.Method != "GET" && s.rejectMisrouted(w, r) {
+		return
+	}
+	// Branches' metadata is only written by pfs itself, through the paths
+	// below, so that it's kept out of user writes and freezes.
+	if r.Method != "GET" && isMetaPath(fileName(r)) {
+		http.Error(w, fmt.Sprintf("May not write to %s.", fileName(r)), 400)
+		return
+	}
+	if striped {
+		r.URL.Path = stripePath(r.URL.Path, i)
+	}
+	if isUpload(r) && !isComplete(r) {
+		if r.Method != "GET" && s.rejectWrite(w) {
+			return
+		}
+		s.UploadHandler(w, r, branchParam(r))
+		return
+	}
+	if r.Method == "POST" || r.Method == "DELETE" || r.Method == "PUT" || r.Method == "PATCH" {
+		if s.rejectWrite(w) {
+			return
+		}
+		// Writes share the branch so that they can't be part way through
+		// when it's committed.
+		lock, err := btrfs.RLockBranch(s.dataRepo, branchParam(r))
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		defer lock.Unlock()
+		w.Header().Set(tokenHeader, btrfs.Head(s.dataRepo, branchParam(r)))
+		s.idempotent(w, r, branchParam(r), func(w http.ResponseWriter, r *http.Request) {
+			// The shared lock stops the head moving until we're done.
+			if head := btrfs.Head(s.dataRepo, branchParam(r)); ifMatch(r) != "" && ifMatch(r) != head {
+				err := btrfs.HeadMovedError{Branch: branchParam(r), Head: head, Expected: ifMatch(r)}
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return
+			}
+			var upload string
+			if isComplete(r) {
+				var ok bool
+				if upload, ok = s.completeUpload(w, r); !ok {
+					return
+				}
+			}
+			if r.Method == "POST" || r.Method == "PUT" {
+				if err := checkUpload(r); err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+			}
+			if r.Method != "DELETE" {
+				if err := s.limitWrite(r, path.Join(s.dataRepo, branchParam(r))); err != nil {
+					httpError(w, r, err)
+					return
+				}
+			}
+			if upload == "" && r.Method == "POST" && r.Header.Get(stripe.Header) != "" {
+				writeManifest(path.Join(s.dataRepo, branchParam(r)), w, r)
+				return
+			}
+			if upload == "" {
+				genericFileHandler(path.Join(s.dataRepo, branchParam(r)), w, r)
+				return
+			}
+			rw := &recordingWriter{ResponseWriter: w}
+			genericFileHandler(path.Join(s.dataRepo, branchParam(r)), rw, r)
+			if rw.status < 300 {
+				if err := btrfs.RemoveAll(s.uploadDir(upload)); err != nil {
+					logError(r, err)
+				}
+			}
+		})
 	} else if r.Method == "GET" {
-		genericFileHandler(path.Join(s.dataRepo, commitParam(r)), w, r)
+		if !striped && isHistory(r) {
+			s.historyHandler(w, r)
+			return
+		}
+		if !striped && s.serveRemote(w, r) {
+			return
+		}
+		if id := r.URL.Query().Get("hold"); id != "" {
+			root, err := s.heldRoot(id)
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+			genericFileHandler(root, w, r)
+			return
+		}
+		genericFileHandler(path.Join(s.dataRepo, s.commitParam(r)), w, r)
 	} else {
 		http.Error(w, "Invalid method.", 405)
 	}
@@ -225,138 +790,309 @@ func (s Shard) CommitHandler(w http.ResponseWriter, r *http.Request) {
 	url := strings.Split(r.URL.Path, "/")
 	// url looks like [, commit, <commit>, file, <file>]
 	if len(url) > 3 && url[3] == "file" {
-		genericFileHandler(path.Join(s.dataRepo, url[2]), w, r)
+		// Files are only read here, writes go through /file so that they're
+		// checked and locked.
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid method.", 405)
+			return
+		}
+		if err := btrfs.ValidRef(url[2]); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		genericFileHandler(path.Join(s.dataRepo, btrfs.Resolve(s.dataRepo, url[2])), w, r)
 		return
 	}
 	if r.Method == "GET" {
+		opts, err := listOptions(r)
+		if err == nil {
+			opts.Order, err = btrfs.ParseOrder(r.URL.Query().Get("order"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		encoder := json.NewEncoder(w)
-		btrfs.Commits(s.dataRepo, "", btrfs.Desc, func(c btrfs.CommitInfo) error {
-			isReadOnly, err := btrfs.IsReadOnly(path.Join(s.dataRepo, c.Path))
-			if err != nil {
-				log.Print(err)
-				return err
-			}
-			if isReadOnly {
-				fi, err := btrfs.Stat(path.Join(s.dataRepo, c.Path))
+		written := false
+		err = timeOp(w, "btrfs.WalkCommits", func() error {
+			return btrfs.WalkCommits(s.dataRepo, opts, func(c btrfs.Subvolume) error {
+				fi, err := btrfs.Stat(path.Join(s.dataRepo, c.Name))
 				if err != nil {
-					log.Print(err)
 					return err
 				}
-				err = encoder.Encode(CommitMsg{Name: fi.Name(), TStamp: fi.ModTime().Format("2006-01-02T15:04:05.999999-07:00")})
-				if err != nil {
-					log.Print(err)
-					return err
-				}
-			}
-			return nil
+				written = true
+				return encoder.Encode(CommitMsg{Name: fi.Name(), TStamp: fi.ModTime().Format("2006-01-02T15:04:05.999999-07:00"), Transid: c.Transid})
+			})
 		})
+		if err != nil && !written {
+			httpError(w, r, err)
+		} else if err != nil {
+			logError(r, err)
+		}
 	} else if r.Method == "POST" && r.ContentLength == 0 {
 		// Create a commit from local data
-		var commit string
-		if commit = r.URL.Query().Get("commit"); commit == "" {
-			commit = uuid.New()
-		}
-		err := btrfs.Commit(s.dataRepo, commit, branchParam(r))
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			log.Print(err)
+		if s.rejectWrite(w) {
 			return
 		}
-
-		if materializeParam(r) == "true" {
-			go func() {
-				err := mapreduce.Materialize(s.dataRepo, branchParam(r), commit,
-					s.compRepo, jobDir, s.shard, s.modulos)
-				if err != nil {
-					log.Print(err)
-				}
-			}()
+		if r.URL.Query().Get("phase") != "" {
+			s.commitPhase(w, r)
+			return
 		}
-		// Sync changes to peers
-		go s.SyncToPeers()
-		fmt.Fprintf(w, "%s\n", commit)
+		s.idempotent(w, r, branchParam(r), s.localCommit)
 	} else if r.Method == "POST" {
 		// Commit being pushed via a diff
-		replica := btrfs.NewLocalReplica(s.dataRepo)
-		if err := replica.Push(r.Body); err != nil {
-			http.Error(w, err.Error(), 500)
-			log.Print(err)
+		if !s.acceptPush(w, r) {
+			return
+		}
+		replica := s.localReplica()
+		if err := timeOp(w, "btrfs.Recv", func() error { return replica.Push(r.Context(), r.Body) }); err != nil {
+			httpError(w, r, err)
 			return
 		}
 	} else {
 		http.Error(w, "Unsupported method.", http.StatusMethodNotAllowed)
-		log.Printf("Unsupported method %s in request to %s.", r.Method, r.URL.String())
+		logger.WarnContext(r.Context(), "unsupported method", "method", r.Method, "url", r.URL.String())
 		return
 	}
 }
 
+// localCommit commits the branch named in r.
+func (s Shard) localCommit(w http.ResponseWriter, r *http.Request) {
+	var commit string
+	if commit = r.URL.Query().Get("commit"); commit == "" {
+		commit = btrfs.NewCommitId()
+	}
+	if err := s.validNewName(commit); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	err := timeOp(w, "btrfs.Commit", func() error {
+		_, err := btrfs.CommitWithOptions(s.dataRepo, commit, branchParam(r), btrfs.CommitOptions{IfHead: ifMatch(r)})
+		return err
+	})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	msg, err := s.newCommitMsg(commit)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+
+	if materializeParam(r) == "true" {
+		go func() {
+			err := mapreduce.Materialize(s.dataRepo, branchParam(r), commit,
+				s.compRepo, jobDir, s.shard, s.modulos)
+			if err != nil {
+				logError(r, err)
+			}
+		}()
+	}
+	go s.publishCommit(commit)
+	// Sync changes to peers
+	go s.syncToPeers(s.detach(r))
+	w.Header().Set(tokenHeader, commit)
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		logError(r, err)
+	}
+}
+
 // BranchHandler creates a new branch from commit.
 func (s Shard) BranchHandler(w http.ResponseWriter, r *http.Request) {
 	url := strings.Split(r.URL.Path, "/")
 	// url looks like [, commit, <commit>, file, <file>]
 	if len(url) > 3 && url[3] == "file" {
-		genericFileHandler(path.Join(s.dataRepo, url[2]), w, r)
+		// Files are only read here, writes go through /file so that they're
+		// checked and locked.
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "Invalid method.", 405)
+			return
+		}
+		if err := btrfs.ValidRef(url[2]); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		genericFileHandler(path.Join(s.dataRepo, btrfs.Resolve(s.dataRepo, url[2])), w, r)
 		return
 	}
 	if r.Method == "GET" {
 		encoder := json.NewEncoder(w)
-		btrfs.Commits(s.dataRepo, "", btrfs.Desc, func(c btrfs.CommitInfo) error {
-			isReadOnly, err := btrfs.IsReadOnly(path.Join(s.dataRepo, c.Path))
+		subvolumes, err := btrfs.Listing(s.dataRepo)
+		if err != nil {
+			logError(r, err)
+			return
+		}
+		for _, b := range subvolumes {
+			if b.Commit {
+				continue
+			}
+			fi, err := btrfs.Stat(path.Join(s.dataRepo, b.Name))
 			if err != nil {
-				return err
+				logError(r, err)
+				return
 			}
-			if !isReadOnly {
-				fi, err := btrfs.Stat(path.Join(s.dataRepo, c.Path))
-				if err != nil {
-					return err
-				}
-				err = encoder.Encode(BranchMsg{Name: fi.Name(), TStamp: fi.ModTime().Format("2006-01-02T15:04:05.999999-07:00")})
-				if err != nil {
-					log.Print(err)
-					return err
-				}
+			err = encoder.Encode(BranchMsg{
+				Name:   fi.Name(),
+				TStamp: fi.ModTime().Format("2006-01-02T15:04:05.999999-07:00"),
+				Head:   b.Head,
+			})
+			if err != nil {
+				logError(r, err)
+				return
 			}
-			return nil
-		})
+		}
 	} else if r.Method == "POST" {
-		if err := btrfs.Branch(s.dataRepo, commitParam(r), branchParam(r)); err != nil {
-			http.Error(w, err.Error(), 500)
-			log.Print(err)
+		if s.rejectWrite(w) {
+			return
+		}
+		if err := s.validNewName(branchParam(r)); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := btrfs.ValidName(s.commitParam(r)); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		var opts btrfs.BranchOptions
+		if quota := r.URL.Query().Get("quota"); quota != "" {
+			var err error
+			if opts.Quota, err = strconv.ParseInt(quota, 10, 64); err != nil || opts.Quota < 0 {
+				http.Error(w, fmt.Sprintf("Invalid quota %s.", quota), 400)
+				return
+			}
+		}
+		err := timeOp(w, "btrfs.Branch", func() error {
+			return btrfs.BranchWithOptions(s.dataRepo, s.commitParam(r), branchParam(r), opts)
+		})
+		if err != nil {
+			httpError(w, r, err)
 			return
 		}
-		fmt.Fprintf(w, "Created branch. (%s) -> %s.\n", commitParam(r), branchParam(r))
+		fmt.Fprintf(w, "Created branch. (%s) -> %s.\n", s.commitParam(r), branchParam(r))
 	} else {
 		http.Error(w, "Invalid method.", 405)
-		log.Print("Invalid method %s.", r.Method)
+		logger.WarnContext(r.Context(), "invalid method", "method", r.Method)
+		return
+	}
+}
+
+// UnlockHandler breaks a branch's lock, for when whoever holds it is stuck.
+func (s Shard) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if err := btrfs.ValidName(branchParam(r)); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := btrfs.ForceUnlock(s.dataRepo, branchParam(r)); err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
 		return
 	}
+	fmt.Fprintf(w, "Unlocked branch %s.\n", branchParam(r))
 }
 
 func (s Shard) JobHandler(w http.ResponseWriter, r *http.Request) {
-	url := strings.Split(r.URL.Path, "/")
+	url := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	if r.Method == "GET" && (len(url) <= 3 || url[3] == "logs") {
+		s.PipelineJobHandler(w, r)
+		return
+	}
 	if r.Method == "GET" && len(url) > 3 && url[3] == "file" {
 		// url looks like [, job, <job>, file, <file>]
 		if hasBranch(r) {
-			err := mapreduce.WaitJob(s.compRepo, branchParam(r), commitParam(r), url[2])
+			err := mapreduce.WaitJob(s.compRepo, branchParam(r), s.commitParam(r), url[2])
 			if err != nil {
 				http.Error(w, err.Error(), 500)
-				log.Print(err)
+				logError(r, err)
 				return
 			}
 			genericFileHandler(path.Join(s.compRepo, branchParam(r), url[2]), w, r)
 		} else {
-			genericFileHandler(path.Join(s.compRepo, commitParam(r), url[2]), w, r)
+			genericFileHandler(path.Join(s.compRepo, s.commitParam(r), url[2]), w, r)
 		}
 		return
-	} else if r.Method == "POST" {
+	} else if r.Method == "POST" && len(url) > 2 {
+		if s.rejectWrite(w) {
+			return
+		}
 		r.URL.Path = path.Join("/file", jobDir, url[2])
-		log.Print("URL with reset path:\n", r.URL)
+		logger.DebugContext(r.Context(), "url with reset path", "url", r.URL.String())
 		genericFileHandler(path.Join(s.dataRepo, branchParam(r)), w, r)
 	} else {
 		http.Error(w, "Invalid method.", 405)
-		log.Print("Invalid method %s.", r.Method)
+		logger.WarnContext(r.Context(), "invalid method", "method", r.Method)
+		return
+	}
+}
+
+// DiffHandler lists the files that changed between two commits, including
+// the ones that were deleted.
+func (s Shard) DiffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = "t0"
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = "master"
+	}
+	from, to = btrfs.Resolve(s.dataRepo, from), btrfs.Resolve(s.dataRepo, to)
+	for _, commit := range []string{from, to} {
+		exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+			return
+		}
+	}
+	filter, err := fileFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
 		return
 	}
+	var files []string
+	err = timeOp(w, "btrfs.FindNew", func() error {
+		var err error
+		files, err = btrfs.FindNew(s.dataRepo, from, to)
+		return err
+	})
+	if err == nil {
+		// FindNew only sees files that are in to, deleted files changed too.
+		err = timeOp(w, "btrfs.FindDeleted", func() error {
+			deleted, err := btrfs.FindDeleted(s.dataRepo, from, to)
+			files = append(files, deleted...)
+			return err
+		})
+		sort.Strings(files)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if filter != nil {
+		var matched []string
+		for _, file := range files {
+			if filter(file) {
+				matched = append(matched, file)
+			}
+		}
+		files = matched
+	}
+	writeFileList(w, r, files)
 }
 
 func (s Shard) PullHandler(w http.ResponseWriter, r *http.Request) {
@@ -366,31 +1102,240 @@ func (s Shard) PullHandler(w http.ResponseWriter, r *http.Request) {
 	cb := NewMultiPartCommitBrancher(mpw)
 	w.Header().Add("Boundary", mpw.Boundary())
 	localReplica := btrfs.NewLocalReplica(s.dataRepo)
-	err := localReplica.Pull(from, cb)
+	err := timeOp(w, "btrfs.Pull", func() error { return localReplica.Pull(r.Context(), from, cb) })
 	if err != nil {
 		http.Error(w, err.Error(), 500)
-		log.Print(err)
+		logError(r, err)
 		return
 	}
 }
 
+// SendHandler streams the commits after `from` as raw btrfs send data.
+func (s Shard) SendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from != "" {
+		exists, err := btrfs.FileExists(path.Join(s.dataRepo, from))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Commit %s not found.", from), 404)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	localReplica := btrfs.NewLocalReplica(s.dataRepo)
+	err := timeOp(w, "btrfs.Pull", func() error { return localReplica.Pull(r.Context(), from, NewWriterPusher(w)) })
+	if err != nil {
+		// The stream has started so all we can do is cut it short, Recv
+		// will fail on the other end.
+		logError(r, err)
+	}
+}
+
+// RecvHandler applies raw btrfs send data, such as the output of /send, to
+// our data repo.
+func (s Shard) RecvHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if !s.acceptPush(w, r) {
+		return
+	}
+	replica := s.localReplica()
+	if err := timeOp(w, "btrfs.Recv", func() error { return replica.Push(r.Context(), r.Body) }); err != nil {
+		httpError(w, r, err)
+		return
+	}
+	from, err := btrfs.GetFrom(s.dataRepo)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	fmt.Fprintf(w, "Received, latest commit: %s.\n", from)
+}
+
+// ExportHandler writes a commit as a portable archive, see btrfs.Export, or
+// as a pack with format=pack, see btrfs.WritePack.
+func (s Shard) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	commit := btrfs.Resolve(s.dataRepo, r.URL.Query().Get("commit"))
+	exists, err := btrfs.FileExists(path.Join(s.dataRepo, commit))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if commit == "" || !exists {
+		http.Error(w, fmt.Sprintf("Commit %s not found.", commit), 404)
+		return
+	}
+	opts := btrfs.ExportOptions{Open: openContent}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		err = timeOp(w, "btrfs.Export", func() error { return btrfs.ExportWithOptions(s.dataRepo, commit, w, opts) })
+	case "pack":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		err = timeOp(w, "btrfs.WritePack", func() error { return btrfs.WritePack(s.dataRepo, commit, w, opts) })
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported format %s, it must be tar or pack.", format), 400)
+		return
+	}
+	if err != nil {
+		// Like /send, once the archive has started all we can do is cut it
+		// short and Import will fail on the other end.
+		logError(r, err)
+	}
+}
+
+// ImportHandler recreates the commit in a portable archive made by /export.
+func (s Shard) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if s.rejectWrite(w) {
+		return
+	}
+	var commit string
+	err := timeOp(w, "btrfs.Import", func() error {
+		var err error
+		commit, err = btrfs.Import(s.dataRepo, r.Body)
+		return err
+	})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fmt.Fprintf(w, "Imported %s.\n", commit)
+}
+
 // ShardMux creates a multiplexer for a Shard writing to the passed in FS.
 func (s Shard) ShardMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/branch", s.BranchHandler)
-	mux.HandleFunc("/commit", s.CommitHandler)
-	mux.HandleFunc("/file/", s.FileHandler)
-	mux.HandleFunc("/job/", s.JobHandler)
+	mux.HandleFunc("/archive", s.latency.wrap("/archive", s.ArchiveHandler))
+	mux.HandleFunc("/backup", s.latency.wrap("/backup", s.BackupHandler))
+	mux.HandleFunc("/batch", s.latency.wrap("/batch", s.BatchHandler))
+	mux.HandleFunc("/branch", s.latency.wrap("/branch", s.BranchHandler))
+	mux.HandleFunc("/commit", s.latency.wrap("/commit", s.CommitHandler))
+	mux.HandleFunc("/dav", s.latency.wrap("/dav", s.DavHandler))
+	mux.HandleFunc("/dav/", s.latency.wrap("/dav/", s.DavHandler))
+	mux.HandleFunc("/diff", s.latency.wrap("/diff", s.DiffHandler))
+	mux.HandleFunc("/du", s.latency.wrap("/du", s.DuHandler))
+	mux.HandleFunc("/events", s.EventsHandler)
+	mux.HandleFunc("/export", s.latency.wrap("/export", s.ExportHandler))
+	mux.HandleFunc("/file/", s.latency.wrap("/file/", s.FileHandler))
+	mux.HandleFunc("/filediff", s.latency.wrap("/filediff", s.FileDiffHandler))
+	mux.HandleFunc("/fsck", s.latency.wrap("/fsck", s.FsckHandler))
+	mux.HandleFunc("/head", s.latency.wrap("/head", s.HeadHandler))
+	mux.HandleFunc("/health", s.HealthHandler)
+	mux.HandleFunc("/hold", s.latency.wrap("/hold", s.HoldHandler))
+	mux.HandleFunc("/hold/", s.latency.wrap("/hold/", s.HoldHandler))
+	mux.HandleFunc("/import", s.latency.wrap("/import", s.ImportHandler))
+	mux.HandleFunc("/job", s.latency.wrap("/job", s.JobHandler))
+	mux.HandleFunc("/job/", s.latency.wrap("/job/", s.JobHandler))
+	mux.HandleFunc("/limits", s.latency.wrap("/limits", s.LimitsHandler))
+	mux.HandleFunc("/list", s.latency.wrap("/list", s.ListHandler))
+	mux.HandleFunc("/pipeline", s.latency.wrap("/pipeline", s.PipelineHandler))
+	mux.HandleFunc("/pipeline/", s.latency.wrap("/pipeline/", s.PipelineHandler))
 	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "pong\n") })
-	mux.HandleFunc("/pull", s.PullHandler)
+	mux.HandleFunc("/provenance", s.latency.wrap("/provenance", s.ProvenanceHandler))
+	mux.HandleFunc("/pull", s.latency.wrap("/pull", s.PullHandler))
+	mux.HandleFunc("/recv", s.latency.wrap("/recv", s.RecvHandler))
+	mux.HandleFunc("/repo", s.latency.wrap("/repo", s.RepoHandler))
+	mux.HandleFunc("/repo/", s.latency.wrap("/repo/", s.RepoHandler))
+	mux.HandleFunc("/replica", s.latency.wrap("/replica", s.ReplicaHandler))
+	mux.HandleFunc("/replica/", s.latency.wrap("/replica/", s.ReplicaHandler))
+	mux.HandleFunc("/reshard", s.latency.wrap("/reshard", s.ReshardHandler))
+	mux.HandleFunc("/scrub", s.latency.wrap("/scrub", s.ScrubHandler))
+	mux.HandleFunc("/send", s.latency.wrap("/send", s.SendHandler))
+	mux.HandleFunc("/shuffle", s.latency.wrap("/shuffle", s.ShuffleHandler))
+	mux.HandleFunc("/tag", s.latency.wrap("/tag", s.TagHandler))
+	mux.HandleFunc("/tag/", s.latency.wrap("/tag/", s.TagHandler))
+	mux.HandleFunc("/tier", s.latency.wrap("/tier", s.TierHandler))
+	mux.HandleFunc("/watch", s.WatchHandler)
+	mux.HandleFunc("/webhook", s.latency.wrap("/webhook", s.WebhookHandler))
+	mux.HandleFunc("/webhook/", s.latency.wrap("/webhook/", s.WebhookHandler))
+	mux.HandleFunc("/admin/demote", s.latency.wrap("/admin/demote", s.DemoteHandler))
+	mux.HandleFunc("/admin/failover", s.latency.wrap("/admin/failover", s.FailoverHandler))
+	mux.HandleFunc("/admin/fence", s.latency.wrap("/admin/fence", s.RoleHandler))
+	mux.HandleFunc("/admin/gc", s.latency.wrap("/admin/gc", s.GCHandler))
+	mux.HandleFunc("/admin/promote", s.latency.wrap("/admin/promote", s.RoleHandler))
+	mux.HandleFunc("/admin/region", s.latency.wrap("/admin/region", s.RegionHandler))
+	mux.HandleFunc("/admin/role", s.latency.wrap("/admin/role", s.RoleHandler))
+	mux.HandleFunc("/admin/unlock", s.latency.wrap("/admin/unlock", s.UnlockHandler))
+	mux.HandleFunc("/debug/latency", s.latency.LatencyHandler)
+	mux.HandleFunc("/debug/slow", s.latency.SlowHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/metrics", s.MetricsHandler)
+
+	h := s.drainer.wrap(mux)
+	if s.auth != nil {
+		h = s.authorize(h)
+	}
+	outer := http.NewServeMux()
+	outer.Handle("/", withRequestId(h))
+	return outer
+}
 
-	return mux
+// listen listens on port 80. If PFS_TLS_CERT and PFS_TLS_KEY are set it
+// serves TLS and, if PFS_TLS_CLIENT_CA is also set, verifies client
+// certificates against it.
+func listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", ":80")
+	if err != nil {
+		return nil, err
+	}
+	cert, key := os.Getenv("PFS_TLS_CERT"), os.Getenv("PFS_TLS_KEY")
+	if cert == "" || key == "" {
+		return l, nil
+	}
+	keyPair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	if ca := os.Getenv("PFS_TLS_CLIENT_CA"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s.", ca)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tls.NewListener(l, config), nil
 }
 
-// RunServer runs a shard server listening on port 80
+// RunServer runs a shard server listening on port 80 until it's shut down
+// with SIGTERM.
 func (s Shard) RunServer() {
-	http.ListenAndServe(":80", s.ShardMux())
+	l, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go s.shutdownOnSignal(l)
+	if err := http.Serve(l, s.ShardMux()); err != nil && !s.drainer.isDraining() {
+		logger.Error("serving", "err", err)
+	}
 }
 
 func main() {
@@ -403,17 +1348,57 @@ func main() {
 		log.Fatal(err)
 	}
 	defer logF.Close()
-	log.SetOutput(logF)
+	level, err := logging.ParseLevel(os.Getenv("PFS_LOG_LEVEL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger = logging.New(logF, level).With("shard", os.Args[1])
+	// Packages that still use the log package log through logger too.
+	slog.SetDefault(logger)
+	btrfs.SetLogger(logger)
+	shell.SetLogger(logger)
+	s3utils.SetLogger(logger)
 
+	if err := route.SetPlacement(os.Getenv("PFS_PLACEMENT")); err != nil {
+		log.Fatal(err)
+	}
+	chunkFiles = os.Getenv("PFS_CHUNK_STORE") == "true"
+	pipeline.AllowExec = os.Getenv("PFS_ALLOW_EXEC") == "true"
+	s3Options.Bucket = s3utils.BucketOptionsFromEnv()
+	s3Options.Files = os.Getenv("PFS_S3_FILES") == "true"
+	s3Options.Packs = os.Getenv("PFS_S3_PACKS") == "true"
+	if size := os.Getenv("PFS_S3_PART_SIZE"); size != "" {
+		if s3Options.Upload.PartSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if parallelism := os.Getenv("PFS_S3_PARALLELISM"); parallelism != "" {
+		if s3Options.Upload.Parallelism, err = strconv.Atoi(parallelism); err != nil {
+			log.Fatal(err)
+		}
+	}
 	s, err := ShardFromArgs()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := s.Recover(); err != nil {
+		log.Fatal(err)
+	}
+	if err := s.checkChunkStore(); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Print("Listening on port 80...")
-	log.Printf("dataRepo: %s, compRepo: %s.", s.dataRepo, s.compRepo)
+	logger.Info("listening on port 80")
+	logger.Info("repos", "data", s.dataRepo, "comp", s.compRepo)
 	cancel := make(chan struct{})
 	defer close(cancel)
 	go s.FillRole(cancel)
+	go s.FollowUpstream(cancel)
+	go s.RunPipelines(cancel)
+	go s.RunHoldExpiry(cancel)
+	go s.RunRequestExpiry(cancel)
+	go s.RunScrubs(cancel)
+	go s.RunTiering(cancel)
+	go s.ReloadConfigOnHangup(cancel)
 	s.RunServer()
 }
@@ -1,21 +1,48 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"reflect"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/logging"
+	"github.com/pachyderm/pfs/lib/pipeline"
+	"github.com/pachyderm/pfs/lib/route"
+	"github.com/pachyderm/pfs/lib/stripe"
 	"github.com/pachyderm/pfs/lib/traffic"
 )
 
-func check(err error, t *testing.T) {
+func init() {
+	// The tests' pipelines don't have images, they run on the host.
+	pipeline.AllowExec = true
+}
+
+func check(err error, t testing.TB) {
 	if err != nil {
 		debug.PrintStack()
 		t.Fatal(err)
@@ -56,11 +83,28 @@ func checkNoFile(url, name, commit string, t *testing.T) {
 	}
 }
 
+func deleteFile(url, name, branch string, t *testing.T) {
+	req, err := http.NewRequest("DELETE", url+path.Join("/file", name)+"?branch="+branch, nil)
+	check(err, t)
+	res, err := http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, fmt.Sprintf("Deleted %s.\n", name), t)
+}
+
 func commit(url, commit, branch string, t *testing.T) {
 	_url := fmt.Sprintf("%s/commit?branch=%s&commit=%s", url, branch, commit)
 	res, err := http.Post(_url, "", nil)
 	check(err, t)
-	checkResp(res, fmt.Sprintf("%s\n", commit), t)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		debug.PrintStack()
+		t.Fatalf("Got error status: %s", res.Status)
+	}
+	var msg NewCommitMsg
+	check(json.NewDecoder(res.Body).Decode(&msg), t)
+	if msg.Id != commit || msg.Branch != branch {
+		t.Fatalf("Commit response %+v doesn't match commit: %s, branch: %s.", msg, commit, branch)
+	}
 }
 
 func branch(url, commit, branch string, t *testing.T) {
@@ -103,6 +147,41 @@ func TestPing(t *testing.T) {
 	res.Body.Close()
 }
 
+func TestDelete(t *testing.T) {
+	shard := NewShard("TestDeleteData", "TestDeleteComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	deleteFile(s.URL, "file", "master", t)
+	commit(s.URL, "commit2", "master", t)
+
+	checkFile(s.URL, "file", "commit1", "foo", t)
+	checkNoFile(s.URL, "file", "commit2", t)
+
+	// The deletion shows up in the diff.
+	res, err := http.Get(s.URL + "/diff?from=commit1&to=commit2")
+	check(err, t)
+	var files []string
+	check(json.NewDecoder(res.Body).Decode(&files), t)
+	res.Body.Close()
+	if len(files) != 1 || files[0] != "file" {
+		t.Fatalf("Got diff %v, expected file.", files)
+	}
+
+	// Deleting a file that doesn't exist is a 404
+	req, err := http.NewRequest("DELETE", s.URL+"/file/file?branch=master", nil)
+	check(err, t)
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Deleting a nonexistent file should return 404, got %s.", res.Status)
+	}
+}
+
 func TestBasic(t *testing.T) {
 	c := 0
 	f := func(w traffic.Workload) bool {
@@ -141,7 +220,7 @@ func TestPull(t *testing.T) {
 		// Replicate the data
 		srcReplica := NewShardReplica(src.URL)
 		dstReplica := NewShardReplica(dst.URL)
-		err := srcReplica.Pull("", dstReplica)
+		err := srcReplica.Pull(context.Background(), "", dstReplica)
 		check(err, t)
 		facts := w.Facts()
 		runWorkload(dst.URL, facts, t)
@@ -170,7 +249,7 @@ func TestSyncTo(t *testing.T) {
 			runOp(src.URL, o, t)
 			if o.Object == traffic.Commit {
 				// Replicate the data
-				err := SyncTo(fmt.Sprintf("TestSyncToSrc%d", c), []string{dst.URL})
+				err := SyncTo(context.Background(), fmt.Sprintf("TestSyncToSrc%d", c), []string{dst.URL})
 				check(err, t)
 			}
 		}
@@ -204,7 +283,7 @@ func TestSyncFrom(t *testing.T) {
 			runOp(src.URL, o, t)
 			if o.Object == traffic.Commit {
 				// Replicate the data
-				err := SyncFrom(fmt.Sprintf("TestSyncFromDst%d", c), []string{src.URL})
+				err := SyncFrom(context.Background(), fmt.Sprintf("TestSyncFromDst%d", c), []string{src.URL})
 				check(err, t)
 			}
 		}
@@ -219,3 +298,3131 @@ func TestSyncFrom(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDebugSlow(t *testing.T) {
+	shard := NewShard("TestDebugSlowData", "TestDebugSlowComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	res, err := http.Get(s.URL + "/debug/slow")
+	check(err, t)
+	defer res.Body.Close()
+	var slowest []SlowRequestMsg
+	check(json.NewDecoder(res.Body).Decode(&slowest), t)
+	if len(slowest) != 2 {
+		t.Fatalf("Expected 2 slow requests, got %d.", len(slowest))
+	}
+	for _, req := range slowest {
+		if len(req.Ops) == 0 {
+			t.Fatalf("Request to %s has no timed operations.", req.URL)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	shard := NewShard("TestMetricsData", "TestMetricsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	checkNoFile(s.URL, "nofile", "master", t)
+
+	res, err := http.Get(s.URL + "/metrics")
+	check(err, t)
+	metrics, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	check(err, t)
+	for _, line := range []string{
+		`pfs_requests_total{route="/file/",method="POST",code="200"} 1`,
+		`pfs_requests_total{route="/file/",method="GET",code="404"} 1`,
+		`pfs_request_bytes_total{route="/file/"} 3`,
+		`pfs_request_duration_seconds_count{route="/file/"} 2`,
+	} {
+		if !strings.Contains(string(metrics), line+"\n") {
+			t.Fatalf("Metrics:\n%s\nare missing:\n%s\n", metrics, line)
+		}
+	}
+
+	res, err = http.Get(s.URL + "/debug/pprof/")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("/debug/pprof/ returned %s.", res.Status)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	shard := NewShard("TestDrainData", "TestDrainComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	check(shard.drainer.drain(time.Second), t)
+
+	// Writes are refused once we're draining but reads still work
+	res, err := http.Post(s.URL+"/file/file2?branch=master", "application/text", strings.NewReader("bar"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Write to draining shard should return 503, got %s.", res.Status)
+	}
+	checkFile(s.URL, "file", "master", "foo", t)
+}
+
+func TestIdempotentWrites(t *testing.T) {
+	shard := NewShard("TestIdempotentWritesData", "TestIdempotentWritesComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	// The retry is a no-op, even though its body is different
+	for _, data := range []string{"foo", "foobar"} {
+		res, err := http.Post(s.URL+"/file/file?branch=master&tag=write1", "application/text", strings.NewReader(data))
+		check(err, t)
+		checkResp(res, "Created file, size: 3.\n", t)
+	}
+	checkFile(s.URL, "file", "master", "foo", t)
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", s.URL+"/commit?branch=master", nil)
+		check(err, t)
+		req.Header.Set("X-Request-Id", "commit1")
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		var msg NewCommitMsg
+		check(json.NewDecoder(res.Body).Decode(&msg), t)
+		res.Body.Close()
+		ids = append(ids, msg.Id)
+	}
+	if ids[0] != ids[1] {
+		t.Fatalf("Retried commit created a new commit: %s != %s.", ids[0], ids[1])
+	}
+
+	// Reusing the id for a different write doesn't replay the first write's
+	// response.
+	res, err := http.Post(s.URL+"/file/other?branch=master&tag=write1", "application/text", strings.NewReader("other"))
+	check(err, t)
+	checkResp(res, "Created file, size: 5.\n", t)
+	checkFile(s.URL, "other", "master", "other", t)
+
+	// Once the record expires the write happens again.
+	check(shard.expireRequests(time.Now().Add(requestTTL+time.Minute)), t)
+	res, err = http.Post(s.URL+"/file/file?branch=master&tag=write1", "application/text", strings.NewReader("foobar"))
+	check(err, t)
+	checkResp(res, "Created file, size: 6.\n", t)
+	checkFile(s.URL, "file", "master", "foobar", t)
+}
+
+func TestReplicaAPI(t *testing.T) {
+	_src := NewShard("TestReplicaAPISrc", "TestReplicaAPISrcComp", 0, 1)
+	_dst := NewShard("TestReplicaAPIDst", "TestReplicaAPIDstComp", 0, 1)
+	check(_src.EnsureRepos(), t)
+	check(_dst.EnsureReplicaRepos(), t)
+	src := httptest.NewServer(_src.ShardMux())
+	dst := httptest.NewServer(_dst.ShardMux())
+	defer src.Close()
+	defer dst.Close()
+
+	res, err := http.Post(src.URL+"/replica", "application/json", strings.NewReader(`{"url": "ftp://nope"}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Registering an unsupported url should return 400, got %s.", res.Status)
+	}
+	res, err = http.Post(src.URL+"/replica", "application/json", strings.NewReader(fmt.Sprintf(`{"url": "%s"}`, dst.URL)))
+	check(err, t)
+	var replica ReplicaMsg
+	check(json.NewDecoder(res.Body).Decode(&replica), t)
+	res.Body.Close()
+
+	writeFile(src.URL, "file", "master", "foo", t)
+	commit(src.URL, "commit1", "master", t)
+	res, err = http.Post(src.URL+"/replica/"+replica.Id+"/sync", "", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Sync failed: %s", res.Status)
+	}
+	checkFile(dst.URL, "file", "commit1", "foo", t)
+
+	res, err = http.Get(src.URL + "/replica")
+	check(err, t)
+	var replicas []ReplicaMsg
+	check(json.NewDecoder(res.Body).Decode(&replicas), t)
+	res.Body.Close()
+	if len(replicas) != 1 || replicas[0].Lag != 0 || replicas[0].LastSync != "commit1" {
+		t.Fatalf("Unexpected replicas: %+v", replicas)
+	}
+
+	res, err = http.Post(src.URL+"/replica/nope/sync", "", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Syncing an unknown replica should return 404, got %s.", res.Status)
+	}
+
+	// Only S3 targets can restore single files.
+	for url, status := range map[string]int{
+		"/replica/" + replica.Id + "/file/file?commit=commit1": 400,
+		"/replica/" + replica.Id + "/file/file":                400,
+		"/replica/nope/file/file?commit=commit1":               404,
+	} {
+		res, err = http.Get(src.URL + url)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("GET %s returned %s, expected %d.", url, res.Status, status)
+		}
+	}
+
+	for _, status := range []int{200, 404} {
+		req, err := http.NewRequest("DELETE", src.URL+"/replica/"+replica.Id, nil)
+		check(err, t)
+		res, err = http.DefaultClient.Do(req)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("DELETE returned %s, expected %d.", res.Status, status)
+		}
+	}
+	res, err = http.Get(src.URL + "/replica")
+	check(err, t)
+	replicas = nil
+	check(json.NewDecoder(res.Body).Decode(&replicas), t)
+	res.Body.Close()
+	if len(replicas) != 0 {
+		t.Fatalf("Removed replica is still listed: %+v", replicas)
+	}
+}
+
+func TestSendRecv(t *testing.T) {
+	_src := NewShard("TestSendRecvSrc", "TestSendRecvSrcComp", 0, 1)
+	_dst := NewShard("TestSendRecvDst", "TestSendRecvDstComp", 0, 1)
+	check(_src.EnsureRepos(), t)
+	check(_dst.EnsureReplicaRepos(), t)
+	src := httptest.NewServer(_src.ShardMux())
+	dst := httptest.NewServer(_dst.ShardMux())
+	defer src.Close()
+	defer dst.Close()
+
+	writeFile(src.URL, "file1", "master", "foo", t)
+	commit(src.URL, "commit1", "master", t)
+	writeFile(src.URL, "file2", "master", "bar", t)
+	commit(src.URL, "commit2", "master", t)
+
+	send, err := http.Get(src.URL + "/send")
+	check(err, t)
+	defer send.Body.Close()
+	res, err := http.Post(dst.URL+"/recv", "application/octet-stream", send.Body)
+	check(err, t)
+	checkResp(res, "Received, latest commit: commit2.\n", t)
+	checkFile(dst.URL, "file1", "commit1", "foo", t)
+	checkFile(dst.URL, "file2", "commit2", "bar", t)
+
+	// Incremental sends pick up from `from`
+	writeFile(src.URL, "file3", "master", "buzz", t)
+	commit(src.URL, "commit3", "master", t)
+	send, err = http.Get(src.URL + "/send?from=commit2")
+	check(err, t)
+	defer send.Body.Close()
+	res, err = http.Post(dst.URL+"/recv", "application/octet-stream", send.Body)
+	check(err, t)
+	checkResp(res, "Received, latest commit: commit3.\n", t)
+	checkFile(dst.URL, "file3", "commit3", "buzz", t)
+}
+
+func TestMisrouted(t *testing.T) {
+	shard := NewShard("TestMisroutedData", "TestMisroutedComp", 0, 2)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if route.Owner(path.Join("/file", name), 2) == 0 {
+			writeFile(s.URL, name, "master", "foo", t)
+			continue
+		}
+		res, err := http.Post(s.URL+path.Join("/file", name), "application/text", strings.NewReader("foo"))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 421 {
+			t.Fatalf("Writing %s to the wrong shard should return 421, got %s.", name, res.Status)
+		}
+
+		// Archives are checked file by file too.
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		check(tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Size: 3, Typeflag: tar.TypeReg}), t)
+		_, err = tw.Write([]byte("foo"))
+		check(err, t)
+		check(tw.Close(), t)
+		res, err = http.Post(s.URL+"/archive?branch=master", "application/x-tar", &buf)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 421 {
+			t.Fatalf("Unpacking %s on the wrong shard should return 421, got %s.", name, res.Status)
+		}
+		checkNoFile(s.URL, name, "master", t)
+	}
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	shard := NewShard("TestTwoPhaseCommitData", "TestTwoPhaseCommitComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	phase := func(phase, commit string) *http.Response {
+		res, err := http.Post(fmt.Sprintf("%s/commit?phase=%s&commit=%s&branch=master", s.URL, phase, commit), "", nil)
+		check(err, t)
+		return res
+	}
+
+	writeFile(s.URL, "file1", "master", "foo", t)
+	checkResp(phase("prepare", "commit1"), "Prepared commit1.\n", t)
+	// Writes after prepare aren't in the commit
+	writeFile(s.URL, "file2", "master", "bar", t)
+	res := phase("finalize", "commit1")
+	var msg NewCommitMsg
+	check(json.NewDecoder(res.Body).Decode(&msg), t)
+	res.Body.Close()
+	if msg.Id != "commit1" || msg.Branch != "master" {
+		t.Fatalf("Bad finalize response: %+v", msg)
+	}
+	checkFile(s.URL, "file1", "commit1", "foo", t)
+	checkNoFile(s.URL, "file2", "commit1", t)
+
+	checkResp(phase("prepare", "commit2"), "Prepared commit2.\n", t)
+	checkResp(phase("abort", "commit2"), "Aborted commit2.\n", t)
+	res = phase("finalize", "commit2")
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Finalizing an aborted commit should return 404, got %s.", res.Status)
+	}
+	checkNoFile(s.URL, "file1", "commit2", t)
+
+	// Commits made between prepare and finalize aren't orphaned.
+	checkResp(phase("prepare", "commit3"), "Prepared commit3.\n", t)
+	commit(s.URL, "commit4", "master", t)
+	res = phase("finalize", "commit3")
+	res.Body.Close()
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Finalizing after the head moved should return 412, got %s.", res.Status)
+	}
+	checkResp(phase("abort", "commit3"), "Aborted commit3.\n", t)
+	checkFile(s.URL, "file2", "commit4", "bar", t)
+}
+
+func TestReshardPlan(t *testing.T) {
+	shard := NewShard("TestReshardPlanData", "TestReshardPlanComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	moving := 0
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d", i)
+		writeFile(s.URL, name, "master", "foo", t)
+		if route.Owner(path.Join("/file", name), 4) != 0 {
+			moving++
+		}
+	}
+	res, err := http.Get(s.URL + "/reshard?modulos=4")
+	check(err, t)
+	defer res.Body.Close()
+	var plan ReshardPlanMsg
+	check(json.NewDecoder(res.Body).Decode(&plan), t)
+	if plan.Files != 10 || plan.Moving != moving {
+		t.Fatalf("Expected 10 files with %d moving, got %+v.", moving, plan)
+	}
+}
+
+func TestReshardTake(t *testing.T) {
+	check(route.SetPlacement("consistent"), t)
+	defer route.SetPlacement("")
+	_src := NewShard("TestReshardTakeSrc", "TestReshardTakeSrcComp", 0, 1)
+	_dst := NewShard("TestReshardTakeDst", "TestReshardTakeDstComp", 1, 2)
+	check(_src.EnsureRepos(), t)
+	check(_dst.EnsureRepos(), t)
+	src := httptest.NewServer(_src.ShardMux())
+	dst := httptest.NewServer(_dst.ShardMux())
+	defer src.Close()
+	defer dst.Close()
+
+	branch(src.URL, "t0", "other", t)
+	var files []string
+	for i := 0; i < 20; i++ {
+		files = append(files, fmt.Sprintf("dir/file%d", i))
+		writeFile(src.URL, files[i], "master", "foo", t)
+	}
+	writeFile(src.URL, "file", "other", "bar", t)
+	// Whatever the new shard had before is replaced.
+	writeFile(dst.URL, "stale", "master", "stale", t)
+
+	res, err := http.Post(dst.URL+"/reshard?take="+url.QueryEscape(src.URL), "", nil)
+	check(err, t)
+	var msg ReshardMsg
+	check(json.NewDecoder(res.Body).Decode(&msg), t)
+	res.Body.Close()
+	taken := 0
+	for _, name := range files {
+		if owns(name, 1, 2) {
+			taken++
+			checkFile(dst.URL, name, "master", "foo", t)
+		} else {
+			checkNoFile(dst.URL, name, "master", t)
+		}
+	}
+	if owns("file", 1, 2) {
+		taken++
+		checkFile(dst.URL, "file", "other", "bar", t)
+	}
+	if taken == 0 || msg.Taken != taken {
+		t.Fatalf("Expected to take %d files, got %+v.", taken, msg)
+	}
+	checkNoFile(dst.URL, "stale", "master", t)
+}
+
+func TestFencing(t *testing.T) {
+	shard := NewShard("TestFencingData", "TestFencingComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	shard.role.becomePrimary(2)
+	writeFile(s.URL, "file1", "master", "foo", t)
+
+	// Epoch 3 starts somewhere else, we're no longer primary.
+	res, err := http.Post(s.URL+"/admin/fence?epoch=3", "", nil)
+	check(err, t)
+	var role RoleMsg
+	check(json.NewDecoder(res.Body).Decode(&role), t)
+	res.Body.Close()
+	if role.Role != "replica" || role.Epoch != 3 {
+		t.Fatalf("Expected to be a replica at epoch 3, got %+v.", role)
+	}
+	res, err = http.Post(s.URL+"/file/file2", "application/text", strings.NewReader("bar"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Writes to a fenced primary should return 503, got %s.", res.Status)
+	}
+
+	// Pushes from the old epoch are refused.
+	req, err := http.NewRequest("POST", s.URL+"/commit", strings.NewReader("not a real diff"))
+	check(err, t)
+	req.Header.Set(epochHeader, "2")
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Pushes from an old epoch should return 409, got %s.", res.Status)
+	}
+	req, err = http.NewRequest("POST", s.URL+"/recv", strings.NewReader("not a real diff"))
+	check(err, t)
+	req.Header.Set(epochHeader, "2")
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Receives from an old epoch should return 409, got %s.", res.Status)
+	}
+
+	// So are pushes without an epoch, now that we're clustered.
+	for _, url := range []string{"/commit", "/recv"} {
+		res, err = http.Post(s.URL+url, "application/octet-stream", strings.NewReader("not a real diff"))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Fatalf("Pushes to %s without an epoch should return 400, got %s.", url, res.Status)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	shard := NewShard("TestPipelineData", "TestPipelineComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go shard.RunPipelines(cancel)
+
+	res, err := http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(`{"name": "bad/name", "command": ["true"]}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Registering an invalid pipeline should return 400, got %s.", res.Status)
+	}
+	spec := `{"name": "upper", "input": "in", "command": ["sh", "-c", "tr a-z A-Z < $PFS_INPUT/file > $PFS_OUTPUT/file"]}`
+	res, err = http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(spec))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Registering a pipeline failed: %s", res.Status)
+	}
+	res, err = http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(spec))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Fatalf("Registering a pipeline twice should return 409, got %s.", res.Status)
+	}
+
+	res, err = http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(`{"name": "changed", "command": ["sh", "-c", "cd $PFS_DIFF && find . -type f | sort > $PFS_OUTPUT/changed"]}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Registering a pipeline failed: %s", res.Status)
+	}
+	output := func(name, file, commit string) *http.Response {
+		for i := 0; ; i++ {
+			res, err := http.Get(s.URL + path.Join("/pipeline", name, "file", file) + "?commit=" + commit)
+			check(err, t)
+			if res.StatusCode == 200 || i == 50 {
+				return res
+			}
+			res.Body.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	writeFile(s.URL, "in/file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	checkResp(output("upper", "file", "commit1"), "FOO", t)
+	if provenance := btrfs.GetMeta(path.Join(shard.compRepo, pipeline.OutputCommit("upper", "commit1")), "provenance"); provenance != "TestPipelineData/commit1" {
+		t.Fatalf("Unexpected provenance %q.", provenance)
+	}
+
+	// The second run only sees the file that changed.
+	writeFile(s.URL, "in/other", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+	checkResp(output("changed", "changed", "commit1"), "./in/file\n", t)
+	checkResp(output("changed", "changed", "commit2"), "./in/other\n", t)
+	if from := btrfs.GetMeta(path.Join(shard.compRepo, pipeline.OutputCommit("changed", "commit2")), "delta-from"); from != "commit1" {
+		t.Fatalf("Unexpected delta-from %q.", from)
+	}
+	res, err = http.Get(s.URL + "/pipeline/upper/file/file?commit=" + url.QueryEscape("../../TestPipelineData/master"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Reading pipeline output at an invalid commit should return 400, got %s.", res.Status)
+	}
+	req, err := http.NewRequest("DELETE", s.URL+"/pipeline/upper", nil)
+	check(err, t)
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "Deleted pipeline upper.\n", t)
+}
+
+func TestPipelineJobs(t *testing.T) {
+	shard := NewShard("TestPipelineJobsData", "TestPipelineJobsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go shard.RunPipelines(cancel)
+
+	for _, spec := range []string{
+		`{"name": "ok", "command": ["sh", "-c", "echo fine"]}`,
+		`{"name": "fail", "command": ["sh", "-c", "echo oops; exit 3"]}`,
+	} {
+		res, err := http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(spec))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Registering a pipeline failed: %s", res.Status)
+		}
+	}
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	// Jobs are queued once the commit's event is published.
+	for i := 0; ; i++ {
+		res, err := http.Get(s.URL + "/job/pipeline-fail-commit1")
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Job wasn't queued: %s", res.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Streaming the logs waits for the job to finish.
+	res, err := http.Get(s.URL + "/job/pipeline-fail-commit1/logs")
+	check(err, t)
+	checkResp(res, "oops\n", t)
+	res, err = http.Get(s.URL + "/job/pipeline-ok-commit1/logs")
+	check(err, t)
+	checkResp(res, "fine\n", t)
+
+	res, err = http.Get(s.URL + "/job")
+	check(err, t)
+	var jobs []JobMsg
+	check(json.NewDecoder(res.Body).Decode(&jobs), t)
+	res.Body.Close()
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got: %+v", jobs)
+	}
+	for _, job := range jobs {
+		switch job.Pipeline {
+		case "ok":
+			if job.State != "succeeded" || job.Output != "pipeline-ok-commit1" || job.Started == "" || job.Finished == "" {
+				t.Fatalf("Unexpected job: %+v", job)
+			}
+		case "fail":
+			if job.State != "failed" || job.ExitCode != 3 || job.Output != "" {
+				t.Fatalf("Unexpected job: %+v", job)
+			}
+		default:
+			t.Fatalf("Unexpected job: %+v", job)
+		}
+	}
+
+	res, err = http.Get(s.URL + "/job/nope")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Getting an unknown job should return 404, got %s.", res.Status)
+	}
+}
+
+func TestPipelineRetry(t *testing.T) {
+	shard := NewShard("TestPipelineRetryData", "TestPipelineRetryComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go shard.RunPipelines(cancel)
+
+	// flaky fails the first time it runs, leaving junk in its outputs.
+	marker, err := ioutil.TempDir("", "pfs-retry")
+	check(err, t)
+	defer os.RemoveAll(marker)
+	for _, spec := range []string{
+		fmt.Sprintf(`{"name": "flaky", "command": ["sh", "-c", "if [ -e %s/tried ]; then cp $PFS_INPUT/file $PFS_OUTPUT/file; else touch %s/tried $PFS_OUTPUT/junk; exit 1; fi"], "retry": {"attempts": 3, "backoff": "10ms"}}`, marker, marker),
+		`{"name": "broken", "command": ["sh", "-c", "exit 2"], "retry": {"attempts": 2}}`,
+	} {
+		res, err := http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(spec))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Registering a pipeline failed: %s", res.Status)
+		}
+	}
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	for i := 0; ; i++ {
+		res, err := http.Get(s.URL + "/job/pipeline-broken-commit1")
+		check(err, t)
+		var job JobMsg
+		if res.StatusCode == 200 {
+			check(json.NewDecoder(res.Body).Decode(&job), t)
+		}
+		res.Body.Close()
+		if job.State == "failed" {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("broken never finished: %+v", job)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	res, err := http.Get(s.URL + "/job/pipeline-flaky-commit1")
+	check(err, t)
+	var job JobMsg
+	check(json.NewDecoder(res.Body).Decode(&job), t)
+	res.Body.Close()
+	if job.State != "succeeded" || job.Attempts != 2 {
+		t.Fatalf("flaky should have succeeded on its second attempt: %+v", job)
+	}
+	checkFile(s.URL+"/pipeline/flaky", "file", "commit1", "foo", t)
+	// Outputs of failed attempts are thrown away.
+	checkNoFile(s.URL+"/pipeline/flaky", "junk", "commit1", t)
+
+	res, err = http.Get(s.URL + "/job?state=failed")
+	check(err, t)
+	var jobs []JobMsg
+	check(json.NewDecoder(res.Body).Decode(&jobs), t)
+	res.Body.Close()
+	if len(jobs) != 1 || jobs[0].Pipeline != "broken" || jobs[0].Commit != "commit1" || jobs[0].Attempts != 2 || jobs[0].ExitCode != 2 {
+		t.Fatalf("Expected broken's job over commit1 to be the only failure, got: %+v", jobs)
+	}
+}
+
+func TestPipelineSchedule(t *testing.T) {
+	shard := NewShard("TestPipelineScheduleData", "TestPipelineScheduleComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go shard.RunPipelines(cancel)
+
+	// The file isn't committed, the scheduler commits it.
+	writeFile(s.URL, "file", "master", "foo", t)
+	res, err := http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(
+		`{"name": "hourly", "command": ["sh", "-c", "cp $PFS_INPUT/file $PFS_OUTPUT/file"], "schedule": {"every": "1h"}}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Registering a pipeline failed: %s", res.Status)
+	}
+
+	var jobs []JobMsg
+	for i := 0; ; i++ {
+		res, err := http.Get(s.URL + "/job?pipeline=hourly&state=succeeded")
+		check(err, t)
+		check(json.NewDecoder(res.Body).Decode(&jobs), t)
+		res.Body.Close()
+		if len(jobs) != 0 {
+			break
+		}
+		if i == 50 {
+			t.Fatal("hourly never ran.")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	trigger := jobs[0].Commit
+	if !strings.HasPrefix(trigger, "trigger-hourly-") {
+		t.Fatalf("Unexpected trigger commit %s.", trigger)
+	}
+	checkFile(s.URL, "file", trigger, "foo", t)
+	checkFile(s.URL+"/pipeline/hourly", "file", trigger, "foo", t)
+
+	// Commits don't set off scheduled pipelines and it isn't due again for
+	// an hour.
+	commit(s.URL, "commit1", "master", t)
+	time.Sleep(2 * scheduleInterval)
+	res, err = http.Get(s.URL + "/job?pipeline=hourly")
+	check(err, t)
+	check(json.NewDecoder(res.Body).Decode(&jobs), t)
+	res.Body.Close()
+	if len(jobs) != 1 {
+		t.Fatalf("hourly should only have run once, got: %+v", jobs)
+	}
+}
+
+func TestPipelineDAG(t *testing.T) {
+	shard := NewShard("TestPipelineDAGData", "TestPipelineDAGComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go shard.RunPipelines(cancel)
+
+	register := func(spec string, status int) {
+		res, err := http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(spec))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Registering %s returned %s, expected %d.", spec, res.Status, status)
+		}
+	}
+	register(`{"name": "count", "from": "upper", "command": ["sh", "-c", "wc -c < $PFS_INPUT/file > $PFS_OUTPUT/count"]}`, 400)
+	register(`{"name": "upper", "command": ["sh", "-c", "tr a-z A-Z < $PFS_INPUT/file > $PFS_OUTPUT/file"]}`, 200)
+	register(`{"name": "count", "from": "upper", "command": ["sh", "-c", "wc -c < $PFS_INPUT/file > $PFS_OUTPUT/count"]}`, 200)
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	for i := 0; ; i++ {
+		res, err := http.Get(s.URL + "/pipeline/count/file/count?commit=commit1")
+		check(err, t)
+		if res.StatusCode == 200 {
+			checkResp(res, "3\n", t)
+			break
+		}
+		res.Body.Close()
+		if i == 50 {
+			t.Fatalf("count never ran: %s", res.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	res, err := http.Get(s.URL + "/job/pipeline-count-commit1")
+	check(err, t)
+	var job JobMsg
+	check(json.NewDecoder(res.Body).Decode(&job), t)
+	res.Body.Close()
+	if job.Commit != "commit1" || job.Input != "pipeline-upper-commit1" || job.State != "succeeded" {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+	if provenance := btrfs.GetMeta(path.Join(shard.compRepo, job.Output), "provenance"); provenance != "TestPipelineDAGComp/pipeline-upper-commit1" {
+		t.Fatalf("Unexpected provenance %q.", provenance)
+	}
+	res, err = http.Get(s.URL + "/provenance?commit=pipeline-count-commit1")
+	check(err, t)
+	var lineage []ProvenanceMsg
+	check(json.NewDecoder(res.Body).Decode(&lineage), t)
+	res.Body.Close()
+	if len(lineage) != 3 ||
+		lineage[0].Commit != "pipeline-count-commit1" || lineage[0].Pipeline != "count" || lineage[0].SpecHash == "" ||
+		lineage[1].Commit != "pipeline-upper-commit1" || lineage[1].Pipeline != "upper" || lineage[1].SpecHash == lineage[0].SpecHash ||
+		lineage[2].Repo != "TestPipelineDAGData" || lineage[2].Commit != "commit1" {
+		t.Fatalf("Unexpected lineage: %+v", lineage)
+	}
+	res, err = http.Get(s.URL + "/provenance?commit=nope")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("The provenance of an unknown commit should return 404, got %s.", res.Status)
+	}
+
+	req, err := http.NewRequest("DELETE", s.URL+"/pipeline/upper", nil)
+	check(err, t)
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 409 {
+		t.Fatalf("Deleting a pipeline that's read from should return 409, got %s.", res.Status)
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	// A single shard shuffles to itself.
+	shard := NewShard("TestShuffleData", "TestShuffleComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	cancel := make(chan struct{})
+	defer close(cancel)
+	go shard.RunPipelines(cancel)
+
+	for _, spec := range []string{
+		`{"name": "spread", "shuffle": true, "command": ["sh", "-c", "cp $PFS_INPUT/file $PFS_SPOOL/0/key"]}`,
+		`{"name": "gather", "from": "spread", "command": ["sh", "-c", "cp $PFS_INPUT/key $PFS_OUTPUT/key"]}`,
+	} {
+		res, err := http.Post(s.URL+"/pipeline", "application/json", strings.NewReader(spec))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Registering a pipeline failed: %s", res.Status)
+		}
+	}
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	for i := 0; ; i++ {
+		res, err := http.Get(s.URL + "/pipeline/gather/file/key?commit=commit1")
+		check(err, t)
+		if res.StatusCode == 200 {
+			checkResp(res, "foo", t)
+			break
+		}
+		res.Body.Close()
+		if i == 50 {
+			t.Fatalf("gather never ran: %s", res.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Shard 0 of 2 merges what both shards send it, in shard order.
+	_shard := NewShard("TestShuffleData2", "TestShuffleComp2", 0, 2)
+	check(_shard.EnsureRepos(), t)
+	s2 := httptest.NewServer(_shard.ShardMux())
+	defer s2.Close()
+	for _, from := range []string{"1", "0"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		data := "from" + from + "\n"
+		check(tw.WriteHeader(&tar.Header{Name: "key", Mode: 0666, Size: int64(len(data)), Typeflag: tar.TypeReg}), t)
+		_, err := tw.Write([]byte(data))
+		check(err, t)
+		check(tw.Close(), t)
+		res, err := http.Post(s2.URL+"/shuffle?pipeline=spread&commit=commit1&from="+from, "application/x-tar", &buf)
+		check(err, t)
+		checkResp(res, fmt.Sprintf("Received shuffle of spread from shard %s.\n", from), t)
+	}
+	data, err := btrfs.ReadFile(path.Join(_shard.compRepo, pipeline.ShuffleCommit("spread", "commit1"), "key"))
+	check(err, t)
+	if string(data) != "from0\nfrom1\n" {
+		t.Fatalf("Unexpected merged file %q.", data)
+	}
+}
+
+func TestDav(t *testing.T) {
+	shard := NewShard("TestDavData", "TestDavComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	dav := func(method, url, body string, header map[string]string, status int) *http.Response {
+		req, err := http.NewRequest(method, s.URL+url, strings.NewReader(body))
+		check(err, t)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		if res.StatusCode != status {
+			t.Fatalf("%s %s returned %s, expected %d.", method, url, res.Status, status)
+		}
+		return res
+	}
+	dav("PUT", "/dav/master/file", "foo", nil, 201).Body.Close()
+	dav("PUT", "/dav/master/file", "bar", nil, 204).Body.Close()
+	dav("MKCOL", "/dav/master/dir", "", nil, 201).Body.Close()
+	dav("MOVE", "/dav/master/file", "", map[string]string{"Destination": s.URL + "/dav/master/dir/moved"}, 201).Body.Close()
+	checkFile(s.URL, "dir/moved", "master", "bar", t)
+	checkResp(dav("GET", "/dav/master/dir/moved", "", nil, 200), "bar", t)
+	commit(s.URL, "commit1", "master", t)
+
+	res := dav("PROPFIND", "/dav/master/dir", "", map[string]string{"Depth": "1"}, 207)
+	var ms struct {
+		Responses []struct {
+			Href       string    `xml:"href"`
+			Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+			Length     string    `xml:"propstat>prop>getcontentlength"`
+		} `xml:"response"`
+	}
+	check(xml.NewDecoder(res.Body).Decode(&ms), t)
+	res.Body.Close()
+	if len(ms.Responses) != 2 || ms.Responses[0].Href != "/dav/master/dir/" || ms.Responses[0].Collection == nil ||
+		ms.Responses[1].Href != "/dav/master/dir/moved" || ms.Responses[1].Length != "3" {
+		t.Fatalf("Unexpected PROPFIND response: %+v", ms)
+	}
+	res = dav("PROPFIND", "/dav/", "", map[string]string{"Depth": "1"}, 207)
+	data, err := ioutil.ReadAll(res.Body)
+	check(err, t)
+	res.Body.Close()
+	if !strings.Contains(string(data), "<D:href>/dav/commit1/</D:href>") {
+		t.Fatalf("Refs should be listed, got: %s", data)
+	}
+
+	// Commits are read-only.
+	dav("PUT", "/dav/commit1/file", "foo", nil, 403).Body.Close()
+	checkResp(dav("GET", "/dav/commit1/dir/moved", "", nil, 200), "bar", t)
+	dav("DELETE", "/dav/master/dir/moved", "", nil, 204).Body.Close()
+	checkNoFile(s.URL, "dir/moved", "master", t)
+	res = dav("LOCK", "/dav/master/dir/new", "", nil, 200)
+	res.Body.Close()
+	if !strings.HasPrefix(res.Header.Get("Lock-Token"), "<opaquelocktoken:") {
+		t.Fatalf("Unexpected lock token %q.", res.Header.Get("Lock-Token"))
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	events := make(chan WebhookEventMsg, 16)
+	failures := 1
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		check(err, t)
+		if r.Header.Get("X-Pfs-Signature") != signature("secret", body) {
+			t.Errorf("Bad signature %q.", r.Header.Get("X-Pfs-Signature"))
+		}
+		// Fail the first delivery to make sure it's retried.
+		if failures > 0 {
+			failures--
+			http.Error(w, "Try again.", 500)
+			return
+		}
+		var e WebhookEventMsg
+		check(json.Unmarshal(body, &e), t)
+		events <- e
+	}))
+	defer hook.Close()
+
+	shard := NewShard("TestWebhookData", "TestWebhookComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	for _, webhook := range []string{
+		fmt.Sprintf(`{"name": "all", "url": "%s", "secret": "secret"}`, hook.URL),
+		fmt.Sprintf(`{"name": "other", "url": "%s", "secret": "secret", "branch": "other"}`, hook.URL),
+	} {
+		res, err := http.Post(s.URL+"/webhook", "application/json", strings.NewReader(webhook))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("Registering webhook returned %s.", res.Status)
+		}
+	}
+	writeFile(s.URL, "file1", "master", "foo", t)
+	writeFile(s.URL, "file2", "master", "bar", t)
+	commit(s.URL, "commit1", "master", t)
+
+	select {
+	case e := <-events:
+		if e.Repo != "TestWebhookData" || e.Branch != "master" || e.Commit != "commit1" || e.Files != 2 {
+			t.Fatalf("Unexpected event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook.")
+	}
+	// Only the webhook without a branch should have been told.
+	select {
+	case e := <-events:
+		t.Fatalf("Unexpected event: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	res, err := http.Get(s.URL + "/webhook")
+	check(err, t)
+	var webhooks []WebhookMsg
+	check(json.NewDecoder(res.Body).Decode(&webhooks), t)
+	res.Body.Close()
+	if len(webhooks) != 2 || webhooks[0].Secret != "" || webhooks[0].LastError != "" {
+		t.Fatalf("Unexpected webhooks: %+v", webhooks)
+	}
+
+	req, err := http.NewRequest("DELETE", s.URL+"/webhook/all", nil)
+	check(err, t)
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "Deleted webhook all.\n", t)
+}
+
+func TestChunkStore(t *testing.T) {
+	chunkFiles = true
+	defer func() { chunkFiles = false }()
+	shard := NewShard("TestChunkStoreData", "TestChunkStoreComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	// Big enough to be chunked.
+	data := strings.Repeat("pachyderm ", 500000)
+	countChunks := func() int {
+		n := 0
+		filepath.Walk(btrfs.FilePath("blocks"), func(_ string, fi os.FileInfo, _ error) error {
+			if fi != nil && !fi.IsDir() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	writeFile(s.URL, "file1", "master", data, t)
+	checkFile(s.URL, "file1", "master", data, t)
+	commit(s.URL, "commit1", "master", t)
+	branch(s.URL, "commit1", "branch1", t)
+	stored := countChunks()
+	// The same data in another file and branch is only stored once.
+	writeFile(s.URL, "file2", "branch1", data, t)
+	if countChunks() != stored {
+		t.Fatalf("Identical data was stored twice, %d chunks became %d.", stored, countChunks())
+	}
+	checkFile(s.URL, "file2", "branch1", data, t)
+	checkFile(s.URL, "file1", "commit1", data, t)
+
+	req, err := http.NewRequest("GET", s.URL+"/file/file1?commit=commit1", nil)
+	check(err, t)
+	req.Header.Set("Range", "bytes=10-19")
+	res, err := http.DefaultClient.Do(req)
+	check(err, t)
+	body, err := ioutil.ReadAll(res.Body)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 206 || string(body) != "pachyderm " {
+		t.Fatalf("Range request returned %s: %q", res.Status, body)
+	}
+
+	// Small files are stored whole.
+	writeFile(s.URL, "small", "master", "foo", t)
+	data2, err := btrfs.ReadFile(path.Join("TestChunkStoreData", "master", "small"))
+	check(err, t)
+	if string(data2) != "foo" {
+		t.Fatalf("Small file was chunked: %q", data2)
+	}
+
+	// Archives get the content of chunked files, not their manifests.
+	for _, format := range []string{"tar", "zip"} {
+		res, err := http.Get(s.URL + "/archive?commit=commit1&format=" + format)
+		check(err, t)
+		archive, err := ioutil.ReadAll(res.Body)
+		check(err, t)
+		res.Body.Close()
+		var content []byte
+		if format == "tar" {
+			tr := tar.NewReader(bytes.NewReader(archive))
+			hdr, err := tr.Next()
+			check(err, t)
+			if hdr.Name != "file1" || hdr.Size != int64(len(data)) {
+				t.Fatalf("Got tar header %s of %d bytes, expected file1 of %d.", hdr.Name, hdr.Size, len(data))
+			}
+			content, err = ioutil.ReadAll(tr)
+			check(err, t)
+		} else {
+			zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+			check(err, t)
+			f, err := zr.File[0].Open()
+			check(err, t)
+			content, err = ioutil.ReadAll(f)
+			check(err, t)
+			f.Close()
+		}
+		if string(content) != data {
+			t.Fatalf("The %s archive has %d bytes of file1, expected its %d.", format, len(content), len(data))
+		}
+	}
+
+	// Replicas and pipelines would see manifests.
+	for url, body := range map[string]string{"/replica": `{"url":"http://replica"}`, "/pipeline": `{"name":"wc","cmd":["wc"]}`} {
+		res, err := http.Post(s.URL+url, "application/json", strings.NewReader(body))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 409 {
+			t.Fatalf("Adding to %s with the chunk store enabled returned %s, expected 409.", url, res.Status)
+		}
+	}
+	check(shard.checkChunkStore(), t)
+}
+
+func TestRepoCompression(t *testing.T) {
+	shard := NewShard("TestRepoCompressionData", "TestRepoCompressionComp", 0, 1)
+	shard.compression = "zlib"
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	checkRepos := func(expected []RepoMsg) {
+		res, err := http.Get(s.URL + "/repo")
+		check(err, t)
+		var repos []RepoMsg
+		check(json.NewDecoder(res.Body).Decode(&repos), t)
+		res.Body.Close()
+		if !reflect.DeepEqual(repos, expected) {
+			t.Fatalf("Got repos %+v, expected %+v.", repos, expected)
+		}
+	}
+	checkRepos([]RepoMsg{{Name: "TestRepoCompressionData", Compression: "zlib"}, {Name: "TestRepoCompressionComp", Compression: "zlib"}})
+
+	res, err := http.Post(s.URL+"/repo/data", "application/json", strings.NewReader(`{"compression": "zstd"}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Setting compression returned %s.", res.Status)
+	}
+	checkRepos([]RepoMsg{{Name: "TestRepoCompressionData", Compression: "zstd"}, {Name: "TestRepoCompressionComp", Compression: "zlib"}})
+	writeFile(s.URL, "file", "master", strings.Repeat("foo", 10000), t)
+	checkFile(s.URL, "file", "master", strings.Repeat("foo", 10000), t)
+
+	res, err = http.Post(s.URL+"/repo/data", "application/json", strings.NewReader(`{"compression": "gzip"}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Setting an unsupported compression returned %s.", res.Status)
+	}
+}
+
+func TestRepoQuota(t *testing.T) {
+	shard := NewShard("TestRepoQuotaData", "TestRepoQuotaComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	res, err := http.Post(s.URL+"/repo/data", "application/json", strings.NewReader(`{"quota": 1048576}`))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Setting quota returned %s.", res.Status)
+	}
+	writeFile(s.URL, "small", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	// Writes that go over the quota fail.
+	res, err = http.Post(s.URL+"/file/big?branch=master", "application/text", strings.NewReader(strings.Repeat("x", 4<<20)))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 507 {
+		t.Fatalf("Writing over the quota returned %s.", res.Status)
+	}
+
+	res, err = http.Post(s.URL+"/branch?commit=commit1&branch=limited&quota=65536", "", nil)
+	check(err, t)
+	checkResp(res, "Created branch. (commit1) -> limited.\n", t)
+	res, err = http.Post(s.URL+"/file/big?branch=limited", "application/text", strings.NewReader(strings.Repeat("x", 256<<10)))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 507 {
+		t.Fatalf("Writing over the branch quota returned %s.", res.Status)
+	}
+
+	res, err = http.Get(s.URL + "/repo/data/usage")
+	check(err, t)
+	var usage RepoUsageMsg
+	check(json.NewDecoder(res.Body).Decode(&usage), t)
+	res.Body.Close()
+	if usage.Total == nil || usage.Total.Quota != 1048576 || usage.Total.Used > 1048576 {
+		t.Fatalf("Unexpected repo usage: %+v", usage.Total)
+	}
+	found := false
+	for _, branch := range usage.Branches {
+		if branch.Name == "limited" {
+			found = true
+			if branch.Quota != 65536 {
+				t.Fatalf("Unexpected branch usage: %+v", branch)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Branch limited missing from usage: %+v", usage.Branches)
+	}
+}
+
+func TestDu(t *testing.T) {
+	shard := NewShard("TestDuData", "TestDuComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", strings.Repeat("x", 100000), t)
+	commit(s.URL, "commit1", "master", t)
+	res, err := http.Get(s.URL + "/du?commit=commit1")
+	check(err, t)
+	var du DuMsg
+	check(json.NewDecoder(res.Body).Decode(&du), t)
+	res.Body.Close()
+	if du.Name != "commit1" || !du.Commit || du.Logical < 100000 {
+		t.Fatalf("Unexpected usage: %+v", du)
+	}
+
+	res, err = http.Get(s.URL + "/du")
+	check(err, t)
+	decoder := json.NewDecoder(res.Body)
+	names := make(map[string]bool)
+	for {
+		var du DuMsg
+		if err := decoder.Decode(&du); err == io.EOF {
+			break
+		} else {
+			check(err, t)
+		}
+		names[du.Name] = du.Commit
+	}
+	res.Body.Close()
+	if isCommit, ok := names["master"]; !ok || isCommit || !names["commit1"] || !names["t0"] {
+		t.Fatalf("Unexpected commits and branches: %v", names)
+	}
+
+	res, err = http.Get(s.URL + "/du?commit=nope")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Du of a missing commit returned %s.", res.Status)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	shard := NewShard("TestScrubData", "TestScrubComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	res, err := http.Post(s.URL+"/scrub", "", nil)
+	check(err, t)
+	var scrub ScrubMsg
+	check(json.NewDecoder(res.Body).Decode(&scrub), t)
+	res.Body.Close()
+	if res.StatusCode != 200 || scrub.BytesScrubbed == 0 || scrub.UncorrectableErrors != 0 {
+		t.Fatalf("Scrub returned %s: %+v", res.Status, scrub)
+	}
+
+	res, err = http.Get(s.URL + "/health")
+	check(err, t)
+	var health HealthMsg
+	check(json.NewDecoder(res.Body).Decode(&health), t)
+	res.Body.Close()
+	if res.StatusCode != 200 || health.Status != "ok" || health.LastScrub == nil || *health.LastScrub != scrub {
+		t.Fatalf("Health returned %s: %+v", res.Status, health)
+	}
+
+	res, err = http.Get(s.URL + "/metrics")
+	check(err, t)
+	metrics, err := ioutil.ReadAll(res.Body)
+	check(err, t)
+	res.Body.Close()
+	if !strings.Contains(string(metrics), "pfs_scrub_uncorrectable_errors 0\n") {
+		t.Fatalf("Scrub metrics missing:\n%s", metrics)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	shard := NewShard("TestFsckData", "TestFsckComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	check(btrfs.UnsetReadOnly(path.Join("TestFsckData", "commit1")), t)
+	check(shard.saveReplicas([]ReplicaMsg{{Id: "replica1", Url: "s3://bucket/path", LastSync: "missing"}}), t)
+
+	fsck := func(method string) []FsckMsg {
+		req, err := http.NewRequest(method, s.URL+"/fsck", nil)
+		check(err, t)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		defer res.Body.Close()
+		var msgs []FsckMsg
+		check(json.NewDecoder(res.Body).Decode(&msgs), t)
+		return msgs
+	}
+	expected := []FsckMsg{
+		{Repo: "TestFsckData", Problems: []FsckProblemMsg{
+			{Name: "commit1", Problem: "Commit isn't read only."},
+			{Name: "replica replica1", Problem: "Last synced commit missing doesn't exist."},
+		}},
+		{Repo: "TestFsckComp", Problems: []FsckProblemMsg{}},
+	}
+	if msgs := fsck("GET"); !reflect.DeepEqual(msgs, expected) {
+		t.Fatalf("Got %+v, expected %+v.", msgs, expected)
+	}
+	for i := range expected[0].Problems {
+		expected[0].Problems[i].Repaired = true
+	}
+	if msgs := fsck("POST"); !reflect.DeepEqual(msgs, expected) {
+		t.Fatalf("Got %+v, expected %+v.", msgs, expected)
+	}
+	expected[0].Problems = []FsckProblemMsg{}
+	if msgs := fsck("GET"); !reflect.DeepEqual(msgs, expected) {
+		t.Fatalf("Got %+v after repairing, expected %+v.", msgs, expected)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	shard := NewShard("TestIfMatchData", "TestIfMatchComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	post := func(uri, ifMatch string, body string) int {
+		req, err := http.NewRequest("POST", s.URL+uri, strings.NewReader(body))
+		check(err, t)
+		req.Header.Set("If-Match", ifMatch)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := post("/file/file?branch=master", "t0", "foo"); status != 200 {
+		t.Fatalf("Writing with the right head returned %d.", status)
+	}
+	if status := post("/commit?branch=master&commit=commit1", `"t0"`, ""); status != 200 {
+		t.Fatalf("Committing with the right head returned %d.", status)
+	}
+	// The head is now commit1.
+	if status := post("/file/file?branch=master", "t0", "bar"); status != http.StatusPreconditionFailed {
+		t.Fatalf("Writing with a stale head returned %d.", status)
+	}
+	if status := post("/commit?branch=master&commit=commit2", "t0", ""); status != http.StatusPreconditionFailed {
+		t.Fatalf("Committing with a stale head returned %d.", status)
+	}
+	if status := post("/commit?phase=prepare&branch=master&commit=commit2", "t0", ""); status != http.StatusPreconditionFailed {
+		t.Fatalf("Preparing with a stale head returned %d.", status)
+	}
+	checkFile(s.URL, "file", "commit1", "foo", t)
+	if status := post("/commit?branch=master&commit=commit2", "commit1", ""); status != 200 {
+		t.Fatalf("Committing with the right head returned %d.", status)
+	}
+}
+
+func TestNameValidation(t *testing.T) {
+	shard := NewShard("TestNameValidationData", "TestNameValidationComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	for _, uri := range []string{
+		"/commit?branch=master&commit=t0",
+		"/commit?branch=master&commit=.meta",
+		"/commit?phase=prepare&branch=master&commit=pipeline-x",
+		"/branch?commit=t0&branch=pipeline-x",
+		"/branch?commit=..&branch=feature",
+	} {
+		res, err := http.Post(s.URL+uri, "application/text", nil)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Fatalf("POST %s returned %d.", uri, res.StatusCode)
+		}
+	}
+
+	shard.allowReserved = true
+	s2 := httptest.NewServer(shard.ShardMux())
+	defer s2.Close()
+	res, err := http.Post(s2.URL+"/branch?commit=t0&branch=pipeline-x", "application/text", nil)
+	check(err, t)
+	checkResp(res, "Created branch. (t0) -> pipeline-x.\n", t)
+}
+
+func TestErrorStatus(t *testing.T) {
+	shard := NewShard("TestErrorStatusData", "TestErrorStatusComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	for uri, status := range map[string]int{
+		"/commit?branch=nobranch&commit=commit2":               404,
+		"/commit?branch=master&commit=commit1":                 http.StatusConflict,
+		"/branch?commit=nocommit&branch=branch1":               404,
+		"/branch?commit=commit1&branch=master":                 http.StatusConflict,
+		"/commit?phase=finalize&commit=unprepared":             404,
+		"/file/file?branch=commit1":                            http.StatusForbidden,
+		"/file/file?branch=nobranch":                           404,
+		"/commit?phase=prepare&branch=nobranch&commit=commit2": 404,
+	} {
+		var body io.Reader
+		if strings.HasPrefix(uri, "/file") {
+			body = strings.NewReader("bar")
+		}
+		res, err := http.Post(s.URL+uri, "application/text", body)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("POST %s returned %d, expected %d.", uri, res.StatusCode, status)
+		}
+	}
+}
+
+// TestPullCancel checks that cancelling a pull from a shard that's stopped
+// responding doesn't leave it hanging.
+func TestPullCancel(t *testing.T) {
+	hung := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer s.Close()
+	defer close(hung)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := NewShardReplica(s.URL).Pull(ctx, "", NewWriterPusher(ioutil.Discard))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+// TestRequestId checks that request ids are passed on to the shards we
+// replicate to.
+func TestRequestId(t *testing.T) {
+	var pushed string
+	replica := httptest.NewServer(withRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed = logging.Id(r.Context())
+	})))
+	defer replica.Close()
+	s := httptest.NewServer(withRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		check(NewShardReplica(replica.URL).Push(r.Context(), strings.NewReader("diff")), t)
+	})))
+	defer s.Close()
+
+	req, err := http.NewRequest("POST", s.URL, nil)
+	check(err, t)
+	req.Header.Set(logging.IdHeader, "abc")
+	res, err := http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if pushed != "abc" || res.Header.Get(logging.IdHeader) != "abc" {
+		t.Fatalf("Expected the id abc to be passed on, the replica got %q and the response had %q.", pushed, res.Header.Get(logging.IdHeader))
+	}
+
+	res, err = http.Post(s.URL, "application/text", nil)
+	check(err, t)
+	res.Body.Close()
+	if id := res.Header.Get(logging.IdHeader); id == "" || id != pushed {
+		t.Fatalf("Expected a new id to be passed on, the replica got %q and the response had %q.", pushed, id)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	shard := NewShard("TestBatchData", "TestBatchComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, data := range map[string]string{"file1": "foo", "dir/file2": "bar"} {
+		fw, err := mw.CreateFormFile("file", name)
+		check(err, t)
+		_, err = fw.Write([]byte(data))
+		check(err, t)
+	}
+	check(mw.Close(), t)
+	res, err := http.Post(s.URL+"/batch?branch=master", mw.FormDataContentType(), &buf)
+	check(err, t)
+	checkResp(res, "{\"files\":2,\"bytes\":6}\n", t)
+
+	buf.Reset()
+	encoder := json.NewEncoder(&buf)
+	check(encoder.Encode(BatchFile{Path: "file3", Data: []byte("baz")}), t)
+	check(encoder.Encode(BatchFile{Path: "dir/file4", Data: []byte("quux")}), t)
+	res, err = http.Post(s.URL+"/batch?branch=master", "application/x-ndjson", &buf)
+	check(err, t)
+	checkResp(res, "{\"files\":2,\"bytes\":7}\n", t)
+
+	commit(s.URL, "commit1", "master", t)
+	checkFile(s.URL, "file1", "commit1", "foo", t)
+	checkFile(s.URL, "dir/file2", "commit1", "bar", t)
+	checkFile(s.URL, "file3", "commit1", "baz", t)
+	checkFile(s.URL, "dir/file4", "commit1", "quux", t)
+
+	for body, status := range map[string]int{
+		`{"path": "../file", "data": "Zm9v"}`:     400,
+		`{"path": ".meta/file", "data": "Zm9v"}`:  400,
+		`{"path": "file5", "data": "not base64"}`: 400,
+	} {
+		res, err := http.Post(s.URL+"/batch?branch=master", "application/x-ndjson", strings.NewReader(body))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Batch %s returned %d, expected %d.", body, res.StatusCode, status)
+		}
+	}
+	res, err = http.Post(s.URL+"/batch?branch=master", "application/text", strings.NewReader("foo"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("Expected 415, got %d.", res.StatusCode)
+	}
+}
+
+func TestStripes(t *testing.T) {
+	shard := NewShard("TestStripesData", "TestStripesComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	res, err := http.Post(s.URL+"/file/big?stripe=1", "application/text", strings.NewReader("bar"))
+	check(err, t)
+	checkResp(res, "Created .meta/stripes/big/1, size: 3.\n", t)
+	res, err = http.Get(s.URL + "/file/big?stripe=1&commit=master")
+	check(err, t)
+	checkResp(res, "bar", t)
+
+	var manifest bytes.Buffer
+	check(stripe.WriteManifest(&manifest, stripe.Manifest{Size: 6, StripeSize: 3}), t)
+	req, err := http.NewRequest("POST", s.URL+"/file/big", &manifest)
+	check(err, t)
+	req.Header.Set(stripe.Header, "2")
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "Created big, size: 6.\n", t)
+	res, err = http.Get(s.URL + "/file/big")
+	check(err, t)
+	res.Body.Close()
+	if res.Header.Get(stripe.Header) != "2" {
+		t.Fatalf("Manifest read without %s.", stripe.Header)
+	}
+
+	// Overwriting the manifest with a whole file unmarks it.
+	writeFile(s.URL, "big", "master", "foobar", t)
+	res, err = http.Get(s.URL + "/file/big")
+	check(err, t)
+	res.Body.Close()
+	if res.Header.Get(stripe.Header) != "" {
+		t.Fatal("Whole file read as a manifest.")
+	}
+
+	res, err = http.Post(s.URL+"/file/big?stripe=x", "application/text", strings.NewReader("bar"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Expected 400 for a bad stripe, got %d.", res.StatusCode)
+	}
+}
+
+// readFromRecorder is a ResponseRecorder that can copy like net/http's
+// ResponseWriter, it records whether it was asked to.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+func TestServeContentReadFrom(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestServeContentReadFrom")
+	check(err, t)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := strings.Repeat("foo", 100000)
+	_, err = io.WriteString(f, data)
+	check(err, t)
+
+	for _, readFrom := range []bool{true, false} {
+		_, err = f.Seek(0, os.SEEK_SET)
+		check(err, t)
+		rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		tw := &tracedWriter{ResponseWriter: rec}
+		if !readFrom {
+			tw.ResponseWriter = rec.ResponseRecorder
+		}
+		r, err := http.NewRequest("GET", "/file/foo", nil)
+		check(err, t)
+		http.ServeContent(tw, r, "foo", time.Time{}, f)
+		if rec.Body.String() != data {
+			t.Fatalf("Served %d bytes, expected %d.", rec.Body.Len(), len(data))
+		}
+		if rec.readFrom != readFrom {
+			t.Fatalf("ReadFrom used: %t, expected %t.", rec.readFrom, readFrom)
+		}
+		if tw.written != int64(len(data)) || tw.status != 200 {
+			t.Fatalf("Traced %d bytes with status %d.", tw.written, tw.status)
+		}
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	fetches := make(map[string]int)
+	var lock sync.Mutex
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		fetches[r.URL.Path]++
+		lock.Unlock()
+		if r.URL.Query().Get("commit") != "remote" {
+			http.Error(w, "404 page not found", 404)
+			return
+		}
+		w.Header().Set("ETag", `"remote"`)
+		w.Write([]byte(strings.Repeat("x", len(path.Base(r.URL.Path)))))
+	}))
+	defer peer.Close()
+	shard := NewShard("TestReadCacheData", "TestReadCacheComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	cache, err := newReadCache(t.TempDir(), 10)
+	check(err, t)
+	shard.readCache = cache
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	res, err := http.Post(s.URL+"/replica", "application/json", strings.NewReader(fmt.Sprintf(`{"url": %q}`, peer.URL)))
+	check(err, t)
+	res.Body.Close()
+
+	fetched := func(name string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return fetches["/file/"+name]
+	}
+	checkFile(s.URL, "abcd", "remote", "xxxx", t)
+	checkFile(s.URL, "abcd", "remote", "xxxx", t)
+	if fetched("abcd") != 1 {
+		t.Fatalf("abcd was fetched %d times, expected once.", fetched("abcd"))
+	}
+	// Caching a second file evicts the first.
+	checkFile(s.URL, "abcdefgh", "remote", "xxxxxxxx", t)
+	checkFile(s.URL, "abcd", "remote", "xxxx", t)
+	if fetched("abcd") != 2 {
+		t.Fatalf("abcd was fetched %d times, expected it to be evicted.", fetched("abcd"))
+	}
+	// Files too big for the cache are passed through.
+	checkFile(s.URL, "abcdefghijkl", "remote", "xxxxxxxxxxxx", t)
+	checkFile(s.URL, "abcdefghijkl", "remote", "xxxxxxxxxxxx", t)
+	if fetched("abcdefghijkl") != 2 {
+		t.Fatalf("abcdefghijkl was fetched %d times, expected twice.", fetched("abcdefghijkl"))
+	}
+	checkNoFile(s.URL, "abcd", "missing", t)
+
+	// The cache survives a restart.
+	restarted, err := newReadCache(cache.dir, 10)
+	check(err, t)
+	if _, ok := restarted.get("remote/abcd"); !ok {
+		t.Fatal("Cached file was lost on restart.")
+	}
+}
+
+func TestTier(t *testing.T) {
+	shard := NewShard("TestTierData", "TestTierComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "file", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+	for url, status := range map[string]int{
+		"/tier":                400,
+		"/tier?commit=master":  409,
+		"/tier?commit=commit2": 409,
+		// There's no S3 target to tier it to.
+		"/tier?commit=commit1": 409,
+		"/tier?commit=nope":    404,
+	} {
+		res, err := http.Post(s.URL+url, "", nil)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("POST %s returned %s, expected %d.", url, res.Status, status)
+		}
+	}
+	checkFile(s.URL, "file", "commit1", "foo", t)
+	res, err := http.Get(s.URL + "/tier")
+	check(err, t)
+	checkResp(res, "[]\n", t)
+}
+
+func TestBackup(t *testing.T) {
+	_src := NewShard("TestBackupSrc", "TestBackupSrcComp", 0, 1)
+	_backup := NewShard("TestBackupReplica", "TestBackupReplicaComp", 0, 1)
+	check(_src.EnsureRepos(), t)
+	check(_backup.EnsureReplicaRepos(), t)
+	src := httptest.NewServer(_src.ShardMux())
+	backup := httptest.NewServer(_backup.ShardMux())
+	defer src.Close()
+	defer backup.Close()
+
+	writeFile(src.URL, "file1", "master", "foo", t)
+	commit(src.URL, "commit1", "master", t)
+	writeFile(src.URL, "file2", "master", "bar", t)
+	res, err := http.Post(src.URL+"/backup?url="+backup.URL, "", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Backup failed: %s", res.Status)
+	}
+
+	_dst := NewShard("TestBackupDst", "TestBackupDstComp", 0, 1)
+	_dst.restoreFrom = backup.URL
+	check(_dst.EnsureRepos(), t)
+	dst := httptest.NewServer(_dst.ShardMux())
+	defer dst.Close()
+	checkFile(dst.URL, "file1", "commit1", "foo", t)
+	checkFile(dst.URL, "file2", "master", "bar", t)
+	checkNoFile(dst.URL, "file2", "commit1", t)
+}
+
+func TestReplicaUrls(t *testing.T) {
+	for url, expected := range map[string]string{
+		"pfs://shard:80":    "http://shard:80",
+		"https://shard:443": "https://shard:443",
+	} {
+		r, err := newReplica(url)
+		check(err, t)
+		if sr, ok := r.(ShardReplica); !ok || sr.url != expected {
+			t.Fatalf("%s made %#v, expected a ShardReplica for %s.", url, r, expected)
+		}
+	}
+	r, err := newReplica("s3://bucket/path")
+	check(err, t)
+	if _, ok := r.(*btrfs.S3Replica); !ok {
+		t.Fatalf("Expected an S3Replica, got %T.", r)
+	}
+	if _, err := newReplica("ftp://host/path"); err == nil {
+		t.Fatal("ftp urls should be rejected.")
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	_src := NewShard("TestCatchUpSrc", "TestCatchUpSrcComp", 0, 1)
+	check(_src.EnsureRepos(), t)
+	src := httptest.NewServer(_src.ShardMux())
+	defer src.Close()
+	writeFile(src.URL, "file1", "master", "foo", t)
+	commit(src.URL, "commit1", "master", t)
+
+	// Upstreams that can't be reached are skipped.
+	_dst := NewShard("TestCatchUpDst", "TestCatchUpDstComp", 0, 1)
+	_dst.catchUpFrom = []string{"http://127.0.0.1:1", src.URL}
+	check(_dst.CatchUp(), t)
+	dst := httptest.NewServer(_dst.ShardMux())
+	defer dst.Close()
+	checkFile(dst.URL, "file1", "commit1", "foo", t)
+
+	// Stale repos pick up where they left off.
+	writeFile(src.URL, "file2", "master", "bar", t)
+	commit(src.URL, "commit2", "master", t)
+	check(_dst.CatchUp(), t)
+	checkFile(dst.URL, "file2", "commit2", "bar", t)
+
+	res, err := http.Get(dst.URL + "/health")
+	check(err, t)
+	var health HealthMsg
+	check(json.NewDecoder(res.Body).Decode(&health), t)
+	res.Body.Close()
+	if health.Status != "ok" {
+		t.Fatalf("Expected ok once caught up, got %s.", health.Status)
+	}
+
+	_lost := NewShard("TestCatchUpLost", "TestCatchUpLostComp", 0, 1)
+	_lost.catchUpFrom = []string{"http://127.0.0.1:1"}
+	if err := _lost.CatchUp(); err == nil {
+		t.Fatal("Catching up without any reachable upstreams should fail.")
+	}
+}
+
+func TestTags(t *testing.T) {
+	shard := NewShard("TestTagsData", "TestTagsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "file", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+
+	res, err := http.Post(s.URL+"/tag?commit=commit1&tag=v1.0", "", nil)
+	check(err, t)
+	checkResp(res, "Tagged commit1 as v1.0.\n", t)
+	res, err = http.Post(s.URL+"/tag?commit=commit2&tag=v1.0", "", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Reusing a tag should return 409, got %s.", res.Status)
+	}
+
+	checkFile(s.URL, "file", "v1.0", "foo", t)
+	res, err = http.Get(s.URL + "/diff?from=v1.0&to=commit2")
+	check(err, t)
+	checkResp(res, "[\"file\"]\n", t)
+
+	res, err = http.Get(s.URL + "/tag")
+	check(err, t)
+	checkResp(res, "{\"name\":\"v1.0\",\"commit\":\"commit1\"}\n", t)
+
+	req, err := http.NewRequest("DELETE", s.URL+"/tag/v1.0", nil)
+	check(err, t)
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "Deleted tag v1.0.\n", t)
+	checkNoFile(s.URL, "file", "v1.0", t)
+}
+
+func TestAsOf(t *testing.T) {
+	shard := NewShard("TestAsOfData", "TestAsOfComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	between := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+	writeFile(s.URL, "file", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+
+	checkFile(s.URL, "file", "master&asof="+between, "foo", t)
+	checkFile(s.URL, "file", "master@{"+between+"}", "foo", t)
+	checkFile(s.URL, "file", "commit2&asof="+time.Now().UTC().Format(time.RFC3339Nano), "bar", t)
+	checkNoFile(s.URL, "file", "master&asof=2000-01-01", t)
+}
+
+func TestHistory(t *testing.T) {
+	shard := NewShard("TestHistoryData", "TestHistoryComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "dir/file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "dir/file", "master", "foobar", t)
+	commit(s.URL, "commit2", "master", t)
+
+	res, err := http.Get(s.URL + "/file/dir/file/history")
+	check(err, t)
+	var changes []FileChangeMsg
+	check(json.NewDecoder(res.Body).Decode(&changes), t)
+	res.Body.Close()
+	if len(changes) != 2 || changes[0].Commit != "commit2" || changes[0].Size != 6 ||
+		changes[1].Commit != "commit1" || changes[1].Size != 3 {
+		t.Fatalf("Got history %v.", changes)
+	}
+
+	res, err = http.Get(s.URL + "/file/dir/file/history?commit=commit1&limit=1")
+	check(err, t)
+	changes = nil
+	check(json.NewDecoder(res.Body).Decode(&changes), t)
+	res.Body.Close()
+	if len(changes) != 1 || changes[0].Commit != "commit1" {
+		t.Fatalf("Got history %v.", changes)
+	}
+
+	res, err = http.Get(s.URL + "/file/dir/file/history?commit=missing")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Got %s for a missing commit.", res.Status)
+	}
+}
+
+func TestFileDiff(t *testing.T) {
+	shard := NewShard("TestFileDiffData", "TestFileDiffComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo\nbar\n", t)
+	writeFile(s.URL, "bin", "master", "\x00\x01", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "file", "master", "foo\nbaz\n", t)
+	writeFile(s.URL, "bin", "master", "\x00\x02", t)
+	commit(s.URL, "commit2", "master", t)
+
+	res, err := http.Get(s.URL + "/filediff?from=commit1&to=commit2&path=file")
+	check(err, t)
+	checkResp(res, "--- commit1/file\n+++ commit2/file\n@@ -1,2 +1,2 @@\n foo\n-bar\n+baz\n", t)
+	res, err = http.Get(s.URL + "/filediff?from=t0&to=commit1&path=file")
+	check(err, t)
+	checkResp(res, "--- /dev/null\n+++ commit1/file\n@@ -0,0 +1,2 @@\n+foo\n+bar\n", t)
+	res, err = http.Get(s.URL + "/filediff?from=commit2&to=master&path=file")
+	check(err, t)
+	checkResp(res, "", t)
+	res, err = http.Get(s.URL + "/filediff?from=commit1&to=commit2&path=bin")
+	check(err, t)
+	checkResp(res, fmt.Sprintf("Binary files commit1/bin and commit2/bin differ\n- size: 2, sha256: %x\n+ size: 2, sha256: %x\n",
+		sha256.Sum256([]byte("\x00\x01")), sha256.Sum256([]byte("\x00\x02"))), t)
+
+	for _, query := range []string{"from=commit1&to=commit2&path=missing", "from=missing&path=file"} {
+		res, err = http.Get(s.URL + "/filediff?" + query)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 404 {
+			t.Fatalf("Got %s for %s.", res.Status, query)
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	shard := NewShard("TestLinksData", "TestLinksComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	res, err := http.Post(s.URL+"/file/dir/symlink?branch=master&symlink=../file", "application/text", nil)
+	check(err, t)
+	checkResp(res, "Created dir/symlink -> ../file.\n", t)
+	res, err = http.Post(s.URL+"/file/link?branch=master&link=file", "application/text", nil)
+	check(err, t)
+	checkResp(res, "Linked link to file.\n", t)
+	res, err = http.Post(s.URL+"/file/escape?branch=master&symlink=../file", "application/text", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s for a symlink out of the commit.", res.Status)
+	}
+	commit(s.URL, "commit1", "master", t)
+
+	checkFile(s.URL, "dir/symlink", "commit1", "foo", t)
+	checkFile(s.URL, "link", "commit1", "foo", t)
+	res, err = http.Get(s.URL + "/file/dir/symlink?commit=commit1&stat=true")
+	check(err, t)
+	var info FileInfoMsg
+	check(json.NewDecoder(res.Body).Decode(&info), t)
+	res.Body.Close()
+	if info.Type != "symlink" || info.Target != "../file" {
+		t.Fatalf("Got %+v for the symlink.", info)
+	}
+
+	// Links survive a trip through an archive.
+	res, err = http.Get(s.URL + "/archive?commit=commit1&format=tar")
+	check(err, t)
+	data, err := ioutil.ReadAll(res.Body)
+	check(err, t)
+	res.Body.Close()
+	res, err = http.Post(s.URL+"/archive?branch=master&commit=commit2", "application/x-tar", bytes.NewReader(data))
+	check(err, t)
+	res.Body.Close()
+	res, err = http.Get(s.URL + "/file/link?commit=commit2&stat=true")
+	check(err, t)
+	check(json.NewDecoder(res.Body).Decode(&info), t)
+	res.Body.Close()
+	if info.Type != "file" || info.Links != 2 {
+		t.Fatalf("Got %+v for the hard link.", info)
+	}
+
+	req, err := http.NewRequest("DELETE", s.URL+"/file/dir/symlink?branch=master", nil)
+	check(err, t)
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "Deleted dir/symlink.\n", t)
+}
+
+func TestFileMeta(t *testing.T) {
+	shard := NewShard("TestFileMetaData", "TestFileMetaComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	post := func(header http.Header) {
+		req, err := http.NewRequest("POST", s.URL+"/file/file?branch=master", strings.NewReader("foo"))
+		check(err, t)
+		req.Header = header
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		checkResp(res, "Created file, size: 3.\n", t)
+	}
+	post(http.Header{"Content-Type": {"text/csv"}, "X-Pfs-Meta-Schema": {"v1"}, "X-Pfs-Meta-Source": {"sensor-1"}})
+	commit(s.URL, "commit1", "master", t)
+	post(http.Header{"X-Pfs-Meta-Schema": {"v2"}})
+
+	res, err := http.Get(s.URL + "/file/file?commit=commit1")
+	check(err, t)
+	res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/csv" || res.Header.Get("X-Pfs-Meta-Schema") != "v1" ||
+		res.Header.Get("X-Pfs-Meta-Source") != "sensor-1" {
+		t.Fatalf("Got headers %v.", res.Header)
+	}
+	res, err = http.Get(s.URL + "/file/file?commit=master")
+	check(err, t)
+	res.Body.Close()
+	if res.Header.Get("X-Pfs-Meta-Schema") != "v2" || res.Header.Get("X-Pfs-Meta-Source") != "" {
+		t.Fatalf("Got headers %v, writing should replace the metadata.", res.Header)
+	}
+
+	res, err = http.Get(s.URL + "/file/file?commit=commit1&stat=true")
+	check(err, t)
+	var info FileInfoMsg
+	check(json.NewDecoder(res.Body).Decode(&info), t)
+	res.Body.Close()
+	expected := map[string]string{"schema": "v1", "source": "sensor-1"}
+	if info.ContentType != "text/csv" || !reflect.DeepEqual(info.Meta, expected) || info.Sha256 != "" {
+		t.Fatalf("Got %+v.", info)
+	}
+	res, err = http.Get(s.URL + "/file/file?commit=commit1&stat=true&checksum=true")
+	check(err, t)
+	check(json.NewDecoder(res.Body).Decode(&info), t)
+	res.Body.Close()
+	if info.Sha256 != fmt.Sprintf("%x", sha256.Sum256([]byte("foo"))) {
+		t.Fatalf("Got checksum %s.", info.Sha256)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	shard := NewShard("TestPermissionsData", "TestPermissionsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	post := func(header http.Header) *http.Response {
+		req, err := http.NewRequest("POST", s.URL+"/file/file?branch=master", strings.NewReader("foo"))
+		check(err, t)
+		req.Header = header
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		return res
+	}
+	perms := http.Header{"X-Pfs-Mode": {"0750"}, "X-Pfs-Uid": {"1000"}, "X-Pfs-Gid": {"1000"}}
+	res := post(perms)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s setting permissions in a repo that doesn't keep them.", res.Status)
+	}
+
+	res, err := http.Post(s.URL+"/repo/data", "application/json", strings.NewReader(`{"permissions": true}`))
+	check(err, t)
+	var repo RepoMsg
+	check(json.NewDecoder(res.Body).Decode(&repo), t)
+	res.Body.Close()
+	if !repo.Permissions {
+		t.Fatal("The data repo should keep permissions.")
+	}
+	checkResp(post(perms), "Created file, size: 3.\n", t)
+	res = post(http.Header{"X-Pfs-Mode": {"rwx"}})
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s for an invalid mode.", res.Status)
+	}
+	commit(s.URL, "commit1", "master", t)
+
+	res, err = http.Get(s.URL + "/file/file?commit=commit1")
+	check(err, t)
+	res.Body.Close()
+	if res.Header.Get("X-Pfs-Mode") != "0750" || res.Header.Get("X-Pfs-Uid") != "1000" || res.Header.Get("X-Pfs-Gid") != "1000" {
+		t.Fatalf("Got headers %v.", res.Header)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	shard := NewShard("TestPatchData", "TestPatchComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	patch := func(query, data string) *http.Response {
+		req, err := http.NewRequest("PATCH", s.URL+"/file/log?branch=master&"+query, strings.NewReader(data))
+		check(err, t)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		return res
+	}
+	checkResp(patch("append=true", "foo\n"), "Wrote 4 bytes to log at offset 0.\n", t)
+	checkResp(patch("append=true", "bar\n"), "Wrote 4 bytes to log at offset 4.\n", t)
+	commit(s.URL, "commit1", "master", t)
+	checkResp(patch("offset=4", "baz\n"), "Wrote 4 bytes to log at offset 4.\n", t)
+	commit(s.URL, "commit2", "master", t)
+	checkFile(s.URL, "log", "commit1", "foo\nbar\n", t)
+	checkFile(s.URL, "log", "commit2", "foo\nbaz\n", t)
+
+	for query, status := range map[string]int{
+		"offset=100":           http.StatusRequestedRangeNotSatisfiable,
+		"offset=-1":            400,
+		"":                     400,
+		"offset=0&append=true": 400,
+	} {
+		res := patch(query, "qux\n")
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Got %s for %q, expected %d.", res.Status, query, status)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	shard := NewShard("TestGlobData", "TestGlobComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "images/a.png", "master", "foo", t)
+	writeFile(s.URL, "images/2015/b.png", "master", "bar", t)
+	writeFile(s.URL, "text/c.txt", "master", "baz", t)
+	commit(s.URL, "commit1", "master", t)
+
+	list := func(url string) []string {
+		res, err := http.Get(s.URL + url)
+		check(err, t)
+		defer res.Body.Close()
+		var files []string
+		check(json.NewDecoder(res.Body).Decode(&files), t)
+		return files
+	}
+	for url, expected := range map[string][]string{
+		"/list?commit=commit1":                       {"images/2015/b.png", "images/a.png", "text/c.txt"},
+		"/list?commit=commit1&glob=images/**/*.png":  {"images/2015/b.png", "images/a.png"},
+		"/list?commit=commit1&prefix=text/":          {"text/c.txt"},
+		"/diff?from=t0&to=commit1&glob=images/*.png": {"images/a.png"},
+		"/list?commit=commit1&glob=*.csv":            {},
+	} {
+		if files := list(url); !reflect.DeepEqual(files, expected) {
+			t.Fatalf("%s listed %v, expected %v.", url, files, expected)
+		}
+	}
+
+	res, err := http.Get(s.URL + "/archive?commit=commit1&format=tar&glob=images/**")
+	check(err, t)
+	defer res.Body.Close()
+	var names []string
+	tr := tar.NewReader(res.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err, t)
+		names = append(names, hdr.Name)
+	}
+	if expected := []string{"images/2015/b.png", "images/a.png"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Archive contained %v, expected %v.", names, expected)
+	}
+
+	res, err = http.Get(s.URL + "/list?glob=a/[")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s for an invalid pattern.", res.Status)
+	}
+}
+
+func TestHead(t *testing.T) {
+	shard := NewShard("TestHeadData", "TestHeadComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	head := func(branch string) *http.Response {
+		res, err := http.Get(s.URL + "/head?branch=" + branch)
+		check(err, t)
+		return res
+	}
+	res := head("master")
+	var msg HeadMsg
+	check(json.NewDecoder(res.Body).Decode(&msg), t)
+	res.Body.Close()
+	if msg.Branch != "master" || msg.Commit != "commit1" {
+		t.Fatalf("Got head %+v, expected commit1.", msg)
+	}
+
+	// Reads pinned to the head don't see the branch move.
+	writeFile(s.URL, "file", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+	checkFile(s.URL, "file", msg.Commit, "foo", t)
+	checkFile(s.URL, "file", "master", "bar", t)
+
+	for branch, status := range map[string]int{"missing": 404, "commit1": 400, "..": 400} {
+		res := head(branch)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Got %s for the head of %s, expected %d.", res.Status, branch, status)
+		}
+	}
+}
+
+func TestHold(t *testing.T) {
+	shard := NewShard("TestHoldData", "TestHoldComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "a", "master", "foo", t)
+	writeFile(s.URL, "b", "master", "bar", t)
+	commit(s.URL, "commit1", "master", t)
+	do := func(method, url string) *http.Response {
+		req, err := http.NewRequest(method, s.URL+url, nil)
+		check(err, t)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		return res
+	}
+	res := do("POST", "/hold?commit=commit1&id=hold1")
+	var msg HoldMsg
+	check(json.NewDecoder(res.Body).Decode(&msg), t)
+	res.Body.Close()
+	if msg.Id != "hold1" || msg.Commit != "commit1" {
+		t.Fatalf("Got hold %+v, expected hold1 of commit1.", msg)
+	}
+	// Retries get the same hold.
+	res = do("POST", "/hold?commit=commit1&id=hold1")
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Retrying the hold returned %s.", res.Status)
+	}
+
+	// Reads from the hold see commit1 even once it's gone.
+	check(btrfs.SubvolumeDelete(path.Join("TestHoldData", "commit1")), t)
+	for name, data := range map[string]string{"a": "foo", "b": "bar"} {
+		res := do("GET", "/file/"+name+"?hold=hold1")
+		checkResp(res, data, t)
+	}
+	res = do("GET", "/list?hold=hold1")
+	var files []string
+	check(json.NewDecoder(res.Body).Decode(&files), t)
+	res.Body.Close()
+	if strings.Join(files, ",") != "a,b" {
+		t.Fatalf("Listed %v, expected a and b.", files)
+	}
+
+	res = do("DELETE", "/hold/hold1")
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Releasing the hold returned %s.", res.Status)
+	}
+	res = do("GET", "/file/a?hold=hold1")
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Reading a released hold returned %s, expected 404.", res.Status)
+	}
+
+	// Holds expire.
+	writeFile(s.URL, "a", "master", "baz", t)
+	commit(s.URL, "commit2", "master", t)
+	res = do("POST", "/hold?commit=commit2&id=hold2&ttl=1ms")
+	res.Body.Close()
+	time.Sleep(10 * time.Millisecond)
+	res = do("GET", "/file/a?hold=hold2")
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Reading an expired hold returned %s, expected 404.", res.Status)
+	}
+	check(shard.expireHolds(time.Now()), t)
+	if exists, err := btrfs.FileExists(shard.holdPath("hold2")); err != nil || exists {
+		t.Fatalf("The expired hold's snapshot wasn't released, %v.", err)
+	}
+}
+
+func TestInvalidRefs(t *testing.T) {
+	shard := NewShard("TestInvalidRefsData", "TestInvalidRefsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	for _, url := range []string{
+		"POST /file/x?branch=..",
+		"POST /file/x?branch=.",
+		"DELETE /file/x?branch=..",
+		"POST /file/x?branch=../TestInvalidRefsComp/master",
+		"GET /file/x?commit=..",
+		"GET /file/x?commit=..@{2015-03-01}",
+		"GET /list?commit=..",
+		"POST /batch?branch=..",
+	} {
+		method, url := strings.Split(url, " ")[0], strings.Split(url, " ")[1]
+		req, err := http.NewRequest(method, s.URL+url, strings.NewReader("foo"))
+		check(err, t)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != 400 {
+			t.Fatalf("%s %s returned %s, expected 400.", method, url, res.Status)
+		}
+	}
+	if exists, err := btrfs.FileExists("x"); err != nil || exists {
+		t.Fatalf("A write escaped the repo, %v.", err)
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	shard := NewShard("TestListPaginationData", "TestListPaginationComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "a/x", "master", "foo", t)
+	writeFile(s.URL, "a/y", "master", "foo", t)
+	writeFile(s.URL, "a.b", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "b", "master", "foo", t)
+	commit(s.URL, "commit2", "master", t)
+
+	var pages [][]string
+	after := ""
+	for {
+		res, err := http.Get(s.URL + "/list?commit=commit2&limit=2&after=" + url.QueryEscape(after))
+		check(err, t)
+		var page []string
+		check(json.NewDecoder(res.Body).Decode(&page), t)
+		res.Body.Close()
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		after = page[len(page)-1]
+	}
+	if expected := [][]string{{"a/x", "a/y"}, {"a.b", "b"}}; !reflect.DeepEqual(pages, expected) {
+		t.Fatalf("Got pages %v, expected %v.", pages, expected)
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/list?commit=commit2&after=a/y", nil)
+	check(err, t)
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "\"a.b\"\n\"b\"\n", t)
+
+	res, err = http.Get(s.URL + "/list?commit=commit2&limit=-1")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s for an invalid limit.", res.Status)
+	}
+
+	res, err = http.Get(s.URL + "/commit?after=commit2&limit=1")
+	check(err, t)
+	var commits []CommitMsg
+	decoder := json.NewDecoder(res.Body)
+	for decoder.More() {
+		var c CommitMsg
+		check(decoder.Decode(&c), t)
+		commits = append(commits, c)
+	}
+	res.Body.Close()
+	if len(commits) != 1 || commits[0].Name != "commit1" {
+		t.Fatalf("Got commits %v, expected commit1.", commits)
+	}
+	if commits[0].Transid == 0 {
+		t.Fatalf("commit1 should have its transid, got %+v.", commits[0])
+	}
+	// Oldest first.
+	for query, expected := range map[string]string{"order=asc&limit=1": "t0", "order=asc&after=commit1": "commit2"} {
+		res, err = http.Get(s.URL + "/commit?" + query)
+		check(err, t)
+		var c CommitMsg
+		check(json.NewDecoder(res.Body).Decode(&c), t)
+		res.Body.Close()
+		if c.Name != expected {
+			t.Fatalf("Got %s for %s, expected %s.", c.Name, query, expected)
+		}
+	}
+	res, err = http.Get(s.URL + "/commit?order=sideways")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s for an invalid order.", res.Status)
+	}
+	res, err = http.Get(s.URL + "/commit?after=missing")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Got %s paging after a missing commit.", res.Status)
+	}
+}
+
+func TestGC(t *testing.T) {
+	chunkFiles = true
+	defer func() { chunkFiles = false }()
+	shard := NewShard("TestGCData", "TestGCComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	kept := strings.Repeat("kept ", 500000)
+	writeFile(s.URL, "file1", "master", kept, t)
+	commit(s.URL, "commit1", "master", t)
+	// file2's chunks aren't in any commit, deleting it leaves them behind.
+	writeFile(s.URL, "file2", "master", strings.Repeat("garbage ", 500000), t)
+	deleteFile(s.URL, "file2", "master", t)
+
+	gc := func(method string) GCMsg {
+		req, err := http.NewRequest(method, s.URL+"/admin/gc?grace=0s", nil)
+		check(err, t)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		defer res.Body.Close()
+		var msg GCMsg
+		check(json.NewDecoder(res.Body).Decode(&msg), t)
+		return msg
+	}
+	dryRun := gc("GET")
+	if !dryRun.DryRun || dryRun.Removed == 0 {
+		t.Fatalf("Dry run found nothing to remove: %+v", dryRun)
+	}
+	if msg := gc("POST"); msg.Removed != dryRun.Removed || msg.Bytes != dryRun.Bytes {
+		t.Fatalf("Removed %+v, the dry run said %+v.", msg, dryRun)
+	}
+	if msg := gc("GET"); msg.Removed != 0 {
+		t.Fatalf("Found more to remove after collecting: %+v", msg)
+	}
+	checkFile(s.URL, "file1", "commit1", kept, t)
+
+	res, err := http.Get(s.URL + "/admin/gc?grace=soon")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s for an invalid grace.", res.Status)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	shard := NewShard("TestLimitsData", "TestLimitsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	setLimits := func(limits string, status int) {
+		res, err := http.Post(s.URL+"/limits", "application/json", strings.NewReader(limits))
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Setting %s returned %s, expected %d.", limits, res.Status, status)
+		}
+	}
+	write := func(name, branch string, body io.Reader, status int) *http.Response {
+		res, err := http.Post(s.URL+"/file/"+name+"?branch="+branch, "application/text", body)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Writing %s returned %s, expected %d.", name, res.Status, status)
+		}
+		return res
+	}
+	setLimits(`{"branch": "master", "maxFiles": -1}`, 400)
+	setLimits(`{"branch": "master", "maxFileSize": 5}`, 200)
+	setLimits(`{"branch": "files-*", "maxFiles": 2}`, 200)
+	setLimits(`{"branch": "slow", "maxBytesPerSec": 10}`, 200)
+
+	// Too big, whether or not we know it up front.
+	write("big", "master", strings.NewReader("too big"), 413)
+	write("big", "master", io.MultiReader(strings.NewReader("too big")), 413)
+	checkNoFile(s.URL, "big", "master", t)
+	// Striped files are limited by their whole size, not their stripes'.
+	write("big", "master&stripe=0&stripedSize=10", strings.NewReader("too"), 413)
+	// Archives and uploads are limited like any other write.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	check(tw.WriteHeader(&tar.Header{Name: "big", Mode: 0666, Size: 7, Typeflag: tar.TypeReg}), t)
+	_, err := tw.Write([]byte("too big"))
+	check(err, t)
+	check(tw.Close(), t)
+	res, err := http.Post(s.URL+"/archive?branch=master", "application/x-tar", &buf)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 413 {
+		t.Fatalf("Unpacking a file that's too big returned %s, expected 413.", res.Status)
+	}
+	res, err = http.Post(s.URL+"/file/big?uploads&branch=master", "", nil)
+	check(err, t)
+	id, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	check(err, t)
+	uploadId := strings.TrimSpace(string(id))
+	for n := 1; n <= 2; n++ {
+		res, err := http.Post(fmt.Sprintf("%s/file/big?uploadId=%s&part=%d", s.URL, uploadId, n), "application/text", strings.NewReader("foo"))
+		check(err, t)
+		res.Body.Close()
+	}
+	write("big", "master&complete&uploadId="+uploadId, nil, 413)
+	checkNoFile(s.URL, "big", "master", t)
+	writeFile(s.URL, "small", "master", "small", t)
+
+	commit(s.URL, "commit1", "master", t)
+	branch(s.URL, "commit1", "files-1", t)
+	writeFile(s.URL, "a", "files-1", "foo", t)
+	writeFile(s.URL, "b", "files-1", "foo", t)
+	write("c", "files-1", strings.NewReader("foo"), 413)
+	// Files that have already changed can change again.
+	writeFile(s.URL, "a", "files-1", "bar", t)
+
+	branch(s.URL, "commit1", "slow", t)
+	writeFile(s.URL, "a", "slow", strings.Repeat("a", 100), t)
+	if res := write("b", "slow", strings.NewReader("foo"), 429); res.Header.Get("Retry-After") == "" {
+		t.Fatal("429 didn't say when to retry.")
+	}
+
+	res, err = http.Get(s.URL + "/limits")
+	check(err, t)
+	var limits []LimitsMsg
+	check(json.NewDecoder(res.Body).Decode(&limits), t)
+	res.Body.Close()
+	if len(limits) != 3 || limits[2] != (LimitsMsg{Branch: "slow", MaxBytesPerSec: 10}) {
+		t.Fatalf("Got limits %+v.", limits)
+	}
+	for _, status := range []int{200, 404} {
+		req, err := http.NewRequest("DELETE", s.URL+"/limits?branch=slow", nil)
+		check(err, t)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("DELETE returned %s, expected %d.", res.Status, status)
+		}
+	}
+	writeFile(s.URL, "b", "slow", "foo", t)
+}
+
+func TestFreeze(t *testing.T) {
+	shard := NewShard("TestFreezeData", "TestFreezeComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	freeze := func(frozen bool) {
+		res, err := http.Post(s.URL+"/repo/data", "application/json", strings.NewReader(fmt.Sprintf(`{"frozen": %t}`, frozen)))
+		check(err, t)
+		defer res.Body.Close()
+		var msg RepoMsg
+		check(json.NewDecoder(res.Body).Decode(&msg), t)
+		if msg.Frozen != frozen {
+			t.Fatalf("Repo frozen is %t, expected %t.", msg.Frozen, frozen)
+		}
+	}
+	expectLocked := func(res *http.Response, err error) {
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != http.StatusLocked {
+			t.Fatalf("Got %s from a frozen repo, expected 423.", res.Status)
+		}
+	}
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	freeze(true)
+	expectLocked(http.Post(s.URL+"/file/file2?branch=master", "application/text", strings.NewReader("bar")))
+	expectLocked(http.Post(s.URL+"/commit?branch=master&commit=commit2", "", nil))
+	expectLocked(http.Post(s.URL+"/branch?commit=commit1&branch=branch", "", nil))
+	// Stripes are kept in the branch's metadata but they're still files.
+	expectLocked(http.Post(s.URL+"/file/file3?branch=master&stripe=0", "application/text", strings.NewReader("bar")))
+	res, err := http.Post(s.URL+"/file/.meta/file4?branch=master", "application/text", strings.NewReader("bar"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Got %s writing to a branch's metadata, expected 400.", res.Status)
+	}
+	checkFile(s.URL, "file", "commit1", "foo", t)
+	checkNoFile(s.URL, "file2", "master", t)
+
+	freeze(false)
+	writeFile(s.URL, "file2", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+	checkFile(s.URL, "file2", "commit2", "bar", t)
+}
+
+func TestRepoConfig(t *testing.T) {
+	shard := NewShard("TestRepoConfigData", "TestRepoConfigComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	post := func(body string, status int) btrfs.Config {
+		res, err := http.Post(s.URL+"/repo/data/config", "application/json", strings.NewReader(body))
+		check(err, t)
+		defer res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("Posting %s returned %s, expected %d.", body, res.Status, status)
+		}
+		var c btrfs.Config
+		if status == 200 {
+			check(json.NewDecoder(res.Body).Decode(&c), t)
+		}
+		return c
+	}
+	c := post(`{"version": 0, "replicas": ["http://replica"], "gcGrace": "2h"}`, 200)
+	if c.Version != 1 {
+		t.Fatalf("Expected version 1, got %+v.", c)
+	}
+	if grace := shard.gcGrace(); grace != 2*time.Hour {
+		t.Fatalf("Expected the configured GC grace, got %s.", grace)
+	}
+	post(`{"version": 0}`, 409)
+	post(`{"version": 1, "compression": "nope"}`, 400)
+	post(`{"version": 1, "replicas": ["ftp://replica"]}`, 400)
+
+	res, err := http.Get(s.URL + "/replica")
+	check(err, t)
+	var replicas []ReplicaMsg
+	check(json.NewDecoder(res.Body).Decode(&replicas), t)
+	res.Body.Close()
+	if len(replicas) != 1 || replicas[0].Url != "http://replica" {
+		t.Fatalf("Expected the configured replica to be registered, got %+v.", replicas)
+	}
+
+	// Configs edited by hand are picked up by reloads, replicas that are
+	// already registered aren't registered again.
+	c.Replicas = append(c.Replicas, "s3://bucket/replica")
+	_, err = btrfs.SaveConfig(shard.dataRepo, c)
+	check(err, t)
+	check(shard.ReloadConfig(), t)
+	shard.replicas.lock.Lock()
+	replicas, err = shard.loadReplicas()
+	shard.replicas.lock.Unlock()
+	check(err, t)
+	if len(replicas) != 2 || replicas[1].Url != "s3://bucket/replica" {
+		t.Fatalf("Expected the reloaded replica to be registered, got %+v.", replicas)
+	}
+	res, err = http.Get(s.URL + "/repo/data/config")
+	check(err, t)
+	check(json.NewDecoder(res.Body).Decode(&c), t)
+	res.Body.Close()
+	if c.Version != 2 || len(c.Replicas) != 2 {
+		t.Fatalf("Unexpected config %+v.", c)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	shard := NewShard("TestChecksumsData", "TestChecksumsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	write := func(method, name, data, header, sum string, status int) {
+		req, err := http.NewRequest(method, s.URL+"/file/"+name+"?branch=master", strings.NewReader(data))
+		check(err, t)
+		req.Header.Set(header, sum)
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("%s of %s returned %s, expected %d.", method, name, res.Status, status)
+		}
+	}
+	const fooMD5 = "rL0Y20zC+Fzt72VPzMSk2A=="
+	const fooSHA256 = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	write("POST", "file", "foo", "Content-MD5", fooMD5, 200)
+	write("POST", "file2", "foo", "X-Checksum-Sha256", fooSHA256, 200)
+	checkFile(s.URL, "file", "master", "foo", t)
+
+	write("POST", "corrupt", "fob", "Content-MD5", fooMD5, 400)
+	write("POST", "corrupt", "fob", "X-Checksum-Sha256", fooSHA256, 400)
+	checkNoFile(s.URL, "corrupt", "master", t)
+	write("POST", "corrupt", "foo", "Content-MD5", "nope", 400)
+	checkNoFile(s.URL, "corrupt", "master", t)
+}
+
+func TestFailover(t *testing.T) {
+	_src := NewShard("TestFailoverSrc", "TestFailoverSrcComp", 0, 1)
+	_dst := NewShard("TestFailoverDst", "TestFailoverDstComp", 0, 1)
+	check(_src.EnsureRepos(), t)
+	check(_dst.EnsureReplicaRepos(), t)
+	src := httptest.NewServer(_src.ShardMux())
+	dst := httptest.NewServer(_dst.ShardMux())
+	defer src.Close()
+	defer dst.Close()
+
+	res, err := http.Post(dst.URL+"/admin/demote?upstream="+src.URL, "", nil)
+	check(err, t)
+	checkResp(res, fmt.Sprintf("Following %s.\n", src.URL), t)
+
+	writeFile(src.URL, "file", "master", "foo", t)
+	commit(src.URL, "commit1", "master", t)
+	check(_dst.syncFromUpstream(), t)
+	checkFile(dst.URL, "file", "commit1", "foo", t)
+
+	// Writes to the passive shard are rejected
+	res, err = http.Post(dst.URL+"/file/file2?branch=master", "application/text", strings.NewReader("bar"))
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Write to passive shard should return 503, got %s.", res.Status)
+	}
+
+	res, err = http.Post(dst.URL+"/admin/failover?demote=false", "", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Failover failed: %s", res.Status)
+	}
+	writeFile(dst.URL, "file2", "master", "bar", t)
+	commit(dst.URL, "commit2", "master", t)
+	checkFile(dst.URL, "file2", "commit2", "bar", t)
+}
+
+func TestDiff(t *testing.T) {
+	shard := NewShard("TestDiffData", "TestDiffComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file1", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "file2", "master", "bar", t)
+	commit(s.URL, "commit2", "master", t)
+
+	res, err := http.Get(s.URL + "/diff?from=commit1&to=commit2")
+	check(err, t)
+	checkResp(res, "[\"file2\"]\n", t)
+
+	req, err := http.NewRequest("GET", s.URL+"/diff?from=t0&to=commit2", nil)
+	check(err, t)
+	req.Header.Set("Accept", "text/plain")
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	checkResp(res, "file1\nfile2\n", t)
+}
+
+func TestRange(t *testing.T) {
+	shard := NewShard("TestRangeData", "TestRangeComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "0123456789", t)
+	commit(s.URL, "commit1", "master", t)
+
+	req, err := http.NewRequest("GET", s.URL+"/file/file?commit=commit1", nil)
+	check(err, t)
+	req.Header.Set("Range", "bytes=2-5")
+	res, err := http.DefaultClient.Do(req)
+	check(err, t)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected 206, got %s.", res.Status)
+	}
+	value, err := ioutil.ReadAll(res.Body)
+	check(err, t)
+	if string(value) != "2345" {
+		t.Fatalf("Expected 2345, got %s.", value)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	shard := NewShard("TestMultipartUploadData", "TestMultipartUploadComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	res, err := http.Post(s.URL+"/file/file?uploads", "", nil)
+	check(err, t)
+	id, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	check(err, t)
+	uploadId := strings.TrimSpace(string(id))
+
+	// Upload the parts out of order
+	for _, n := range []int{2, 1, 3} {
+		url := fmt.Sprintf("%s/file/file?uploadId=%s&part=%d", s.URL, uploadId, n)
+		res, err := http.Post(url, "application/text", strings.NewReader(fmt.Sprintf("part%d", n)))
+		check(err, t)
+		checkResp(res, fmt.Sprintf("Created part %d, size: 5.\n", n), t)
+	}
+	res, err = http.Post(s.URL+"/file/file?complete&uploadId="+uploadId, "", nil)
+	check(err, t)
+	checkResp(res, "Created file, size: 15.\n", t)
+	commit(s.URL, "commit1", "master", t)
+	checkFile(s.URL, "file", "commit1", "part1part2part3", t)
+
+	// Uploads missing a part can't be completed.
+	res, err = http.Post(s.URL+"/file/gap?uploads", "", nil)
+	check(err, t)
+	id, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	check(err, t)
+	uploadId = strings.TrimSpace(string(id))
+	for _, n := range []int{1, 2, 4} {
+		url := fmt.Sprintf("%s/file/gap?uploadId=%s&part=%d", s.URL, uploadId, n)
+		res, err := http.Post(url, "application/text", strings.NewReader(fmt.Sprintf("part%d", n)))
+		check(err, t)
+		checkResp(res, fmt.Sprintf("Created part %d, size: 5.\n", n), t)
+	}
+	res, err = http.Post(s.URL+"/file/gap?complete&uploadId="+uploadId, "", nil)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("Expected 400 completing an upload missing a part, got %s.", res.Status)
+	}
+	// Completing is a write like any other, it's refused once the branch's
+	// head has moved.
+	url := fmt.Sprintf("%s/file/gap?uploadId=%s&part=3", s.URL, uploadId)
+	res, err = http.Post(url, "application/text", strings.NewReader("part3"))
+	check(err, t)
+	checkResp(res, "Created part 3, size: 5.\n", t)
+	req, err := http.NewRequest("POST", s.URL+"/file/gap?complete&uploadId="+uploadId, nil)
+	check(err, t)
+	req.Header.Set("If-Match", "t0")
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 completing an upload on a moved head, got %s.", res.Status)
+	}
+	res, err = http.Post(s.URL+"/file/gap?complete&uploadId="+uploadId, "", nil)
+	check(err, t)
+	checkResp(res, "Created gap, size: 20.\n", t)
+	commit(s.URL, "commit2", "master", t)
+	checkFile(s.URL, "gap", "commit2", "part1part2part3part4", t)
+}
+
+func TestETag(t *testing.T) {
+	shard := NewShard("TestETagData", "TestETagComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	res, err := http.Get(s.URL + "/file/file?commit=commit1")
+	check(err, t)
+	res.Body.Close()
+	if res.Header.Get("ETag") != "\"commit1\"" {
+		t.Fatalf("Expected ETag \"commit1\", got %s.", res.Header.Get("ETag"))
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/file/file?commit=commit1", nil)
+	check(err, t)
+	req.Header.Set("If-None-Match", "\"commit1\"")
+	res, err = http.DefaultClient.Do(req)
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("Expected 304, got %s.", res.Status)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	shard := NewShard("TestEventsData", "TestEventsComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/events")
+	check(err, t)
+	defer res.Body.Close()
+
+	writeFile(s.URL, "file", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "data: ") {
+			continue
+		}
+		var e CommitEventMsg
+		check(json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &e), t)
+		if e.Name != "commit1" || e.Branch != "master" || e.Files != 1 {
+			t.Fatalf("Unexpected event: %#v", e)
+		}
+		return
+	}
+	check(scanner.Err(), t)
+	t.Fatal("Event stream ended without an event.")
+}
+
+func TestWatch(t *testing.T) {
+	shard := NewShard("TestWatchData", "TestWatchComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "images/a", "master", "foo", t)
+	writeFile(s.URL, "images/b", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+
+	req, err := http.NewRequest("GET", s.URL+"/watch?branch=master&prefix=images/", nil)
+	check(err, t)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	check(err, t)
+	defer res.Body.Close()
+
+	// Commits that don't touch images/ aren't watched.
+	writeFile(s.URL, "other", "master", "foo", t)
+	commit(s.URL, "commit2", "master", t)
+	writeFile(s.URL, "images/a", "master", "bar", t)
+	deleteFile(s.URL, "images/b", "master", t)
+	commit(s.URL, "commit3", "master", t)
+
+	expected := WatchEventMsg{Commit: "commit3", Branch: "master", Parent: "commit2", Files: []string{"images/a"}, Deleted: []string{"images/b"}}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "data: ") {
+			continue
+		}
+		var e WatchEventMsg
+		check(json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &e), t)
+		if !reflect.DeepEqual(e, expected) {
+			t.Fatalf("Got %#v, expected %#v.", e, expected)
+		}
+		break
+	}
+	check(scanner.Err(), t)
+
+	// Long-polls with since return what they missed straight away.
+	res, err = http.Get(s.URL + "/watch?branch=master&prefix=images/&since=commit1")
+	check(err, t)
+	var e WatchEventMsg
+	check(json.NewDecoder(res.Body).Decode(&e), t)
+	res.Body.Close()
+	expected.Parent = "commit1"
+	if !reflect.DeepEqual(e, expected) {
+		t.Fatalf("Got %#v, expected %#v.", e, expected)
+	}
+	res, err = http.Get(s.URL + "/watch?branch=master&prefix=images/&since=commit3&timeout=10ms")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 204 {
+		t.Fatalf("Expected a 204 when nothing changed, got %s.", res.Status)
+	}
+	res, err = http.Get(s.URL + "/watch?branch=nope")
+	check(err, t)
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("Expected a 404 for a missing branch, got %s.", res.Status)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	shard := NewShard("TestArchiveData", "TestArchiveComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "file1", "master", "foo", t)
+	writeFile(s.URL, "dir/file2", "master", "bar", t)
+	commit(s.URL, "commit1", "master", t)
+
+	res, err := http.Get(s.URL + "/archive?commit=commit1&format=tar")
+	check(err, t)
+	defer res.Body.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(res.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err, t)
+		data, err := ioutil.ReadAll(tr)
+		check(err, t)
+		files[hdr.Name] = string(data)
+	}
+	expected := map[string]string{"dir/": "", "dir/file2": "bar", "file1": "foo"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("Archive contained %v, expected %v.", files, expected)
+	}
+}
+
+func TestDiffView(t *testing.T) {
+	shard := NewShard("TestDiffViewData", "TestDiffViewComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	writeFile(s.URL, "same", "master", "foo", t)
+	writeFile(s.URL, "dir/changed", "master", "foo", t)
+	writeFile(s.URL, "dir/deleted", "master", "foo", t)
+	commit(s.URL, "commit1", "master", t)
+	writeFile(s.URL, "dir/changed", "master", "bar", t)
+	writeFile(s.URL, "added", "master", "baz", t)
+	deleteFile(s.URL, "dir/deleted", "master", t)
+	commit(s.URL, "commit2", "master", t)
+
+	dav := func(method, url string, status int) *http.Response {
+		req, err := http.NewRequest(method, s.URL+url, nil)
+		check(err, t)
+		req.Header.Set("Depth", "1")
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		if res.StatusCode != status {
+			t.Fatalf("%s %s returned %s, expected %d.", method, url, res.Status, status)
+		}
+		return res
+	}
+	res := dav("PROPFIND", "/dav/commit1..commit2/", 207)
+	var ms struct {
+		Responses []struct {
+			Href string `xml:"href"`
+		} `xml:"response"`
+	}
+	check(xml.NewDecoder(res.Body).Decode(&ms), t)
+	res.Body.Close()
+	var hrefs []string
+	for _, r := range ms.Responses {
+		hrefs = append(hrefs, r.Href)
+	}
+	expected := []string{"/dav/commit1..commit2/", "/dav/commit1..commit2/added", "/dav/commit1..commit2/dir/", "/dav/commit1..commit2/.pfs-deleted"}
+	if !reflect.DeepEqual(hrefs, expected) {
+		t.Fatalf("PROPFIND listed %v, expected %v.", hrefs, expected)
+	}
+	checkResp(dav("GET", "/dav/commit1..commit2/dir/changed", 200), "bar", t)
+	checkResp(dav("GET", "/dav/commit1..commit2/.pfs-deleted", 200), "dir/deleted\n", t)
+	dav("GET", "/dav/commit1..commit2/same", 404).Body.Close()
+	dav("PUT", "/dav/commit1..commit2/new", 403).Body.Close()
+	dav("PROPFIND", "/dav/commit1..nope/", 404).Body.Close()
+
+	res, err := http.Get(s.URL + "/archive?from=commit1&commit=commit2&format=tar")
+	check(err, t)
+	defer res.Body.Close()
+	files := make(map[string]string)
+	tr := tar.NewReader(res.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err, t)
+		data, err := ioutil.ReadAll(tr)
+		check(err, t)
+		files[hdr.Name] = string(data)
+	}
+	expectedFiles := map[string]string{"added": "baz", "dir/changed": "bar", ".pfs-deleted": "dir/deleted\n"}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Fatalf("Archive contained %v, expected %v.", files, expectedFiles)
+	}
+}
+
+func TestUnpackArchive(t *testing.T) {
+	shard := NewShard("TestUnpackArchiveData", "TestUnpackArchiveComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, data := range map[string]string{"file1": "foo", "dir/file2": "bar"} {
+		check(tw.WriteHeader(&tar.Header{Name: name, Mode: 0666, Size: int64(len(data)), Typeflag: tar.TypeReg}), t)
+		_, err := tw.Write([]byte(data))
+		check(err, t)
+	}
+	check(tw.Close(), t)
+
+	res, err := http.Post(s.URL+"/archive?branch=master&commit=commit1", "application/x-tar", &buf)
+	check(err, t)
+	checkResp(res, "Unpacked 2 files in to master.\ncommit1\n", t)
+	checkFile(s.URL, "file1", "commit1", "foo", t)
+	checkFile(s.URL, "dir/file2", "commit1", "bar", t)
+}
+
+func TestAuth(t *testing.T) {
+	shard := NewShard("TestAuthData", "TestAuthComp", 0, 1)
+	check(shard.EnsureRepos(), t)
+	shard.auth = newAuthorizer(AuthPolicy{
+		Tokens: map[string]string{"alice-token": "alice", "bob-token": "bob", "ops-token": "ops"},
+		Admins: []string{"ops"},
+		Grants: []Grant{
+			{Principal: "alice", Branches: []string{"master"}, Read: true, Write: true},
+			{Principal: "*", Branches: []string{"*"}, Read: true},
+		},
+	})
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+
+	do := func(method, url, token string) int {
+		req, err := http.NewRequest(method, s.URL+url, strings.NewReader("foo"))
+		check(err, t)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		check(err, t)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	expect := func(method, url, token string, status int) {
+		if got := do(method, url, token); got != status {
+			t.Fatalf("%s %s with token %q returned %d, expected %d.", method, url, token, got, status)
+		}
+	}
+
+	expect("GET", "/ping", "", 200)
+	expect("POST", "/file/file?branch=master", "", 401)
+	expect("POST", "/file/file?branch=master", "bad-token", 401)
+	expect("POST", "/file/file?branch=master", "alice-token", 200)
+	expect("GET", "/file/file?commit=master", "", 200)
+	expect("POST", "/commit?branch=master&commit=commit1", "alice-token", 200)
+	expect("GET", "/file/file?commit=commit1", "", 200)
+	// Only admins can create branches
+	expect("POST", "/branch?commit=commit1&branch=feature", "alice-token", 403)
+	expect("POST", "/branch?commit=commit1&branch=feature", "ops-token", 200)
+	expect("POST", "/file/file?branch=feature", "alice-token", 403)
+	expect("POST", "/file/file?branch=feature", "ops-token", 200)
+	expect("GET", "/debug/slow", "alice-token", 403)
+	// bob can only read, files under /branch and /commit are read only.
+	expect("GET", "/branch/master/file/file", "bob-token", 200)
+	expect("POST", "/branch/master/file/x", "bob-token", 403)
+	expect("DELETE", "/commit/commit1/file/file", "bob-token", 403)
+	expect("POST", "/branch/master/file/x", "alice-token", 403)
+	expect("POST", "/branch/master/file/x", "ops-token", 405)
+}
+
+// _BenchmarkFiles measures writing files of size bytes to a shard over HTTP,
+// and then reading them back.
+func _BenchmarkFiles(size int64, b *testing.B) {
+	name := btrfs.RandSeq(10)
+	shard := NewShard("BenchmarkFilesData"+name, "BenchmarkFilesComp"+name, 0, 1)
+	check(shard.EnsureRepos(), b)
+	s := httptest.NewServer(shard.ShardMux())
+	defer s.Close()
+	data := bytes.Repeat([]byte("a"), int(size))
+	b.Run("write", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			res, err := http.Post(fmt.Sprintf("%s/file/file%d?branch=master", s.URL, i), "application/text", bytes.NewReader(data))
+			check(err, b)
+			res.Body.Close()
+			if res.StatusCode != 200 {
+				b.Fatalf("Writing file%d returned %s.", i, res.Status)
+			}
+		}
+	})
+	b.Run("read", func(b *testing.B) {
+		check(btrfs.WriteFile(path.Join(shard.dataRepo, "master", "file"), data), b)
+		b.SetBytes(size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			res, err := http.Get(s.URL + "/file/file?commit=master")
+			check(err, b)
+			_, err = io.Copy(ioutil.Discard, res.Body)
+			check(err, b)
+			res.Body.Close()
+		}
+	})
+}
+
+func BenchmarkSmallFiles(b *testing.B) {
+	_BenchmarkFiles(1<<10, b)
+}
+
+func BenchmarkLargeFiles(b *testing.B) {
+	_BenchmarkFiles(64<<20, b)
+}
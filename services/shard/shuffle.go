@@ -0,0 +1,241 @@
+package main
+
+// shuffle.go moves the files that shuffling pipelines spool for other shards.
+// When a shuffling pipeline's job over a commit succeeds we send everything
+// in $PFS_SPOOL/<j> to shard j, even if there's nothing, so that j knows
+// we're done:
+//
+//	POST /shuffle?pipeline=<name>&commit=<commit>&from=<shard>  the body is a tar of the files
+//
+// Once a shard has heard from every shard it concatenates the files with the
+// same name, in shard order, and commits them to the pipeline's shuffle
+// branch of the comp repo. The pipelines that read from the shuffling
+// pipeline then run over that commit.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/pipeline"
+)
+
+// spoolDir is where the job with id spools files for other shards.
+func (s Shard) spoolDir(id string) string {
+	return path.Join("spool", s.dataRepo, id)
+}
+
+// shuffleDir is where we collect the files that other shards send us for
+// the pipeline name's jobs over commit.
+func (s Shard) shuffleDir(name, commit string) string {
+	return path.Join("shuffle", s.dataRepo, name, commit)
+}
+
+// makeSpool creates the spool for the job with id, with a directory for
+// each shard.
+func (s Shard) makeSpool(id string) (string, error) {
+	spool := s.spoolDir(id)
+	if err := btrfs.RemoveAll(spool); err != nil {
+		return "", err
+	}
+	for j := uint64(0); j < s.modulos; j++ {
+		if err := btrfs.MkdirAll(path.Join(spool, fmt.Sprint(j))); err != nil {
+			return "", err
+		}
+	}
+	return spool, nil
+}
+
+// shardUrl returns the url of the primary of shard j.
+func (s Shard) shardUrl(j uint64) (string, error) {
+	client := etcd.NewClient([]string{"http://172.17.42.1:4001", "http://10.1.42.1:4001"})
+	resp, err := client.Get(path.Join("/pfs/master", fmt.Sprintf("%d-%d", j, s.modulos)), false, false)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(resp.Node.Value, "[backfilling]") {
+		return "", fmt.Errorf("Shard %d-%d is still backfilling.", j, s.modulos)
+	}
+	return resp.Node.Value, nil
+}
+
+// sendShuffle sends the files in dir, which the pipeline name's job over
+// commit spooled for shard j, to j.
+func (s Shard) sendShuffle(name, commit string, j uint64, dir string) error {
+	r, w := io.Pipe()
+	// Closing r stops the writer if we give up before reading all of it.
+	defer r.Close()
+	go func() {
+		w.CloseWithError(writeTar(w, dir, "", nil, nil))
+	}()
+	if j == s.shard {
+		return s.receiveShuffle(name, commit, s.shard, r)
+	}
+	url, err := s.shardUrl(j)
+	if err != nil {
+		return err
+	}
+	resp, err := peerRequest("POST", fmt.Sprintf("%s/shuffle?pipeline=%s&commit=%s&from=%d", url, name, commit, s.shard), r)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Failed to send shuffled files to %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// sendSpool sends the files in spool, which the pipeline name's job over
+// commit wrote, to their shards and then removes it.
+func (s Shard) sendSpool(name, commit, spool string) error {
+	for j := uint64(0); j < s.modulos; j++ {
+		if err := s.sendShuffle(name, commit, j, path.Join(spool, fmt.Sprint(j))); err != nil {
+			return err
+		}
+	}
+	return btrfs.RemoveAll(spool)
+}
+
+// receiveShuffle records the files that shard from spooled for us, r is a
+// tar of them. If we've heard from every shard the files are merged.
+func (s Shard) receiveShuffle(name, commit string, from uint64, r io.Reader) error {
+	dir := path.Join(s.shuffleDir(name, commit), fmt.Sprint(from))
+	// We unpack next to dir and move it in to place once we have all of
+	// it, so we only count shards that have finished.
+	tmp := dir + ".tmp"
+	if err := btrfs.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(tmp); err != nil {
+		return err
+	}
+	// Shuffles are pipeline output, not writes to a branch, so they aren't
+	// limited, and they were spooled for us so they're ours.
+	if _, err := unpackTar(r, tmp, false, nil, nil); err != nil {
+		return err
+	}
+	s.pipelines.shuffleLock.Lock()
+	defer s.pipelines.shuffleLock.Unlock()
+	if err := btrfs.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := btrfs.Rename(tmp, dir); err != nil {
+		return err
+	}
+	for j := uint64(0); j < s.modulos; j++ {
+		exists, err := btrfs.FileExists(path.Join(s.shuffleDir(name, commit), fmt.Sprint(j)))
+		if err != nil || !exists {
+			return err
+		}
+	}
+	return s.mergeShuffle(name, commit)
+}
+
+// mergeShuffle merges the files that every shard sent us for the pipeline
+// name's jobs over commit, commits them and queues the pipelines that read
+// from name. Callers must hold the shuffle lock.
+func (s Shard) mergeShuffle(name, commit string) error {
+	branch := path.Join(s.compRepo, pipeline.ShuffleBranch(name))
+	exists, err := btrfs.FileExists(branch)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := btrfs.Branch(s.compRepo, "t0", pipeline.ShuffleBranch(name)); err != nil {
+			return err
+		}
+	}
+	// The branch only holds the files shuffled for this commit.
+	infos, err := btrfs.ReadDir(branch)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() == ".meta" {
+			continue
+		}
+		if err := btrfs.RemoveAll(path.Join(branch, info.Name())); err != nil {
+			return err
+		}
+	}
+	for j := uint64(0); j < s.modulos; j++ {
+		dir := path.Join(s.shuffleDir(name, commit), fmt.Sprint(j))
+		err := walkSnapshot(dir, "", func(file string, fi os.FileInfo, abs string) error {
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			return appendFile(path.Join(branch, file), abs)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := btrfs.SetMeta(branch, "provenance", path.Join(s.compRepo, pipeline.OutputCommit(name, commit))); err != nil {
+		return err
+	}
+	shuffled, err := btrfs.Commit(s.compRepo, pipeline.ShuffleCommit(name, commit), pipeline.ShuffleBranch(name))
+	if err != nil {
+		return err
+	}
+	if err := btrfs.RemoveAll(s.shuffleDir(name, commit)); err != nil {
+		logger.Error("removing shuffle dir", "pipeline", name, "commit", commit, "err", err)
+	}
+	return s.queueReaders(name, commit, shuffled)
+}
+
+// appendFile appends the file at abs, an absolute path, to name.
+func appendFile(name, abs string) error {
+	if err := btrfs.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	dst, err := btrfs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	src, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = copyBuffer(dst, src)
+	return err
+}
+
+// ShuffleHandler receives the files that other shards spool for us.
+func (s Shard) ShuffleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	if s.rejectWrite(w) {
+		return
+	}
+	name, commit := r.URL.Query().Get("pipeline"), r.URL.Query().Get("commit")
+	if !validId(name) {
+		http.Error(w, fmt.Sprintf("Invalid pipeline %s.", name), 400)
+		return
+	}
+	if err := btrfs.ValidName(commit); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil || from >= s.modulos {
+		http.Error(w, fmt.Sprintf("Invalid shard %s.", r.URL.Query().Get("from")), 400)
+		return
+	}
+	if err := s.receiveShuffle(name, commit, from, r.Body); err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	fmt.Fprintf(w, "Received shuffle of %s from shard %d.\n", name, from)
+}
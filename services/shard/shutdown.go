@@ -0,0 +1,136 @@
+package main
+
+// shutdown.go lets the shard exit cleanly on SIGTERM. Once the signal arrives
+// the shard leaves the cluster's membership, new writes are refused, in-flight
+// writes get drainTimeout to finish, replication gets flushTimeout to flush,
+// anything still running under the shard's context is cancelled and then the
+// listener is closed. Reads keep being served until the very end.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/pachyderm/pfs/lib/discovery"
+)
+
+// drainTimeout is how long we wait for in-flight writes before giving up on
+// them.
+var drainTimeout = 30 * time.Second
+
+// flushTimeout is how long we spend flushing replication before giving up.
+var flushTimeout = time.Minute
+
+type drainer struct {
+	lock     sync.Mutex
+	draining bool
+	inFlight int
+	writes   sync.WaitGroup
+}
+
+// begin registers a write, it returns false if we're draining in which case
+// the write must not go ahead.
+func (d *drainer) begin() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inFlight++
+	d.writes.Add(1)
+	return true
+}
+
+func (d *drainer) isDraining() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.draining
+}
+
+func (d *drainer) end() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.inFlight--
+	d.writes.Done()
+}
+
+// drain stops new writes and waits up to timeout for in-flight writes to
+// finish.
+func (d *drainer) drain(timeout time.Duration) error {
+	d.lock.Lock()
+	d.draining = true
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.writes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return fmt.Errorf("Gave up waiting for %d in-flight writes after %s.", d.inFlight, timeout)
+	}
+}
+
+// wrap tracks the writes that go through h and refuses them once we're
+// draining.
+func (d *drainer) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if !d.begin() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "This shard is shutting down.", http.StatusServiceUnavailable)
+			return
+		}
+		defer d.end()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown drains writes and flushes replication, it's called before the
+// shard exits.
+func (s Shard) Shutdown() {
+	// Leave the cluster first so routers stop sending us requests.
+	client := etcd.NewClient([]string{"http://172.17.42.1:4001", "http://10.1.42.1:4001"})
+	if err := discovery.Deregister(client, s.member("")); err != nil {
+		logger.Error("deregistering", "err", err)
+	}
+	logger.Info("draining writes")
+	if err := s.drainer.drain(drainTimeout); err != nil {
+		logger.Error("draining writes", "err", err)
+	}
+	logger.Info("flushing replication")
+	ctx, cancel := context.WithTimeout(s.ctx, flushTimeout)
+	defer cancel()
+	if err := s.syncToPeers(ctx); err != nil {
+		logger.Error("flushing replication", "err", err)
+	}
+	s.stop()
+}
+
+// shutdownOnSignal shuts the shard down and closes l when we get SIGTERM or
+// an interrupt.
+func (s Shard) shutdownOnSignal(l net.Listener) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	sig := <-c
+	logger.Info("shutting down", "signal", sig.String())
+	s.Shutdown()
+	if err := l.Close(); err != nil {
+		logger.Error("closing listener", "err", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+// stripes.go keeps this shard's part of striped files, see lib/stripe. The
+// router cuts a striped file up and sends each stripe to the shard that owns
+// it with a stripe parameter:
+//
+//	POST /file/<file>?stripe=<n>  writes stripe n of file
+//	GET  /file/<file>?stripe=<n>  reads it back
+//
+// Stripes are stored in the branch's metadata, under .meta/stripes/<file>/<n>,
+// so they're committed with everything else. The shard that owns the file
+// itself stores its manifest, which the router posts with a stripe.Header,
+// and marks it with the user.pfs.stripes xattr. Reads and deletes of the
+// manifest carry the header too so that the router knows to reassemble, or
+// remove, the stripes.
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/stripe"
+)
+
+// stripesAttr marks manifests, its value is the number of stripes.
+const stripesAttr = "user.pfs.stripes"
+
+// stripeParam returns the stripe r is for and true, or false if it's for a
+// whole file.
+func stripeParam(r *http.Request) (int, bool, error) {
+	if _, ok := r.URL.Query()[stripe.Param]; !ok {
+		return 0, false, nil
+	}
+	i, err := strconv.Atoi(r.URL.Query().Get(stripe.Param))
+	if err != nil || i < 0 {
+		return 0, false, fmt.Errorf("Invalid stripe %q.", r.URL.Query().Get(stripe.Param))
+	}
+	return i, true, nil
+}
+
+// stripePath returns the url path that stripe i of the file at the url path
+// p is stored under.
+func stripePath(p string, i int) string {
+	return path.Join("/file/.meta/stripes", strings.TrimPrefix(p, "/file/"), strconv.Itoa(i))
+}
+
+// stripes returns the number of stripes if the file at abs, an absolute path,
+// is a manifest.
+func stripes(abs string) (string, bool) {
+	buf := make([]byte, 20)
+	n, err := syscall.Getxattr(abs, stripesAttr, buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+// clearStripes unmarks the file at abs, if it exists, so that overwriting a
+// manifest with a whole file doesn't leave it looking like a manifest.
+func clearStripes(abs string) error {
+	err := syscall.Removexattr(abs, stripesAttr)
+	if err == syscall.ENODATA || err == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// writeManifest writes the manifest in the body of r as the file in r's url
+// under fs.
+func writeManifest(fs string, w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(r.URL.Path, "/")
+	name := path.Join(url[indexOf(url, "file")+1:]...)
+	m, err := stripe.ReadManifest(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	perms, setPerms, err := checkPerms(fs, r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	file := path.Join(fs, name)
+	btrfs.MkdirAll(path.Dir(file))
+	err = timeOp(w, "writeManifest", func() error {
+		f, err := btrfs.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := syscall.Removexattr(f.Name(), chunkedAttr); err != nil && err != syscall.ENODATA {
+			return err
+		}
+		// Mark the file before writing the manifest, like chunked files,
+		// so that a crash can't leave a manifest that reads as the file.
+		if err := syscall.Setxattr(f.Name(), stripesAttr, []byte(strconv.Itoa(m.Stripes())), 0); err != nil {
+			return err
+		}
+		if err := setFileMeta(f.Name(), r.Header); err != nil {
+			return err
+		}
+		if setPerms {
+			if err := perms.apply(file); err != nil {
+				return err
+			}
+		}
+		return stripe.WriteManifest(f, m)
+	})
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	fmt.Fprintf(w, "Created %s, size: %d.\n", name, m.Size)
+}
@@ -0,0 +1,68 @@
+package main
+
+// tags.go serves our data repo's tags, see btrfs.Tag:
+//
+//	GET    /tag                           lists tags
+//	POST   /tag?commit=<commit>&tag=<tag>  tags a commit
+//	DELETE /tag/<tag>                     deletes a tag
+//
+// Tags can be passed anywhere a commit can, ?commit= included. Tagged
+// commits are never tiered, see tier.go.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// TagHandler lists, creates and deletes tags.
+func (s Shard) TagHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(r.URL.Path, "/")
+	switch {
+	case len(url) == 2 && r.Method == "GET":
+		tags, err := btrfs.ListTags(s.dataRepo)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		encoder := json.NewEncoder(w)
+		for _, tag := range tags {
+			if err := encoder.Encode(TagMsg{Name: tag.Name, Commit: tag.Commit}); err != nil {
+				logError(r, err)
+				return
+			}
+		}
+	case len(url) == 2 && r.Method == "POST":
+		if s.rejectWrite(w) {
+			return
+		}
+		commit, tag := r.URL.Query().Get("commit"), r.URL.Query().Get("tag")
+		if commit == "" || tag == "" {
+			http.Error(w, "Tagging needs a commit and a tag.", 400)
+			return
+		}
+		if err := s.validNewName(tag); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := btrfs.Tag(s.dataRepo, commit, tag); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "Tagged %s as %s.\n", commit, tag)
+	case len(url) == 3 && r.Method == "DELETE":
+		if s.rejectWrite(w) {
+			return
+		}
+		if err := btrfs.Untag(s.dataRepo, url[2]); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "Deleted tag %s.\n", url[2])
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
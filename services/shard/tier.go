@@ -0,0 +1,271 @@
+package main
+
+// tier.go moves old commits to S3 so that a small disk can front a much
+// larger history. A commit can be tiered once it's in an S3 target that
+// stores files, see btrfs.S3Options.Files: its subvolume is deleted and a
+// stub recording the target is left in its place. Reads of a tiered commit's
+// files are fetched from the target, through the read cache if there is one,
+// see readcache.go.
+//
+//	GET  /tier                  lists our tiered commits
+//	POST /tier?commit=<commit>  tiers a commit now
+//
+// With PFS_TIER_AFTER set commits older than it are tiered automatically.
+// Sending a commit needs its parent, so a commit is only tiered once every
+// commit made on top of it is in the target too, and branch heads never are.
+// Tiered commits can't be branched from and tagged commits aren't tiered.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// tierCheckInterval is how often we look for commits to tier.
+var tierCheckInterval = time.Hour
+
+// errNotTierable is returned for commits that can't be tiered yet.
+var errNotTierable = errors.New("commit can't be tiered")
+
+func (s Shard) tierStubPath(commit string) string {
+	return path.Join("tiered", s.dataRepo, commit)
+}
+
+// tierStub returns commit's stub, nil if it isn't tiered.
+func (s Shard) tierStub(commit string) (*TierMsg, error) {
+	exists, err := btrfs.FileExists(s.tierStubPath(commit))
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := btrfs.ReadFile(s.tierStubPath(commit))
+	if err != nil {
+		return nil, err
+	}
+	var stub TierMsg
+	if err := json.Unmarshal(data, &stub); err != nil {
+		return nil, err
+	}
+	return &stub, nil
+}
+
+// tierTarget returns the url of an S3 target that holds commit's files and
+// every local commit made on top of it, local are our commits and branches.
+func (s Shard) tierTarget(commit string, local []btrfs.Subvolume) (string, error) {
+	s.replicas.lock.Lock()
+	replicas, err := s.loadReplicas()
+	s.replicas.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	var children []string
+	for _, sv := range local {
+		if sv.Commit && btrfs.GetMeta(path.Join(s.dataRepo, sv.Name), "parent") == commit {
+			children = append(children, sv.Name)
+		}
+	}
+	for _, replica := range replicas {
+		if !isS3(replica.Url) {
+			continue
+		}
+		m, err := btrfs.ReadS3Manifest(replica.Url, s3Options.Bucket)
+		if err != nil {
+			logger.Error("reading s3 manifest", "url", replica.Url, "err", err)
+			continue
+		}
+		pushed := make(map[string]bool)
+		files := false
+		for _, c := range m.Commits {
+			pushed[c.Name] = true
+			if c.Name == commit {
+				files = c.Files || c.Pack
+			}
+		}
+		ok := files
+		for _, child := range children {
+			ok = ok && pushed[child]
+		}
+		if ok {
+			return replica.Url, nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't in an S3 target that stores files, with the commits made on top of it: %w", commit, errNotTierable)
+}
+
+// tier tiers commit.
+func (s Shard) tier(commit string) (TierMsg, error) {
+	local, err := btrfs.Listing(s.dataRepo)
+	if err != nil {
+		return TierMsg{}, err
+	}
+	tags, err := btrfs.ListTags(s.dataRepo)
+	if err != nil {
+		return TierMsg{}, err
+	}
+	for _, tag := range tags {
+		if tag.Commit == commit {
+			return TierMsg{}, fmt.Errorf("%s is tagged %s: %w", commit, tag.Name, errNotTierable)
+		}
+	}
+	found := false
+	for _, sv := range local {
+		if sv.Name == commit && !sv.Commit {
+			return TierMsg{}, fmt.Errorf("%s is a branch: %w", commit, errNotTierable)
+		}
+		if sv.Head == commit {
+			return TierMsg{}, fmt.Errorf("%s is the head of %s: %w", commit, sv.Name, errNotTierable)
+		}
+		found = found || sv.Name == commit
+	}
+	if !found {
+		return TierMsg{}, fmt.Errorf("%s: %w", commit, btrfs.ErrCommitNotFound)
+	}
+	url, err := s.tierTarget(commit, local)
+	if err != nil {
+		return TierMsg{}, err
+	}
+	stub := TierMsg{Commit: commit, Url: url, Tiered: time.Now().Format("2006-01-02T15:04:05.999999-07:00")}
+	data, err := json.Marshal(stub)
+	if err != nil {
+		return TierMsg{}, err
+	}
+	// The stub goes first so that a crash can't lose track of the commit.
+	if err := btrfs.MkdirAll(path.Dir(s.tierStubPath(commit))); err != nil {
+		return TierMsg{}, err
+	}
+	if err := btrfs.WriteFileAtomic(s.tierStubPath(commit), data); err != nil {
+		return TierMsg{}, err
+	}
+	if err := btrfs.SubvolumeDelete(path.Join(s.dataRepo, commit)); err != nil {
+		return TierMsg{}, err
+	}
+	logger.Info("tiered commit", "commit", commit, "url", url)
+	return stub, nil
+}
+
+// tierOld tiers the commits older than s.tierAfter that can be.
+func (s Shard) tierOld() error {
+	local, err := btrfs.Listing(s.dataRepo)
+	if err != nil {
+		return err
+	}
+	for _, sv := range local {
+		if !sv.Commit {
+			continue
+		}
+		fi, err := btrfs.Stat(path.Join(s.dataRepo, sv.Name))
+		if err != nil {
+			return err
+		}
+		if time.Since(fi.ModTime()) < s.tierAfter {
+			continue
+		}
+		if _, err := s.tier(sv.Name); err != nil && !errors.Is(err, errNotTierable) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunTiering tiers old commits every tierCheckInterval, if PFS_TIER_AFTER is
+// set, until cancel is closed.
+func (s Shard) RunTiering(cancel chan struct{}) {
+	if s.tierAfter == 0 {
+		return
+	}
+	ticker := time.NewTicker(tierCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.tierOld(); err != nil {
+				logger.Error("tiering", "err", err)
+			}
+		case <-cancel:
+			return
+		}
+	}
+}
+
+// serveTiered serves r, a GET of the file name in stub's commit, from the S3
+// target the commit was tiered to. key is the file's key in the read cache.
+func (s Shard) serveTiered(w http.ResponseWriter, r *http.Request, stub *TierMsg, name, key string) {
+	replica := btrfs.NewS3ReplicaWithOptions(stub.Url, s3Options)
+	f, size, err := replica.OpenFile(r.Context(), stub.Commit, name)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	defer f.Close()
+	if s.readCache != nil && s.readCache.fits(size) {
+		abs, err := s.readCache.put(key, f, size)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		serveCached(w, r, abs, stub.Commit)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf("%q", stub.Commit))
+	if size >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	}
+	if _, err := copyBuffer(w, f); err != nil {
+		logError(r, err)
+	}
+}
+
+// TierHandler lists tiered commits and tiers commits.
+func (s Shard) TierHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		stubs := []TierMsg{}
+		err := btrfs.LazyWalk(path.Join("tiered", s.dataRepo), func(commit string) error {
+			stub, err := s.tierStub(commit)
+			if err != nil || stub == nil {
+				return err
+			}
+			stubs = append(stubs, *stub)
+			return nil
+		})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(stubs); err != nil {
+			logError(r, err)
+		}
+	case "POST":
+		if s.rejectWrite(w) {
+			return
+		}
+		commit := btrfs.Resolve(s.dataRepo, r.URL.Query().Get("commit"))
+		if commit == "" {
+			http.Error(w, "Tiering needs a commit.", 400)
+			return
+		}
+		var stub TierMsg
+		err := timeOp(w, "tier", func() error {
+			var err error
+			stub, err = s.tier(commit)
+			return err
+		})
+		if errors.Is(err, errNotTierable) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(stub); err != nil {
+			logError(r, err)
+		}
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// twophase.go is the shard's half of two phase commits, which the router uses
+// to commit on every shard coherently. The coordinator first prepares the
+// commit on every shard:
+//
+//	POST /commit?phase=prepare&branch=<branch>&commit=<commit>
+//
+// and, if they all succeed, finalizes it on every shard:
+//
+//	POST /commit?phase=finalize&commit=<commit>
+//
+// otherwise it aborts the shards that did prepare:
+//
+//	POST /commit?phase=abort&commit=<commit>
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/mapreduce"
+)
+
+func (s Shard) commitPhase(w http.ResponseWriter, r *http.Request) {
+	commit := r.URL.Query().Get("commit")
+	if err := btrfs.ValidName(commit); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	switch phase := r.URL.Query().Get("phase"); phase {
+	case "prepare":
+		if err := s.validNewName(commit); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		err := timeOp(w, "btrfs.Prepare", func() error {
+			return btrfs.PrepareWithOptions(s.dataRepo, commit, branchParam(r), btrfs.CommitOptions{IfHead: ifMatch(r)})
+		})
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		fmt.Fprintf(w, "Prepared %s.\n", commit)
+	case "finalize":
+		if err := timeOp(w, "btrfs.Finalize", func() error { return btrfs.Finalize(s.dataRepo, commit) }); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		msg, err := s.newCommitMsg(commit)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if materializeParam(r) == "true" {
+			go func() {
+				err := mapreduce.Materialize(s.dataRepo, msg.Branch, commit,
+					s.compRepo, jobDir, s.shard, s.modulos)
+				if err != nil {
+					logError(r, err)
+				}
+			}()
+		}
+		go s.publishCommit(commit)
+		go s.syncToPeers(s.detach(r))
+		w.Header().Set(tokenHeader, commit)
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	case "abort":
+		if err := timeOp(w, "btrfs.Abort", func() error { return btrfs.Abort(s.dataRepo, commit) }); err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		fmt.Fprintf(w, "Aborted %s.\n", commit)
+	default:
+		http.Error(w, fmt.Sprintf("Invalid phase %s.", phase), 400)
+	}
+}
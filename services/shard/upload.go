@@ -0,0 +1,258 @@
+package main
+
+// upload.go implements multipart uploads, which let clients upload very large
+// files as several parts in parallel and resume after failures. The protocol
+// is modeled on S3's:
+//
+//	POST   /file/<name>?uploads                   starts an upload, returns its id
+//	POST   /file/<name>?uploadId=<id>&part=<n>    uploads part n (n >= 1)
+//	GET    /file/<name>?uploadId=<id>             lists the parts uploaded so far
+//	POST   /file/<name>?uploadId=<id>&complete    assembles the parts in to <name>
+//	DELETE /file/<name>?uploadId=<id>             aborts the upload
+//
+// Parts are staged outside of the branch so that they never end up in a
+// commit. Completing an upload needs parts 1 to n with none missing, and
+// writes the file like any other POST of it would, checksum headers on it
+// cover the whole file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// fileName extracts the name of the file from a url that looks like:
+// /foo/bar/.../file/<file>
+func fileName(r *http.Request) string {
+	url := strings.Split(r.URL.Path, "/")
+	return path.Join(url[indexOf(url, "file")+1:]...)
+}
+
+// validId makes sure that an id can't be used to escape a directory.
+func validId(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Shard) uploadDir(id string) string {
+	return path.Join("tmp", "uploads", s.dataRepo, id)
+}
+
+// uploadParts returns the part numbers that have been uploaded, in order.
+func (s Shard) uploadParts(id string) ([]int, error) {
+	infos, err := btrfs.ReadDir(s.uploadDir(id))
+	if err != nil {
+		return nil, err
+	}
+	var parts []int
+	for _, info := range infos {
+		n, err := strconv.Atoi(info.Name())
+		if err != nil {
+			continue
+		}
+		parts = append(parts, n)
+	}
+	sort.Ints(parts)
+	return parts, nil
+}
+
+// isUpload returns true if r is part of a multipart upload.
+func isUpload(r *http.Request) bool {
+	_, uploads := r.URL.Query()["uploads"]
+	return uploads || r.URL.Query().Get("uploadId") != ""
+}
+
+// isComplete returns true if r completes a multipart upload.
+func isComplete(r *http.Request) bool {
+	_, complete := r.URL.Query()["complete"]
+	return complete && r.URL.Query().Get("uploadId") != "" && (r.Method == "POST" || r.Method == "PUT")
+}
+
+// findUpload returns the id of the upload r is part of. It writes an error
+// and returns false if there's no such upload.
+func (s Shard) findUpload(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.URL.Query().Get("uploadId")
+	if !validId(id) {
+		http.Error(w, fmt.Sprintf("Invalid uploadId %s.", id), 400)
+		return "", false
+	}
+	exists, err := btrfs.FileExists(s.uploadDir(id))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return "", false
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Upload %s not found.", id), 404)
+		return "", false
+	}
+	return id, true
+}
+
+// UploadHandler handles the multipart upload protocol for files on branch,
+// apart from completing uploads which FileHandler does, see completeUpload.
+func (s Shard) UploadHandler(w http.ResponseWriter, r *http.Request, branch string) {
+	if _, ok := r.URL.Query()["uploads"]; ok && r.Method == "POST" {
+		id := uuid.New()
+		if err := btrfs.MkdirAll(s.uploadDir(id)); err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		fmt.Fprintf(w, "%s\n", id)
+		return
+	}
+
+	id, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+	switch {
+	case r.Method == "GET":
+		parts, err := s.uploadParts(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		var msg []PartMsg
+		for _, n := range parts {
+			fi, err := btrfs.Stat(path.Join(s.uploadDir(id), strconv.Itoa(n)))
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				logError(r, err)
+				return
+			}
+			msg = append(msg, PartMsg{Part: n, Size: fi.Size()})
+		}
+		if err := json.NewEncoder(w).Encode(msg); err != nil {
+			logError(r, err)
+		}
+	case r.Method == "POST" || r.Method == "PUT":
+		n, err := strconv.Atoi(r.URL.Query().Get("part"))
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("Invalid part %s.", r.URL.Query().Get("part")), 400)
+			return
+		}
+		var size int64
+		err = timeOp(w, "btrfs.CreateFromReader", func() error {
+			var err error
+			size, err = btrfs.CreateFromReader(path.Join(s.uploadDir(id), strconv.Itoa(n)), r.Body)
+			return err
+		})
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		fmt.Fprintf(w, "Created part %d, size: %d.\n", n, size)
+	case r.Method == "DELETE":
+		if err := btrfs.RemoveAll(s.uploadDir(id)); err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		fmt.Fprintf(w, "Aborted upload %s.\n", id)
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
+
+// completeUpload turns r, which completes an upload, in to a POST of the
+// file whose body is the upload's parts in order. FileHandler then writes it
+// like any other file, so completing an upload is locked, checked and
+// limited like any other write. It writes an error and returns false if the
+// upload can't be completed, parts have to be numbered 1 to n with none
+// missing.
+func (s Shard) completeUpload(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := s.findUpload(w, r)
+	if !ok {
+		return "", false
+	}
+	parts, err := s.uploadParts(id)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return "", false
+	}
+	if len(parts) == 0 {
+		http.Error(w, fmt.Sprintf("Upload %s has no parts.", id), 400)
+		return "", false
+	}
+	var size int64
+	for i, n := range parts {
+		if n != i+1 {
+			http.Error(w, fmt.Sprintf("Upload %s is missing part %d.", id, i+1), 400)
+			return "", false
+		}
+		fi, err := btrfs.Stat(path.Join(s.uploadDir(id), strconv.Itoa(n)))
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return "", false
+		}
+		size += fi.Size()
+	}
+	// PUTs overwrite files in place, completing an upload always makes the
+	// file anew.
+	r.Method = "POST"
+	r.Body = &partsReader{dir: s.uploadDir(id), parts: parts}
+	r.ContentLength = size
+	return id, true
+}
+
+// partsReader reads an upload's parts one after another, keeping one open
+// at a time.
+type partsReader struct {
+	dir   string
+	parts []int
+	f     *os.File
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.f == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			f, err := btrfs.Open(path.Join(p.dir, strconv.Itoa(p.parts[0])))
+			if err != nil {
+				return 0, err
+			}
+			p.f, p.parts = f, p.parts[1:]
+		}
+		n, err := p.f.Read(b)
+		if err == io.EOF {
+			p.f.Close()
+			p.f = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.f == nil {
+		return nil
+	}
+	return p.f.Close()
+}
@@ -0,0 +1,178 @@
+package main
+
+// watch.go lets clients follow changes to part of a branch without diffing
+// every commit themselves:
+//
+//	GET /watch?branch=<branch>&prefix=<prefix>
+//
+// With Accept: text/event-stream it streams a server-sent event for every new
+// commit on the branch that changes a file under prefix. Otherwise it
+// long-polls, returning the first such commit as a WatchEventMsg, or a 204 if
+// there isn't one within ?timeout=, 30s by default. ?glob= narrows the files
+// watched like it does for /list.
+//
+// Clients that can't miss a change pass the last commit they've seen as
+// ?since=, if the files have changed between it and the branch's head that's
+// returned, or streamed, straight away. Streams that aren't keeping up miss
+// events like they do on /events.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+// defaultWatchTimeout is how long a long-polling /watch waits for a commit.
+const defaultWatchTimeout = 30 * time.Second
+
+// watchEvent describes the files match matches that changed between the
+// commits from and to, which is on branch. from can be "", for to's first
+// commit. ok is false if none of them changed.
+func (s Shard) watchEvent(branch, from, to string, match func(string) bool) (e WatchEventMsg, ok bool, err error) {
+	e = WatchEventMsg{Commit: to, Branch: branch, Parent: from}
+	if match == nil {
+		match = func(string) bool { return true }
+	}
+	if from == "" {
+		if e.Files, err = btrfs.ListFiles(s.dataRepo, to, match); err != nil {
+			return e, false, err
+		}
+		return e, len(e.Files) > 0, nil
+	}
+	files, err := btrfs.FindNew(s.dataRepo, from, to)
+	if err != nil {
+		return e, false, err
+	}
+	for _, file := range files {
+		if match(file) {
+			e.Files = append(e.Files, file)
+		}
+	}
+	deleted, err := btrfs.FindDeleted(s.dataRepo, from, to)
+	if err != nil {
+		return e, false, err
+	}
+	for _, file := range deleted {
+		if match(file) {
+			e.Deleted = append(e.Deleted, file)
+		}
+	}
+	return e, len(e.Files) > 0 || len(e.Deleted) > 0, nil
+}
+
+// WatchHandler streams, or long-polls for, the commits that change files
+// under a prefix.
+func (s Shard) WatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid method.", 405)
+		return
+	}
+	match, err := fileFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	timeout := defaultWatchTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid timeout %s.", t), 400)
+			return
+		}
+	}
+	branch := branchParam(r)
+	exists, err := btrfs.FileExists(path.Join(s.dataRepo, branch))
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Branch %s not found.", branch), 404)
+		return
+	}
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	var flusher http.Flusher
+	if stream {
+		var ok bool
+		if flusher, ok = w.(http.Flusher); !ok {
+			http.Error(w, "Streaming unsupported.", 500)
+			return
+		}
+	}
+
+	// We subscribe before looking at since so that commits made in between
+	// aren't missed.
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	send := func(e WatchEventMsg) bool {
+		data, err := json.Marshal(e)
+		if err != nil {
+			logError(r, err)
+			return false
+		}
+		if !stream {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(append(data, '\n'))
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: change\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		if head := btrfs.Head(s.dataRepo, branch); head != "" && head != since {
+			e, ok, err := s.watchEvent(branch, since, head, match)
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+			if ok && !send(e) {
+				return
+			}
+		}
+	}
+	if stream {
+		flusher.Flush()
+	}
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	var expired <-chan time.Time
+	if !stream {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case c := <-events:
+			if c.Branch != branch {
+				continue
+			}
+			e, ok, err := s.watchEvent(branch, c.Parent, c.Name, match)
+			if err != nil {
+				logError(r, err)
+				continue
+			}
+			if ok && !send(e) {
+				return
+			}
+		case <-expired:
+			w.WriteHeader(204)
+			return
+		case <-closed:
+			return
+		}
+	}
+}
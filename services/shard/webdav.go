@@ -0,0 +1,324 @@
+package main
+
+// webdav.go serves the data repo over WebDAV so that branches and commits can
+// be mounted from Finder or Explorer:
+//
+//	/dav/                  lists branches and commits
+//	/dav/<ref>/<path>      a file or directory in a branch or commit
+//
+// /dav/<from>..<to>/ is what changed between two commits, see diffview.go.
+//
+// It supports enough of WebDAV class 2 for the common clients: OPTIONS,
+// PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE, LOCK and UNLOCK. Commits are
+// read-only. Locks are granted to anyone who asks and aren't enforced, they
+// only exist because clients won't write without them. Like the rest of the
+// shard's API it only sees the files this shard has, in a cluster writes to
+// files owned by other shards are rejected.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/pachyderm/pfs/lib/btrfs"
+	"github.com/pachyderm/pfs/lib/route"
+)
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davProp struct {
+	DisplayName      string          `xml:"D:displayname"`
+	ResourceType     davResourceType `xml:"D:resourcetype"`
+	GetContentLength string          `xml:"D:getcontentlength,omitempty"`
+	GetLastModified  string          `xml:"D:getlastmodified"`
+}
+
+type davPropStat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	PropStat davPropStat `xml:"D:propstat"`
+}
+
+type davMultiStatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Xmlns     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+func davEntry(href string, fi os.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:     fi.Name(),
+		GetLastModified: fi.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if fi.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+		if !strings.HasSuffix(href, "/") {
+			href += "/"
+		}
+	} else {
+		prop.GetContentLength = fmt.Sprint(fi.Size())
+	}
+	return davResponse{Href: (&url.URL{Path: href}).EscapedPath(), PropStat: davPropStat{Prop: prop, Status: "HTTP/1.1 200 OK"}}
+}
+
+// davPath splits a /dav/ url in to the ref and the path within it, both
+// may be "".
+func davPath(p string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean(p), "/dav"), "/", 3)
+	// parts looks like [], [, <ref>] or [, <ref>, <file>]
+	ref, file := "", ""
+	if len(parts) > 1 {
+		ref = parts[1]
+	}
+	if len(parts) > 2 {
+		file = parts[2]
+	}
+	return ref, file
+}
+
+// rejectDavWrite rejects writes to commits and to files that belong to other
+// shards.
+func (s Shard) rejectDavWrite(w http.ResponseWriter, ref, file string) bool {
+	if s.rejectWrite(w) {
+		return true
+	}
+	if ref == "" || file == "" {
+		http.Error(w, "Only files and directories in branches can be changed.", 403)
+		return true
+	}
+	readOnly, err := btrfs.IsReadOnly(path.Join(s.dataRepo, ref))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Branch %s not found.", ref), 404)
+		return true
+	}
+	if readOnly {
+		http.Error(w, fmt.Sprintf("%s is a commit, commits can't be changed.", ref), 403)
+		return true
+	}
+	if s.modulos > 1 {
+		if owner := route.Owner(path.Join("/file", file), s.modulos); owner != s.shard {
+			http.Error(w, fmt.Sprintf("%s belongs to shard %d-%d, this is shard %d-%d.", file, owner, s.modulos, s.shard, s.modulos), 421)
+			return true
+		}
+	}
+	return false
+}
+
+func (s Shard) davPropfind(w http.ResponseWriter, r *http.Request, ref, file string) {
+	name := path.Join(s.dataRepo, ref, file)
+	fi, err := btrfs.Stat(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	href := path.Join("/dav", ref, file)
+	ms := davMultiStatus{Xmlns: "DAV:", Responses: []davResponse{davEntry(href, fi)}}
+	if fi.IsDir() && r.Header.Get("Depth") != "0" {
+		infos, err := btrfs.ReadDir(name)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		for _, info := range infos {
+			// Hidden files hold metadata and in progress requests.
+			if strings.HasPrefix(info.Name(), ".") {
+				continue
+			}
+			ms.Responses = append(ms.Responses, davEntry(path.Join(href, info.Name()), info))
+		}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		logError(r, err)
+	}
+}
+
+func (s Shard) davPut(w http.ResponseWriter, r *http.Request, ref, file string) {
+	name := path.Join(s.dataRepo, ref, file)
+	l, err := s.newWriteLimiter(ref)
+	var body io.Reader
+	if err == nil {
+		body, err = l.file(file, 0, r.ContentLength, r.Body)
+	}
+	if isLimitError(err) {
+		httpError(w, r, err)
+		return
+	}
+	var exists bool
+	if err == nil {
+		exists, err = btrfs.FileExists(name)
+	}
+	if err == nil {
+		if err = btrfs.MkdirAll(path.Dir(name)); err == nil {
+			_, err = createFile(name, body)
+		}
+	}
+	if isLimitError(err) {
+		// Don't leave the part that fit behind.
+		btrfs.Remove(name)
+		httpError(w, r, err)
+		return
+	}
+	if btrfs.IsQuotaExceeded(err) {
+		// 507 is Insufficient Storage
+		http.Error(w, err.Error(), 507)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if exists {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(201)
+	}
+}
+
+func (s Shard) davMove(w http.ResponseWriter, r *http.Request, ref, file string) {
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	destRef, destFile := davPath(dest.Path)
+	if destRef != ref {
+		http.Error(w, "Files can only be moved within a branch.", 502)
+		return
+	}
+	if s.rejectDavWrite(w, destRef, destFile) {
+		return
+	}
+	// Moves change both files.
+	l, err := s.newWriteLimiter(ref)
+	if err == nil {
+		_, err = l.file(file, 0, 0, nil)
+	}
+	if err == nil {
+		_, err = l.file(destFile, 0, 0, nil)
+	}
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+	to := path.Join(s.dataRepo, destRef, destFile)
+	exists, err := btrfs.FileExists(to)
+	if err == nil && exists {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, fmt.Sprintf("%s already exists.", destFile), 412)
+			return
+		}
+		err = btrfs.RemoveAll(to)
+	}
+	if err == nil {
+		err = btrfs.MkdirAll(path.Dir(to))
+	}
+	if err == nil {
+		err = btrfs.Rename(path.Join(s.dataRepo, ref, file), to)
+	}
+	if os.IsNotExist(err) {
+		http.Error(w, "404 page not found", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		logError(r, err)
+		return
+	}
+	if exists {
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(201)
+	}
+}
+
+func davLock(w http.ResponseWriter, r *http.Request) {
+	token := "opaquelocktoken:" + uuid.New()
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	fmt.Fprintf(w, `%s<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>0</D:depth><D:timeout>Second-%d</D:timeout>`+
+		`<D:locktoken><D:href>%s</D:href></D:locktoken>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`, xml.Header, int(time.Hour/time.Second), token)
+}
+
+// DavHandler serves the data repo over WebDAV.
+func (s Shard) DavHandler(w http.ResponseWriter, r *http.Request) {
+	ref, file := davPath(r.URL.Path)
+	if from, to, ok := s.diffRef(ref); ok {
+		s.davDiff(w, r, ref, from, to, file)
+		return
+	}
+	switch r.Method {
+	case "PUT", "DELETE", "MKCOL", "MOVE":
+		if s.rejectDavWrite(w, ref, file) {
+			return
+		}
+		// Like /file writes, hold the branch's shared lock so a commit never
+		// snapshots a write part way through.
+		lock, err := btrfs.RLockBranch(s.dataRepo, ref)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		defer lock.Unlock()
+	}
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE, LOCK, UNLOCK")
+	case "PROPFIND":
+		s.davPropfind(w, r, ref, file)
+	case "GET", "HEAD":
+		serveFile(w, r, path.Join(s.dataRepo, btrfs.Resolve(s.dataRepo, ref), file))
+	case "PUT":
+		s.davPut(w, r, ref, file)
+	case "DELETE":
+		if err := btrfs.RemoveAll(path.Join(s.dataRepo, ref, file)); err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		w.WriteHeader(204)
+	case "MKCOL":
+		if err := btrfs.Mkdir(path.Join(s.dataRepo, ref, file)); os.IsExist(err) {
+			http.Error(w, fmt.Sprintf("%s already exists.", file), 405)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		w.WriteHeader(201)
+	case "MOVE":
+		s.davMove(w, r, ref, file)
+	case "LOCK":
+		davLock(w, r)
+	case "UNLOCK":
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}
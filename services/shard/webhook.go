@@ -0,0 +1,277 @@
+package main
+
+// webhook.go lets users register urls that are told about new commits:
+//
+//	POST   /webhook         registers a webhook, the body is a WebhookMsg
+//	GET    /webhook         lists webhooks and how their last delivery went
+//	DELETE /webhook/<name>  removes a webhook
+//
+// Every commit that lands on this shard, whether it was made locally or
+// arrived via replication, is POSTed as a WebhookEventMsg to the webhooks
+// that want it. Webhooks with a branch only hear about that branch's commits.
+// If a webhook has a secret its deliveries carry an X-Pfs-Signature header,
+// "sha256=" followed by the hex HMAC-SHA256 of the body keyed with the secret,
+// so receivers can check they came from us. Failed deliveries are retried
+// with backoff. Webhooks are recorded in the volume so that they survive
+// restarts.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pachyderm/pfs/lib/btrfs"
+)
+
+const (
+	webhookAttempts = 5
+	webhookTimeout  = 10 * time.Second
+)
+
+// webhookBackoff is how long we wait before retrying a failed delivery, it
+// doubles with each attempt.
+var webhookBackoff = time.Second
+
+var errWebhookNotFound = fmt.Errorf("Webhook not found.")
+
+type webhookSet struct {
+	// lock guards the webhooks file.
+	lock sync.Mutex
+}
+
+func newWebhookSet() *webhookSet {
+	return &webhookSet{}
+}
+
+func (s Shard) webhooksFile() string {
+	return path.Join("webhooks", s.dataRepo)
+}
+
+// loadWebhooks reads our webhooks from disk, callers must hold the lock.
+func (s Shard) loadWebhooks() ([]WebhookMsg, error) {
+	exists, err := btrfs.FileExists(s.webhooksFile())
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := btrfs.ReadFile(s.webhooksFile())
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []WebhookMsg
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// saveWebhooks writes our webhooks to disk, callers must hold the lock.
+func (s Shard) saveWebhooks(webhooks []WebhookMsg) error {
+	data, err := json.Marshal(webhooks)
+	if err != nil {
+		return err
+	}
+	if err := btrfs.MkdirAll(path.Dir(s.webhooksFile())); err != nil {
+		return err
+	}
+	return btrfs.WriteFile(s.webhooksFile(), data)
+}
+
+// signature returns the value of the X-Pfs-Signature header for body.
+func signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs body to webhook, it returns an error unless the webhook
+// responds with a 2xx.
+func deliver(webhook WebhookMsg, body []byte) error {
+	req, err := http.NewRequest("POST", webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pfs-Event", "commit")
+	if webhook.Secret != "" {
+		req.Header.Set("X-Pfs-Signature", signature(webhook.Secret, body))
+	}
+	client := http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with status: %s", webhook.Url, resp.Status)
+	}
+	return nil
+}
+
+// deliverWithRetries delivers body to webhook, retrying with backoff, and
+// records how it went.
+func (s Shard) deliverWithRetries(webhook WebhookMsg, body []byte) {
+	var err error
+	backoff := webhookBackoff
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = deliver(webhook, body); err == nil {
+			break
+		}
+		logger.Warn("delivering to webhook", "webhook", webhook.Name, "err", err)
+	}
+	s.webhooks.lock.Lock()
+	defer s.webhooks.lock.Unlock()
+	webhooks, loadErr := s.loadWebhooks()
+	if loadErr != nil {
+		logger.Error("loading webhooks", "err", loadErr)
+		return
+	}
+	for i := range webhooks {
+		// The webhook may have been removed, or replaced, while we were
+		// delivering to it.
+		if webhooks[i].Name != webhook.Name || webhooks[i].Url != webhook.Url {
+			continue
+		}
+		webhooks[i].LastDeliveryTime = time.Now().Format("2006-01-02T15:04:05.999999-07:00")
+		webhooks[i].LastError = ""
+		if err != nil {
+			webhooks[i].LastError = err.Error()
+		}
+	}
+	if err := s.saveWebhooks(webhooks); err != nil {
+		logger.Error("saving webhooks", "err", err)
+	}
+}
+
+// notifyWebhooks tells the webhooks that want it about e.
+func (s Shard) notifyWebhooks(e CommitEventMsg) {
+	s.webhooks.lock.Lock()
+	webhooks, err := s.loadWebhooks()
+	s.webhooks.lock.Unlock()
+	if err != nil {
+		logger.Error("loading webhooks", "err", err)
+		return
+	}
+	body, err := json.Marshal(WebhookEventMsg{
+		Repo:   s.dataRepo,
+		Branch: e.Branch,
+		Commit: e.Name,
+		Parent: e.Parent,
+		Files:  e.Files,
+	})
+	if err != nil {
+		logger.Error("encoding webhook body", "commit", e.Name, "err", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if webhook.Branch != "" && webhook.Branch != e.Branch {
+			continue
+		}
+		go s.deliverWithRetries(webhook, body)
+	}
+}
+
+// WebhookHandler manages our webhooks.
+func (s Shard) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	url := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	// url looks like [, webhook] or [, webhook, <name>]
+	switch {
+	case len(url) == 2 && r.Method == "GET":
+		s.webhooks.lock.Lock()
+		webhooks, err := s.loadWebhooks()
+		s.webhooks.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		if webhooks == nil {
+			webhooks = []WebhookMsg{}
+		}
+		// Secrets are write only.
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		if err := json.NewEncoder(w).Encode(webhooks); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 2 && r.Method == "POST":
+		var webhook WebhookMsg
+		if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if webhook.Name == "" || strings.Contains(webhook.Name, "/") {
+			http.Error(w, "Webhooks need a name without slashes.", 400)
+			return
+		}
+		if !strings.HasPrefix(webhook.Url, "http://") && !strings.HasPrefix(webhook.Url, "https://") {
+			http.Error(w, fmt.Sprintf("Unsupported webhook url %s, urls must start with http:// or https://.", webhook.Url), 400)
+			return
+		}
+		webhook = WebhookMsg{Name: webhook.Name, Url: webhook.Url, Branch: webhook.Branch, Secret: webhook.Secret}
+		s.webhooks.lock.Lock()
+		webhooks, err := s.loadWebhooks()
+		if err == nil {
+			// Registering a webhook with an existing name replaces it.
+			var kept []WebhookMsg
+			for _, existing := range webhooks {
+				if existing.Name != webhook.Name {
+					kept = append(kept, existing)
+				}
+			}
+			err = s.saveWebhooks(append(kept, webhook))
+		}
+		s.webhooks.lock.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		webhook.Secret = ""
+		if err := json.NewEncoder(w).Encode(webhook); err != nil {
+			logError(r, err)
+		}
+	case len(url) == 3 && r.Method == "DELETE":
+		s.webhooks.lock.Lock()
+		webhooks, err := s.loadWebhooks()
+		if err == nil {
+			err = errWebhookNotFound
+			var kept []WebhookMsg
+			for _, existing := range webhooks {
+				if existing.Name == url[2] {
+					err = nil
+				} else {
+					kept = append(kept, existing)
+				}
+			}
+			if err == nil {
+				err = s.saveWebhooks(kept)
+			}
+		}
+		s.webhooks.lock.Unlock()
+		if err == errWebhookNotFound {
+			http.Error(w, fmt.Sprintf("Webhook %s not found.", url[2]), 404)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			logError(r, err)
+			return
+		}
+		fmt.Fprintf(w, "Deleted webhook %s.\n", url[2])
+	default:
+		http.Error(w, "Invalid method.", 405)
+	}
+}